@@ -0,0 +1,156 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// ACU link states
+const (
+	linkConnected = "connected"
+	linkDegraded  = "degraded" // recent errors, slow, or frozen status
+	linkDown      = "down"     // no response
+)
+
+const (
+	linkDownFailures = 3 // consecutive failed requests
+
+	linkDegradedAge = 2 * time.Second // since the last response
+	linkDownAge     = 5 * time.Second
+	linkFrozenAge   = 3 * time.Second // of an unchanging ACU status time
+
+	// while down, status polls fail fast except for reconnection attempts,
+	// backing off exponentially
+	linkMinBackoff = 500 * time.Millisecond
+	linkMaxBackoff = 30 * time.Second
+)
+
+var errACUDown = errors.New("ACU link down")
+
+// ACULinkStatus is the health of the ACU link.
+type ACULinkStatus struct {
+	State         string  `json:"state"`
+	LastPacketAge float64 `json:"last_packet_age"` // since the last response [s], -1 if none
+	Failures      int     `json:"consecutive_failures"`
+	LastError     string  `json:"last_error,omitempty"`
+	Frozen        bool    `json:"frozen"` // the ACU status time isn't advancing
+	Reconnects    int     `json:"reconnects"`
+}
+
+// An ACULink tracks the health of the link to the ACU, from the outcome
+// of every request. It is safe for concurrent use.
+type ACULink struct {
+	mu        sync.Mutex
+	lastOK    time.Time
+	failures  int
+	lastErr   error
+	wasDown   bool
+	reconnect func() // drops the idle connections
+
+	// ACU status time, and when it last changed
+	statusTime, statusChanged time.Time
+
+	backoff    time.Duration
+	nextProbe  time.Time
+	reconnects int
+}
+
+func NewACULink(reconnect func()) *ACULink {
+	return &ACULink{reconnect: reconnect, backoff: linkMinBackoff}
+}
+
+// ok records a response at now.
+func (l *ACULink) ok(now time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.wasDown {
+		l.reconnects++
+		l.wasDown = false
+	}
+	l.lastOK, l.failures, l.lastErr = now, 0, nil
+	l.backoff, l.nextProbe = linkMinBackoff, time.Time{}
+}
+
+// fail records a request with no valid response at now, and drops
+// the connections so the next request reconnects.
+func (l *ACULink) fail(now time.Time, err error) {
+	l.mu.Lock()
+	l.failures++
+	l.lastErr = err
+	if l.state(now) == linkDown {
+		l.wasDown = true
+	}
+	l.mu.Unlock()
+	if l.reconnect != nil {
+		l.reconnect()
+	}
+}
+
+// statusAt records the time in an ACU status received at now.
+func (l *ACULink) statusAt(now, acuTime time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if !acuTime.Equal(l.statusTime) || l.statusChanged.IsZero() {
+		l.statusTime, l.statusChanged = acuTime, now
+	}
+}
+
+// allow checks if a status poll should be sent at now: always, unless
+// the link is down and it's not yet time to try reconnecting.
+func (l *ACULink) allow(now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.state(now) != linkDown {
+		return true
+	}
+	if now.Before(l.nextProbe) {
+		return false
+	}
+	l.nextProbe = now.Add(l.backoff)
+	l.backoff *= 2
+	if l.backoff > linkMaxBackoff {
+		l.backoff = linkMaxBackoff
+	}
+	return true
+}
+
+func (l *ACULink) frozen(now time.Time) bool {
+	return !l.statusChanged.IsZero() && now.Sub(l.statusChanged) > linkFrozenAge
+}
+
+func (l *ACULink) state(now time.Time) string {
+	age := now.Sub(l.lastOK)
+	switch {
+	case l.failures >= linkDownFailures, l.failures > 0 && (l.lastOK.IsZero() || age > linkDownAge):
+		return linkDown
+	case l.failures > 0, age > linkDegradedAge, l.frozen(now):
+		return linkDegraded
+	}
+	return linkConnected
+}
+
+// Status returns the link health at now.
+func (l *ACULink) Status(now time.Time) ACULinkStatus {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	s := ACULinkStatus{
+		State:         l.state(now),
+		LastPacketAge: -1,
+		Failures:      l.failures,
+		Frozen:        l.frozen(now),
+		Reconnects:    l.reconnects,
+	}
+	if !l.lastOK.IsZero() {
+		s.LastPacketAge = now.Sub(l.lastOK).Seconds()
+	}
+	if l.lastErr != nil {
+		s.LastError = l.lastErr.Error()
+	}
+	return s
+}
+
+func (s ACULinkStatus) String() string {
+	return fmt.Sprintf("ACU link %s, last response %.1f seconds ago, %d failures", s.State, s.LastPacketAge, s.Failures)
+}
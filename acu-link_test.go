@@ -0,0 +1,56 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestACULink(t *testing.T) {
+	reconnects := 0
+	l := NewACULink(func() { reconnects++ })
+	t0 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	at := func(s float64) time.Time { return t0.Add(Seconds2Duration(s)) }
+
+	l.ok(at(0))
+	l.statusAt(at(0), at(0))
+	if s := l.Status(at(1)); s.State != linkConnected || s.LastPacketAge != 1 {
+		t.Errorf("got %+v, expected connected", s)
+	}
+
+	// frozen status time
+	l.ok(at(4))
+	l.statusAt(at(4), at(0))
+	if s := l.Status(at(4)); s.State != linkDegraded || !s.Frozen {
+		t.Errorf("got %+v, expected degraded and frozen", s)
+	}
+	l.statusAt(at(4.1), at(4.1))
+
+	err := errors.New("timeout")
+	l.fail(at(4.5), err)
+	if s := l.Status(at(4.5)); s.State != linkDegraded || s.LastError != "timeout" || reconnects != 1 {
+		t.Errorf("got %+v, %d reconnects, expected degraded", s, reconnects)
+	}
+	l.fail(at(5), err)
+	l.fail(at(5.5), err)
+	if s := l.Status(at(5.5)); s.State != linkDown || s.Failures != 3 {
+		t.Errorf("got %+v, expected down", s)
+	}
+
+	// polls back off while down
+	var allowed []float64
+	for s := 5.5; s < 10; s += 0.1 {
+		if l.allow(at(s)) {
+			allowed = append(allowed, s)
+		}
+	}
+	if len(allowed) != 4 || allowed[1]-allowed[0] < 0.49 || allowed[2]-allowed[1] < 0.99 {
+		t.Errorf("polls allowed at %v, expected backoff", allowed)
+	}
+
+	l.ok(at(10))
+	l.statusAt(at(10), at(10))
+	if s := l.Status(at(10)); s.State != linkConnected || s.Reconnects != 1 || s.LastError != "" || !l.allow(at(10)) {
+		t.Errorf("got %+v, expected reconnected", s)
+	}
+}
@@ -0,0 +1,216 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+// Engineers send raw ACU requests (mode changes, servo resets, parameter
+// writes) through the TCS, on its connection, rather than with a tool of
+// their own. Every request and response goes in the audit log.
+
+const (
+	auditLogLen      = 1000 // recent entries kept for /acu/raw/audit
+	auditResponseMax = 4096 // bytes of each response recorded
+)
+
+// An acuRawRequest is an engineering request for the ACU.
+type acuRawRequest struct {
+	Admin  bool              `json:"admin"`  // the admin port, e.g. for parameter writes
+	Method string            `json:"method"` // GET or POST (default GET)
+	Path   string            `json:"path"`   // with the query, e.g. /Command?identifier=...
+	Values map[string]string `json:"values"` // form values, for POSTs
+}
+
+func (r *acuRawRequest) Check() error {
+	switch r.Method {
+	case "":
+		r.Method = "GET"
+	case "GET", "POST":
+	default:
+		return fmt.Errorf("bad method %q: expected GET or POST", r.Method)
+	}
+	if !strings.HasPrefix(r.Path, "/") {
+		return fmt.Errorf("bad path %q: expected /...", r.Path)
+	}
+	if r.Method == "GET" && len(r.Values) > 0 {
+		return fmt.Errorf("values need POST")
+	}
+	return nil
+}
+
+func (r acuRawRequest) values() url.Values {
+	values := url.Values{}
+	for k, v := range r.Values {
+		values.Set(k, v)
+	}
+	return values
+}
+
+// An AuditEntry records an engineering request and the ACU's response.
+type AuditEntry struct {
+	Time     time.Time         `json:"time"`
+	User     string            `json:"user,omitempty"` // if authenticated
+	Remote   string            `json:"remote"`
+	Admin    bool              `json:"admin,omitempty"`
+	Method   string            `json:"method"`
+	Path     string            `json:"path"`
+	Values   map[string]string `json:"values,omitempty"`
+	Response string            `json:"response,omitempty"` // truncated; hex if binary
+	Error    string            `json:"error,omitempty"`
+	Duration float64           `json:"duration"` // [s]
+}
+
+// auditResponse is a response as recorded.
+func auditResponse(b []byte) string {
+	n := len(b)
+	if n > auditResponseMax {
+		b = b[:auditResponseMax]
+	}
+	var s string
+	if isText(b) {
+		s = string(b)
+	} else {
+		s = "hex:" + hex.EncodeToString(b)
+	}
+	if n > len(b) {
+		s += fmt.Sprintf("... (%d bytes)", n)
+	}
+	return s
+}
+
+// isText returns true for UTF-8 without control characters, besides
+// whitespace.
+func isText(b []byte) bool {
+	for _, c := range b {
+		if c < 0x20 && c != '\t' && c != '\n' && c != '\r' || c == 0x7f {
+			return false
+		}
+	}
+	return utf8.Valid(b)
+}
+
+// An AuditLog appends entries to a file of JSON lines, if any, and keeps
+// the recent ones. It is safe for concurrent use.
+type AuditLog struct {
+	mu     sync.Mutex
+	out    io.Writer
+	recent []AuditEntry // ring buffer
+	next   int
+}
+
+// OpenAuditLog opens the audit log, appending to filename, if not "".
+func OpenAuditLog(filename string) (*AuditLog, error) {
+	l := &AuditLog{}
+	if filename != "" {
+		f, err := os.OpenFile(filename, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return nil, err
+		}
+		l.out = f
+	}
+	return l, nil
+}
+
+func (l *AuditLog) Record(e AuditEntry) {
+	who, result := e.Remote, "ok"
+	if e.User != "" {
+		who = e.User + "@" + e.Remote
+	}
+	if e.Error != "" {
+		result = e.Error
+	}
+	log.Printf("audit: %s: %s %s: %s", who, e.Method, e.Path, result)
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.recent) < auditLogLen {
+		l.recent = append(l.recent, e)
+	} else {
+		l.recent[l.next] = e
+	}
+	l.next = (l.next + 1) % auditLogLen
+	if l.out != nil {
+		b, _ := json.Marshal(&e)
+		_, err := l.out.Write(append(b, '\n'))
+		if err != nil {
+			log.Printf("audit log: %v", err)
+		}
+	}
+}
+
+// Recent returns the recent entries, oldest first.
+func (l *AuditLog) Recent() []AuditEntry {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.recent) < auditLogLen {
+		return append([]AuditEntry(nil), l.recent...)
+	}
+	return append(append([]AuditEntry(nil), l.recent[l.next:]...), l.recent[:l.next]...)
+}
+
+// serveACURaw serves raw ACU requests, recording them in the audit log.
+func serveACURaw(mux *http.ServeMux, acu *ACU, auditLog *AuditLog) {
+	mux.HandleFunc("/acu/raw", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x acuRawRequest
+		err := json.NewDecoder(req.Body).Decode(&x)
+		if err == nil {
+			err = x.Check()
+		}
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		e := AuditEntry{
+			Time:   time.Now().UTC(),
+			Remote: req.RemoteAddr,
+			Admin:  x.Admin,
+			Method: x.Method,
+			Path:   x.Path,
+			Values: x.Values,
+		}
+		if p := principalFrom(req.Context()); p != nil {
+			e.User = p.Name
+		}
+		b, err := acu.Raw(x.Admin, x.Method, x.Path, x.values())
+		e.Duration = time.Since(e.Time).Seconds()
+		e.Response = auditResponse(b)
+		if err != nil {
+			e.Error = err.Error()
+		}
+		auditLog.Record(e)
+		if err != nil {
+			jsonResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/octet-stream")
+		w.Write(b)
+	})
+
+	mux.HandleFunc("/acu/raw/audit", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := json.NewEncoder(w).Encode(auditLog.Recent())
+		if err != nil {
+			log.Print(err)
+		}
+	})
+}
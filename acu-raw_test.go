@@ -0,0 +1,76 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestACURaw(t *testing.T) {
+	_, acu, _ := newTestSimulator(t, 100, 40)
+	for _, r := range []acuRawRequest{
+		{Method: "PUT", Path: "/Command"},
+		{Path: "Command"},
+		{Path: "/Command", Values: map[string]string{"a": "b"}},
+	} {
+		if r.Check() == nil {
+			t.Errorf("%+v: expected error", r)
+		}
+	}
+	r := acuRawRequest{Path: "/Command?identifier=DataSets.CmdModeTransfer&command=Stop"}
+	if err := r.Check(); err != nil || r.Method != "GET" {
+		t.Fatalf("got %v, method %q", err, r.Method)
+	}
+	if _, err := acu.Raw(r.Admin, r.Method, r.Path, r.values()); err != nil {
+		t.Error(err)
+	}
+	if _, err := acu.Raw(false, "GET", "/Command?identifier=bogus&command=x", nil); err == nil {
+		t.Error("expected the ACU to fail")
+	}
+}
+
+func TestAuditLog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "audit.jsonl")
+	l, err := OpenAuditLog(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < auditLogLen+2; i++ {
+		l.Record(AuditEntry{User: "carol", Method: "GET", Path: "/Command", Duration: float64(i)})
+	}
+	recent := l.Recent()
+	if len(recent) != auditLogLen || recent[0].Duration != 2 || recent[auditLogLen-1].Duration != auditLogLen+1 {
+		t.Errorf("got %d entries, %+v first", len(recent), recent[0])
+	}
+
+	f, err := os.Open(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var n int
+	for s := bufio.NewScanner(f); s.Scan(); n++ {
+		var e AuditEntry
+		if err := json.Unmarshal(s.Bytes(), &e); err != nil || e.User != "carol" {
+			t.Fatalf("line %d: got %+v, %v", n, e, err)
+		}
+	}
+	if n != auditLogLen+2 {
+		t.Errorf("got %d lines, expected %d", n, auditLogLen+2)
+	}
+
+	for _, b := range [][]byte{{0xff, 1}, {0, 0}} {
+		if s := auditResponse(b); !strings.HasPrefix(s, "hex:") {
+			t.Errorf("got %q, expected hex", s)
+		}
+	}
+	if s := auditResponse([]byte("OK\n")); s != "OK\n" {
+		t.Errorf("got %q", s)
+	}
+	if s := auditResponse([]byte(strings.Repeat("x", auditResponseMax+1))); !strings.HasSuffix(s, "x... (4097 bytes)") {
+		t.Errorf("got %q", s[len(s)-20:])
+	}
+}
@@ -0,0 +1,475 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// An ACUSimulator speaks enough of the ACU's HTTP protocol for the TCS:
+// mode changes, presets, program track uploads, the status datasets,
+// and the position broadcast. Each axis follows its commanded position
+// within its speed, acceleration, and jerk limits.
+type ACUSimulator struct {
+	now func() time.Time // for tests
+
+	mu       sync.Mutex
+	t        time.Time // simulation time
+	axes     [2]simAxis
+	rotator  simAxis
+	preset   [2]float64
+	stack    []simPoint // program track, by time
+	stowPins bool
+	trackErr bool // last upload had points out of range
+
+	// position broadcast
+	broadcastDest string
+	broadcastPort string
+	broadcast     net.Conn // if enabled
+	samples       []broadcastSample
+	nextSample    time.Time
+}
+
+type simPoint struct {
+	t        time.Time
+	pos, vel [2]float64
+}
+
+const (
+	simModeStop = iota
+	simModePreset
+	simModeProgramTrack
+)
+
+const (
+	// simulation time step
+	simStep = time.Millisecond
+
+	// how often Run advances the simulation, sending the position
+	// broadcast packets due
+	simTick = 50 * time.Millisecond
+
+	// position broadcast sample interval, 200 Hz
+	simBroadcastInterval = 5 * time.Millisecond
+)
+
+type simAxis struct {
+	mode                       int
+	pos, vel, acc              float64
+	commanded                  float64
+	min, max, vmax, amax, jmax float64
+}
+
+func NewACUSimulator(az, el float64) *ACUSimulator {
+	sim := &ACUSimulator{now: time.Now}
+	sim.t = sim.now()
+	sim.axes[0] = simAxis{pos: az, commanded: az, min: azimuthMin, max: azimuthMax,
+		vmax: azimuthSpeedMax, amax: azimuthAccelMax, jmax: azimuthJerkMax}
+	sim.axes[1] = simAxis{pos: el, commanded: el, min: elevationMin, max: elevationMax,
+		vmax: elevationSpeedMax, amax: elevationAccelMax, jmax: elevationJerkMax}
+	sim.rotator = simAxis{min: rotatorMin, max: rotatorMax,
+		vmax: rotatorSpeedMax, amax: rotatorSpeedMax, jmax: 10 * rotatorSpeedMax}
+	return sim
+}
+
+// step moves the axis toward pos (moving at vel) for dt seconds.
+func (a *simAxis) step(dt, pos, vel float64) {
+	// approach the target fast, but slow enough to stop in time
+	const gain = 1.0 // [1/s]
+	e := pos - a.pos
+	corr := math.Min(gain*math.Abs(e), math.Sqrt(a.amax*math.Abs(e)))
+	vdes := math.Max(-a.vmax, math.Min(a.vmax, vel+math.Copysign(corr, e)))
+
+	// likewise for the velocity, so the acceleration winds down in time
+	const tau = 0.05 // [s]
+	dv := vdes - a.vel
+	ades := math.Min(a.amax, math.Min(math.Abs(dv)/tau, math.Sqrt(a.jmax*math.Abs(dv))))
+	ades = math.Copysign(ades, dv)
+	dj := a.jmax * dt
+	a.acc += math.Max(-dj, math.Min(dj, ades-a.acc))
+
+	a.vel = math.Max(-a.vmax, math.Min(a.vmax, a.vel+a.acc*dt))
+	a.pos += a.vel * dt
+	if a.pos < a.min || a.pos > a.max { // hit the limit switch
+		a.pos = math.Max(a.min, math.Min(a.max, a.pos))
+		a.vel, a.acc = 0, 0
+	}
+}
+
+// advance runs the simulation up to now.
+func (sim *ACUSimulator) advance() {
+	now := sim.now()
+	if now.Sub(sim.t) > time.Minute {
+		sim.t = now.Add(-time.Minute) // don't spin forever after a pause
+	}
+	dt := simStep.Seconds()
+	for ; sim.t.Before(now); sim.t = sim.t.Add(simStep) {
+		var pos, vel [2]float64
+		tracking := false
+		if sim.axes[0].mode == simModeProgramTrack || sim.axes[1].mode == simModeProgramTrack {
+			pos, vel, tracking = sim.track(sim.t)
+		}
+		for i := range sim.axes {
+			a := &sim.axes[i]
+			switch {
+			case a.mode == simModePreset:
+				a.commanded = sim.preset[i]
+				a.step(dt, a.commanded, 0)
+			case a.mode == simModeProgramTrack && tracking:
+				a.commanded = pos[i]
+				a.step(dt, pos[i], vel[i])
+			default: // stop, or waiting for the track to start
+				a.commanded = a.pos
+				a.step(dt, a.pos+a.vel*a.vel/(2*a.amax)*math.Copysign(1, a.vel), 0)
+			}
+		}
+		r := &sim.rotator
+		if r.mode == simModePreset {
+			r.step(dt, r.commanded, 0)
+		} else {
+			r.step(dt, r.pos, 0)
+		}
+		if sim.broadcast != nil && !sim.t.Before(sim.nextSample) {
+			sim.sample()
+			sim.nextSample = sim.nextSample.Add(simBroadcastInterval)
+		}
+	}
+
+	// drop the points we're done with, keeping one to interpolate from
+	i := sort.Search(len(sim.stack), func(i int) bool { return sim.stack[i].t.After(sim.t) })
+	if i > 1 {
+		sim.stack = sim.stack[i-1:]
+	}
+}
+
+// Run advances the simulation in real time, so the position broadcast,
+// if enabled, is sent at its normal rate.
+func (sim *ACUSimulator) Run() {
+	for range time.Tick(simTick) {
+		sim.mu.Lock()
+		sim.advance()
+		sim.mu.Unlock()
+	}
+}
+
+// sample adds the current position to the position broadcast,
+// sending a packet once it's full.
+func (sim *ACUSimulator) sample() {
+	doy, tod := VertexTime(sim.t)
+	az, el, rot := sim.axes[0].pos, sim.axes[1].pos, sim.rotator.pos
+	sim.samples = append(sim.samples, broadcastSample{
+		Day:          doy,
+		Time:         tod / (24 * 60 * 60),
+		Azimuth:      az,
+		Elevation:    el,
+		Rotator:      rot,
+		AzimuthRaw:   az,
+		ElevationRaw: el,
+		RotatorRaw:   rot,
+	})
+	if len(sim.samples) < positionBroadcastSamples {
+		return
+	}
+	var p positionBroadcastPacket
+	copy(p[:], sim.samples)
+	sim.samples = sim.samples[:0]
+	var b bytes.Buffer
+	binary.Write(&b, binary.LittleEndian, &p)
+	_, err := sim.broadcast.Write(b.Bytes())
+	if err != nil {
+		log.Print("ACU simulator: position broadcast: ", err)
+	}
+}
+
+// admin runs an admin interface request. Only the position broadcast
+// settings are simulated; anything else is ignored.
+func (sim *ACUSimulator) admin(req *http.Request) error {
+	q := req.URL.Query()
+	if q.Get("Module") != "Services.PositionBroadcast" {
+		return nil
+	}
+	err := req.ParseForm()
+	if err != nil {
+		return err
+	}
+	switch q.Get("Chapter") {
+	case "1":
+		switch req.PostForm.Get("name") {
+		case "Destination":
+			sim.broadcastDest = req.PostForm.Get("value")
+		case "Port":
+			sim.broadcastPort = req.PostForm.Get("value")
+		}
+	case "3":
+		if req.PostForm.Get("Command") != "Enable" {
+			return fmt.Errorf("position broadcast command %s not simulated", req.PostForm.Get("Command"))
+		}
+		conn, err := net.Dial("udp", net.JoinHostPort(sim.broadcastDest, sim.broadcastPort))
+		if err != nil {
+			return err
+		}
+		if sim.broadcast != nil {
+			sim.broadcast.Close()
+		}
+		sim.broadcast, sim.samples, sim.nextSample = conn, nil, sim.t
+	}
+	return nil
+}
+
+// track interpolates the program track at t.
+func (sim *ACUSimulator) track(t time.Time) ([2]float64, [2]float64, bool) {
+	var pos, vel [2]float64
+	n := len(sim.stack)
+	if n == 0 || t.Before(sim.stack[0].t) {
+		return pos, vel, false
+	}
+	if !t.Before(sim.stack[n-1].t) {
+		return sim.stack[n-1].pos, vel, true // hold the last point
+	}
+	i := sort.Search(n, func(i int) bool { return sim.stack[i].t.After(t) })
+	p0, p1 := sim.stack[i-1], sim.stack[i]
+	h := p1.t.Sub(p0.t).Seconds()
+	u := t.Sub(p0.t).Seconds() / h
+	for j := 0; j < 2; j++ {
+		// cubic Hermite
+		x0, x1, v0, v1 := p0.pos[j], p1.pos[j], p0.vel[j]*h, p1.vel[j]*h
+		pos[j] = (2*u*u*u-3*u*u+1)*x0 + (u*u*u-2*u*u+u)*v0 + (-2*u*u*u+3*u*u)*x1 + (u*u*u-u*u)*v1
+		vel[j] = ((6*u*u-6*u)*x0 + (3*u*u-4*u+1)*v0 + (-6*u*u+6*u)*x1 + (3*u*u-2*u)*v1) / h
+	}
+	return pos, vel, true
+}
+
+func (sim *ACUSimulator) setMode(mode int) {
+	for i := range sim.axes {
+		sim.axes[i].mode = mode
+	}
+}
+
+// statusGeneral returns the StatusGeneral8100 dataset.
+func (sim *ACUSimulator) statusGeneral() datasets.StatusGeneral8100 {
+	var rec datasets.StatusGeneral8100
+	rec.Year, rec.Time = statusTime(sim.t)
+	rec.Remote = true
+	rec.AzimuthMode = datasets.AzimuthModeStop
+	rec.ElevationMode = datasets.ElevationModeStop
+	switch sim.axes[0].mode {
+	case simModePreset:
+		rec.AzimuthMode = datasets.AzimuthModePreset
+	case simModeProgramTrack:
+		rec.AzimuthMode = datasets.AzimuthModeProgramTrack
+	}
+	switch sim.axes[1].mode {
+	case simModePreset:
+		rec.ElevationMode = datasets.ElevationModePreset
+	case simModeProgramTrack:
+		rec.ElevationMode = datasets.ElevationModeProgramTrack
+	}
+	az, el := &sim.axes[0], &sim.axes[1]
+	rec.AzimuthCommandedPosition = az.commanded
+	rec.AzimuthCurrentPosition = az.pos
+	rec.AzimuthCurrentVelocity = az.vel
+	rec.ElevationCommandedPosition = el.commanded
+	rec.ElevationCurrentPosition = el.pos
+	rec.ElevationCurrentVelocity = el.vel
+	free := maxFreeProgramTrackStack - len(sim.stack)
+	if free < 0 {
+		free = 0
+	}
+	rec.QtyOfFreeProgramTrackStackPositions = uint32(free)
+	return rec
+}
+
+func (sim *ACUSimulator) dataset(name string) (interface{}, error) {
+	switch name {
+	case "StatusGeneral8100":
+		rec := sim.statusGeneral()
+		return &rec, nil
+	case "StatusExtra8100":
+		return &datasets.StatusExtra8100{AzimuthProfilerActive: true, ElevationProfilerActive: true}, nil
+	case "StatusCCatDetailed8100":
+		return &datasets.StatusCCatDetailed8100{ProgramTrackPositionFailure: sim.trackErr}, nil
+	case "StatusThirdAxis8100":
+		r := sim.rotator
+		status := thirdAxisStatus{CommandedPosition: r.commanded, CurrentPosition: r.pos, CurrentVelocity: r.vel}
+		if r.mode == simModePreset {
+			status.Mode = thirdAxisModePreset
+		}
+		return &status, nil
+	case "StatusStowPins8100":
+		return &[2]bool{sim.stowPins, sim.stowPins}, nil
+	case "StatusFaults8100":
+		return &faultStatus{}, nil
+	case "StatusTemperatures8100":
+		return &driveTemperatures{20, 20, 20, 20}, nil
+	case "ParametersAxes8100":
+		var params ACUParameters
+		for i, p := range []*ACUAxisParameters{&params.Azimuth, &params.Elevation} {
+			a := sim.axes[i]
+			p.AxisLimits = AxisLimits{a.min, a.max, a.vmax, a.amax, a.jmax}
+			p.GearRatio = 1
+		}
+		return &params, nil
+	}
+	return nil, fmt.Errorf("unknown dataset %s", name)
+}
+
+// command runs a /Command request.
+func (sim *ACUSimulator) command(identifier, command, parameter string) error {
+	switch identifier + "/" + command {
+	case "DataSets.CmdModeTransfer/Stop":
+		sim.setMode(simModeStop)
+	case "DataSets.CmdModeTransfer/SetAzElMode", "DataSets.CmdModeTransfer/SetAzMode", "DataSets.CmdModeTransfer/SetElMode":
+		var mode int
+		switch parameter {
+		case "Stop":
+			mode = simModeStop
+		case "Preset":
+			mode = simModePreset
+		case "ProgramTrack":
+			mode = simModeProgramTrack
+		default:
+			return fmt.Errorf("mode %s not simulated", parameter)
+		}
+		switch command {
+		case "SetAzMode":
+			sim.axes[0].mode = mode
+		case "SetElMode":
+			sim.axes[1].mode = mode
+		default:
+			sim.setMode(mode)
+		}
+	case "DataSets.CmdAzElPositionTransfer/Set Azimuth Elevation":
+		var az, el float64
+		_, err := fmt.Sscanf(parameter, "%g|%g", &az, &el)
+		if err != nil {
+			return err
+		}
+		sim.preset = [2]float64{az, el}
+	case "DataSets.CmdAzElPositionTransfer/Set Azimuth", "DataSets.CmdAzElPositionTransfer/Set Elevation":
+		x, err := strconv.ParseFloat(parameter, 64)
+		if err != nil {
+			return err
+		}
+		if command == "Set Azimuth" {
+			sim.preset[0] = x
+		} else {
+			sim.preset[1] = x
+		}
+	case "DataSets.CmdTimePositionTransfer/Clear Stack":
+		sim.stack = nil
+	case "DataSets.CmdThirdAxisModeTransfer/Stop":
+		sim.rotator.mode = simModeStop
+	case "DataSets.CmdThirdAxisModeTransfer/SetMode":
+		if parameter != "Preset" {
+			return fmt.Errorf("third axis mode %s not simulated", parameter)
+		}
+		sim.rotator.mode = simModePreset
+	case "DataSets.CmdThirdAxisPositionTransfer/Set Position":
+		x, err := strconv.ParseFloat(parameter, 64)
+		if err != nil {
+			return err
+		}
+		sim.rotator.commanded = x
+	case "DataSets.CmdGeneralTransfer/Stowpins Insert":
+		sim.stowPins = true
+	case "DataSets.CmdGeneralTransfer/Stowpins Retract":
+		sim.stowPins = false
+	case "DataSets.CmdGeneralTransfer/Drives Off":
+		sim.setMode(simModeStop)
+		sim.rotator.mode = simModeStop
+	case "DataSets.CmdGeneralTransfer/Drives On", "DataSets.CmdGeneralTransfer/Failure Reset", "DataSets.CmdGeneralTransfer/ACU Reboot",
+		"/SetShutter", "/SetSunAvoidance":
+		// nothing to simulate
+	default:
+		return fmt.Errorf("command %s %s not simulated", identifier, command)
+	}
+	return nil
+}
+
+// upload adds SSV program track points to the stack.
+func (sim *ACUSimulator) upload(r io.Reader) error {
+	sim.trackErr = false
+	for {
+		var p datasets.TimePositionTransfer
+		err := (&p).ReadSSV(r)
+		if err != nil {
+			break
+		}
+		t := VertexTime2Time(p.Day, p.TimeOfDay, sim.t)
+		if checkHardAzEl(p.AzPosition, p.ElPosition, p.AzVelocity, p.ElVelocity) != nil {
+			sim.trackErr = true
+			continue
+		}
+		if n := len(sim.stack); n > 0 && !t.After(sim.stack[n-1].t) {
+			return fmt.Errorf("program track points out of order")
+		}
+		if len(sim.stack) >= maxFreeProgramTrackStack {
+			return fmt.Errorf("program track stack full")
+		}
+		sim.stack = append(sim.stack, simPoint{t,
+			[2]float64{p.AzPosition, p.ElPosition},
+			[2]float64{p.AzVelocity, p.ElVelocity}})
+	}
+	return nil
+}
+
+func (sim *ACUSimulator) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	sim.mu.Lock()
+	defer sim.mu.Unlock()
+	sim.advance()
+
+	q := req.URL.Query()
+	var err error
+	switch req.URL.Path {
+	case "/Values":
+		var d interface{}
+		d, err = sim.dataset(strings.TrimPrefix(q.Get("identifier"), "DataSets."))
+		if err == nil {
+			var b bytes.Buffer
+			binary.Write(&b, binary.LittleEndian, d)
+			w.Write(b.Bytes())
+			return
+		}
+	case "/Command":
+		err = sim.command(q.Get("identifier"), q.Get("command"), q.Get("parameter"))
+	case "/UploadPtStack":
+		var f io.ReadCloser
+		f, _, err = req.FormFile("upload")
+		if err == nil {
+			err = sim.upload(f)
+			f.Close()
+		}
+	case "/GetPtStack":
+		for _, p := range sim.stack {
+			doy, tod := VertexTime(p.t)
+			datasets.TimePositionTransfer{
+				Day: doy, TimeOfDay: tod,
+				AzPosition: p.pos[0], ElPosition: p.pos[1],
+				AzVelocity: p.vel[0], ElVelocity: p.vel[1],
+			}.WriteSSV(w)
+		}
+		return
+	case "/": // admin interface
+		err = sim.admin(req)
+	default:
+		err = fmt.Errorf("%s not simulated", req.URL.Path)
+	}
+	if err != nil {
+		log.Print("ACU simulator: ", err)
+		fmt.Fprintf(w, "Failed: %v", err)
+		return
+	}
+	fmt.Fprint(w, "OK")
+}
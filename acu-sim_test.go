@@ -0,0 +1,251 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+func newTestSimulator(t *testing.T, az, el float64) (*ACUSimulator, *ACU, *time.Time) {
+	now := time.Date(2024, 6, 1, 12, 0, 0, 0, time.UTC)
+	sim := NewACUSimulator(az, el)
+	sim.now = func() time.Time { return now }
+	sim.t = now
+	return sim, newTestACU(t, sim), &now
+}
+
+// newTestACU returns an ACU client for h.
+func newTestACU(t *testing.T, h http.Handler) *ACU {
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse(srv.URL)
+	return NewACU(u.Hostname(), u.Port(), u.Port())
+}
+
+func TestACUSimulatorPreset(t *testing.T) {
+	_, acu, now := newTestSimulator(t, 100, 40)
+	for _, err := range []error{
+		acu.ModeSet("Stop"),
+		acu.PresetPositionSet(130, 60),
+		acu.ModeSet("Preset"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rec datasets.StatusGeneral8100
+	for i := 0; i < 600; i++ {
+		*now = now.Add(100 * time.Millisecond)
+		err := acu.StatusGeneral8100Get(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if math.Abs(rec.AzimuthCurrentVelocity) > azimuthSpeedMax+1e-9 ||
+			math.Abs(rec.ElevationCurrentVelocity) > elevationSpeedMax+1e-9 {
+			t.Fatalf("too fast: %+v", rec)
+		}
+	}
+	if rec.AzimuthMode != datasets.AzimuthModePreset || !rec.Remote {
+		t.Errorf("bad status %+v", rec)
+	}
+	if math.Abs(rec.AzimuthCurrentPosition-130) > 1e-4 ||
+		math.Abs(rec.ElevationCurrentPosition-60) > 1e-4 ||
+		math.Abs(rec.AzimuthCurrentVelocity) > 1e-4 ||
+		math.Abs(rec.ElevationCurrentVelocity) > 1e-4 {
+		t.Errorf("didn't converge: %+v", rec)
+	}
+	if got := StatusTime2Time(rec.Year, rec.Time); math.Abs(got.Sub(*now).Seconds()) > 1e-3 {
+		t.Errorf("status time %v, expected %v", got, *now)
+	}
+
+	if err := acu.ModeSet("SectorScan"); err == nil {
+		t.Error("expected unsimulated mode to fail")
+	}
+}
+
+func TestACUSimulatorAxisPreset(t *testing.T) {
+	_, acu, now := newTestSimulator(t, 100, 40)
+	if err := acu.AxisModeSet("azimuth", "Stop"); !errors.Is(err, errUnconfirmed) {
+		t.Errorf("AxisModeSet: got %v, expected %v", err, errUnconfirmed)
+	}
+	if err := acu.AxisPresetSet("azimuth", 130); !errors.Is(err, errUnconfirmed) {
+		t.Errorf("AxisPresetSet: got %v, expected %v", err, errUnconfirmed)
+	}
+
+	acu.unconfirmed = true
+	for _, err := range []error{
+		acu.AxisModeSet("azimuth", "Stop"),
+		acu.AxisPresetSet("azimuth", 130),
+		acu.AxisModeSet("azimuth", "Preset"),
+	} {
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	var rec datasets.StatusGeneral8100
+	for i := 0; i < 600; i++ {
+		*now = now.Add(100 * time.Millisecond)
+		if err := acu.StatusGeneral8100Get(&rec); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec.AzimuthMode != datasets.AzimuthModePreset || rec.ElevationMode != datasets.ElevationModeStop {
+		t.Errorf("bad modes %+v", rec)
+	}
+	if math.Abs(rec.AzimuthCurrentPosition-130) > 1e-4 || rec.ElevationCurrentPosition != 40 {
+		t.Errorf("got az,el %g,%g, expected 130,40", rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition)
+	}
+
+	if err := acu.AxisModeSet("roll", "Preset"); err == nil {
+		t.Error("expected bad axis to fail")
+	}
+}
+
+func TestACUSimulatorProgramTrack(t *testing.T) {
+	_, acu, now := newTestSimulator(t, 100, 40)
+	var points []datasets.TimePositionTransfer
+	for i := 0; i < 100; i++ {
+		doy, tod := VertexTime(now.Add(time.Duration(i) * 100 * time.Millisecond))
+		points = append(points, datasets.TimePositionTransfer{
+			Day: doy, TimeOfDay: tod,
+			AzPosition: 100 + 0.1*float64(i), ElPosition: 40,
+			AzVelocity: 1,
+		})
+	}
+	err := acu.ProgramTrackAdd(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var stack []datasets.TimePositionTransfer
+	err = acu.ProgramTrackGet(&stack)
+	if len(stack) != len(points) || stack[1] != points[1] {
+		t.Fatalf("got %d points, %v", len(stack), err)
+	}
+
+	err = acu.ModeSet("ProgramTrack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec datasets.StatusGeneral8100
+	for i := 0; i < 50; i++ {
+		*now = now.Add(100 * time.Millisecond)
+		err = acu.StatusGeneral8100Get(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec.AzimuthMode != datasets.AzimuthModeProgramTrack ||
+		math.Abs(rec.AzimuthCommandedPosition-105) > 0.01 ||
+		math.Abs(rec.AzimuthCurrentPosition-rec.AzimuthCommandedPosition) > 0.01 ||
+		math.Abs(rec.AzimuthCurrentVelocity-1) > 0.01 {
+		t.Errorf("not tracking: %+v", rec)
+	}
+	if n := int(rec.QtyOfFreeProgramTrackStackPositions); n <= maxFreeProgramTrackStack-len(points) {
+		t.Errorf("%d free stack positions, expected the past points to be dropped", n)
+	}
+
+	points[0].ElPosition = elevationMax + 1
+	if err := acu.ProgramTrackAdd(points[:1]); err == nil {
+		t.Error("expected out of range point to fail")
+	}
+}
+
+func TestProgramTrackAddUnverified(t *testing.T) {
+	var posts int
+	acu := newTestACU(t, http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			posts++
+			return
+		}
+		http.Error(w, "busy", http.StatusServiceUnavailable)
+	}))
+	err := acu.ProgramTrackAdd([]datasets.TimePositionTransfer{{AzPosition: 100, ElPosition: 40}})
+	var unverified programTrackUnverified
+	if !errors.As(err, &unverified) || posts != 1 {
+		t.Errorf("got %v after %d posts, expected an unverified upload", err, posts)
+	}
+}
+
+func TestACUSimulatorProgramTrackNewYear(t *testing.T) {
+	sim, acu, now := newTestSimulator(t, 100, 40)
+	*now = time.Date(2024, 12, 31, 23, 59, 57, 0, time.UTC)
+	sim.t = *now
+	var points []datasets.TimePositionTransfer
+	for i := 0; i < 100; i++ {
+		doy, tod := VertexTime(now.Add(time.Duration(i) * 100 * time.Millisecond))
+		points = append(points, datasets.TimePositionTransfer{
+			Day: doy, TimeOfDay: tod,
+			AzPosition: 100 + 0.1*float64(i), ElPosition: 40,
+			AzVelocity: 1,
+		})
+	}
+	if points[29].Day != 366 || points[30].Day != 1 || points[30].TimeOfDay != 0 {
+		t.Fatalf("points %+v, %+v don't roll over", points[29], points[30])
+	}
+	err := acu.ProgramTrackAdd(points)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = acu.ModeSet("ProgramTrack")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var rec datasets.StatusGeneral8100
+	for i := 0; i < 50; i++ {
+		*now = now.Add(100 * time.Millisecond)
+		err = acu.StatusGeneral8100Get(&rec)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if rec.Year != 2025 || math.Abs(rec.AzimuthCommandedPosition-105) > 0.01 ||
+		math.Abs(rec.AzimuthCurrentPosition-rec.AzimuthCommandedPosition) > 0.01 {
+		t.Errorf("not tracking across the New Year: %+v", rec)
+	}
+}
+
+func TestACUSimulatorPositionBroadcast(t *testing.T) {
+	_, acu, now := newTestSimulator(t, 100, 40)
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	err = acu.PositionBroadcastEnable("127.0.0.1", conn.LocalAddr().(*net.UDPAddr).Port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := *now
+	*now = now.Add(100 * time.Millisecond)
+	var rec datasets.StatusGeneral8100
+	if err := acu.StatusGeneral8100Get(&rec); err != nil {
+		t.Fatal(err)
+	}
+
+	// 200 Hz, in packets of positionBroadcastSamples
+	buf := make([]byte, 1024)
+	for i := 0; i < 2; i++ {
+		conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples, err := decodePositionBroadcast(buf[:n], *now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for j, s := range samples {
+			expected := start.Add(time.Duration(i*len(samples)+j) * simBroadcastInterval)
+			if math.Abs(s.Time.Sub(expected).Seconds()) > 1e-6 || s.Azimuth != 100 || s.Elevation != 40 {
+				t.Errorf("packet %d sample %d: got %+v, expected time %v", i, j, s, expected)
+			}
+		}
+	}
+}
@@ -3,6 +3,8 @@ package main
 import (
 	"bytes"
 	"encoding/binary"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
@@ -21,31 +23,110 @@ type ACU struct {
 	Addr      string
 	AdminAddr string
 	client    *http.Client
+	recorder  *StatusRecorder // if recording
+	link      *ACULink
+
+	// whether to use the unconfirmed capabilities (see acuCapabilities),
+	// so far only with the simulator
+	unconfirmed bool
+}
+
+// An acuCapability is a group of ACU commands or datasets the TCS uses
+// beyond those it was first written against.
+type acuCapability int
+
+const (
+	capAxisCommands      acuCapability = iota // SetAzMode, Set+Azimuth, ...
+	capThirdAxis                              // CmdThirdAxis*Transfer, StatusThirdAxis8100 (see thirdAxisStatus)
+	capDrives                                 // Drives+On, Drives+Off
+	capStowPins                               // Stowpins+Insert, StatusStowPins8100, ...
+	capFaults                                 // StatusFaults8100 (see faultStatus, axisFaultBits)
+	capTemperatures                           // StatusTemperatures8100 (see driveTemperatures)
+	capParameters                             // ParametersAxes8100 (see ACUAxisParameters)
+	capPositionBroadcast                      // packet layout (see positionBroadcastSamples)
+	capUploadSize                             // maxProgramTrackUploadPoints
+)
+
+// acuCapabilities records which capabilities are confirmed against the
+// ACU ICD. Until they are, their names and layouts are guesses, so the
+// real ACU isn't sent their commands (see ACU.supports). Datasets only
+// read for monitoring are read all the same, as a wrong guess just fails.
+var acuCapabilities = [...]struct {
+	name      string
+	confirmed bool
+}{
+	capAxisCommands:      {"single axis commands", false},
+	capThirdAxis:         {"third axis commands", false},
+	capDrives:            {"drives commands", false},
+	capStowPins:          {"stow pins", false},
+	capFaults:            {"fault status", false},
+	capTemperatures:      {"drive temperatures", false},
+	capParameters:        {"axis parameters", false},
+	capPositionBroadcast: {"position broadcast packets", false},
+	capUploadSize:        {"program track upload size", false},
+}
+
+var errUnconfirmed = errors.New("ACU command names unconfirmed")
+
+// supports returns an error wrapping errUnconfirmed if acu can't use c.
+func (acu *ACU) supports(c acuCapability) error {
+	if acuCapabilities[c].confirmed || acu.unconfirmed {
+		return nil
+	}
+	return fmt.Errorf("%s not supported: %w", acuCapabilities[c].name, errUnconfirmed)
 }
 
 // NewACU returns a new connection to host.
 func NewACU(host, port, adminPort string) *ACU {
 	addr := fmt.Sprintf("%s:%s", host, port)
 	adminAddr := fmt.Sprintf("%s:%s", host, adminPort)
+	client := &http.Client{
+		Timeout: 500 * time.Millisecond,
+	}
 	return &ACU{
 		Addr:      addr,
 		AdminAddr: adminAddr,
-		client: &http.Client{
-			Timeout: 500 * time.Millisecond,
-		},
+		client:    client,
+		link:      NewACULink(client.CloseIdleConnections),
 	}
 }
 
+// Link returns the health of the link to the ACU.
+func (acu *ACU) Link() ACULinkStatus {
+	return acu.link.Status(time.Now())
+}
+
 func (acu *ACU) do(req *http.Request) ([]byte, error) {
+	// status polls give up while the link is down, between reconnection
+	// attempts, so they don't each wait for the timeout
+	if strings.HasPrefix(req.URL.Path, "/Values") && !acu.link.allow(time.Now()) {
+		tcsMetrics.acuErrors.Inc(req.Method)
+		return nil, errACUDown
+	}
+	b, err := acu.roundTrip(req)
+	if err != nil {
+		tcsMetrics.acuErrors.Inc(req.Method)
+	}
+	return b, err
+}
+
+// roundTrip sends req, recording the outcome on the link: any response,
+// even an error, shows it's alive.
+func (acu *ACU) roundTrip(req *http.Request) ([]byte, error) {
+	t0 := time.Now()
 	resp, err := acu.client.Do(req)
 	if err != nil {
+		acu.link.fail(time.Now(), err)
 		return nil, err
 	}
 	defer resp.Body.Close()
 	b, err := io.ReadAll(resp.Body)
 	if err != nil {
+		acu.link.fail(time.Now(), err)
 		return nil, err
 	}
+	acu.link.ok(time.Now())
+	tcsMetrics.acuLatency.Observe(time.Since(t0).Seconds())
 	if resp.StatusCode != http.StatusOK {
 		return nil, fmt.Errorf(resp.Status)
 	}
@@ -102,14 +183,45 @@ func (acu *ACU) postAdminValues(path string, values url.Values) ([]byte, error)
 	return acu.do(req)
 }
 
+// Raw sends an engineering request to the ACU, on the command port or,
+// if admin, the admin port. A POST sends values as a form.
+func (acu *ACU) Raw(admin bool, method, path string, values url.Values) ([]byte, error) {
+	log.Printf("ACU: raw %s %s", method, path)
+	newRequest := acu.newRequest
+	if admin {
+		newRequest = acu.newAdminRequest
+	}
+	var body io.Reader
+	if method == "POST" {
+		body = strings.NewReader(values.Encode())
+	}
+	req, err := newRequest(method, path, body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	}
+	return acu.do(req)
+}
+
 func (acu *ACU) command(id, cmd string) error {
 	_, err := acu.get("/Command?identifier=" + id + "&command=" + cmd)
 	return err
 }
 
+// DatasetRaw fetches a dataset, undecoded.
+func (acu *ACU) DatasetRaw(name string) ([]byte, error) {
+	b, err := acu.get("/Values?identifier=DataSets." + name + "&format=Binary")
+	if err == nil && acu.recorder != nil {
+		acu.recorder.Record(name, b)
+	}
+	return b, err
+}
+
 // DatasetGet fetches a dataset.
 func (acu *ACU) DatasetGet(name string, d interface{}) error {
-	b, err := acu.get("/Values?identifier=DataSets." + name + "&format=Binary")
+	b, err := acu.DatasetRaw(name)
 	if err != nil {
 		return err
 	}
@@ -129,14 +241,53 @@ func (acu *ACU) ModeSet(mode string) error {
 	return fmt.Errorf("ModeSet: bad mode: %s", mode)
 }
 
-// StatusGeneral8100Get fetches the StatusGeneral8100 dataset.
-func (acu *ACU) StatusGeneral8100Get(record *datasets.StatusGeneral8100) error {
-	b, err := acu.get("/Values?identifier=DataSets.StatusGeneral8100&format=Binary")
+// axis mode and preset commands, by axis (see capAxisCommands)
+var (
+	axisModeCommands   = map[string]string{"azimuth": "SetAzMode", "elevation": "SetElMode"}
+	axisPresetCommands = map[string]string{"azimuth": "Set+Azimuth", "elevation": "Set+Elevation"}
+)
+
+// AxisModeSet changes the mode of one axis, "azimuth" or "elevation",
+// leaving the other in its current mode.
+func (acu *ACU) AxisModeSet(axis, mode string) error {
+	cmd, ok := axisModeCommands[axis]
+	if !ok {
+		return fmt.Errorf("AxisModeSet: bad axis: %s", axis)
+	}
+	switch mode {
+	case "Stop", "Preset", "ProgramTrack", "Rate":
+		err := acu.supports(capAxisCommands)
+		if err != nil {
+			return err
+		}
+		_, err = acu.get("/Command?identifier=DataSets.CmdModeTransfer&command=" + cmd + "&parameter=" + mode)
+		return err
+	}
+	return fmt.Errorf("AxisModeSet: bad mode: %s", mode)
+}
+
+// AxisPresetSet sets the preset position of one axis.
+func (acu *ACU) AxisPresetSet(axis string, position float64) error {
+	cmd, ok := axisPresetCommands[axis]
+	if !ok {
+		return fmt.Errorf("AxisPresetSet: bad axis: %s", axis)
+	}
+	err := acu.supports(capAxisCommands)
 	if err != nil {
 		return err
 	}
-	r := bytes.NewBuffer(b)
-	return binary.Read(r, binary.LittleEndian, record)
+	path := fmt.Sprintf("/Command?identifier=DataSets.CmdAzElPositionTransfer&command=%s&parameter=%g", cmd, position)
+	_, err = acu.get(path)
+	return err
+}
+
+// StatusGeneral8100Get fetches the StatusGeneral8100 dataset.
+func (acu *ACU) StatusGeneral8100Get(record *datasets.StatusGeneral8100) error {
+	err := acu.DatasetGet("StatusGeneral8100", record)
+	if err == nil && record.Year >= minStatusTimeYear {
+		acu.link.statusAt(time.Now(), StatusTime2Time(record.Year, record.Time))
+	}
+	return err
 }
 
 // PresetPositionSet sets the preset position.
@@ -176,17 +327,39 @@ func (acu *ACU) ProgramTrackAdd(points []datasets.TimePositionTransfer) error {
 	var details datasets.StatusCCatDetailed8100
 	err = acu.DatasetGet("StatusCCatDetailed8100", &details)
 	if err != nil {
-		return err
+		return programTrackUnverified{err}
 	}
 	if details.StartOfProgramTrackTooEarly {
-		return fmt.Errorf("ProgramTrackAdd: StartOfProgramTrackTooEarly")
+		return programTrackRejected("StartOfProgramTrackTooEarly")
 	}
 	if details.ProgramTrackPositionFailure {
-		return fmt.Errorf("ProgramTrackAdd: ProgramTrackPositionFailure")
+		return programTrackRejected("ProgramTrackPositionFailure")
 	}
 	return nil
 }
 
+// A programTrackRejected error is the ACU rejecting uploaded points,
+// so uploading them again won't help.
+type programTrackRejected string
+
+func (e programTrackRejected) Error() string {
+	return "ProgramTrackAdd: " + string(e)
+}
+
+// A programTrackUnverified error is failing to check the ACU accepted
+// points after posting them, so uploading them again could duplicate them.
+type programTrackUnverified struct {
+	err error
+}
+
+func (e programTrackUnverified) Error() string {
+	return "ProgramTrackAdd: uploaded, but not verified: " + e.err.Error()
+}
+
+func (e programTrackUnverified) Unwrap() error {
+	return e.err
+}
+
 // ProgramTrackGet gets the current program track queue.
 func (acu *ACU) ProgramTrackGet(points *[]datasets.TimePositionTransfer) error {
 	b, err := acu.get("/GetPtStack")
@@ -231,6 +404,84 @@ func (acu *ACU) SunAvoidanceEnable() error {
 	return err
 }
 
+// ThirdAxisStatusGet fetches the third axis (instrument rotator) status.
+func (acu *ACU) ThirdAxisStatusGet(status *thirdAxisStatus) error {
+	err := acu.supports(capThirdAxis)
+	if err != nil {
+		return err
+	}
+	return acu.DatasetGet("StatusThirdAxis8100", status)
+}
+
+// ThirdAxisPresetSet moves the third axis to a preset position.
+func (acu *ACU) ThirdAxisPresetSet(position float64) error {
+	err := acu.supports(capThirdAxis)
+	if err != nil {
+		return err
+	}
+	err = acu.command("DataSets.CmdThirdAxisModeTransfer", "Stop")
+	if err != nil {
+		return err
+	}
+	path := fmt.Sprintf("/Command?identifier=DataSets.CmdThirdAxisPositionTransfer&command=Set+Position&parameter=%g", position)
+	_, err = acu.get(path)
+	if err != nil {
+		return err
+	}
+	_, err = acu.get("/Command?identifier=DataSets.CmdThirdAxisModeTransfer&command=SetMode&parameter=Preset")
+	return err
+}
+
+// ThirdAxisStop stops the third axis.
+func (acu *ACU) ThirdAxisStop() error {
+	err := acu.supports(capThirdAxis)
+	if err != nil {
+		return err
+	}
+	return acu.command("DataSets.CmdThirdAxisModeTransfer", "Stop")
+}
+
+// StowPinsSet inserts or retracts the stow pins.
+func (acu *ACU) StowPinsSet(insert bool) error {
+	err := acu.supports(capStowPins)
+	if err != nil {
+		return err
+	}
+	if insert {
+		return acu.command("DataSets.CmdGeneralTransfer", "Stowpins+Insert")
+	}
+	return acu.command("DataSets.CmdGeneralTransfer", "Stowpins+Retract")
+}
+
+// StowPinsGet returns whether the azimuth and elevation stow pins are inserted.
+func (acu *ACU) StowPinsGet() (bool, bool, error) {
+	var status struct {
+		AzimuthStowPinInserted   bool
+		ElevationStowPinInserted bool
+	}
+	err := acu.supports(capStowPins)
+	if err == nil {
+		err = acu.DatasetGet("StatusStowPins8100", &status)
+	}
+	return status.AzimuthStowPinInserted, status.ElevationStowPinInserted, err
+}
+
+// FaultStatusGet fetches the axis fault bits and drive temperatures.
+func (acu *ACU) FaultStatusGet(status *faultStatus) error {
+	return acu.DatasetGet("StatusFaults8100", status)
+}
+
+// DriveTemperaturesGet fetches the motor and drive cabinet temperatures.
+func (acu *ACU) DriveTemperaturesGet(temps *driveTemperatures) error {
+	return acu.DatasetGet("StatusTemperatures8100", temps)
+}
+
+// ParametersGet fetches the axis limits and servo parameters configured
+// in the ACU.
+func (acu *ACU) ParametersGet(params *ACUParameters) error {
+	return acu.DatasetGet("ParametersAxes8100", params)
+}
+
 // PositionBroadcastEnable enables the 200Hz position broadcast UDP stream.
 func (acu *ACU) PositionBroadcastEnable(host string, port int) error {
 	data := url.Values{}
@@ -259,6 +510,39 @@ func (acu *ACU) PositionBroadcastEnable(host string, port int) error {
 	return nil
 }
 
+// DrivesSet switches the drives on or off.
+func (acu *ACU) DrivesSet(on bool) error {
+	err := acu.supports(capDrives)
+	if err != nil {
+		return err
+	}
+	if on {
+		return acu.command("DataSets.CmdGeneralTransfer", "Drives+On")
+	}
+	return acu.command("DataSets.CmdGeneralTransfer", "Drives+Off")
+}
+
+// EmergencyStop stops all the axes and disables the drives, trying each
+// step even if one fails. Only the confirmed commands are sent, so
+// without the third axis and drives capabilities, it stops the main
+// axes and clears the program track.
+func (acu *ACU) EmergencyStop() error {
+	errs := []error{acu.command("DataSets.CmdModeTransfer", "Stop")}
+	if err := acu.ThirdAxisStop(); !errors.Is(err, errUnconfirmed) {
+		errs = append(errs, err)
+	}
+	if err := acu.DrivesSet(false); !errors.Is(err, errUnconfirmed) {
+		errs = append(errs, err)
+	}
+	errs = append(errs, acu.ProgramTrackClear())
+	for _, err := range errs {
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 // FailureReset needs to be called after an e-stop is triggered and reset.
 func (acu *ACU) FailureReset() error {
 	return acu.command("DataSets.CmdGeneralTransfer", "Failure+Reset")
@@ -268,3 +552,67 @@ func (acu *ACU) FailureReset() error {
 func (acu *ACU) Reboot() error {
 	return acu.command("DataSets.CmdGeneralTransfer", "ACU+Reboot")
 }
+
+// serveACUControl serves the ACU link health, and its resets.
+func serveACUControl(mux *http.ServeMux, acu *ACU) {
+	mux.HandleFunc("/acu/link", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		link := acu.Link()
+		err := json.NewEncoder(w).Encode(&link)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/acu/failure-reset", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := acu.FailureReset()
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		jsonResponse(w, err, status)
+	})
+
+	mux.HandleFunc("/acu/reboot", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+
+		err := acu.Reboot()
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusInternalServerError
+		}
+		jsonResponse(w, err, status)
+	})
+
+	mux.HandleFunc("/clear-track", func(w http.ResponseWriter, req *http.Request) {
+		var statusCode int
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		log.Print("clearing program track stack")
+		err := acu.ProgramTrackClear()
+		if err != nil {
+			log.Print(err)
+			statusCode = http.StatusBadRequest
+		} else {
+			statusCode = http.StatusOK
+		}
+		jsonResponse(w, err, statusCode)
+	})
+}
@@ -0,0 +1,365 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// A Severity ranks alarms.
+type Severity int
+
+const (
+	severityInfo Severity = iota
+	severityWarning
+	severityCritical
+)
+
+var severityNames = []string{"info", "warning", "critical"}
+
+func (s Severity) String() string {
+	if s < 0 || int(s) >= len(severityNames) {
+		return fmt.Sprintf("Severity(%d)", int(s))
+	}
+	return severityNames[s]
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+func (s *Severity) UnmarshalText(b []byte) error {
+	for i, name := range severityNames {
+		if string(b) == name {
+			*s = Severity(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown severity %q", b)
+}
+
+// An Alarm is a condition needing attention. Latching alarms stay
+// raised after their condition clears, until acknowledged.
+type Alarm struct {
+	Name         string     `json:"name"`
+	Severity     Severity   `json:"severity"`
+	Message      string     `json:"message"`
+	Latching     bool       `json:"latching"`
+	Active       bool       `json:"active"` // condition still present
+	Raised       time.Time  `json:"raised"`
+	Cleared      *time.Time `json:"cleared,omitempty"`
+	Acknowledged bool       `json:"acknowledged"`
+	AckedBy      string     `json:"acked_by,omitempty"`
+}
+
+// An AlarmEvent is a change in an alarm.
+type AlarmEvent struct {
+	Time  time.Time `json:"time"`
+	Event string    `json:"event"` // raised, cleared, acknowledged
+	Alarm Alarm     `json:"alarm"`
+}
+
+// how many alarm events to remember
+const alarmHistoryLen = 1000
+
+// Alarms tracks the raised alarms.
+type Alarms struct {
+	mu      sync.Mutex
+	alarms  map[string]*Alarm
+	history []AlarmEvent
+	notify  []func(AlarmEvent)
+}
+
+func NewAlarms() *Alarms {
+	return &Alarms{alarms: make(map[string]*Alarm)}
+}
+
+// OnEvent calls fn, which mustn't block, on each alarm event.
+func (a *Alarms) OnEvent(fn func(AlarmEvent)) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.notify = append(a.notify, fn)
+}
+
+func (a *Alarms) event(now time.Time, event string, alarm *Alarm) {
+	e := AlarmEvent{now, event, *alarm}
+	log.Printf("alarm %s: %s %s: %s", event, alarm.Severity, alarm.Name, alarm.Message)
+	a.history = append(a.history, e)
+	if len(a.history) > alarmHistoryLen {
+		a.history = a.history[len(a.history)-alarmHistoryLen:]
+	}
+	for _, fn := range a.notify {
+		fn(e)
+	}
+}
+
+// Raise raises (or updates) the named alarm.
+func (a *Alarms) Raise(name string, severity Severity, latching bool, format string, args ...interface{}) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	now := time.Now()
+	msg := fmt.Sprintf(format, args...)
+	alarm := a.alarms[name]
+	if alarm != nil && alarm.Active {
+		if severity > alarm.Severity {
+			// escalate, needing a new acknowledgment
+			alarm.Severity, alarm.Message, alarm.Acknowledged = severity, msg, false
+			a.event(now, "raised", alarm)
+		}
+		return
+	}
+	alarm = &Alarm{
+		Name:     name,
+		Severity: severity,
+		Message:  msg,
+		Latching: latching,
+		Active:   true,
+		Raised:   now,
+	}
+	a.alarms[name] = alarm
+	a.event(now, "raised", alarm)
+}
+
+// Clear clears the named alarm's condition.
+func (a *Alarms) Clear(name string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	alarm := a.alarms[name]
+	if alarm == nil || !alarm.Active {
+		return
+	}
+	now := time.Now()
+	alarm.Active = false
+	alarm.Cleared = &now
+	a.event(now, "cleared", alarm)
+	if !alarm.Latching || alarm.Acknowledged {
+		delete(a.alarms, name)
+	}
+}
+
+// Set raises the named alarm if active, else clears it.
+func (a *Alarms) Set(active bool, name string, severity Severity, latching bool, format string, args ...interface{}) {
+	if active {
+		a.Raise(name, severity, latching, format, args...)
+	} else {
+		a.Clear(name)
+	}
+}
+
+// Acknowledge acknowledges the named alarm, or all alarms if name is empty.
+func (a *Alarms) Acknowledge(name, who string) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if name != "" && a.alarms[name] == nil {
+		return fmt.Errorf("no alarm %s", name)
+	}
+	now := time.Now()
+	for n, alarm := range a.alarms {
+		if (name != "" && n != name) || alarm.Acknowledged {
+			continue
+		}
+		alarm.Acknowledged, alarm.AckedBy = true, who
+		a.event(now, "acknowledged", alarm)
+		if !alarm.Active {
+			delete(a.alarms, n)
+		}
+	}
+	return nil
+}
+
+// List returns the raised alarms, most severe first.
+func (a *Alarms) List() []Alarm {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	list := make([]Alarm, 0, len(a.alarms))
+	for _, alarm := range a.alarms {
+		list = append(list, *alarm)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		if list[i].Severity != list[j].Severity {
+			return list[i].Severity > list[j].Severity
+		}
+		return list[i].Raised.Before(list[j].Raised)
+	})
+	return list
+}
+
+// History returns the recent alarm events, oldest first.
+func (a *Alarms) History() []AlarmEvent {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]AlarmEvent(nil), a.history...)
+}
+
+const (
+	driveTemperatureWarning  = 60.0 // [C]
+	driveTemperatureCritical = 75.0 // [C]
+	acuStaleAlarm            = 5 * time.Second
+	alarmCheckInterval       = 1 * time.Second
+)
+
+// see capFaults
+type faultStatus struct {
+	AzimuthFaults             uint32 // bitmask, 0 if none (see axisFaultBits)
+	ElevationFaults           uint32
+	AzimuthDriveTemperature   float64 // hottest drive [C]
+	ElevationDriveTemperature float64
+	EmergencyStop             bool
+}
+
+// An AlarmMonitor raises alarms from the ACU status.
+type AlarmMonitor struct {
+	acu      *ACU
+	alarms   *Alarms
+	stream   *StatusStream
+	faults   *Faults
+	derating *Derating
+}
+
+func NewAlarmMonitor(acu *ACU, alarms *Alarms, stream *StatusStream, faults *Faults, derating *Derating) *AlarmMonitor {
+	return &AlarmMonitor{acu: acu, alarms: alarms, stream: stream, faults: faults, derating: derating}
+}
+
+func (m *AlarmMonitor) Run() error {
+	sub, err := m.stream.Subscribe(1 / alarmCheckInterval.Seconds())
+	if err != nil {
+		return err
+	}
+	defer m.stream.Unsubscribe(sub)
+
+	lastUpdate := time.Now()
+	for {
+		select {
+		case sample := <-sub.c:
+			lastUpdate = time.Now()
+			checkStatusAlarms(m.alarms, &sample.rec, lastUpdate)
+
+			var faults faultStatus
+			err := m.acu.FaultStatusGet(&faults)
+			m.alarms.Set(err != nil, "fault_status", severityWarning, false, "can't read ACU fault status: %v", err)
+			if err == nil {
+				m.faults.Set(time.Now(), &faults)
+				checkFaultAlarms(m.alarms, &faults)
+			}
+
+			var temps driveTemperatures
+			err = m.acu.DriveTemperaturesGet(&temps)
+			m.alarms.Set(err != nil, "drive_temperatures", severityWarning, false, "can't read ACU drive temperatures: %v", err)
+			if err == nil {
+				m.derating.Update(time.Now(), &temps, currentConfig().Derating)
+				checkDeratingAlarm(m.alarms, m.derating.Factors())
+			}
+		case <-time.After(alarmCheckInterval):
+		}
+		dt := time.Since(lastUpdate)
+		m.alarms.Set(dt > acuStaleAlarm, "acu_no_data", severityCritical, false,
+			"no ACU status for %.0f seconds", dt.Seconds())
+		link := m.acu.Link()
+		m.alarms.Set(link.State != linkConnected, "acu_link", severityWarning, false, "%v", link)
+	}
+}
+
+// checkStatusAlarms checks the ACU status rec, received at now.
+func checkStatusAlarms(alarms *Alarms, rec *datasets.StatusGeneral8100, now time.Time) {
+	if rec.Year >= minStatusTimeYear {
+		lag := now.Sub(StatusTime2Time(rec.Year, rec.Time))
+		alarms.Set(math.Abs(lag.Seconds()) > acuStaleAlarm.Seconds(), "acu_stale", severityCritical, false,
+			"ACU status time is %.1f seconds behind", lag.Seconds())
+	}
+
+	// only while tracking; presets and stops move away from the commanded position
+	trackingErrorAlarm := currentConfig().TrackingErrorAlarm
+	azErr := rec.AzimuthCommandedPosition - rec.AzimuthCurrentPosition
+	alarms.Set(rec.AzimuthMode == datasets.AzimuthModeProgramTrack && math.Abs(azErr) > trackingErrorAlarm,
+		"azimuth_tracking_error", severityWarning, false,
+		"azimuth tracking error %.4f deg > %g deg", azErr, trackingErrorAlarm)
+	elErr := rec.ElevationCommandedPosition - rec.ElevationCurrentPosition
+	alarms.Set(rec.ElevationMode == datasets.ElevationModeProgramTrack && math.Abs(elErr) > trackingErrorAlarm,
+		"elevation_tracking_error", severityWarning, false,
+		"elevation tracking error %.4f deg > %g deg", elErr, trackingErrorAlarm)
+}
+
+func checkDeratingAlarm(alarms *Alarms, factors [2]float64) {
+	alarms.Set(factors[0] < 1 || factors[1] < 1, "derating", severityWarning, false,
+		"speed and acceleration limits derated for temperature: azimuth %.0f%%, elevation %.0f%%",
+		100*factors[0], 100*factors[1])
+}
+
+func checkFaultAlarms(alarms *Alarms, faults *faultStatus) {
+	alarms.Set(faults.EmergencyStop, "emergency_stop", severityCritical, true, "emergency stop")
+	checkAxisFaultAlarms(alarms, "azimuth", faults.AzimuthFaults)
+	checkAxisFaultAlarms(alarms, "elevation", faults.ElevationFaults)
+	for _, d := range []struct {
+		name string
+		temp float64
+	}{
+		{"azimuth_drive_temperature", faults.AzimuthDriveTemperature},
+		{"elevation_drive_temperature", faults.ElevationDriveTemperature},
+	} {
+		switch {
+		case d.temp > driveTemperatureCritical:
+			alarms.Raise(d.name, severityCritical, true, "%s %.1f C > %g C", d.name, d.temp, driveTemperatureCritical)
+		case d.temp > driveTemperatureWarning:
+			alarms.Raise(d.name, severityWarning, true, "%s %.1f C > %g C", d.name, d.temp, driveTemperatureWarning)
+		default:
+			alarms.Clear(d.name)
+		}
+	}
+}
+
+// serveAlarms serves the raised alarms and their history, and acknowledges
+// them.
+func serveAlarms(mux *http.ServeMux, alarms *Alarms) {
+	mux.HandleFunc("/alarms", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := json.NewEncoder(w).Encode(alarms.List())
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/alarms/history", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := json.NewEncoder(w).Encode(alarms.History())
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/alarms/ack", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Name string `json:"name"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			who := "anonymous"
+			if p := principalFrom(req.Context()); p != nil {
+				who = p.Name
+			}
+			err = alarms.Acknowledge(x.Name, who)
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestAlarmsLatching(t *testing.T) {
+	a := NewAlarms()
+	a.Raise("fault", severityCritical, true, "fault bits 0x%x", 4)
+	a.Raise("warm", severityWarning, false, "warm")
+	if list := a.List(); len(list) != 2 || list[0].Name != "fault" {
+		t.Fatalf("List: got %+v", list)
+	}
+
+	// non-latching alarms go when cleared
+	a.Clear("warm")
+	// latching alarms stay until acknowledged
+	a.Clear("fault")
+	list := a.List()
+	if len(list) != 1 || list[0].Name != "fault" || list[0].Active {
+		t.Fatalf("List after clear: got %+v", list)
+	}
+	err := a.Acknowledge("fault", "bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if list := a.List(); len(list) != 0 {
+		t.Errorf("List after ack: got %+v", list)
+	}
+	if err := a.Acknowledge("fault", "bob"); err == nil {
+		t.Error("Acknowledge: expected error for unknown alarm")
+	}
+
+	// raised, raised, cleared, cleared, acknowledged
+	if n := len(a.History()); n != 5 {
+		t.Errorf("History: got %d events, expected 5", n)
+	}
+}
+
+func TestAlarmsEscalate(t *testing.T) {
+	a := NewAlarms()
+	a.Raise("temp", severityWarning, true, "warm")
+	a.Acknowledge("", "alice")
+	a.Raise("temp", severityCritical, true, "hot")
+	list := a.List()
+	if len(list) != 1 || list[0].Severity != severityCritical || list[0].Acknowledged {
+		t.Errorf("List: got %+v, expected unacknowledged critical alarm", list)
+	}
+}
+
+func TestCheckFaultAlarms(t *testing.T) {
+	a := NewAlarms()
+	checkFaultAlarms(a, &faultStatus{ElevationFaults: 0x10, AzimuthDriveTemperature: 65})
+	list := a.List()
+	if len(list) != 2 || list[0].Name != "elevation_prelimit_positive" || list[1].Name != "azimuth_drive_temperature" ||
+		list[1].Severity != severityWarning || list[0].Message != "elevation positive prelimit switch" {
+		t.Errorf("checkFaultAlarms: got %+v", list)
+	}
+
+	// brakes are status, not alarms; unknown bits are
+	a = NewAlarms()
+	checkFaultAlarms(a, &faultStatus{AzimuthFaults: 1<<13 | 1<<0 | 1<<31})
+	list = a.List()
+	if len(list) != 2 || list[0].Name != "azimuth_amplifier_fault" || list[1].Name != "azimuth_fault" ||
+		list[1].Message != "azimuth axis fault bits 0x80000000" {
+		t.Errorf("checkFaultAlarms: got %+v", list)
+	}
+	f := decodeAxisFaults(1<<13 | 1<<0 | 1<<31)
+	if len(f.Conditions) != 2 || f.Conditions[1] != "brakes engaged" || f.Unknown != 1<<31 {
+		t.Errorf("decodeAxisFaults: got %+v", f)
+	}
+}
@@ -0,0 +1,393 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"sync/atomic"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// The archive stores the raw ACU status datasets on local disk, so
+// telemetry survives network outages. Each dataset is in its own
+// directory of chunk files, named by start time, holding records of
+//
+//	int64 unix time [ns] | uint32 length | raw dataset bytes
+//
+// all little endian, after an archiveMagic header.
+
+const (
+	archiveMagic         = "FYSTACU1"
+	archiveChunkLayout   = "20060102T150405Z"
+	archiveChunkExt      = ".dat"
+	archiveFlushInterval = 1 * time.Second
+	archiveMaxRecords    = 100000 // per /archive request
+)
+
+// archived datasets, and how to decode them
+var archiveDatasets = map[string]func() interface{}{
+	"StatusGeneral8100":      func() interface{} { return new(datasets.StatusGeneral8100) },
+	"StatusExtra8100":        func() interface{} { return new(datasets.StatusExtra8100) },
+	"StatusCCatDetailed8100": func() interface{} { return new(datasets.StatusCCatDetailed8100) },
+	positionBroadcastDataset: func() interface{} { return new(positionBroadcastPacket) },
+	tiltDataset:              func() interface{} { return new(tiltRecord) },
+}
+
+// datasets added as they arrive rather than polled
+var archivePushed = map[string]bool{
+	positionBroadcastDataset: true,
+	tiltDataset:              true,
+}
+
+// how many pushed records may wait to be written
+const archivePushQueue = 1000
+
+type archiveRecord struct {
+	name string
+	t    time.Time
+	b    []byte
+}
+
+// An Archive records the ACU status datasets to dir.
+type Archive struct {
+	acu       *ACU
+	dir       string
+	interval  time.Duration // between records
+	rotate    time.Duration // chunk length
+	retention time.Duration // how long to keep chunks
+	chunks    map[string]*archiveChunk
+	pushed    chan archiveRecord
+	dropped   int32 // pushed records
+	stop      chan chan error
+}
+
+type archiveChunk struct {
+	f     *os.File
+	w     *bufio.Writer
+	start time.Time
+}
+
+func NewArchive(acu *ACU, dir string, interval, rotate, retention time.Duration) *Archive {
+	return &Archive{
+		acu:       acu,
+		dir:       dir,
+		interval:  interval,
+		rotate:    rotate,
+		retention: retention,
+		chunks:    make(map[string]*archiveChunk),
+		pushed:    make(chan archiveRecord, archivePushQueue),
+		stop:      make(chan chan error),
+	}
+}
+
+func (a *Archive) Run() error {
+	for name := range archiveDatasets {
+		err := os.MkdirAll(filepath.Join(a.dir, name), 0755)
+		if err != nil {
+			return err
+		}
+	}
+	a.prune(time.Now())
+
+	ticker := time.NewTicker(a.interval)
+	defer ticker.Stop()
+	lastFlush := time.Now()
+	for {
+		var t time.Time
+		select {
+		case t = <-ticker.C:
+		case r := <-a.pushed:
+			err := a.write(r.name, r.t, r.b)
+			if err != nil {
+				return err
+			}
+			continue
+		case c := <-a.stop:
+			c <- a.closeChunks()
+			return nil
+		}
+		for name := range archiveDatasets {
+			if archivePushed[name] {
+				continue
+			}
+			b, err := a.acu.DatasetRaw(name)
+			if err != nil {
+				log.Printf("archive: %s: %v", name, err)
+				continue
+			}
+			err = a.write(name, t, b)
+			if err != nil {
+				return err
+			}
+		}
+		if t.Sub(lastFlush) >= archiveFlushInterval {
+			for name, c := range a.chunks {
+				err := c.w.Flush()
+				if err != nil {
+					return fmt.Errorf("archive: %s: %w", name, err)
+				}
+			}
+			lastFlush = t
+		}
+	}
+}
+
+// Add queues a record of a pushed dataset received at t, dropping it if
+// the archive can't keep up. It doesn't block.
+func (a *Archive) Add(name string, t time.Time, b []byte) {
+	select {
+	case a.pushed <- archiveRecord{name, t, b}:
+	default:
+		if n := atomic.AddInt32(&a.dropped, 1); n%1000 == 1 {
+			log.Printf("archive: %s: dropped %d records", name, n)
+		}
+	}
+}
+
+// Close flushes and closes the archive, stopping Run.
+func (a *Archive) Close() error {
+	c := make(chan error)
+	a.stop <- c
+	return <-c
+}
+
+func (a *Archive) closeChunks() error {
+	var err error
+	for name, c := range a.chunks {
+		if e := c.close(); e != nil && err == nil {
+			err = fmt.Errorf("archive: %s: %w", name, e)
+		}
+	}
+	a.chunks = make(map[string]*archiveChunk)
+	return err
+}
+
+func (a *Archive) write(name string, t time.Time, b []byte) error {
+	c := a.chunks[name]
+	if c == nil || t.Sub(c.start) >= a.rotate {
+		if c != nil {
+			err := c.close()
+			if err != nil {
+				return err
+			}
+			a.prune(t)
+		}
+		var err error
+		c, err = newArchiveChunk(filepath.Join(a.dir, name), t)
+		if err != nil {
+			return err
+		}
+		a.chunks[name] = c
+	}
+	var hdr [12]byte
+	binary.LittleEndian.PutUint64(hdr[0:8], uint64(t.UnixNano()))
+	binary.LittleEndian.PutUint32(hdr[8:12], uint32(len(b)))
+	c.w.Write(hdr[:])
+	_, err := c.w.Write(b)
+	return err
+}
+
+func newArchiveChunk(dir string, start time.Time) (*archiveChunk, error) {
+	filename := filepath.Join(dir, start.UTC().Format(archiveChunkLayout)+archiveChunkExt)
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	w := bufio.NewWriter(f)
+	w.WriteString(archiveMagic)
+	return &archiveChunk{f: f, w: w, start: start}, nil
+}
+
+func (c *archiveChunk) close() error {
+	err := c.w.Flush()
+	if err != nil {
+		c.f.Close()
+		return err
+	}
+	return c.f.Close()
+}
+
+// prune deletes chunks which ended before the retention period.
+func (a *Archive) prune(now time.Time) {
+	for name := range archiveDatasets {
+		chunks, err := archiveChunks(filepath.Join(a.dir, name))
+		if err != nil {
+			log.Print("archive: ", err)
+			continue
+		}
+		// a chunk ends when the next one starts
+		for i := 0; i+1 < len(chunks); i++ {
+			if now.Sub(chunks[i+1].start) > a.retention {
+				log.Printf("archive: removing %s", chunks[i].filename)
+				err := os.Remove(chunks[i].filename)
+				if err != nil {
+					log.Print("archive: ", err)
+				}
+			}
+		}
+	}
+}
+
+type archiveChunkFile struct {
+	filename string
+	start    time.Time
+}
+
+// archiveChunks lists the chunks in dir, oldest first.
+func archiveChunks(dir string) ([]archiveChunkFile, error) {
+	matches, err := filepath.Glob(filepath.Join(dir, "*"+archiveChunkExt))
+	if err != nil {
+		return nil, err
+	}
+	var chunks []archiveChunkFile
+	for _, m := range matches {
+		base := filepath.Base(m)
+		start, err := time.Parse(archiveChunkLayout, base[:len(base)-len(archiveChunkExt)])
+		if err != nil {
+			continue // not ours
+		}
+		chunks = append(chunks, archiveChunkFile{m, start})
+	}
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].start.Before(chunks[j].start) })
+	return chunks, nil
+}
+
+// ReadArchive calls fn for each record of dataset in dir from t0 up to t1.
+func ReadArchive(dir, dataset string, t0, t1 time.Time, fn func(t time.Time, b []byte) error) error {
+	if _, ok := archiveDatasets[dataset]; !ok {
+		return fmt.Errorf("unknown dataset %s", dataset)
+	}
+	chunks, err := archiveChunks(filepath.Join(dir, dataset))
+	if err != nil {
+		return err
+	}
+	for i, c := range chunks {
+		if !c.start.Before(t1) {
+			break
+		}
+		if i+1 < len(chunks) && !chunks[i+1].start.After(t0) {
+			continue // ends before t0
+		}
+		err := readArchiveChunk(c.filename, t0, t1, fn)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func readArchiveChunk(filename string, t0, t1 time.Time, fn func(t time.Time, b []byte) error) error {
+	f, err := os.Open(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(archiveMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != archiveMagic {
+		return fmt.Errorf("%s: not an archive chunk", filename)
+	}
+	for {
+		var hdr [12]byte
+		_, err := io.ReadFull(r, hdr[:])
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return nil // truncated by a crash, ignore the partial record
+		}
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[0:8])))
+		b := make([]byte, binary.LittleEndian.Uint32(hdr[8:12]))
+		_, err = io.ReadFull(r, b)
+		if err != nil {
+			return nil
+		}
+		if t.Before(t0) || !t.Before(t1) {
+			continue
+		}
+		err = fn(t, b)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// decodeDataset decodes raw dataset bytes.
+func decodeDataset(dataset string, b []byte) (interface{}, error) {
+	newRecord, ok := archiveDatasets[dataset]
+	if !ok {
+		return nil, fmt.Errorf("unknown dataset %s", dataset)
+	}
+	d := newRecord()
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, d)
+	return d, err
+}
+
+// serveArchive serves the archived records of a dataset in a time range,
+// from dir, or "" if the archive isn't enabled.
+func serveArchive(dir string) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		if dir == "" {
+			err := fmt.Errorf("archive not enabled")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		q := req.URL.Query()
+		dataset := q.Get("dataset")
+		start, err := strconv.ParseFloat(q.Get("start"), 64)
+		if err != nil {
+			jsonResponse(w, fmt.Errorf("bad start: %w", err), http.StatusBadRequest)
+			return
+		}
+		stop, err := strconv.ParseFloat(q.Get("stop"), 64)
+		if err != nil {
+			jsonResponse(w, fmt.Errorf("bad stop: %w", err), http.StatusBadRequest)
+			return
+		}
+
+		type record struct {
+			Time   float64     `json:"time"`
+			Record interface{} `json:"record"`
+		}
+		var records []record
+		err = ReadArchive(dir, dataset, Unixtime2Time(start), Unixtime2Time(stop), func(t time.Time, b []byte) error {
+			if len(records) >= archiveMaxRecords {
+				return fmt.Errorf("more than %d records, narrow the time range", archiveMaxRecords)
+			}
+			d, err := decodeDataset(dataset, b)
+			if err != nil {
+				return err
+			}
+			if rec, ok := d.(*datasets.StatusGeneral8100); ok {
+				sanitizeStatus(rec)
+			}
+			records = append(records, record{Time2Unixtime(t), d})
+			return nil
+		})
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		err = json.NewEncoder(w).Encode(records)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
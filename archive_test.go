@@ -0,0 +1,63 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestArchive(t *testing.T) {
+	dir := t.TempDir()
+	const name = "StatusExtra8100"
+	err := os.MkdirAll(filepath.Join(dir, name), 0755)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a := NewArchive(nil, dir, time.Second, time.Minute, time.Hour)
+
+	// 3 minutes at 1 Hz, so 3 chunks
+	t0 := time.Date(2025, 3, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 180; i++ {
+		err := a.write(name, t0.Add(time.Duration(i)*time.Second), []byte{byte(i % 2), 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	err = a.closeChunks()
+	if err != nil {
+		t.Fatal(err)
+	}
+	chunks, err := archiveChunks(filepath.Join(dir, name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 3 {
+		t.Errorf("archiveChunks: got %d chunks, expected 3", len(chunks))
+	}
+
+	// across a chunk boundary
+	var n int
+	var first time.Time
+	err = ReadArchive(dir, name, t0.Add(50*time.Second), t0.Add(70*time.Second), func(t time.Time, b []byte) error {
+		if n == 0 {
+			first = t
+		}
+		n++
+		_, err := decodeDataset(name, b)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 20 || !first.Equal(t0.Add(50*time.Second)) {
+		t.Errorf("ReadArchive: got %d records from %v, expected 20 from %v", n, first, t0.Add(50*time.Second))
+	}
+
+	// all but the last chunk have expired
+	a.prune(t0.Add(2 * time.Hour))
+	chunks, _ = archiveChunks(filepath.Join(dir, name))
+	if len(chunks) != 1 {
+		t.Errorf("prune: got %d chunks, expected 1", len(chunks))
+	}
+}
@@ -2,12 +2,18 @@ package main
 
 // #cgo CPPFLAGS: -I${SRCDIR}/deps/include
 // #cgo LDFLAGS: ${SRCDIR}/deps/lib/liberfa.a -lm
+// #include <stdlib.h>
 // #include "erfa.h"
 import "C"
 
 import (
+	"encoding/json"
 	"fmt"
+	"log"
 	"math"
+	"net/http"
+	"time"
+	"unsafe"
 )
 
 const (
@@ -39,11 +45,14 @@ func AzEl2RADec(unixtime, az, el float64) (float64, float64, error) {
 	xp := 0.0
 	yp := 0.0
 
+	typ := C.CString("A")
+	defer C.free(unsafe.Pointer(typ))
+
 	var ra, dec C.double
 
 	// Observed place at a groundbased site to to ICRS astrometric RA,Dec.
 	stat := C.eraAtoc13(
-		C.CString("A"),           // ob1 and ob2 are azimuth and zenith distance
+		typ,                      // ob1 and ob2 are azimuth and zenith distance
 		C.double(deg2rad(az)),    // observed Az (radians; Az is N=0,E=90)
 		C.double(deg2rad(90-el)), // observed ZD (radians)
 		C.double(utc1),           // UTC as a 2-part...
@@ -76,9 +85,57 @@ func AzEl2RADec(unixtime, az, el float64) (float64, float64, error) {
 	return rad2deg(float64(ra)), rad2deg(float64(dec)), err
 }
 
+// AzEl2AppRADec converts topocentric (i.e., unrefracted) Az/El to apparent
+// RA/Dec, referred to the true equator and equinox of date, taking UT1 = UTC.
+// All angles are in degrees.
+func AzEl2AppRADec(unixtime, az, el float64) (float64, float64, error) {
+	tt1, tt2, err := unixtime2TT(unixtime)
+	if err != nil {
+		return 0, 0, err
+	}
+	typ := C.CString("A")
+	defer C.free(unsafe.Pointer(typ))
+
+	var ri, di C.double
+
+	// Observed place to CIRS RA,Dec.
+	stat := C.eraAtoi13(
+		typ,                      // ob1 and ob2 are azimuth and zenith distance
+		C.double(deg2rad(az)),    // observed Az (radians; Az is N=0,E=90)
+		C.double(deg2rad(90-el)), // observed ZD (radians)
+		UNIX_JD_EPOCH,            // UTC as a 2-part...
+		C.double(unixtime/86400), // ...quasi Julian Date
+		0,                        // UT1-UTC (seconds)
+		FYST_LONGITUDE_EAST_RAD,  // longitude (radians, east +ve)
+		FYST_LATITUDE_RAD,        // geodetic latitude (radians)
+		FYST_ELEVATION_METERS,    // height above ellipsoid (m, geodetic)
+		0,                        // polar motion coordinates (radians)
+		0,                        // polar motion coordinates (radians)
+		0,                        // pressure at the observer (hPa = mB), i.e. no refraction
+		0,                        // ambient temperature at the observer (deg C)
+		0,                        // relative humidity at the observer (range 0-1)
+		0,                        // wavelength (micrometers)
+		&ri,                      // CIRS RA (radians)
+		&di)                      // CIRS Dec (radians)
+	if stat < 0 {
+		return 0, 0, fmt.Errorf("eraAtoi13: unacceptable date")
+	}
+
+	// the equation of the origins takes CIRS RA to apparent RA
+	ra := C.eraAnp(ri - C.eraEo06a(C.double(tt1), C.double(tt2)))
+	return rad2deg(float64(ra)), rad2deg(float64(di)), nil
+}
+
 // RADec2AzEl converts ICRS RA/Dec to topocentric (i.e., unrefracted) Az/El.
 // All angles are in degrees.
 func RADec2AzEl(unixtime, ra, dec float64) (float64, float64, error) {
+	return radecpm2AzEl(unixtime, ra, dec, 0, 0, 0, 0)
+}
+
+// radecpm2AzEl is RADec2AzEl for a J2000.0 position with proper motion
+// pr,pd (dRA/dt and dDec/dt, radians/year), parallax px (arcsec),
+// and radial velocity rv (km/s).
+func radecpm2AzEl(unixtime, ra, dec, pr, pd, px, rv float64) (float64, float64, error) {
 	utc1 := UNIX_JD_EPOCH
 	utc2 := unixtime / 86400
 	dut1 := 0.0
@@ -91,10 +148,10 @@ func RADec2AzEl(unixtime, ra, dec float64) (float64, float64, error) {
 	stat := C.eraAtco13(
 		C.double(deg2rad(ra)),   // ICRS right ascension at J2000.0 (radians, Note 1)
 		C.double(deg2rad(dec)),  // ICRS declination at J2000.0 (radians, Note 1)
-		0,                       // RA proper motion (radians/year; Note 2)
-		0,                       // Dec proper motion (radians/year)
-		0,                       // parallax (arcsec)
-		0,                       // radial velocity (km/s, +ve if receding)
+		C.double(pr),            // RA proper motion (radians/year; Note 2)
+		C.double(pd),            // Dec proper motion (radians/year)
+		C.double(px),            // parallax (arcsec)
+		C.double(rv),            // radial velocity (km/s, +ve if receding)
 		C.double(utc1),          // UTC as a 2-part...
 		C.double(utc2),          // ...quasi Julian Date (Notes 3-4)
 		C.double(dut1),          // UT1-UTC (seconds, Note 5)
@@ -128,3 +185,128 @@ func RADec2AzEl(unixtime, ra, dec float64) (float64, float64, error) {
 
 	return rad2deg(float64(aob)), 90 - rad2deg(float64(zob)), err
 }
+
+// LST returns the local apparent sidereal time in hours,
+// taking UT1 = UTC.
+func LST(unixtime float64) (float64, error) {
+	tt1, tt2, err := unixtime2TT(unixtime)
+	if err != nil {
+		return 0, err
+	}
+	gst := float64(C.eraGst06a(UNIX_JD_EPOCH, C.double(unixtime/86400), C.double(tt1), C.double(tt2)))
+	lst := math.Mod(rad2deg(gst)+FYST_LONGITUDE_EAST_DEG+360, 360)
+	return lst / 15, nil
+}
+
+// A Star is an ICRS catalog position with space motion.
+type Star struct {
+	RA             float64 // [deg]
+	Dec            float64 // [deg]
+	PMRA           float64 // proper motion in RA, times cos(Dec) [mas/yr]
+	PMDec          float64 // proper motion in Dec [mas/yr]
+	Parallax       float64 // [mas]
+	RadialVelocity float64 // [km/s]
+	Epoch          float64 // Julian epoch of the position; 0 means J2000.0
+}
+
+const MAS_PER_RAD = 180 * 3600e3 / math.Pi
+
+// StarAzEl converts a catalog position to topocentric (i.e., unrefracted) Az/El,
+// applying proper motion, parallax, and radial velocity.
+// All angles are in degrees.
+func StarAzEl(unixtime float64, star Star) (float64, float64, error) {
+	ra := deg2rad(star.RA)
+	dec := deg2rad(star.Dec)
+	pr := star.PMRA / MAS_PER_RAD / math.Cos(dec)
+	pd := star.PMDec / MAS_PER_RAD
+	px := star.Parallax / 1e3
+	rv := star.RadialVelocity
+
+	// eraAtco13 wants the position at J2000.0
+	if star.Epoch != 0 && star.Epoch != 2000 {
+		const j2000 = 2451545.0
+		ep1 := j2000 + (star.Epoch-2000)*365.25
+		var ra2, dec2, pr2, pd2, px2, rv2 C.double
+		stat := C.eraPmsafe(C.double(ra), C.double(dec), C.double(pr), C.double(pd), C.double(px), C.double(rv),
+			C.double(ep1), 0, j2000, 0, &ra2, &dec2, &pr2, &pd2, &px2, &rv2)
+		if stat < 0 || stat&4 != 0 {
+			return 0, 0, fmt.Errorf("eraPmsafe: failed to propagate from epoch %g", star.Epoch)
+		}
+		ra, dec, pr, pd, px, rv = float64(ra2), float64(dec2), float64(pr2), float64(pd2), float64(px2), float64(rv2)
+	}
+
+	return radecpm2AzEl(unixtime, rad2deg(ra), rad2deg(dec), pr, pd, px, rv)
+}
+
+// ICRS2Galactic converts ICRS RA/Dec to Galactic l/b, in degrees.
+func ICRS2Galactic(ra, dec float64) (float64, float64) {
+	var l, b C.double
+	C.eraIcrs2g(C.double(deg2rad(ra)), C.double(deg2rad(dec)), &l, &b)
+	return rad2deg(float64(l)), rad2deg(float64(b))
+}
+
+// Sky2ICRS converts x,y in a celestial coordinate system to ICRS RA/Dec:
+// "ICRS" (RA/Dec), "Galactic" (l/b), or "Ecliptic" (J2000 mean ecliptic
+// longitude/latitude). All angles are in degrees.
+func Sky2ICRS(coordsys string, x, y float64) (float64, float64, error) {
+	var ra, dec C.double
+	switch coordsys {
+	case "ICRS":
+		return x, y, nil
+	case "Galactic":
+		C.eraG2icrs(C.double(deg2rad(x)), C.double(deg2rad(y)), &ra, &dec)
+	case "Ecliptic":
+		const j2000 = 2451545.0
+		C.eraEceq06(j2000, 0, C.double(deg2rad(x)), C.double(deg2rad(y)), &ra, &dec)
+	default:
+		return 0, 0, fmt.Errorf("bad celestial coordinate system: %s", coordsys)
+	}
+	return rad2deg(float64(ra)), rad2deg(float64(dec)), nil
+}
+
+// serveTelescopePosition serves the site's position.
+func serveTelescopePosition() http.HandlerFunc {
+	type MeasurementFloat struct {
+		Name        string
+		Description string
+		Unit        string
+		Value       float64
+		Created     time.Time
+	}
+
+	var tel_pos = []MeasurementFloat{
+		{
+			Name:        "Elevation",
+			Description: "Telescope height above sea level",
+			Unit:        "meters",
+			Value:       FYST_ELEVATION_METERS,
+			Created:     time.Now(),
+		},
+		{
+			Name:        "Latitude",
+			Description: "Telescope latitude",
+			Unit:        "degrees",
+			Value:       FYST_LATITUDE_DEG,
+			Created:     time.Now(),
+		},
+		{
+			Name:        "Longitude",
+			Description: "Telescope longitude with positive east",
+			Unit:        "degrees",
+			Value:       FYST_LONGITUDE_EAST_DEG,
+			Created:     time.Now(),
+		},
+	}
+
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := json.NewEncoder(w).Encode(&tel_pos)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
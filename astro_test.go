@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSky2ICRS(t *testing.T) {
+	const tol = 1e-4 // [deg]
+	for _, test := range []struct {
+		coordsys string
+		x, y     float64
+		ra, dec  float64
+	}{
+		{"ICRS", 123.4, -56.7, 123.4, -56.7},
+		// the Galactic center and north pole
+		{"Galactic", 0, 0, 266.40499, -28.93617},
+		{"Galactic", 0, 90, 192.85948, 27.12825},
+		// the equinox, and the solstice at the J2000 obliquity (84381.406")
+		{"Ecliptic", 0, 0, 0, 0},
+		{"Ecliptic", 90, 0, 90, 84381.406 / 3600},
+	} {
+		ra, dec, err := Sky2ICRS(test.coordsys, test.x, test.y)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if sep := angularSeparation(ra, dec, test.ra, test.dec); sep > tol {
+			t.Errorf("%s %g,%g: got %.5f,%.5f, expected %.5f,%.5f", test.coordsys, test.x, test.y, ra, dec, test.ra, test.dec)
+		}
+	}
+
+	// round trips through Galactic
+	for ra := 0.0; ra < 360; ra += 45 {
+		for dec := -80.0; dec <= 80; dec += 40 {
+			l, b := ICRS2Galactic(ra, dec)
+			ra1, dec1, err := Sky2ICRS("Galactic", l, b)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sep := angularSeparation(ra, dec, ra1, dec1); sep > 1e-9 || math.IsNaN(sep) {
+				t.Errorf("%g,%g: got %g,%g back", ra, dec, ra1, dec1)
+			}
+		}
+	}
+
+	if _, _, err := Sky2ICRS("FK4", 0, 0); err == nil {
+		t.Error("FK4 accepted")
+	}
+}
+
+func TestStarAzElEpoch(t *testing.T) {
+	// Barnard's star, the fastest proper motion: Hipparcos (ESA 1997)
+	// at epoch J1991.25, and at J2000.0 (SIMBAD, with van Leeuwen 2007's
+	// space motion), agree to within their motions' differences, about
+	// 1 mas/yr, so 0.05 arcsec by 2024
+	hip := Star{RA: 269.45402305, Dec: 4.66828815, PMRA: -797.84, PMDec: 10326.93, Parallax: 549.01, RadialVelocity: -110.6, Epoch: 1991.25}
+	j2000 := Star{RA: 269.45207511, Dec: 4.69339088, PMRA: -798.58, PMDec: 10328.12, Parallax: 548.31, RadialVelocity: -110.6}
+	ut := Time2Unixtime(time.Date(2024, 6, 1, 4, 0, 0, 0, time.UTC))
+	az0, el0, err := StarAzEl(ut, j2000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	az1, el1, err := StarAzEl(ut, hip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sep := angularSeparation(az0, el0, az1, el1) * 3600; sep > 0.1 || math.IsNaN(sep) {
+		t.Errorf("J1991.25 and J2000.0 positions %.3f arcsec apart", sep)
+	}
+
+	// the 8.75 years of proper motion matter, about 90.6 arcsec
+	hip.Epoch = 0
+	az1, el1, err = StarAzEl(ut, hip)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sep := angularSeparation(az0, el0, az1, el1) * 3600; math.Abs(sep-90.6) > 0.5 {
+		t.Errorf("J1991.25 position taken as J2000.0 %.1f arcsec away, expected 90.6", sep)
+	}
+}
@@ -0,0 +1,398 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A Role is what a client may do. Each role may do everything
+// the roles below it may.
+type Role int
+
+const (
+	roleNone     Role = iota
+	roleObserver      // read status, submit scans
+	roleOperator      // stow, overrides, limit changes
+	roleEngineer      // low-level ACU access
+)
+
+var roleNames = []string{"none", "observer", "operator", "engineer"}
+
+func (r Role) String() string {
+	if r < 0 || int(r) >= len(roleNames) {
+		return fmt.Sprintf("Role(%d)", int(r))
+	}
+	return roleNames[r]
+}
+
+func (r Role) MarshalJSON() ([]byte, error) {
+	return json.Marshal(r.String())
+}
+
+func (r *Role) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	for i, name := range roleNames {
+		if s == name && i != int(roleNone) {
+			*r = Role(i)
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown role %q", s)
+}
+
+// A Principal is an authenticated client.
+type Principal struct {
+	Name string `json:"name"`
+	Role Role   `json:"role"`
+}
+
+// the roles needed to POST to endpoints, if more than roleObserver
+var endpointRoles = map[string]Role{
+	"/acu/failure-reset":       roleEngineer,
+	"/acu/position-broadcast":  roleEngineer,
+	"/acu/raw":                 roleEngineer,
+	"/acu/reboot":              roleEngineer,
+	"/alarms/ack":              roleOperator,
+	"/catalog":                 roleOperator,
+	"/catalog/delete":          roleOperator,
+	"/clear-track":             roleEngineer,
+	"/config/reload":           roleEngineer,
+	"/encoder-zero":            roleEngineer,
+	"/encoder-zero/measure":    roleEngineer,
+	"/encoder-zero/revert":     roleEngineer,
+	"/emergency-stop/release":  roleOperator,
+	"/hexapod":                 roleOperator,
+	"/limits":                  roleOperator,
+	"/limits/clear":            roleOperator,
+	"/limits/overrides":        roleOperator,
+	"/limits/overrides/revoke": roleOperator,
+	"/maintenance":             roleOperator,
+	"/pointing-model":          roleOperator,
+	"/pointing-model/approve":  roleOperator,
+	"/pointing-model/reject":   roleOperator,
+	"/refraction":              roleOperator,
+	"/shutdown":                roleOperator,
+	"/shutter":                 roleOperator,
+	"/shutter/override":        roleOperator,
+	"/startup":                 roleOperator,
+	"/stow":                    roleOperator,
+	"/sun-avoidance":           roleOperator,
+	"/templates":               roleOperator,
+	"/templates/delete":        roleOperator,
+	"/tilt":                    roleOperator,
+	"/wind-stow":               roleOperator,
+}
+
+// endpoints open to anyone, for supervisors and monitoring
+var publicEndpoints = map[string]bool{
+	"/healthz": true,
+	"/readyz":  true,
+}
+
+// endpoints which move the telescope, so need the operator lock,
+// besides motion commands (see submitCommand)
+var lockedEndpoints = map[string]bool{
+	"/encoder-zero":         true,
+	"/encoder-zero/measure": true,
+	"/encoder-zero/revert":  true,
+	"/offsets":              true,
+	"/offsets/clear":        true,
+	"/pause":                true,
+	"/resume":               true,
+}
+
+func requiredRole(method, endpoint string) Role {
+	if method == "GET" {
+		return roleObserver
+	}
+	if r, ok := endpointRoles[endpoint]; ok {
+		return r
+	}
+	return roleObserver
+}
+
+// commandRole returns the role needed to POST cmd to endpoint, which
+// may be more than requiredRole for a command running others, with the
+// endpoint needing it.
+func commandRole(endpoint string, cmd Command) (Role, string) {
+	r := requiredRole("POST", endpoint)
+	var endpoints []string
+	var nested []Command
+	switch c := cmd.(type) {
+	case sequenceCmd:
+		endpoints, nested = c.endpoints, c.Commands
+	case chainCmd:
+		endpoints = c.endpoints
+		for _, c1 := range c.Commands {
+			nested = append(nested, c1)
+		}
+	}
+	for i := range endpoints {
+		if r1, e1 := commandRole(endpoints[i], nested[i]); r1 > r {
+			r, endpoint = r1, e1
+		}
+	}
+	return r, endpoint
+}
+
+// Auth authenticates clients by bearer token.
+type Auth struct {
+	tokens map[string]Principal
+	lock   *OperatorLock
+}
+
+// LoadAuth reads a JSON list of tokens, like
+//
+//	[{"token": "...", "name": "alice", "role": "operator"}, ...]
+func LoadAuth(filename string) (*Auth, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var entries []struct {
+		Token string `json:"token"`
+		Principal
+	}
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&entries)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	a := &Auth{
+		tokens: make(map[string]Principal),
+		lock:   &OperatorLock{},
+	}
+	for _, e := range entries {
+		if e.Token == "" || e.Name == "" {
+			return nil, fmt.Errorf("%s: token and name required", filename)
+		}
+		a.tokens[e.Token] = e.Principal
+	}
+	return a, nil
+}
+
+// Authenticate returns the principal for a token.
+func (a *Auth) Authenticate(token string) (*Principal, error) {
+	p, ok := a.tokens[token]
+	if !ok {
+		return nil, fmt.Errorf("unauthorized")
+	}
+	return &p, nil
+}
+
+// Authorize checks p may POST (or GET) to endpoint.
+func (a *Auth) Authorize(p *Principal, method, endpoint string) error {
+	if r := requiredRole(method, endpoint); p.Role < r {
+		return &RoleError{endpoint, r, p}
+	}
+	return nil
+}
+
+// A RoleError is a client without the role an endpoint needs.
+type RoleError struct {
+	Endpoint  string
+	Role      Role
+	Principal *Principal
+}
+
+func (e *RoleError) Error() string {
+	return fmt.Sprintf("%s needs role %s: %s is %s", e.Endpoint, e.Role, e.Principal.Name, e.Principal.Role)
+}
+
+// checkCommandRole checks p may POST cmd to endpoint (see commandRole).
+// Without authentication p is nil, and may do anything.
+func checkCommandRole(p *Principal, endpoint string, cmd Command) error {
+	if r, e := commandRole(endpoint, cmd); p != nil && p.Role < r {
+		return &RoleError{e, r, p}
+	}
+	return nil
+}
+
+// requestToken gets the bearer token, or for WebSocket clients
+// which can't set headers, the access_token query parameter.
+func requestToken(req *http.Request) string {
+	const prefix = "Bearer "
+	if h := req.Header.Get("Authorization"); strings.HasPrefix(h, prefix) {
+		return strings.TrimPrefix(h, prefix)
+	}
+	return req.URL.Query().Get("access_token")
+}
+
+// clientName returns p's name, or "" without authentication.
+func clientName(p *Principal) string {
+	if p == nil {
+		return ""
+	}
+	return p.Name
+}
+
+type principalKey struct{}
+
+// principalFrom returns the request's principal, or nil without authentication.
+func principalFrom(ctx context.Context) *Principal {
+	p, _ := ctx.Value(principalKey{}).(*Principal)
+	return p
+}
+
+// Handler authenticates and authorizes requests to next.
+// A nil Auth allows everything.
+func (a *Auth) Handler(next http.Handler) http.Handler {
+	if a == nil {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "GET" && publicEndpoints[req.URL.Path] {
+			next.ServeHTTP(w, req)
+			return
+		}
+		p, err := a.Authenticate(requestToken(req))
+		if err != nil {
+			jsonResponse(w, err, http.StatusUnauthorized)
+			return
+		}
+		// the same endpoints of other telescopes need the same roles
+		_, endpoint := splitTelescopePath(req.URL.Path)
+		err = a.Authorize(p, req.Method, endpoint)
+		if err != nil {
+			jsonResponse(w, err, http.StatusForbidden)
+			return
+		}
+		if req.Method == "POST" && lockedEndpoints[endpoint] {
+			err = a.lock.Check(p)
+			if err != nil {
+				jsonResponse(w, err, http.StatusLocked)
+				return
+			}
+		}
+		ctx := context.WithValue(req.Context(), principalKey{}, p)
+		next.ServeHTTP(w, req.WithContext(ctx))
+	})
+}
+
+// CheckLock checks p holds the operator lock. Without authentication
+// there's no lock.
+func (a *Auth) CheckLock(p *Principal) error {
+	if a == nil {
+		return nil
+	}
+	return a.lock.Check(p)
+}
+
+// An OperatorLock makes sure only one client commands motion.
+type OperatorLock struct {
+	mu     sync.Mutex
+	holder string
+	since  time.Time
+}
+
+func (l *OperatorLock) Check(p *Principal) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder != p.Name {
+		return l.lockedError(p)
+	}
+	return nil
+}
+
+func (l *OperatorLock) lockedError(p *Principal) error {
+	if l.holder == "" {
+		return fmt.Errorf("%s doesn't hold the operator lock, see /lock", p.Name)
+	}
+	return fmt.Errorf("operator lock held by %s since %s", l.holder, l.since.UTC().Format(time.RFC3339))
+}
+
+// Acquire takes the lock for p. Operators may take it from another holder.
+func (l *OperatorLock) Acquire(p *Principal, force bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder == p.Name {
+		return nil
+	}
+	if l.holder != "" && !(force && p.Role >= roleOperator) {
+		return l.lockedError(p)
+	}
+	l.holder, l.since = p.Name, time.Now()
+	return nil
+}
+
+// Release releases p's lock. Operators may release another holder's.
+func (l *OperatorLock) Release(p *Principal, force bool) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.holder != p.Name && !(force && p.Role >= roleOperator) {
+		return l.lockedError(p)
+	}
+	l.holder = ""
+	return nil
+}
+
+// Holder returns who holds the lock and since when, if anyone.
+func (l *OperatorLock) Holder() (string, time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.holder, l.since
+}
+
+// serveLock serves the operator lock.
+func serveLock(auth *Auth) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if auth == nil {
+			err := fmt.Errorf("authentication not enabled")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Holder string     `json:"holder,omitempty"`
+				Since  *time.Time `json:"since,omitempty"`
+			}
+			holder, since := auth.lock.Holder()
+			if holder != "" {
+				response.Holder, response.Since = holder, &since
+			}
+			err := json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Release bool `json:"release"`
+				Force   bool `json:"force"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			p := principalFrom(req.Context())
+			if x.Release {
+				err = auth.lock.Release(p, x.Force)
+			} else {
+				err = auth.lock.Acquire(p, x.Force)
+			}
+			if err == nil {
+				log.Printf("operator lock: release=%v force=%v by %s", x.Release, x.Force, p.Name)
+			}
+			jsonResponse(w, err, http.StatusLocked)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	}
+}
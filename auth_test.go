@@ -0,0 +1,105 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestAuth(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "tokens.json")
+	err := os.WriteFile(filename, []byte(`[
+		{"token": "t1", "name": "alice", "role": "observer"},
+		{"token": "t2", "name": "bob", "role": "operator"}
+	]`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	auth, err := LoadAuth(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	alice, _ := auth.Authenticate("t1")
+	bob, _ := auth.Authenticate("t2")
+
+	handler := auth.Handler(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {}))
+	for _, tc := range []struct {
+		method, path, token string
+		code                int
+	}{
+		{"GET", "/acu/status", "", http.StatusUnauthorized},
+		{"GET", "/acu/status", "bogus", http.StatusUnauthorized},
+		{"GET", "/acu/status", "t1", http.StatusOK},
+		{"POST", "/track", "t1", http.StatusOK},
+		{"POST", "/stow", "t1", http.StatusForbidden},
+		{"POST", "/stow", "t2", http.StatusOK},
+		{"POST", "/acu/reboot", "t2", http.StatusForbidden},
+		{"POST", "/acu/raw", "t2", http.StatusForbidden},
+		{"POST", "/emergency-stop/release", "t1", http.StatusForbidden},
+		{"POST", "/shutter/override", "t1", http.StatusForbidden},
+		{"POST", "/telescopes/calib/stow", "t1", http.StatusForbidden},
+		{"POST", "/telescopes/calib/stow", "t2", http.StatusOK},
+		{"POST", "/pause", "t1", http.StatusLocked},
+		{"GET", "/readyz", "", http.StatusOK},
+		{"POST", "/readyz", "", http.StatusUnauthorized},
+	} {
+		req := httptest.NewRequest(tc.method, tc.path, nil)
+		if tc.token != "" {
+			req.Header.Set("Authorization", "Bearer "+tc.token)
+		}
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, req)
+		if w.Code != tc.code {
+			t.Errorf("%s %s with %q: got %d, expected %d", tc.method, tc.path, tc.token, w.Code, tc.code)
+		}
+	}
+
+	lock := auth.lock
+	if lock.Check(alice) == nil {
+		t.Error("Check: expected error without the lock")
+	}
+	if err := lock.Acquire(alice, false); err != nil {
+		t.Fatal(err)
+	}
+	if lock.Check(alice) != nil || lock.Check(bob) == nil {
+		t.Error("Check: only alice should hold the lock")
+	}
+	if lock.Acquire(bob, false) == nil {
+		t.Error("Acquire: expected error, lock held")
+	}
+	if err := lock.Acquire(bob, true); err != nil {
+		t.Errorf("Acquire: operator should be able to force: %v", err)
+	}
+	if lock.Release(alice, true) == nil {
+		t.Error("Release: observer shouldn't be able to force")
+	}
+	if err := lock.Release(bob, false); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestCommandRole(t *testing.T) {
+	for _, tc := range []struct {
+		endpoint, body string
+		role           Role
+		needs          string
+	}{
+		{"/track", `{"ra": 10, "dec": 20}`, roleObserver, "/track"},
+		{"/stow", `{}`, roleOperator, "/stow"},
+		{"/sequence", `{"commands": [{"command": "/track", "args": {"ra": 10, "dec": 20}}]}`, roleObserver, "/sequence"},
+		{"/sequence", `{"commands": [{"command": "/track", "args": {"ra": 10, "dec": 20}}, {"command": "/shutdown", "args": {}}]}`, roleOperator, "/shutdown"},
+		{"/sequence", `{"commands": [{"command": "/sequence", "args": {"commands": [{"command": "/stow", "args": {}}]}}]}`, roleOperator, "/stow"},
+	} {
+		cmd, err := decodeCommand(tc.endpoint, strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatalf("%s %s: %v", tc.endpoint, tc.body, err)
+		}
+		r, e := commandRole(tc.endpoint, cmd)
+		if r != tc.role || e != tc.needs {
+			t.Errorf("%s %s: got %s for %s, expected %s for %s", tc.endpoint, tc.body, r, e, tc.role, tc.needs)
+		}
+	}
+}
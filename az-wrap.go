@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"time"
+)
+
+// The azimuth range [azimuthMin,azimuthMax] covers more than a full turn,
+// so some azimuths can be reached on two wraps. The cable wrap is neutral
+// in the middle of the range.
+func azimuthCableCenter() float64 {
+	return (azimuthMin + azimuthMax) / 2
+}
+
+// An AzWrapScanPattern unwraps the azimuths of a celestial pattern,
+// so it doesn't jump by 360 deg when crossing north, and shifts them
+// by a whole number of turns to keep the pattern within the azimuth limits.
+type AzWrapScanPattern struct {
+	pattern ScanPattern
+	offset  float64 // [deg]
+}
+
+// wrapAzimuth wraps a pattern in coordinate system coordsys.
+// wrap is "low" or "high" to force the lowest or highest wrap that fits;
+// by default the wrap closest to azimuthCableCenter is chosen.
+// Horizon patterns are returned unchanged.
+func wrapAzimuth(pattern ScanPattern, coordsys, wrap string) (ScanPattern, error) {
+	if coordsys == "Horizon" {
+		if wrap != "" {
+			return nil, fmt.Errorf("az_wrap not allowed with Horizon coordinates")
+		}
+		return pattern, nil
+	}
+	return NewAzWrapScanPattern(pattern, wrap)
+}
+
+func NewAzWrapScanPattern(pattern ScanPattern, wrap string) (*AzWrapScanPattern, error) {
+	switch wrap {
+	case "", "low", "high":
+	default:
+		return nil, fmt.Errorf("bad az_wrap: %s", wrap)
+	}
+
+	// find the range of the unwrapped azimuths
+	scan := &AzWrapScanPattern{pattern: pattern}
+	lo, hi := math.Inf(1), math.Inf(-1)
+	sum, n := 0.0, 0
+	iter := scan.Iterator()
+	for !scan.Done(iter) {
+		var x ScanPatternSample
+		err := scan.Next(iter, &x)
+		if err != nil {
+			return nil, err
+		}
+		lo = math.Min(lo, x.Az)
+		hi = math.Max(hi, x.Az)
+		sum += x.Az
+		n++
+	}
+	if n == 0 {
+		return scan, nil
+	}
+
+	kmin := math.Ceil((azimuthMin - lo) / 360)
+	kmax := math.Floor((azimuthMax - hi) / 360)
+	if kmin > kmax {
+		return nil, fmt.Errorf("pattern spans %.1f deg of azimuth, and doesn't fit on any wrap", hi-lo)
+	}
+	var k float64
+	switch wrap {
+	case "low":
+		k = kmin
+	case "high":
+		k = kmax
+	default:
+		mean := sum / float64(n)
+		k = math.Round((azimuthCableCenter() - mean) / 360)
+		k = math.Max(kmin, math.Min(kmax, k))
+	}
+	scan.offset = 360 * k
+	return scan, nil
+}
+
+func (scan AzWrapScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{inner: scan.pattern.Iterator()}
+}
+
+func (scan AzWrapScanPattern) Delay(d time.Duration) ScanPattern {
+	scan.pattern = scan.pattern.(DelayableScanPattern).Delay(d)
+	return scan
+}
+
+func (scan AzWrapScanPattern) Done(iter *ScanPatternIterator) bool {
+	return scan.pattern.Done(iter.inner)
+}
+
+func (scan AzWrapScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	err := scan.pattern.Next(iter.inner, p)
+	if err != nil {
+		return err
+	}
+	// iter.next holds the previous sample, unwrapped but not offset
+	az := math.Mod(p.Az, 360)
+	if az < 0 {
+		az += 360
+	}
+	if prev := iter.next; prev != nil {
+		az = prev.Az + math.Remainder(az-prev.Az, 360)
+	}
+	x := *p
+	x.Az = az
+	iter.next = &x
+	iter.index++
+	p.Az = az + scan.offset
+	return nil
+}
@@ -0,0 +1,296 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"time"
+)
+
+// The TCS mirrors its status, alarms, and command lifecycle onto the
+// observatory's message bus, for the rest of the site software, and can
+// take commands from it. The bus is reached through a busTransport, of
+// which MQTT is the only one so far.
+
+const (
+	busReconnectInterval = 5 * time.Second
+	busKeepAlive         = 30 * time.Second
+	busQueueLen          = 100 // messages waiting to be published
+	defaultBusPrefix     = "fyst/tcs"
+	defaultBusClientID   = "fyst-tcs"
+	defaultBusStatusRate = 1 // [Hz]
+)
+
+// A BusConfig configures the message bus, e.g.
+//
+//	{"type": "mqtt", "addr": "broker:1883", "prefix": "fyst/tcs", "status_rate": 1, "commands": true}
+//
+// With authentication, commands from the bus are made by the client ID,
+// with Role (default observer).
+type BusConfig struct {
+	Type       string  `json:"type"`
+	Addr       string  `json:"addr"`
+	ClientID   string  `json:"client_id,omitempty"`
+	Username   string  `json:"username,omitempty"`
+	Password   string  `json:"password,omitempty"`
+	Prefix     string  `json:"prefix,omitempty"`      // of the topics
+	StatusRate float64 `json:"status_rate,omitempty"` // [Hz]
+	Commands   bool    `json:"commands,omitempty"`    // accepted from the bus
+	Role       Role    `json:"role,omitempty"`
+}
+
+func (c *BusConfig) check() error {
+	if c.Type != "mqtt" {
+		return fmt.Errorf("unknown bus type %q", c.Type)
+	}
+	if c.Addr == "" {
+		return fmt.Errorf("%s bus: addr required", c.Type)
+	}
+	if c.ClientID == "" {
+		c.ClientID = defaultBusClientID
+	}
+	c.Prefix = strings.TrimSuffix(c.Prefix, "/")
+	if c.Prefix == "" {
+		c.Prefix = defaultBusPrefix
+	}
+	if c.StatusRate == 0 {
+		c.StatusRate = defaultBusStatusRate
+	}
+	if c.StatusRate < statusStreamMinRate || c.StatusRate > statusStreamMaxRate {
+		return fmt.Errorf("bus status rate (%g Hz) out of range [%g,%g]", c.StatusRate, statusStreamMinRate, statusStreamMaxRate)
+	}
+	if c.Role == roleNone {
+		c.Role = roleObserver
+	}
+	return nil
+}
+
+func LoadBusConfig(filename string) (*BusConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var c BusConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err == nil {
+		err = c.check()
+	}
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &c, nil
+}
+
+// A busTransport is a connection to a message bus.
+type busTransport interface {
+	Publish(topic string, payload []byte, retain bool) error
+	Subscribe(filter string) error
+	Ping() error
+	Receive() (topic string, payload []byte, err error) // blocks
+	Close() error
+}
+
+func (c *BusConfig) dial() (busTransport, error) {
+	switch c.Type {
+	case "mqtt":
+		return dialMQTT(c.Addr, c.ClientID, c.Username, c.Password, busKeepAlive)
+	}
+	return nil, fmt.Errorf("unknown bus type %q", c.Type)
+}
+
+type busMessage struct {
+	topic   string
+	payload []byte
+}
+
+// A Bus publishes to the message bus, reconnecting as needed.
+// Messages are dropped while it's disconnected, except that the commands
+// which changed are published on reconnecting.
+type Bus struct {
+	config  BusConfig
+	stream  *StatusStream
+	tracker *CommandTracker
+	auth    *Auth
+	submit  func(p *Principal, endpoint string, body io.Reader) (string, int, error)
+
+	messages chan busMessage
+	changed  chan struct{}     // the tracker changed
+	states   map[string]string // the last published state of each command, by ID
+}
+
+func NewBus(config BusConfig, stream *StatusStream, tracker *CommandTracker, alarms *Alarms, auth *Auth,
+	submit func(p *Principal, endpoint string, body io.Reader) (string, int, error)) *Bus {
+	b := &Bus{
+		config:   config,
+		stream:   stream,
+		tracker:  tracker,
+		auth:     auth,
+		submit:   submit,
+		messages: make(chan busMessage, busQueueLen),
+		changed:  make(chan struct{}, 1),
+		states:   make(map[string]string),
+	}
+	for _, r := range tracker.List() {
+		b.states[r.ID] = r.State // e.g. restored, not news
+	}
+	alarms.OnEvent(func(e AlarmEvent) {
+		msg, _ := json.Marshal(e)
+		b.queue(b.topic("alarms"), msg)
+	})
+	tracker.OnChange(func() {
+		select {
+		case b.changed <- struct{}{}:
+		default: // already pending
+		}
+	})
+	return b
+}
+
+func (b *Bus) topic(name string) string {
+	return b.config.Prefix + "/" + name
+}
+
+// queue queues a message for publishing, without blocking.
+func (b *Bus) queue(topic string, payload []byte) {
+	select {
+	case b.messages <- busMessage{topic, payload}:
+	default:
+		log.Printf("bus: queue full, dropping %s message", topic)
+	}
+}
+
+func (b *Bus) Run() {
+	for {
+		err := b.session()
+		log.Printf("bus: %v, reconnecting in %v", err, busReconnectInterval)
+		time.Sleep(busReconnectInterval)
+	}
+}
+
+// session publishes until the connection fails.
+func (b *Bus) session() error {
+	conn, err := b.config.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	log.Printf("bus: connected to %s %s", b.config.Type, b.config.Addr)
+	sub, err := b.stream.Subscribe(b.config.StatusRate)
+	if err != nil {
+		return err
+	}
+	defer b.stream.Unsubscribe(sub)
+	if b.config.Commands {
+		err = conn.Subscribe(b.topic("command/#"))
+		if err != nil {
+			return err
+		}
+	}
+
+	// stopped by closing the connection
+	received := make(chan error, 1)
+	go func() {
+		for {
+			topic, payload, err := conn.Receive()
+			if err != nil {
+				received <- err
+				return
+			}
+			b.command(topic, payload)
+		}
+	}()
+
+	ping := time.NewTicker(busKeepAlive / 2)
+	defer ping.Stop()
+	err = b.publishCommands(conn)
+	for err == nil {
+		select {
+		case sample := <-sub.c:
+			var msg []byte
+			msg, err = encodeStatus(&sample, nil)
+			if err == nil {
+				err = conn.Publish(b.topic("status"), msg, true)
+			}
+		case m := <-b.messages:
+			err = conn.Publish(m.topic, m.payload, false)
+		case <-b.changed:
+			err = b.publishCommands(conn)
+		case <-ping.C:
+			err = conn.Ping()
+		case err = <-received:
+		}
+	}
+	return err
+}
+
+// publishCommands publishes the records of the commands whose state has
+// changed, without their arguments.
+func (b *Bus) publishCommands(conn busTransport) error {
+	list := b.tracker.List()
+	seen := make(map[string]bool, len(list))
+	for _, r := range list {
+		seen[r.ID] = true
+		if b.states[r.ID] == r.State {
+			continue
+		}
+		r.Args = nil
+		msg, err := json.Marshal(r)
+		if err != nil {
+			return err
+		}
+		err = conn.Publish(b.topic("commands"), msg, false)
+		if err != nil {
+			return err
+		}
+		b.states[r.ID] = r.State
+	}
+	for id := range b.states {
+		if !seen[id] {
+			delete(b.states, id) // forgotten by the tracker
+		}
+	}
+	return nil
+}
+
+// A busReply is the reply to a command from the bus, as the HTTP API's,
+// with the command's endpoint and metadata to tell which it was.
+type busReply struct {
+	Command  string            `json:"command"`
+	Status   string            `json:"status"`
+	Message  string            `json:"message,omitempty"`
+	ID       string            `json:"id,omitempty"`
+	Error    *FieldError       `json:"error,omitempty"`
+	Metadata map[string]string `json:"metadata,omitempty"`
+}
+
+// command submits a command received on <prefix>/command/<endpoint>,
+// and queues the reply.
+func (b *Bus) command(topic string, payload []byte) {
+	endpoint := "/" + strings.TrimPrefix(topic, b.topic("command/"))
+	var p *Principal
+	var err error
+	if b.auth != nil {
+		p = &Principal{Name: b.config.ClientID, Role: b.config.Role}
+		err = b.auth.Authorize(p, "POST", endpoint)
+	}
+	reply := busReply{Command: endpoint, Status: "ok"}
+	if err == nil {
+		reply.ID, _, err = b.submit(p, endpoint, bytes.NewReader(payload))
+	}
+	if err != nil {
+		reply.Status, reply.Message = "error", err.Error()
+		errors.As(err, &reply.Error)
+		log.Printf("bus: command %s: %v", endpoint, err)
+	}
+	reply.Metadata, _ = commandMetadata(payload)
+	msg, _ := json.Marshal(reply)
+	b.queue(b.topic("command-replies"), msg)
+}
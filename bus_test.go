@@ -0,0 +1,152 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMQTT(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// a broker which accepts the client and its subscription, sends it
+	// a message, and returns what it publishes
+	published := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+		first, b, err := c.readPacket()
+		if err != nil || first>>4 != mqttConnect || !strings.Contains(string(b), "fyst-tcs") {
+			t.Errorf("broker: got %x %q, %v, expected CONNECT", first, b, err)
+			return
+		}
+		c.write(mqttConnAck<<4, []byte{0, 0})
+		first, b, err = c.readPacket()
+		if err != nil || first != mqttSubscribe<<4|0x02 || !strings.Contains(string(b), "fyst/tcs/command/#") {
+			t.Errorf("broker: got %x %q, %v, expected SUBSCRIBE", first, b, err)
+			return
+		}
+		c.write(mqttSubAck<<4, []byte{0, 1, 0})
+		c.write(mqttPublish<<4, append(appendMQTTString(nil, "fyst/tcs/command/stow"), "{}"...))
+		first, b, err = c.readPacket()
+		if err == nil && first>>4 == mqttPublish {
+			published <- string(b[2:])
+		}
+	}()
+
+	c, err := dialMQTT(l.Addr().String(), "fyst-tcs", "", "", busKeepAlive)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	err = c.Subscribe("fyst/tcs/command/#")
+	if err != nil {
+		t.Fatal(err)
+	}
+	topic, payload, err := c.Receive()
+	if err != nil || topic != "fyst/tcs/command/stow" || string(payload) != "{}" {
+		t.Errorf("Receive: got %s %q, %v", topic, payload, err)
+	}
+	err = c.Publish("fyst/tcs/status", []byte(`{"Azimuth": 120}`), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case s := <-published:
+		if s != `fyst/tcs/status{"Azimuth": 120}` {
+			t.Errorf("Publish: broker got %q", s)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Publish: timed out")
+	}
+}
+
+// a busTransport recording what's published
+type fakeBus struct {
+	published []busMessage
+}
+
+func (f *fakeBus) Publish(topic string, payload []byte, retain bool) error {
+	f.published = append(f.published, busMessage{topic, payload})
+	return nil
+}
+func (f *fakeBus) Subscribe(filter string) error                { return nil }
+func (f *fakeBus) Ping() error                                  { return nil }
+func (f *fakeBus) Receive() (topic string, b []byte, err error) { return "", nil, io.EOF }
+func (f *fakeBus) Close() error                                 { return nil }
+
+func TestBus(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "bus.json")
+	err := os.WriteFile(filename, []byte(`{"type": "mqtt", "addr": "broker:1883", "commands": true}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config, err := LoadBusConfig(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if config.Prefix != defaultBusPrefix || config.StatusRate != defaultBusStatusRate || config.Role != roleObserver {
+		t.Errorf("LoadBusConfig: got %+v", config)
+	}
+	os.WriteFile(filename, []byte(`{"type": "wamp", "addr": "router:8080"}`), 0600)
+	if _, err := LoadBusConfig(filename); err == nil || !strings.Contains(err.Error(), "unknown bus type") {
+		t.Errorf("LoadBusConfig: got error %v, expected unknown bus type", err)
+	}
+
+	tracker := NewCommandTracker()
+	tracker.Add("restored", "/stow")
+	alarms := NewAlarms()
+	var submitted string
+	submit := func(p *Principal, endpoint string, body io.Reader) (string, int, error) {
+		submitted = endpoint
+		return "a", 200, nil
+	}
+	b := NewBus(*config, nil, tracker, alarms, nil, submit)
+
+	// only the commands which changed are published
+	var conn fakeBus
+	tracker.Add("a", "/move-to")
+	tracker.SetArgs("a", []byte(`{"azimuth": 120, "elevation": 60}`))
+	b.publishCommands(&conn)
+	tracker.Set("a", commandStarted, nil)
+	b.publishCommands(&conn)
+	b.publishCommands(&conn)
+	var states []string
+	for _, m := range conn.published {
+		var r CommandRecord
+		json.Unmarshal(m.payload, &r)
+		if m.topic != "fyst/tcs/commands" || r.ID != "a" || r.Args != nil {
+			t.Errorf("publishCommands: got %s %s", m.topic, m.payload)
+		}
+		states = append(states, r.State)
+	}
+	if strings.Join(states, ",") != "queued,started" {
+		t.Errorf("publishCommands: got states %v", states)
+	}
+
+	b.command("fyst/tcs/command/move-to", []byte(`{"azimuth": 120, "elevation": 60, "metadata": {"request": "42"}}`))
+	alarms.Raise("fault", severityCritical, true, "fault bits 1")
+	var reply busReply
+	m := <-b.messages
+	json.Unmarshal(m.payload, &reply)
+	if submitted != "/move-to" || m.topic != "fyst/tcs/command-replies" || reply.ID != "a" || reply.Metadata["request"] != "42" {
+		t.Errorf("command: submitted %s, replied %s %s", submitted, m.topic, m.payload)
+	}
+	if m := <-b.messages; m.topic != "fyst/tcs/alarms" || !strings.Contains(string(m.payload), `"raised"`) {
+		t.Errorf("alarm: got %s %s", m.topic, m.payload)
+	}
+}
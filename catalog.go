@@ -0,0 +1,228 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A CatalogEntry is a named source, at an ICRS catalog position with
+// space motion (see Star).
+type CatalogEntry struct {
+	Name           string  `json:"name"`
+	RA             float64 `json:"ra"`                        // [deg]
+	Dec            float64 `json:"dec"`                       // [deg]
+	PMRA           float64 `json:"pmra,omitempty"`            // times cos(Dec) [mas/yr]
+	PMDec          float64 `json:"pmdec,omitempty"`           // [mas/yr]
+	Parallax       float64 `json:"parallax,omitempty"`        // [mas]
+	RadialVelocity float64 `json:"radial_velocity,omitempty"` // [km/s]
+	Epoch          float64 `json:"epoch,omitempty"`           // Julian epoch, default J2000
+}
+
+func (e CatalogEntry) Star() Star {
+	return Star{
+		RA:             e.RA,
+		Dec:            e.Dec,
+		PMRA:           e.PMRA,
+		PMDec:          e.PMDec,
+		Parallax:       e.Parallax,
+		RadialVelocity: e.RadialVelocity,
+		Epoch:          e.Epoch,
+	}
+}
+
+func (e CatalogEntry) check() error {
+	switch {
+	case strings.TrimSpace(e.Name) == "":
+		return &FieldError{Field: "name", Reason: "required"}
+	case checkSolarSystemBody(e.Name) == nil:
+		return &FieldError{Field: "name", Reason: fmt.Sprintf("%s is a solar system body", e.Name)}
+	case !isFinite(e.RA) || e.RA < 0 || e.RA >= 360:
+		return rangeError("ra", 0, 360, "bad RA: %g", e.RA)
+	case !isFinite(e.Dec) || e.Dec < -90 || e.Dec > 90:
+		return rangeError("dec", -90, 90, "bad Dec: %g", e.Dec)
+	case !isFinite(e.PMRA) || !isFinite(e.PMDec) || !isFinite(e.RadialVelocity) || !isFinite(e.Epoch):
+		return fmt.Errorf("%s: space motion not finite", e.Name)
+	case !isFinite(e.Parallax) || e.Parallax < 0:
+		return fmt.Errorf("%s: bad parallax: %g", e.Name, e.Parallax)
+	}
+	return nil
+}
+
+// builtinCatalog are the sources known without a catalog file.
+var builtinCatalog = []CatalogEntry{
+	{Name: "RCW38", RA: 134.7729, Dec: -47.5108},
+	{Name: "OrionKL", RA: 83.8104, Dec: -5.3750},
+	{Name: "TauA", RA: 83.6331, Dec: 22.0145},
+	{Name: "SgrA*", RA: 266.4168, Dec: -29.0078},
+}
+
+// A Catalog maps source names, in any case, to their positions.
+// Changes are saved to its file, if any. It is safe for concurrent use.
+type Catalog struct {
+	mu      sync.Mutex
+	file    string
+	entries map[string]CatalogEntry // by lower case name
+}
+
+var siteCatalog = NewCatalog()
+
+// NewCatalog returns the built-in catalog.
+func NewCatalog() *Catalog {
+	c := &Catalog{entries: make(map[string]CatalogEntry)}
+	for _, e := range builtinCatalog {
+		c.entries[strings.ToLower(e.Name)] = e
+	}
+	return c
+}
+
+// Load replaces the catalog with the JSON list of entries in filename,
+// like
+//
+//	[{"name": "RCW38", "ra": 134.7729, "dec": -47.5108}, ...]
+//
+// and saves later changes there. A missing file leaves the built-in
+// catalog, and is created by the first change.
+func (c *Catalog) Load(filename string) error {
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		c.file = filename
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []CatalogEntry
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	entries := make(map[string]CatalogEntry, len(list))
+	for _, e := range list {
+		if err := e.check(); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		entries[strings.ToLower(e.Name)] = e
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.file, c.entries = filename, entries
+	return nil
+}
+
+func (c *Catalog) Get(name string) (CatalogEntry, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	e, ok := c.entries[strings.ToLower(name)]
+	return e, ok
+}
+
+// List returns the entries, by name.
+func (c *Catalog) List() []CatalogEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.list()
+}
+
+func (c *Catalog) list() []CatalogEntry {
+	list := make([]CatalogEntry, 0, len(c.entries))
+	for _, e := range c.entries {
+		list = append(list, e)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	return list
+}
+
+// Set adds or replaces an entry.
+func (c *Catalog) Set(e CatalogEntry) error {
+	err := e.check()
+	if err != nil {
+		return err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries[strings.ToLower(e.Name)] = e
+	return c.save()
+}
+
+// Delete removes an entry.
+func (c *Catalog) Delete(name string) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	key := strings.ToLower(name)
+	if _, ok := c.entries[key]; !ok {
+		return fmt.Errorf("unknown target %s", name)
+	}
+	delete(c.entries, key)
+	return c.save()
+}
+
+// save writes the catalog to its file, if any.
+func (c *Catalog) save() error {
+	if c.file == "" {
+		return nil
+	}
+	return writeJSONFile(c.file, c.list())
+}
+
+// serveCatalog serves the site catalog.
+func serveCatalog(mux *http.ServeMux) {
+	mux.HandleFunc("/catalog", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var v interface{} = siteCatalog.List()
+			if name := req.URL.Query().Get("name"); name != "" {
+				e, ok := siteCatalog.Get(name)
+				if !ok {
+					err := fmt.Errorf("unknown target %s", name)
+					jsonResponse(w, err, http.StatusNotFound)
+					return
+				}
+				v = e
+			}
+			err := json.NewEncoder(w).Encode(v)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var e CatalogEntry
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&e)
+			if err == nil {
+				log.Printf("setting catalog target: %+v", e)
+				err = siteCatalog.Set(e)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/catalog/delete", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Name string `json:"name"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			log.Printf("deleting catalog target %s", x.Name)
+			err = siteCatalog.Delete(x.Name)
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
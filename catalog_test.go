@@ -0,0 +1,54 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestCatalog(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "catalog.json")
+	c := NewCatalog()
+	if err := c.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := c.Get("rcw38"); !ok || e.Name != "RCW38" {
+		t.Errorf("built-in target: got %+v, %v", e, ok)
+	}
+
+	src := CatalogEntry{Name: "Proxima", RA: 217.4, Dec: -62.7, PMRA: -3781, PMDec: 770, Parallax: 768, Epoch: 2016}
+	if err := c.Set(src); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete("TauA"); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []CatalogEntry{
+		{Name: "", RA: 10},
+		{Name: "Jupiter", RA: 10},
+		{Name: "x", RA: 360},
+		{Name: "x", Dec: -91},
+		{Name: "x", Parallax: -1},
+	} {
+		if err := c.Set(bad); err == nil {
+			t.Errorf("bad entry accepted: %+v", bad)
+		}
+	}
+	if err := c.Delete("TauA"); err == nil {
+		t.Error("deleted an unknown target")
+	}
+
+	// the changes are saved
+	c2 := NewCatalog()
+	if err := c2.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if e, ok := c2.Get("PROXIMA"); !ok || e != src {
+		t.Errorf("got %+v, expected %+v", e, src)
+	}
+	if _, ok := c2.Get("TauA"); ok {
+		t.Error("deleted target restored")
+	}
+	if len(c2.List()) != len(builtinCatalog) {
+		t.Errorf("got %d targets, expected %d", len(c2.List()), len(builtinCatalog))
+	}
+}
@@ -0,0 +1,757 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// A FieldError is a machine-readable command error.
+type FieldError struct {
+	Field  string    `json:"field,omitempty"`
+	Reason string    `json:"reason"`
+	Limits []float64 `json:"limits,omitempty"`
+	msg    string
+}
+
+func (e *FieldError) Error() string {
+	if e.msg != "" {
+		return e.msg
+	}
+	if e.Field == "" {
+		return e.Reason
+	}
+	return fmt.Sprintf("%s: %s", e.Field, e.Reason)
+}
+
+// A LimitError is a commanded position or velocity outside an axis'
+// limits. The API reports it as a FieldError (see As).
+type LimitError struct {
+	Axis     string // azimuth, elevation, or rotator
+	Quantity string // position or velocity
+	Value    float64
+	Min, Max float64
+	Soft     bool // the soft limits, rather than the axis limits
+}
+
+func (e *LimitError) Error() string {
+	name := e.Axis
+	if e.Quantity == "velocity" {
+		name += " vel"
+	} else if e.Axis == "rotator" {
+		name += " angle"
+	}
+	if e.Soft {
+		return fmt.Sprintf("commanded %s (%g) outside the soft limits [%g,%g]", name, e.Value, e.Min, e.Max)
+	}
+	return fmt.Sprintf("commanded %s (%g) out of range [%g,%g]", name, e.Value, e.Min, e.Max)
+}
+
+// Field returns the name of the command field the error is about.
+func (e *LimitError) Field() string {
+	if e.Quantity == "velocity" {
+		return e.Axis + "_velocity"
+	}
+	return e.Axis
+}
+
+// As converts the error to a *FieldError, for errors.As.
+func (e *LimitError) As(target interface{}) bool {
+	fe, ok := target.(**FieldError)
+	if ok {
+		*fe = rangeError(e.Field(), e.Min, e.Max, "%s", e.Error())
+	}
+	return ok
+}
+
+// reasonNotFinite is the FieldError reason for NaN and ±Inf values,
+// as distinct from those out of range.
+const reasonNotFinite = "not finite"
+
+func isFinite(x float64) bool {
+	return !math.IsNaN(x) && !math.IsInf(x, 0)
+}
+
+func finiteError(field string, x float64) *FieldError {
+	return &FieldError{
+		Field:  field,
+		Reason: reasonNotFinite,
+		msg:    fmt.Sprintf("%s (%g) not finite", field, x),
+	}
+}
+
+func rangeError(field string, min, max float64, format string, a ...interface{}) *FieldError {
+	return &FieldError{
+		Field:  field,
+		Reason: "out of range",
+		Limits: []float64{min, max},
+		msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+// fieldError is a FieldError keeping the message it had as a plain error.
+func fieldError(field, reason, format string, a ...interface{}) *FieldError {
+	return &FieldError{
+		Field:  field,
+		Reason: reason,
+		msg:    fmt.Sprintf(format, a...),
+	}
+}
+
+const (
+	maxCommandSize  = 16 << 20 // bytes of JSON
+	maxCommandItems = 100000   // in any list, e.g. path points
+
+	maxMetadataKeys = 32
+	maxMetadataLen  = 1024 // bytes of each key and value
+
+	maxIdempotencyKeyLen = 256 // bytes
+)
+
+var (
+	errTooLarge    = fmt.Errorf("command larger than %d bytes", maxCommandSize)
+	errBadEndpoint = errors.New("bad endpoint")
+	errBusy        = errors.New("busy")
+	errShutdown    = errors.New("shutting down")
+)
+
+// newCommand returns the command for endpoint, with default values.
+func newCommand(endpoint string) (Command, error) {
+	switch endpoint {
+	case "/acu/position-broadcast":
+		return enablePositionBroadcastCmd{}, nil
+	case "/azimuth-scan":
+		return azScanCmd{}, nil
+	case "/chain":
+		return chainCmd{}, nil
+	case "/daisy-scan":
+		return daisyScanCmd{}, nil
+	case "/drift-scan":
+		return driftScanCmd{}, nil
+	case "/elevation-scan":
+		return elScanCmd{}, nil
+	case "/focus":
+		return focusCmd{}, nil
+	case "/focus-sweep":
+		return focusSweepCmd{}, nil
+	case "/lissajous-scan":
+		return lissajousScanCmd{}, nil
+	case "/maintenance":
+		return newMaintenanceCmd(), nil
+	case "/move-to":
+		return moveToCmd{}, nil
+	case "/path":
+		return pathCmd{}, nil
+	case "/pointing-scan":
+		return newPointingScanCmd(), nil
+	case "/raster-scan":
+		return rasterScanCmd{}, nil
+	case "/rotator":
+		return rotatorCmd{}, nil
+	case "/run-template":
+		return runTemplateCmd{}, nil
+	case "/scan-track":
+		return scanTrackCmd{}, nil
+	case "/sequence":
+		return sequenceCmd{}, nil
+	case "/shutdown":
+		return newShutdownCmd(), nil
+	case "/startup":
+		return newStartupCmd(), nil
+	case "/skydip":
+		return newSkydipCmd(), nil
+	case "/stow":
+		return newStowCmd(), nil
+	case "/track":
+		return trackCmd{}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", errBadEndpoint, endpoint)
+}
+
+// readCommand reads the JSON body of a command, up to maxCommandSize.
+func readCommand(r io.Reader) ([]byte, error) {
+	b, err := ioutil.ReadAll(io.LimitReader(r, maxCommandSize+1))
+	if err == nil && len(b) > maxCommandSize {
+		err = errTooLarge
+	}
+	return b, err
+}
+
+// decodeCommand decodes the JSON body of a command sent to endpoint,
+// and validates the values decoded (see validateValue). A /run-template
+// command decodes to its template's command.
+func decodeCommand(endpoint string, r io.Reader) (Command, error) {
+	cmd, err := newCommand(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	x := reflect.New(reflect.TypeOf(cmd))
+	x.Elem().Set(reflect.ValueOf(cmd))
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	var raw json.RawMessage
+	err = dec.Decode(&raw)
+	if err == nil && dec.More() {
+		err = &FieldError{Reason: "bad JSON: data after the command"}
+	}
+	if err == nil {
+		_, raw, err = splitMetadata(raw)
+	}
+	if err == nil {
+		_, raw, err = splitIdempotencyKey(raw)
+	}
+	if err == nil {
+		_, raw, err = splitIfBusy(raw)
+	}
+	if err == nil {
+		dec = json.NewDecoder(bytes.NewReader(raw))
+		dec.DisallowUnknownFields()
+		err = dec.Decode(x.Interface())
+	}
+	if err == nil {
+		err = validateValue("", x.Elem())
+	}
+	if err == nil {
+		var v interface{}
+		json.Unmarshal(raw, &v)
+		err = checkRequired(endpoint, v)
+		if err == nil {
+			err = checkArrayLengths("", x.Elem().Type(), v)
+		}
+	}
+	cmd = x.Elem().Interface().(Command)
+	if t, ok := cmd.(runTemplateCmd); ok && err == nil {
+		cmd = t.Command
+	}
+	return cmd, decodeError(err)
+}
+
+// Any command may carry a "metadata" object of strings, e.g. the
+// observation ID, project, observer and intent, which the TCS doesn't
+// interpret but records with the command, and reports while it runs, so
+// the data taken can be matched to it.
+
+// commandMetadata returns the metadata of a command's JSON body, if any.
+func commandMetadata(b []byte) (map[string]string, error) {
+	metadata, _, err := splitMetadata(b)
+	return metadata, err
+}
+
+// splitMetadata splits the metadata from the rest of a command's JSON
+// body. Bodies which aren't objects are left for decodeCommand to reject.
+func splitMetadata(b []byte) (map[string]string, []byte, error) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(b, &obj) != nil {
+		return nil, b, nil
+	}
+	raw, ok := obj["metadata"]
+	if !ok {
+		return nil, b, nil
+	}
+	var metadata map[string]string
+	err := json.Unmarshal(raw, &metadata)
+	if err != nil {
+		return nil, nil, &FieldError{Field: "metadata", Reason: "expected an object of strings"}
+	}
+	if len(metadata) > maxMetadataKeys {
+		return nil, nil, &FieldError{
+			Field:  "metadata",
+			Reason: "too many items",
+			Limits: []float64{0, maxMetadataKeys},
+			msg:    fmt.Sprintf("metadata: more than %d items", maxMetadataKeys),
+		}
+	}
+	for k, v := range metadata {
+		if k == "" || len(k) > maxMetadataLen || len(v) > maxMetadataLen {
+			return nil, nil, &FieldError{
+				Field:  "metadata",
+				Reason: fmt.Sprintf("empty key, or key or value longer than %d bytes", maxMetadataLen),
+			}
+		}
+	}
+	delete(obj, "metadata")
+	b, err = json.Marshal(obj)
+	return metadata, b, err
+}
+
+// Any command may also carry an "idempotency_key" string, chosen by the
+// client, so that resubmitting it, e.g. after a lost reply, returns the
+// command already queued rather than queueing another.
+
+// commandIdempotencyKey returns the idempotency key of a command's JSON
+// body, if any.
+func commandIdempotencyKey(b []byte) (string, error) {
+	key, _, err := splitIdempotencyKey(b)
+	return key, err
+}
+
+// splitIdempotencyKey splits the idempotency key from the rest of a
+// command's JSON body, as splitMetadata.
+func splitIdempotencyKey(b []byte) (string, []byte, error) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(b, &obj) != nil {
+		return "", b, nil
+	}
+	raw, ok := obj["idempotency_key"]
+	if !ok {
+		return "", b, nil
+	}
+	var key string
+	err := json.Unmarshal(raw, &key)
+	if err != nil || key == "" || len(key) > maxIdempotencyKeyLen {
+		return "", nil, &FieldError{
+			Field:  "idempotency_key",
+			Reason: fmt.Sprintf("expected a string of 1 to %d bytes", maxIdempotencyKeyLen),
+		}
+	}
+	delete(obj, "idempotency_key")
+	b, err = json.Marshal(obj)
+	return key, b, err
+}
+
+// Any command may also carry an "if_busy" policy, saying what to do if
+// another command is running when it's submitted.
+const (
+	ifBusyReject  = "reject"  // fail with a busy error, the default
+	ifBusyQueue   = "queue"   // run after the current and queued commands
+	ifBusyPreempt = "preempt" // abort the current command, and run once stopped
+)
+
+// commandIfBusy returns the if_busy policy of a command's JSON body.
+func commandIfBusy(b []byte) (string, error) {
+	policy, _, err := splitIfBusy(b)
+	return policy, err
+}
+
+// splitIfBusy splits the if_busy policy from the rest of a command's
+// JSON body, as splitMetadata.
+func splitIfBusy(b []byte) (string, []byte, error) {
+	var obj map[string]json.RawMessage
+	if json.Unmarshal(b, &obj) != nil {
+		return ifBusyReject, b, nil
+	}
+	raw, ok := obj["if_busy"]
+	if !ok {
+		return ifBusyReject, b, nil
+	}
+	var policy string
+	err := json.Unmarshal(raw, &policy)
+	switch {
+	case err != nil:
+	case policy == ifBusyReject, policy == ifBusyQueue, policy == ifBusyPreempt:
+		delete(obj, "if_busy")
+		b, err = json.Marshal(obj)
+		return policy, b, err
+	}
+	return "", nil, &FieldError{
+		Field:  "if_busy",
+		Reason: fmt.Sprintf("expected %s, %s or %s", ifBusyReject, ifBusyQueue, ifBusyPreempt),
+	}
+}
+
+// requiredFields are the fields which have no sensible default.
+var requiredFields = map[string][]string{
+	"/chain":        {"commands", "transition_time"},
+	"/drift-scan":   {"azimuth", "elevation", "duration"},
+	"/focus":        {"focus"},
+	"/focus-sweep":  {"focus", "command"},
+	"/move-to":      {"azimuth", "elevation"},
+	"/path":         {"coordsys", "points"},
+	"/rotator":      {"angle"},
+	"/run-template": {"name"},
+	"/skydip":       {"azimuth", "elevation_range", "speed"},
+}
+
+func checkRequired(endpoint string, v interface{}) error {
+	obj, _ := v.(map[string]interface{})
+	for _, name := range requiredFields[endpoint] {
+		if endpoint == "/move-to" && !movesAxis(obj, name) {
+			continue
+		}
+		found := false
+		for k := range obj {
+			found = found || strings.EqualFold(k, name)
+		}
+		if !found {
+			return &FieldError{Field: name, Reason: "required"}
+		}
+	}
+	return nil
+}
+
+// movesAxis returns false if a /move-to command obj moves only the
+// other axis than name.
+func movesAxis(obj map[string]interface{}, name string) bool {
+	for k, v := range obj {
+		if strings.EqualFold(k, "axis") {
+			axis, ok := v.(string)
+			return !ok || axis == "" || strings.EqualFold(axis, name)
+		}
+	}
+	return true
+}
+
+// checkArrayLengths checks the JSON lists decoded into fixed-size arrays
+// are the right length, which encoding/json doesn't: it drops extra
+// values, and zeroes missing ones.
+func checkArrayLengths(field string, t reflect.Type, v interface{}) error {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Array, reflect.Slice:
+		list, ok := v.([]interface{})
+		if !ok {
+			return nil
+		}
+		if t.Kind() == reflect.Array && len(list) != t.Len() {
+			return &FieldError{
+				Field:  field,
+				Reason: fmt.Sprintf("expected %d values, got %d", t.Len(), len(list)),
+			}
+		}
+		for _, x := range list {
+			err := checkArrayLengths(field, t.Elem(), x)
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		obj, ok := v.(map[string]interface{})
+		if !ok {
+			return nil
+		}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = f.Name
+			}
+			for k, x := range obj {
+				if strings.EqualFold(k, name) {
+					err := checkArrayLengths(strings.ToLower(name), f.Type, x)
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// validateValue checks what JSON can't rule out: that floats are finite,
+// and lists no longer than maxCommandItems. Command-specific checks are
+// left to Command.Check.
+func validateValue(field string, v reflect.Value) error {
+	switch v.Kind() {
+	case reflect.Float32, reflect.Float64:
+		if !isFinite(v.Float()) {
+			return finiteError(field, v.Float())
+		}
+	case reflect.Ptr:
+		if !v.IsNil() {
+			return validateValue(field, v.Elem())
+		}
+	case reflect.Slice, reflect.Array:
+		if v.Len() > maxCommandItems {
+			return &FieldError{
+				Field:  field,
+				Reason: "too many items",
+				Limits: []float64{0, maxCommandItems},
+				msg:    fmt.Sprintf("%s: more than %d items", field, maxCommandItems),
+			}
+		}
+		for i := 0; i < v.Len(); i++ {
+			err := validateValue(field, v.Index(i))
+			if err != nil {
+				return err
+			}
+		}
+	case reflect.Struct:
+		t := v.Type()
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			err := validateValue(name, v.Field(i))
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeError converts JSON decoding errors to FieldErrors.
+func decodeError(err error) error {
+	if err == nil {
+		return nil
+	}
+	var typeErr *json.UnmarshalTypeError
+	if errors.As(err, &typeErr) {
+		return &FieldError{
+			Field:  typeErr.Field,
+			Reason: fmt.Sprintf("expected %s, got %s", typeErr.Type, typeErr.Value),
+		}
+	}
+	const unknown = "json: unknown field "
+	if msg := err.Error(); strings.HasPrefix(msg, unknown) {
+		return &FieldError{
+			Field:  strings.Trim(strings.TrimPrefix(msg, unknown), `"`),
+			Reason: "unknown field",
+		}
+	}
+	var fieldErr *FieldError
+	if errors.As(err, &fieldErr) || errors.Is(err, errBadEndpoint) {
+		return err
+	}
+	return &FieldError{Reason: fmt.Sprintf("bad JSON: %v", err)}
+}
+
+// commandSchema returns a JSON schema for the command at endpoint.
+func commandSchema(endpoint string) (map[string]interface{}, error) {
+	cmd, err := newCommand(endpoint)
+	if err != nil {
+		return nil, err
+	}
+	schema := typeSchema(reflect.TypeOf(cmd))
+	if props, ok := schema["properties"].(map[string]interface{}); ok {
+		props["metadata"] = map[string]interface{}{
+			"type":                 "object",
+			"additionalProperties": map[string]interface{}{"type": "string"},
+		}
+		props["idempotency_key"] = map[string]interface{}{
+			"type":      "string",
+			"minLength": 1,
+			"maxLength": maxIdempotencyKeyLen,
+		}
+		props["if_busy"] = map[string]interface{}{
+			"enum": []string{ifBusyReject, ifBusyQueue, ifBusyPreempt},
+		}
+	}
+	schema["$schema"] = "https://json-schema.org/draft/2020-12/schema"
+	schema["title"] = endpoint
+	if required, ok := requiredFields[endpoint]; ok {
+		schema["required"] = required
+	}
+	return schema, nil
+}
+
+func typeSchema(t reflect.Type) map[string]interface{} {
+	if t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch t.Kind() {
+	case reflect.Bool:
+		return map[string]interface{}{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return map[string]interface{}{"type": "integer"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]interface{}{"type": "number"}
+	case reflect.String:
+		return map[string]interface{}{"type": "string"}
+	case reflect.Array:
+		return map[string]interface{}{
+			"type":     "array",
+			"items":    typeSchema(t.Elem()),
+			"minItems": t.Len(),
+			"maxItems": t.Len(),
+		}
+	case reflect.Slice:
+		return map[string]interface{}{
+			"type":  "array",
+			"items": typeSchema(t.Elem()),
+		}
+	case reflect.Struct:
+		if t == reflect.TypeOf(sequenceCmd{}) {
+			// see sequenceCmd.UnmarshalJSON
+			return map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"commands": map[string]interface{}{
+						"type": "array",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"command": map[string]interface{}{"type": "string"},
+								"args":    map[string]interface{}{"type": "object"},
+							},
+							"required": []string{"command"},
+						},
+					},
+				},
+				"additionalProperties": false,
+			}
+		}
+		if t == reflect.TypeOf(chainCmd{}) {
+			// see chainCmd.UnmarshalJSON
+			return map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"commands": map[string]interface{}{
+						"type": "array",
+						"items": map[string]interface{}{
+							"type": "object",
+							"properties": map[string]interface{}{
+								"command": map[string]interface{}{"type": "string"},
+								"args":    map[string]interface{}{"type": "object"},
+							},
+							"required": []string{"command"},
+						},
+					},
+					"transition_time": typeSchema(reflect.TypeOf(0.)),
+				},
+				"additionalProperties": false,
+			}
+		}
+		if t == reflect.TypeOf(runTemplateCmd{}) {
+			// see runTemplateCmd.UnmarshalJSON
+			return map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"name":   map[string]interface{}{"type": "string"},
+					"params": map[string]interface{}{"type": "object"},
+				},
+				"additionalProperties": false,
+			}
+		}
+		if t == reflect.TypeOf(focusSweepCmd{}) {
+			// see focusSweepCmd.UnmarshalJSON
+			return map[string]interface{}{
+				"type": "object",
+				"properties": map[string]interface{}{
+					"focus": typeSchema(reflect.TypeOf([]float64{})),
+					"command": map[string]interface{}{
+						"type": "object",
+						"properties": map[string]interface{}{
+							"command": map[string]interface{}{"type": "string"},
+							"args":    map[string]interface{}{"type": "object"},
+						},
+						"required": []string{"command"},
+					},
+				},
+				"additionalProperties": false,
+			}
+		}
+		props := map[string]interface{}{}
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.PkgPath != "" {
+				continue // unexported
+			}
+			name := strings.Split(f.Tag.Get("json"), ",")[0]
+			if name == "-" {
+				continue
+			}
+			if name == "" {
+				name = strings.ToLower(f.Name)
+			}
+			props[name] = typeSchema(f.Type)
+		}
+		return map[string]interface{}{
+			"type":                 "object",
+			"properties":           props,
+			"additionalProperties": false,
+		}
+	}
+	return map[string]interface{}{}
+}
+
+// newCommandID returns a random (version 4) UUID.
+func newCommandID() string {
+	var b [16]byte
+	_, err := rand.Read(b[:])
+	if err != nil {
+		panic(err)
+	}
+	b[6] = (b[6] & 0x0f) | 0x40
+	b[8] = (b[8] & 0x3f) | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:])
+}
+
+// serveCommandAPI serves the commands: submitting them, dry running them,
+// exporting their trajectories, and their schemas.
+func serveCommandAPI(mux *http.ServeMux, submit func(p *Principal, endpoint string, body io.Reader) (string, int, error),
+	pointing *Pointing, currentPosition func() *[2]float64) {
+	mux.HandleFunc("/estimate/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			commandResponse(w, "", err, http.StatusMethodNotAllowed)
+			return
+		}
+		dryRunResponse(w, req, strings.TrimPrefix(req.URL.Path, "/estimate"), currentPosition)
+	})
+
+	mux.HandleFunc("/export/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			commandResponse(w, "", err, http.StatusMethodNotAllowed)
+			return
+		}
+		cmd, err := decodeCommand(strings.TrimPrefix(req.URL.Path, "/export"), req.Body)
+		if errors.Is(err, errBadEndpoint) {
+			commandResponse(w, "", err, http.StatusNotFound)
+			return
+		}
+		if err != nil {
+			commandResponse(w, "", err, http.StatusBadRequest)
+			return
+		}
+		trajectoryResponse(w, req, cmd, pointing)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "POST":
+			dryRun := false
+			if s := req.URL.Query().Get("dry_run"); s != "" {
+				var err error
+				dryRun, err = strconv.ParseBool(s)
+				if err != nil {
+					commandResponse(w, "", fmt.Errorf("bad dry_run: %w", err), http.StatusBadRequest)
+					return
+				}
+			}
+			if dryRun {
+				dryRunResponse(w, req, req.URL.Path, currentPosition)
+				return
+			}
+			id, statusCode, err := submit(principalFrom(req.Context()), req.URL.Path, req.Body)
+			commandResponse(w, id, err, statusCode)
+		case "GET":
+			// GET returns the command's schema
+			schema, err := commandSchema(req.URL.Path)
+			if err != nil {
+				commandResponse(w, "", err, http.StatusNotFound)
+				return
+			}
+			err = json.NewEncoder(w).Encode(schema)
+			if err != nil {
+				log.Print(err)
+			}
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			commandResponse(w, "", err, http.StatusMethodNotAllowed)
+		}
+	})
+}
@@ -0,0 +1,264 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strings"
+	"testing"
+	"testing/quick"
+	"time"
+)
+
+// checkCommand decodes and checks a command, and if it's valid generates
+// the start of its pattern, as the API does before starting it.
+func checkCommand(endpoint, body string) error {
+	cmd, err := decodeCommand(endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	err = cmd.Check()
+	if err != nil {
+		return err
+	}
+	if p, ok := cmd.(PatternCommand); ok {
+		pattern, err := p.Pattern()
+		if err != nil {
+			return err
+		}
+		iter := pattern.Iterator()
+		var sample ScanPatternSample
+		for i := 0; i < 100 && !pattern.Done(iter); i++ {
+			err = pattern.Next(iter, &sample)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func FuzzDecodeCommand(f *testing.F) {
+	for _, seed := range []struct{ endpoint, body string }{
+		{"/azimuth-scan", `{"azimuth_range": [110,130], "elevation": 60, "num_scans": 20, "start_time": 1615586380, "turnaround_time": 30, "speed": 0.8}`},
+		{"/chain", `{"transition_time": 10, "commands": [{"command": "/azimuth-scan", "args": {"azimuth_range": [110,130], "elevation": 60, "num_scans": 2, "start_time": 5, "turnaround_time": 5, "speed": 0.5}}, {"command": "/elevation-scan", "args": {"elevation_range": [50,60], "azimuth": 120, "num_scans": 2, "turnaround_time": 5, "speed": 0.5}}]}`},
+		{"/daisy-scan", `{"start_time": 1555190103, "stop_time": 1555190403, "ra": 120, "dec": 45, "coordsys": "ICRS", "radius": 0.25, "speed": 0.1, "num_petals": 11}`},
+		{"/drift-scan", `{"azimuth": 120, "elevation": 60, "azimuth_rate": 0.05, "duration": 300, "start_time": 1615586380}`},
+		{"/elevation-scan", `{"elevation_range": [30,60], "azimuth": 120, "num_scans": 10, "start_time": 1615586380, "turnaround_time": 5, "speed": 0.5}`},
+		{"/focus", `{"focus": -0.5}`},
+		{"/focus-sweep", `{"focus": [-1, 0, 1], "command": {"command": "/azimuth-scan", "args": {"azimuth_range": [110,130], "elevation": 60, "num_scans": 2, "start_time": 5, "turnaround_time": 5, "speed": 0.5}}}`},
+		{"/lissajous-scan", `{"start_time": 1555190103, "stop_time": 1555190403, "ra": 120, "dec": 45, "coordsys": "ICRS", "amplitude": [0.5, 0.5], "period": [30, 37], "phase": 90}`},
+		{"/move-to", `{"azimuth": 120, "elevation": 45, "rotator": 10}`},
+		{"/path", `{"start_time": 1615586629, "coordsys": "ICRS", "points": [[0, 103, -33, 0.05, -0.05], [60, 106, -36, 0.05, -0.05], [120, 109, -39, 0.05, -0.05]]}`},
+		{"/path", `{"coordsys": "Horizon", "spline": true, "points": [[0, 100, 40, 0, 0], [10, 101, 41, 0, 0]]}`},
+		{"/pointing-scan", `{"start_time": 1555190103, "target": "Jupiter", "mode": "grid", "speed": 0.02, "turnaround_time": 2}`},
+		{"/raster-scan", `{"azimuth_range": [110,130], "elevation_range": [40,50], "scan_axis": "azimuth", "step": 0.5, "start_time": 1615586380, "turnaround_time": 5, "speed": 0.8}`},
+		{"/rotator", `{"angle": 30}`},
+		{"/scan-track", `{"start_time": 1555190103, "stop_time": 1555193703, "ra": 120, "dec": 45, "coordsys": "ICRS", "throw": 5, "speed": 1, "turnaround_time": 2}`},
+		{"/sequence", `{"commands": [{"command": "/move-to", "args": {"azimuth": 120, "elevation": 60}}, {"command": "/stow", "args": {}}]}`},
+		{"/shutdown", `{"abort": true}`},
+		{"/skydip", `{"azimuth": 180, "elevation_range": [20,80], "mode": "sweep", "speed": 0.5, "turnaround_time": 5, "num_scans": 4, "start_time": 1615586380}`},
+		{"/stow", `{}`},
+		{"/track", `{"start_time": 1555190103, "stop_time": 1555190166, "ra": 217.42895, "dec": -62.67949, "coordsys": "ICRS", "pmra": -3781.31, "pmdec": 769.77, "parallax": 768.07, "radial_velocity": -22.4, "epoch": 2016.0}`},
+		{"/track", `{"start_time": 1555190103, "stop_time": 1555190166, "body": "Jupiter"}`},
+	} {
+		f.Add(seed.endpoint, seed.body)
+	}
+	f.Fuzz(func(t *testing.T, endpoint, body string) {
+		checkCommand(endpoint, body)
+	})
+}
+
+func TestDecodeCommandValidation(t *testing.T) {
+	now := float64(time.Now().Unix())
+	manyPoints := make([][5]float64, maxCommandItems+1)
+	b, _ := json.Marshal(map[string]interface{}{"coordsys": "Horizon", "points": manyPoints})
+	for _, tc := range []struct {
+		endpoint, body, err string
+		field               string // of the FieldError, if any
+	}{
+		{"/move-to", `{"azimuth": 1e999, "elevation": 45}`, "azimuth: expected float64, got number 1e999", ""},
+		{"/move-to", `{"azimuth": NaN, "elevation": 45}`, "bad JSON", ""},
+		{"/move-to", `{"azimuth": "120", "elevation": 45}`, "azimuth: expected float64", ""},
+		{"/move-to", `{"azimuth": 120, "elevation": 45} {}`, "data after the command", ""},
+		{"/move-to", `{"azimuth": 120, "elevation": 45`, "bad JSON", ""},
+		{"/move-to", `{}`, "azimuth: required", ""},
+		{"/move-to", `{"Azimuth": 120}`, "elevation: required", ""},
+		{"/move-to", `{"elevation": 60, "axis": "azimuth"}`, "azimuth: required", ""},
+		{"/move-to", `{"elevation": 60, "axis": "roll"}`, "axis: expected azimuth or elevation", "axis"},
+		{"/move-to", `{"elevation": 200, "axis": "elevation"}`, "commanded elevation (200) out of range", "elevation"},
+		{"/acu/position-broadcast", `{"destination_port": 80}`, "invalid port number 80", "destination_port"},
+		{"/azimuth-scan", `{}`, "bad number of scans", "num_scans"},
+		{"/azimuth-scan", `{"num_scans": 1, "azimuth_range": [100, 100], "elevation": 45, "speed": 1}`, "empty azimuth range", "azimuth_range"},
+		{"/azimuth-scan", `{"num_scans": 1, "azimuth_range": [100, 110], "elevation": 45, "speed": 1, "turnaround_time": 0.01}`, "turnaround time (0.01) too short", "turnaround_time"},
+		{"/azimuth-scan", `{"num_scans": 1, "azimuth_range": [100, 110], "elevation": 45, "speed": 1, "turnaround_time": 10, "start_time": 1e9}`, "is in the past", "start_time"},
+		{"/elevation-scan", `{"num_scans": 1, "elevation_range": [40, 40], "azimuth": 100, "speed": 1}`, "empty elevation range", "elevation_range"},
+		{"/drift-scan", `{"duration": 0.5, "azimuth": 100, "elevation": 45}`, "bad duration", "duration"},
+		{"/drift-scan", `{"duration": 1e6, "azimuth": 100, "elevation": 45}`, "longer than 24h0m0s", "duration"},
+		{"/raster-scan", `{"scan_axis": "roll"}`, "bad scan axis: roll", "scan_axis"},
+		{"/raster-scan", `{"azimuth_range": [100, 100], "elevation_range": [40, 50], "speed": 1}`, "empty azimuth range", "azimuth_range"},
+		{"/raster-scan", `{"azimuth_range": [100, 110], "elevation_range": [40, 50], "speed": 0.1, "step": 20}`, "bad step size", "step"},
+		{"/raster-scan", `{"azimuth_range": [100, 110], "elevation_range": [40, 50], "speed": 0.1, "step": 5, "turnaround_time": 2}`, "too short to step 5 deg", "turnaround_time"},
+		{"/track", `{"ra": 120, "dec": 45}`, "bad coordinate system", "coordsys"},
+		{"/track", `{"ra": 120, "dec": 45, "coordsys": "B1950"}`, "bad coordinate system", "coordsys"},
+		{"/track", `{"body": "Mars", "coordsys": "ICRS"}`, "coordsys not allowed with body", "coordsys"},
+		{"/track", `{"target": "Mars", "ra": 120}`, "not allowed with target", "target"},
+		{"/track", `{"ra": 120, "dec": 45, "coordsys": "Galactic", "pmra": 10}`, "require ICRS", "coordsys"},
+		{"/track", `{"ra": 120, "dec": 45, "coordsys": "ICRS", "parallax": -1}`, "bad parallax", "parallax"},
+		{"/track", fmt.Sprintf(`{"start_time": %f, "stop_time": %f, "ra": 120, "dec": 45, "coordsys": "ICRS"}`, now+100, now), "bad times", "stop_time"},
+		{"/track", fmt.Sprintf(`{"start_time": %f, "stop_time": %f, "ra": 120, "dec": 45, "coordsys": "ICRS"}`, now, now+1e9), "longer than 24h0m0s", "stop_time"},
+		{"/path", `{"coordsys": "Horizon"}`, "points: required", ""},
+		{"/path", `{"coordsys": "Horizon", "points": []}`, "no points in path", "points"},
+		{"/path", `{"coordsys": "Horizon", "points": [[10, 100, 40, 0, 0], [10.01, 100, 40, 0, 0]]}`, "separated by less than 50 ms", "points"},
+		{"/path", `{"coordsys": "Horizon", "spline": true, "points": [[10, 100, 40, 0, 0]]}`, "spline path needs at least 2 points", "points"},
+		{"/path", `{"coordsys": "ICRS", "points": [[0, 1, 2]]}`, "points: expected 5 values, got 3", ""},
+		{"/path", `{"coordsys": "ICRS", "points": [[0, 1, 2, 3, 4, 5]]}`, "points: expected 5 values, got 6", ""},
+		{"/path", string(b), "points: more than 100000 items", ""},
+		{"/path", `{"coordsys": "Horizon", "spline": true, "points": [[0, 100, 40, 0, 0], [1e7, 101, 41, 0, 0]]}`, "longer than 24h0m0s", "points"},
+		{"/lissajous-scan", `{"coordsys": "Horizon", "period": [0, 10]}`, "bad period", "period"},
+		{"/lissajous-scan", `{"coordsys": "Horizon", "period": [10, 10], "amplitude": [-1, 1]}`, "bad amplitude", "amplitude"},
+		{"/lissajous-scan", `{"coordsys": "Horizon", "ra": 100, "dec": 45, "period": [1, 1], "amplitude": [50, 50]}`, "exceeds limit", "amplitude"},
+		{"/daisy-scan", `{"coordsys": "Horizon"}`, "bad radius", "radius"},
+		{"/daisy-scan", `{"coordsys": "Horizon", "radius": 1}`, "bad speed", "speed"},
+		{"/daisy-scan", `{"coordsys": "Horizon", "radius": 1, "speed": 0.1}`, "bad number of petals", "num_petals"},
+		{"/scan-track", `{"coordsys": "Horizon"}`, "bad throw", "throw"},
+		{"/scan-track", `{"coordsys": "Horizon", "throw": 1, "speed": 0.1}`, "bad turnaround time", "turnaround_time"},
+		{"/scan-track", `{"coordsys": "Horizon", "ra": 100, "dec": 45, "throw": 1, "speed": 1, "turnaround_time": 0.2}`, "turnaround time (0.2) too short", "turnaround_time"},
+		{"/sequence", `{"commands": []}`, "no commands in sequence", "commands"},
+		{"/sequence", `{"commands": [{"command": "/move-to", "args": {"azimuth": 1e999}}]}`, "sequence command 0: azimuth", ""},
+		{"/sequence", `{"commands": [{"command": "/bogus"}]}`, "bad endpoint", ""},
+		{"/chain", `{"commands": [], "transition_time": 1}`, "no commands in chain", "commands"},
+		{"/chain", `{"commands": [{"command": "/track", "args": {"ra": 120, "dec": 45, "coordsys": "ICRS"}}], "transition_time": 0}`, "bad transition time", "transition_time"},
+		{"/bogus", `{}`, "bad endpoint", ""},
+		{"/stow", `{"metadata": {"observation_id": 42}}`, "metadata: expected an object of strings", ""},
+		{"/stow", `{"metadata": {"": "x"}}`, "metadata: empty key", ""},
+		{"/stow", `{"idempotency_key": 42}`, "idempotency_key: expected a string", ""},
+		{"/stow", `{"if_busy": "wait"}`, "if_busy: expected reject, queue or preempt", ""},
+	} {
+		err := checkCommand(tc.endpoint, tc.body)
+		body := tc.body
+		if len(body) > 100 {
+			body = body[:100] + "..."
+		}
+		if err == nil || !strings.Contains(err.Error(), tc.err) {
+			t.Errorf("%s %s: got error %v, expected %q", tc.endpoint, body, err, tc.err)
+		}
+		var ferr *FieldError
+		if tc.field != "" && (!errors.As(err, &ferr) || ferr.Field != tc.field) {
+			t.Errorf("%s %s: got error %#v, expected field %s", tc.endpoint, body, err, tc.field)
+		}
+	}
+
+	_, err := readCommand(strings.NewReader(strings.Repeat(" ", maxCommandSize+1)))
+	if !errors.Is(err, errTooLarge) {
+		t.Errorf("readCommand: got error %v, expected %v", err, errTooLarge)
+	}
+}
+
+func TestCommandMetadata(t *testing.T) {
+	body := `{"azimuth": 120, "elevation": 60, "metadata": {"observation_id": "obs-1", "project": "EoR-Spec"}}`
+	cmd, err := decodeCommand("/move-to", strings.NewReader(body))
+	if err != nil || cmd.(moveToCmd).Azimuth != 120 {
+		t.Fatalf("decodeCommand: got %+v, %v", cmd, err)
+	}
+	metadata, err := commandMetadata([]byte(body))
+	if err != nil || metadata["observation_id"] != "obs-1" || metadata["project"] != "EoR-Spec" {
+		t.Errorf("commandMetadata: got %v, %v", metadata, err)
+	}
+	metadata, err = commandMetadata([]byte(`{"azimuth": 120, "elevation": 60}`))
+	if err != nil || metadata != nil {
+		t.Errorf("commandMetadata: got %v, %v, expected none", metadata, err)
+	}
+
+	ct := NewCommandTracker()
+	ct.Add("a", "/move-to")
+	ct.SetMetadata("a", map[string]string{"observation_id": "obs-1"})
+	ct.Set("a", commandStarted, nil)
+	if r := ct.Current(); r == nil || r.Metadata["observation_id"] != "obs-1" {
+		t.Errorf("Current: got %+v", r)
+	}
+}
+
+func TestCommandIfBusy(t *testing.T) {
+	body := `{"azimuth": 120, "elevation": 60, "if_busy": "queue"}`
+	if _, err := decodeCommand("/move-to", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if policy, err := commandIfBusy([]byte(body)); err != nil || policy != ifBusyQueue {
+		t.Errorf("got %q, %v", policy, err)
+	}
+	if policy, err := commandIfBusy([]byte(`{}`)); err != nil || policy != ifBusyReject {
+		t.Errorf("default: got %q, %v", policy, err)
+	}
+}
+
+func TestCommandIdempotencyKey(t *testing.T) {
+	body := `{"azimuth": 120, "elevation": 60, "idempotency_key": "k1"}`
+	if _, err := decodeCommand("/move-to", strings.NewReader(body)); err != nil {
+		t.Fatal(err)
+	}
+	if key, err := commandIdempotencyKey([]byte(body)); err != nil || key != "k1" {
+		t.Errorf("commandIdempotencyKey: got %q, %v", key, err)
+	}
+
+	ct := NewCommandTracker()
+	ct.Add("x", "/stow")
+	for _, tc := range []struct {
+		id, client, key, expected string
+		added                     bool
+	}{
+		{"a", "alice", "k1", "a", true},
+		{"b", "alice", "k1", "a", false},
+		{"c", "bob", "k1", "c", true}, // keys are per client
+		{"d", "alice", "", "d", true},
+		{"e", "alice", "", "e", true},
+	} {
+		id, added := ct.AddOnce(tc.id, "/move-to", tc.client, tc.key)
+		if id != tc.expected || added != tc.added {
+			t.Errorf("AddOnce(%s, %s, %q): got %s, %v", tc.id, tc.client, tc.key, id, added)
+		}
+	}
+	if id, ok := ct.Lookup("alice", "k1"); !ok || id != "a" {
+		t.Errorf("Lookup: got %s, %v", id, ok)
+	}
+	if _, ok := ct.Lookup("alice", ""); ok {
+		t.Error("Lookup: found the empty key")
+	}
+
+	// forgotten with the command
+	ct.Set("a", commandDone, nil)
+	for i := 0; i < commandHistoryLen; i++ {
+		id := fmt.Sprint(i)
+		ct.Add(id, "/stow")
+		ct.Set(id, commandDone, nil)
+	}
+	if _, ok := ct.Lookup("alice", "k1"); ok {
+		t.Error("Lookup: found a forgotten command")
+	}
+}
+
+// TestMoveToProperty checks that any move-to round-trips through the API,
+// and is refused if it's outside the axis limits.
+func TestMoveToProperty(t *testing.T) {
+	f := func(az, el float64) bool {
+		b, _ := json.Marshal(moveToCmd{Azimuth: az, Elevation: el})
+		cmd, err := decodeCommand("/move-to", strings.NewReader(string(b)))
+		if err != nil || !reflect.DeepEqual(cmd, moveToCmd{Azimuth: az, Elevation: el}) {
+			return false
+		}
+		inRange := az >= azimuthMin && az <= azimuthMax && el >= elevationMin && el <= elevationMax
+		return inRange || cmd.Check() != nil
+	}
+	cfg := &quick.Config{
+		Values: func(args []reflect.Value, r *rand.Rand) {
+			for i := range args {
+				args[i] = reflect.ValueOf(r.Float64()*800 - 400)
+			}
+		},
+	}
+	if err := quick.Check(f, cfg); err != nil {
+		t.Error(err)
+	}
+}
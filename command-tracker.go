@@ -0,0 +1,505 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// command lifecycle states
+const (
+	commandQueued    = "queued"
+	commandChecking  = "checking"  // pre-start checks in the command loop
+	commandStarted   = "started"   // running, not a pattern
+	commandUploading = "uploading" // pattern running, points still being uploaded
+	commandTracking  = "tracking"  // pattern running, all points uploaded
+	commandDone      = "done"
+	commandFailed    = "failed"
+	commandAborted   = "aborted"
+)
+
+// step states, for commands made of steps
+const (
+	stepPending = "pending"
+	stepRunning = "running"
+	stepDone    = "done"
+	stepSkipped = "skipped"
+	stepFailed  = "failed"
+)
+
+// how many finished commands to remember
+const commandHistoryLen = 100
+
+// longer command arguments aren't recorded
+const maxRecordedArgs = 64 << 10
+
+type commandTransition struct {
+	State string    `json:"state"`
+	Time  time.Time `json:"time"`
+}
+
+// A CommandStep is the progress of a step of a command.
+type CommandStep struct {
+	Name  string     `json:"name"`
+	State string     `json:"state"`
+	Time  *time.Time `json:"time,omitempty"` // of the last change
+	Error string     `json:"error,omitempty"`
+}
+
+// A CommandRecord is the lifecycle of a command.
+type CommandRecord struct {
+	ID            string                `json:"id"`
+	Command       string                `json:"command"`            // endpoint, or type for internal commands
+	Metadata      map[string]string     `json:"metadata,omitempty"` // see commandMetadata
+	State         string                `json:"state"`
+	Error         string                `json:"error,omitempty"`
+	History       []commandTransition   `json:"history"`
+	Steps         []CommandStep         `json:"steps,omitempty"`
+	Progress      *PatternProgress      `json:"progress,omitempty"`       // of the running pattern, if any
+	TrackingError *TrackingErrorSummary `json:"tracking_error,omitempty"` // of a finished pattern
+	Args          json.RawMessage       `json:"args,omitempty"`           // the request body, if not too long
+	Latency       map[string]float64    `json:"latency,omitempty"`        // [s] by stage, see SetLatency
+
+	IdempotencyKey string `json:"idempotency_key,omitempty"`
+	client         string // which gave the idempotency key
+}
+
+func (r CommandRecord) finished() bool {
+	switch r.State {
+	case commandDone, commandFailed, commandAborted:
+		return true
+	}
+	return false
+}
+
+// A queuedCommand is a command and its tracker ID.
+type queuedCommand struct {
+	id  string
+	cmd Command
+}
+
+// A CommandTracker records the lifecycle of recent commands.
+type CommandTracker struct {
+	mu       sync.Mutex
+	records  map[string]*CommandRecord
+	order    []string // IDs, oldest first
+	keys     map[idempotencyKey]string
+	onChange []func()
+}
+
+// An idempotencyKey is a command's idempotency key, for the client
+// which gave it, since clients choose their keys independently.
+type idempotencyKey struct {
+	client, key string
+}
+
+func NewCommandTracker() *CommandTracker {
+	return &CommandTracker{
+		records: make(map[string]*CommandRecord),
+		keys:    make(map[idempotencyKey]string),
+	}
+}
+
+// OnChange calls fn, which mustn't block, after each change.
+func (ct *CommandTracker) OnChange(fn func()) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	ct.onChange = append(ct.onChange, fn)
+}
+
+func (ct *CommandTracker) changed() {
+	ct.mu.Lock()
+	fns := ct.onChange
+	ct.mu.Unlock()
+	for _, fn := range fns {
+		fn()
+	}
+}
+
+// Add records a new command, in the queued state.
+func (ct *CommandTracker) Add(id, command string) {
+	ct.AddOnce(id, command, "", "")
+}
+
+// AddOnce is Add for a command with an idempotency key from client,
+// unless the key is already used by a remembered command, returning
+// that command's ID and false. An empty key is never used.
+func (ct *CommandTracker) AddOnce(id, command, client, key string) (string, bool) {
+	ct.mu.Lock()
+	if first, ok := ct.keys[idempotencyKey{client, key}]; ok && key != "" {
+		ct.mu.Unlock()
+		return first, false
+	}
+	defer ct.changed()
+	defer ct.mu.Unlock()
+	ct.records[id] = &CommandRecord{
+		ID:             id,
+		Command:        command,
+		State:          commandQueued,
+		History:        []commandTransition{{commandQueued, time.Now()}},
+		IdempotencyKey: key,
+		client:         client,
+	}
+	if key != "" {
+		ct.keys[idempotencyKey{client, key}] = id
+	}
+	ct.order = append(ct.order, id)
+	tcsMetrics.commands.Inc(command)
+
+	// forget the oldest finished commands
+	for i := 0; len(ct.order) > commandHistoryLen && i < len(ct.order); {
+		r := ct.records[ct.order[i]]
+		if !r.finished() {
+			i++
+			continue
+		}
+		k := idempotencyKey{r.client, r.IdempotencyKey}
+		if ct.keys[k] == r.ID {
+			delete(ct.keys, k)
+		}
+		delete(ct.records, r.ID)
+		ct.order = append(ct.order[:i], ct.order[i+1:]...)
+	}
+	return id, true
+}
+
+// Set moves a command to state, recording err if not nil.
+// Finished commands are left alone, as are repeated states.
+func (ct *CommandTracker) Set(id, state string, err error) {
+	ct.mu.Lock()
+	r, ok := ct.records[id]
+	if !ok || r.finished() || r.State == state {
+		ct.mu.Unlock()
+		return
+	}
+	defer ct.changed()
+	defer ct.mu.Unlock()
+	r.State = state
+	if err != nil {
+		r.Error = err.Error()
+	}
+	if state == commandFailed {
+		tcsMetrics.failures.Inc(r.Command)
+	}
+	r.History = append(r.History, commandTransition{state, time.Now()})
+}
+
+// SetIf moves a command from state from to state to, returning false
+// if it wasn't in state from.
+func (ct *CommandTracker) SetIf(id, from, to string) bool {
+	ct.mu.Lock()
+	r, ok := ct.records[id]
+	if !ok || r.State != from || from == to {
+		ct.mu.Unlock()
+		return false
+	}
+	defer ct.changed()
+	defer ct.mu.Unlock()
+	r.State = to
+	r.History = append(r.History, commandTransition{to, time.Now()})
+	return true
+}
+
+// SetArgs records the command's arguments, if they're valid JSON
+// and not too long.
+func (ct *CommandTracker) SetArgs(id string, args []byte) {
+	if len(args) > maxRecordedArgs || !json.Valid(args) {
+		return
+	}
+	defer ct.changed()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if r, ok := ct.records[id]; ok {
+		r.Args = append(json.RawMessage(nil), args...)
+	}
+}
+
+// SetMetadata records the command's metadata.
+func (ct *CommandTracker) SetMetadata(id string, metadata map[string]string) {
+	if len(metadata) == 0 {
+		return
+	}
+	defer ct.changed()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if r, ok := ct.records[id]; ok {
+		r.Metadata = metadata
+	}
+}
+
+// SetSteps records a command's steps, all pending.
+func (ct *CommandTracker) SetSteps(id string, names []string) {
+	defer ct.changed()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if r, ok := ct.records[id]; ok {
+		r.Steps = make([]CommandStep, len(names))
+		for i, name := range names {
+			r.Steps[i] = CommandStep{Name: name, State: stepPending}
+		}
+	}
+}
+
+// SetStep moves a command's step i to state, recording err if not nil.
+func (ct *CommandTracker) SetStep(id string, i int, state string, err error) {
+	defer ct.changed()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	r, ok := ct.records[id]
+	if !ok || i < 0 || i >= len(r.Steps) {
+		return
+	}
+	t := time.Now()
+	r.Steps[i].State, r.Steps[i].Time = state, &t
+	if err != nil {
+		r.Steps[i].Error = err.Error()
+	}
+}
+
+// SetProgress records the progress of a command's pattern. Progress is
+// transient, so unlike the other changes it isn't reported to OnChange.
+func (ct *CommandTracker) SetProgress(id string, p PatternProgress) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if r, ok := ct.records[id]; ok && !r.finished() {
+		r.Progress = &p
+	}
+}
+
+// command latency stages, from receipt to the first points on the stack
+const (
+	latencyDecode      = "decode"       // the request body
+	latencyCheck       = "check"        // Check
+	latencyQueued      = "queued"       // waiting for the command before
+	latencyPreStart    = "pre_start"    // the dispatcher's checks
+	latencyStart       = "start"        // Start, which includes:
+	latencyPattern     = "pattern"      // generating the whole pattern to summarize it
+	latencyModeChange  = "mode_change"  // Stop, clearing the stack, and ProgramTrack
+	latencyFirstUpload = "first_upload" // generating and uploading the first points
+)
+
+// SetLatency records how long command id took in a stage of starting,
+// in its record and the metrics.
+func (ct *CommandTracker) SetLatency(id, stage string, d time.Duration) {
+	tcsMetrics.commandLatency.Observe(stage, d.Seconds())
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if r, ok := ct.records[id]; ok {
+		if r.Latency == nil {
+			r.Latency = make(map[string]float64)
+		}
+		r.Latency[stage] = d.Seconds()
+	}
+}
+
+// SetTrackingError records the summary of a pattern's tracking error,
+// usually once it's finished.
+func (ct *CommandTracker) SetTrackingError(id string, s TrackingErrorSummary) {
+	defer ct.changed()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	if r, ok := ct.records[id]; ok {
+		r.TrackingError = &s
+	}
+}
+
+type commandStepsKey struct{}
+
+// withCommandSteps returns a context whose commandSteps reports to the
+// tracker's record of command id.
+func withCommandSteps(ctx context.Context, ct *CommandTracker, id string) context.Context {
+	return context.WithValue(ctx, commandStepsKey{}, stepReporter{ct, id})
+}
+
+// A stepReporter reports a command's steps. The zero value ignores them.
+type stepReporter struct {
+	ct *CommandTracker
+	id string
+}
+
+// commandSteps returns the context's step reporter, if any.
+func commandSteps(ctx context.Context) stepReporter {
+	r, _ := ctx.Value(commandStepsKey{}).(stepReporter)
+	return r
+}
+
+func (r stepReporter) Init(names []string) {
+	if r.ct != nil {
+		r.ct.SetSteps(r.id, names)
+	}
+}
+
+func (r stepReporter) Set(i int, state string, err error) {
+	if r.ct != nil {
+		r.ct.SetStep(r.id, i, state, err)
+	}
+}
+
+func (r stepReporter) Latency(stage string, d time.Duration) {
+	if r.ct != nil {
+		r.ct.SetLatency(r.id, stage, d)
+	}
+}
+
+// Restore adds the records of a previous run, oldest first, before any
+// new commands. Unfinished commands are marked aborted by the restart.
+func (ct *CommandTracker) Restore(records []CommandRecord, restart time.Time) {
+	defer ct.changed()
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	var order []string
+	for i := range records {
+		r := records[i].copy()
+		if _, ok := ct.records[r.ID]; ok {
+			continue
+		}
+		if !r.finished() {
+			r.State, r.Error = commandAborted, "interrupted by a TCS restart"
+			r.History = append(r.History, commandTransition{commandAborted, restart})
+		}
+		ct.records[r.ID] = &r
+		order = append(order, r.ID)
+	}
+	ct.order = append(order, ct.order...)
+}
+
+// Lookup returns the ID of the remembered command with the idempotency
+// key from client, if any.
+func (ct *CommandTracker) Lookup(client, key string) (string, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	id, ok := ct.keys[idempotencyKey{client, key}]
+	return id, ok && key != ""
+}
+
+func (ct *CommandTracker) Get(id string) (CommandRecord, bool) {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	r, ok := ct.records[id]
+	if !ok {
+		return CommandRecord{}, false
+	}
+	return r.copy(), true
+}
+
+// List returns the recent commands, oldest first.
+func (ct *CommandTracker) List() []CommandRecord {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	list := make([]CommandRecord, 0, len(ct.order))
+	for _, id := range ct.order {
+		list = append(list, ct.records[id].copy())
+	}
+	return list
+}
+
+// Count returns the number of commands in state.
+func (ct *CommandTracker) Count(state string) int {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	n := 0
+	for _, r := range ct.records {
+		if r.State == state {
+			n++
+		}
+	}
+	return n
+}
+
+// Current returns the most recent unfinished command, if any,
+// without its arguments.
+func (ct *CommandTracker) Current() *CommandRecord {
+	ct.mu.Lock()
+	defer ct.mu.Unlock()
+	for i := len(ct.order) - 1; i >= 0; i-- {
+		r := ct.records[ct.order[i]]
+		if r.State != commandQueued && !r.finished() {
+			c := r.copy()
+			c.Args = nil
+			return &c
+		}
+	}
+	return nil
+}
+
+func (r *CommandRecord) copy() CommandRecord {
+	c := *r
+	c.History = append([]commandTransition(nil), r.History...)
+	c.Steps = append([]CommandStep(nil), r.Steps...)
+	if r.Latency != nil {
+		c.Latency = make(map[string]float64, len(r.Latency))
+		for k, v := range r.Latency {
+			c.Latency[k] = v
+		}
+	}
+	return c
+}
+
+// commandName names a command for the tracker.
+func commandName(cmd Command) string {
+	s := fmt.Sprintf("%T", cmd)
+	return strings.TrimPrefix(s, "main.")
+}
+
+// serveCommandTracker serves the tracked commands, with their logs and
+// trajectories.
+func serveCommandTracker(mux *http.ServeMux, tracker *CommandTracker, pointing *Pointing) {
+	mux.HandleFunc("/commands", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := json.NewEncoder(w).Encode(tracker.List())
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/commands/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		id := strings.TrimPrefix(req.URL.Path, "/commands/")
+		logs := strings.HasSuffix(id, "/log")
+		id = strings.TrimSuffix(id, "/log")
+		trajectory := strings.HasSuffix(id, "/trajectory")
+		id = strings.TrimSuffix(id, "/trajectory")
+		r, ok := tracker.Get(id)
+		if !ok {
+			err := fmt.Errorf("unknown command %s", id)
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		if trajectory {
+			if r.Args == nil {
+				err := fmt.Errorf("command %s has no recorded arguments", id)
+				jsonResponse(w, err, http.StatusNotFound)
+				return
+			}
+			cmd, err := decodeCommand(r.Command, bytes.NewReader(r.Args))
+			if err != nil {
+				jsonResponse(w, err, http.StatusNotFound)
+				return
+			}
+			trajectoryResponse(w, req, cmd, pointing)
+			return
+		}
+		var v interface{} = r
+		if logs {
+			v = tcsLog.CommandLog(id)
+		}
+		err := json.NewEncoder(w).Encode(v)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+}
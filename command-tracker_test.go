@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"testing"
+	"time"
+)
+
+func TestCommandTracker(t *testing.T) {
+	ct := NewCommandTracker()
+	ct.Add("a", "/track")
+	if ct.Current() != nil {
+		t.Error("Current: queued command is not current")
+	}
+	ct.Set("a", commandChecking, nil)
+	ct.Set("a", commandStarted, nil)
+	ct.Set("a", commandStarted, nil)
+	ct.Set("a", commandFailed, fmt.Errorf("oops"))
+	ct.Set("a", commandDone, nil) // ignored, already finished
+
+	r, ok := ct.Get("a")
+	if !ok {
+		t.Fatal("Get: command not found")
+	}
+	if r.State != commandFailed || r.Error != "oops" {
+		t.Errorf("Get: got state %s error %q", r.State, r.Error)
+	}
+	var states []string
+	for _, h := range r.History {
+		states = append(states, h.State)
+	}
+	if fmt.Sprint(states) != "[queued checking started failed]" {
+		t.Errorf("Get: got history %v", states)
+	}
+
+	// old finished commands are forgotten
+	for i := 0; i < commandHistoryLen; i++ {
+		ct.Add(fmt.Sprint(i), "/move-to")
+	}
+	if _, ok := ct.Get("a"); ok {
+		t.Error("Get: expected oldest command to be forgotten")
+	}
+	if n := len(ct.List()); n != commandHistoryLen {
+		t.Errorf("List: got %d commands, expected %d", n, commandHistoryLen)
+	}
+}
+
+func TestCommandLatency(t *testing.T) {
+	disableSunAvoidance(t)
+	_, acu, _ := newTestSimulator(t, 120, 60)
+	tel := NewTelescope(acu)
+	if err := tel.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	ct := NewCommandTracker()
+	ct.Add("a", "/azimuth-scan")
+	ctx, cancel := context.WithCancel(withCommandSteps(context.Background(), ct, "a"))
+	defer cancel()
+	cmd := azScanCmd{AzimuthRange: [2]float64{110, 130}, Elevation: 60, NumScans: 2, TurnaroundTime: 5, Speed: 0.5}
+	if _, err := startPatternCmd(ctx, tel, cmd); err != nil {
+		t.Fatal(err)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, _ := ct.Get("a")
+		_, ok := r.Latency[latencyFirstUpload]
+		if ok {
+			if _, ok := r.Latency[latencyPattern]; !ok {
+				t.Errorf("no pattern latency: %v", r.Latency)
+			}
+			if _, ok := r.Latency[latencyModeChange]; !ok {
+				t.Errorf("no mode change latency: %v", r.Latency)
+			}
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("no first upload latency: %v", r.Latency)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
@@ -1,7 +1,9 @@
 package main
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"fmt"
 	"log"
 	"math"
@@ -11,10 +13,12 @@ import (
 )
 
 const (
-	positionTol              = 1e-4
-	speedTol                 = 1e-4
+	startTimeTol             = 1 * time.Second
 	maxFreeProgramTrackStack = 10000
+)
 
+// axis limits, set at startup from the config, see applyConfig
+var (
 	azimuthMin      = -180.0
 	azimuthMax      = 360.0
 	azimuthSpeedMax = 3.0  // [deg/sec]
@@ -28,26 +32,100 @@ const (
 	elevationJerkMax  = 6.0 // [deg/sec^3]
 )
 
+// checkAzEl checks a commanded position and velocity against the hard
+// and soft limits.
 func checkAzEl(az, el, vaz, vel float64) error {
-	if az < azimuthMin || az > azimuthMax {
-		error := fmt.Sprintf("commanded azimuth (%g) out of range [%g,%g]", az, azimuthMin, azimuthMax)
-		log.Print(error)
-		return fmt.Errorf(error)
-	}
-	if el < elevationMin || el > elevationMax {
-		error := fmt.Sprintf("commanded elevation (%g) out of range [%g,%g]", el, elevationMin, elevationMax)
-		log.Print(error)
-		return fmt.Errorf(error)
-	}
-	if math.Abs(vaz) > azimuthSpeedMax {
-		error := fmt.Sprintf("commanded azimuth vel (%g) out of range [%g,%g]", vaz, -azimuthSpeedMax, azimuthSpeedMax)
-		log.Print(error)
-		return fmt.Errorf(error)
-	}
-	if math.Abs(vel) > elevationSpeedMax {
-		error := fmt.Sprintf("commanded elevation vel (%g) out of range [%g,%g]", vel, -elevationSpeedMax, elevationSpeedMax)
-		log.Print(error)
-		return fmt.Errorf(error)
+	err := checkHardAzEl(az, el, vaz, vel)
+	if err == nil {
+		err = siteSoftLimits.Check(az, el)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+	return err
+}
+
+// checkHardAzEl checks a position and velocity against the axis limits.
+func checkHardAzEl(az, el, vaz, vel float64) error {
+	var err error
+	switch {
+	case !isFinite(az):
+		err = finiteError("azimuth", az)
+	case !isFinite(el):
+		err = finiteError("elevation", el)
+	case !isFinite(vaz):
+		err = finiteError("azimuth_velocity", vaz)
+	case !isFinite(vel):
+		err = finiteError("elevation_velocity", vel)
+	case az < azimuthMin || az > azimuthMax:
+		err = &LimitError{"azimuth", "position", az, azimuthMin, azimuthMax, false}
+	case el < elevationMin || el > elevationMax:
+		err = &LimitError{"elevation", "position", el, elevationMin, elevationMax, false}
+	case math.Abs(vel) > elevationSpeedMax:
+		err = &LimitError{"elevation", "velocity", vel, -elevationSpeedMax, elevationSpeedMax, false}
+	default:
+		speedMax, _ := azimuthLimitsAt(el)
+		if math.Abs(vaz) <= speedMax {
+			return nil
+		}
+		err = &LimitError{"azimuth", "velocity", vaz, -speedMax, speedMax, false}
+	}
+	log.Print(err)
+	return err
+}
+
+// minTurnaroundTime returns the shortest time to reverse from +speed
+// to -speed with an S-curve velocity profile limited by accelMax and jerkMax.
+func minTurnaroundTime(speed, accelMax, jerkMax float64) float64 {
+	dv := 2 * speed
+	if dv <= accelMax*accelMax/jerkMax {
+		// never reaches max acceleration
+		return 2 * math.Sqrt(dv/jerkMax)
+	}
+	return dv/accelMax + accelMax/jerkMax
+}
+
+// checkTurnaround checks that a turnaround is long enough to reverse
+// from +speed to -speed.
+func checkTurnaround(turnaround, speed, accelMax, jerkMax float64) error {
+	minTurnaround := minTurnaroundTime(speed, accelMax, jerkMax)
+	if turnaround < minTurnaround {
+		return fieldError("turnaround_time", "too short", "turnaround time (%g) too short, need at least %g secs", turnaround, minTurnaround)
+	}
+	return nil
+}
+
+// checkStartTime rejects start times in the past.
+func checkStartTime(x float64) error {
+	if !isFinite(x) {
+		return finiteError("start_time", x)
+	}
+	t0 := jsontime(x)
+	if t0.Before(time.Now().Add(-startTimeTol)) {
+		return fieldError("start_time", "in the past", "start time (%f) is in the past", x)
+	}
+	return nil
+}
+
+// checkTimes checks a pattern's start and stop times are in order, and
+// not too far apart to validate (see maxPatternDuration).
+func checkTimes(start, stop float64) error {
+	return checkTimeFields("start_time", "stop_time", start, stop)
+}
+
+// checkTimeFields is checkTimes for times given by the named fields.
+func checkTimeFields(startField, stopField string, start, stop float64) error {
+	switch {
+	case !isFinite(start):
+		return finiteError(startField, start)
+	case !isFinite(stop):
+		return finiteError(stopField, stop)
+	}
+	if stop < start {
+		return fieldError(stopField, "before the start", "bad times: start=%f, stop=%f", start, stop)
+	}
+	if stop-start > maxPatternDuration.Seconds() {
+		return fieldError(stopField, "too long", "bad times: longer than %v", maxPatternDuration)
 	}
 	return nil
 }
@@ -59,6 +137,24 @@ type Command interface {
 	Start(context.Context, *Telescope) (IsDoneFunc, error)
 }
 
+// isMotionCommand returns false for commands that don't move the telescope.
+func isMotionCommand(cmd Command) bool {
+	switch cmd.(type) {
+	case enablePositionBroadcastCmd, abortCmd:
+		return false
+	}
+	return true
+}
+
+// isMoveCommand returns true for commands that drive to a fixed position.
+func isMoveCommand(cmd Command) bool {
+	switch cmd.(type) {
+	case moveToCmd, stowCmd, maintenanceCmd, rotatorCmd, focusCmd, startupCmd, shutdownCmd:
+		return true
+	}
+	return false
+}
+
 // JSON times are float64 unixtime in seconds,
 // except that small values are relative to now.
 func jsontime(x float64) time.Time {
@@ -78,7 +174,7 @@ type enablePositionBroadcastCmd struct {
 
 func (cmd enablePositionBroadcastCmd) Check() error {
 	if cmd.Port < 1024 || cmd.Port > 65535 {
-		return fmt.Errorf("invalid port number %d", cmd.Port)
+		return rangeError("destination_port", 1024, 65535, "invalid port number %d", cmd.Port)
 	}
 	return nil
 }
@@ -91,38 +187,153 @@ func (cmd enablePositionBroadcastCmd) Start(ctx context.Context, t *Telescope) (
 /*
  */
 
+// how long an abort may take to stop the telescope
+var abortTimeout = 30 * time.Second
+
+// An abortCmd flushes the program track and brings the telescope to a stop.
+type abortCmd struct{}
+
+func (cmd abortCmd) Check() error {
+	return nil
+}
+
+func (cmd abortCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	err := tel.Abort()
+	if err != nil {
+		return nil, err
+	}
+	t0 := time.Now()
+	isDone := func(tel *Telescope) (bool, error) {
+		rec, cfg := tel.Status(), currentConfig()
+		done := (math.Abs(rec.AzimuthCurrentVelocity) < cfg.SpeedTolerance) &&
+			(math.Abs(rec.ElevationCurrentVelocity) < cfg.SpeedTolerance)
+		if done {
+			log.Print("abort: telescope stopped")
+		} else if time.Since(t0) > abortTimeout {
+			return true, fmt.Errorf("abort: telescope not stopped after %v", abortTimeout)
+		}
+		return done, nil
+	}
+	return isDone, nil
+}
+
+// axisIndex returns the index of axis, "azimuth" or "elevation",
+// in an az,el pair.
+func axisIndex(axis string) int {
+	if axis == "elevation" {
+		return 1
+	}
+	return 0
+}
+
+// checkAxisPosition checks the position of one axis, "azimuth" or
+// "elevation", against its limits.
+func checkAxisPosition(axis string, x float64) error {
+	min, max := azimuthMin, azimuthMax
+	switch axis {
+	case "azimuth":
+	case "elevation":
+		min, max = elevationMin, elevationMax
+	default:
+		return &FieldError{Field: "axis", Reason: fmt.Sprintf("expected azimuth or elevation, got %q", axis)}
+	}
+	if !isFinite(x) {
+		return finiteError(axis, x)
+	}
+	if x < min || x > max {
+		return &LimitError{axis, "position", x, min, max, false}
+	}
+	return nil
+}
+
 type moveToCmd struct {
 	Azimuth   float64
 	Elevation float64
+	Axis      string   `json:"axis"` // "azimuth" or "elevation" to move only that axis
+	Rotator   *float64 `json:"rotator"`
+
+	// for safety moves, e.g. wind stow
+	skipSunCheck bool
 }
 
 func (cmd moveToCmd) Check() error {
-	return checkAzEl(cmd.Azimuth, cmd.Elevation, 0, 0)
+	if cmd.Axis != "" {
+		// the soft limits and the Sun are checked by start,
+		// once the other axis' position is known
+		err := checkAxisPosition(cmd.Axis, [2]float64{cmd.Azimuth, cmd.Elevation}[axisIndex(cmd.Axis)])
+		if err == nil {
+			err = checkRotatorOption(cmd.Rotator)
+		}
+		return err
+	}
+	err := checkAzEl(cmd.Azimuth, cmd.Elevation, 0, 0)
+	if err == nil {
+		err = checkRotatorOption(cmd.Rotator)
+	}
+	if err != nil || cmd.skipSunCheck {
+		return err
+	}
+	return siteSunAvoidance.CheckPosition(time.Now(), cmd.Azimuth, cmd.Elevation)
 }
 
 func estimateMoveTime(az0, az1, el0, el1 float64) time.Duration {
 	s, c := math.Sincos((az1 - az0) * math.Pi / 180)
 	daz := math.Abs(math.Atan2(s, c) * 180 / math.Pi)
 	daz = math.Max(daz, 360-daz) // might have to take the long way around (XXX:refine this estimate)
-	taz := daz/azimuthSpeedMax + azimuthSpeedMax/azimuthAccelMax + azimuthAccelMax/azimuthJerkMax
+	speed, accel := azimuthLimitsOver(el0, el1)
+	taz := daz/speed + speed/accel + accel/azimuthJerkMax
 	tel := math.Abs(el1-el0)/elevationSpeedMax + elevationSpeedMax/elevationAccelMax + elevationAccelMax/elevationJerkMax
 	return Seconds2Duration(1.1 * math.Max(taz, tel))
 }
 
 func (cmd moveToCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startWithRotator(tel, cmd.Rotator, func() (IsDoneFunc, error) {
+		return cmd.start(ctx, tel)
+	})
+}
+
+func (cmd moveToCmd) start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
 	t0 := time.Now()
 	rec := tel.Status()
+	if cmd.Axis != "" {
+		// the other axis stays where it is
+		az, el := tel.Position()
+		if cmd.Axis == "azimuth" {
+			cmd.Elevation = el
+		} else {
+			cmd.Azimuth = az
+		}
+		err := checkAzEl(cmd.Azimuth, cmd.Elevation, 0, 0)
+		if err == nil && !cmd.skipSunCheck {
+			err = siteSunAvoidance.CheckPosition(t0, cmd.Azimuth, cmd.Elevation)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
 	timeout := estimateMoveTime(cmd.Azimuth, rec.AzimuthCurrentPosition, cmd.Elevation, rec.ElevationCurrentPosition)
 	log.Printf("estimated move time: %g secs", timeout.Seconds())
-	err := tel.MoveTo(cmd.Azimuth, cmd.Elevation)
+	if !cmd.skipSunCheck {
+		err := siteSunAvoidance.CheckMove(t0, rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition, cmd.Azimuth, cmd.Elevation)
+		if err != nil {
+			return nil, err
+		}
+	}
+	var err error
+	if cmd.Axis == "" {
+		err = tel.MoveTo(cmd.Azimuth, cmd.Elevation)
+	} else {
+		err = tel.MoveAxisTo(cmd.Axis, cmd.Azimuth, cmd.Elevation)
+	}
 	isDone := func(tel *Telescope) (bool, error) {
-		rec := tel.Status()
-		done := (rec.AzimuthMode == datasets.AzimuthModePreset) &&
-			(rec.ElevationMode == datasets.ElevationModePreset) &&
-			(math.Abs(rec.AzimuthCurrentPosition-rec.AzimuthCommandedPosition) < positionTol) &&
-			(math.Abs(rec.ElevationCurrentPosition-rec.ElevationCommandedPosition) < positionTol) &&
-			(math.Abs(rec.AzimuthCurrentVelocity) < speedTol) &&
-			(math.Abs(rec.ElevationCurrentVelocity) < speedTol)
+		rec, cfg := tel.Status(), currentConfig()
+		azDone := (rec.AzimuthMode == datasets.AzimuthModePreset) &&
+			(math.Abs(rec.AzimuthCurrentPosition-rec.AzimuthCommandedPosition) < cfg.PositionTolerance) &&
+			(math.Abs(rec.AzimuthCurrentVelocity) < cfg.SpeedTolerance)
+		elDone := (rec.ElevationMode == datasets.ElevationModePreset) &&
+			(math.Abs(rec.ElevationCurrentPosition-rec.ElevationCommandedPosition) < cfg.PositionTolerance) &&
+			(math.Abs(rec.ElevationCurrentVelocity) < cfg.SpeedTolerance)
+		done := (azDone || cmd.Axis == "elevation") && (elDone || cmd.Axis == "azimuth")
 		if !done && time.Since(t0) > timeout {
 			return false, fmt.Errorf("move command timed out")
 		}
@@ -141,58 +352,359 @@ type azScanCmd struct {
 	StartTime      float64    `json:"start_time"`
 	TurnaroundTime float64    `json:"turnaround_time"`
 	Speed          float64    `json:"speed"`
+	Rotator        *float64   `json:"rotator"`
+	SingleAxis     bool       `json:"single_axis"` // leave elevation in its current mode
 }
 
 func (cmd azScanCmd) Check() error {
-	// XXX:TBD
-	return nil
+	if err := checkRotatorOption(cmd.Rotator); err != nil {
+		return err
+	}
+	if cmd.NumScans < 1 {
+		return fieldError("num_scans", "not positive", "bad number of scans: %d", cmd.NumScans)
+	}
+	if cmd.AzimuthRange[0] == cmd.AzimuthRange[1] {
+		return fieldError("azimuth_range", "empty", "empty azimuth range")
+	}
+	speedMax, accelMax := azimuthLimitsAt(cmd.Elevation)
+	if cmd.Speed <= 0 || cmd.Speed > speedMax {
+		return rangeError("speed", 0, speedMax, "scan speed (%g) out of range (0,%g]", cmd.Speed, speedMax)
+	}
+	for _, az := range cmd.AzimuthRange {
+		err := checkAzEl(az, cmd.Elevation, cmd.Speed, 0)
+		if err != nil {
+			return err
+		}
+	}
+	// zero for the shortest turnaround
+	if cmd.TurnaroundTime != 0 {
+		err := checkTurnaround(cmd.TurnaroundTime, cmd.Speed, accelMax, azimuthJerkMax)
+		if err != nil {
+			return err
+		}
+	}
+	err := checkStartTime(cmd.StartTime)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+// A PatternCommand is a Command that executes a ScanPattern.
+type PatternCommand interface {
+	Command
+	Pattern() (ScanPattern, error)
 }
 
-func startPattern(ctx context.Context, tel *Telescope, pattern ScanPattern) (IsDoneFunc, error) {
-	// ICD Section 9.1: "Before commanding or setting up a new mode,
-	// it is best practice to set the antenna to Stop mode first."
-	err := tel.acu.ModeSet("Stop")
+// patternCheckWindow bounds the points checked when a pattern command is
+// submitted, so a long track can't hold up the API; the rest are checked
+// when it starts.
+const patternCheckWindow = 10 * time.Minute
+
+// checkPatternCmd generates the command's pattern and validates its
+// points within patternCheckWindow of the first.
+func checkPatternCmd(cmd PatternCommand) error {
+	pattern, err := cmd.Pattern()
 	if err != nil {
-		return nil, err
+		return err
+	}
+	return checkPattern(newWindowScanPattern(pattern, patternCheckWindow))
+}
+
+// checkPattern checks every point of a pattern against the limits and the Sun.
+func checkPattern(pattern ScanPattern) error {
+	err := ValidateScanPattern(pattern)
+	if err != nil {
+		return err
 	}
+	return siteSunAvoidance.CheckPattern(pattern)
+}
 
-	err = tel.acu.ProgramTrackClear()
+func startPatternCmd(ctx context.Context, tel *Telescope, cmd PatternCommand) (IsDoneFunc, error) {
+	pattern, err := cmd.Pattern()
 	if err != nil {
 		return nil, err
 	}
-	time.Sleep(3 * time.Millisecond) // wait for ProgramTrackClear to take effect
+	err = checkPattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	var tags map[string]string
+	if cmd, ok := cmd.(taggedCommand); ok {
+		tags = cmd.scanTags()
+	}
+	axis := ""
+	if cmd, ok := cmd.(singleAxisCommand); ok {
+		var held float64
+		axis, held = cmd.drivenAxis()
+		if axis != "" {
+			err = checkHeldAxis(tel, axis, held)
+			if err != nil {
+				return nil, err
+			}
+		}
+	}
+	return startPattern(ctx, tel, pattern, tags, axis)
+}
 
-	uploadErrChan := make(chan error)
-	go func() {
-		uploadErrChan <- tel.UploadScanPattern(ctx, pattern)
-	}()
+// A singleAxisCommand is a PatternCommand which may drive only one axis,
+// leaving the other in its current mode.
+type singleAxisCommand interface {
+	// drivenAxis returns the axis driven, "" for both, and where the
+	// other axis is held, as the pattern was checked there.
+	drivenAxis() (axis string, held float64)
+}
+
+// checkHeldAxis checks the axis a single axis pattern doesn't drive is
+// where the pattern holds it.
+func checkHeldAxis(tel *Telescope, axis string, held float64) error {
+	az, el := tel.Position()
+	i := 1 - axisIndex(axis)
+	x := [2]float64{az, el}[i]
+	if math.Abs(x-held) > currentConfig().PositionTolerance {
+		name := [2]string{"azimuth", "elevation"}[i]
+		return fmt.Errorf("%s (%g) not at the scan's %s (%g)", name, x, name, held)
+	}
+	return nil
+}
 
+// startPattern starts executing pattern on axis, "azimuth" or
+// "elevation", or on both if axis is "".
+func startPattern(ctx context.Context, tel *Telescope, pattern ScanPattern, tags map[string]string, axis string) (IsDoneFunc, error) {
+	exec, err := tel.StartPattern(ctx, pattern, tags, axis)
+	if err != nil {
+		return nil, err
+	}
 	isDone := func(tel *Telescope) (bool, error) {
-		// check for upload errors
-		select {
-		default:
-		case err := <-uploadErrChan:
-			if err != nil {
-				return true, err
-			}
+		done, err := exec.IsDone(tel.Status())
+		if done || err != nil {
+			tel.pattern = nil
 		}
+		return done, err
+	}
+	return isDone, nil
+}
 
-		// XXX:racy
-		rec := tel.Status()
-		done := (rec.QtyOfFreeProgramTrackStackPositions == maxFreeProgramTrackStack-1) && // last point remains on the stack
-			(math.Abs(rec.AzimuthCurrentVelocity) < speedTol) &&
-			(math.Abs(rec.ElevationCurrentVelocity) < speedTol) &&
-			(rec.AzimuthMode == datasets.AzimuthModeProgramTrack) &&
-			(rec.ElevationMode == datasets.ElevationModeProgramTrack)
-		return done, nil
+func (cmd azScanCmd) Pattern() (ScanPattern, error) {
+	t0 := jsontime(cmd.StartTime)
+	return NewAzimuthScanPattern(t0, cmd.NumScans, cmd.Elevation, cmd.AzimuthRange, cmd.Speed, Seconds2Duration(cmd.TurnaroundTime)), nil
+}
+
+func (cmd azScanCmd) drivenAxis() (string, float64) {
+	if !cmd.SingleAxis {
+		return "", 0
 	}
-	return isDone, tel.acu.ModeSet("ProgramTrack")
+	return "azimuth", cmd.Elevation
 }
 
 func (cmd azScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startWithRotator(tel, cmd.Rotator, func() (IsDoneFunc, error) {
+		return startPatternCmd(ctx, tel, cmd)
+	})
+}
+
+type elScanCmd struct {
+	ElevationRange [2]float64 `json:"elevation_range"`
+	Azimuth        float64    `json:"azimuth"`
+	NumScans       int        `json:"num_scans"`
+	StartTime      float64    `json:"start_time"`
+	TurnaroundTime float64    `json:"turnaround_time"`
+	Speed          float64    `json:"speed"`
+	Rotator        *float64   `json:"rotator"`
+	SingleAxis     bool       `json:"single_axis"` // leave azimuth in its current mode
+}
+
+func (cmd elScanCmd) Check() error {
+	if err := checkRotatorOption(cmd.Rotator); err != nil {
+		return err
+	}
+	if cmd.NumScans < 1 {
+		return fieldError("num_scans", "not positive", "bad number of scans: %d", cmd.NumScans)
+	}
+	if cmd.ElevationRange[0] == cmd.ElevationRange[1] {
+		return fieldError("elevation_range", "empty", "empty elevation range")
+	}
+	if cmd.Speed <= 0 || cmd.Speed > elevationSpeedMax {
+		return rangeError("speed", 0, elevationSpeedMax, "scan speed (%g) out of range (0,%g]", cmd.Speed, elevationSpeedMax)
+	}
+	for _, el := range cmd.ElevationRange {
+		err := checkAzEl(cmd.Azimuth, el, 0, cmd.Speed)
+		if err != nil {
+			return err
+		}
+	}
+	// zero for the shortest turnaround
+	if cmd.TurnaroundTime != 0 {
+		err := checkTurnaround(cmd.TurnaroundTime, cmd.Speed, elevationAccelMax, elevationJerkMax)
+		if err != nil {
+			return err
+		}
+	}
+	err := checkStartTime(cmd.StartTime)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd elScanCmd) Pattern() (ScanPattern, error) {
+	t0 := jsontime(cmd.StartTime)
+	return NewElevationScanPattern(t0, cmd.NumScans, cmd.Azimuth, cmd.ElevationRange, cmd.Speed, Seconds2Duration(cmd.TurnaroundTime)), nil
+}
+
+func (cmd elScanCmd) drivenAxis() (string, float64) {
+	if !cmd.SingleAxis {
+		return "", 0
+	}
+	return "elevation", cmd.Azimuth
+}
+
+func (cmd elScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startWithRotator(tel, cmd.Rotator, func() (IsDoneFunc, error) {
+		return startPatternCmd(ctx, tel, cmd)
+	})
+}
+
+// A driftScanCmd holds the telescope at a fixed elevation for a duration,
+// parked at a fixed azimuth, or drifting at a constant azimuth rate,
+// letting the sky drift through the beam. Its scan is tagged as a drift.
+type driftScanCmd struct {
+	Azimuth     float64  `json:"azimuth"`
+	Elevation   float64  `json:"elevation"`
+	AzimuthRate float64  `json:"azimuth_rate"` // [deg/s]
+	Duration    float64  `json:"duration"`     // [s]
+	StartTime   float64  `json:"start_time"`
+	Rotator     *float64 `json:"rotator"`
+}
+
+func (cmd driftScanCmd) Check() error {
+	if err := checkRotatorOption(cmd.Rotator); err != nil {
+		return err
+	}
+	if !isFinite(cmd.Duration) {
+		return finiteError("duration", cmd.Duration)
+	}
+	if cmd.Duration < 1 {
+		return fieldError("duration", "less than 1 sec", "bad duration: %g", cmd.Duration)
+	}
+	err := checkTimeFields("start_time", "duration", cmd.StartTime, cmd.StartTime+cmd.Duration)
+	if err != nil {
+		return err
+	}
+	speedMax, _ := azimuthLimitsAt(cmd.Elevation)
+	if math.Abs(cmd.AzimuthRate) > speedMax {
+		return rangeError("azimuth_rate", -speedMax, speedMax, "azimuth rate (%g) out of range [%g,%g]", cmd.AzimuthRate, -speedMax, speedMax)
+	}
+	for _, az := range []float64{cmd.Azimuth, cmd.Azimuth + cmd.AzimuthRate*cmd.Duration} {
+		err := checkAzEl(az, cmd.Elevation, cmd.AzimuthRate, 0)
+		if err != nil {
+			return err
+		}
+	}
+	err = checkStartTime(cmd.StartTime)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd driftScanCmd) Pattern() (ScanPattern, error) {
+	t0 := jsontime(cmd.StartTime)
+	return NewDriftScanPattern(t0, Seconds2Duration(cmd.Duration), cmd.Azimuth, cmd.Elevation, cmd.AzimuthRate), nil
+}
+
+func (cmd driftScanCmd) scanTags() map[string]string {
+	return map[string]string{
+		"observation":  "drift",
+		"azimuth":      fmt.Sprint(cmd.Azimuth),
+		"elevation":    fmt.Sprint(cmd.Elevation),
+		"azimuth_rate": fmt.Sprint(cmd.AzimuthRate),
+		"duration":     fmt.Sprint(cmd.Duration),
+	}
+}
+
+func (cmd driftScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startWithRotator(tel, cmd.Rotator, func() (IsDoneFunc, error) {
+		return startPatternCmd(ctx, tel, cmd)
+	})
+}
+
+type rasterScanCmd struct {
+	AzimuthRange   [2]float64 `json:"azimuth_range"`
+	ElevationRange [2]float64 `json:"elevation_range"`
+	ScanAxis       string     `json:"scan_axis"`
+	Step           float64    `json:"step"`
+	StartTime      float64    `json:"start_time"`
+	TurnaroundTime float64    `json:"turnaround_time"`
+	Speed          float64    `json:"speed"`
+	Rotator        *float64   `json:"rotator"`
+}
+
+func (cmd rasterScanCmd) sweepEl() bool {
+	return cmd.ScanAxis == "elevation"
+}
+
+func (cmd rasterScanCmd) Check() error {
+	if err := checkRotatorOption(cmd.Rotator); err != nil {
+		return err
+	}
+	var sweep, cross [2]float64
+	var sweepAxis string
+	var speedMax, sweepAccelMax, sweepJerkMax, crossAccelMax float64
+	azSpeedMax, azAccelMax := azimuthLimitsOver(cmd.ElevationRange[0], cmd.ElevationRange[1])
+	switch cmd.ScanAxis {
+	case "", "azimuth":
+		sweep, cross, sweepAxis = cmd.AzimuthRange, cmd.ElevationRange, "azimuth"
+		speedMax, sweepAccelMax, sweepJerkMax = azSpeedMax, azAccelMax, azimuthJerkMax
+		crossAccelMax = elevationAccelMax
+	case "elevation":
+		sweep, cross, sweepAxis = cmd.ElevationRange, cmd.AzimuthRange, "elevation"
+		speedMax, sweepAccelMax, sweepJerkMax = elevationSpeedMax, elevationAccelMax, elevationJerkMax
+		crossAccelMax = azAccelMax
+	default:
+		return fieldError("scan_axis", "expected azimuth or elevation", "bad scan axis: %s", cmd.ScanAxis)
+	}
+	if sweep[0] == sweep[1] {
+		return fieldError(sweepAxis+"_range", "empty", "empty %s range", sweepAxis)
+	}
+	if cmd.Speed <= 0 || cmd.Speed > speedMax {
+		return rangeError("speed", 0, speedMax, "scan speed (%g) out of range (0,%g]", cmd.Speed, speedMax)
+	}
+	if cmd.Step <= 0 || cmd.Step > math.Abs(cross[1]-cross[0]) {
+		return rangeError("step", 0, math.Abs(cross[1]-cross[0]), "bad step size: %g", cmd.Step)
+	}
+	for _, az := range cmd.AzimuthRange {
+		for _, el := range cmd.ElevationRange {
+			err := checkAzEl(az, el, 0, 0)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	err := checkTurnaround(cmd.TurnaroundTime, cmd.Speed, sweepAccelMax, sweepJerkMax)
+	if err != nil {
+		return err
+	}
+	// stepping from rest to rest takes at least 2*sqrt(step/accel)
+	if minStep := 2 * math.Sqrt(cmd.Step/crossAccelMax); cmd.TurnaroundTime < minStep {
+		return fieldError("turnaround_time", "too short", "turnaround time (%g) too short to step %g deg, need at least %g secs", cmd.TurnaroundTime, cmd.Step, minStep)
+	}
+	err = checkStartTime(cmd.StartTime)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd rasterScanCmd) Pattern() (ScanPattern, error) {
 	t0 := jsontime(cmd.StartTime)
-	pattern := NewAzimuthScanPattern(t0, cmd.NumScans, cmd.Elevation, cmd.AzimuthRange, cmd.Speed, Seconds2Duration(cmd.TurnaroundTime))
-	return startPattern(ctx, tel, pattern)
+	return NewRasterScanPattern(t0, cmd.AzimuthRange, cmd.ElevationRange, cmd.Step, cmd.Speed, Seconds2Duration(cmd.TurnaroundTime), cmd.sweepEl()), nil
+}
+
+func (cmd rasterScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startWithRotator(tel, cmd.Rotator, func() (IsDoneFunc, error) {
+		return startPatternCmd(ctx, tel, cmd)
+	})
 }
 
 type trackCmd struct {
@@ -201,45 +713,144 @@ type trackCmd struct {
 	RA        float64
 	Dec       float64
 	Coordsys  string
+	Body      string   // solar system body, instead of RA/Dec
+	Target    string   // solar system body or catalog source, instead of RA/Dec
+	AzWrap    string   `json:"az_wrap"`
+	Rotator   *float64 `json:"rotator"`
+
+	// ICRS only
+	PMRA           float64 `json:"pmra"`  // times cos(Dec) [mas/yr]
+	PMDec          float64 `json:"pmdec"` // [mas/yr]
+	Parallax       float64 // [mas]
+	RadialVelocity float64 `json:"radial_velocity"` // [km/s]
+	Epoch          float64 // Julian epoch, default J2000
+}
+
+func (cmd trackCmd) hasSpaceMotion() bool {
+	return cmd.PMRA != 0 || cmd.PMDec != 0 || cmd.Parallax != 0 || cmd.RadialVelocity != 0 || cmd.Epoch != 0
+}
+
+// resolve looks up the command's target, if any, returning the command
+// tracking its body or catalog position instead.
+func (cmd trackCmd) resolve() (trackCmd, error) {
+	if cmd.Target == "" {
+		return cmd, nil
+	}
+	if cmd.Body != "" || cmd.Coordsys != "" || cmd.RA != 0 || cmd.Dec != 0 || cmd.hasSpaceMotion() {
+		return cmd, fieldError("target", "not allowed with body, coordinates, or space motion", "body, coordinates, and space motion not allowed with target")
+	}
+	if checkSolarSystemBody(cmd.Target) == nil {
+		cmd.Body = cmd.Target
+	} else if e, ok := siteCatalog.Get(cmd.Target); ok {
+		cmd.Coordsys = "ICRS"
+		cmd.RA, cmd.Dec = e.RA, e.Dec
+		cmd.PMRA, cmd.PMDec = e.PMRA, e.PMDec
+		cmd.Parallax, cmd.RadialVelocity, cmd.Epoch = e.Parallax, e.RadialVelocity, e.Epoch
+	} else {
+		return cmd, &FieldError{Field: "target", Reason: fmt.Sprintf("unknown target %s", cmd.Target)}
+	}
+	cmd.Target = ""
+	return cmd, nil
 }
 
 func (cmd trackCmd) Check() error {
-	switch cmd.Coordsys {
-	case "Horizon":
-	case "ICRS":
-	default:
-		return fmt.Errorf("bad coordinate system: %s", cmd.Coordsys)
+	if cmd.Target != "" {
+		resolved, err := cmd.resolve()
+		if err != nil {
+			return err
+		}
+		return resolved.Check()
 	}
-	if cmd.StopTime < cmd.StartTime {
-		return fmt.Errorf("bad times: start=%f, stop=%f", cmd.StartTime, cmd.StopTime)
+	if err := checkRotatorOption(cmd.Rotator); err != nil {
+		return err
 	}
-	return nil
+	if cmd.Body != "" {
+		if cmd.Coordsys != "" {
+			return fieldError("coordsys", "not allowed with body", "coordsys not allowed with body")
+		}
+		err := checkSolarSystemBody(cmd.Body)
+		if err != nil {
+			return err
+		}
+	} else if err := checkCoordsys(cmd.Coordsys); err != nil {
+		return err
+	}
+	if cmd.hasSpaceMotion() && cmd.Coordsys != "ICRS" {
+		return fieldError("coordsys", "expected ICRS with space motion", "proper motion, parallax, and epoch require ICRS")
+	}
+	if cmd.Parallax < 0 {
+		return fieldError("parallax", "negative", "bad parallax: %g", cmd.Parallax)
+	}
+	if err := checkTimes(cmd.StartTime, cmd.StopTime); err != nil {
+		return err
+	}
+	if cmd.Coordsys != "Horizon" {
+		pattern, err := cmd.trackPattern()
+		if err != nil {
+			return err
+		}
+		err = checkVisibility(*pattern.(*TrackScanPattern), jsontime(cmd.StartTime), jsontime(cmd.StopTime))
+		if err != nil {
+			return err
+		}
+	}
+	return checkPatternCmd(cmd)
 }
 
-func (cmd trackCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
-	pattern, err := NewTrackScanPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), cmd.RA, cmd.Dec, cmd.Coordsys)
+func (cmd trackCmd) Pattern() (ScanPattern, error) {
+	cmd, err := cmd.resolve()
 	if err != nil {
 		return nil, err
 	}
-	return startPattern(ctx, tel, pattern)
+	pattern, err := cmd.trackPattern()
+	if err != nil {
+		return nil, err
+	}
+	return wrapAzimuth(pattern, cmd.Coordsys, cmd.AzWrap)
+}
+
+func (cmd trackCmd) trackPattern() (ScanPattern, error) {
+	if cmd.Body != "" {
+		return NewBodyTrackScanPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), cmd.Body)
+	}
+	if cmd.Coordsys == "ICRS" {
+		star := Star{
+			RA:             cmd.RA,
+			Dec:            cmd.Dec,
+			PMRA:           cmd.PMRA,
+			PMDec:          cmd.PMDec,
+			Parallax:       cmd.Parallax,
+			RadialVelocity: cmd.RadialVelocity,
+			Epoch:          cmd.Epoch,
+		}
+		return NewStarTrackScanPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), star)
+	}
+	return NewTrackScanPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), cmd.RA, cmd.Dec, cmd.Coordsys)
+}
+
+func (cmd trackCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startWithRotator(tel, cmd.Rotator, func() (IsDoneFunc, error) {
+		return startPatternCmd(ctx, tel, cmd)
+	})
 }
 
 type pathCmd struct {
 	Coordsys  string
 	Points    [][5]float64
 	StartTime float64 `json:"start_time"`
+	AzWrap    string  `json:"az_wrap"`
+	SkyRates  bool    `json:"sky_rates"` // vx,vy are sky rates, for sky coordsys
+	Spline    bool    // resample along splines through the points
 }
 
 func (cmd pathCmd) Check() error {
-	switch cmd.Coordsys {
-	case "Horizon":
-	case "ICRS":
-	default:
-		return fmt.Errorf("bad coordinate system: %s", cmd.Coordsys)
+	err := checkCoordsys(cmd.Coordsys)
+	if err != nil {
+		return err
 	}
 
 	if len(cmd.Points) == 0 {
-		return fmt.Errorf("no points in path")
+		return fieldError("points", "empty", "no points in path")
 	}
 
 	// check the times
@@ -247,32 +858,407 @@ func (cmd pathCmd) Check() error {
 		// ACU ICD 2.0, section 8.9.3:
 		// "The minimum time interval between two samples is 0.05 s."
 		if cmd.Points[i][0]-cmd.Points[i-1][0] < 0.05 {
-			return fmt.Errorf("points are separated by less than 50 ms")
+			return fieldError("points", "less than 50 ms apart", "points are separated by less than 50 ms")
+		}
+	}
+	if err := checkTimeFields("points", "points", cmd.Points[0][0], cmd.Points[len(cmd.Points)-1][0]); err != nil {
+		return err
+	}
+	if cmd.Spline && len(cmd.Points) < 2 {
+		return fieldError("points", "fewer than 2 for a spline", "spline path needs at least 2 points")
+	}
+
+	return checkPatternCmd(cmd)
+}
+
+func (cmd pathCmd) Pattern() (ScanPattern, error) {
+	points, skyRates := cmd.Points, cmd.SkyRates
+	if cmd.Spline {
+		endRates := skyRates || cmd.Coordsys == "Horizon"
+		points = splinePath(points, cmd.Coordsys, pathSplineInterval, endRates)
+		skyRates = true // the splines' rates
+	}
+	pattern := NewPathScanPattern(jsontime(cmd.StartTime), points, cmd.Coordsys, skyRates)
+	return wrapAzimuth(pattern, cmd.Coordsys, cmd.AzWrap)
+}
+
+func (cmd pathCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+func checkCoordsys(coordsys string) error {
+	switch coordsys {
+	case "Horizon":
+	case "ICRS":
+	case "Galactic":
+	case "Ecliptic":
+	default:
+		return fieldError("coordsys", "expected Horizon, ICRS, Galactic or Ecliptic", "bad coordinate system: %s", coordsys)
+	}
+	return nil
+}
+
+// centerElevation returns the elevation of x,y at time t.
+func centerElevation(t time.Time, x, y float64, coordsys string) (float64, error) {
+	if coordsys != "Horizon" {
+		_, el, err := Sky2ObsAzEl(Time2Unixtime(t), x, y, coordsys)
+		return el, err
+	}
+	return y, nil
+}
+
+// checkOffsetKinematics checks the peak on-sky speed, acceleration, and jerk
+// of an offset pattern (indexed by axis) centered at elevation el,
+// blaming field if they're too high.
+// Azimuth rates are magnified by 1/cos(el), and limited as at el.
+func checkOffsetKinematics(field string, el float64, speed, accel, jerk [2]float64) error {
+	cosEl := math.Abs(math.Cos(deg2rad(el)))
+	azSpeedMax, azAccelMax := azimuthLimitsAt(el)
+	limits := []struct {
+		name   string
+		values [2]float64
+		max    [2]float64
+	}{
+		{"speed", speed, [2]float64{azSpeedMax, elevationSpeedMax}},
+		{"acceleration", accel, [2]float64{azAccelMax, elevationAccelMax}},
+		{"jerk", jerk, [2]float64{azimuthJerkMax, elevationJerkMax}},
+	}
+	for _, lim := range limits {
+		if v := lim.values[0] / cosEl; v > lim.max[0] {
+			return fieldError(field, "peak azimuth "+lim.name+" exceeds limit", "peak azimuth %s (%g) exceeds limit (%g)", lim.name, v, lim.max[0])
+		}
+		if v := lim.values[1]; v > lim.max[1] {
+			return fieldError(field, "peak elevation "+lim.name+" exceeds limit", "peak elevation %s (%g) exceeds limit (%g)", lim.name, v, lim.max[1])
 		}
 	}
+	return nil
+}
 
-	// check the first 100 coordinates
-	pattern := NewPathScanPattern(jsontime(cmd.StartTime), cmd.Points, cmd.Coordsys)
-	iter := pattern.Iterator()
-	for i := 0; i < 100; i++ {
-		if pattern.Done(iter) {
-			break
+type lissajousScanCmd struct {
+	StartTime float64 `json:"start_time"`
+	StopTime  float64 `json:"stop_time"`
+	RA        float64
+	Dec       float64
+	Coordsys  string
+	Amplitude [2]float64 `json:"amplitude"`
+	Period    [2]float64 `json:"period"`
+	Phase     float64    `json:"phase"`
+	AzWrap    string     `json:"az_wrap"`
+}
+
+func (cmd lissajousScanCmd) Check() error {
+	err := checkCoordsys(cmd.Coordsys)
+	if err != nil {
+		return err
+	}
+	if err := checkTimes(cmd.StartTime, cmd.StopTime); err != nil {
+		return err
+	}
+	for i := range cmd.Period {
+		if cmd.Period[i] <= 0 {
+			return fieldError("period", "not positive", "bad period: %g", cmd.Period[i])
+		}
+		if cmd.Amplitude[i] < 0 {
+			return fieldError("amplitude", "negative", "bad amplitude: %g", cmd.Amplitude[i])
 		}
-		var pt ScanPatternSample
-		err := pattern.Next(iter, &pt)
+	}
+	el, err := centerElevation(jsontime(cmd.StartTime), cmd.RA, cmd.Dec, cmd.Coordsys)
+	if err != nil {
+		return err
+	}
+	var speed, accel, jerk [2]float64
+	for i := range cmd.Period {
+		w := 2 * math.Pi / cmd.Period[i]
+		speed[i] = cmd.Amplitude[i] * w
+		accel[i] = speed[i] * w
+		jerk[i] = accel[i] * w
+	}
+	err = checkOffsetKinematics("amplitude", el, speed, accel, jerk)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd lissajousScanCmd) Pattern() (ScanPattern, error) {
+	pattern := NewLissajousScanPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), cmd.RA, cmd.Dec, cmd.Coordsys, cmd.Amplitude, cmd.Period, cmd.Phase)
+	return wrapAzimuth(pattern, cmd.Coordsys, cmd.AzWrap)
+}
+
+func (cmd lissajousScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+type daisyScanCmd struct {
+	StartTime float64 `json:"start_time"`
+	StopTime  float64 `json:"stop_time"`
+	RA        float64
+	Dec       float64
+	Coordsys  string
+	Radius    float64 `json:"radius"`
+	Speed     float64 `json:"speed"`
+	NumPetals int     `json:"num_petals"`
+	AzWrap    string  `json:"az_wrap"`
+}
+
+func (cmd daisyScanCmd) Check() error {
+	err := checkCoordsys(cmd.Coordsys)
+	if err != nil {
+		return err
+	}
+	if err := checkTimes(cmd.StartTime, cmd.StopTime); err != nil {
+		return err
+	}
+	if cmd.Radius <= 0 {
+		return fieldError("radius", "not positive", "bad radius: %g", cmd.Radius)
+	}
+	if cmd.Speed <= 0 {
+		return fieldError("speed", "not positive", "bad speed: %g", cmd.Speed)
+	}
+	if cmd.NumPetals < 1 {
+		return fieldError("num_petals", "not positive", "bad number of petals: %d", cmd.NumPetals)
+	}
+	el, err := centerElevation(jsontime(cmd.StartTime), cmd.RA, cmd.Dec, cmd.Coordsys)
+	if err != nil {
+		return err
+	}
+	// the n-th derivative of radius*sin(wr t)*exp(i wt t)
+	// is bounded by radius*(wr+wt)^n
+	wr, wt := daisyRates(cmd.Radius, cmd.Speed, cmd.NumPetals)
+	w := wr + wt
+	v := cmd.Radius * w
+	a := v * w
+	j := a * w
+	err = checkOffsetKinematics("speed", el, [2]float64{v, v}, [2]float64{a, a}, [2]float64{j, j})
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd daisyScanCmd) Pattern() (ScanPattern, error) {
+	pattern := NewDaisyScanPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), cmd.RA, cmd.Dec, cmd.Coordsys, cmd.Radius, cmd.Speed, cmd.NumPetals)
+	return wrapAzimuth(pattern, cmd.Coordsys, cmd.AzWrap)
+}
+
+func (cmd daisyScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+type scanTrackCmd struct {
+	StartTime      float64 `json:"start_time"`
+	StopTime       float64 `json:"stop_time"`
+	RA             float64
+	Dec            float64
+	Coordsys       string
+	Throw          float64 `json:"throw"`
+	Speed          float64 `json:"speed"`
+	TurnaroundTime float64 `json:"turnaround_time"`
+	AzWrap         string  `json:"az_wrap"`
+}
+
+func (cmd scanTrackCmd) Check() error {
+	err := checkCoordsys(cmd.Coordsys)
+	if err != nil {
+		return err
+	}
+	if err := checkTimes(cmd.StartTime, cmd.StopTime); err != nil {
+		return err
+	}
+	if cmd.Throw <= 0 {
+		return fieldError("throw", "not positive", "bad throw: %g", cmd.Throw)
+	}
+	if cmd.Speed <= 0 {
+		return fieldError("speed", "not positive", "bad speed: %g", cmd.Speed)
+	}
+	if cmd.TurnaroundTime <= 0 {
+		return fieldError("turnaround_time", "not positive", "bad turnaround time: %g", cmd.TurnaroundTime)
+	}
+	el, err := centerElevation(jsontime(cmd.StartTime), cmd.RA, cmd.Dec, cmd.Coordsys)
+	if err != nil {
+		return err
+	}
+	err = checkOffsetKinematics("speed", el, [2]float64{cmd.Speed, 0}, [2]float64{}, [2]float64{})
+	if err != nil {
+		return err
+	}
+	// the S-curve turnarounds are at the jerk limit, so their
+	// acceleration is within its limit if they're long enough
+	cosEl := math.Abs(math.Cos(deg2rad(el)))
+	_, accelMax := azimuthLimitsAt(el)
+	err = checkTurnaround(cmd.TurnaroundTime, cmd.Speed/cosEl, accelMax, azimuthJerkMax)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+// scanTrackJerk returns the jerk of a scan-track's turnarounds at elevation
+// el: the azimuth jerk limit, as a great-circle rate.
+func scanTrackJerk(el float64) float64 {
+	return azimuthJerkMax * math.Abs(math.Cos(deg2rad(el)))
+}
+
+func (cmd scanTrackCmd) Pattern() (ScanPattern, error) {
+	el, err := centerElevation(jsontime(cmd.StartTime), cmd.RA, cmd.Dec, cmd.Coordsys)
+	if err != nil {
+		return nil, err
+	}
+	pattern := NewScanTrackPattern(jsontime(cmd.StartTime), jsontime(cmd.StopTime), cmd.RA, cmd.Dec, cmd.Coordsys,
+		cmd.Throw, cmd.Speed, Seconds2Duration(cmd.TurnaroundTime), scanTrackJerk(el))
+	return wrapAzimuth(pattern, cmd.Coordsys, cmd.AzWrap)
+}
+
+func (cmd scanTrackCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+// A sequenceCmd runs a list of commands back-to-back,
+// starting each one as soon as the previous one is done.
+type sequenceCmd struct {
+	Commands  []Command
+	endpoints []string // of Commands, for commandRole
+}
+
+func (cmd *sequenceCmd) UnmarshalJSON(b []byte) error {
+	var x struct {
+		Commands []struct {
+			Command string          `json:"command"`
+			Args    json.RawMessage `json:"args"`
+		} `json:"commands"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&x)
+	if err != nil {
+		return err
+	}
+	cmd.Commands = make([]Command, len(x.Commands))
+	cmd.endpoints = make([]string, len(x.Commands))
+	for i, c := range x.Commands {
+		cmd.Commands[i], err = decodeCommand(c.Command, bytes.NewReader(c.Args))
 		if err != nil {
-			return err
+			return fmt.Errorf("sequence command %d: %w", i, err)
 		}
-		err = checkAzEl(pt.Az, pt.El, pt.AzVel, pt.ElVel)
+		cmd.endpoints[i] = c.Command
+	}
+	return nil
+}
+
+func (cmd sequenceCmd) Check() error {
+	if len(cmd.Commands) == 0 {
+		return fieldError("commands", "empty", "no commands in sequence")
+	}
+	for i, c := range cmd.Commands {
+		err := c.Check()
 		if err != nil {
-			return fmt.Errorf("point %d: %w", i, err)
+			return fmt.Errorf("sequence command %d: %w", i, err)
 		}
 	}
+	return nil
+}
 
+func (cmd sequenceCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	i := 0
+	isCurrentDone, err := cmd.Commands[i].Start(ctx, tel)
+	if err != nil {
+		return nil, fmt.Errorf("sequence command %d: %w", i, err)
+	}
+	isDone := func(tel *Telescope) (bool, error) {
+		done, err := isCurrentDone(tel)
+		if err != nil {
+			return true, fmt.Errorf("sequence command %d: %w", i, err)
+		}
+		if !done {
+			return false, nil
+		}
+		log.Printf("sequence command %d done", i)
+		i++
+		if i == len(cmd.Commands) {
+			return true, nil
+		}
+		err = tel.Ready()
+		if err == nil {
+			isCurrentDone, err = cmd.Commands[i].Start(ctx, tel)
+		}
+		if err != nil {
+			return true, fmt.Errorf("sequence command %d: %w", i, err)
+		}
+		return false, nil
+	}
+	return isDone, nil
+}
+
+// A chainCmd runs scans back-to-back in one program track, without
+// stopping between them (see ChainedScanPattern). Each scan after the
+// first starts transition_time after the one before ends, so only the
+// first scan's start time is used. Their rotator options are ignored.
+type chainCmd struct {
+	Commands       []PatternCommand
+	TransitionTime float64  `json:"transition_time"` // [s]
+	endpoints      []string // of Commands, for commandRole
+}
+
+func (cmd *chainCmd) UnmarshalJSON(b []byte) error {
+	var x struct {
+		Commands []struct {
+			Command string          `json:"command"`
+			Args    json.RawMessage `json:"args"`
+		} `json:"commands"`
+		TransitionTime float64 `json:"transition_time"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&x)
+	if err != nil {
+		return err
+	}
+	cmd.Commands = make([]PatternCommand, len(x.Commands))
+	cmd.endpoints = make([]string, len(x.Commands))
+	for i, c := range x.Commands {
+		c1, err := decodeCommand(c.Command, bytes.NewReader(c.Args))
+		if err != nil {
+			return fmt.Errorf("chain command %d: %w", i, err)
+		}
+		pattern, ok := c1.(PatternCommand)
+		if !ok {
+			return &FieldError{Field: fmt.Sprintf("commands[%d]", i), Reason: fmt.Sprintf("%s is not a scan", c.Command)}
+		}
+		cmd.Commands[i] = pattern
+		cmd.endpoints[i] = c.Command
+	}
+	cmd.TransitionTime = x.TransitionTime
 	return nil
 }
 
-func (cmd pathCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
-	pattern := NewPathScanPattern(jsontime(cmd.StartTime), cmd.Points, cmd.Coordsys)
-	return startPattern(ctx, tel, pattern)
+func (cmd chainCmd) Check() error {
+	if len(cmd.Commands) == 0 {
+		return fieldError("commands", "empty", "no commands in chain")
+	}
+	if cmd.TransitionTime <= 0 {
+		return fieldError("transition_time", "not positive", "bad transition time: %g", cmd.TransitionTime)
+	}
+	for i, c := range cmd.Commands {
+		err := c.Check()
+		if err != nil {
+			return fmt.Errorf("chain command %d: %w", i, err)
+		}
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd chainCmd) Pattern() (ScanPattern, error) {
+	patterns := make([]ScanPattern, len(cmd.Commands))
+	for i, c := range cmd.Commands {
+		var err error
+		patterns[i], err = c.Pattern()
+		if err != nil {
+			return nil, fmt.Errorf("chain command %d: %w", i, err)
+		}
+	}
+	return NewChainedScanPattern(patterns, Seconds2Duration(cmd.TransitionTime))
+}
+
+func (cmd chainCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
 }
@@ -0,0 +1,285 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestMinTurnaroundTime(t *testing.T) {
+	// acceleration limited: 2*2/6 + 6/12
+	got := minTurnaroundTime(2, 6, 12)
+	if math.Abs(got-(4.0/6+0.5)) > 1e-12 {
+		t.Errorf("minTurnaroundTime: got %v", got)
+	}
+	// jerk limited: 2*sqrt(0.2/12)
+	got = minTurnaroundTime(0.1, 6, 12)
+	if math.Abs(got-2*math.Sqrt(0.2/12)) > 1e-12 {
+		t.Errorf("minTurnaroundTime: got %v", got)
+	}
+}
+
+func TestAzScanCmdCheck(t *testing.T) {
+	disableSunAvoidance(t)
+	good := azScanCmd{
+		AzimuthRange:   [2]float64{110, 130},
+		Elevation:      60,
+		NumScans:       20,
+		StartTime:      10,
+		TurnaroundTime: 5,
+		Speed:          0.8,
+	}
+	if err := good.Check(); err != nil {
+		t.Errorf("good command failed check: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*azScanCmd)
+	}{
+		{"azimuth out of range", func(c *azScanCmd) { c.AzimuthRange[1] = 400 }},
+		{"elevation out of range", func(c *azScanCmd) { c.Elevation = 200 }},
+		{"empty range", func(c *azScanCmd) { c.AzimuthRange[1] = c.AzimuthRange[0] }},
+		{"too fast", func(c *azScanCmd) { c.Speed = azimuthSpeedMax + 1 }},
+		{"zero speed", func(c *azScanCmd) { c.Speed = 0 }},
+		{"short turnaround", func(c *azScanCmd) { c.TurnaroundTime = 0.1 }},
+		{"no scans", func(c *azScanCmd) { c.NumScans = 0 }},
+		{"start in past", func(c *azScanCmd) { c.StartTime = 1615586380 }},
+	}
+	for _, test := range tests {
+		cmd := good
+		test.modify(&cmd)
+		if err := cmd.Check(); err == nil {
+			t.Errorf("%s: check passed", test.name)
+		}
+	}
+}
+
+func TestDriftScanCmdCheck(t *testing.T) {
+	disableSunAvoidance(t)
+	good := driftScanCmd{
+		Azimuth:     120,
+		Elevation:   60,
+		AzimuthRate: 0.1,
+		Duration:    600,
+		StartTime:   10,
+	}
+	if err := good.Check(); err != nil {
+		t.Errorf("good command failed check: %v", err)
+	}
+	parked := good
+	parked.AzimuthRate = 0
+	if err := parked.Check(); err != nil {
+		t.Errorf("parked command failed check: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		modify func(*driftScanCmd)
+	}{
+		{"elevation out of range", func(c *driftScanCmd) { c.Elevation = 200 }},
+		{"drifts out of range", func(c *driftScanCmd) { c.AzimuthRate = 1 }},
+		{"too fast", func(c *driftScanCmd) { c.AzimuthRate = -azimuthSpeedMax - 1 }},
+		{"no duration", func(c *driftScanCmd) { c.Duration = 0 }},
+		{"too long", func(c *driftScanCmd) { c.AzimuthRate, c.Duration = 0, 2*maxPatternDuration.Seconds() }},
+		{"start in past", func(c *driftScanCmd) { c.StartTime = 1615586380 }},
+	}
+	for _, test := range tests {
+		cmd := good
+		test.modify(&cmd)
+		if err := cmd.Check(); err == nil {
+			t.Errorf("%s: check passed", test.name)
+		}
+	}
+}
+
+func TestDecodeSequenceCmd(t *testing.T) {
+	disableSunAvoidance(t)
+	body := `{"commands": [
+		{"command": "/move-to", "args": {"azimuth": 120, "elevation": 60}},
+		{"command": "/move-to", "args": {"azimuth": 130, "elevation": 50}}
+	]}`
+	cmd, err := decodeCommand("/sequence", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	seq := cmd.(sequenceCmd)
+	if len(seq.Commands) != 2 {
+		t.Fatalf("got %d commands, expected 2", len(seq.Commands))
+	}
+	if m := seq.Commands[1].(moveToCmd); m.Azimuth != 130 || m.Elevation != 50 {
+		t.Errorf("bad command: %+v", m)
+	}
+	if err := seq.Check(); err != nil {
+		t.Error(err)
+	}
+
+	bad := `{"commands": [{"command": "/nope", "args": {}}]}`
+	_, err = decodeCommand("/sequence", strings.NewReader(bad))
+	if !errors.Is(err, errBadEndpoint) {
+		t.Errorf("got %v, expected bad endpoint", err)
+	}
+}
+
+func TestTrackCmdCheck(t *testing.T) {
+	disableSunAvoidance(t)
+	good := []trackCmd{
+		{StartTime: 10, StopTime: 20, Body: "Jupiter"},
+		{StartTime: 10, StopTime: 20, RA: 217.4, Dec: -62.7, Coordsys: "ICRS", PMRA: -3781, PMDec: 770, Parallax: 768, Epoch: 2016},
+		{StartTime: 10, StopTime: 20, Target: "Uranus"},
+		{StartTime: 10, StopTime: 20, Target: "rcw38"},
+	}
+	for _, cmd := range good {
+		if err := cmd.Check(); err != nil {
+			t.Errorf("good command failed check: %v", err)
+		}
+	}
+	bad := []trackCmd{
+		{StartTime: 10, StopTime: 20, Body: "Pluto"},
+		{StartTime: 10, StopTime: 20, Body: "Moon", Coordsys: "ICRS"},
+		{StartTime: 10, StopTime: 20, RA: 10, Dec: 20, Coordsys: "Galactic", PMRA: 5},
+		{StartTime: 10, StopTime: 20, RA: 10, Dec: 20, Coordsys: "ICRS", Parallax: -1},
+		{StartTime: 10, StopTime: 20, Target: "Nowhere"},
+		{StartTime: 10, StopTime: 20, Target: "RCW38", Coordsys: "ICRS"},
+	}
+	for _, cmd := range bad {
+		if err := cmd.Check(); err == nil {
+			t.Errorf("bad command passed check: %+v", cmd)
+		}
+	}
+}
+
+func TestRotatorCheck(t *testing.T) {
+	disableSunAvoidance(t)
+	good, bad := 30.0, 200.0
+	if err := (moveToCmd{Azimuth: 100, Elevation: 45, Rotator: &good}).Check(); err != nil {
+		t.Errorf("good command failed check: %v", err)
+	}
+	if err := (moveToCmd{Azimuth: 100, Elevation: 45, Rotator: &bad}).Check(); err == nil {
+		t.Error("bad rotator angle passed check")
+	}
+	if err := (rotatorCmd{Angle: bad}).Check(); err == nil {
+		t.Error("bad rotator angle passed check")
+	}
+}
+
+func TestDecodeCommandErrors(t *testing.T) {
+	tests := []struct {
+		body  string
+		field string
+	}{
+		{`{"azimuth": 10, "elevation": "high"}`, "elevation"},
+		{`{"azimuth": 10, "elev": 45}`, "elev"},
+		{`{"azimuth": 10,`, ""},
+	}
+	for _, test := range tests {
+		_, err := decodeCommand("/move-to", strings.NewReader(test.body))
+		var ferr *FieldError
+		if !errors.As(err, &ferr) || ferr.Field != test.field {
+			t.Errorf("%s: got %#v, expected field %q", test.body, err, test.field)
+		}
+	}
+
+	disableSunAvoidance(t)
+	err := moveToCmd{Azimuth: 400, Elevation: 45}.Check()
+	var ferr *FieldError
+	if !errors.As(err, &ferr) || ferr.Field != "azimuth" || len(ferr.Limits) != 2 {
+		t.Errorf("got %#v, expected azimuth range error", err)
+	}
+}
+
+func TestCommandSchema(t *testing.T) {
+	schema, err := commandSchema("/track")
+	if err != nil {
+		t.Fatal(err)
+	}
+	props := schema["properties"].(map[string]interface{})
+	for _, name := range []string{"start_time", "ra", "coordsys", "pmra", "rotator"} {
+		if _, ok := props[name]; !ok {
+			t.Errorf("missing property %s", name)
+		}
+	}
+	if _, err := commandSchema("/nope"); !errors.Is(err, errBadEndpoint) {
+		t.Errorf("got %v, expected bad endpoint", err)
+	}
+}
+
+func TestCheckHardAzElNonFinite(t *testing.T) {
+	nan, inf := math.NaN(), math.Inf(1)
+	for _, test := range []struct {
+		az, el, vaz, vel float64
+		field            string
+	}{
+		{nan, 45, 0, 0, "azimuth"},
+		{100, -inf, 0, 0, "elevation"},
+		{100, 45, inf, 0, "azimuth_velocity"},
+		{100, 45, 0, nan, "elevation_velocity"},
+	} {
+		err := checkHardAzEl(test.az, test.el, test.vaz, test.vel)
+		var ferr *FieldError
+		if !errors.As(err, &ferr) || ferr.Field != test.field || ferr.Reason != reasonNotFinite {
+			t.Errorf("%g,%g,%g,%g: got %#v, expected %s not finite", test.az, test.el, test.vaz, test.vel, err, test.field)
+		}
+	}
+	if err := checkTimes(0, inf); err == nil {
+		t.Error("checkTimes: infinite stop time passed")
+	}
+}
+
+func TestLimitError(t *testing.T) {
+	for _, test := range []struct {
+		err            error
+		axis, quantity string
+		field, message string
+	}{
+		{checkHardAzEl(400, 45, 0, 0), "azimuth", "position", "azimuth", "commanded azimuth (400) out of range [-180,360]"},
+		{checkHardAzEl(100, 45, 0, -2), "elevation", "velocity", "elevation_velocity", "commanded elevation vel (-2) out of range [-1.5,1.5]"},
+		{fmt.Errorf("point 3: %w", checkHardAzEl(100, 45, 5, 0)), "azimuth", "velocity", "azimuth_velocity", "point 3: commanded azimuth vel (5) out of range [-3,3]"},
+		{checkRotator(1000), "rotator", "position", "rotator", "commanded rotator angle (1000) out of range"},
+	} {
+		var lerr *LimitError
+		if !errors.As(test.err, &lerr) || lerr.Axis != test.axis || lerr.Quantity != test.quantity {
+			t.Errorf("%v: got %#v, expected %s %s limit error", test.err, lerr, test.axis, test.quantity)
+			continue
+		}
+		var ferr *FieldError
+		if !errors.As(test.err, &ferr) || ferr.Field != test.field || len(ferr.Limits) != 2 {
+			t.Errorf("%v: got %#v, expected field %s", test.err, ferr, test.field)
+		}
+		if !strings.HasPrefix(test.err.Error(), test.message) {
+			t.Errorf("got message %q, expected %q", test.err, test.message)
+		}
+	}
+}
+
+func TestChainCmd(t *testing.T) {
+	disableSunAvoidance(t)
+	scan := `{"command": "/azimuth-scan", "args": {"azimuth_range": [110, 130], "elevation": 60, "num_scans": 2, "start_time": 5, "turnaround_time": 5, "speed": 0.5}}`
+	cmd, err := decodeCommand("/chain", strings.NewReader(`{"transition_time": 10, "commands": [`+scan+`, `+scan+`]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Check(); err != nil {
+		t.Fatal(err)
+	}
+	if !isTimeCritical(cmd) {
+		t.Error("chain not time critical")
+	}
+
+	for _, bad := range []string{
+		`{"transition_time": 10, "commands": []}`,
+		`{"transition_time": 0, "commands": [` + scan + `]}`,
+		`{"transition_time": 10, "commands": [{"command": "/stow", "args": {}}]}`,
+		`{"commands": [` + scan + `]}`,
+	} {
+		cmd, err := decodeCommand("/chain", strings.NewReader(bad))
+		if err == nil {
+			err = cmd.Check()
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
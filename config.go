@@ -0,0 +1,311 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+)
+
+// AxisLimits are an axis' position [deg] and motion limits.
+type AxisLimits struct {
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	SpeedMax float64 `json:"speed_max"` // [deg/s]
+	AccelMax float64 `json:"accel_max"` // [deg/s^2]
+	JerkMax  float64 `json:"jerk_max"`  // [deg/s^3]
+}
+
+// RotatorLimits are the instrument rotator's limits.
+type RotatorLimits struct {
+	Min      float64 `json:"min"`
+	Max      float64 `json:"max"`
+	SpeedMax float64 `json:"speed_max"` // [deg/s]
+}
+
+// ACUAddress is where to reach the ACU.
+type ACUAddress struct {
+	Host      string `json:"host"`
+	Port      string `json:"port"`
+	AdminPort string `json:"admin_port"`
+}
+
+// Config is the TCS configuration. The ACU address, axis limits, azimuth
+// limit profile, and stow pins are only applied at startup; the rest may
+// be reloaded.
+type Config struct {
+	ACU       ACUAddress    `json:"acu"`
+	Azimuth   AxisLimits    `json:"azimuth"`
+	Elevation AxisLimits    `json:"elevation"`
+	Rotator   RotatorLimits `json:"rotator"`
+	StowPins  bool          `json:"stow_pins"`
+
+	// azimuth speed and acceleration limits by elevation, if any
+	AzimuthProfile []AzimuthLimitPoint `json:"azimuth_profile,omitempty"`
+
+	// reloadable
+	PositionTolerance   float64    `json:"position_tolerance"` // [deg]
+	SpeedTolerance      float64    `json:"speed_tolerance"`    // [deg/s]
+	StowPosition        [2]float64 `json:"stow_position"`
+	MaintenancePosition [2]float64 `json:"maintenance_position"`
+	TrackingErrorAlarm  float64    `json:"tracking_error_alarm"` // [deg]
+
+	// allowed past a command's estimated end [s], and whether to abort it then
+	CommandTimeoutMargin float64 `json:"command_timeout_margin"`
+	CommandTimeoutAbort  bool    `json:"command_timeout_abort"`
+
+	// largest clock offset for starting program tracks [s]
+	TimeSkewMax float64 `json:"time_skew_max"`
+
+	// beam full width at half maximum, for sizing pointing scans [deg]
+	BeamFWHM float64 `json:"beam_fwhm"`
+
+	RateLimits RateLimitsConfig `json:"rate_limits"`
+
+	Derating DeratingConfig `json:"derating"`
+	Shutter  ShutterConfig  `json:"shutter"`
+	Hexapod  HexapodConfig  `json:"hexapod"`
+	Tilt     TiltConfig     `json:"tilt"`
+}
+
+func defaultConfig() Config {
+	return Config{
+		ACU:       ACUAddress{Host: "172.16.5.95", Port: "8100", AdminPort: "8080"},
+		Azimuth:   AxisLimits{azimuthMin, azimuthMax, azimuthSpeedMax, azimuthAccelMax, azimuthJerkMax},
+		Elevation: AxisLimits{elevationMin, elevationMax, elevationSpeedMax, elevationAccelMax, elevationJerkMax},
+		Rotator:   RotatorLimits{rotatorMin, rotatorMax, rotatorSpeedMax},
+
+		PositionTolerance:   1e-4,
+		SpeedTolerance:      1e-4,
+		StowPosition:        [2]float64{0, 90},
+		MaintenancePosition: [2]float64{0, 0},
+		TrackingErrorAlarm:  0.05,
+
+		CommandTimeoutMargin: 60,
+
+		TimeSkewMax: 0.1,
+
+		BeamFWHM: 0.01,
+
+		RateLimits: RateLimitsConfig{
+			Observer: RateLimit{Rate: 1, Burst: 10, DuplicateWindow: 5},
+			Operator: RateLimit{Rate: 2, Burst: 20, DuplicateWindow: 5},
+			Engineer: RateLimit{Rate: 5, Burst: 50, DuplicateWindow: 5},
+		},
+
+		Derating: DeratingConfig{
+			MotorStart:   driveTemperatureWarning,
+			MotorLimit:   driveTemperatureCritical,
+			CabinetStart: 40,
+			CabinetLimit: 50,
+			MinFactor:    0.5,
+		},
+
+		Hexapod: HexapodConfig{FocusMax: 5},
+		Tilt:    TiltConfig{MaxCorrection: 30},
+	}
+}
+
+// LoadConfig reads a JSON config file. Settings missing from the file
+// are taken from base.
+func LoadConfig(filename string, base Config) (Config, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return base, err
+	}
+	defer f.Close()
+	c := base
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&c)
+	if err == nil {
+		err = c.Validate()
+	}
+	if err != nil {
+		return base, fmt.Errorf("%s: %w", filename, err)
+	}
+	return c, nil
+}
+
+func (l AxisLimits) validate(axis string) error {
+	switch {
+	case l.Min >= l.Max:
+		return fmt.Errorf("%s: min (%g) not below max (%g)", axis, l.Min, l.Max)
+	case l.SpeedMax <= 0 || l.AccelMax <= 0 || l.JerkMax <= 0:
+		return fmt.Errorf("%s: speed, accel and jerk limits must be positive", axis)
+	}
+	return nil
+}
+
+func (c Config) checkPosition(name string, pos [2]float64) error {
+	if pos[0] < c.Azimuth.Min || pos[0] > c.Azimuth.Max || pos[1] < c.Elevation.Min || pos[1] > c.Elevation.Max {
+		return fmt.Errorf("%s (%g,%g) outside the axis limits", name, pos[0], pos[1])
+	}
+	return nil
+}
+
+// Validate checks the config is consistent.
+func (c Config) Validate() error {
+	if c.ACU.Host == "" || c.ACU.Port == "" || c.ACU.AdminPort == "" {
+		return fmt.Errorf("acu: host, port and admin_port required")
+	}
+	err := c.Azimuth.validate("azimuth")
+	if err != nil {
+		return err
+	}
+	err = c.Elevation.validate("elevation")
+	if err != nil {
+		return err
+	}
+	err = checkAzimuthProfile(c.AzimuthProfile, c.Azimuth)
+	if err != nil {
+		return err
+	}
+	if c.Rotator.Min >= c.Rotator.Max || c.Rotator.SpeedMax <= 0 {
+		return fmt.Errorf("rotator: bad limits %+v", c.Rotator)
+	}
+	if c.PositionTolerance <= 0 || c.SpeedTolerance <= 0 {
+		return fmt.Errorf("tolerances must be positive")
+	}
+	if c.TrackingErrorAlarm <= 0 {
+		return fmt.Errorf("tracking_error_alarm must be positive")
+	}
+	if c.CommandTimeoutMargin <= 0 {
+		return fmt.Errorf("command_timeout_margin must be positive")
+	}
+	if c.TimeSkewMax <= 0 {
+		return fmt.Errorf("time_skew_max must be positive")
+	}
+	if c.BeamFWHM <= 0 {
+		return fmt.Errorf("beam_fwhm must be positive")
+	}
+	err = c.RateLimits.validate()
+	if err != nil {
+		return err
+	}
+	if d := c.Derating; d.MotorStart >= d.MotorLimit || d.CabinetStart >= d.CabinetLimit ||
+		d.MinFactor <= 0 || d.MinFactor > 1 {
+		return fmt.Errorf("derating: bad settings %+v", d)
+	}
+	for _, x := range c.Hexapod.Nominal {
+		if !isFinite(x) {
+			return fmt.Errorf("hexapod: nominal position not finite")
+		}
+	}
+	if c.Hexapod.FocusMax <= 0 {
+		return fmt.Errorf("hexapod: focus_max must be positive")
+	}
+	if t := c.Tilt; !isFinite(t.Orientation) || !isFinite(t.Reference[0]) || !isFinite(t.Reference[1]) || t.MaxCorrection <= 0 {
+		return fmt.Errorf("tilt: bad settings %+v", t)
+	}
+	err = c.checkPosition("stow_position", c.StowPosition)
+	if err != nil {
+		return err
+	}
+	return c.checkPosition("maintenance_position", c.MaintenancePosition)
+}
+
+// restartNeeded lists the startup-only settings which differ.
+func restartNeeded(a, b Config) []string {
+	var changed []string
+	if a.ACU != b.ACU {
+		changed = append(changed, "acu")
+	}
+	if a.Azimuth != b.Azimuth {
+		changed = append(changed, "azimuth")
+	}
+	if a.Elevation != b.Elevation {
+		changed = append(changed, "elevation")
+	}
+	if a.Rotator != b.Rotator {
+		changed = append(changed, "rotator")
+	}
+	if a.StowPins != b.StowPins {
+		changed = append(changed, "stow_pins")
+	}
+	if !equalAzimuthProfiles(a.AzimuthProfile, b.AzimuthProfile) {
+		changed = append(changed, "azimuth_profile")
+	}
+	return changed
+}
+
+func equalAzimuthProfiles(a, b []AzimuthLimitPoint) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i] != b[i] {
+			return false
+		}
+	}
+	return true
+}
+
+var (
+	configMu sync.Mutex
+	config   = defaultConfig()
+)
+
+// currentConfig returns the config in use.
+func currentConfig() Config {
+	configMu.Lock()
+	defer configMu.Unlock()
+	return config
+}
+
+// applyConfig sets the config at startup, before anything uses it.
+func applyConfig(c Config) {
+	azimuthMin, azimuthMax = c.Azimuth.Min, c.Azimuth.Max
+	azimuthSpeedMax, azimuthAccelMax, azimuthJerkMax = c.Azimuth.SpeedMax, c.Azimuth.AccelMax, c.Azimuth.JerkMax
+	elevationMin, elevationMax = c.Elevation.Min, c.Elevation.Max
+	elevationSpeedMax, elevationAccelMax, elevationJerkMax = c.Elevation.SpeedMax, c.Elevation.AccelMax, c.Elevation.JerkMax
+	rotatorMin, rotatorMax, rotatorSpeedMax = c.Rotator.Min, c.Rotator.Max, c.Rotator.SpeedMax
+	stowPinsEnabled = c.StowPins
+	azimuthProfile = c.AzimuthProfile
+	configMu.Lock()
+	config = c
+	configMu.Unlock()
+}
+
+// reloadConfig replaces the reloadable settings, rejecting the new config
+// if any startup-only settings changed.
+func reloadConfig(c Config) error {
+	err := c.Validate()
+	if err != nil {
+		return err
+	}
+	configMu.Lock()
+	defer configMu.Unlock()
+	if changed := restartNeeded(config, c); len(changed) > 0 {
+		return fmt.Errorf("%v changed: restart to apply", changed)
+	}
+	config = c
+	return nil
+}
+
+// serveConfig serves the current config, and reloads it with reload.
+func serveConfig(mux *http.ServeMux, reload func() error) {
+	mux.HandleFunc("/config", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		c := currentConfig()
+		err := json.NewEncoder(w).Encode(&c)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/config/reload", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		jsonResponse(w, reload(), http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, s string) string {
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := ioutil.WriteFile(filename, []byte(s), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadConfig(t *testing.T) {
+	base := defaultConfig()
+	c, err := LoadConfig(writeConfig(t, `{"stow_position": [10, 80], "elevation": {"min": 0, "max": 120, "speed_max": 1, "accel_max": 1, "jerk_max": 2}}`), base)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.StowPosition != [2]float64{10, 80} || c.Elevation.Max != 120 || c.Azimuth != base.Azimuth || c.ACU != base.ACU {
+		t.Errorf("got %+v", c)
+	}
+
+	for _, s := range []string{
+		`{"stow_positon": [10, 80]}`,
+		`{"stow_position": [10, 190]}`,
+		`{"azimuth": {"min": 10, "max": 0, "speed_max": 1, "accel_max": 1, "jerk_max": 1}}`,
+		`{"speed_tolerance": 0}`,
+		`{"acu": {"port": ""}}`,
+	} {
+		if _, err := LoadConfig(writeConfig(t, s), base); err == nil {
+			t.Errorf("%s: expected error", s)
+		}
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	defer applyConfig(currentConfig())
+
+	c := currentConfig()
+	c.PositionTolerance = 1e-3
+	err := reloadConfig(c)
+	if err != nil || currentConfig().PositionTolerance != 1e-3 {
+		t.Errorf("got %v, %+v", err, currentConfig())
+	}
+
+	c.PositionTolerance = 1e-2
+	c.Azimuth.SpeedMax = 1
+	err = reloadConfig(c)
+	if err == nil || !strings.Contains(err.Error(), "azimuth") || currentConfig().PositionTolerance != 1e-3 {
+		t.Errorf("got %v, %+v", err, currentConfig())
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+)
+
+// Long fast scans heat the motors and drive cabinets until the ACU trips a
+// thermal fault. As they approach their limits, derating lowers the speed
+// and acceleration limits that new patterns are checked against.
+
+// DeratingConfig sets when the axis limits are derated for temperature.
+// Between start and limit the speed and acceleration limits fall
+// linearly, to min_factor of themselves at the limit and above.
+type DeratingConfig struct {
+	MotorStart   float64 `json:"motor_start"` // [C]
+	MotorLimit   float64 `json:"motor_limit"`
+	CabinetStart float64 `json:"cabinet_start"`
+	CabinetLimit float64 `json:"cabinet_limit"`
+	MinFactor    float64 `json:"min_factor"`
+}
+
+// see capTemperatures
+type driveTemperatures struct {
+	AzimuthMotor     float64 // hottest motor [C]
+	ElevationMotor   float64
+	AzimuthCabinet   float64 // drive cabinet [C]
+	ElevationCabinet float64
+}
+
+// AxisTemperatures are an axis' drive temperatures, and the factor its
+// limits are derated by.
+type AxisTemperatures struct {
+	Motor    float64 `json:"motor"`   // [C]
+	Cabinet  float64 `json:"cabinet"` // [C]
+	Derating float64 `json:"derating"`
+}
+
+// TemperatureStatus is the drive temperatures last read.
+type TemperatureStatus struct {
+	Time      *time.Time       `json:"time,omitempty"` // nil if not read yet
+	Azimuth   AxisTemperatures `json:"azimuth"`
+	Elevation AxisTemperatures `json:"elevation"`
+}
+
+// Derating holds the derating factors. It is safe for concurrent use.
+type Derating struct {
+	mu     sync.Mutex
+	status TemperatureStatus
+}
+
+var siteDerating = &Derating{}
+
+// Update derates the limits for the temperatures read at t.
+func (d *Derating) Update(t time.Time, temps *driveTemperatures, cfg DeratingConfig) {
+	axis := func(motor, cabinet float64) AxisTemperatures {
+		return AxisTemperatures{
+			Motor:   motor,
+			Cabinet: cabinet,
+			Derating: math.Min(
+				deratingFactor(motor, cfg.MotorStart, cfg.MotorLimit, cfg.MinFactor),
+				deratingFactor(cabinet, cfg.CabinetStart, cfg.CabinetLimit, cfg.MinFactor)),
+		}
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.status = TemperatureStatus{
+		Time:      &t,
+		Azimuth:   axis(temps.AzimuthMotor, temps.AzimuthCabinet),
+		Elevation: axis(temps.ElevationMotor, temps.ElevationCabinet),
+	}
+}
+
+func (d *Derating) Status() TemperatureStatus {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.status
+}
+
+// Factors returns the azimuth and elevation derating factors, 1 until
+// the temperatures are read.
+func (d *Derating) Factors() [2]float64 {
+	status := d.Status()
+	if status.Time == nil {
+		return [2]float64{1, 1}
+	}
+	return [2]float64{status.Azimuth.Derating, status.Elevation.Derating}
+}
+
+func deratingFactor(temp, start, limit, minFactor float64) float64 {
+	x := math.Max(0, math.Min(1, (temp-start)/(limit-start)))
+	return 1 - x*(1-minFactor)
+}
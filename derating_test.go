@@ -0,0 +1,37 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDerating(t *testing.T) {
+	d := &Derating{}
+	if f := d.Factors(); f != [2]float64{1, 1} {
+		t.Errorf("got %v before reading, expected no derating", f)
+	}
+	cfg := DeratingConfig{MotorStart: 60, MotorLimit: 80, CabinetStart: 40, CabinetLimit: 50, MinFactor: 0.5}
+	d.Update(time.Now(), &driveTemperatures{
+		AzimuthMotor: 70, AzimuthCabinet: 30, // halfway on the motor
+		ElevationMotor: 20, ElevationCabinet: 55, // past the cabinet limit
+	}, cfg)
+	if f := d.Factors(); math.Abs(f[0]-0.75) > 1e-9 || f[1] != 0.5 {
+		t.Errorf("got %v, expected [0.75 0.5]", f)
+	}
+
+	t.Cleanup(func() { siteDerating = &Derating{} })
+	siteDerating = d
+	lim := currentKinematicLimits(45)
+	if math.Abs(lim[0].speedMax-0.75*azimuthSpeedMax) > 1e-9 || lim[1].accelMax != 0.5*elevationAccelMax || lim[1].jerkMax != elevationJerkMax {
+		t.Errorf("got %+v", lim)
+	}
+	// too fast for the derated elevation limit
+	t0 := time.Now().Add(time.Minute)
+	if err := ValidateScanPattern(NewElevationScanPattern(t0, 1, 100, [2]float64{40, 50}, 0.9*elevationSpeedMax, 0)); err == nil {
+		t.Error("expected the derated limits exceeded")
+	}
+	if err := ValidateScanPattern(NewElevationScanPattern(t0, 1, 100, [2]float64{40, 50}, 0.4*elevationSpeedMax, 0)); err != nil {
+		t.Error(err)
+	}
+}
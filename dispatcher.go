@@ -0,0 +1,543 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+// A Dispatcher runs a telescope's commands, one at a time: it checks
+// they can start, starts them, and watches them until they're done,
+// aborted, or preempted. A command submitted while another is running
+// is rejected, queued, or preempts it, by its if_busy policy.
+type Dispatcher struct {
+	name         string // "" for the main telescope
+	log          *log.Logger
+	tel          *Telescope
+	tracker      *CommandTracker
+	alarms       *Alarms
+	estop        *EmergencyStop
+	timeSync     *TimeSync
+	motionParams *MotionParams
+	windStow     *WindStow // nil if none
+
+	cmds      chan queuedCommand // command queue
+	preempt   chan queuedCommand // commands that preempt the current command
+	interrupt chan queuedCommand // commands that run once the current one is aborted
+	enqueue   chan enqueueRequest
+	waiting   []queuedCommand // commands queued to run in turn, only used by Run
+	abort     chan abortRequest
+	pause     chan chan error
+	resume    chan chan error
+	quit      chan chan struct{} // stops the loop once it's idle
+	done      chan struct{}      // closed once the loop stops
+}
+
+// how long to wait for the loop to take a request, which it does between
+// status updates, unless it's starting a command
+const dispatchTimeout = 5 * time.Second
+
+var errNotResponding = fmt.Errorf("%w: dispatcher not responding", errBusy)
+
+func NewDispatcher(name string, tel *Telescope, tracker *CommandTracker, alarms *Alarms,
+	estop *EmergencyStop, timeSync *TimeSync, motionParams *MotionParams) *Dispatcher {
+	logger := log.Default()
+	if name != "" {
+		logger = log.New(tcsLog, name+": ", log.Lshortfile|log.Lmsgprefix)
+	}
+	return &Dispatcher{
+		name:         name,
+		log:          logger,
+		tel:          tel,
+		tracker:      tracker,
+		alarms:       alarms,
+		estop:        estop,
+		timeSync:     timeSync,
+		motionParams: motionParams,
+		cmds:         make(chan queuedCommand),
+		preempt:      make(chan queuedCommand),
+		interrupt:    make(chan queuedCommand),
+		enqueue:      make(chan enqueueRequest),
+		abort:        make(chan abortRequest),
+		pause:        make(chan chan error),
+		resume:       make(chan chan error),
+		quit:         make(chan chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+// setCommand tags untagged log lines with the main telescope's command.
+func (d *Dispatcher) setCommand(id, command string) {
+	if d.name == "" {
+		tcsLog.SetCommand(id, command)
+	}
+}
+
+// Run runs commands until Quit.
+func (d *Dispatcher) Run() {
+	var next queuedCommand // preempting command
+	for {
+		d.setCommand("", "")
+
+		// wait for command
+		id, cmd, preempted := next.id, next.cmd, next.cmd != nil
+		next = queuedCommand{}
+	waitForCmdLoop:
+		for cmd == nil {
+			if len(d.waiting) > 0 {
+				q := d.waiting[0]
+				d.waiting = d.waiting[1:]
+				id, cmd = q.id, q.cmd
+				break waitForCmdLoop
+			}
+			select {
+			case q := <-d.cmds:
+				id, cmd = q.id, q.cmd
+				break waitForCmdLoop
+			case q := <-d.preempt:
+				id, cmd, preempted = q.id, q.cmd, true
+				break waitForCmdLoop
+			case q := <-d.interrupt:
+				id, cmd = q.id, q.cmd
+				break waitForCmdLoop
+			case r := <-d.enqueue:
+				d.addWaiting(r)
+			case <-time.After(statusUpdateDuration):
+				err := d.tel.UpdateStatus()
+				if err != nil {
+					d.log.Print(err)
+				}
+			case a := <-d.abort:
+				d.log.Print("ignoring abort")
+				a.ok <- false
+			case c := <-d.pause:
+				c <- fmt.Errorf("nothing to pause")
+			case c := <-d.resume:
+				c <- fmt.Errorf("nothing to resume")
+			case c := <-d.quit:
+				close(d.done)
+				close(c)
+				return
+			}
+		}
+
+		desc := fmt.Sprintf("%#v", cmd)
+		if len(desc) > 200 {
+			desc = fmt.Sprintf("%.200s...", desc)
+		}
+		if id == "" {
+			// internal command
+			id = newCommandID()
+			d.tracker.Add(id, commandName(cmd))
+		}
+		r, _ := d.tracker.Get(id)
+		d.setCommand(id, r.Command)
+		d.log.Printf("got command: %s", desc)
+		t0 := time.Now()
+		if len(r.History) > 0 {
+			d.tracker.SetLatency(id, latencyQueued, t0.Sub(r.History[0].Time))
+		}
+		if !d.tracker.SetIf(id, commandQueued, commandChecking) {
+			if r, _ := d.tracker.Get(id); r.State == commandAborted {
+				d.log.Print("command aborted while queued")
+				continue
+			}
+		}
+
+		if isMotionCommand(cmd) {
+			if err := d.estop.Check(); err != nil {
+				err = fmt.Errorf("refusing command: %w", err)
+				d.log.Print(err)
+				d.tracker.Set(id, commandFailed, err)
+				continue
+			}
+		}
+
+		if d.windStow != nil && !preempted && isMotionCommand(cmd) {
+			if err := d.windStow.Blocked(); err != nil {
+				d.log.Print(err)
+				d.tracker.Set(id, commandFailed, err)
+				continue
+			}
+		}
+
+		if err := d.tel.Ready(); err != nil {
+			d.log.Print(err)
+			d.tracker.Set(id, commandFailed, err)
+			continue
+		}
+
+		if isTimeCritical(cmd) {
+			if err := d.timeSync.Check(time.Now()); err != nil {
+				err = fmt.Errorf("refusing program track: %w", err)
+				d.log.Print(err)
+				d.tracker.Set(id, commandFailed, err)
+				continue
+			}
+		}
+
+		if isMotionCommand(cmd) {
+			if err := d.motionParams.Check(); err != nil {
+				err = fmt.Errorf("refusing command: %w", err)
+				d.log.Print(err)
+				d.tracker.Set(id, commandFailed, err)
+				continue
+			}
+		}
+
+		if d.tel.shutter != nil {
+			if err := d.tel.shutter.Prepare(cmd); err != nil {
+				err = fmt.Errorf("refusing command: %w", err)
+				d.log.Print(err)
+				d.tracker.Set(id, commandFailed, err)
+				continue
+			}
+		}
+
+		// start command
+		cfg := currentConfig()
+		rec := d.tel.Status()
+		watchdog := newCommandWatchdog(cmd, &[2]float64{rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition},
+			time.Now(), Seconds2Duration(cfg.CommandTimeoutMargin))
+		ctx := withCommandSteps(withCommandLog(context.Background(), id, r.Command), d.tracker, id)
+		ctx, cancel := context.WithCancel(ctx)
+		d.tracker.SetLatency(id, latencyPreStart, time.Since(t0))
+		t0 = time.Now()
+		var isDone IsDoneFunc
+		var err error
+		if isMotionCommand(cmd) {
+			isDone, err = startRetracted(ctx, d.tel, cmd.Start)
+		} else {
+			isDone, err = cmd.Start(ctx, d.tel)
+		}
+		d.tracker.SetLatency(id, latencyStart, time.Since(t0))
+		if err != nil {
+			d.log.Print(err)
+			d.tracker.Set(id, commandFailed, err)
+			cancel()
+			continue
+		}
+		d.tracker.Set(id, commandStarted, nil)
+		if !watchdog.deadline.IsZero() {
+			d.log.Printf("command deadline %s", watchdog.deadline.UTC().Format(time.RFC3339))
+		}
+
+		// wait for command to finish
+		for done := false; !done; {
+			select {
+			case <-time.After(statusUpdateDuration):
+				err = d.tel.UpdateStatus()
+				if err != nil {
+					break // select statement
+				}
+				// moves are checked on start, and may need
+				// to pass near the Sun on their way out of it
+				if !isMoveCommand(cmd) && isMotionCommand(cmd) {
+					rec := d.tel.Status()
+					err = siteSunAvoidance.CheckPosition(time.Now(), rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition)
+					if err != nil {
+						d.log.Print("sun avoidance: stopping")
+						cancel()
+						if aerr := d.tel.Abort(); aerr != nil {
+							d.log.Print(aerr)
+						}
+						// wait for the telescope to stop
+						next = queuedCommand{cmd: abortCmd{}}
+						break // select statement
+					}
+				}
+				done, err = isDone(d.tel)
+				if !done && d.tel.pattern != nil {
+					if _, uploaded := d.tel.pattern.progress.get(); uploaded {
+						d.tracker.Set(id, commandTracking, nil)
+					} else {
+						d.tracker.Set(id, commandUploading, nil)
+					}
+					d.tracker.SetProgress(id, d.tel.pattern.Progress(d.tel.Status(), time.Now()))
+					if err == nil {
+						err = d.tel.pattern.CheckUnderrun(d.tel.Status(), time.Now(), d.alarms)
+					}
+				}
+				if err == nil && !done && watchdog.expired(time.Now()) {
+					d.alarms.Raise("command_timeout", severityWarning, false,
+						"command %s %s still running %g seconds past its estimated end", id, r.Command, cfg.CommandTimeoutMargin)
+					if cfg.CommandTimeoutAbort {
+						d.log.Print("command timed out: aborting")
+						done = true
+						d.tracker.Set(id, commandFailed, fmt.Errorf("timed out"))
+						cancel()
+						err = d.tel.Abort()
+						next = queuedCommand{cmd: abortCmd{}} // wait for the telescope to stop
+					}
+				}
+			case a := <-d.abort:
+				if a.id != "" && a.id != id {
+					a.ok <- false
+					break // select statement
+				}
+				d.log.Print("aborting")
+				a.ok <- true
+				done = true
+				d.tracker.Set(id, commandAborted, nil)
+				if a.id == "" {
+					d.dropWaiting()
+				}
+				cancel()
+				err = d.tel.Abort()
+				next = queuedCommand{cmd: abortCmd{}} // wait for the telescope to stop
+			case c := <-d.preempt:
+				d.log.Print("preempting")
+				next = c
+				done = true
+				d.tracker.Set(id, commandAborted, fmt.Errorf("preempted"))
+				cancel()
+				err = d.tel.Abort()
+			case q := <-d.interrupt:
+				d.log.Printf("preempted by command %s", q.id)
+				done = true
+				d.tracker.Set(id, commandAborted, fmt.Errorf("preempted by command %s", q.id))
+				cancel()
+				err = d.tel.Abort()
+				next = queuedCommand{cmd: abortCmd{}} // wait for the telescope to stop
+				d.waiting = append([]queuedCommand{q}, d.waiting...)
+			case r := <-d.enqueue:
+				d.addWaiting(r)
+			case c := <-d.pause:
+				perr := d.tel.PausePattern()
+				if perr == nil {
+					watchdog.pause(time.Now())
+				}
+				c <- perr
+			case c := <-d.resume:
+				rerr := d.tel.ResumePattern()
+				if rerr == nil {
+					watchdog.resume(time.Now())
+				}
+				c <- rerr
+			}
+			if err != nil {
+				d.log.Print(err)
+				d.tracker.Set(id, commandFailed, err)
+				break
+			}
+		}
+		d.alarms.Clear("command_timeout")
+		d.alarms.Clear("program_track_underrun")
+
+		cancel()
+		d.tracker.Set(id, commandDone, nil)
+		d.tel.pattern = nil
+		d.log.Printf("command done: %s", desc)
+	}
+}
+
+// Submit runs q by the if_busy policy ifBusy, returning errBusy if
+// it's rejected.
+func (d *Dispatcher) Submit(q queuedCommand, ifBusy string) error {
+	switch ifBusy {
+	case ifBusyQueue:
+		return d.Enqueue(q)
+	case ifBusyPreempt:
+		return d.Interrupt(q)
+	}
+	return d.Queue(q)
+}
+
+// Queue queues a command, returning errBusy if the current one doesn't
+// finish soon.
+func (d *Dispatcher) Queue(q queuedCommand) error {
+	select {
+	case d.cmds <- q:
+		return nil
+	case <-time.After(commandBusyTimeout):
+		return errBusy
+	}
+}
+
+// how many commands may wait their turn, see Enqueue
+const maxWaitingCommands = 20
+
+type enqueueRequest struct {
+	q   queuedCommand
+	err chan error
+}
+
+// Enqueue queues a command to run after the current one and those
+// already queued, returning errBusy if too many are.
+func (d *Dispatcher) Enqueue(q queuedCommand) error {
+	r := enqueueRequest{q, make(chan error)}
+	select {
+	case d.enqueue <- r:
+	case <-d.done:
+		return errShutdown
+	case <-time.After(dispatchTimeout):
+		return errNotResponding
+	}
+	return <-r.err
+}
+
+func (d *Dispatcher) addWaiting(r enqueueRequest) {
+	if len(d.waiting) >= maxWaitingCommands {
+		r.err <- fmt.Errorf("%w: %d commands queued", errBusy, len(d.waiting))
+		return
+	}
+	d.waiting = append(d.waiting, r.q)
+	r.err <- nil
+}
+
+// dropWaiting aborts the queued commands.
+func (d *Dispatcher) dropWaiting() {
+	for _, q := range d.waiting {
+		d.tracker.SetIf(q.id, commandQueued, commandAborted)
+	}
+	d.waiting = nil
+}
+
+// Interrupt aborts the current command, if any, and runs q once the
+// telescope has stopped, before any queued commands. Unlike Preempt,
+// q gets the usual checks.
+func (d *Dispatcher) Interrupt(q queuedCommand) error {
+	select {
+	case d.interrupt <- q:
+	case <-d.done:
+		return errShutdown
+	case <-time.After(dispatchTimeout):
+		return errNotResponding
+	}
+	return nil
+}
+
+// Preempt aborts the current command, if any, and runs q next.
+func (d *Dispatcher) Preempt(q queuedCommand) error {
+	select {
+	case d.preempt <- q:
+	case <-d.done:
+		return errShutdown
+	case <-time.After(dispatchTimeout):
+		return errNotResponding
+	}
+	return nil
+}
+
+// An abortRequest aborts the running command id, or whichever command
+// is running if id is "", sending whether it did to ok.
+type abortRequest struct {
+	id string
+	ok chan bool
+}
+
+// Abort aborts the current command, returning false if there's none.
+func (d *Dispatcher) Abort() bool {
+	return d.AbortCommand("")
+}
+
+// AbortCommand aborts the command id: if it's running, cancelling its
+// context and stopping the telescope as Abort does, or if it's queued,
+// before it starts. It returns false if it's neither.
+func (d *Dispatcher) AbortCommand(id string) bool {
+	a := abortRequest{id, make(chan bool)}
+	select {
+	case d.abort <- a:
+		if <-a.ok {
+			return true
+		}
+	case <-d.done:
+	case <-time.After(dispatchTimeout):
+		d.log.Printf("abort: %v", errNotResponding)
+	}
+	return id != "" && d.tracker.SetIf(id, commandQueued, commandAborted)
+}
+
+func (d *Dispatcher) Pause() error {
+	c := make(chan error)
+	select {
+	case d.pause <- c:
+	case <-d.done:
+		return errShutdown
+	case <-time.After(dispatchTimeout):
+		return errNotResponding
+	}
+	return <-c
+}
+
+func (d *Dispatcher) Resume() error {
+	c := make(chan error)
+	select {
+	case d.resume <- c:
+	case <-d.done:
+		return errShutdown
+	case <-time.After(dispatchTimeout):
+		return errNotResponding
+	}
+	return <-c
+}
+
+// Quit waits for the current command to finish and the loop to stop,
+// returning false after timeout.
+func (d *Dispatcher) Quit(timeout time.Duration) bool {
+	c := make(chan struct{})
+	select {
+	case d.quit <- c:
+		<-c
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
+
+// serveDispatcher serves aborting, pausing and resuming commands.
+func serveDispatcher(mux *http.ServeMux, d *Dispatcher) {
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, req *http.Request) {
+		var err error
+		var statusCode int
+
+		if req.Method == "POST" {
+			// the command to abort is optional
+			var x struct {
+				ID string `json:"id"`
+			}
+			err = json.NewDecoder(req.Body).Decode(&x)
+			if err != nil && err != io.EOF { // an empty body aborts the current command
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			err = nil
+			if x.ID == "" && d.Abort() || x.ID != "" && d.AbortCommand(x.ID) {
+				statusCode = http.StatusOK
+			} else if x.ID != "" {
+				err = fmt.Errorf("command %s not queued or running", x.ID)
+				statusCode = http.StatusConflict
+			} else {
+				err = fmt.Errorf("nothing to abort")
+				statusCode = http.StatusConflict // not sure if this is the most appropriate code
+			}
+		} else {
+			err = fmt.Errorf("method not POST")
+			statusCode = http.StatusMethodNotAllowed
+		}
+
+		jsonResponse(w, err, statusCode)
+	})
+
+	mux.HandleFunc("/pause", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		jsonResponse(w, d.Pause(), http.StatusConflict)
+	})
+
+	mux.HandleFunc("/resume", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		jsonResponse(w, d.Resume(), http.StatusConflict)
+	})
+}
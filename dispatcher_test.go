@@ -0,0 +1,166 @@
+package main
+
+import (
+	"errors"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// newTestDispatcher returns a running dispatcher for a fake ACU.
+func newTestDispatcher(t *testing.T) (*Dispatcher, *CommandTracker) {
+	disableSunAvoidance(t)
+	tel := NewTelescope(newFakeACU(120, 60))
+	if err := tel.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	tracker, alarms := NewCommandTracker(), NewAlarms()
+	d := NewDispatcher("", tel, tracker, alarms, NewEmergencyStop(&Faults{}, alarms),
+		NewTimeSync(nil, "", alarms), NewMotionParams(nil, alarms))
+	go d.Run()
+	return d, tracker
+}
+
+func waitForCommandState(t *testing.T, tracker *CommandTracker, id, state string) {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		r, _ := tracker.Get(id)
+		if r.State == state {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s: state %s, expected %s", id, r.State, state)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+var testScanCmd = azScanCmd{AzimuthRange: [2]float64{110, 130}, Elevation: 60, NumScans: 2, TurnaroundTime: 5, Speed: 0.5}
+
+func TestDispatcherAbortCommand(t *testing.T) {
+	before := runtime.NumGoroutine()
+	d, tracker := newTestDispatcher(t)
+	waitForState := func(id, state string) {
+		t.Helper()
+		waitForCommandState(t, tracker, id, state)
+	}
+
+	tracker.Add("a", "/azimuth-scan")
+	if err := d.Queue(queuedCommand{"a", testScanCmd}); err != nil {
+		t.Fatal(err)
+	}
+	waitForState("a", commandStarted)
+
+	// a queued command is dropped, leaving the running one
+	tracker.Add("b", "/move-to")
+	queued := make(chan error)
+	go func() { queued <- d.Queue(queuedCommand{"b", moveToCmd{Azimuth: 100, Elevation: 50}}) }()
+	if !d.AbortCommand("b") {
+		t.Error("queued command not aborted")
+	}
+	<-queued
+	if d.AbortCommand("c") {
+		t.Error("unknown command aborted")
+	}
+	if r, _ := tracker.Get("a"); r.finished() {
+		t.Errorf("running command %s", r.State)
+	}
+
+	if !d.AbortCommand("a") {
+		t.Error("running command not aborted")
+	}
+	waitForState("a", commandAborted)
+	if d.AbortCommand("a") {
+		t.Error("aborted twice")
+	}
+	if r, _ := tracker.Get("b"); r.State != commandAborted {
+		t.Errorf("queued command %s", r.State)
+	}
+
+	// the command's goroutines have all exited
+	if !d.Quit(10 * time.Second) {
+		t.Fatal("dispatcher still busy")
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			buf := make([]byte, 1<<16)
+			t.Fatalf("%d goroutines left, %d before:\n%s", runtime.NumGoroutine(), before, buf[:runtime.Stack(buf, true)])
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestDispatcherIfBusy(t *testing.T) {
+	d, tracker := newTestDispatcher(t)
+	defer d.Quit(10 * time.Second)
+	submit := func(id string, cmd Command, ifBusy string) error {
+		tracker.Add(id, commandName(cmd))
+		return d.Submit(queuedCommand{id, cmd}, ifBusy)
+	}
+
+	if err := submit("a", testScanCmd, ifBusyReject); err != nil {
+		t.Fatal(err)
+	}
+	waitForCommandState(t, tracker, "a", commandStarted)
+	if err := submit("b", testScanCmd, ifBusyReject); !errors.Is(err, errBusy) {
+		t.Errorf("reject: got %v", err)
+	}
+
+	// queued commands wait their turn
+	for _, id := range []string{"c", "d"} {
+		if err := submit(id, testScanCmd, ifBusyQueue); err != nil {
+			t.Fatal(err)
+		}
+	}
+	time.Sleep(10 * time.Millisecond)
+	for _, id := range []string{"c", "d"} {
+		if r, _ := tracker.Get(id); r.State != commandQueued {
+			t.Errorf("%s: state %s", id, r.State)
+		}
+	}
+
+	// a preempting command stops the current one, and goes first
+	if err := submit("e", testScanCmd, ifBusyPreempt); err != nil {
+		t.Fatal(err)
+	}
+	waitForCommandState(t, tracker, "a", commandAborted)
+	waitForCommandState(t, tracker, "e", commandStarted)
+	if r, _ := tracker.Get("c"); r.State != commandQueued {
+		t.Errorf("c: state %s", r.State)
+	}
+
+	// and an abort drops the queue
+	if !d.Abort() {
+		t.Fatal("nothing aborted")
+	}
+	for _, id := range []string{"c", "d", "e"} {
+		waitForCommandState(t, tracker, id, commandAborted)
+	}
+}
+
+func TestDispatcherQuit(t *testing.T) {
+	d, tracker := newTestDispatcher(t)
+	if !d.Quit(10 * time.Second) {
+		t.Fatal("dispatcher still busy")
+	}
+
+	// requests fail rather than block once the loop has stopped
+	tracker.Add("a", "/move-to")
+	q := queuedCommand{"a", moveToCmd{Azimuth: 100, Elevation: 50}}
+	for _, ifBusy := range []string{ifBusyQueue, ifBusyPreempt} {
+		if err := d.Submit(q, ifBusy); !errors.Is(err, errShutdown) {
+			t.Errorf("%s: got %v", ifBusy, err)
+		}
+	}
+	if err := d.Preempt(q); !errors.Is(err, errShutdown) {
+		t.Errorf("preempt: got %v", err)
+	}
+	if err := d.Pause(); !errors.Is(err, errShutdown) {
+		t.Errorf("pause: got %v", err)
+	}
+	if d.Abort() {
+		t.Error("aborted")
+	}
+}
@@ -0,0 +1,235 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"time"
+)
+
+// A DryRun summarizes what a command would do, without doing it.
+type DryRun struct {
+	Command string     `json:"command"`
+	Start   *time.Time `json:"start,omitempty"`
+	Stop    *time.Time `json:"stop,omitempty"`
+
+	// estimated, if known [s]
+	Duration *float64 `json:"duration,omitempty"`
+
+	// pattern commands
+	Points     int         `json:"points,omitempty"`
+	AzRange    *[2]float64 `json:"az_range,omitempty"`
+	ElRange    *[2]float64 `json:"el_range,omitempty"`
+	MaxAzSpeed float64     `json:"max_az_speed,omitempty"`
+	MaxElSpeed float64     `json:"max_el_speed,omitempty"`
+
+	// mean speed outside turnarounds, and the fraction of time in them
+	MeanScanSpeed      float64 `json:"mean_scan_speed,omitempty"`
+	TurnaroundFraction float64 `json:"turnaround_fraction,omitempty"`
+	NumSweeps          int     `json:"num_sweeps,omitempty"` // between turnarounds, if any
+
+	// moves
+	Target *[2]float64 `json:"target,omitempty"`
+
+	// sequences
+	Steps []*DryRun `json:"steps,omitempty"`
+
+	first  *[2]float64 // pattern's first position
+	sweeps []time.Time // when each sweep starts
+}
+
+// dryRunCommand checks cmd, generating and validating its full trajectory,
+// and estimates how long it takes from pos (nil if unknown) at now.
+func dryRunCommand(cmd Command, pos *[2]float64, now time.Time) (*DryRun, error) {
+	err := cmd.Check()
+	if err != nil {
+		return nil, err
+	}
+	d, _, err := dryRun(cmd, pos, now)
+	return d, err
+}
+
+// dryRun returns cmd's summary, and where it leaves the telescope.
+func dryRun(cmd Command, pos *[2]float64, now time.Time) (*DryRun, *[2]float64, error) {
+	d := &DryRun{Command: commandName(cmd)}
+	switch cmd := cmd.(type) {
+	case PatternCommand:
+		pattern, err := cmd.Pattern()
+		if err != nil {
+			return nil, nil, err
+		}
+		end, err := d.summarizePattern(pattern)
+		return d, end, err
+	case moveToCmd:
+		if cmd.Axis != "" {
+			if pos == nil {
+				// no knowing where the other axis is
+				return d, nil, nil
+			}
+			target := *pos
+			target[axisIndex(cmd.Axis)] = [2]float64{cmd.Azimuth, cmd.Elevation}[axisIndex(cmd.Axis)]
+			if err := checkAzEl(target[0], target[1], 0, 0); err != nil {
+				return nil, nil, err
+			}
+			return d.move(pos, now, target[0], target[1], cmd.skipSunCheck)
+		}
+		return d.move(pos, now, cmd.Azimuth, cmd.Elevation, cmd.skipSunCheck)
+	case stowCmd:
+		return d.move(pos, now, cmd.az, cmd.el, true)
+	case maintenanceCmd:
+		return d.move(pos, now, cmd.az, cmd.el, false)
+	case startupCmd:
+		return d.move(pos, now, cmd.az, cmd.el, true)
+	case shutdownCmd:
+		return d.move(pos, now, cmd.az, cmd.el, true)
+	case focusSweepCmd:
+		seq, end, err := dryRun(cmd.sequence(0), pos, now)
+		if err == nil {
+			seq.Command = d.Command
+		}
+		return seq, end, err
+	case sequenceCmd:
+		total, known := 0., true
+		for i, c := range cmd.Commands {
+			step, end, err := dryRun(c, pos, now)
+			if err != nil {
+				return nil, nil, fmt.Errorf("sequence command %d: %w", i, err)
+			}
+			d.Steps = append(d.Steps, step)
+			pos = end
+			if step.Stop != nil {
+				now = *step.Stop
+			} else if step.Duration != nil {
+				now = now.Add(Seconds2Duration(*step.Duration))
+			}
+			if step.Duration != nil {
+				total += *step.Duration
+			} else {
+				known = false
+			}
+		}
+		if known {
+			d.Duration = &total
+		}
+		return d, pos, nil
+	}
+	// e.g. the rotator, which doesn't move the telescope
+	return d, pos, nil
+}
+
+// summarizePattern fills in the pattern's extent, returning its last position.
+func (d *DryRun) summarizePattern(pattern ScanPattern) (*[2]float64, error) {
+	var first, prev, p ScanPatternSample
+	az := [2]float64{math.Inf(1), math.Inf(-1)}
+	el := az
+	var scanTime, turnaroundTime, distance float64
+	iter := pattern.Iterator()
+	for !pattern.Done(iter) {
+		err := pattern.Next(iter, &p)
+		if err != nil {
+			return nil, err
+		}
+		inTurnaround := p.AzFlag == 2 || p.ElFlag == 2
+		if d.Points == 0 {
+			first = p
+			if !inTurnaround {
+				d.sweeps = append(d.sweeps, p.T)
+			}
+		} else {
+			// the turnaround flag marks the interval after the point
+			dt := p.T.Sub(prev.T).Seconds()
+			if prev.AzFlag == 2 || prev.ElFlag == 2 {
+				turnaroundTime += dt
+				if !inTurnaround {
+					d.sweeps = append(d.sweeps, p.T)
+				}
+			} else {
+				scanTime += dt
+				distance += dt * math.Hypot(prev.AzVel, prev.ElVel)
+			}
+		}
+		prev = p
+		d.Points++
+		az = [2]float64{math.Min(az[0], p.Az), math.Max(az[1], p.Az)}
+		el = [2]float64{math.Min(el[0], p.El), math.Max(el[1], p.El)}
+		d.MaxAzSpeed = math.Max(d.MaxAzSpeed, math.Abs(p.AzVel))
+		d.MaxElSpeed = math.Max(d.MaxElSpeed, math.Abs(p.ElVel))
+	}
+	if d.Points == 0 {
+		return nil, fmt.Errorf("empty pattern")
+	}
+	duration := p.T.Sub(first.T).Seconds()
+	d.Start, d.Stop, d.Duration = &first.T, &p.T, &duration
+	d.AzRange, d.ElRange = &az, &el
+	d.first = &[2]float64{first.Az, first.El}
+	if scanTime > 0 {
+		d.MeanScanSpeed = distance / scanTime
+	}
+	if duration > 0 {
+		d.TurnaroundFraction = turnaroundTime / duration
+	}
+	if len(d.sweeps) > 1 {
+		d.NumSweeps = len(d.sweeps)
+	}
+	return &[2]float64{p.Az, p.El}, nil
+}
+
+// move fills in a move to az,el, checking the way there avoids the Sun.
+func (d *DryRun) move(pos *[2]float64, now time.Time, az, el float64, skipSunCheck bool) (*DryRun, *[2]float64, error) {
+	target := &[2]float64{az, el}
+	d.Target = target
+	if pos == nil {
+		return d, target, nil
+	}
+	if !skipSunCheck {
+		err := siteSunAvoidance.CheckMove(now, pos[0], pos[1], az, el)
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	duration := estimateMoveTime(pos[0], az, pos[1], el).Seconds()
+	d.Duration = &duration
+	return d, target, nil
+}
+
+// dryRunResponse dry runs the command in req's body, sent to endpoint.
+// Moves are estimated from the from=az,el query parameter, else the
+// current position, from currentPosition.
+func dryRunResponse(w http.ResponseWriter, req *http.Request, endpoint string, currentPosition func() *[2]float64) {
+	cmd, err := decodeCommand(endpoint, req.Body)
+	if errors.Is(err, errBadEndpoint) {
+		commandResponse(w, "", err, http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		commandResponse(w, "", err, http.StatusBadRequest)
+		return
+	}
+	var pos *[2]float64
+	if from := req.URL.Query().Get("from"); from != "" {
+		p, err := parseAzEl(from)
+		if err != nil {
+			commandResponse(w, "", fmt.Errorf("bad from: %w", err), http.StatusBadRequest)
+			return
+		}
+		pos = &p
+	} else {
+		pos = currentPosition()
+	}
+	result, err := dryRunCommand(cmd, pos, time.Now())
+	if err != nil {
+		commandResponse(w, "", err, http.StatusBadRequest)
+		return
+	}
+	response := struct {
+		S      string  `json:"status"`
+		DryRun *DryRun `json:"dry_run"`
+	}{"ok", result}
+	err = json.NewEncoder(w).Encode(&response)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestDryRun(t *testing.T) {
+	disableSunAvoidance(t)
+	scan := azScanCmd{
+		AzimuthRange:   [2]float64{110, 130},
+		Elevation:      60,
+		NumScans:       4,
+		StartTime:      10,
+		TurnaroundTime: 5,
+		Speed:          0.8,
+	}
+	seq := sequenceCmd{Commands: []Command{
+		moveToCmd{Azimuth: 120, Elevation: 60},
+		scan,
+		moveToCmd{Azimuth: 0, Elevation: 90},
+	}}
+
+	d, err := dryRunCommand(seq, &[2]float64{0, 90}, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(d.Steps) != 3 || d.Duration == nil {
+		t.Fatalf("got %+v", d)
+	}
+	s := d.Steps[1]
+	// the turnarounds overshoot by less than speed*turnaround/2
+	if s.Points == 0 || s.AzRange == nil || s.AzRange[0] < 110-2 || s.AzRange[1] > 130+2 ||
+		s.ElRange[0] != 60 || s.ElRange[1] != 60 {
+		t.Errorf("bad scan summary %+v", s)
+	}
+	if math.Abs(s.MaxAzSpeed-0.8) > 1e-6 || s.Start == nil || s.Stop.Sub(*s.Start) < 4*20/0.8*time.Second {
+		t.Errorf("bad scan summary %+v", s)
+	}
+	// 25 s sweeps with 5 s turnarounds
+	if math.Abs(s.MeanScanSpeed-0.8) > 1e-6 || s.TurnaroundFraction < 0.1 || s.TurnaroundFraction > 1./6+1e-6 {
+		t.Errorf("mean scan speed %g, turnaround fraction %g", s.MeanScanSpeed, s.TurnaroundFraction)
+	}
+	// there and back again, four times
+	if s.NumSweeps != 8 {
+		t.Errorf("got %d sweeps, expected 8", s.NumSweeps)
+	}
+	expected := *d.Steps[0].Duration + *s.Duration + *d.Steps[2].Duration
+	if math.Abs(*d.Duration-expected) > 1e-9 {
+		t.Errorf("total duration %g, expected %g", *d.Duration, expected)
+	}
+	if d.Steps[2].Duration == nil || *d.Steps[2].Duration < 10 {
+		t.Errorf("final move should start from the end of the scan: %+v", d.Steps[2])
+	}
+
+	// without the current position, moves can't be estimated
+	d, err = dryRunCommand(seq, nil, time.Now())
+	if err != nil || d.Duration != nil || d.Steps[0].Duration != nil || d.Steps[1].Duration == nil {
+		t.Errorf("got %+v, %v", d, err)
+	}
+
+	scan.Speed = azimuthSpeedMax + 1
+	if _, err := dryRunCommand(scan, nil, time.Now()); err == nil {
+		t.Error("expected check to fail")
+	}
+}
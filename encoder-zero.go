@@ -0,0 +1,322 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// The encoder zero points are what the encoders read at the true zero of
+// each axis, e.g. after an encoder is replaced. They're measured against
+// a mechanical reference mark or a star, and added to every raw position
+// after the pointing model and offsets, so both the commanded positions
+// and, through Raw2Sky, the reported ones are corrected. Each change is a
+// new version, so the history is kept and earlier versions can be reverted to.
+
+// zero points larger than this are surely a mistake
+const maxEncoderZero = 10.0 // [deg]
+
+// encoder zero point methods
+const (
+	zeroMethodReference = "reference" // axis at a mechanical reference mark
+	zeroMethodStar      = "star"      // centered on a star
+	zeroMethodManual    = "manual"    // entered, e.g. from the old spreadsheet
+	zeroMethodRevert    = "revert"    // an earlier version again
+)
+
+// An EncoderZeroPoint is a version of the encoder zero points.
+type EncoderZeroPoint struct {
+	Version int       `json:"version"`
+	Time    time.Time `json:"time"`
+	AzElOffset
+	Method string `json:"method"`
+	Note   string `json:"note,omitempty"`
+	By     string `json:"by,omitempty"`
+}
+
+func (z EncoderZeroPoint) check() error {
+	for _, x := range []struct {
+		name  string
+		value float64
+	}{{"azimuth", z.Az}, {"elevation", z.El}} {
+		if !isFinite(x.value) {
+			return finiteError(x.name, x.value)
+		}
+		if math.Abs(x.value) > maxEncoderZero {
+			return rangeError(x.name, -maxEncoderZero, maxEncoderZero, "%s zero point (%g) out of range [%g,%g]",
+				x.name, x.value, -maxEncoderZero, maxEncoderZero)
+		}
+	}
+	switch z.Method {
+	case zeroMethodReference, zeroMethodStar, zeroMethodManual, zeroMethodRevert:
+		return nil
+	}
+	return &FieldError{Field: "method", Reason: fmt.Sprintf("expected %s, %s or %s, got %q",
+		zeroMethodReference, zeroMethodStar, zeroMethodManual, z.Method)}
+}
+
+// An EncoderZeroMeasurement measures the zero points where the telescope
+// is, either with one axis at a mechanical reference mark, whose true
+// angle is Reference, or centered on a star at the observed Azimuth and
+// Elevation. The star is corrected by the pointing model and the offset
+// registers in use, so once applied, Sky2Raw maps it to the encoder
+// readings.
+type EncoderZeroMeasurement struct {
+	Method    string  `json:"method"`
+	Axis      string  `json:"axis"`      // reference: "azimuth" or "elevation"
+	Reference float64 `json:"reference"` // [deg]
+	Azimuth   float64 `json:"azimuth"`   // star [deg]
+	Elevation float64 `json:"elevation"` // star [deg]
+}
+
+// EncoderZeroPoints is the versioned encoder zero point calibration,
+// saved to its file, if any, and applied to pointing.
+// It is safe for concurrent use.
+type EncoderZeroPoints struct {
+	pointing *Pointing
+
+	mu       sync.Mutex
+	file     string
+	versions []EncoderZeroPoint // oldest first
+}
+
+func NewEncoderZeroPoints(pointing *Pointing) *EncoderZeroPoints {
+	return &EncoderZeroPoints{pointing: pointing}
+}
+
+// Load reads the versions in filename, applies the latest, and saves
+// later ones there. A missing file is created by the first version.
+func (z *EncoderZeroPoints) Load(filename string) error {
+	var versions []EncoderZeroPoint
+	b, err := os.ReadFile(filename)
+	if err == nil {
+		err = json.Unmarshal(b, &versions)
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	for i, v := range versions {
+		if err == nil {
+			err = v.check()
+		}
+		if err == nil && v.Version != i+1 {
+			err = fmt.Errorf("version %d out of order", v.Version)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	z.file, z.versions = filename, versions
+	z.pointing.SetEncoderZero(z.current().AzElOffset)
+	return nil
+}
+
+// Current returns the version in use, version 0 if none.
+func (z *EncoderZeroPoints) Current() EncoderZeroPoint {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return z.current()
+}
+
+func (z *EncoderZeroPoints) current() EncoderZeroPoint {
+	if len(z.versions) == 0 {
+		return EncoderZeroPoint{Method: zeroMethodManual}
+	}
+	return z.versions[len(z.versions)-1]
+}
+
+// Versions returns every version, oldest first.
+func (z *EncoderZeroPoints) Versions() []EncoderZeroPoint {
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	return append([]EncoderZeroPoint(nil), z.versions...)
+}
+
+// Apply saves zero as the next version, and applies it.
+func (z *EncoderZeroPoints) Apply(zero EncoderZeroPoint) (EncoderZeroPoint, error) {
+	err := zero.check()
+	if err != nil {
+		return zero, err
+	}
+	z.mu.Lock()
+	defer z.mu.Unlock()
+	zero.Version = len(z.versions) + 1
+	zero.Time = time.Now().UTC()
+	versions := append(z.versions[:len(z.versions):len(z.versions)], zero)
+	if z.file != "" {
+		err = writeJSONFile(z.file, versions)
+		if err != nil {
+			return zero, err
+		}
+	}
+	z.versions = versions
+	z.pointing.SetEncoderZero(zero.AzElOffset)
+	return zero, nil
+}
+
+// Revert applies an earlier version again, as the next version.
+func (z *EncoderZeroPoints) Revert(version int, by string) (EncoderZeroPoint, error) {
+	z.mu.Lock()
+	n := len(z.versions)
+	var old EncoderZeroPoint
+	if version >= 1 && version <= n {
+		old = z.versions[version-1]
+	}
+	z.mu.Unlock()
+	if old.Version == 0 {
+		return old, &FieldError{Field: "version", Reason: fmt.Sprintf("no version %d", version)}
+	}
+	return z.Apply(EncoderZeroPoint{
+		AzElOffset: old.AzElOffset,
+		Method:     zeroMethodRevert,
+		Note:       fmt.Sprintf("revert to version %d", version),
+		By:         by,
+	})
+}
+
+// Measure returns the zero points m measures, with the encoders reading
+// raw az/el, keeping the current zero point of an axis it doesn't
+// measure. They aren't applied.
+func (z *EncoderZeroPoints) Measure(m EncoderZeroMeasurement, rawAz, rawEl float64) (EncoderZeroPoint, error) {
+	zero := z.Current()
+	zero.Version, zero.Time, zero.Method, zero.Note, zero.By = 0, time.Time{}, m.Method, "", ""
+	switch m.Method {
+	case zeroMethodReference:
+		if !isFinite(m.Reference) {
+			return zero, finiteError("reference", m.Reference)
+		}
+		switch m.Axis {
+		case "azimuth":
+			zero.Az = rawAz - m.Reference
+		case "elevation":
+			zero.El = rawEl - m.Reference
+		default:
+			return zero, &FieldError{Field: "axis", Reason: fmt.Sprintf("expected azimuth or elevation, got %q", m.Axis)}
+		}
+	case zeroMethodStar:
+		if !isFinite(m.Azimuth) || !isFinite(m.Elevation) {
+			return zero, fmt.Errorf("star position not finite")
+		}
+		az, el := z.pointing.corrected(m.Azimuth, m.Elevation)
+		off := z.pointing.offsets.Total()
+		zero.Az, zero.El = rawAz-az-off.Az, rawEl-el-off.El
+	default:
+		return zero, &FieldError{Field: "method", Reason: fmt.Sprintf("expected %s or %s, got %q",
+			zeroMethodReference, zeroMethodStar, m.Method)}
+	}
+	return zero, zero.check()
+}
+
+// serveEncoderZero serves the encoder zero points, measuring them from the
+// ACU's position.
+func serveEncoderZero(mux *http.ServeMux, acu *ACU, encoderZero *EncoderZeroPoints) {
+	mux.HandleFunc("/encoder-zero", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Current  EncoderZeroPoint   `json:"current"`
+				Versions []EncoderZeroPoint `json:"versions"`
+			}
+			response.Current = encoderZero.Current()
+			response.Versions = encoderZero.Versions()
+			err := json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				AzElOffset
+				Method string `json:"method"`
+				Note   string `json:"note"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil {
+				var zero EncoderZeroPoint
+				zero, err = encoderZero.Apply(EncoderZeroPoint{AzElOffset: x.AzElOffset, Method: x.Method, Note: x.Note,
+					By: clientName(principalFrom(req.Context()))})
+				if err == nil {
+					log.Printf("applied encoder zero points: %+v", zero)
+				}
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/encoder-zero/measure", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			EncoderZeroMeasurement
+			Note  string `json:"note"`
+			Apply bool   `json:"apply"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		var rec datasets.StatusGeneral8100
+		if err == nil {
+			err = acu.StatusGeneral8100Get(&rec)
+		}
+		var zero EncoderZeroPoint
+		if err == nil {
+			zero, err = encoderZero.Measure(x.EncoderZeroMeasurement, rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition)
+		}
+		if err == nil && x.Apply {
+			zero.Note, zero.By = x.Note, clientName(principalFrom(req.Context()))
+			zero, err = encoderZero.Apply(zero)
+			if err == nil {
+				log.Printf("applied encoder zero points: %+v", zero)
+			}
+		}
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		response := struct {
+			S    string           `json:"status"`
+			Zero EncoderZeroPoint `json:"zero"`
+		}{"ok", zero}
+		err = json.NewEncoder(w).Encode(&response)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/encoder-zero/revert", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Version int `json:"version"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			var zero EncoderZeroPoint
+			zero, err = encoderZero.Revert(x.Version, clientName(principalFrom(req.Context())))
+			if err == nil {
+				log.Printf("reverted encoder zero points: %+v", zero)
+			}
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+)
+
+func TestEncoderZeroPoints(t *testing.T) {
+	p := NewPointing()
+	p.SetModel(PointingModel{IA: 36, IE: -18}, "test")
+	z := NewEncoderZeroPoints(p)
+	filename := filepath.Join(t.TempDir(), "encoder-zero.json")
+	if err := z.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	// applied to commanded and reported positions
+	az0, el0, _, _ := p.Sky2Raw(120, 45, 0, 0)
+	if _, err := z.Apply(EncoderZeroPoint{AzElOffset: AzElOffset{Az: 0.5, El: -0.25}, Method: zeroMethodManual}); err != nil {
+		t.Fatal(err)
+	}
+	az1, el1, _, _ := p.Sky2Raw(120, 45, 0, 0)
+	if math.Abs(az1-az0-0.5) > 1e-9 || math.Abs(el1-el0+0.25) > 1e-9 {
+		t.Errorf("zero points not applied: %g,%g then %g,%g", az0, el0, az1, el1)
+	}
+	if az, el := p.Raw2Sky(az1, el1); math.Abs(az-120) > 1e-6 || math.Abs(el-45) > 1e-6 {
+		t.Errorf("Raw2Sky: got %g,%g", az, el)
+	}
+
+	// the azimuth axis at a reference mark at 180, reading 180.2
+	zero, err := z.Measure(EncoderZeroMeasurement{Method: zeroMethodReference, Axis: "azimuth", Reference: 180}, 180.2, 30)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(zero.Az-0.2) > 1e-9 || zero.El != -0.25 || zero.Version != 0 {
+		t.Errorf("reference: got %+v", zero)
+	}
+	if p.EncoderZero().Az != 0.5 {
+		t.Error("measurement applied")
+	}
+
+	// centered on a star, with the encoders reading 0.1 deg more than expected
+	az, el := p.corrected(150, 60)
+	zero, err = z.Measure(EncoderZeroMeasurement{Method: zeroMethodStar, Azimuth: 150, Elevation: 60}, az+0.1, el-0.1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if math.Abs(zero.Az-0.1) > 1e-9 || math.Abs(zero.El+0.1) > 1e-9 {
+		t.Errorf("star: got %+v", zero)
+	}
+	if zero, err = z.Apply(zero); err != nil || zero.Version != 2 {
+		t.Fatalf("apply: got %+v, %v", zero, err)
+	}
+
+	// centered with offsets, which are kept, so not counted twice
+	if err := p.offsets.Set("user", AzElOffset{Az: 0.02, El: -0.01}); err != nil {
+		t.Fatal(err)
+	}
+	rawAz, rawEl := az+0.15, el-0.05
+	zero, err = z.Measure(EncoderZeroMeasurement{Method: zeroMethodStar, Azimuth: 150, Elevation: 60}, rawAz, rawEl)
+	if err == nil {
+		_, err = z.Apply(zero)
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	if az, el, _, _ := p.Sky2Raw(150, 60, 0, 0); math.Abs(az-rawAz) > 1e-9 || math.Abs(el-rawEl) > 1e-9 {
+		t.Errorf("Sky2Raw(star): got %g,%g, expected the encoders' %g,%g", az, el, rawAz, rawEl)
+	}
+	if az, el := p.Raw2Sky(rawAz, rawEl); math.Abs(az-150) > 1e-6 || math.Abs(el-60) > 1e-6 {
+		t.Errorf("Raw2Sky: got %g,%g, expected the star", az, el)
+	}
+	if err := p.offsets.Clear("user"); err != nil {
+		t.Fatal(err)
+	}
+
+	if zero, err = z.Revert(1, "bob"); err != nil || zero.Version != 4 || zero.Az != 0.5 || zero.Method != zeroMethodRevert {
+		t.Errorf("revert: got %+v, %v", zero, err)
+	}
+	if _, err := z.Revert(7, ""); err == nil {
+		t.Error("revert to a missing version accepted")
+	}
+
+	for _, bad := range []EncoderZeroPoint{
+		{AzElOffset: AzElOffset{Az: 20}, Method: zeroMethodManual},
+		{AzElOffset: AzElOffset{El: math.NaN()}, Method: zeroMethodManual},
+		{Method: "guess"},
+	} {
+		if _, err := z.Apply(bad); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+	for _, bad := range []EncoderZeroMeasurement{
+		{Method: zeroMethodReference, Axis: "roll"},
+		{Method: zeroMethodReference, Axis: "azimuth", Reference: 150},
+		{Method: "guess"},
+	} {
+		if _, err := z.Measure(bad, 180, 30); err == nil {
+			t.Errorf("%+v accepted", bad)
+		}
+	}
+
+	// the versions are saved, and the latest applied when loaded
+	p = NewPointing()
+	z = NewEncoderZeroPoints(p)
+	if err := z.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(z.Versions()); n != 4 || z.Current().By != "bob" || p.EncoderZero() != (AzElOffset{Az: 0.5, El: -0.25}) {
+		t.Errorf("loaded %d versions, current %+v, applied %+v", n, z.Current(), p.EncoderZero())
+	}
+}
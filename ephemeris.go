@@ -0,0 +1,148 @@
+package main
+
+// #include "erfa.h"
+import "C"
+
+import (
+	"fmt"
+	"math"
+)
+
+const (
+	// speed of light (au/day)
+	AU_PER_DAY_C = 173.1446326846693
+
+	// arcseconds per radian
+	ARCSEC_PER_RAD = 180 * 3600 / math.Pi
+)
+
+// eraPlan94 planet numbers
+var solarSystemBodies = map[string]int{
+	"Sun":     0,
+	"Moon":    -1,
+	"Mercury": 1,
+	"Venus":   2,
+	"Mars":    4,
+	"Jupiter": 5,
+	"Saturn":  6,
+	"Uranus":  7,
+	"Neptune": 8,
+}
+
+func checkSolarSystemBody(body string) error {
+	if _, ok := solarSystemBodies[body]; !ok {
+		return fmt.Errorf("unknown solar system body: %s", body)
+	}
+	return nil
+}
+
+// unixtime2TT converts unixtime (UTC) to a 2-part TT Julian date,
+// which is within 2 ms of TDB.
+func unixtime2TT(unixtime float64) (float64, float64, error) {
+	var tai1, tai2, tt1, tt2 C.double
+	stat := C.eraUtctai(UNIX_JD_EPOCH, C.double(unixtime/86400), &tai1, &tai2)
+	switch stat {
+	case 0:
+	case 1:
+		return 0, 0, fmt.Errorf("eraUtctai: dubious year")
+	default:
+		return 0, 0, fmt.Errorf("eraUtctai: unacceptable date")
+	}
+	C.eraTaitt(tai1, tai2, &tt1, &tt2)
+	return float64(tt1), float64(tt2), nil
+}
+
+// earthSun returns the barycentric positions of the Earth and the Sun (au).
+func earthSun(tdb1, tdb2 float64) (earth, sun [3]float64, err error) {
+	var pvh, pvb [2][3]C.double
+	if C.eraEpv00(C.double(tdb1), C.double(tdb2), &pvh[0], &pvb[0]) != 0 {
+		err = fmt.Errorf("eraEpv00: date outside 1900-2100")
+	}
+	for i := 0; i < 3; i++ {
+		earth[i] = float64(pvb[0][i])
+		sun[i] = float64(pvb[0][i] - pvh[0][i])
+	}
+	return
+}
+
+// bodyPosition returns the barycentric position of a body (au).
+func bodyPosition(tdb1, tdb2 float64, body string) ([3]float64, error) {
+	earth, p, err := earthSun(tdb1, tdb2)
+	if err != nil {
+		return p, err
+	}
+
+	var pv [2][3]C.double
+	switch np := solarSystemBodies[body]; np {
+	case 0:
+		return p, nil
+	case -1:
+		C.eraMoon98(C.double(tdb1), C.double(tdb2), &pv[0])
+		p = earth // Moon98 is geocentric
+	default:
+		switch C.eraPlan94(C.double(tdb1), C.double(tdb2), C.int(np), &pv[0]) {
+		case 0:
+		case 1:
+			return p, fmt.Errorf("eraPlan94: year outside 1000-3000")
+		default:
+			return p, fmt.Errorf("eraPlan94: failed for %s", body)
+		}
+	}
+	for i := 0; i < 3; i++ {
+		p[i] += float64(pv[0][i])
+	}
+	return p, nil
+}
+
+// BodyRADec returns the barycentric ICRS RA/Dec (deg) of a solar system
+// body at unixtime, as seen from the Earth (i.e., corrected for light time),
+// and its parallax (arcsec).
+func BodyRADec(unixtime float64, body string) (float64, float64, float64, error) {
+	if err := checkSolarSystemBody(body); err != nil {
+		return 0, 0, 0, err
+	}
+	tdb1, tdb2, err := unixtime2TT(unixtime)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+	earth, _, err := earthSun(tdb1, tdb2)
+	if err != nil {
+		return 0, 0, 0, err
+	}
+
+	// iterate light time
+	var p [3]float64
+	tau := 0.0
+	for i := 0; i < 3; i++ {
+		p, err = bodyPosition(tdb1, tdb2-tau, body)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		d := math.Sqrt(sq(p[0]-earth[0]) + sq(p[1]-earth[1]) + sq(p[2]-earth[2]))
+		tau = d / AU_PER_DAY_C
+	}
+
+	r := math.Sqrt(sq(p[0]) + sq(p[1]) + sq(p[2]))
+	if r == 0 {
+		return 0, 0, 0, fmt.Errorf("%s: bad ephemeris position", body)
+	}
+	ra := math.Mod(rad2deg(math.Atan2(p[1], p[0]))+360, 360)
+	dec := rad2deg(math.Asin(p[2] / r))
+	return ra, dec, ARCSEC_PER_RAD / r, nil
+}
+
+// BodyObsAzEl returns the observed (i.e., refracted) Az/El of a solar system
+// body, using the site atmosphere. All angles are in degrees.
+func BodyObsAzEl(unixtime float64, body string) (float64, float64, error) {
+	ra, dec, px, err := BodyRADec(unixtime, body)
+	if err != nil {
+		return 0, 0, err
+	}
+	// the parallax takes us from the barycenter to the telescope
+	az, el, err := radecpm2AzEl(unixtime, ra, dec, 0, 0, px, 0)
+	return az, siteAtmosphere.SkyEl2ObsEl(el), err
+}
+
+func sq(x float64) float64 {
+	return x * x
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestBodyRADec(t *testing.T) {
+	// Meeus, Astronomical Algorithms, 2nd ed., example 33.a: Venus at
+	// 1992 December 20, 0h TT (TT-UTC = 59.184 s), apparent geocentric
+	// RA 21h04m41.454s, Dec -18°53'16.84"
+	t0 := time.Date(1992, 12, 19, 23, 59, 0, 816e6, time.UTC)
+	ut := Time2Unixtime(t0)
+	ra, dec, px, err := BodyRADec(ut, "Venus")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// from the barycenter, within 0.01 au of Venus' heliocentric 0.724603 au
+	if r := ARCSEC_PER_RAD / px; math.Abs(r-0.724603) > 0.01 {
+		t.Errorf("parallax: got %g arcsec, i.e. %g au", px, r)
+	}
+
+	// apparent RA/Dec of date, topocentric, so within Venus' horizontal
+	// parallax (10 arcsec) and the accuracy of Plan94 (a few arcsec)
+	az, el, err := radecpm2AzEl(ut, ra, dec, 0, 0, px, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	appRA, appDec, err := AzEl2AppRADec(ut, az, el)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expectedRA := (21 + 4/60. + 41.454/3600) * 15
+	expectedDec := -(18 + 53/60. + 16.84/3600)
+	const tol = 20.0 / 3600 // [deg]
+	if sep := angularSeparation(appRA, appDec, expectedRA, expectedDec); sep > tol {
+		t.Errorf("got RA=%.5f Dec=%.5f, %.1f arcsec from RA=%.5f Dec=%.5f",
+			appRA, appDec, sep*3600, expectedRA, expectedDec)
+	}
+
+	if _, _, _, err := BodyRADec(ut, "Pluto"); err == nil {
+		t.Error("unknown body accepted")
+	}
+}
@@ -0,0 +1,745 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A minimal EPICS Channel Access server (protocol 4.13), so engineering
+// screens and archivers can see the telescope as PVs: name resolution
+// over UDP, and reads, monitors, and writes of scalar channels over TCP,
+// without an external dependency. Beacons aren't sent, so clients only
+// notice a restart when their connection drops.
+
+const (
+	caMinorVersion  = 13
+	caHeaderSize    = 16
+	caMaxPayload    = 1 << 14
+	caStringSize    = 40 // MAX_STRING_SIZE
+	caWriteTimeout  = 5 * time.Second
+	caQueueLen      = 100 // messages waiting to be sent to a client
+	caUpdateRate    = 10  // [Hz] of the status the PVs follow
+	defaultCAPrefix = "FYST:TCS:"
+
+	caVersion      = 0
+	caEventAdd     = 1
+	caEventCancel  = 2
+	caWrite        = 4
+	caSearch       = 6
+	caEventsOff    = 8
+	caEventsOn     = 9
+	caClearChannel = 12
+	caNotFound     = 14
+	caReadNotify   = 15
+	caCreateChan   = 18
+	caWriteNotify  = 19
+	caClientName   = 20
+	caHostName     = 21
+	caAccessRights = 22
+	caEcho         = 23
+	caCreateChFail = 26
+
+	caDoReply     = 10 // search reply flag
+	caAccessRead  = 1
+	caAccessWrite = 2
+
+	// status codes
+	ecaNormal     = 1
+	ecaBadType    = 114
+	ecaPutFail    = 160
+	ecaBadCount   = 176
+	ecaNoWtAccess = 376
+	ecaBadChanID  = 410
+
+	// alarm conditions and severities
+	caAlarmState = 7  // STATE_ALARM
+	caAlarmUDF   = 17 // UDF_ALARM, undefined
+	caSevMinor   = 1
+	caSevMajor   = 2
+	caSevInvalid = 3
+
+	caEpochOffset  = 631152000 // the EPICS epoch, 1990-01-01, in Unix time
+	caDBRClassSize = 7         // DBR_STRING ... DBR_DOUBLE, then STS, TIME, GR, CTRL
+)
+
+var errSlowClient = errors.New("client not keeping up")
+
+// DBR field types
+const (
+	dbrString = iota
+	dbrShort
+	dbrFloat
+	dbrEnum
+	dbrChar
+	dbrLong
+	dbrDouble
+)
+
+// A caValue is the value of a PV, and its alarm.
+type caValue struct {
+	num      float64
+	str      string
+	isString bool
+	status   int16 // alarm condition
+	severity int16
+	time     time.Time
+}
+
+func (v caValue) String() string {
+	if v.isString {
+		return v.str
+	}
+	return strconv.FormatFloat(v.num, 'g', -1, 64)
+}
+
+// Float returns the value as a number, failing for strings that aren't.
+func (v caValue) Float() (float64, error) {
+	if v.isString {
+		return strconv.ParseFloat(strings.TrimSpace(v.str), 64)
+	}
+	return v.num, nil
+}
+
+// encodeDBR encodes v as DBR type typ, the plain, STS, or TIME type of
+// any field type, or the GR or CTRL type of a string or double.
+func encodeDBR(typ uint16, v caValue) ([]byte, error) {
+	base, class := typ%caDBRClassSize, typ/caDBRClassSize
+	if class > 4 {
+		return nil, fmt.Errorf("unsupported DBR type %d", typ)
+	}
+	var num float64
+	if base != dbrString {
+		var err error
+		num, err = v.Float()
+		if err != nil {
+			return nil, fmt.Errorf("%q is not a number", v.str)
+		}
+	}
+	var b bytes.Buffer
+	w := func(x interface{}) { binary.Write(&b, binary.BigEndian, x) }
+	if class > 0 {
+		w([2]int16{v.status, v.severity})
+	}
+	if class == 2 {
+		var sec, nsec uint32
+		if !v.time.IsZero() {
+			sec, nsec = uint32(v.time.Unix()-caEpochOffset), uint32(v.time.Nanosecond())
+		}
+		w([2]uint32{sec, nsec})
+	}
+	if class >= 3 {
+		switch base {
+		case dbrString: // the same as STS
+		case dbrDouble:
+			w([2]int16{6, 0}) // precision, padding
+			w([8]byte{})      // units
+			n := 6
+			if class == 4 {
+				n = 8
+			}
+			w(make([]float64, n)) // display, alarm, and control limits
+		default:
+			return nil, fmt.Errorf("unsupported DBR type %d", typ)
+		}
+	}
+	switch base {
+	case dbrString:
+		var s [caStringSize]byte
+		copy(s[:caStringSize-1], v.String())
+		w(s)
+	case dbrShort:
+		if class == 2 {
+			w(int16(0))
+		}
+		w(int16(num))
+	case dbrFloat:
+		w(float32(num))
+	case dbrEnum:
+		if class == 2 {
+			w(int16(0))
+		}
+		w(uint16(num))
+	case dbrChar:
+		switch class {
+		case 1:
+			w(uint8(0))
+		case 2:
+			w([3]uint8{})
+		}
+		w(uint8(num))
+	case dbrLong:
+		w(int32(num))
+	case dbrDouble:
+		if class == 1 || class == 2 {
+			w(int32(0))
+		}
+		w(num)
+	}
+	return b.Bytes(), nil
+}
+
+// decodeDBR decodes a written value of plain DBR type typ.
+func decodeDBR(typ uint16, b []byte) (caValue, error) {
+	r := bytes.NewReader(b)
+	var err error
+	read := func(x interface{}) float64 {
+		if err == nil {
+			err = binary.Read(r, binary.BigEndian, x)
+		}
+		switch x := x.(type) {
+		case *int16:
+			return float64(*x)
+		case *uint16:
+			return float64(*x)
+		case *uint8:
+			return float64(*x)
+		case *int32:
+			return float64(*x)
+		case *float32:
+			return float64(*x)
+		case *float64:
+			return *x
+		}
+		return 0
+	}
+	var v caValue
+	switch typ {
+	case dbrString:
+		s := b
+		if i := bytes.IndexByte(s, 0); i >= 0 {
+			s = s[:i]
+		}
+		v.str, v.isString = string(s), true
+	case dbrShort:
+		v.num = read(new(int16))
+	case dbrFloat:
+		v.num = read(new(float32))
+	case dbrEnum:
+		v.num = read(new(uint16))
+	case dbrChar:
+		v.num = read(new(uint8))
+	case dbrLong:
+		v.num = read(new(int32))
+	case dbrDouble:
+		v.num = read(new(float64))
+	default:
+		err = fmt.Errorf("unsupported DBR type %d for a write", typ)
+	}
+	return v, err
+}
+
+// A caPV is a process variable served by the gateway.
+type caPV struct {
+	name  string // without the prefix
+	value caValue
+	write func(c *caConn, v caValue) error // nil if read only
+}
+
+func (pv *caPV) nativeType() uint16 {
+	if pv.value.isString {
+		return dbrString
+	}
+	return dbrDouble
+}
+
+type caSub struct {
+	pv    *caPV
+	typ   uint16
+	count uint16
+}
+
+// A caConn is a client's TCP connection.
+type caConn struct {
+	conn       net.Conn
+	out        chan []byte // written in order by write
+	user, host string
+
+	// guarded by the gateway's mu
+	chans map[uint32]*caPV
+	subs  map[uint32]caSub
+}
+
+// send queues a message, failing if the client isn't keeping up.
+func (c *caConn) send(cmd, typ, count uint16, p1, p2 uint32, payload []byte) error {
+	n := (len(payload) + 7) &^ 7
+	b := make([]byte, caHeaderSize+n)
+	binary.BigEndian.PutUint16(b[0:], cmd)
+	binary.BigEndian.PutUint16(b[2:], uint16(n))
+	binary.BigEndian.PutUint16(b[4:], typ)
+	binary.BigEndian.PutUint16(b[6:], count)
+	binary.BigEndian.PutUint32(b[8:], p1)
+	binary.BigEndian.PutUint32(b[12:], p2)
+	copy(b[caHeaderSize:], payload)
+	select {
+	case c.out <- b:
+		return nil
+	default:
+		return errSlowClient
+	}
+}
+
+// write writes the queued messages until the queue is closed.
+func (c *caConn) write() {
+	for b := range c.out {
+		c.conn.SetWriteDeadline(time.Now().Add(caWriteTimeout))
+		_, err := c.conn.Write(b)
+		if err != nil {
+			c.conn.Close() // stopping serve
+			for range c.out {
+			}
+			return
+		}
+	}
+}
+
+// principal is who a client is, for authorizing its writes.
+func (c *caConn) principal(role Role) *Principal {
+	return &Principal{Name: fmt.Sprintf("epics:%s@%s", c.user, c.host), Role: role}
+}
+
+// A caHeader is a Channel Access message header.
+type caHeader struct {
+	Command, Size, Type, Count uint16
+	P1, P2                     uint32
+}
+
+// readCAMessage reads a message, with an extended header if need be.
+func readCAMessage(r io.Reader) (caHeader, []byte, error) {
+	var h caHeader
+	err := binary.Read(r, binary.BigEndian, &h)
+	if err != nil {
+		return h, nil, err
+	}
+	size := int(h.Size)
+	if h.Size == 0xffff && h.Count == 0 {
+		var ext [2]uint32
+		err = binary.Read(r, binary.BigEndian, &ext)
+		if err != nil {
+			return h, nil, err
+		}
+		size, h.Count = int(ext[0]), uint16(ext[1])
+	}
+	if size > caMaxPayload {
+		return h, nil, fmt.Errorf("channel access: %d byte payload too large", size)
+	}
+	b := make([]byte, size)
+	_, err = io.ReadFull(r, b)
+	return h, b, err
+}
+
+func cString(b []byte) string {
+	if i := bytes.IndexByte(b, 0); i >= 0 {
+		b = b[:i]
+	}
+	return string(b)
+}
+
+// An EPICSGateway serves the telescope's status, and a few commands,
+// as PVs named with a prefix, e.g. FYST:TCS:AZ.
+type EPICSGateway struct {
+	prefix   string
+	commands bool // writes allowed
+	role     Role // of clients' commands, with authentication
+	auth     *Auth
+	stream   *StatusStream
+	submit   func(p *Principal, endpoint string, body io.Reader) (string, int, error)
+	abort    func() bool
+
+	tcp *net.TCPListener
+	udp *net.UDPConn
+
+	mu    sync.Mutex
+	pvs   map[string]*caPV
+	conns map[*caConn]bool
+	sid   uint32 // the last channel ID
+}
+
+// ListenEPICS listens for Channel Access clients on addr, e.g. ":5064",
+// for both name searches (UDP) and channels (TCP). With commands, clients
+// may write the command PVs, as role if tokens are required.
+func ListenEPICS(addr, prefix string, commands bool, role Role, auth *Auth, stream *StatusStream,
+	submit func(p *Principal, endpoint string, body io.Reader) (string, int, error), abort func() bool) (*EPICSGateway, error) {
+	taddr, err := net.ResolveTCPAddr("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	gw := &EPICSGateway{
+		prefix:   prefix,
+		commands: commands,
+		role:     role,
+		auth:     auth,
+		stream:   stream,
+		submit:   submit,
+		abort:    abort,
+		pvs:      make(map[string]*caPV),
+		conns:    make(map[*caConn]bool),
+	}
+	gw.tcp, err = net.ListenTCP("tcp", taddr)
+	if err != nil {
+		return nil, err
+	}
+	// searches come to the same port
+	uaddr := &net.UDPAddr{IP: taddr.IP, Port: gw.tcp.Addr().(*net.TCPAddr).Port}
+	gw.udp, err = net.ListenUDP("udp", uaddr)
+	if err != nil {
+		gw.tcp.Close()
+		return nil, err
+	}
+	gw.addPVs()
+	return gw, nil
+}
+
+func (gw *EPICSGateway) addPVs() {
+	now := time.Now()
+	num := func(name string) {
+		gw.pvs[name] = &caPV{name: name, value: caValue{status: caAlarmUDF, severity: caSevInvalid, time: now}}
+	}
+	str := func(name string) {
+		gw.pvs[name] = &caPV{name: name, value: caValue{isString: true, status: caAlarmUDF, severity: caSevInvalid, time: now}}
+	}
+	for _, name := range []string{"AZ", "EL", "AZ_TRACKING_ERROR", "EL_TRACKING_ERROR", "ALARMS"} {
+		num(name)
+	}
+	for _, name := range []string{"AZ_MODE", "EL_MODE", "ALARM", "COMMAND", "COMMAND_STATE"} {
+		str(name)
+	}
+
+	// commands: /move-to the setpoints, /stow, and /abort
+	for _, name := range []string{"AZ_SP", "EL_SP"} {
+		gw.pvs[name] = &caPV{name: name, value: caValue{time: now}, write: func(c *caConn, v caValue) error { return nil }}
+	}
+	gw.pvs["MOVE"] = &caPV{name: "MOVE", value: caValue{time: now}, write: func(c *caConn, v caValue) error {
+		body := fmt.Sprintf(`{"azimuth": %s, "elevation": %s}`, gw.pvs["AZ_SP"].value, gw.pvs["EL_SP"].value)
+		return gw.command(c, "/move-to", body)
+	}}
+	gw.pvs["STOW"] = &caPV{name: "STOW", value: caValue{time: now}, write: func(c *caConn, v caValue) error {
+		return gw.command(c, "/stow", "{}")
+	}}
+	gw.pvs["ABORT"] = &caPV{name: "ABORT", value: caValue{time: now}, write: func(c *caConn, v caValue) error {
+		if gw.auth != nil {
+			err := gw.auth.Authorize(c.principal(gw.role), "POST", "/abort")
+			if err != nil {
+				return err
+			}
+		}
+		if !gw.abort() {
+			return fmt.Errorf("nothing to abort")
+		}
+		log.Printf("epics: abort by %s@%s", c.user, c.host)
+		return nil
+	}}
+}
+
+// command submits a command written by the client c. It's called with
+// the gateway's mu held, so may read the other PVs.
+func (gw *EPICSGateway) command(c *caConn, endpoint, body string) error {
+	var p *Principal
+	if gw.auth != nil {
+		p = c.principal(gw.role)
+		err := gw.auth.Authorize(p, "POST", endpoint)
+		if err != nil {
+			return err
+		}
+	}
+	id, _, err := gw.submit(p, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	log.Printf("epics: command %s: %s by %s@%s", id, endpoint, c.user, c.host)
+	return nil
+}
+
+func (gw *EPICSGateway) Run() error {
+	go gw.follow()
+	go gw.serveSearches()
+	for {
+		conn, err := gw.tcp.Accept()
+		if err != nil {
+			return err
+		}
+		go gw.serve(conn)
+	}
+}
+
+// follow updates the PVs from the status stream.
+func (gw *EPICSGateway) follow() {
+	sub, err := gw.stream.Subscribe(caUpdateRate)
+	if err != nil {
+		log.Print("epics: ", err)
+		return
+	}
+	defer gw.stream.Unsubscribe(sub)
+	for sample := range sub.c {
+		gw.update(&sample, time.Now())
+	}
+}
+
+// update sets the status PVs from a status sample, posting those which
+// changed to their monitors.
+func (gw *EPICSGateway) update(sample *statusSample, now time.Time) {
+	rec := &sample.rec
+	values := map[string]caValue{
+		"AZ":            {num: rec.AzimuthCurrentPosition},
+		"EL":            {num: rec.ElevationCurrentPosition},
+		"AZ_MODE":       {str: fmt.Sprint(rec.AzimuthMode), isString: true},
+		"EL_MODE":       {str: fmt.Sprint(rec.ElevationMode), isString: true},
+		"ALARM":         {isString: true},
+		"COMMAND":       {isString: true},
+		"COMMAND_STATE": {isString: true},
+	}
+	for i, x := range []*float64{sample.tracking.Azimuth, sample.tracking.Elevation} {
+		name := [2]string{"AZ_TRACKING_ERROR", "EL_TRACKING_ERROR"}[i]
+		if x != nil {
+			values[name] = caValue{num: *x}
+		} else {
+			values[name] = caValue{status: caAlarmUDF, severity: caSevInvalid} // not tracking
+		}
+	}
+	alarms := caValue{num: float64(len(sample.alarms))}
+	var worst *Alarm
+	for i := range sample.alarms {
+		if a := &sample.alarms[i]; worst == nil || a.Severity > worst.Severity {
+			worst = a
+		}
+	}
+	if worst != nil {
+		sev := int16(0)
+		switch worst.Severity {
+		case severityWarning:
+			sev = caSevMinor
+		case severityCritical:
+			sev = caSevMajor
+		}
+		if sev != 0 {
+			alarms.status, alarms.severity = caAlarmState, sev
+		}
+		values["ALARM"] = caValue{str: worst.Name + ": " + worst.Message, isString: true, status: alarms.status, severity: alarms.severity}
+	}
+	values["ALARMS"] = alarms
+	if cmd := sample.command; cmd != nil {
+		values["COMMAND"] = caValue{str: cmd.Command, isString: true}
+		values["COMMAND_STATE"] = caValue{str: cmd.State, isString: true}
+	}
+
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	for name, v := range values {
+		pv := gw.pvs[name]
+		old := pv.value
+		if v.num == old.num && v.str == old.str && v.status == old.status && v.severity == old.severity {
+			continue
+		}
+		v.time = now
+		pv.value = v
+		gw.post(pv)
+	}
+}
+
+// post sends a PV's value to its monitors. It's called with mu held.
+func (gw *EPICSGateway) post(pv *caPV) {
+	for c := range gw.conns {
+		for id, sub := range c.subs {
+			if sub.pv == pv {
+				gw.sendEvent(c, id, sub)
+			}
+		}
+	}
+}
+
+func (gw *EPICSGateway) sendEvent(c *caConn, id uint32, sub caSub) {
+	b, err := encodeDBR(sub.typ, sub.pv.value)
+	status := uint32(ecaNormal)
+	if err != nil {
+		status = ecaBadType
+	}
+	c.send(caEventAdd, sub.typ, sub.count, status, id, b) // dropped for slow clients
+}
+
+// serveSearches answers clients' UDP searches for our PVs.
+func (gw *EPICSGateway) serveSearches() {
+	port := uint16(gw.tcp.Addr().(*net.TCPAddr).Port)
+	buf := make([]byte, 65536)
+	for {
+		n, from, err := gw.udp.ReadFromUDP(buf)
+		if err != nil {
+			log.Print("epics: ", err)
+			return
+		}
+		var reply bytes.Buffer
+		r := bytes.NewReader(buf[:n])
+		for r.Len() > 0 {
+			h, b, err := readCAMessage(r)
+			if err != nil {
+				break
+			}
+			if h.Command != caSearch {
+				continue
+			}
+			gw.mu.Lock()
+			name := cString(b)
+			_, found := gw.pvs[strings.TrimPrefix(name, gw.prefix)]
+			found = found && strings.HasPrefix(name, gw.prefix)
+			gw.mu.Unlock()
+			switch {
+			case found:
+				binary.Write(&reply, binary.BigEndian, caHeader{caSearch, 8, port, 0, 0xffffffff, h.P2})
+				binary.Write(&reply, binary.BigEndian, [4]uint16{caMinorVersion})
+			case h.Type == caDoReply:
+				binary.Write(&reply, binary.BigEndian, caHeader{caNotFound, 0, h.Type, h.Count, h.P1, h.P2})
+			}
+		}
+		if reply.Len() > 0 {
+			var version bytes.Buffer
+			binary.Write(&version, binary.BigEndian, caHeader{Command: caVersion, Count: caMinorVersion})
+			gw.udp.WriteToUDP(append(version.Bytes(), reply.Bytes()...), from)
+		}
+	}
+}
+
+// serve handles a client's TCP connection.
+func (gw *EPICSGateway) serve(conn net.Conn) {
+	c := &caConn{
+		conn:  conn,
+		out:   make(chan []byte, caQueueLen),
+		chans: make(map[uint32]*caPV),
+		subs:  make(map[uint32]caSub),
+	}
+	go c.write()
+	gw.mu.Lock()
+	gw.conns[c] = true
+	gw.mu.Unlock()
+	defer func() {
+		gw.mu.Lock()
+		delete(gw.conns, c)
+		close(c.out)
+		gw.mu.Unlock()
+		conn.Close()
+	}()
+
+	r := bufio.NewReader(conn)
+	for {
+		h, b, err := readCAMessage(r)
+		if err != nil {
+			if err != io.EOF {
+				log.Print("epics: ", err)
+			}
+			return
+		}
+		err = gw.handle(c, h, b)
+		if err != nil {
+			log.Print("epics: ", err)
+			return
+		}
+	}
+}
+
+func (gw *EPICSGateway) handle(c *caConn, h caHeader, b []byte) error {
+	gw.mu.Lock()
+	defer gw.mu.Unlock()
+	switch h.Command {
+	case caVersion:
+		return c.send(caVersion, 0, caMinorVersion, 0, 0, nil)
+	case caClientName:
+		c.user = cString(b)
+	case caHostName:
+		c.host = cString(b)
+	case caEcho:
+		return c.send(caEcho, 0, 0, 0, 0, nil)
+	case caCreateChan:
+		name := cString(b)
+		pv, ok := gw.pvs[strings.TrimPrefix(name, gw.prefix)]
+		if !ok || !strings.HasPrefix(name, gw.prefix) {
+			return c.send(caCreateChFail, 0, 0, h.P1, 0, nil)
+		}
+		gw.sid++
+		c.chans[gw.sid] = pv
+		rights := uint32(caAccessRead)
+		if pv.write != nil && gw.commands {
+			rights |= caAccessWrite
+		}
+		err := c.send(caAccessRights, 0, 0, h.P1, rights, nil)
+		if err != nil {
+			return err
+		}
+		return c.send(caCreateChan, pv.nativeType(), 1, h.P1, gw.sid, nil)
+	case caClearChannel:
+		for id, sub := range c.subs {
+			if sub.pv == c.chans[h.P1] {
+				delete(c.subs, id)
+			}
+		}
+		delete(c.chans, h.P1)
+		return c.send(caClearChannel, 0, 0, h.P1, h.P2, nil)
+	case caReadNotify:
+		pv, ok := c.chans[h.P1]
+		if !ok {
+			return c.send(caReadNotify, h.Type, h.Count, ecaBadChanID, h.P2, nil)
+		}
+		if h.Count > 1 {
+			return c.send(caReadNotify, h.Type, h.Count, ecaBadCount, h.P2, nil)
+		}
+		v, err := encodeDBR(h.Type, pv.value)
+		if err != nil {
+			return c.send(caReadNotify, h.Type, h.Count, ecaBadType, h.P2, nil)
+		}
+		return c.send(caReadNotify, h.Type, 1, ecaNormal, h.P2, v)
+	case caEventAdd:
+		pv, ok := c.chans[h.P1]
+		if !ok {
+			return nil
+		}
+		sub := caSub{pv, h.Type, 1}
+		c.subs[h.P2] = sub
+		gw.sendEvent(c, h.P2, sub)
+	case caEventCancel:
+		delete(c.subs, h.P2)
+		return c.send(caEventAdd, h.Type, h.Count, h.P1, h.P2, nil)
+	case caWrite, caWriteNotify:
+		status := uint32(ecaNormal)
+		pv, ok := c.chans[h.P1]
+		switch {
+		case !ok:
+			status = ecaBadChanID
+		case pv.write == nil || !gw.commands:
+			status = ecaNoWtAccess
+		default:
+			v, err := decodeDBR(h.Type, b)
+			if err == nil && !pv.value.isString {
+				var x float64
+				x, err = v.Float()
+				if err == nil && (math.IsNaN(x) || math.IsInf(x, 0)) {
+					err = finiteError(pv.name, x)
+				}
+				v = caValue{num: x}
+			}
+			if err == nil {
+				err = pv.write(c, v)
+			}
+			if err != nil {
+				log.Printf("epics: write to %s%s: %v", gw.prefix, pv.name, err)
+				status = ecaPutFail
+			} else {
+				v.time = time.Now()
+				pv.value = v
+				gw.post(pv)
+			}
+		}
+		if h.Command == caWriteNotify {
+			return c.send(caWriteNotify, h.Type, h.Count, status, h.P2, nil)
+		}
+	case caEventsOff, caEventsOn:
+		// flow control: slow clients miss updates instead
+	}
+	return nil
+}
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"math"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestEncodeDBR(t *testing.T) {
+	v := caValue{num: 120.5, status: caAlarmState, severity: caSevMinor, time: time.Unix(caEpochOffset+10, 5)}
+	for _, test := range []struct {
+		typ  uint16
+		size int
+	}{
+		{dbrDouble, 8},
+		{dbrString, caStringSize},
+		{caDBRClassSize + dbrDouble, 16},   // STS
+		{caDBRClassSize + dbrString, 44},   // STS
+		{caDBRClassSize + dbrChar, 6},      // STS
+		{2*caDBRClassSize + dbrDouble, 24}, // TIME
+		{2*caDBRClassSize + dbrString, 52}, // TIME
+		{2*caDBRClassSize + dbrShort, 16},  // TIME
+		{2*caDBRClassSize + dbrChar, 16},   // TIME
+		{3*caDBRClassSize + dbrDouble, 72}, // GR
+		{4*caDBRClassSize + dbrDouble, 88}, // CTRL
+		{4*caDBRClassSize + dbrString, 44}, // CTRL, as STS
+	} {
+		b, err := encodeDBR(test.typ, v)
+		if err != nil || len(b) != test.size {
+			t.Errorf("encodeDBR(%d): got %d bytes, %v, expected %d", test.typ, len(b), err, test.size)
+		}
+	}
+
+	b, _ := encodeDBR(2*caDBRClassSize+dbrDouble, v)
+	var x struct {
+		Status, Severity int16
+		Sec, Nsec        uint32
+		Pad              int32
+		Value            float64
+	}
+	binary.Read(bytes.NewReader(b), binary.BigEndian, &x)
+	if x.Status != caAlarmState || x.Severity != caSevMinor || x.Sec != 10 || x.Nsec != 5 || x.Value != 120.5 {
+		t.Errorf("encodeDBR(TIME_DOUBLE): got %+v", x)
+	}
+	if _, err := encodeDBR(3*caDBRClassSize+dbrLong, v); err == nil {
+		t.Error("encodeDBR(GR_LONG): expected unsupported")
+	}
+	if _, err := encodeDBR(dbrDouble, caValue{str: "stop", isString: true}); err == nil {
+		t.Error("encodeDBR(DOUBLE) of a string: expected an error")
+	}
+
+	w, err := decodeDBR(dbrLong, []byte{0, 0, 0, 42, 0, 0, 0, 0})
+	if err != nil || w.num != 42 {
+		t.Errorf("decodeDBR(LONG): got %+v, %v", w, err)
+	}
+}
+
+func caRequest(t *testing.T, conn io.Writer, cmd, typ, count uint16, p1, p2 uint32, payload []byte) {
+	t.Helper()
+	n := (len(payload) + 7) &^ 7
+	binary.Write(conn, binary.BigEndian, caHeader{cmd, uint16(n), typ, count, p1, p2})
+	_, err := conn.Write(append(payload, make([]byte, n-len(payload))...))
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func caReply(t *testing.T, conn net.Conn, cmd uint16) (caHeader, []byte) {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	h, b, err := readCAMessage(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Command != cmd {
+		t.Fatalf("got command %d, expected %d", h.Command, cmd)
+	}
+	return h, b
+}
+
+func TestEPICSGateway(t *testing.T) {
+	submitted := make(chan string, 2)
+	submit := func(p *Principal, endpoint string, body io.Reader) (string, int, error) {
+		b, _ := io.ReadAll(body)
+		submitted <- endpoint + " " + string(b)
+		return "a", 200, nil
+	}
+	stream := NewStatusStream(nil, nil, nil, nil, nil, nil, nil, nil, nil, nil)
+	gw, err := ListenEPICS("127.0.0.1:0", defaultCAPrefix, true, roleOperator, nil, stream, submit, func() bool { return false })
+	if err != nil {
+		t.Fatal(err)
+	}
+	go gw.Run()
+	var sample statusSample
+	sample.rec.AzimuthCurrentPosition = 120
+	sample.alarms = []Alarm{{Name: "fault", Severity: severityCritical, Message: "fault bits 1"}}
+	gw.update(&sample, time.Now())
+
+	// search for a PV
+	udp, err := net.Dial("udp", gw.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer udp.Close()
+	var search bytes.Buffer
+	caRequest(t, &search, caVersion, 0, caMinorVersion, 0, 0, nil)
+	caRequest(t, &search, caSearch, 5, caMinorVersion, 7, 7, []byte("FYST:TCS:AZ\x00"))
+	caRequest(t, &search, caSearch, 5, caMinorVersion, 8, 8, []byte("OTHER:PV\x00"))
+	udp.Write(search.Bytes())
+	buf := make([]byte, 1024)
+	udp.SetReadDeadline(time.Now().Add(5 * time.Second))
+	n, err := udp.Read(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := bytes.NewReader(buf[:n])
+	version, _, _ := readCAMessage(r)
+	h, _, err := readCAMessage(r)
+	if version.Command != caVersion || h.Command != caSearch || err != nil || r.Len() != 0 ||
+		int(h.Type) != gw.tcp.Addr().(*net.TCPAddr).Port || h.P2 != 7 {
+		t.Errorf("search: got %+v, %v", h, err)
+	}
+
+	conn, err := net.Dial("tcp", gw.tcp.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	caRequest(t, conn, caVersion, 0, caMinorVersion, 0, 0, nil)
+	caRequest(t, conn, caClientName, 0, 0, 0, 0, []byte("alice\x00"))
+	caRequest(t, conn, caHostName, 0, 0, 0, 0, []byte("opsws1\x00"))
+	caReply(t, conn, caVersion)
+
+	// create channels
+	sids := map[string]uint32{}
+	for i, name := range []string{"AZ", "ALARMS", "STOW", "AZ_SP", "EL_SP", "MOVE"} {
+		caRequest(t, conn, caCreateChan, 0, 0, uint32(i), caMinorVersion, []byte(defaultCAPrefix+name+"\x00"))
+		h, _ := caReply(t, conn, caAccessRights)
+		writable := h.P2&caAccessWrite != 0
+		if writable != (name != "AZ" && name != "ALARMS") {
+			t.Errorf("%s: got access rights %d", name, h.P2)
+		}
+		h, _ = caReply(t, conn, caCreateChan)
+		if h.Type != dbrDouble || h.Count != 1 || h.P1 != uint32(i) {
+			t.Errorf("%s: got %+v", name, h)
+		}
+		sids[name] = h.P2
+	}
+	caRequest(t, conn, caCreateChan, 0, 0, 99, caMinorVersion, []byte("FYST:TCS:BOGUS\x00"))
+	if h, _ := caReply(t, conn, caCreateChFail); h.P1 != 99 {
+		t.Errorf("create bogus channel: got %+v", h)
+	}
+
+	// read and monitor
+	caRequest(t, conn, caReadNotify, dbrDouble, 1, sids["AZ"], 1, nil)
+	h, b := caReply(t, conn, caReadNotify)
+	if h.P1 != ecaNormal || h.P2 != 1 || math.Float64frombits(binary.BigEndian.Uint64(b)) != 120 {
+		t.Errorf("read AZ: got %+v %x", h, b)
+	}
+	caRequest(t, conn, caEventAdd, caDBRClassSize+dbrDouble, 1, sids["ALARMS"], 5, make([]byte, 16))
+	h, b = caReply(t, conn, caEventAdd)
+	if h.P2 != 5 || int16(binary.BigEndian.Uint16(b[2:])) != caSevMajor || math.Float64frombits(binary.BigEndian.Uint64(b[8:])) != 1 {
+		t.Errorf("monitor ALARMS: got %+v %x", h, b)
+	}
+	sample.alarms = nil
+	gw.update(&sample, time.Now())
+	h, b = caReply(t, conn, caEventAdd)
+	if h.P2 != 5 || int16(binary.BigEndian.Uint16(b[2:])) != 0 || math.Float64frombits(binary.BigEndian.Uint64(b[8:])) != 0 {
+		t.Errorf("monitor ALARMS cleared: got %+v %x", h, b)
+	}
+
+	// write
+	caRequest(t, conn, caWriteNotify, dbrDouble, 1, sids["AZ"], 2, make([]byte, 8))
+	if h, _ := caReply(t, conn, caWriteNotify); h.P1 != ecaNoWtAccess {
+		t.Errorf("write AZ: got %+v", h)
+	}
+	caRequest(t, conn, caWriteNotify, dbrLong, 1, sids["STOW"], 3, []byte{0, 0, 0, 1})
+	if h, _ := caReply(t, conn, caWriteNotify); h.P1 != ecaNormal {
+		t.Errorf("write STOW: got %+v", h)
+	}
+	if s := <-submitted; s != "/stow {}" {
+		t.Errorf("write STOW: submitted %q", s)
+	}
+	caRequest(t, conn, caWrite, dbrString, 1, sids["AZ_SP"], 0, []byte("180\x00"))
+	caRequest(t, conn, caWrite, dbrString, 1, sids["EL_SP"], 0, []byte("45.5\x00"))
+	caRequest(t, conn, caWriteNotify, dbrLong, 1, sids["MOVE"], 4, []byte{0, 0, 0, 1})
+	if h, _ := caReply(t, conn, caWriteNotify); h.P1 != ecaNormal {
+		t.Errorf("write MOVE: got %+v", h)
+	}
+	if s := <-submitted; s != `/move-to {"azimuth": 180, "elevation": 45.5}` {
+		t.Errorf("write MOVE: submitted %q", s)
+	}
+}
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// SoftwareEStop is who engaged the software emergency stop, and why.
+type SoftwareEStop struct {
+	By     string    `json:"by,omitempty"`
+	Reason string    `json:"reason,omitempty"`
+	Time   time.Time `json:"time"`
+}
+
+// EStopStatus is the emergency stop state. Motion commands are refused
+// while it's engaged.
+type EStopStatus struct {
+	Engaged  bool           `json:"engaged"`
+	Hardware bool           `json:"hardware"` // the ACU's e-stop circuit
+	Software *SoftwareEStop `json:"software,omitempty"`
+}
+
+// An EmergencyStop tracks the hardware e-stop, as read with the faults,
+// and the software one. It is safe for concurrent use.
+type EmergencyStop struct {
+	faults *Faults
+	alarms *Alarms
+
+	mu       sync.Mutex
+	software *SoftwareEStop
+}
+
+func NewEmergencyStop(faults *Faults, alarms *Alarms) *EmergencyStop {
+	return &EmergencyStop{faults: faults, alarms: alarms}
+}
+
+// Engage engages the software emergency stop. It doesn't stop the ACU:
+// see ACU.EmergencyStop.
+func (e *EmergencyStop) Engage(by, reason string) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.software == nil {
+		e.software = &SoftwareEStop{By: by, Reason: reason, Time: time.Now().UTC()}
+	}
+	e.alarms.Raise("software_emergency_stop", severityCritical, false, "software emergency stop by %s: %s", by, reason)
+}
+
+// Release releases the software emergency stop.
+func (e *EmergencyStop) Release() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if e.software == nil {
+		return fmt.Errorf("software emergency stop not engaged")
+	}
+	e.software = nil
+	e.alarms.Clear("software_emergency_stop")
+	return nil
+}
+
+func (e *EmergencyStop) Status() EStopStatus {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	status := EStopStatus{Hardware: e.faults.Status().EmergencyStop}
+	if e.software != nil {
+		sw := *e.software
+		status.Software = &sw
+	}
+	status.Engaged = status.Hardware || status.Software != nil
+	return status
+}
+
+// Check checks the emergency stop is released, for starting a motion command.
+func (e *EmergencyStop) Check() error {
+	status := e.Status()
+	switch {
+	case status.Hardware:
+		return fmt.Errorf("hardware emergency stop engaged")
+	case status.Software != nil:
+		return fmt.Errorf("software emergency stop engaged by %s: %s", status.Software.By, status.Software.Reason)
+	}
+	return nil
+}
+
+// serveEmergencyStop serves the software emergency stop, which stops the
+// ACU, then aborts the current command.
+func serveEmergencyStop(mux *http.ServeMux, estop *EmergencyStop, acu *ACU, abort func() bool) {
+	mux.HandleFunc("/emergency-stop", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			status := estop.Status()
+			err := json.NewEncoder(w).Encode(&status)
+			if err != nil {
+				log.Print(err)
+			}
+			return
+		case "POST":
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(req.Body).Decode(&x) // the reason is optional
+		by := req.RemoteAddr
+		if p := principalFrom(req.Context()); p != nil {
+			by = p.Name
+		}
+
+		// stop the ACU first, then tidy up the command: its loop may be
+		// busy, e.g. uploading
+		estop.Engage(by, x.Reason)
+		log.Printf("software emergency stop by %s: %s", by, x.Reason)
+		err := acu.EmergencyStop()
+		go abort()
+		status := http.StatusOK
+		if err != nil {
+			log.Print(err)
+			status = http.StatusInternalServerError
+		}
+		jsonResponse(w, err, status)
+	})
+
+	mux.HandleFunc("/emergency-stop/release", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := estop.Release()
+		status := http.StatusOK
+		if err != nil {
+			status = http.StatusConflict
+		} else {
+			log.Print("software emergency stop released")
+		}
+		jsonResponse(w, err, status)
+	})
+}
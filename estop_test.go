@@ -0,0 +1,73 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestEmergencyStop(t *testing.T) {
+	faults := &Faults{}
+	alarms := NewAlarms()
+	e := NewEmergencyStop(faults, alarms)
+	if e.Check() != nil || e.Status().Engaged || e.Release() == nil {
+		t.Errorf("got %+v, expected released", e.Status())
+	}
+
+	e.Engage("alice", "person on the platform")
+	err := e.Check()
+	if err == nil || !strings.Contains(err.Error(), "alice") || len(alarms.List()) != 1 {
+		t.Errorf("got %v, expected the software e-stop engaged", err)
+	}
+	if err := e.Release(); err != nil || e.Check() != nil || len(alarms.List()) != 0 {
+		t.Errorf("got %v, expected released", err)
+	}
+
+	faults.Set(time.Now(), &faultStatus{EmergencyStop: true})
+	if status := e.Status(); !status.Engaged || !status.Hardware || e.Check() == nil {
+		t.Errorf("got %+v, expected the hardware e-stop engaged", status)
+	}
+}
+
+func TestACUEmergencyStop(t *testing.T) {
+	sim, acu, _ := newTestSimulator(t, 100, 40)
+	if err := acu.ModeSet("Preset"); err != nil {
+		t.Fatal(err)
+	}
+	if err := acu.ThirdAxisPresetSet(30); !errors.Is(err, errUnconfirmed) {
+		t.Errorf("ThirdAxisPresetSet: got %v, expected %v", err, errUnconfirmed)
+	}
+	acu.unconfirmed = true
+	if err := acu.ThirdAxisPresetSet(30); err != nil {
+		t.Fatal(err)
+	}
+	acu.unconfirmed = false
+	if err := acu.EmergencyStop(); err != nil {
+		t.Fatal(err)
+	}
+	for i, a := range sim.axes {
+		if a.mode != simModeStop {
+			t.Errorf("axis %d: mode %d, expected stopped", i, a.mode)
+		}
+	}
+	// the real ACU is only sent the confirmed commands
+	if sim.rotator.mode != simModePreset {
+		t.Errorf("rotator: mode %d, expected unconfirmed commands not sent", sim.rotator.mode)
+	}
+
+	if err := NewTelescope(acu).Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if sim.rotator.mode != simModePreset {
+		t.Errorf("rotator: mode %d, expected the abort not to send unconfirmed commands", sim.rotator.mode)
+	}
+
+	acu.unconfirmed = true
+	if err := acu.EmergencyStop(); err != nil {
+		t.Fatal(err)
+	}
+	if sim.rotator.mode != simModeStop {
+		t.Errorf("rotator: mode %d, expected stopped", sim.rotator.mode)
+	}
+}
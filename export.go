@@ -0,0 +1,130 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// patterns longer than this aren't exported
+const maxExportPoints = 1000000
+
+// A TrajectoryPoint is a program track point, in sky and in raw (encoder)
+// coordinates, as it would be uploaded with the current pointing model.
+type TrajectoryPoint struct {
+	ScanPatternSample
+	RawAz    float64 `json:"raw_az"`
+	RawEl    float64 `json:"raw_el"`
+	RawAzVel float64 `json:"raw_vaz"`
+	RawElVel float64 `json:"raw_vel"`
+}
+
+// commandTrajectory checks cmd, and returns the points of its patterns,
+// in order, or an error if it has none.
+func commandTrajectory(cmd Command, pointing *Pointing) ([]TrajectoryPoint, error) {
+	err := cmd.Check()
+	if err != nil {
+		return nil, err
+	}
+	var points []TrajectoryPoint
+	err = appendTrajectory(&points, cmd, pointing)
+	if err != nil {
+		return nil, err
+	}
+	if len(points) == 0 {
+		return nil, fmt.Errorf("%s has no pattern", commandName(cmd))
+	}
+	return points, nil
+}
+
+func appendTrajectory(points *[]TrajectoryPoint, cmd Command, pointing *Pointing) error {
+	switch cmd := cmd.(type) {
+	case PatternCommand:
+		pattern, err := cmd.Pattern()
+		if err != nil {
+			return err
+		}
+		iter := pattern.Iterator()
+		for !pattern.Done(iter) {
+			if len(*points) >= maxExportPoints {
+				return fmt.Errorf("more than %d points", maxExportPoints)
+			}
+			var p TrajectoryPoint
+			err := pattern.Next(iter, &p.ScanPatternSample)
+			if err != nil {
+				return err
+			}
+			p.RawAz, p.RawEl, p.RawAzVel, p.RawElVel = pointing.Sky2Raw(p.Az, p.El, p.AzVel, p.ElVel)
+			*points = append(*points, p)
+		}
+	case focusSweepCmd:
+		return appendTrajectory(points, cmd.sequence(0), pointing)
+	case sequenceCmd:
+		for i, c := range cmd.Commands {
+			err := appendTrajectory(points, c, pointing)
+			if err != nil {
+				return fmt.Errorf("sequence command %d: %w", i, err)
+			}
+		}
+	}
+	return nil
+}
+
+var trajectoryCSVHeader = []string{"time", "az", "el", "vaz", "vel", "azFlag", "elFlag", "raw_az", "raw_el", "raw_vaz", "raw_vel"}
+
+// writeTrajectoryCSV writes points as CSV, with a header line.
+func writeTrajectoryCSV(w io.Writer, points []TrajectoryPoint) error {
+	cw := csv.NewWriter(w)
+	err := cw.Write(trajectoryCSVHeader)
+	if err != nil {
+		return err
+	}
+	f := func(x float64) string { return strconv.FormatFloat(x, 'f', -1, 64) }
+	for _, p := range points {
+		err = cw.Write([]string{
+			p.T.UTC().Format(time.RFC3339Nano),
+			f(p.Az), f(p.El), f(p.AzVel), f(p.ElVel),
+			strconv.Itoa(int(p.AzFlag)), strconv.Itoa(int(p.ElFlag)),
+			f(p.RawAz), f(p.RawEl), f(p.RawAzVel), f(p.RawElVel),
+		})
+		if err != nil {
+			return err
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+// trajectoryResponse sends cmd's trajectory in the format given by the
+// format query parameter, json (the default) or csv.
+func trajectoryResponse(w http.ResponseWriter, req *http.Request, cmd Command, pointing *Pointing) {
+	format := req.URL.Query().Get("format")
+	if format != "" && format != "json" && format != "csv" {
+		err := &FieldError{Field: "format", Reason: fmt.Sprintf("unknown format %s", format)}
+		commandResponse(w, "", err, http.StatusBadRequest)
+		return
+	}
+	points, err := commandTrajectory(cmd, pointing)
+	if err != nil {
+		commandResponse(w, "", err, http.StatusBadRequest)
+		return
+	}
+	if format == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="trajectory.csv"`)
+		err = writeTrajectoryCSV(w, points)
+	} else {
+		w.Header().Set("Content-Type", "application/json")
+		err = json.NewEncoder(w).Encode(&struct {
+			Points []TrajectoryPoint `json:"points"`
+		}{points})
+	}
+	if err != nil {
+		log.Print(err)
+	}
+}
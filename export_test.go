@@ -0,0 +1,53 @@
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"testing"
+)
+
+func TestCommandTrajectory(t *testing.T) {
+	disableSunAvoidance(t)
+	scan := elScanCmd{
+		ElevationRange: [2]float64{50, 60},
+		Azimuth:        120,
+		NumScans:       2,
+		StartTime:      10,
+		TurnaroundTime: 5,
+		Speed:          0.5,
+	}
+	seq := sequenceCmd{Commands: []Command{moveToCmd{Azimuth: 120, Elevation: 50}, scan, scan}}
+	pointing := NewPointing()
+
+	one, err := commandTrajectory(scan, pointing)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d, err := dryRunCommand(scan, nil, one[0].T)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(one) != d.Points || one[0].Az != 120 || one[0].RawAz != 120 || one[0].RawEl != one[0].El {
+		t.Errorf("got %d points from %+v, expected %d", len(one), one[0], d.Points)
+	}
+	both, err := commandTrajectory(seq, pointing)
+	if err != nil || len(both) != 2*len(one) {
+		t.Errorf("sequence: got %d points, %v", len(both), err)
+	}
+	if _, err := commandTrajectory(moveToCmd{Azimuth: 120, Elevation: 50}, pointing); err == nil {
+		t.Error("trajectory of a move")
+	}
+
+	var b bytes.Buffer
+	err = writeTrajectoryCSV(&b, one)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rows, err := csv.NewReader(&b).ReadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != len(one)+1 || len(rows[0]) != len(trajectoryCSVHeader) || rows[1][1] != "120" {
+		t.Errorf("got %d rows, starting %q", len(rows), rows[:2])
+	}
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+// A faultBit is a named condition in an axis' fault bits.
+type faultBit struct {
+	mask        uint32
+	name        string // for the alarm, after the axis
+	description string
+	severity    Severity
+	alarm       bool // false for status, e.g. the brakes
+}
+
+// axis fault bits (see capFaults)
+var axisFaultBits = []faultBit{
+	{1 << 0, "amplifier_fault", "amplifier fault", severityCritical, true},
+	{1 << 1, "amplifier_overcurrent", "amplifier overcurrent", severityCritical, true},
+	{1 << 2, "motor_overtemperature", "motor overtemperature", severityCritical, true},
+	{1 << 3, "encoder_fault", "encoder fault", severityCritical, true},
+	{1 << 4, "prelimit_positive", "positive prelimit switch", severityWarning, true},
+	{1 << 5, "prelimit_negative", "negative prelimit switch", severityWarning, true},
+	{1 << 6, "limit_positive", "positive final limit switch", severityCritical, true},
+	{1 << 7, "limit_negative", "negative final limit switch", severityCritical, true},
+	{1 << 8, "overspeed", "overspeed", severityCritical, true},
+	{1 << 9, "following_error", "following error", severityCritical, true},
+	{1 << 10, "brake_fault", "brake fault", severityCritical, true},
+	{1 << 11, "servo_interlock", "servo interlock open", severityCritical, true},
+	{1 << 12, "safety_interlock", "safety interlock open", severityCritical, true},
+	{1 << 13, "brakes_engaged", "brakes engaged", severityInfo, false},
+}
+
+// AxisFaults are an axis' fault bits, decoded.
+type AxisFaults struct {
+	Bits       uint32   `json:"bits"`
+	Conditions []string `json:"conditions,omitempty"` // descriptions of the bits set
+	Unknown    uint32   `json:"unknown,omitempty"`    // bits set not in the table
+}
+
+func decodeAxisFaults(bits uint32) AxisFaults {
+	f := AxisFaults{Bits: bits, Unknown: bits}
+	for _, b := range axisFaultBits {
+		if bits&b.mask != 0 {
+			f.Conditions = append(f.Conditions, b.description)
+			f.Unknown &^= b.mask
+		}
+	}
+	return f
+}
+
+// FaultsStatus is the ACU fault status, decoded.
+type FaultsStatus struct {
+	Time                      *time.Time `json:",omitempty"` // when read, nil if not yet
+	Azimuth                   AxisFaults
+	Elevation                 AxisFaults
+	AzimuthDriveTemperature   float64 // hottest drive [C]
+	ElevationDriveTemperature float64
+	EmergencyStop             bool
+}
+
+// Faults holds the fault status last read, for the status output. It is
+// safe for concurrent use.
+type Faults struct {
+	mu     sync.Mutex
+	status FaultsStatus
+}
+
+func (f *Faults) Set(t time.Time, faults *faultStatus) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.status = FaultsStatus{
+		Time:                      &t,
+		Azimuth:                   decodeAxisFaults(faults.AzimuthFaults),
+		Elevation:                 decodeAxisFaults(faults.ElevationFaults),
+		AzimuthDriveTemperature:   faults.AzimuthDriveTemperature,
+		ElevationDriveTemperature: faults.ElevationDriveTemperature,
+		EmergencyStop:             faults.EmergencyStop,
+	}
+}
+
+func (f *Faults) Status() FaultsStatus {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.status
+}
+
+// checkAxisFaultAlarms raises an alarm for each condition set in an axis'
+// fault bits, and one for any unknown bits. Critical faults latch.
+func checkAxisFaultAlarms(alarms *Alarms, axis string, bits uint32) {
+	for _, b := range axisFaultBits {
+		if b.alarm {
+			alarms.Set(bits&b.mask != 0, axis+"_"+b.name, b.severity, b.severity == severityCritical,
+				"%s %s", axis, b.description)
+		}
+	}
+	unknown := decodeAxisFaults(bits).Unknown
+	alarms.Set(unknown != 0, axis+"_fault", severityCritical, true,
+		"%s axis fault bits 0x%08x", axis, unknown)
+}
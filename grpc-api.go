@@ -0,0 +1,11 @@
+package main
+
+import "io"
+
+// grpcAPI is what the gRPC server needs from main, see grpc.go.
+type grpcAPI struct {
+	submit func(p *Principal, endpoint string, body io.Reader) (string, int, error)
+	abort  func() bool
+	auth   *Auth // nil without authentication
+	status *StatusStream
+}
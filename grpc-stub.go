@@ -0,0 +1,10 @@
+//go:build !grpc
+// +build !grpc
+
+package main
+
+import "fmt"
+
+func serveGRPC(addr string, api grpcAPI) error {
+	return fmt.Errorf("gRPC not supported: rebuild with -tags grpc")
+}
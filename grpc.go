@@ -0,0 +1,179 @@
+//go:build grpc
+// +build grpc
+
+package main
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative tcspb/tcs.proto
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/ccatobs/telescope-control-system/tcspb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+type grpcServer struct {
+	tcspb.UnimplementedTelescopeControlServer
+	api grpcAPI
+}
+
+func serveGRPC(addr string, api grpcAPI) error {
+	lis, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+	s := grpc.NewServer()
+	tcspb.RegisterTelescopeControlServer(s, &grpcServer{api: api})
+	log.Printf("gRPC listening on %s", addr)
+	return s.Serve(lis)
+}
+
+// authorize authenticates the caller by its "authorization: Bearer <token>"
+// metadata, as for the HTTP API, and checks it may access endpoint.
+func (s *grpcServer) authorize(ctx context.Context, method, endpoint string) (*Principal, error) {
+	if s.api.auth == nil {
+		return nil, nil
+	}
+	var token string
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if v := md.Get("authorization"); len(v) > 0 {
+			token = strings.TrimPrefix(v[0], "Bearer ")
+		}
+	}
+	p, err := s.api.auth.Authenticate(token)
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	err = s.api.auth.Authorize(p, method, endpoint)
+	if err != nil {
+		return nil, status.Error(codes.PermissionDenied, err.Error())
+	}
+	return p, nil
+}
+
+func (s *grpcServer) SubmitCommand(ctx context.Context, req *tcspb.CommandRequest) (*tcspb.CommandReply, error) {
+	p, err := s.authorize(ctx, "POST", req.Command)
+	if err != nil {
+		return nil, err
+	}
+	id, code, err := s.api.submit(p, req.Command, strings.NewReader(req.ArgsJson))
+	if err != nil {
+		return nil, grpcCommandError(code, err)
+	}
+	return &tcspb.CommandReply{Id: id}, nil
+}
+
+// grpcCommandError converts a command error to a gRPC status.
+func grpcCommandError(httpCode int, err error) error {
+	code := codes.Internal
+	switch httpCode {
+	case http.StatusBadRequest:
+		code = codes.InvalidArgument
+	case http.StatusNotFound:
+		code = codes.NotFound
+	case http.StatusServiceUnavailable:
+		code = codes.Unavailable
+	case http.StatusLocked:
+		code = codes.FailedPrecondition
+	}
+	st := status.New(code, err.Error())
+	var fe *FieldError
+	if errors.As(err, &fe) {
+		detailed, derr := st.WithDetails(&tcspb.FieldError{
+			Field:  fe.Field,
+			Reason: fe.Reason,
+			Limits: fe.Limits,
+		})
+		if derr == nil {
+			st = detailed
+		}
+	}
+	return st.Err()
+}
+
+func (s *grpcServer) AbortCommand(ctx context.Context, req *tcspb.AbortRequest) (*tcspb.AbortReply, error) {
+	if _, err := s.authorize(ctx, "POST", "/abort"); err != nil {
+		return nil, err
+	}
+	if !s.api.abort() {
+		return nil, status.Error(codes.FailedPrecondition, "nothing to abort")
+	}
+	return &tcspb.AbortReply{}, nil
+}
+
+func (s *grpcServer) StreamStatus(req *tcspb.StatusRequest, stream tcspb.TelescopeControl_StreamStatusServer) error {
+	if _, err := s.authorize(stream.Context(), "GET", "/acu/status/stream"); err != nil {
+		return err
+	}
+	rate := req.Rate
+	if rate == 0 {
+		rate = 10
+	}
+	sub, err := s.api.status.Subscribe(rate)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, err.Error())
+	}
+	defer s.api.status.Unsubscribe(sub)
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case sample := <-sub.c:
+			rec := sample.rec
+			st := &tcspb.Status{
+				Time:                       rec.Time,
+				Year:                       int32(rec.Year),
+				AzimuthMode:                fmt.Sprint(rec.AzimuthMode),
+				AzimuthCommandedPosition:   rec.AzimuthCommandedPosition,
+				AzimuthCurrentPosition:     rec.AzimuthCurrentPosition,
+				AzimuthCurrentVelocity:     rec.AzimuthCurrentVelocity,
+				ElevationMode:              fmt.Sprint(rec.ElevationMode),
+				ElevationCommandedPosition: rec.ElevationCommandedPosition,
+				ElevationCurrentPosition:   rec.ElevationCurrentPosition,
+				ElevationCurrentVelocity:   rec.ElevationCurrentVelocity,
+				FreeProgramTrackStack:      int32(rec.QtyOfFreeProgramTrackStackPositions),
+				Remote:                     rec.Remote,
+			}
+			if c := sample.command; c != nil {
+				st.CommandId = c.ID
+				st.CommandState = c.State
+			}
+			err := stream.Send(st)
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (s *grpcServer) GetLimits(ctx context.Context, req *tcspb.LimitsRequest) (*tcspb.Limits, error) {
+	if _, err := s.authorize(ctx, "GET", "/limits"); err != nil {
+		return nil, err
+	}
+	return &tcspb.Limits{
+		Azimuth: &tcspb.AxisLimits{
+			Position: &tcspb.Range{Min: azimuthMin, Max: azimuthMax},
+			Speed:    azimuthSpeedMax,
+			Accel:    azimuthAccelMax,
+			Jerk:     azimuthJerkMax,
+		},
+		Elevation: &tcspb.AxisLimits{
+			Position: &tcspb.Range{Min: elevationMin, Max: elevationMax},
+			Speed:    elevationSpeedMax,
+			Accel:    elevationAccelMax,
+			Jerk:     elevationJerkMax,
+		},
+		Rotator:      &tcspb.Range{Min: rotatorMin, Max: rotatorMax},
+		RotatorSpeed: rotatorSpeedMax,
+	}, nil
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// the status stream is stale after this long without a sample
+const healthStatusMaxAge = 5 * time.Second
+
+// A HealthCheck is the outcome of one readiness check.
+type HealthCheck struct {
+	Name  string `json:"name"`
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+// A HealthReport is the outcome of all the readiness checks.
+type HealthReport struct {
+	Status string        `json:"status"` // "ok" or "unavailable"
+	Checks []HealthCheck `json:"checks"`
+}
+
+// Health checks the TCS is ready to command the telescope: the ACU link is
+// up, the status stream is fresh, the clocks agree, and the config file,
+// if any, still loads.
+type Health struct {
+	acu        *ACU
+	stream     *StatusStream
+	timeSync   *TimeSync
+	configFile string
+	baseConfig Config
+}
+
+func NewHealth(acu *ACU, stream *StatusStream, timeSync *TimeSync, configFile string, baseConfig Config) *Health {
+	return &Health{
+		acu:        acu,
+		stream:     stream,
+		timeSync:   timeSync,
+		configFile: configFile,
+		baseConfig: baseConfig,
+	}
+}
+
+// Check runs the readiness checks at now.
+func (h *Health) Check(now time.Time) HealthReport {
+	var r HealthReport
+	check := func(name string, err error) {
+		c := HealthCheck{Name: name, OK: err == nil}
+		if err != nil {
+			c.Error = err.Error()
+		}
+		r.Checks = append(r.Checks, c)
+	}
+
+	var err error
+	if link := h.acu.link.Status(now); link.State == linkDown {
+		err = fmt.Errorf("%s", link)
+	}
+	check("acu", err)
+
+	err = nil
+	if last := h.stream.LastSample(); last.IsZero() {
+		err = fmt.Errorf("no status yet")
+	} else if age := now.Sub(last); age > healthStatusMaxAge {
+		err = fmt.Errorf("last status %.1f seconds ago", age.Seconds())
+	}
+	check("status", err)
+
+	check("time_sync", h.timeSync.Check(now))
+
+	err = currentConfig().Validate()
+	if err == nil && h.configFile != "" {
+		// what a reload or restart would use
+		_, err = LoadConfig(h.configFile, h.baseConfig)
+	}
+	check("config", err)
+
+	r.Status = "ok"
+	for _, c := range r.Checks {
+		if !c.OK {
+			r.Status = "unavailable"
+		}
+	}
+	return r
+}
+
+// serveHealth serves the health report: for liveness, always with status
+// 200, since restarting the TCS doesn't fix the ACU or the clocks, and
+// for readiness, with 503 if any check failed.
+func serveHealth(h *Health, readiness bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		r := h.Check(time.Now())
+		w.Header().Set("Content-Type", "application/json")
+		if readiness && r.Status != "ok" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+		err := json.NewEncoder(w).Encode(&r)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
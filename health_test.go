@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestHealth(t *testing.T) {
+	_, acu, _ := newTestSimulator(t, 120, 45)
+	alarms := NewAlarms()
+	stream := NewStatusStream(acu, nil, alarms, nil, nil, nil, nil, nil, nil, NewPointing())
+	filename := filepath.Join(t.TempDir(), "config.json")
+	err := os.WriteFile(filename, []byte(`{"time_skew_max": 0.1}`), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h := NewHealth(acu, stream, NewTimeSync(acu, "", alarms), filename, defaultConfig())
+
+	failed := func(r HealthReport) (names []string) {
+		for _, c := range r.Checks {
+			if !c.OK {
+				names = append(names, c.Name)
+			}
+		}
+		return names
+	}
+	now := time.Now()
+	if r := h.Check(now); r.Status != "unavailable" || len(failed(r)) != 1 || failed(r)[0] != "status" {
+		t.Errorf("no status: got %+v", r)
+	}
+	stream.last = now.Add(-time.Second)
+	if r := h.Check(now); r.Status != "ok" || len(r.Checks) != 4 {
+		t.Errorf("got %+v", r)
+	}
+	os.WriteFile(filename, []byte(`{"bogus": 1}`), 0600)
+	if r := h.Check(now); len(failed(r)) != 1 || failed(r)[0] != "config" {
+		t.Errorf("bad config: got %+v", r)
+	}
+
+	// only readiness fails
+	for _, readiness := range []bool{false, true} {
+		w := httptest.NewRecorder()
+		serveHealth(h, readiness)(w, httptest.NewRequest("GET", "/readyz", nil))
+		var r HealthReport
+		err := json.Unmarshal(w.Body.Bytes(), &r)
+		expected := http.StatusOK
+		if readiness {
+			expected = http.StatusServiceUnavailable
+		}
+		if w.Code != expected || err != nil || r.Status != "unavailable" {
+			t.Errorf("readiness %v: got %d %s", readiness, w.Code, w.Body)
+		}
+	}
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// The subreflector hexapod has its own controller. The TCS polls its
+// position for the telemetry, and moves it for focus offsets along the
+// optical (z) axis from the nominal position (see HexapodConfig), alone
+// or stepped between repeats of a scan (see focusSweepCmd).
+
+const (
+	hexapodPollInterval = 1 * time.Second
+	hexapodStaleAge     = 10 * time.Second
+	hexapodMoveTimeout  = 2 * time.Minute
+	hexapodTolerance    = 1e-3 // [mm] or [deg]
+)
+
+// HexapodConfig is the nominal position of the hexapod, and the range
+// of the focus offsets from it.
+type HexapodConfig struct {
+	Nominal  [6]float64 `json:"nominal"`   // x, y, z [mm], rx, ry, rz [deg]
+	FocusMax float64    `json:"focus_max"` // largest focus offset [mm]
+}
+
+// hexapod states, as reported by the controller
+const (
+	hexapodReady   = "ready"
+	hexapodMoving  = "moving"
+	hexapodFault   = "fault"
+	hexapodUnknown = "unknown" // not read, or stale
+)
+
+// HexapodStatus is the state and position of the hexapod, and the focus
+// offset of that position from nominal.
+type HexapodStatus struct {
+	State    string     `json:"state"`
+	Position [6]float64 `json:"position"`       // x, y, z [mm], rx, ry, rz [deg]
+	Focus    float64    `json:"focus"`          // [mm]
+	Time     time.Time  `json:"time,omitempty"` // when reported
+	Error    string     `json:"error,omitempty"`
+}
+
+// A Hexapod polls the hexapod controller over HTTP. GETs of the URL
+// should return a JSON object like {"state": "ready", "position": [x,
+// y, z, rx, ry, rz]}, and POSTs of {"position": [...]} move it.
+// XXX:TBD interface to be agreed with the subreflector controller
+// It is safe for concurrent use.
+type Hexapod struct {
+	url    string
+	client *http.Client
+	alarms *Alarms
+
+	mu     sync.Mutex
+	status HexapodStatus
+	err    error
+}
+
+func NewHexapod(url string, alarms *Alarms) *Hexapod {
+	return &Hexapod{
+		url: url,
+		client: &http.Client{
+			Timeout: 2 * time.Second,
+		},
+		alarms: alarms,
+		status: HexapodStatus{State: hexapodUnknown},
+		err:    fmt.Errorf("no hexapod state yet"),
+	}
+}
+
+// Run polls the hexapod controller forever.
+func (h *Hexapod) Run() {
+	for {
+		err := h.poll()
+		status := h.Status()
+		h.alarms.Set(err != nil, "hexapod", severityWarning, false, "can't read hexapod state: %v", err)
+		h.alarms.Set(status.State == hexapodFault, "hexapod_fault", severityCritical, false, "hexapod fault")
+		time.Sleep(hexapodPollInterval)
+	}
+}
+
+func (h *Hexapod) poll() error {
+	var status HexapodStatus
+	resp, err := h.client.Get(h.url)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf(resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&status)
+		}
+	}
+	if err == nil {
+		switch status.State {
+		case hexapodReady, hexapodMoving, hexapodFault:
+		default:
+			err = fmt.Errorf("unknown hexapod state %q", status.State)
+		}
+	}
+	if err == nil && status.Time.IsZero() {
+		status.Time = time.Now()
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.err = err
+	if err != nil {
+		log.Printf("hexapod: %v", err)
+		return err
+	}
+	if h.status.State != status.State {
+		log.Printf("hexapod %s", status.State)
+	}
+	h.status.State, h.status.Position, h.status.Time = status.State, status.Position, status.Time
+	return nil
+}
+
+func (h *Hexapod) Status() HexapodStatus {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	status, err := h.status, h.err
+	if age := time.Since(status.Time); err == nil && age > hexapodStaleAge {
+		err = fmt.Errorf("hexapod state is stale (%.0f secs old)", age.Seconds())
+	}
+	if err != nil {
+		status.State, status.Error = hexapodUnknown, err.Error()
+	}
+	status.Focus = status.Position[2] - currentConfig().Hexapod.Nominal[2]
+	return status
+}
+
+// Move commands the hexapod to position, without waiting.
+func (h *Hexapod) Move(position [6]float64) error {
+	log.Printf("hexapod: moving to %v", position)
+	b, _ := json.Marshal(map[string][6]float64{"position": position})
+	resp, err := h.client.Post(h.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("hexapod move: %w", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("hexapod move: %s", resp.Status)
+	}
+	return nil
+}
+
+// checkFocus checks a focus offset is within the configured range.
+func checkFocus(field string, focus float64) error {
+	max := currentConfig().Hexapod.FocusMax
+	if !isFinite(focus) {
+		return finiteError(field, focus)
+	}
+	if math.Abs(focus) > max {
+		return rangeError(field, -max, max, "focus offset (%g mm) out of range [%g,%g]", focus, -max, max)
+	}
+	return nil
+}
+
+// startFocus moves the hexapod to the nominal position offset by focus,
+// returning an IsDoneFunc that is done when it's there and ready.
+func startFocus(tel *Telescope, focus float64) (IsDoneFunc, error) {
+	if tel.hexapod == nil {
+		return nil, fmt.Errorf("no hexapod controller configured")
+	}
+	position := currentConfig().Hexapod.Nominal
+	position[2] += focus
+	err := tel.hexapod.Move(position)
+	if err != nil {
+		return nil, err
+	}
+	t0 := time.Now()
+	isDone := func(tel *Telescope) (bool, error) {
+		status := tel.hexapod.Status()
+		if status.State == hexapodFault {
+			return true, fmt.Errorf("hexapod fault while moving")
+		}
+		done := status.State == hexapodReady && status.Time.After(t0)
+		for i := range position {
+			done = done && math.Abs(status.Position[i]-position[i]) < hexapodTolerance
+		}
+		if !done && time.Since(t0) > hexapodMoveTimeout {
+			return true, fmt.Errorf("hexapod move timed out")
+		}
+		return done, nil
+	}
+	return isDone, nil
+}
+
+// A focusCmd moves the subreflector to a focus offset from nominal.
+type focusCmd struct {
+	Focus float64 `json:"focus"` // [mm]
+}
+
+func (cmd focusCmd) Check() error {
+	return checkFocus("focus", cmd.Focus)
+}
+
+func (cmd focusCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startFocus(tel, cmd.Focus)
+}
+
+// A focusSweepCmd repeats a scan at each of a list of focus offsets,
+// moving the subreflector between them, then returns it to the focus
+// it started at. The scan's start time should be relative, since it's
+// resolved as each repeat starts.
+type focusSweepCmd struct {
+	Focus   []float64 `json:"focus"` // [mm]
+	Command PatternCommand
+}
+
+func (cmd *focusSweepCmd) UnmarshalJSON(b []byte) error {
+	var x struct {
+		Focus   []float64 `json:"focus"`
+		Command struct {
+			Command string          `json:"command"`
+			Args    json.RawMessage `json:"args"`
+		} `json:"command"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&x)
+	if err != nil {
+		return err
+	}
+	c, err := decodeCommand(x.Command.Command, bytes.NewReader(x.Command.Args))
+	if err != nil {
+		return fmt.Errorf("focus sweep command: %w", err)
+	}
+	pattern, ok := c.(PatternCommand)
+	if !ok {
+		return &FieldError{Field: "command", Reason: fmt.Sprintf("%s is not a scan", x.Command.Command)}
+	}
+	cmd.Focus, cmd.Command = x.Focus, pattern
+	return nil
+}
+
+func (cmd focusSweepCmd) Check() error {
+	if len(cmd.Focus) == 0 {
+		return &FieldError{Field: "focus", Reason: "required"}
+	}
+	for i, focus := range cmd.Focus {
+		err := checkFocus(fmt.Sprintf("focus[%d]", i), focus)
+		if err != nil {
+			return err
+		}
+	}
+	if cmd.Command == nil {
+		return &FieldError{Field: "command", Reason: "required"}
+	}
+	err := cmd.Command.Check()
+	if err != nil {
+		return fmt.Errorf("focus sweep command: %w", err)
+	}
+	return nil
+}
+
+// sequence returns the moves and scans of the sweep, ending at focus.
+func (cmd focusSweepCmd) sequence(focus float64) sequenceCmd {
+	var seq sequenceCmd
+	for _, f := range cmd.Focus {
+		seq.Commands = append(seq.Commands, focusCmd{f}, focusScanCmd{cmd.Command, f})
+	}
+	seq.Commands = append(seq.Commands, focusCmd{focus})
+	return seq
+}
+
+func (cmd focusSweepCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	if tel.hexapod == nil {
+		return nil, fmt.Errorf("no hexapod controller configured")
+	}
+	status := tel.hexapod.Status()
+	if status.Error != "" {
+		return nil, fmt.Errorf("hexapod state unknown: %s", status.Error)
+	}
+	return cmd.sequence(status.Focus).Start(ctx, tel)
+}
+
+// A focusScanCmd is a scan of a focus sweep, with its scan flags
+// tagged with the focus offset.
+type focusScanCmd struct {
+	PatternCommand
+	focus float64
+}
+
+func (cmd focusScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+func (cmd focusScanCmd) scanTags() map[string]string {
+	tags := map[string]string{}
+	if c, ok := cmd.PatternCommand.(taggedCommand); ok {
+		tags = c.scanTags()
+	}
+	tags["focus"] = strconv.FormatFloat(cmd.focus, 'g', -1, 64)
+	return tags
+}
+
+// serveHexapod serves the hexapod controller, or nil if there's none.
+func serveHexapod(hexapod *Hexapod) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if hexapod == nil {
+			err := fmt.Errorf("no hexapod controller configured")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			status := hexapod.Status()
+			err := json.NewEncoder(w).Encode(&status)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Position *[6]float64 `json:"position"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil && x.Position == nil {
+				err = &FieldError{Field: "position", Reason: "required"}
+			}
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			err = hexapod.Move(*x.Position)
+			jsonResponse(w, err, http.StatusInternalServerError)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	}
+}
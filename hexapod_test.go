@@ -0,0 +1,84 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHexapod(t *testing.T) {
+	reply := `{"state": "ready", "position": [0, 0, 1.5, 0, 0, 0]}`
+	var moves [][6]float64
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			var x struct{ Position [6]float64 }
+			json.NewDecoder(req.Body).Decode(&x)
+			moves = append(moves, x.Position)
+			return
+		}
+		w.Write([]byte(reply))
+	}))
+	defer srv.Close()
+	h := NewHexapod(srv.URL, NewAlarms())
+
+	if status := h.Status(); status.State != hexapodUnknown || status.Error == "" {
+		t.Errorf("got %+v before the state is read", status)
+	}
+	if err := h.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if status := h.Status(); status.State != hexapodReady || status.Focus != 1.5 {
+		t.Errorf("got %+v, expected ready at focus 1.5", status)
+	}
+
+	reply = `{"state": "parked"}`
+	if h.poll() == nil || h.Status().State != hexapodUnknown {
+		t.Errorf("got %+v, expected unknown", h.Status())
+	}
+
+	tel := &Telescope{hexapod: h}
+	if _, err := startFocus(tel, -2); err != nil || len(moves) != 1 || moves[0][2] != -2 {
+		t.Errorf("got %v %v, expected a move to z -2", err, moves)
+	}
+}
+
+func TestFocusSweepCmd(t *testing.T) {
+	disableSunAvoidance(t)
+	body := `{"focus": [-1, 0, 1], "command": {"command": "/azimuth-scan", "args": {"azimuth_range": [110, 130], "elevation": 60, "num_scans": 2, "start_time": 5, "turnaround_time": 5, "speed": 0.5}}}`
+	cmd, err := decodeCommand("/focus-sweep", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	sweep := cmd.(focusSweepCmd)
+	if err := sweep.Check(); err != nil {
+		t.Fatal(err)
+	}
+	seq := sweep.sequence(0.5)
+	// a move and a scan at each focus, then back to the start
+	if n := len(seq.Commands); n != 7 {
+		t.Fatalf("got %d commands, expected 7", n)
+	}
+	if c := seq.Commands[6]; c != (focusCmd{0.5}) {
+		t.Errorf("got %+v, expected a return to focus 0.5", c)
+	}
+	scan := seq.Commands[5].(focusScanCmd)
+	if tags := scan.scanTags(); tags["focus"] != "1" {
+		t.Errorf("got tags %v", tags)
+	}
+
+	for _, bad := range []string{
+		`{"focus": [], "command": {"command": "/azimuth-scan", "args": {}}}`,
+		`{"focus": [1], "command": {"command": "/stow", "args": {}}}`,
+		`{"focus": [100], "command": {"command": "/azimuth-scan", "args": {"azimuth_range": [110, 130], "elevation": 60, "num_scans": 2, "start_time": 5, "turnaround_time": 5, "speed": 0.5}}}`,
+	} {
+		cmd, err := decodeCommand("/focus-sweep", strings.NewReader(bad))
+		if err == nil {
+			err = cmd.Check()
+		}
+		if err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+}
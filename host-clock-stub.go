@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "fmt"
+
+func hostClock() (*HostClock, error) {
+	return nil, fmt.Errorf("host clock status not supported")
+}
@@ -0,0 +1,34 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// from <sys/timex.h>
+const (
+	adjtimexUnsync = 0x0040 // STA_UNSYNC
+	adjtimexNano   = 0x2000 // STA_NANO
+	adjtimexError  = 5      // TIME_ERROR
+)
+
+// hostClock reads the kernel's clock discipline, set by NTP or PTP.
+func hostClock() (*HostClock, error) {
+	var tx syscall.Timex
+	state, err := syscall.Adjtimex(&tx)
+	if err != nil {
+		return nil, err
+	}
+	offset := float64(tx.Offset) * 1e-6
+	if tx.Status&adjtimexNano != 0 {
+		offset = float64(tx.Offset) * 1e-9
+	}
+	return &HostClock{
+		Synchronized:   state != adjtimexError && tx.Status&adjtimexUnsync == 0,
+		Offset:         offset,
+		EstimatedError: float64(tx.Esterror) * 1e-6,
+		MaxError:       float64(tx.Maxerror) * 1e-6,
+	}, nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+const (
+	housekeepingMeasurement   = "acu_status"
+	housekeepingFlushInterval = 1 * time.Second
+	housekeepingQueueLen      = 30 // batches waiting to be written
+	housekeepingTimeout       = 5 * time.Second
+)
+
+// A Housekeeping writer batches the ACU status and writes it to a
+// time series database in the InfluxDB line protocol, which is also
+// accepted by e.g. VictoriaMetrics and QuestDB.
+type Housekeeping struct {
+	url    string // e.g. http://influx:8086/api/v2/write?org=fyst&bucket=tcs&precision=ns
+	token  string
+	rate   float64 // [Hz]
+	stream *StatusStream
+	client *http.Client
+	stop   chan chan struct{}
+}
+
+func NewHousekeeping(url, token string, rate float64, stream *StatusStream) *Housekeeping {
+	return &Housekeeping{
+		url:    url,
+		token:  token,
+		rate:   rate,
+		stream: stream,
+		client: &http.Client{Timeout: housekeepingTimeout},
+		stop:   make(chan chan struct{}),
+	}
+}
+
+func (hk *Housekeeping) Run() error {
+	sub, err := hk.stream.Subscribe(hk.rate)
+	if err != nil {
+		return err
+	}
+	defer hk.stream.Unsubscribe(sub)
+
+	// write in the background, so slow writes don't drop samples
+	batches := make(chan []byte, housekeepingQueueLen)
+	written := make(chan struct{})
+	go func() {
+		defer close(written)
+		for b := range batches {
+			err := hk.write(b)
+			if err != nil {
+				log.Print("housekeeping: ", err)
+			}
+		}
+	}()
+
+	var batch bytes.Buffer
+	flush := func() {
+		if batch.Len() == 0 {
+			return
+		}
+		select {
+		case batches <- append([]byte(nil), batch.Bytes()...):
+		default:
+			log.Print("housekeeping: queue full, dropping batch")
+		}
+		batch.Reset()
+	}
+	ticker := time.NewTicker(housekeepingFlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case sample := <-sub.c:
+			appendStatusLine(&batch, &sample.rec, sample.command, time.Now())
+			if sample.hexapod != nil {
+				appendHexapodLine(&batch, sample.hexapod)
+			}
+		case <-ticker.C:
+			flush()
+		case c := <-hk.stop:
+			flush()
+			close(batches)
+			select {
+			case <-written:
+			case <-time.After(housekeepingTimeout):
+				log.Printf("housekeeping: dropping %d unwritten batches", len(batches))
+			}
+			close(c)
+			return nil
+		}
+	}
+}
+
+// Close writes the batched status, stopping Run.
+func (hk *Housekeeping) Close() {
+	c := make(chan struct{})
+	hk.stop <- c
+	<-c
+}
+
+func (hk *Housekeeping) write(b []byte) error {
+	req, err := http.NewRequest("POST", hk.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "text/plain; charset=utf-8")
+	if hk.token != "" {
+		req.Header.Set("Authorization", "Token "+hk.token)
+	}
+	resp, err := hk.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", hk.url, resp.Status)
+	}
+	return nil
+}
+
+var lineTagEscaper = strings.NewReplacer(",", `\,`, "=", `\=`, " ", `\ `)
+
+// appendStatusLine appends rec as a line protocol point, tagged with the
+// axis modes and the current command, timestamped by the ACU if its
+// clock is set, else now.
+func appendStatusLine(b *bytes.Buffer, rec *datasets.StatusGeneral8100, cmd *CommandRecord, now time.Time) {
+	b.WriteString(housekeepingMeasurement)
+	b.WriteString(",source=acu")
+	fmt.Fprintf(b, ",azimuth_mode=%s", lineTagEscaper.Replace(fmt.Sprint(rec.AzimuthMode)))
+	fmt.Fprintf(b, ",elevation_mode=%s", lineTagEscaper.Replace(fmt.Sprint(rec.ElevationMode)))
+	if cmd != nil {
+		fmt.Fprintf(b, ",command_id=%s,command=%s", cmd.ID, lineTagEscaper.Replace(cmd.Command))
+	}
+
+	sep := byte(' ')
+	v := reflect.ValueOf(rec).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		var s string
+		f := v.Field(i)
+		switch f.Kind() {
+		case reflect.Bool:
+			s = strconv.FormatBool(f.Bool())
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			s = strconv.FormatInt(f.Int(), 10) + "i"
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			s = strconv.FormatUint(f.Uint(), 10) + "i"
+		case reflect.Float32, reflect.Float64:
+			x := f.Float()
+			if math.IsNaN(x) || math.IsInf(x, 0) {
+				continue // not representable
+			}
+			s = strconv.FormatFloat(x, 'g', -1, 64)
+		default:
+			continue
+		}
+		b.WriteByte(sep)
+		b.WriteString(v.Type().Field(i).Name)
+		b.WriteByte('=')
+		b.WriteString(s)
+		sep = ','
+	}
+
+	t := now
+	if rec.Year >= minStatusTimeYear {
+		t = StatusTime2Time(rec.Year, rec.Time)
+	}
+	fmt.Fprintf(b, " %d\n", t.UnixNano())
+}
+
+// the hexapod position fields, in order
+var hexapodLineFields = []string{"x", "y", "z", "rx", "ry", "rz"}
+
+// appendHexapodLine appends the hexapod position and focus offset as a
+// line protocol point, tagged with its state, timestamped when reported.
+// Unknown states are skipped.
+func appendHexapodLine(b *bytes.Buffer, status *HexapodStatus) {
+	if status.State == hexapodUnknown {
+		return
+	}
+	fmt.Fprintf(b, "%s,source=hexapod,state=%s", housekeepingMeasurement, lineTagEscaper.Replace(status.State))
+	sep := byte(' ')
+	for i, name := range hexapodLineFields {
+		b.WriteByte(sep)
+		fmt.Fprintf(b, "%s=%s", name, strconv.FormatFloat(status.Position[i], 'g', -1, 64))
+		sep = ','
+	}
+	fmt.Fprintf(b, ",focus=%s %d\n", strconv.FormatFloat(status.Focus, 'g', -1, 64), status.Time.UnixNano())
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+func TestAppendStatusLine(t *testing.T) {
+	rec := datasets.StatusGeneral8100{
+		Year:                     2025,
+		Time:                     2.5, // Jan 2 noon
+		AzimuthCurrentPosition:   120.25,
+		AzimuthCommandedPosition: math.NaN(),
+		Remote:                   true,
+	}
+	cmd := &CommandRecord{ID: "abc", Command: "/track"}
+	var b bytes.Buffer
+	appendStatusLine(&b, &rec, cmd, time.Now())
+	line := b.String()
+
+	prefix := "acu_status,source=acu,azimuth_mode="
+	if !bytes.HasPrefix(b.Bytes(), []byte(prefix)) {
+		t.Errorf("appendStatusLine: got %q, expected prefix %q", line, prefix)
+	}
+	for _, s := range []string{",command_id=abc,command=/track ", "AzimuthCurrentPosition=120.25", ",Remote=true", ",Year=2025i"} {
+		if !bytes.Contains(b.Bytes(), []byte(s)) {
+			t.Errorf("appendStatusLine: missing %q in %q", s, line)
+		}
+	}
+	if bytes.Contains(b.Bytes(), []byte("AzimuthCommandedPosition")) {
+		t.Errorf("appendStatusLine: NaN field in %q", line)
+	}
+	ts := time.Date(2025, 1, 2, 12, 0, 0, 0, time.UTC).UnixNano()
+	if !bytes.HasSuffix(b.Bytes(), []byte(fmt.Sprintf(" %d\n", ts))) {
+		t.Errorf("appendStatusLine: expected timestamp %d in %q", ts, line)
+	}
+}
+
+func TestAppendHexapodLine(t *testing.T) {
+	status := HexapodStatus{
+		State:    hexapodReady,
+		Position: [6]float64{0, 0.5, -1.25, 0, 0, 0.01},
+		Focus:    -1.25,
+		Time:     time.Unix(1700000000, 0),
+	}
+	var b bytes.Buffer
+	appendHexapodLine(&b, &status)
+	expected := "acu_status,source=hexapod,state=ready x=0,y=0.5,z=-1.25,rx=0,ry=0,rz=0.01,focus=-1.25 1700000000000000000\n"
+	if b.String() != expected {
+		t.Errorf("appendHexapodLine: got %q, expected %q", b.String(), expected)
+	}
+	b.Reset()
+	status.State = hexapodUnknown
+	if appendHexapodLine(&b, &status); b.Len() != 0 {
+		t.Errorf("appendHexapodLine: got %q for an unknown state", b.String())
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+)
+
+// kinematicsTol absorbs rounding in the finite differences.
+const kinematicsTol = 1e-6
+
+// maxPatternDuration bounds the patterns validated, so that a long track
+// can't tie up the API walking its points.
+const maxPatternDuration = 24 * time.Hour
+
+type axisKinematicLimits struct {
+	name     string
+	speedMax float64
+	accelMax float64
+	jerkMax  float64
+}
+
+// An AzimuthLimitPoint is a row of the azimuth limit profile: the azimuth
+// speed and acceleration limits at an elevation. Between rows the limits
+// are interpolated linearly, and beyond the ends they're held constant.
+// The profile can only lower the azimuth axis limits.
+type AzimuthLimitPoint struct {
+	Elevation float64 `json:"elevation"` // [deg]
+	SpeedMax  float64 `json:"speed_max"` // [deg/s]
+	AccelMax  float64 `json:"accel_max"` // [deg/s^2]
+}
+
+// the azimuth limit profile, set at startup from the config, see applyConfig
+var azimuthProfile []AzimuthLimitPoint
+
+// checkAzimuthProfile checks the profile's rows are in increasing
+// elevation, and within the azimuth axis limits.
+func checkAzimuthProfile(profile []AzimuthLimitPoint, limits AxisLimits) error {
+	for i, p := range profile {
+		switch {
+		case !isFinite(p.Elevation) || !isFinite(p.SpeedMax) || !isFinite(p.AccelMax):
+			return fmt.Errorf("azimuth_profile %d: not finite", i)
+		case i > 0 && p.Elevation <= profile[i-1].Elevation:
+			return fmt.Errorf("azimuth_profile %d: elevation (%g) not increasing", i, p.Elevation)
+		case p.SpeedMax <= 0 || p.SpeedMax > limits.SpeedMax:
+			return fmt.Errorf("azimuth_profile %d: speed_max (%g) out of range (0,%g]", i, p.SpeedMax, limits.SpeedMax)
+		case p.AccelMax <= 0 || p.AccelMax > limits.AccelMax:
+			return fmt.Errorf("azimuth_profile %d: accel_max (%g) out of range (0,%g]", i, p.AccelMax, limits.AccelMax)
+		}
+	}
+	return nil
+}
+
+// azimuthLimitsAt returns the azimuth speed and acceleration limits at
+// elevation el, from the profile if any.
+func azimuthLimitsAt(el float64) (float64, float64) {
+	p := azimuthProfile
+	switch {
+	case len(p) == 0:
+		return azimuthSpeedMax, azimuthAccelMax
+	case el <= p[0].Elevation:
+		return p[0].SpeedMax, p[0].AccelMax
+	case el >= p[len(p)-1].Elevation:
+		return p[len(p)-1].SpeedMax, p[len(p)-1].AccelMax
+	}
+	i := sort.Search(len(p), func(i int) bool { return p[i].Elevation > el })
+	a, b := p[i-1], p[i]
+	f := (el - a.Elevation) / (b.Elevation - a.Elevation)
+	return a.SpeedMax + f*(b.SpeedMax-a.SpeedMax), a.AccelMax + f*(b.AccelMax-a.AccelMax)
+}
+
+// azimuthLimitsOver returns the lowest azimuth speed and acceleration
+// limits over the elevations between el0 and el1.
+func azimuthLimitsOver(el0, el1 float64) (float64, float64) {
+	if el0 > el1 {
+		el0, el1 = el1, el0
+	}
+	speed, accel := azimuthLimitsAt(el0)
+	els := []float64{el1}
+	for _, p := range azimuthProfile {
+		if p.Elevation > el0 && p.Elevation < el1 {
+			els = append(els, p.Elevation)
+		}
+	}
+	for _, el := range els {
+		s, a := azimuthLimitsAt(el)
+		speed, accel = math.Min(speed, s), math.Min(accel, a)
+	}
+	return speed, accel
+}
+
+// currentKinematicLimits returns the axis limits at elevation el, with
+// the speed and acceleration derated for the drive temperatures.
+func currentKinematicLimits(el float64) [2]axisKinematicLimits {
+	return kinematicLimitsAt(siteDerating.Factors(), el)
+}
+
+// kinematicLimitsAt returns the axis limits at elevation el, derated
+// by the factors f.
+func kinematicLimitsAt(f [2]float64, el float64) [2]axisKinematicLimits {
+	speed, accel := azimuthLimitsAt(el)
+	return [2]axisKinematicLimits{
+		{"azimuth", f[0] * speed, f[0] * accel, azimuthJerkMax},
+		{"elevation", f[1] * elevationSpeedMax, f[1] * elevationAccelMax, elevationJerkMax},
+	}
+}
+
+// ValidateScanPattern walks every point of a pattern, checking its position
+// and commanded velocity against the axis limits, and the velocity,
+// acceleration, and jerk implied by consecutive points against the
+// per-axis kinematic limits at the points' elevation, as derated for
+// temperature.
+//
+// The implied rates are finite differences, so they are lower bounds
+// on what the ACU will see when interpolating between points.
+func ValidateScanPattern(pattern ScanPattern) error {
+	var prev ScanPatternSample
+	var v, a [2]float64  // previous implied velocity & acceleration
+	var tv, ta time.Time // ...and their (midpoint) times
+	var t0 time.Time     // of the first point
+
+	derating := siteDerating.Factors()
+	iter := pattern.Iterator()
+	for i := 0; !pattern.Done(iter); i++ {
+		var x ScanPatternSample
+		err := pattern.Next(iter, &x)
+		if err != nil {
+			return fmt.Errorf("point %d: %w", i, err)
+		}
+		err = checkSample(&x)
+		if err == nil {
+			err = checkAzEl(x.Az, x.El, x.AzVel, x.ElVel)
+		}
+		if err != nil {
+			return fmt.Errorf("point %d: %w", i, err)
+		}
+		if i == 0 {
+			t0, prev = x.T, x
+			continue
+		}
+		if x.T.Sub(t0) > maxPatternDuration {
+			return fmt.Errorf("point %d: pattern longer than %v", i, maxPatternDuration)
+		}
+
+		dt := x.T.Sub(prev.T)
+		if dt <= 0 {
+			return fmt.Errorf("point %d: time not increasing", i)
+		}
+		tv1 := prev.T.Add(dt / 2)
+		ta1 := tv.Add(tv1.Sub(tv) / 2)
+		pos := [2][2]float64{{prev.Az, x.Az}, {prev.El, x.El}}
+		var v1, a1 [2]float64
+		for k, lim := range kinematicLimitsAt(derating, math.Min(prev.El, x.El)) {
+			v1[k] = (pos[k][1] - pos[k][0]) / dt.Seconds()
+			if math.Abs(v1[k]) > lim.speedMax+kinematicsTol {
+				return fmt.Errorf("point %d: implied %s speed (%g) exceeds limit (%g)", i, lim.name, v1[k], lim.speedMax)
+			}
+			if i < 2 {
+				continue
+			}
+			a1[k] = (v1[k] - v[k]) / tv1.Sub(tv).Seconds()
+			if math.Abs(a1[k]) > lim.accelMax+kinematicsTol {
+				return fmt.Errorf("point %d: implied %s acceleration (%g) exceeds limit (%g)", i, lim.name, a1[k], lim.accelMax)
+			}
+			if i < 3 {
+				continue
+			}
+			j := (a1[k] - a[k]) / ta1.Sub(ta).Seconds()
+			if math.Abs(j) > lim.jerkMax+kinematicsTol {
+				return fmt.Errorf("point %d: implied %s jerk (%g) exceeds limit (%g)", i, lim.name, j, lim.jerkMax)
+			}
+		}
+		prev, v, a, tv, ta = x, v1, a1, tv1, ta1
+	}
+	return nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestValidateScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	good := NewAzimuthScanPattern(t0, 3, 60, [2]float64{110, 130}, 0.8, 5*time.Second)
+	if err := ValidateScanPattern(good); err != nil {
+		t.Errorf("good pattern failed validation: %v", err)
+	}
+
+	tests := []struct {
+		name   string
+		points [][5]float64
+		reason string
+	}{
+		{"speed", [][5]float64{{0, 100, 45, 0, 0}, {1, 110, 45, 0, 0}}, "azimuth speed"},
+		{"acceleration", [][5]float64{{0, 100, 45, 0, 0}, {0.5, 100, 45, 0, 0}, {1, 100, 45.7, 0, 0}}, "elevation acceleration"},
+		{"time", [][5]float64{{0, 100, 45, 0, 0}, {0, 100, 45, 0, 0}}, "time not increasing"},
+		{"position", [][5]float64{{0, 100, 45, 0, 0}, {1, 100, 190, 0, 0}}, "out of range"},
+		{"NaN", [][5]float64{{0, 100, 45, 0, 0}, {1, 100, math.NaN(), 0, 0}}, "elevation (NaN) not finite"},
+		{"Inf", [][5]float64{{0, 100, 45, math.Inf(1), 0}}, "azimuth_velocity (+Inf) not finite"},
+		{"Inf time", [][5]float64{{0, 100, 45, 0, 0}, {math.Inf(1), 100, 45, 0, 0}}, "time"},
+	}
+	for _, test := range tests {
+		pattern := NewPathScanPattern(t0, test.points, "Horizon", false)
+		err := ValidateScanPattern(pattern)
+		if err == nil || !strings.Contains(err.Error(), test.reason) {
+			t.Errorf("%s: got %v, expected %q", test.name, err, test.reason)
+		}
+	}
+}
+
+func TestAzimuthProfile(t *testing.T) {
+	defer func(p []AzimuthLimitPoint) { azimuthProfile = p }(azimuthProfile)
+	azimuthProfile = []AzimuthLimitPoint{{20, 1, 2}, {60, 3, 6}}
+
+	for _, tc := range []struct{ el, speed, accel float64 }{
+		{10, 1, 2},
+		{40, 2, 4},
+		{70, 3, 6},
+	} {
+		if speed, accel := azimuthLimitsAt(tc.el); math.Abs(speed-tc.speed) > 1e-12 || math.Abs(accel-tc.accel) > 1e-12 {
+			t.Errorf("el %g: got %g, %g, expected %g, %g", tc.el, speed, accel, tc.speed, tc.accel)
+		}
+	}
+	if speed, _ := azimuthLimitsOver(50, 30); math.Abs(speed-1.5) > 1e-12 {
+		t.Errorf("got speed %g over [30,50], expected 1.5", speed)
+	}
+
+	// 2 deg/s is fine at 60 deg, but not at 30
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	if err := ValidateScanPattern(NewAzimuthScanPattern(t0, 1, 60, [2]float64{110, 130}, 2, 0)); err != nil {
+		t.Errorf("got %v at 60 deg", err)
+	}
+	err := ValidateScanPattern(NewAzimuthScanPattern(t0, 1, 30, [2]float64{110, 130}, 2, 0))
+	if err == nil || !strings.Contains(err.Error(), "azimuth") {
+		t.Errorf("got %v at 30 deg, expected an azimuth limit", err)
+	}
+	cmd := azScanCmd{AzimuthRange: [2]float64{110, 130}, Elevation: 30, NumScans: 1, Speed: 2}
+	if err := cmd.Check(); err == nil || !strings.Contains(err.Error(), "speed") {
+		t.Errorf("got %v, expected a speed limit", err)
+	}
+
+	limits := defaultConfig().Azimuth
+	for _, bad := range [][]AzimuthLimitPoint{
+		{{60, 1, 2}, {20, 3, 6}},
+		{{20, 0, 2}},
+		{{20, 1, 2 * limits.AccelMax}},
+	} {
+		if checkAzimuthProfile(bad, limits) == nil {
+			t.Errorf("%v: expected an error", bad)
+		}
+	}
+}
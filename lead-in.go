@@ -0,0 +1,126 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+// A pattern's first point is usually away from wherever the telescope is
+// when it starts, and the ACU would lurch to it on entering ProgramTrack.
+// So each pattern is led in from the telescope's position and velocity
+// by a cubic (Hermite) path ending on its first point, like the
+// transitions between chained patterns.
+
+// the lead-in starts this long after it's generated, leaving time to upload it
+const leadInDelay = time.Second
+
+// A LeadInScanPattern is a pattern preceded by its lead-in. The lead-in's
+// points are flagged as turning around.
+type LeadInScanPattern struct {
+	leadIn  transitionScanPattern // from the start point, but not the first point of the pattern
+	pattern ScanPattern
+	start   time.Time // of the pattern
+}
+
+// NewLeadInScanPattern leads into pattern from the point from, failing if
+// the pattern starts too soon to reach it within the axis limits.
+func NewLeadInScanPattern(from ScanPatternSample, pattern ScanPattern) (*LeadInScanPattern, error) {
+	var first ScanPatternSample
+	iter := pattern.Iterator()
+	if pattern.Done(iter) {
+		return nil, fmt.Errorf("pattern has no points")
+	}
+	err := pattern.Next(iter, &first)
+	if err != nil {
+		return nil, err
+	}
+	T := first.T.Sub(from.T).Seconds()
+	if T < chainTransitionInterval.Seconds() {
+		return nil, fmt.Errorf("pattern starts too soon for a lead-in")
+	}
+
+	f := siteDerating.Factors()
+	azSpeedMax, azAccelMax := azimuthLimitsOver(from.El, first.El)
+	limits := [2]axisKinematicLimits{
+		{"azimuth", f[0] * azSpeedMax, f[0] * azAccelMax, azimuthJerkMax},
+		{"elevation", f[1] * elevationSpeedMax, f[1] * elevationAccelMax, elevationJerkMax},
+	}
+	p0, v0 := [2]float64{from.Az, from.El}, [2]float64{from.AzVel, from.ElVel}
+	p1, v1 := [2]float64{first.Az, first.El}, [2]float64{first.AzVel, first.ElVel}
+	for i, lim := range limits {
+		speed, accel, jerk := hermitePeaks(p0[i], v0[i], p1[i], v1[i], T)
+		switch {
+		case speed > lim.speedMax:
+			return nil, fmt.Errorf("lead-in %s speed (%g) exceeds limit (%g)", lim.name, speed, lim.speedMax)
+		case accel > lim.accelMax:
+			return nil, fmt.Errorf("lead-in %s acceleration (%g) exceeds limit (%g)", lim.name, accel, lim.accelMax)
+		case jerk > lim.jerkMax:
+			return nil, fmt.Errorf("lead-in %s jerk (%g) exceeds limit (%g)", lim.name, jerk, lim.jerkMax)
+		}
+	}
+
+	from.AzFlag, from.ElFlag = 2, 2
+	leadIn := newTransitionScanPattern(from, first)
+	leadIn.samples = append([]ScanPatternSample{from}, leadIn.samples...)
+	for i := range leadIn.samples {
+		x := &leadIn.samples[i]
+		err := checkHardAzEl(x.Az, x.El, x.AzVel, x.ElVel)
+		if err != nil {
+			return nil, fmt.Errorf("lead-in: %w", err)
+		}
+	}
+	return &LeadInScanPattern{leadIn: leadIn, pattern: pattern, start: first.T}, nil
+}
+
+// points returns the number of points in the lead-in.
+func (scan LeadInScanPattern) points() int {
+	return len(scan.leadIn.samples)
+}
+
+func (scan LeadInScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{inner: scan.leadIn.Iterator()}
+}
+
+// Done moves the iterator on to the pattern after the lead-in.
+func (scan LeadInScanPattern) Done(iter *ScanPatternIterator) bool {
+	if iter.part == 0 {
+		if !scan.leadIn.Done(iter.inner) {
+			return false
+		}
+		iter.part++
+		iter.inner = scan.pattern.Iterator()
+	}
+	return scan.pattern.Done(iter.inner)
+}
+
+func (scan LeadInScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	if scan.Done(iter) {
+		return fmt.Errorf("no more points in lead-in pattern")
+	}
+	iter.index++
+	if iter.part == 0 {
+		return scan.leadIn.Next(iter.inner, p)
+	}
+	return scan.pattern.Next(iter.inner, p)
+}
+
+// leadInStart returns where the lead-in of a pattern started now will
+// start from: the telescope's observed position leadInDelay from now,
+// moving at its current velocity. The telescope is normally at rest,
+// since the command before has to finish first.
+func (t *Telescope) leadInStart(now time.Time) (ScanPatternSample, error) {
+	rec := &t.rec
+	if rec.Year == 0 {
+		return ScanPatternSample{}, fmt.Errorf("no ACU status")
+	}
+	dt := leadInDelay.Seconds()
+	az, el := t.pointing.Raw2Sky(rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition)
+	x := ScanPatternSample{
+		T:     now.Add(leadInDelay),
+		Az:    az + rec.AzimuthCurrentVelocity*dt,
+		El:    el + rec.ElevationCurrentVelocity*dt,
+		AzVel: rec.AzimuthCurrentVelocity,
+		ElVel: rec.ElevationCurrentVelocity,
+	}
+	return x, checkSample(&x)
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLeadInScanPattern(t *testing.T) {
+	t0 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	scan := NewAzimuthScanPattern(t0.Add(30*time.Second), 2, 60, [2]float64{110, 130}, 0.8, 5*time.Second)
+	from := ScanPatternSample{T: t0, Az: 100, El: 50}
+	leadIn, err := NewLeadInScanPattern(from, scan)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samples := collectPattern(t, leadIn)
+	expected := collectPattern(t, scan)
+	n := leadIn.points()
+	if len(samples) != n+len(expected) {
+		t.Fatalf("got %d samples, expected %d lead-in and %d pattern", len(samples), n, len(expected))
+	}
+	if x := samples[0]; x.T != t0 || x.Az != 100 || x.El != 50 || x.AzVel != 0 || x.ElVel != 0 {
+		t.Errorf("lead-in starts at %+v", x)
+	}
+	for i, x := range samples[:n] {
+		if x.AzFlag != 2 || x.ElFlag != 2 {
+			t.Errorf("lead-in sample %d not flagged: %+v", i, x)
+		}
+	}
+	for i, x := range samples[n:] {
+		if x != expected[i] {
+			t.Fatalf("pattern sample %d: got %+v, expected %+v", i, x, expected[i])
+		}
+	}
+	if err := ValidateScanPattern(leadIn); err != nil {
+		t.Error(err)
+	}
+
+	// 20 deg in 2 seconds is too fast
+	from.T = t0.Add(28 * time.Second)
+	if _, err := NewLeadInScanPattern(from, scan); err == nil {
+		t.Error("lead-in too fast accepted")
+	}
+	from.T = t0.Add(30 * time.Second)
+	if _, err := NewLeadInScanPattern(from, scan); err == nil {
+		t.Error("lead-in with no time accepted")
+	}
+}
+
+func TestHermitePeaks(t *testing.T) {
+	// rest to rest: the velocity peaks at 1.5 d/T mid-way
+	speed, accel, jerk := hermitePeaks(0, 0, 10, 0, 5)
+	if math.Abs(speed-3) > 1e-12 || math.Abs(accel-2.4) > 1e-12 || math.Abs(jerk-0.96) > 1e-12 {
+		t.Errorf("got speed %g, accel %g, jerk %g", speed, accel, jerk)
+	}
+	// at constant velocity
+	speed, accel, jerk = hermitePeaks(0, 2, 10, 2, 5)
+	if speed != 2 || accel != 0 || jerk != 0 {
+		t.Errorf("got speed %g, accel %g, jerk %g", speed, accel, jerk)
+	}
+}
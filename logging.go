@@ -0,0 +1,159 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// how many command log lines to keep for /commands/<id>/log
+const commandLogLen = 10000
+
+// A LogEntry is a structured log line.
+type LogEntry struct {
+	Time      time.Time `json:"time"`
+	Subsystem string    `json:"subsystem"` // source file, e.g. "telescope"
+	Source    string    `json:"source"`    // file:line
+	CommandID string    `json:"command_id,omitempty"`
+	Command   string    `json:"command,omitempty"` // endpoint, or type for internal commands
+	Message   string    `json:"msg"`
+}
+
+// A LogSink turns the standard logger's lines into LogEntries, tagged
+// with the current command, and writes them as logfmt or JSON lines.
+// It keeps the recent lines logged during commands.
+type LogSink struct {
+	mu        sync.Mutex
+	out       io.Writer
+	json      bool
+	commandID string
+	command   string
+	recent    []LogEntry // ring buffer
+	next      int
+}
+
+var tcsLog = NewLogSink(os.Stderr)
+
+func NewLogSink(out io.Writer) *LogSink {
+	return &LogSink{out: out}
+}
+
+// SetFormat sets the output format, "text" (logfmt) or "json".
+func (s *LogSink) SetFormat(format string) error {
+	switch format {
+	case "text", "json":
+	default:
+		return fmt.Errorf("bad log format %q: expected text or json", format)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.json = format == "json"
+	return nil
+}
+
+// SetCommand sets the command tagging lines from now on, if not tagged
+// already (see commandLogger). An empty id clears it.
+func (s *LogSink) SetCommand(id, command string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.commandID, s.command = id, command
+}
+
+// Write logs a line from a logger with the log.Lshortfile flag only.
+func (s *LogSink) Write(p []byte) (int, error) {
+	return s.write(p, "", "")
+}
+
+func (s *LogSink) write(p []byte, commandID, command string) (int, error) {
+	e := LogEntry{Time: time.Now().UTC(), Message: strings.TrimSuffix(string(p), "\n")}
+	// file.go:123: message
+	if i := strings.Index(e.Message, ": "); i > 0 && strings.Contains(e.Message[:i], ".go:") {
+		e.Source, e.Message = e.Message[:i], e.Message[i+2:]
+		e.Subsystem = e.Source[:strings.Index(e.Source, ".go:")]
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	e.CommandID, e.Command = commandID, command
+	if commandID == "" {
+		e.CommandID, e.Command = s.commandID, s.command
+	}
+	if e.CommandID != "" {
+		if len(s.recent) < commandLogLen {
+			s.recent = append(s.recent, e)
+		} else {
+			s.recent[s.next] = e
+			s.next = (s.next + 1) % commandLogLen
+		}
+	}
+
+	var b []byte
+	if s.json {
+		b, _ = json.Marshal(&e)
+		b = append(b, '\n')
+	} else {
+		b = e.logfmt()
+	}
+	_, err := s.out.Write(b)
+	return len(p), err
+}
+
+func (e *LogEntry) logfmt() []byte {
+	var b bytes.Buffer
+	fmt.Fprintf(&b, "time=%s", e.Time.Format("2006-01-02T15:04:05.000000Z"))
+	if e.Subsystem != "" {
+		fmt.Fprintf(&b, " subsystem=%s source=%s", e.Subsystem, e.Source)
+	}
+	if e.CommandID != "" {
+		fmt.Fprintf(&b, " command_id=%s command=%s", e.CommandID, e.Command)
+	}
+	fmt.Fprintf(&b, " msg=%q\n", e.Message)
+	return b.Bytes()
+}
+
+// CommandLog returns the recent lines logged during a command, oldest first.
+func (s *LogSink) CommandLog(id string) []LogEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	entries := []LogEntry{}
+	for i := range s.recent {
+		e := &s.recent[(s.next+i)%len(s.recent)]
+		if e.CommandID == id {
+			entries = append(entries, *e)
+		}
+	}
+	return entries
+}
+
+type commandLogWriter struct {
+	sink            *LogSink
+	commandID, name string
+}
+
+func (w commandLogWriter) Write(p []byte) (int, error) {
+	return w.sink.write(p, w.commandID, w.name)
+}
+
+type commandLogKey struct{}
+
+// withCommandLog returns a context whose commandLogger tags lines with
+// the command, even after another has started.
+func withCommandLog(ctx context.Context, id, command string) context.Context {
+	l := log.New(commandLogWriter{tcsLog, id, command}, "", log.Lshortfile)
+	return context.WithValue(ctx, commandLogKey{}, l)
+}
+
+// commandLogger returns the context's command logger, or the standard logger.
+func commandLogger(ctx context.Context) *log.Logger {
+	if l, ok := ctx.Value(commandLogKey{}).(*log.Logger); ok {
+		return l
+	}
+	return log.Default()
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log"
+	"strings"
+	"testing"
+)
+
+func TestLogSink(t *testing.T) {
+	var out bytes.Buffer
+	sink := NewLogSink(&out)
+	logger := log.New(sink, "", log.Lshortfile)
+
+	logger.Print("idle")
+	sink.SetCommand("1", "/azimuth-scan")
+	logger.Print("scanning")
+	l := log.New(commandLogWriter{sink, "0", "/move-to"}, "", log.Lshortfile)
+	l.Print("late upload")
+	sink.SetCommand("", "")
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	if len(lines) != 3 || !strings.Contains(lines[0], `subsystem=logging_test source=logging_test.go:`) ||
+		strings.Contains(lines[0], "command_id") || !strings.HasSuffix(lines[0], `msg="idle"`) ||
+		!strings.Contains(lines[1], "command_id=1 command=/azimuth-scan") ||
+		!strings.Contains(lines[2], "command_id=0 command=/move-to") {
+		t.Errorf("got %q", lines)
+	}
+	if e := sink.CommandLog("1"); len(e) != 1 || e[0].Message != "scanning" || e[0].Subsystem != "logging_test" {
+		t.Errorf("got %+v", e)
+	}
+
+	out.Reset()
+	err := sink.SetFormat("json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.SetCommand("2", "/stow")
+	logger.Print("stowing")
+	var e LogEntry
+	err = json.Unmarshal(out.Bytes(), &e)
+	if err != nil || e.CommandID != "2" || e.Message != "stowing" {
+		t.Errorf("got %s, %v", out.Bytes(), err)
+	}
+	if sink.SetFormat("xml") == nil {
+		t.Error("expected bad format to fail")
+	}
+
+	if commandLogger(context.Background()) != log.Default() {
+		t.Error("expected the standard logger without a command")
+	}
+}
@@ -1,13 +1,20 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
+	"flag"
 	"fmt"
+	"io"
 	"log"
-	"math"
 	"net/http"
 	"os"
+	"os/signal"
+	"strconv"
+	"sync/atomic"
+	"syscall"
 	"time"
 
 	"github.com/ccatobs/antenna-control-unit/datasets"
@@ -25,8 +32,9 @@ const (
 )
 
 func init() {
-	// log format: date time(UTC) file:linenumber message
-	log.SetFlags(log.Ldate | log.Ltime | log.Lmicroseconds | log.LUTC | log.Lshortfile)
+	// the sink adds the time and current command, see logging.go
+	log.SetFlags(log.Lshortfile)
+	log.SetOutput(tcsLog)
 }
 
 func jsonResponse(w http.ResponseWriter, err error, statusCode int) {
@@ -50,6 +58,33 @@ func jsonResponse(w http.ResponseWriter, err error, statusCode int) {
 	}
 }
 
+// commandResponse is jsonResponse for command submission,
+// adding the command ID and any FieldError.
+func commandResponse(w http.ResponseWriter, id string, err error, statusCode int) {
+	var response struct {
+		S  string      `json:"status"`
+		M  string      `json:"message,omitempty"`
+		ID string      `json:"id,omitempty"`
+		E  *FieldError `json:"error,omitempty"`
+	}
+
+	if err != nil {
+		response.S = "error"
+		response.M = err.Error()
+		errors.As(err, &response.E)
+	} else {
+		response.S = "ok"
+		response.ID = id
+		statusCode = http.StatusOK
+	}
+
+	w.WriteHeader(statusCode)
+	err = json.NewEncoder(w).Encode(response)
+	if err != nil {
+		log.Print(err)
+	}
+}
+
 func getenv(key, def string) string {
 	if val, ok := os.LookupEnv(key); ok {
 		return val
@@ -58,326 +93,705 @@ func getenv(key, def string) string {
 }
 
 func main() {
-	acuHost := getenv("FYST_ACU_HOST", "172.16.5.95")
-	acuPort := getenv("FYST_ACU_PORT", "8100")
-	acuAdminPort := getenv("FYST_ACU_ADMIN_PORT", "8080")
-	apiAddr := getenv("FYST_TCS_ADDR", ":5600")
+	simulate := flag.Bool("simulate", false, "run against a simulated ACU, like FYST_ACU_SIMULATOR=1")
+	flag.Parse()
 
-	acu := NewACU(acuHost, acuPort, acuAdminPort)
-	tel := NewTelescope(acu)
-
-	// report immediately any ACU problems
-	err := tel.UpdateStatus()
+	err := tcsLog.SetFormat(getenv("FYST_LOG_FORMAT", "text"))
 	if err != nil {
-		log.Print(err)
+		log.Fatal(err)
 	}
-	err = tel.Ready()
+	configFile := getenv("FYST_TCS_CONFIG", "")
+	baseConfig := defaultConfig()
+	acuHost := getenv("FYST_ACU_HOST", baseConfig.ACU.Host)
+	acuPort := getenv("FYST_ACU_PORT", baseConfig.ACU.Port)
+	acuAdminPort := getenv("FYST_ACU_ADMIN_PORT", baseConfig.ACU.AdminPort)
+	apiAddr := getenv("FYST_TCS_ADDR", ":5600")
+	grpcAddr := getenv("FYST_TCS_GRPC_ADDR", "")
+	tokensFile := getenv("FYST_TCS_TOKENS", "")
+	housekeepingURL := getenv("FYST_HOUSEKEEPING_URL", "")
+	housekeepingToken := getenv("FYST_HOUSEKEEPING_TOKEN", "")
+	housekeepingRate := getenv("FYST_HOUSEKEEPING_RATE", "10")
+	archiveDir := getenv("FYST_ARCHIVE_DIR", "")
+	archiveRate := getenv("FYST_ARCHIVE_RATE", "10")
+	archiveRotate := getenv("FYST_ARCHIVE_ROTATE", "1h")
+	archiveRetention := getenv("FYST_ARCHIVE_RETENTION", "720h")
+	positionBroadcastAddr := getenv("FYST_POSITION_BROADCAST_ADDR", "")
+	positionBroadcastForward := getenv("FYST_POSITION_BROADCAST_FORWARD", "")
+	positionBroadcastHeader := getenv("FYST_POSITION_BROADCAST_HEADER", "") != ""
+	gpsTimeServer := getenv("FYST_GPS_TIME_SERVER", "")
+	auditLogFile := getenv("FYST_ACU_AUDIT_LOG", "")
+	trackingErrorAlarmStr := getenv("FYST_TRACKING_ERROR_ALARM", "")
+	notifyConfig := getenv("FYST_NOTIFY_CONFIG", "")
+	busConfigFile := getenv("FYST_BUS_CONFIG", "")
+	epicsAddr := getenv("FYST_EPICS_ADDR", "")
+	epicsPrefix := getenv("FYST_EPICS_PREFIX", defaultCAPrefix)
+	epicsCommands := getenv("FYST_EPICS_COMMANDS", "")
+	pointingModelFile := getenv("FYST_POINTING_MODEL", "")
+	catalogFile := getenv("FYST_CATALOG", "")
+	templatesFile := getenv("FYST_TEMPLATES", "")
+	pointingRunsFile := getenv("FYST_POINTING_RUNS", "")
+	encoderZeroFile := getenv("FYST_ENCODER_ZERO", "")
+	weatherURL := getenv("FYST_WEATHER_URL", "")
+	shutterURL := getenv("FYST_SHUTTER_URL", "")
+	hexapodURL := getenv("FYST_HEXAPOD_URL", "")
+	tiltmeterURL := getenv("FYST_TILTMETER_URL", "")
+	stowPositionStr := getenv("FYST_STOW_POSITION", "")
+	maintenancePositionStr := getenv("FYST_MAINTENANCE_POSITION", "")
+	stowPins := getenv("FYST_STOW_PINS", "") != ""
+	simulateACU := *simulate || getenv("FYST_ACU_SIMULATOR", "") != ""
+	recordFile := getenv("FYST_ACU_RECORD", "")
+	replayPath := getenv("FYST_ACU_REPLAY", "")
+	replaySpeed := getenv("FYST_ACU_REPLAY_SPEED", "1")
+	replayStart := getenv("FYST_ACU_REPLAY_START", "")
+	replayStop := getenv("FYST_ACU_REPLAY_STOP", "")
+	shutdownMode := getenv("FYST_SHUTDOWN_MODE", shutdownStop)
+	shutdownTimeoutStr := getenv("FYST_SHUTDOWN_TIMEOUT", "5m")
+	stateFile := getenv("FYST_TCS_STATE", "")
+	telescopesFile := getenv("FYST_TELESCOPES", "")
+
+	err = checkShutdownMode(shutdownMode)
 	if err != nil {
-		log.Print(err)
+		log.Fatal(err)
+	}
+	shutdownTimeout, err := time.ParseDuration(shutdownTimeoutStr)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	type MeasurementFloat struct {
-		Name        string
-		Description string
-		Unit        string
-		Value       float64
-		Created     time.Time
-	}
-
-	var tel_pos = []MeasurementFloat{
-		{
-			Name:        "Elevation",
-			Description: "Telescope height above sea level",
-			Unit:        "meters",
-			Value:       FYST_ELEVATION_METERS,
-			Created:     time.Now(),
-		},
-		{
-			Name:        "Latitude",
-			Description: "Telescope latitude",
-			Unit:        "degrees",
-			Value:       FYST_LATITUDE_DEG,
-			Created:     time.Now(),
-		},
-		{
-			Name:        "Longitude",
-			Description: "Telescope longitude with positive east",
-			Unit:        "degrees",
-			Value:       FYST_LONGITUDE_EAST_DEG,
-			Created:     time.Now(),
-		},
-	}
-	// XXX:DEBUG fake pointing model
-	tel.pointing.azOffset = 0
-	tel.pointing.elOffset = 0
-
-	// command queue
-	cmds := make(chan Command)
-
-	// abort signal
-	abort := make(chan chan bool)
-
-	// main loop
-	go func() {
-		for {
-			// wait for command
-			var cmd Command
-		waitForCmdLoop:
-			for {
-				select {
-				case cmd = <-cmds:
-					break waitForCmdLoop
-				case <-time.After(statusUpdateDuration):
-					err := tel.UpdateStatus()
-					if err != nil {
-						log.Print(err)
-					}
-				case c := <-abort:
-					log.Print("ignoring abort")
-					c <- false
-				}
-			}
-
-			desc := fmt.Sprintf("%#v", cmd)
-			if len(desc) > 200 {
-				desc = fmt.Sprintf("%.200s...", desc)
-			}
-			log.Printf("got command: %s", desc)
+	// the environment sets the defaults for the config file
+	baseConfig.ACU = ACUAddress{Host: acuHost, Port: acuPort, AdminPort: acuAdminPort}
+	baseConfig.StowPins = stowPins
+	if stowPositionStr != "" {
+		pos, err := parseAzEl(stowPositionStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		baseConfig.StowPosition = pos
+	}
+	if maintenancePositionStr != "" {
+		pos, err := parseAzEl(maintenancePositionStr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		baseConfig.MaintenancePosition = pos
+	}
+	if trackingErrorAlarmStr != "" {
+		x, err := strconv.ParseFloat(trackingErrorAlarmStr, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		baseConfig.TrackingErrorAlarm = x
+	}
 
-			if err := tel.Ready(); err != nil {
-				log.Print(err)
-				continue
-			}
+	cfg := baseConfig
+	if configFile != "" {
+		var err error
+		cfg, err = LoadConfig(configFile, baseConfig)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded config %s", configFile)
+	} else if err := cfg.Validate(); err != nil {
+		log.Fatal(err)
+	}
+	applyConfig(cfg)
+	acuHost, acuPort, acuAdminPort = cfg.ACU.Host, cfg.ACU.Port, cfg.ACU.AdminPort
 
-			// start command
-			ctx, cancel := context.WithCancel(context.Background())
-			isDone, err := cmd.Start(ctx, tel)
+	// reloads the config file, keeping the current config on error
+	reload := func() error {
+		if configFile == "" {
+			return fmt.Errorf("no config file (FYST_TCS_CONFIG)")
+		}
+		c, err := LoadConfig(configFile, baseConfig)
+		if err == nil {
+			err = reloadConfig(c)
+		}
+		if err != nil {
+			return fmt.Errorf("config not reloaded: %w", err)
+		}
+		log.Printf("reloaded config %s", configFile)
+		return nil
+	}
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	go func() {
+		for range hup {
+			err := reload()
 			if err != nil {
 				log.Print(err)
-				cancel()
-				continue
 			}
+		}
+	}()
 
-			// wait for command to finish
-			for done := false; !done; {
-				select {
-				case <-time.After(statusUpdateDuration):
-					err = tel.UpdateStatus()
-					if err != nil {
-						break // select statement
-					}
-					done, err = isDone(tel)
-				case c := <-abort:
-					log.Print("aborting")
-					c <- true
-					done = true
-					cancel()
-					err = tel.Stop()
-				}
+	var auth *Auth
+	if tokensFile != "" {
+		var err error
+		auth, err = LoadAuth(tokensFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded %d tokens from %s", len(auth.tokens), tokensFile)
+	}
+
+	// serve a stand-in ACU on a local port
+	serveACU := func(h http.Handler) {
+		port, err := listenLocal(h)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acuHost, acuPort, acuAdminPort = "127.0.0.1", port, port
+	}
+	if simulateACU {
+		sim := NewACUSimulator(cfg.StowPosition[0], cfg.StowPosition[1])
+		go sim.Run()
+		serveACU(sim)
+		log.Printf("simulating the ACU on port %s", acuPort)
+	}
+	if replayPath != "" {
+		replay, err := loadReplay(replayPath, replayStart, replayStop)
+		if err != nil {
+			log.Fatal(err)
+		}
+		speed, err := strconv.ParseFloat(replaySpeed, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		r, err := NewReplayACU(replay, speed)
+		if err != nil {
+			log.Fatal(err)
+		}
+		serveACU(r)
+		log.Printf("replaying %s from %s to %s at %gx on port %s",
+			replayPath, r.t0.UTC().Format(time.RFC3339), r.t1.UTC().Format(time.RFC3339), speed, acuPort)
+	}
+
+	acu := NewACU(acuHost, acuPort, acuAdminPort)
+	acu.unconfirmed = simulateACU
+	if recordFile != "" {
+		r, err := NewStatusRecorder(recordFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		acu.recorder = r
+		log.Printf("recording ACU status to %s", recordFile)
+	}
+	tel := NewTelescope(acu)
+
+	if pointingModelFile != "" {
+		m, err := LoadPointingModel(pointingModelFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		tel.pointing.SetModel(m, pointingModelFile)
+		log.Printf("loaded pointing model %s: %+v", pointingModelFile, m)
+	}
+
+	pointingRuns := NewPointingRuns(tel.pointing)
+	if pointingRunsFile != "" {
+		err := pointingRuns.Load(pointingRunsFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded pointing runs %s: %d runs", pointingRunsFile, len(pointingRuns.Runs(time.Time{})))
+	}
+
+	encoderZero := NewEncoderZeroPoints(tel.pointing)
+	if encoderZeroFile != "" {
+		err := encoderZero.Load(encoderZeroFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded encoder zero points %s: %+v", encoderZeroFile, encoderZero.Current())
+	}
+
+	if catalogFile != "" {
+		err := siteCatalog.Load(catalogFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded catalog %s: %d targets", catalogFile, len(siteCatalog.List()))
+	}
+
+	if templatesFile != "" {
+		err := siteTemplates.Load(templatesFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("loaded templates %s: %d templates", templatesFile, len(siteTemplates.List()))
+	}
+
+	tracker := NewCommandTracker()
+
+	// restore what we can of the previous run, and save this one's state
+	var prevState *TCSState
+	var scheduler *Scheduler
+	var stateStore *StateStore
+	if stateFile != "" {
+		var err error
+		prevState, err = LoadState(stateFile)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if prevState != nil {
+			reportPreviousState(prevState)
+			for name, off := range prevState.Offsets {
+				err := tel.pointing.offsets.Set(name, off)
 				if err != nil {
 					log.Print(err)
-					break
 				}
 			}
+			tracker.Restore(prevState.Commands, time.Now())
+		}
+		stateStore = NewStateStore(stateFile, func() *TCSState {
+			return &TCSState{
+				Current:  currentCommand(tracker),
+				Schedule: pendingEntries(scheduler.List()),
+				Offsets:  tel.pointing.offsets.Get(),
+				Commands: tracker.List(),
+			}
+		})
+		tracker.OnChange(stateStore.Changed)
+		tel.pointing.offsets.OnChange(stateStore.Changed)
+	}
 
-			log.Printf("command done: %s", desc)
+	alarms := NewAlarms()
+	if notifyConfig != "" {
+		notifier, err := LoadNotifier(notifyConfig)
+		if err != nil {
+			log.Fatal(err)
 		}
+		alarms.OnEvent(notifier.Notify)
+	}
+	timeSync := NewTimeSync(acu, gpsTimeServer, alarms)
+	go timeSync.Run()
+
+	motionParams := NewMotionParams(acu, alarms)
+	go motionParams.Run()
+
+	faults := &Faults{}
+	estop := NewEmergencyStop(faults, alarms)
+	trackingErrors := NewTrackingErrors(tracker)
+	if hexapodURL != "" {
+		tel.hexapod = NewHexapod(hexapodURL, alarms)
+		go tel.hexapod.Run()
+	}
+	statusStream := NewStatusStream(acu, tracker, alarms, timeSync, faults, estop, siteDerating, trackingErrors, tel.hexapod, tel.pointing)
+	go statusStream.Run()
+	go func() {
+		log.Fatal(trackingErrors.Run(statusStream))
+	}()
+	go func() {
+		log.Fatal(NewAlarmMonitor(acu, alarms, statusStream, faults, siteDerating).Run())
 	}()
 
-	// build http API
-	mux := http.NewServeMux()
-
-	mux.HandleFunc("/abort", func(w http.ResponseWriter, req *http.Request) {
-		var err error
-		var statusCode int
-
-		if req.Method == "POST" {
-			c := make(chan bool)
-			abort <- c
-			if <-c {
-				statusCode = http.StatusOK
-			} else {
-				err = fmt.Errorf("nothing to abort")
-				statusCode = http.StatusConflict // not sure if this is the most appropriate code
+	var hk *Housekeeping
+	if housekeepingURL != "" {
+		rate, err := strconv.ParseFloat(housekeepingRate, 64)
+		if err != nil {
+			log.Fatal(err)
+		}
+		hk = NewHousekeeping(housekeepingURL, housekeepingToken, rate, statusStream)
+		go func() {
+			if err := hk.Run(); err != nil {
+				log.Fatal(err)
 			}
-		} else {
-			err = fmt.Errorf("method not POST")
-			statusCode = http.StatusMethodNotAllowed
+		}()
+	}
+
+	var archive *Archive
+	if archiveDir != "" {
+		rate, err := strconv.ParseFloat(archiveRate, 64)
+		if err != nil {
+			log.Fatal(err)
 		}
+		rotate, err := time.ParseDuration(archiveRotate)
+		if err != nil {
+			log.Fatal(err)
+		}
+		retention, err := time.ParseDuration(archiveRetention)
+		if err != nil {
+			log.Fatal(err)
+		}
+		archive = NewArchive(acu, archiveDir, Seconds2Duration(1/rate), rotate, retention)
+		go func() {
+			if err := archive.Run(); err != nil {
+				log.Fatal(err)
+			}
+		}()
+	}
 
-		jsonResponse(w, err, statusCode)
-	})
+	var tiltmeter *Tiltmeter
+	if tiltmeterURL != "" {
+		tiltmeter = NewTiltmeter(tiltmeterURL, tel.pointing, archive, alarms, func() (float64, error) {
+			var rec datasets.StatusGeneral8100
+			err := acu.StatusGeneral8100Get(&rec)
+			return rec.AzimuthCurrentPosition, err
+		})
+		go tiltmeter.Run()
+	}
 
-	mux.HandleFunc("/acu/status", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "GET" {
-			err := fmt.Errorf("method not GET")
-			jsonResponse(w, err, http.StatusMethodNotAllowed)
-			return
+	var positionBroadcast *PositionBroadcast
+	if positionBroadcastAddr != "" {
+		positionBroadcast, err = ListenPositionBroadcast(positionBroadcastAddr, positionBroadcastForward, archive)
+		if err != nil {
+			log.Fatal(err)
 		}
+		if positionBroadcastHeader {
+			positionBroadcast.SetHeader(func() PositionBroadcastHeader {
+				r := tracker.Current()
+				if r == nil {
+					return PositionBroadcastHeader{}
+				}
+				return PositionBroadcastHeader{CommandID: r.ID, Command: r.Command, Metadata: r.Metadata}
+			})
+		}
+		go func() {
+			log.Fatal(positionBroadcast.Run())
+		}()
+	}
 
-		var rec datasets.StatusGeneral8100
-		err := acu.StatusGeneral8100Get(&rec)
+	dispatcher := NewDispatcher("", tel, tracker, alarms, estop, timeSync, motionParams)
+
+	var weather *WeatherStation
+	var windStow *WindStow
+	if weatherURL != "" {
+		weather = NewWeatherStation(weatherURL, siteAtmosphere)
+		go weather.Run()
+		statusStream.weather = weather
+		windStow = NewWindStow(weather, dispatcher.preempt, alarms)
+		go windStow.Run()
+		dispatcher.windStow = windStow
+	}
+
+	if shutterURL != "" {
+		tel.shutter = NewShutter(shutterURL, alarms)
+		go tel.shutter.Run()
+	}
+
+	// report immediately any ACU problems
+	err = tel.UpdateStatus()
+	if err != nil {
+		log.Print(err)
+	}
+	err = tel.Ready()
+	if err != nil {
+		log.Print(err)
+	}
+
+	go dispatcher.Run()
+
+	// other telescopes, e.g. a calibration antenna
+	var instances []*Instance
+	if telescopesFile != "" {
+		configs, err := LoadTelescopes(telescopesFile)
 		if err != nil {
-			jsonResponse(w, err, http.StatusInternalServerError)
-			return
+			log.Fatal(err)
 		}
+		for _, c := range configs {
+			inst, err := StartInstance(c)
+			if err != nil {
+				log.Fatal(err)
+			}
+			instances = append(instances, inst)
+			log.Printf("telescope %s: ACU at %s", c.Name, inst.acu.Addr)
+		}
+	}
 
-		// XXX: encoding/json doesn't handle NaNs
-		if math.IsNaN(rec.AzimuthCommandedPosition) {
-			rec.AzimuthCommandedPosition = -1e9
+	// submitCommand decodes, checks and queues a command, returning its
+	// ID, or an error and the corresponding HTTP status code.
+	var shuttingDown int32
+	limiter := NewCommandLimiter()
+	submitCommand := func(p *Principal, endpoint string, body io.Reader) (string, int, error) {
+		if atomic.LoadInt32(&shuttingDown) != 0 {
+			return "", http.StatusServiceUnavailable, errShutdown
 		}
-		if math.IsNaN(rec.ElevationCommandedPosition) {
-			rec.ElevationCommandedPosition = -1e9
+		args, err := readCommand(body)
+		if errors.Is(err, errTooLarge) {
+			return "", http.StatusRequestEntityTooLarge, err
 		}
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		t0 := time.Now()
+		cmd, err := decodeCommand(endpoint, bytes.NewReader(args))
+		if errors.Is(err, errBadEndpoint) {
+			return "", http.StatusNotFound, err
+		}
+		if err != nil {
+			return "", http.StatusBadRequest, err
+		}
+		decodeTime := time.Since(t0)
 
-		err = json.NewEncoder(w).Encode(&rec)
+		// the handlers only checked the outer endpoint
+		err = checkCommandRole(p, endpoint, cmd)
 		if err != nil {
-			log.Print(err)
+			return "", http.StatusForbidden, err
 		}
-	})
 
-	mux.HandleFunc("/acu/failure-reset", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "POST" {
-			err := fmt.Errorf("method not POST")
-			jsonResponse(w, err, http.StatusMethodNotAllowed)
-			return
+		// a resubmission gets the command it repeats
+		key, _ := commandIdempotencyKey(args) // checked by decodeCommand
+		if id, ok := tracker.Lookup(clientName(p), key); ok {
+			log.Printf("resubmitted command %s: %s", id, endpoint)
+			return id, http.StatusOK, nil
 		}
 
-		err := acu.FailureReset()
-		status := http.StatusOK
+		// check parameters
+		t0 = time.Now()
+		err = cmd.Check()
 		if err != nil {
-			status = http.StatusInternalServerError
+			return "", http.StatusBadRequest, err
 		}
-		jsonResponse(w, err, status)
-	})
+		checkTime := time.Since(t0)
 
-	mux.HandleFunc("/acu/reboot", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "POST" {
-			err := fmt.Errorf("method not POST")
-			jsonResponse(w, err, http.StatusMethodNotAllowed)
-			return
+		if isMotionCommand(cmd) {
+			err = auth.CheckLock(p)
+			if err != nil {
+				return "", http.StatusLocked, err
+			}
+		}
+
+		if windStow != nil && isMotionCommand(cmd) {
+			err = windStow.Blocked()
+			if err != nil {
+				return "", http.StatusServiceUnavailable, err
+			}
 		}
 
-		err := acu.Reboot()
-		status := http.StatusOK
+		err = limiter.Allow(p, endpoint, args, time.Now())
 		if err != nil {
-			status = http.StatusInternalServerError
+			return "", http.StatusTooManyRequests, err
 		}
-		jsonResponse(w, err, status)
-	})
 
-	mux.HandleFunc("/clear-track", func(w http.ResponseWriter, req *http.Request) {
-		var statusCode int
-		if req.Method != "POST" {
-			err := fmt.Errorf("method not POST")
-			jsonResponse(w, err, http.StatusMethodNotAllowed)
-			return
+		// queue command
+		metadata, _ := commandMetadata(args) // checked by decodeCommand
+		id, ok := tracker.AddOnce(newCommandID(), endpoint, clientName(p), key)
+		if !ok {
+			log.Printf("resubmitted command %s: %s", id, endpoint)
+			return id, http.StatusOK, nil
+		}
+		tracker.SetArgs(id, args)
+		tracker.SetMetadata(id, metadata)
+		tracker.SetLatency(id, latencyDecode, decodeTime)
+		tracker.SetLatency(id, latencyCheck, checkTime)
+		if s, ok := cmd.(shutdownCmd); ok && s.Abort {
+			// abort the current command, if any
+			err = dispatcher.Preempt(queuedCommand{id, cmd})
+			if err != nil {
+				tracker.Set(id, commandFailed, err)
+				return "", http.StatusServiceUnavailable, err
+			}
+			log.Printf("preempting with command %s: %s", id, endpoint)
+			return id, http.StatusOK, nil
 		}
-		log.Print("clearing program track stack")
-		err := acu.ProgramTrackClear()
+		ifBusy, _ := commandIfBusy(args) // checked by decodeCommand
+		err = dispatcher.Submit(queuedCommand{id, cmd}, ifBusy)
 		if err != nil {
-			log.Print(err)
-			statusCode = http.StatusBadRequest
-		} else {
-			statusCode = http.StatusOK
+			tracker.Set(id, commandFailed, err)
+			return "", http.StatusServiceUnavailable, err
 		}
-		jsonResponse(w, err, statusCode)
-	})
 
-	mux.HandleFunc("/telescope-position", func(w http.ResponseWriter, req *http.Request) {
-		if req.Method != "GET" {
-			err := fmt.Errorf("method not GET")
-			jsonResponse(w, err, http.StatusMethodNotAllowed)
-			return
+		if p != nil {
+			log.Printf("queued command %s: %s by %s", id, endpoint, p.Name)
+		} else {
+			log.Printf("queued command %s: %s", id, endpoint)
 		}
-		err := json.NewEncoder(w).Encode(&tel_pos)
+		return id, http.StatusOK, nil
+	}
+
+	abortCommand := dispatcher.Abort
+
+	if grpcAddr != "" {
+		go func() {
+			log.Fatal(serveGRPC(grpcAddr, grpcAPI{
+				submit: submitCommand,
+				abort:  abortCommand,
+				auth:   auth,
+				status: statusStream,
+			}))
+		}()
+	}
+
+	if busConfigFile != "" {
+		busConfig, err := LoadBusConfig(busConfigFile)
 		if err != nil {
-			log.Print(err)
+			log.Fatal(err)
 		}
-	})
+		go NewBus(*busConfig, statusStream, tracker, alarms, auth, submitCommand).Run()
+	}
 
-	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
-		var cmd Command
-		var err error
-		var statusCode int
-
-		// parse command
-		if req.Method == "POST" {
-			dec := json.NewDecoder(req.Body)
-			dec.DisallowUnknownFields()
-			endpoint := req.URL.Path
-			switch endpoint {
-			case "/acu/position-broadcast":
-				var x enablePositionBroadcastCmd
-				err = dec.Decode(&x)
-				cmd = x
-			case "/azimuth-scan":
-				var x azScanCmd
-				err = dec.Decode(&x)
-				cmd = x
-			case "/move-to":
-				var x moveToCmd
-				err = dec.Decode(&x)
-				cmd = x
-			case "/path":
-				var x pathCmd
-				err = dec.Decode(&x)
-				cmd = x
-			case "/track":
-				var x trackCmd
-				err = dec.Decode(&x)
-				cmd = x
-			default:
-				err = fmt.Errorf("bad endpoint: %s", endpoint)
-				statusCode = http.StatusNotFound
-				goto respond
-			}
+	if epicsAddr != "" {
+		// FYST_EPICS_COMMANDS is the role of EPICS clients' commands
+		var role Role
+		if epicsCommands != "" {
+			err := role.UnmarshalJSON([]byte(strconv.Quote(epicsCommands)))
 			if err != nil {
-				statusCode = http.StatusBadRequest
-				goto respond
+				log.Fatal("FYST_EPICS_COMMANDS: ", err)
 			}
-		} else {
-			// XXX:TODO: hacky
-			endpoint := req.URL.Path
-			switch endpoint {
-			case "/azimuth-scan", "/enable-udp-stream", "/move-to", "/path", "/track":
-				err = fmt.Errorf("method not POST")
-				statusCode = http.StatusMethodNotAllowed
-			default:
-				err = fmt.Errorf("bad endpoint: %s", endpoint)
-				statusCode = http.StatusNotFound
-			}
-			goto respond
 		}
-
-		// check parameters
-		err = cmd.Check()
+		gw, err := ListenEPICS(epicsAddr, epicsPrefix, epicsCommands != "", role, auth, statusStream, submitCommand, abortCommand)
 		if err != nil {
-			statusCode = http.StatusBadRequest
-			goto respond
+			log.Fatal(err)
 		}
+		go func() {
+			log.Fatal(gw.Run())
+		}()
+	}
 
-		// queue command
-		select {
-		case cmds <- cmd:
-		case <-time.After(commandBusyTimeout):
-			err = fmt.Errorf("busy")
-			statusCode = http.StatusServiceUnavailable
-			goto respond
+	auditLog, err := OpenAuditLog(auditLogFile)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// currentPosition reads the telescope's position for estimates, or nil.
+	currentPosition := func() *[2]float64 {
+		var rec datasets.StatusGeneral8100
+		err := acu.StatusGeneral8100Get(&rec)
+		if err != nil {
+			log.Print(err)
+			return nil
 		}
+		return &[2]float64{rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition}
+	}
 
-		statusCode = http.StatusOK
-	respond:
-		jsonResponse(w, err, statusCode)
-	})
+	scheduler = NewScheduler(submitCommand, func() bool { return tracker.Current() != nil })
+	if stateStore != nil {
+		scheduler.OnChange(stateStore.Changed)
+		go stateStore.Run()
+	}
+
+	var weatherReading func() (WeatherReading, error)
+	if weather != nil {
+		weatherReading = weather.Latest
+	}
+	scripts := NewScriptRunner(submitCommand, tracker.Get, weatherReading)
+
+	health := NewHealth(acu, statusStream, timeSync, configFile, baseConfig)
+
+	// build http API
+	mux := http.NewServeMux()
+	serveCommandAPI(mux, submitCommand, tel.pointing, currentPosition)
+	serveDispatcher(mux, dispatcher)
+	serveCommandTracker(mux, tracker, tel.pointing)
+	serveEmergencyStop(mux, estop, acu, abortCommand)
+	mux.HandleFunc("/lock", serveLock(auth))
+	serveSchedule(mux, scheduler, auth, currentPosition)
+	serveScripts(mux, scripts, auth)
+	mux.HandleFunc("/state/previous", serveState(prevState))
+
+	mux.HandleFunc("/acu/status", serveACUStatus(statusStream))
+	mux.HandleFunc("/acu/status/stream", serveStatusStream(statusStream))
+	mux.HandleFunc("/status", serveStatus(statusStream))
+	serveACUControl(mux, acu)
+	serveACURaw(mux, acu, auditLog)
+	mux.HandleFunc("/acu/parameters", serveMotionParams(motionParams))
+	servePositionBroadcast(mux, positionBroadcast)
+	mux.HandleFunc("/scan-flags/stream", serveScanFlags(tel.flags))
+	mux.HandleFunc("/time-sync", serveTimeSync(timeSync))
+	mux.HandleFunc("/healthz", serveHealth(health, false))
+	mux.HandleFunc("/readyz", serveHealth(health, true))
+	mux.HandleFunc("/metrics", serveMetrics(acu, tracker))
+	mux.HandleFunc("/archive", serveArchive(archiveDir))
+	serveAlarms(mux, alarms)
+
+	serveOffsets(mux, tel.pointing.offsets)
+	servePointingModel(mux, tel.pointing, pointingRuns)
+	serveEncoderZero(mux, acu, encoderZero)
+	serveSoftLimits(mux)
+	serveCatalog(mux)
+	serveTemplates(mux)
+	serveConfig(mux, reload)
+	mux.HandleFunc("/refraction", serveRefraction())
+	mux.HandleFunc("/sun-avoidance", serveSunAvoidance())
+	mux.HandleFunc("/telescope-position", serveTelescopePosition())
+
+	mux.HandleFunc("/tilt", serveTilt(tiltmeter))
+	mux.HandleFunc("/weather", serveWeather(weather))
+	mux.HandleFunc("/wind-stow", serveWindStow(windStow))
+	mux.HandleFunc("/hexapod", serveHexapod(tel.hexapod))
+	serveShutter(mux, tel.shutter)
+	serveTelescopes(mux, instances, auth)
 
 	// start accepting commands
 	server := &http.Server{
 		Addr:         apiAddr,
-		Handler:      mux,
+		Handler:      auth.Handler(mux),
 		ReadTimeout:  connectionTimeout,
 		WriteTimeout: connectionTimeout,
 	}
+
+	// shut down on SIGTERM: stop taking commands, stop or finish the current
+	// one, flush the telemetry, and save what was interrupted
+	shutdownDone := make(chan struct{})
+	term := make(chan os.Signal, 1)
+	signal.Notify(term, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-term
+		signal.Stop(term) // a second signal kills
+		log.Printf("%v: shutting down (shutdown mode %s)", sig, shutdownMode)
+		atomic.StoreInt32(&shuttingDown, 1)
+		ctx, cancel := context.WithTimeout(context.Background(), connectionTimeout)
+		err := server.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Print(err)
+		}
+		state := &TCSState{Shutdown: shutdownMode, Schedule: pendingEntries(scheduler.List())}
+		scheduler.Cancel()
+		scripts.Cancel()
+
+		current := tracker.Current()
+		if shutdownMode == shutdownStop && abortCommand() {
+			log.Print("shutdown: stopping the telescope")
+		}
+		if !dispatcher.Quit(shutdownTimeout) {
+			log.Print("shutdown: timed out waiting for the current command, stopping the telescope")
+			abortCommand()
+			if !dispatcher.Quit(shutdownTimeout) {
+				log.Print("shutdown: timed out waiting for the telescope to stop")
+			}
+		}
+		for _, inst := range instances {
+			if shutdownMode == shutdownStop {
+				inst.dispatcher.Abort()
+			}
+			if !inst.dispatcher.Quit(shutdownTimeout) {
+				log.Printf("shutdown: timed out waiting for telescope %s", inst.config.Name)
+			}
+		}
+		if current != nil {
+			r, _ := tracker.Get(current.ID)
+			if r.State != commandDone {
+				state.Current = &r
+			}
+		}
+
+		if hk != nil {
+			hk.Close()
+		}
+		if archive != nil {
+			err := archive.Close()
+			if err != nil {
+				log.Print(err)
+			}
+		}
+		if stateStore != nil {
+			state.Offsets = tel.pointing.offsets.Get()
+			state.Commands = tracker.List()
+			err := stateStore.Close(state)
+			if err != nil {
+				log.Print(err)
+			} else {
+				log.Printf("shutdown: saved state to %s", stateFile)
+			}
+		}
+		close(shutdownDone)
+	}()
+
 	log.Printf("listening on %s\n", server.Addr)
-	log.Fatal(server.ListenAndServe())
+	err = server.ListenAndServe()
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	<-shutdownDone
+	log.Print("shut down")
 }
@@ -0,0 +1,259 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// Metrics in the Prometheus text exposition format.
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+
+type counter struct {
+	mu    sync.Mutex
+	value float64
+}
+
+func (c *counter) Add(x float64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.value += x
+}
+
+func (c *counter) write(w io.Writer, name string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(w, "%s %s\n", name, formatMetric(c.value))
+}
+
+// a counter with one label
+type counterVec struct {
+	mu     sync.Mutex
+	values map[string]float64
+}
+
+func (c *counterVec) Inc(label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.values == nil {
+		c.values = make(map[string]float64)
+	}
+	c.values[label]++
+}
+
+func (c *counterVec) write(w io.Writer, name, label string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=%q} %s\n", name, label, k, formatMetric(c.values[k]))
+	}
+}
+
+type histogram struct {
+	mu      sync.Mutex
+	buckets []float64 // upper bounds
+	counts  []uint64
+	sum     float64
+	count   uint64
+}
+
+func newHistogram(buckets ...float64) *histogram {
+	return &histogram{buckets: buckets, counts: make([]uint64, len(buckets))}
+}
+
+func (h *histogram) Observe(x float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.buckets {
+		if x <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += x
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name string) {
+	h.writeLabeled(w, name, "")
+}
+
+// writeLabeled writes the histogram with labels, like `stage="check"`.
+func (h *histogram) writeLabeled(w io.Writer, name, labels string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	sep, all := "", ""
+	if labels != "" {
+		sep, all = labels+",", "{"+labels+"}"
+	}
+	for i, b := range h.buckets {
+		fmt.Fprintf(w, "%s_bucket{%sle=\"%s\"} %d\n", name, sep, formatMetric(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{%sle=\"+Inf\"} %d\n", name, sep, h.count)
+	fmt.Fprintf(w, "%s_sum%s %s\n", name, all, formatMetric(h.sum))
+	fmt.Fprintf(w, "%s_count%s %d\n", name, all, h.count)
+}
+
+// a histogram with one label
+type histogramVec struct {
+	mu      sync.Mutex
+	buckets []float64
+	values  map[string]*histogram
+}
+
+func newHistogramVec(buckets ...float64) *histogramVec {
+	return &histogramVec{buckets: buckets, values: make(map[string]*histogram)}
+}
+
+func (h *histogramVec) Observe(label string, x float64) {
+	h.mu.Lock()
+	v := h.values[label]
+	if v == nil {
+		v = newHistogram(h.buckets...)
+		h.values[label] = v
+	}
+	h.mu.Unlock()
+	v.Observe(x)
+}
+
+func (h *histogramVec) write(w io.Writer, name, label string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	keys := make([]string, 0, len(h.values))
+	for k := range h.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		h.values[k].writeLabeled(w, name, fmt.Sprintf("%s=%q", label, k))
+	}
+}
+
+func formatMetric(x float64) string {
+	return strconv.FormatFloat(x, 'g', -1, 64)
+}
+
+func writeMetricHeader(w io.Writer, name, typ, help string) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+}
+
+// Metrics are the TCS metrics, besides those read from the ACU status.
+type Metrics struct {
+	commands       counterVec
+	failures       counterVec
+	acuErrors      counterVec
+	acuLatency     *histogram
+	commandLatency *histogramVec // by stage, see CommandTracker.SetLatency
+	uploads        counterVec    // program track uploads, by result
+	uploadedPoints counter
+}
+
+var tcsMetrics = &Metrics{
+	acuLatency:     newHistogram(.001, .002, .005, .01, .02, .05, .1, .2, .5),
+	commandLatency: newHistogramVec(.001, .01, .1, .5, 1, 2, 5, 10, 30),
+}
+
+// Write writes all the metrics, with the ACU status rec (if not nil),
+// the link health, the drive temperatures, and the number of queued
+// commands.
+func (m *Metrics) Write(w io.Writer, rec *datasets.StatusGeneral8100, link ACULinkStatus, temps TemperatureStatus, queued int) {
+	if rec != nil {
+		gauges := []struct {
+			name, help string
+			value      float64
+		}{
+			{"tcs_azimuth_position_degrees", "Current azimuth.", rec.AzimuthCurrentPosition},
+			{"tcs_elevation_position_degrees", "Current elevation.", rec.ElevationCurrentPosition},
+			{"tcs_azimuth_velocity_degrees_per_second", "Current azimuth velocity.", rec.AzimuthCurrentVelocity},
+			{"tcs_elevation_velocity_degrees_per_second", "Current elevation velocity.", rec.ElevationCurrentVelocity},
+			{"tcs_azimuth_tracking_error_degrees", "Commanded minus current azimuth.", rec.AzimuthCommandedPosition - rec.AzimuthCurrentPosition},
+			{"tcs_elevation_tracking_error_degrees", "Commanded minus current elevation.", rec.ElevationCommandedPosition - rec.ElevationCurrentPosition},
+			{"tcs_program_track_free_stack_positions", "Free program track stack positions.", float64(rec.QtyOfFreeProgramTrackStackPositions)},
+		}
+		for _, g := range gauges {
+			writeMetricHeader(w, g.name, "gauge", g.help)
+			fmt.Fprintf(w, "%s %s\n", g.name, formatMetric(g.value))
+		}
+	}
+
+	if temps.Time != nil {
+		axes := []struct {
+			name  string
+			temps AxisTemperatures
+		}{{"azimuth", temps.Azimuth}, {"elevation", temps.Elevation}}
+		writeMetricHeader(w, "tcs_drive_temperature_celsius", "gauge", "Hottest motor and drive cabinet temperatures.")
+		for _, a := range axes {
+			fmt.Fprintf(w, "tcs_drive_temperature_celsius{axis=%q,location=\"motor\"} %s\n", a.name, formatMetric(a.temps.Motor))
+			fmt.Fprintf(w, "tcs_drive_temperature_celsius{axis=%q,location=\"cabinet\"} %s\n", a.name, formatMetric(a.temps.Cabinet))
+		}
+		writeMetricHeader(w, "tcs_derating_factor", "gauge", "Fraction of the speed and acceleration limits allowed for temperature.")
+		for _, a := range axes {
+			fmt.Fprintf(w, "tcs_derating_factor{axis=%q} %s\n", a.name, formatMetric(a.temps.Derating))
+		}
+	}
+
+	writeMetricHeader(w, "tcs_command_queue_depth", "gauge", "Commands waiting to be run.")
+	fmt.Fprintf(w, "tcs_command_queue_depth %d\n", queued)
+
+	writeMetricHeader(w, "tcs_commands_total", "counter", "Commands accepted, by command.")
+	m.commands.write(w, "tcs_commands_total", "command")
+	writeMetricHeader(w, "tcs_command_failures_total", "counter", "Failed commands, by command.")
+	m.failures.write(w, "tcs_command_failures_total", "command")
+	writeMetricHeader(w, "tcs_command_stage_duration_seconds", "histogram", "Time taken by each stage of submitting and starting a command.")
+	m.commandLatency.write(w, "tcs_command_stage_duration_seconds", "stage")
+
+	writeMetricHeader(w, "tcs_program_track_uploads_total", "counter", "Program track uploads, by result: ok, unverified, retried or failed.")
+	m.uploads.write(w, "tcs_program_track_uploads_total", "result")
+	writeMetricHeader(w, "tcs_program_track_points_uploaded_total", "counter", "Program track points uploaded.")
+	m.uploadedPoints.write(w, "tcs_program_track_points_uploaded_total")
+
+	writeMetricHeader(w, "tcs_acu_request_duration_seconds", "histogram", "ACU request round-trip time.")
+	m.acuLatency.write(w, "tcs_acu_request_duration_seconds")
+	writeMetricHeader(w, "tcs_acu_errors_total", "counter", "Failed ACU requests, by method.")
+	m.acuErrors.write(w, "tcs_acu_errors_total", "method")
+
+	writeMetricHeader(w, "tcs_acu_link_state", "gauge", "ACU link state, 1 for the current state.")
+	for _, state := range []string{linkConnected, linkDegraded, linkDown} {
+		value := 0
+		if link.State == state {
+			value = 1
+		}
+		fmt.Fprintf(w, "tcs_acu_link_state{state=%q} %d\n", state, value)
+	}
+	if link.LastPacketAge >= 0 {
+		writeMetricHeader(w, "tcs_acu_last_packet_age_seconds", "gauge", "Time since the last ACU response.")
+		fmt.Fprintf(w, "tcs_acu_last_packet_age_seconds %s\n", formatMetric(link.LastPacketAge))
+	}
+	writeMetricHeader(w, "tcs_acu_reconnects_total", "counter", "ACU link recoveries after going down.")
+	fmt.Fprintf(w, "tcs_acu_reconnects_total %d\n", link.Reconnects)
+}
+
+// serveMetrics serves the metrics in the Prometheus text format.
+func serveMetrics(acu *ACU, tracker *CommandTracker) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var rec datasets.StatusGeneral8100
+		status := &rec
+		err := acu.StatusGeneral8100Get(&rec)
+		if err != nil {
+			log.Print(err)
+			status = nil // still report the other metrics
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		tcsMetrics.Write(w, status, acu.Link(), siteDerating.Status(), tracker.Count(commandQueued))
+	}
+}
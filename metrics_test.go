@@ -0,0 +1,59 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+func TestMetricsWrite(t *testing.T) {
+	m := &Metrics{acuLatency: newHistogram(.01, .1), commandLatency: newHistogramVec(1, 10)}
+	m.commands.Inc("/track")
+	m.commands.Inc("/track")
+	m.failures.Inc("/track")
+	m.acuLatency.Observe(.005)
+	m.acuLatency.Observe(.05)
+	m.commandLatency.Observe("pattern", 4)
+	m.uploads.Inc("retried")
+	m.uploadedPoints.Add(1500)
+
+	rec := datasets.StatusGeneral8100{AzimuthCommandedPosition: 120.5, AzimuthCurrentPosition: 120}
+	var b bytes.Buffer
+	link := ACULinkStatus{State: linkDegraded, LastPacketAge: 2.5, Reconnects: 1}
+	now := time.Now()
+	temps := TemperatureStatus{Time: &now, Azimuth: AxisTemperatures{Motor: 65, Cabinet: 30, Derating: 0.8}}
+	m.Write(&b, &rec, link, temps, 2)
+	out := b.String()
+	for _, line := range []string{
+		"# TYPE tcs_azimuth_position_degrees gauge",
+		"tcs_azimuth_position_degrees 120",
+		"tcs_azimuth_tracking_error_degrees 0.5",
+		"tcs_command_queue_depth 2",
+		`tcs_commands_total{command="/track"} 2`,
+		`tcs_command_failures_total{command="/track"} 1`,
+		`tcs_acu_request_duration_seconds_bucket{le="0.01"} 1`,
+		`tcs_acu_request_duration_seconds_bucket{le="0.1"} 2`,
+		`tcs_acu_request_duration_seconds_bucket{le="+Inf"} 2`,
+		"tcs_acu_request_duration_seconds_count 2",
+		`tcs_command_stage_duration_seconds_bucket{stage="pattern",le="1"} 0`,
+		`tcs_command_stage_duration_seconds_bucket{stage="pattern",le="10"} 1`,
+		`tcs_command_stage_duration_seconds_sum{stage="pattern"} 4`,
+		`tcs_command_stage_duration_seconds_count{stage="pattern"} 1`,
+		`tcs_program_track_uploads_total{result="retried"} 1`,
+		"tcs_program_track_points_uploaded_total 1500",
+		`tcs_acu_link_state{state="connected"} 0`,
+		`tcs_acu_link_state{state="degraded"} 1`,
+		"tcs_acu_last_packet_age_seconds 2.5",
+		"tcs_acu_reconnects_total 1",
+		`tcs_drive_temperature_celsius{axis="azimuth",location="motor"} 65`,
+		`tcs_drive_temperature_celsius{axis="azimuth",location="cabinet"} 30`,
+		`tcs_derating_factor{axis="azimuth"} 0.8`,
+	} {
+		if !strings.Contains(out, line+"\n") {
+			t.Errorf("missing %q in:\n%s", line, out)
+		}
+	}
+}
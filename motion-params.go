@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ACU enforces its own axis limits. Where ours are looser, commands
+// we accept are clipped by the ACU and it falls behind the pattern. The
+// MotionParams monitor reads the ACU's parameters, caches them, and
+// refuses motion commands while our limits exceed them. Our limits may
+// be tighter: the config can lower them deliberately.
+
+const (
+	motionParamsInterval = time.Minute
+	motionParamsTol      = 1e-6
+)
+
+// ACUAxisParameters are an axis' parameters as configured in the ACU
+// (see capParameters).
+type ACUAxisParameters struct {
+	AxisLimits
+	GearRatio             float64 `json:"gear_ratio"`
+	PositionLoopGain      float64 `json:"position_loop_gain"`      // [1/s]
+	VelocityLoopGain      float64 `json:"velocity_loop_gain"`      // [A s/deg]
+	VelocityIntegralTime  float64 `json:"velocity_integral_time"`  // [s]
+	FollowingErrorTimeout float64 `json:"following_error_timeout"` // [s]
+}
+
+// ACUParameters are the ACU's motion parameters.
+type ACUParameters struct {
+	Azimuth   ACUAxisParameters `json:"azimuth"`
+	Elevation ACUAxisParameters `json:"elevation"`
+}
+
+// MotionParamsStatus compares our limits with the ACU's.
+type MotionParamsStatus struct {
+	ACU        *ACUParameters `json:"acu,omitempty"`  // nil if not read yet
+	Time       *time.Time     `json:"time,omitempty"` // when read
+	Azimuth    AxisLimits     `json:"azimuth"`        // ours
+	Elevation  AxisLimits     `json:"elevation"`
+	Mismatches []string       `json:"mismatches,omitempty"`
+	Error      string         `json:"error,omitempty"` // reading the ACU's
+}
+
+// A MotionParams monitors the ACU's motion parameters. It is safe for
+// concurrent use.
+type MotionParams struct {
+	acu    *ACU
+	alarms *Alarms
+
+	mu     sync.Mutex
+	params *ACUParameters
+	time   time.Time
+	err    error
+}
+
+func NewMotionParams(acu *ACU, alarms *Alarms) *MotionParams {
+	return &MotionParams{acu: acu, alarms: alarms}
+}
+
+func (m *MotionParams) Run() {
+	for {
+		err := m.Refresh()
+		m.alarms.Set(err != nil, "motion_params", severityWarning, false, "can't read ACU motion parameters: %v", err)
+		err = m.Check()
+		m.alarms.Set(err != nil, "motion_params_mismatch", severityCritical, false, "%v", err)
+		time.Sleep(motionParamsInterval)
+	}
+}
+
+// Refresh re-reads the ACU's parameters, keeping the last ones on error.
+func (m *MotionParams) Refresh() error {
+	var p ACUParameters
+	err := m.acu.ParametersGet(&p)
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.err = err
+	if err != nil {
+		return err
+	}
+	if m.params != nil && *m.params != p {
+		log.Printf("ACU motion parameters changed: %+v", p)
+	}
+	m.params, m.time = &p, time.Now()
+	return nil
+}
+
+func (m *MotionParams) Status() MotionParamsStatus {
+	status := MotionParamsStatus{
+		Azimuth:   AxisLimits{azimuthMin, azimuthMax, azimuthSpeedMax, azimuthAccelMax, azimuthJerkMax},
+		Elevation: AxisLimits{elevationMin, elevationMax, elevationSpeedMax, elevationAccelMax, elevationJerkMax},
+	}
+	m.mu.Lock()
+	if m.params != nil {
+		p, t := *m.params, m.time
+		status.ACU, status.Time = &p, &t
+	}
+	if m.err != nil {
+		status.Error = m.err.Error()
+	}
+	m.mu.Unlock()
+	if status.ACU != nil {
+		status.Mismatches = append(
+			compareAxisLimits("azimuth", status.Azimuth, status.ACU.Azimuth.AxisLimits),
+			compareAxisLimits("elevation", status.Elevation, status.ACU.Elevation.AxisLimits)...)
+	}
+	return status
+}
+
+// Check checks our limits are within the ACU's, for starting a motion
+// command. Parameters not read yet are assumed good.
+func (m *MotionParams) Check() error {
+	status := m.Status()
+	if len(status.Mismatches) > 0 {
+		return fmt.Errorf("limits exceed the ACU's: %s", strings.Join(status.Mismatches, "; "))
+	}
+	return nil
+}
+
+// compareAxisLimits lists where our limits exceed the ACU's. The ACU
+// reports 0 for limits not set.
+func compareAxisLimits(axis string, ours, acu AxisLimits) []string {
+	var mismatches []string
+	if acu.Min != 0 || acu.Max != 0 {
+		if ours.Min < acu.Min-motionParamsTol {
+			mismatches = append(mismatches, fmt.Sprintf("%s min %g < %g", axis, ours.Min, acu.Min))
+		}
+		if ours.Max > acu.Max+motionParamsTol {
+			mismatches = append(mismatches, fmt.Sprintf("%s max %g > %g", axis, ours.Max, acu.Max))
+		}
+	}
+	for _, lim := range []struct {
+		name      string
+		ours, acu float64
+	}{
+		{"speed", ours.SpeedMax, acu.SpeedMax},
+		{"acceleration", ours.AccelMax, acu.AccelMax},
+		{"jerk", ours.JerkMax, acu.JerkMax},
+	} {
+		if lim.acu != 0 && lim.ours > lim.acu+motionParamsTol {
+			mismatches = append(mismatches, fmt.Sprintf("%s %s max %g > %g", axis, lim.name, lim.ours, lim.acu))
+		}
+	}
+	return mismatches
+}
+
+// serveMotionParams serves the ACU motion parameters, re-reading them on POST.
+func serveMotionParams(m *MotionParams) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+		case "POST":
+			// re-read them, e.g. after changing the ACU's settings
+			m.Refresh()
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		status := m.Status()
+		err := json.NewEncoder(w).Encode(&status)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestMotionParams(t *testing.T) {
+	sim, acu, _ := newTestSimulator(t, 100, 40)
+	m := NewMotionParams(acu, NewAlarms())
+	if err := m.Check(); err != nil {
+		t.Errorf("expected parameters not read yet to pass, got %v", err)
+	}
+	if err := m.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	status := m.Status()
+	if status.ACU == nil || status.ACU.Elevation.SpeedMax != elevationSpeedMax || status.ACU.Azimuth.GearRatio != 1 {
+		t.Errorf("got %+v", status.ACU)
+	}
+	if err := m.Check(); err != nil {
+		t.Error(err)
+	}
+
+	sim.mu.Lock()
+	sim.axes[1].vmax = elevationSpeedMax / 2
+	sim.axes[0].max = azimuthMax - 10
+	sim.axes[0].jmax = 0 // not set
+	sim.mu.Unlock()
+	if err := m.Refresh(); err != nil {
+		t.Fatal(err)
+	}
+	err := m.Check()
+	if err == nil || !strings.Contains(err.Error(), "elevation speed max") ||
+		!strings.Contains(err.Error(), "azimuth max") || strings.Contains(err.Error(), "jerk") {
+		t.Errorf("got %v", err)
+	}
+}
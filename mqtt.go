@@ -0,0 +1,197 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// A minimal client side implementation of MQTT 3.1.1, enough to publish
+// and subscribe at QoS 0 without an external dependency. Sessions are
+// clean, and there are no wills.
+
+const (
+	mqttConnectTimeout = 5 * time.Second
+	mqttWriteTimeout   = 5 * time.Second
+	mqttMaxPacket      = maxCommandSize + 1<<16 // bytes, for commands
+
+	mqttConnect    = 1
+	mqttConnAck    = 2
+	mqttPublish    = 3
+	mqttSubscribe  = 8
+	mqttSubAck     = 9
+	mqttPingReq    = 12
+	mqttPingResp   = 13
+	mqttDisconnect = 14
+)
+
+type mqttConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+	mu   sync.Mutex // serializes writes
+}
+
+// dialMQTT connects to the broker at addr, with a clean session.
+// The broker drops the connection if nothing is sent for 1.5 keepAlive.
+func dialMQTT(addr, clientID, username, password string, keepAlive time.Duration) (*mqttConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, mqttConnectTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &mqttConn{conn: conn, r: bufio.NewReader(conn)}
+
+	var b []byte
+	b = appendMQTTString(b, "MQTT")
+	flags := byte(0x02) // clean session
+	if username != "" {
+		flags |= 0x80
+	}
+	if password != "" {
+		flags |= 0x40
+	}
+	b = append(b, 4, flags) // protocol level 3.1.1
+	ka := uint16(keepAlive.Seconds())
+	b = append(b, byte(ka>>8), byte(ka))
+	b = appendMQTTString(b, clientID)
+	if username != "" {
+		b = appendMQTTString(b, username)
+	}
+	if password != "" {
+		b = appendMQTTString(b, password)
+	}
+	conn.SetDeadline(time.Now().Add(mqttConnectTimeout))
+	err = c.write(mqttConnect<<4, b)
+	if err == nil {
+		var typ byte
+		typ, b, err = c.readPacket()
+		switch {
+		case err != nil:
+		case typ>>4 != mqttConnAck || len(b) != 2:
+			err = fmt.Errorf("mqtt: expected CONNACK")
+		case b[1] != 0:
+			err = fmt.Errorf("mqtt: connection refused (return code %d)", b[1])
+		}
+	}
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return c, nil
+}
+
+func appendMQTTString(b []byte, s string) []byte {
+	b = append(b, byte(len(s)>>8), byte(len(s)))
+	return append(b, s...)
+}
+
+// write sends a packet with the given first byte (type and flags).
+func (c *mqttConn) write(first byte, body []byte) error {
+	hdr := []byte{first}
+	n := len(body)
+	for {
+		d := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			d |= 0x80
+		}
+		hdr = append(hdr, d)
+		if n == 0 {
+			break
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(mqttWriteTimeout))
+	_, err := c.conn.Write(append(hdr, body...))
+	return err
+}
+
+// readPacket reads a packet, returning its first byte and the rest.
+func (c *mqttConn) readPacket() (byte, []byte, error) {
+	first, err := c.r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+	n, shift := 0, 0
+	for {
+		d, err := c.r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		n |= int(d&0x7f) << shift
+		if d&0x80 == 0 {
+			break
+		}
+		shift += 7
+		if shift > 21 {
+			return 0, nil, fmt.Errorf("mqtt: bad remaining length")
+		}
+	}
+	if n > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("mqtt: %d byte packet too large", n)
+	}
+	b := make([]byte, n)
+	_, err = io.ReadFull(c.r, b)
+	return first, b, err
+}
+
+func (c *mqttConn) Publish(topic string, payload []byte, retain bool) error {
+	first := byte(mqttPublish << 4)
+	if retain {
+		first |= 0x01
+	}
+	b := appendMQTTString(nil, topic)
+	return c.write(first, append(b, payload...))
+}
+
+// Subscribe subscribes to the topic filter, e.g. "fyst/tcs/command/#".
+// The broker's acknowledgement is skipped by Receive.
+func (c *mqttConn) Subscribe(filter string) error {
+	b := []byte{0, 1} // packet identifier
+	b = appendMQTTString(b, filter)
+	return c.write(mqttSubscribe<<4|0x02, append(b, 0)) // QoS 0
+}
+
+func (c *mqttConn) Ping() error {
+	return c.write(mqttPingReq<<4, nil)
+}
+
+// Receive returns the next message published to a subscribed topic.
+func (c *mqttConn) Receive() (string, []byte, error) {
+	for {
+		first, b, err := c.readPacket()
+		if err != nil {
+			return "", nil, err
+		}
+		switch first >> 4 {
+		case mqttSubAck, mqttPingResp:
+			continue
+		case mqttPublish:
+		default:
+			return "", nil, fmt.Errorf("mqtt: unexpected packet type %d", first>>4)
+		}
+		if len(b) < 2 {
+			return "", nil, fmt.Errorf("mqtt: short PUBLISH")
+		}
+		n := int(binary.BigEndian.Uint16(b))
+		if len(b) < 2+n {
+			return "", nil, fmt.Errorf("mqtt: short PUBLISH")
+		}
+		topic, payload := string(b[2:2+n]), b[2+n:]
+		if qos := (first >> 1) & 3; qos != 0 {
+			// only QoS 0 is subscribed to, so the broker shouldn't send more
+			return "", nil, fmt.Errorf("mqtt: unexpected QoS %d", qos)
+		}
+		return topic, payload, nil
+	}
+}
+
+func (c *mqttConn) Close() error {
+	c.write(mqttDisconnect<<4, nil)
+	return c.conn.Close()
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/smtp"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	notifyTimeout         = 10 * time.Second
+	defaultNotifyInterval = 10 * time.Minute
+)
+
+// A NotifyRoute sends alarms of at least MinSeverity somewhere:
+//
+//	{"type": "slack", "url": "https://hooks.slack.com/services/...", "min_severity": "critical"}
+//	{"type": "webhook", "url": "https://...", "min_severity": "warning"}
+//	{"type": "email", "smtp": "mail:25", "from": "tcs@...", "to": ["oncall@..."], "min_severity": "critical"}
+//
+// The same alarm is sent at most once per Interval (Go duration, default 10m).
+type NotifyRoute struct {
+	Type        string   `json:"type"`
+	URL         string   `json:"url,omitempty"`
+	SMTP        string   `json:"smtp,omitempty"`
+	Username    string   `json:"username,omitempty"` // SMTP PLAIN auth, if set
+	Password    string   `json:"password,omitempty"`
+	From        string   `json:"from,omitempty"`
+	To          []string `json:"to,omitempty"`
+	MinSeverity Severity `json:"min_severity"`
+	Interval    string   `json:"interval,omitempty"`
+
+	interval time.Duration
+}
+
+func (r *NotifyRoute) check() error {
+	switch r.Type {
+	case "slack", "webhook":
+		if r.URL == "" {
+			return fmt.Errorf("%s notifier: url required", r.Type)
+		}
+	case "email":
+		if r.SMTP == "" || r.From == "" || len(r.To) == 0 {
+			return fmt.Errorf("email notifier: smtp, from, and to required")
+		}
+	default:
+		return fmt.Errorf("unknown notifier type %q", r.Type)
+	}
+	r.interval = defaultNotifyInterval
+	if r.Interval != "" {
+		d, err := time.ParseDuration(r.Interval)
+		if err != nil {
+			return err
+		}
+		r.interval = d
+	}
+	return nil
+}
+
+// A Notifier sends alarm events to its routes.
+type Notifier struct {
+	routes []NotifyRoute
+	client *http.Client
+
+	mu   sync.Mutex
+	sent map[string]time.Time // by route index and alarm name
+}
+
+func LoadNotifier(filename string) (*Notifier, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var routes []NotifyRoute
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&routes)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	for i := range routes {
+		err := routes[i].check()
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+	}
+	return &Notifier{
+		routes: routes,
+		client: &http.Client{Timeout: notifyTimeout},
+		sent:   make(map[string]time.Time),
+	}, nil
+}
+
+// Notify sends a raised alarm to the routes it's severe enough for,
+// unless they've had it recently. It doesn't block.
+func (n *Notifier) Notify(e AlarmEvent) {
+	if e.Event != "raised" {
+		return
+	}
+	for i := range n.routes {
+		r := &n.routes[i]
+		if e.Alarm.Severity < r.MinSeverity || !n.due(i, r, e) {
+			continue
+		}
+		go func() {
+			err := n.send(r, e)
+			if err != nil {
+				log.Printf("notify %s: %v", r.Type, err)
+			}
+		}()
+	}
+}
+
+// due checks the rate limit.
+func (n *Notifier) due(i int, r *NotifyRoute, e AlarmEvent) bool {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	key := fmt.Sprintf("%d/%s", i, e.Alarm.Name)
+	if last, ok := n.sent[key]; ok && e.Time.Sub(last) < r.interval {
+		return false
+	}
+	n.sent[key] = e.Time
+	return true
+}
+
+func alarmText(a Alarm) string {
+	return fmt.Sprintf("[%s] %s: %s", strings.ToUpper(a.Severity.String()), a.Name, a.Message)
+}
+
+func (n *Notifier) send(r *NotifyRoute, e AlarmEvent) error {
+	switch r.Type {
+	case "slack":
+		return n.post(r.URL, map[string]string{"text": "FYST TCS " + alarmText(e.Alarm)})
+	case "webhook":
+		return n.post(r.URL, e)
+	case "email":
+		var auth smtp.Auth
+		if r.Username != "" {
+			host := strings.Split(r.SMTP, ":")[0]
+			auth = smtp.PlainAuth("", r.Username, r.Password, host)
+		}
+		msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: FYST TCS %s\r\n\r\n%s\r\nRaised at %s\r\n",
+			r.From, strings.Join(r.To, ", "), alarmText(e.Alarm), e.Alarm.Message,
+			e.Alarm.Raised.UTC().Format(time.RFC3339))
+		return smtp.SendMail(r.SMTP, auth, r.From, r.To, []byte(msg))
+	}
+	return fmt.Errorf("unknown notifier type %q", r.Type)
+}
+
+func (n *Notifier) post(url string, v interface{}) error {
+	b, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	resp, err := n.client.Post(url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("%s: %s", url, resp.Status)
+	}
+	return nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestNotifier(t *testing.T) {
+	got := make(chan AlarmEvent, 10)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		var e AlarmEvent
+		err := json.NewDecoder(req.Body).Decode(&e)
+		if err != nil {
+			t.Error(err)
+		}
+		got <- e
+	}))
+	defer server.Close()
+
+	filename := filepath.Join(t.TempDir(), "notify.json")
+	config := `[{"type": "webhook", "url": "` + server.URL + `", "min_severity": "critical", "interval": "1h"}]`
+	err := os.WriteFile(filename, []byte(config), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, err := LoadNotifier(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := NewAlarms()
+	a.OnEvent(n.Notify)
+	a.Raise("warm", severityWarning, false, "warm")          // not severe enough
+	a.Raise("fault", severityCritical, true, "fault bits 1") // sent
+	a.Clear("fault")                                         // not a raise
+	a.Acknowledge("", "bob")
+	a.Raise("fault", severityCritical, true, "fault bits 1") // rate limited
+
+	select {
+	case e := <-got:
+		if e.Alarm.Name != "fault" || e.Alarm.Severity != severityCritical {
+			t.Errorf("Notify: got %+v", e)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Notify: timed out")
+	}
+	select {
+	case e := <-got:
+		t.Errorf("Notify: unexpected %+v", e)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+)
+
+// offset registers, in the order they're reported
+var offsetNames = []string{
+	"pointing",  // pointing model residual
+	"boresight", // receiver boresight
+	"user",      // per-observation user offset
+}
+
+type AzElOffset struct {
+	Az float64 `json:"azimuth"`
+	El float64 `json:"elevation"`
+}
+
+// Offsets holds named az/el offset registers, whose sum is applied
+// to all commanded positions. It is safe for concurrent use.
+type Offsets struct {
+	mu       sync.Mutex
+	regs     map[string]AzElOffset
+	onChange func()
+}
+
+func NewOffsets() *Offsets {
+	return &Offsets{
+		regs: make(map[string]AzElOffset),
+	}
+}
+
+func checkOffsetName(name string) error {
+	for _, x := range offsetNames {
+		if name == x {
+			return nil
+		}
+	}
+	return fmt.Errorf("bad offset name: %s", name)
+}
+
+// OnChange calls fn, which mustn't block, after each change.
+// It must be set before the offsets are used.
+func (o *Offsets) OnChange(fn func()) {
+	o.onChange = fn
+}
+
+// Set sets the named register.
+func (o *Offsets) Set(name string, off AzElOffset) error {
+	err := checkOffsetName(name)
+	if err != nil {
+		return err
+	}
+	o.mu.Lock()
+	o.regs[name] = off
+	o.mu.Unlock()
+	if o.onChange != nil {
+		o.onChange()
+	}
+	return nil
+}
+
+// Clear zeros the named register.
+func (o *Offsets) Clear(name string) error {
+	return o.Set(name, AzElOffset{})
+}
+
+// Get returns a copy of all the registers.
+func (o *Offsets) Get() map[string]AzElOffset {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	regs := make(map[string]AzElOffset, len(offsetNames))
+	for _, name := range offsetNames {
+		regs[name] = o.regs[name]
+	}
+	return regs
+}
+
+// Total returns the sum of all the registers.
+func (o *Offsets) Total() AzElOffset {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	var total AzElOffset
+	for _, off := range o.regs {
+		total.Az += off.Az
+		total.El += off.El
+	}
+	return total
+}
+
+// serveOffsets serves the pointing offset registers.
+func serveOffsets(mux *http.ServeMux, offsets *Offsets) {
+	mux.HandleFunc("/offsets", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Registers map[string]AzElOffset `json:"registers"`
+				Total     AzElOffset            `json:"total"`
+			}
+			response.Registers = offsets.Get()
+			response.Total = offsets.Total()
+			err := json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Name string `json:"name"`
+				AzElOffset
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil {
+				log.Printf("setting %s offset: %+v", x.Name, x.AzElOffset)
+				err = offsets.Set(x.Name, x.AzElOffset)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/offsets/clear", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Name string `json:"name"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			log.Printf("clearing %s offset", x.Name)
+			err = offsets.Clear(x.Name)
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
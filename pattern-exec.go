@@ -0,0 +1,387 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"runtime/debug"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+const (
+	// time between resuming a paused pattern and its next point
+	resumeLeadTime = 5 * time.Second
+
+	// the stack is about to underrun if the uploaded points run out this soon
+	underrunMargin = 10 * time.Second
+
+	// times the upload is restarted to recover from an underrun
+	maxUnderrunRecoveries = 3
+)
+
+// how long to wait for the upload goroutine to exit
+var uploadStopTimeout = 10 * time.Second
+
+// An uploadProgress records how much of a pattern has been uploaded.
+// It is written by the upload goroutine and read by the command loop.
+type uploadProgress struct {
+	mu    sync.Mutex
+	lastT time.Time // time of the last uploaded point
+	n     int       // points uploaded
+	done  bool      // all points uploaded
+}
+
+func (p *uploadProgress) add(lastT time.Time, n int, done bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.lastT = lastT
+	p.n += n
+	p.done = done
+}
+
+func (p *uploadProgress) get() (time.Time, bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.lastT, p.done
+}
+
+func (p *uploadProgress) count() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.n
+}
+
+// A patternExec tracks the execution of a scan pattern by the ACU.
+// It is only accessed from the command loop; the upload goroutine
+// reports back through uploadErr.
+type patternExec struct {
+	ctx       context.Context
+	tel       *Telescope
+	pattern   ScanPattern
+	cancel    context.CancelFunc
+	uploadErr chan error
+	uploaded  chan struct{} // closed when the upload goroutine exits
+	progress  *uploadProgress
+	pausedAt  time.Time     // zero unless paused
+	delay     time.Duration // accumulated delay from pauses
+	summary   *DryRun       // of the whole pattern, for progress
+	consumed  int           // points consumed before the last pause
+	leadIn    int           // points in the lead-in uploaded since the last start
+	flagger   *scanFlagger
+	recovered int    // underrun recoveries
+	axis      string // driven, "" for both
+}
+
+// A PatternProgress is how far the ACU has got through a pattern.
+type PatternProgress struct {
+	Points    int        `json:"points"`
+	Uploaded  int        `json:"uploaded"`
+	Consumed  int        `json:"consumed"`             // by the ACU
+	Percent   float64    `json:"percent"`              // of the points consumed
+	Sweep     int        `json:"sweep,omitempty"`      // current sweep, from 1
+	NumSweeps int        `json:"num_sweeps,omitempty"` // if more than one
+	ETA       *time.Time `json:"eta,omitempty"`
+}
+
+// StartPattern starts executing pattern, tagging its scan flags with tags.
+// Only axis, "azimuth" or "elevation", follows the pattern, leaving the
+// other in its current mode, unless axis is "".
+func (t *Telescope) StartPattern(ctx context.Context, pattern ScanPattern, tags map[string]string, axis string) (*patternExec, error) {
+	t0 := time.Now()
+	summary := &DryRun{}
+	_, err := summary.summarizePattern(pattern)
+	if err != nil {
+		return nil, err
+	}
+	commandSteps(ctx).Latency(latencyPattern, time.Since(t0))
+	exec := &patternExec{
+		ctx:     ctx,
+		tel:     t,
+		pattern: pattern,
+		summary: summary,
+		flagger: &scanFlagger{flags: t.flags, tags: tags},
+		axis:    axis,
+	}
+	err = exec.start(pattern)
+	if err != nil {
+		return nil, err
+	}
+	t.pattern = exec
+	return exec, nil
+}
+
+// PausePattern stops feeding the current pattern to the ACU and lets
+// the telescope coast to a stop.
+func (t *Telescope) PausePattern() error {
+	if t.pattern == nil {
+		return fmt.Errorf("no pattern to pause")
+	}
+	return t.pattern.pause()
+}
+
+// ResumePattern resumes a paused pattern from where it left off,
+// delaying the remaining points by the time spent paused.
+func (t *Telescope) ResumePattern() error {
+	if t.pattern == nil {
+		return fmt.Errorf("no pattern to resume")
+	}
+	return t.pattern.resume()
+}
+
+func (exec *patternExec) start(pattern ScanPattern) error {
+	tel := exec.tel
+
+	// lead in from where the telescope is, if there's time to
+	exec.leadIn, exec.flagger.start = 0, time.Time{}
+	from, err := tel.leadInStart(time.Now())
+	var leadIn *LeadInScanPattern
+	if err == nil {
+		leadIn, err = NewLeadInScanPattern(from, pattern)
+	}
+	if err != nil {
+		log.Printf("starting pattern without a lead-in: %v", err)
+	} else {
+		err = siteSunAvoidance.CheckPattern(leadIn.leadIn)
+		if err != nil {
+			return fmt.Errorf("lead-in: %w", err)
+		}
+		pattern = leadIn
+		exec.leadIn, exec.flagger.start = leadIn.points(), leadIn.start
+	}
+
+	// ICD Section 9.1: "Before commanding or setting up a new mode,
+	// it is best practice to set the antenna to Stop mode first."
+	t0 := time.Now()
+	err = tel.setMode(exec.axis, "Stop")
+	if err != nil {
+		return err
+	}
+
+	err = tel.acu.ProgramTrackClear()
+	if err != nil {
+		return err
+	}
+	time.Sleep(3 * time.Millisecond) // wait for ProgramTrackClear to take effect
+	modeChange := time.Since(t0)
+
+	exec.progress = &uploadProgress{}
+	exec.upload(pattern)
+
+	t0 = time.Now()
+	err = tel.setMode(exec.axis, "ProgramTrack")
+	commandSteps(exec.ctx).Latency(latencyModeChange, modeChange+time.Since(t0))
+	return err
+}
+
+// upload starts a goroutine uploading pattern, adding to exec.progress.
+// Its error, including a panic, is reported to IsDone through uploadErr.
+func (exec *patternExec) upload(pattern ScanPattern) {
+	// buffered so the goroutine can exit after we stop listening
+	uploadErr := make(chan error, 1)
+	uploaded := make(chan struct{})
+	ctx, cancel := context.WithCancel(exec.ctx)
+	tel, progress, flagger := exec.tel, exec.progress, exec.flagger
+	go func() {
+		defer close(uploaded)
+		var err error
+		defer func() {
+			if r := recover(); r != nil {
+				err = fmt.Errorf("panic: %v", r)
+				commandLogger(ctx).Printf("upload %v\n%s", err, debug.Stack())
+			}
+			if err != nil {
+				flagger.end(time.Now())
+			}
+			uploadErr <- err
+		}()
+		err = tel.UploadScanPattern(ctx, pattern, progress, flagger)
+	}()
+	exec.cancel = cancel
+	exec.uploadErr = uploadErr
+	exec.uploaded = uploaded
+}
+
+func (exec *patternExec) pause() error {
+	if !exec.pausedAt.IsZero() {
+		return fmt.Errorf("pattern already paused")
+	}
+	if _, ok := exec.pattern.(DelayableScanPattern); !ok {
+		return fmt.Errorf("pattern can't be paused")
+	}
+	log.Print("pausing pattern")
+	now := time.Now()
+	exec.consumed = exec.Progress(exec.tel.Status(), now).Consumed
+	exec.pausedAt = now
+	return exec.stop()
+}
+
+// stopUpload cancels the upload goroutine and waits for it to exit,
+// so it can't add points after the stack is cleared.
+func (exec *patternExec) stopUpload() error {
+	exec.cancel()
+	select {
+	case <-exec.uploaded:
+		return nil
+	case <-time.After(uploadStopTimeout):
+		return fmt.Errorf("upload failed to stop")
+	}
+}
+
+// stop stops the telescope, then the upload, and clears the program
+// track stack. The telescope is stopped first, so a stuck upload
+// can't keep it moving.
+func (exec *patternExec) stop() error {
+	err := exec.tel.setMode(exec.axis, "Stop")
+	if uerr := exec.stopUpload(); uerr != nil {
+		return uerr
+	}
+	exec.flagger.end(time.Now())
+	if err != nil {
+		return err
+	}
+	return exec.tel.acu.ProgramTrackClear()
+}
+
+func (exec *patternExec) resume() error {
+	if exec.pausedAt.IsZero() {
+		return fmt.Errorf("pattern not paused")
+	}
+	t1 := time.Now().Add(resumeLeadTime)
+	exec.delay += t1.Sub(exec.pausedAt)
+	log.Printf("resuming pattern, delayed by %v", exec.delay)
+	pattern := exec.pattern.(DelayableScanPattern).Delay(exec.delay)
+	exec.pausedAt = time.Time{}
+	return exec.start(NewResumedScanPattern(pattern, t1))
+}
+
+func (exec *patternExec) IsDone(rec *datasets.StatusGeneral8100) (bool, error) {
+	if !exec.pausedAt.IsZero() {
+		return false, nil
+	}
+
+	// a failed upload fails the pattern, stopping the telescope
+	// rather than leaving it to run out of points
+	select {
+	default:
+	case err := <-exec.uploadErr:
+		if err != nil {
+			commandLogger(exec.ctx).Printf("upload failed, stopping: %v", err)
+			if serr := exec.stop(); serr != nil {
+				commandLogger(exec.ctx).Printf("failed to stop: %v", serr)
+			}
+			return true, fmt.Errorf("upload: %w", err)
+		}
+	}
+
+	// done once the last point has passed and the telescope has stopped
+	lastT, uploaded := exec.progress.get()
+	if !uploaded {
+		return false, nil
+	}
+	now := time.Now()
+	if rec.Year >= minStatusTimeYear {
+		now = StatusTime2Time(rec.Year, rec.Time)
+	}
+	tol := currentConfig().SpeedTolerance
+	azDone := (math.Abs(rec.AzimuthCurrentVelocity) < tol) &&
+		(rec.AzimuthMode == datasets.AzimuthModeProgramTrack)
+	elDone := (math.Abs(rec.ElevationCurrentVelocity) < tol) &&
+		(rec.ElevationMode == datasets.ElevationModeProgramTrack)
+	done := now.After(lastT) &&
+		(azDone || exec.axis == "elevation") &&
+		(elDone || exec.axis == "azimuth")
+	return done, nil
+}
+
+// CheckUnderrun raises an alarm if the program track stack is about to
+// run out, or has run out, of points before the whole pattern has been
+// uploaded, which would stop the telescope mid-pattern. It recovers by
+// restarting the upload from the next point on the stack, or failing
+// that, far enough ahead to reach the ACU in time; after
+// maxUnderrunRecoveries, the alarm is critical and the pattern is left
+// to end.
+func (exec *patternExec) CheckUnderrun(rec *datasets.StatusGeneral8100, now time.Time, alarms *Alarms) error {
+	const name = "program_track_underrun"
+	if !exec.pausedAt.IsZero() {
+		alarms.Clear(name)
+		return nil
+	}
+	lastT, uploaded := exec.progress.get()
+	queued := maxFreeProgramTrackStack - int(rec.QtyOfFreeProgramTrackStackPositions)
+	if uploaded || exec.progress.count() == 0 || (queued > 0 && lastT.Sub(now) > underrunMargin) {
+		alarms.Clear(name)
+		return nil
+	}
+	logger := commandLogger(exec.ctx)
+	if exec.recovered >= maxUnderrunRecoveries {
+		alarms.Raise(name, severityCritical, false, "program track stack underrun (%d points queued, the last at %s), recovery failed",
+			queued, lastT.UTC().Format(time.RFC3339))
+		return nil
+	}
+	alarms.Raise(name, severityWarning, false, "program track stack underrun (%d points queued, the last at %s), restarting the upload",
+		queued, lastT.UTC().Format(time.RFC3339))
+	exec.recovered++
+	logger.Printf("program track stack underrun: %d points queued, the last at %s; restarting the upload (attempt %d)",
+		queued, lastT.UTC().Format(time.RFC3339), exec.recovered)
+
+	err := exec.stopUpload()
+	if err != nil {
+		return err
+	}
+	lastT, _ = exec.progress.get()
+	tmin := now.Add(resumeLeadTime)
+	if queued > 0 && lastT.After(now) {
+		tmin = lastT.Add(time.Nanosecond)
+	}
+	pattern := exec.pattern
+	if exec.delay != 0 {
+		pattern = pattern.(DelayableScanPattern).Delay(exec.delay)
+	}
+	exec.upload(NewResumedScanPattern(pattern, tmin))
+	return nil
+}
+
+// Progress reports the pattern's progress at now, given the ACU status
+// rec. Points still on the program track stack haven't been consumed,
+// and the lead-in's points aren't counted.
+func (exec *patternExec) Progress(rec *datasets.StatusGeneral8100, now time.Time) PatternProgress {
+	d := exec.summary
+	p := PatternProgress{
+		Points:    d.Points,
+		Consumed:  exec.consumed,
+		NumSweeps: d.NumSweeps,
+	}
+	delay := exec.delay
+	if exec.pausedAt.IsZero() {
+		n := exec.progress.count()
+		queued := maxFreeProgramTrackStack - int(rec.QtyOfFreeProgramTrackStackPositions)
+		if queued < 0 {
+			queued = 0
+		} else if queued > n {
+			queued = n
+		}
+		p.Uploaded = exec.consumed + n - minInt(exec.leadIn, n)
+		p.Consumed += n - queued - minInt(exec.leadIn, n-queued)
+	} else {
+		p.Uploaded = exec.consumed
+		delay += now.Sub(exec.pausedAt)
+	}
+	if p.Points > 0 {
+		p.Percent = 100 * float64(p.Consumed) / float64(p.Points)
+	}
+	if p.NumSweeps > 0 {
+		for _, t := range d.sweeps {
+			if t.Add(delay).After(now) {
+				break
+			}
+			p.Sweep++
+		}
+	}
+	eta := d.Stop.Add(delay)
+	p.ETA = &eta
+	return p
+}
@@ -0,0 +1,227 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+func TestPatternExecIsDone(t *testing.T) {
+	t0 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	acu := newFakeACU(120, 60)
+	exec := &patternExec{
+		ctx:       context.Background(),
+		tel:       NewTelescope(acu),
+		uploadErr: make(chan error, 1),
+		progress:  &uploadProgress{},
+		flagger:   &scanFlagger{flags: NewScanFlags()},
+		cancel:    func() {},
+		uploaded:  make(chan struct{}),
+	}
+	close(exec.uploaded)
+	rec := datasets.StatusGeneral8100{
+		AzimuthMode:   datasets.AzimuthModeProgramTrack,
+		ElevationMode: datasets.ElevationModeProgramTrack,
+	}
+	at := func(t time.Time) *datasets.StatusGeneral8100 {
+		rec.Year, rec.Time = statusTime(t)
+		return &rec
+	}
+
+	exec.progress.add(t0, 1, false)
+	if done, _ := exec.IsDone(at(t0.Add(time.Minute))); done {
+		t.Error("done before upload finished")
+	}
+	exec.progress.add(t0.Add(time.Minute), 1, true)
+	if done, _ := exec.IsDone(at(t0.Add(30 * time.Second))); done {
+		t.Error("done before last point")
+	}
+	rec.AzimuthCurrentVelocity = 1
+	if done, _ := exec.IsDone(at(t0.Add(2 * time.Minute))); done {
+		t.Error("done while moving")
+	}
+	rec.AzimuthCurrentVelocity = 0
+	if done, err := exec.IsDone(at(t0.Add(2 * time.Minute))); !done || err != nil {
+		t.Errorf("not done after last point: %v", err)
+	}
+
+	// a failed upload stops the telescope
+	exec.uploadErr <- fmt.Errorf("connection refused")
+	if done, err := exec.IsDone(at(t0)); !done || err == nil || err.Error() != "upload: connection refused" {
+		t.Errorf("upload error not reported: %v", err)
+	}
+	if len(acu.modes) != 1 || acu.modes[0] != "Stop" || acu.cleared != 1 {
+		t.Errorf("not stopped: modes %v, cleared %d", acu.modes, acu.cleared)
+	}
+}
+
+func TestPatternExecSingleAxis(t *testing.T) {
+	acu := newFakeACU(120, 60)
+	tel := NewTelescope(acu)
+	tel.UpdateStatus()
+	pattern := NewAzimuthScanPattern(time.Now().Add(time.Second), 1, 60, [2]float64{120, 121}, 0.5, 5*time.Second)
+	exec, err := tel.StartPattern(context.Background(), pattern, nil, "azimuth")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(acu.modes); s != "[azimuth Stop azimuth ProgramTrack]" {
+		t.Errorf("got modes %s, expected [azimuth Stop azimuth ProgramTrack]", s)
+	}
+
+	// done without elevation in program track
+	if err := exec.stopUpload(); err != nil {
+		t.Fatal(err)
+	}
+	exec.progress.add(time.Now().Add(-time.Minute), 0, true)
+	rec := datasets.StatusGeneral8100{
+		AzimuthMode:   datasets.AzimuthModeProgramTrack,
+		ElevationMode: datasets.ElevationModeStop,
+	}
+	if done, err := exec.IsDone(&rec); !done || err != nil {
+		t.Errorf("not done: %v", err)
+	}
+
+	// the other axis must be where the pattern holds it
+	if err := checkHeldAxis(tel, "azimuth", 50); err == nil {
+		t.Error("elevation 60 accepted for a scan at 50")
+	}
+}
+
+// a panicScanPattern panics generating its first point
+type panicScanPattern struct{}
+
+func (panicScanPattern) Iterator() *ScanPatternIterator                      { return &ScanPatternIterator{} }
+func (panicScanPattern) Done(*ScanPatternIterator) bool                      { return false }
+func (panicScanPattern) Next(*ScanPatternIterator, *ScanPatternSample) error { panic("oops") }
+
+func TestPatternExecUploadPanic(t *testing.T) {
+	exec := &patternExec{
+		ctx:      context.Background(),
+		tel:      NewTelescope(newFakeACU(120, 60)),
+		progress: &uploadProgress{},
+		flagger:  &scanFlagger{flags: NewScanFlags()},
+	}
+	exec.upload(panicScanPattern{})
+	select {
+	case err := <-exec.uploadErr:
+		if err == nil || !strings.Contains(err.Error(), "oops") {
+			t.Errorf("got %v", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("no upload error")
+	}
+}
+
+func TestPatternExecProgress(t *testing.T) {
+	t0 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	scan := NewAzimuthScanPattern(t0, 4, 60, [2]float64{110, 130}, 0.8, 5*time.Second)
+	summary := &DryRun{}
+	if _, err := summary.summarizePattern(scan); err != nil {
+		t.Fatal(err)
+	}
+	exec := &patternExec{
+		progress: &uploadProgress{},
+		summary:  summary,
+		flagger:  &scanFlagger{flags: NewScanFlags()},
+	}
+	var rec datasets.StatusGeneral8100
+	rec.QtyOfFreeProgramTrackStackPositions = maxFreeProgramTrackStack
+
+	p := exec.Progress(&rec, t0.Add(-time.Second))
+	if p.Points != summary.Points || p.Uploaded != 0 || p.Consumed != 0 || p.Sweep != 0 || p.NumSweeps != 8 {
+		t.Errorf("before start: got %+v", p)
+	}
+	if p.ETA == nil || !p.ETA.Equal(*summary.Stop) {
+		t.Errorf("ETA %v, expected %v", p.ETA, summary.Stop)
+	}
+
+	// 100 points uploaded, 40 still on the stack, partway through the second sweep
+	exec.progress.add(t0.Add(time.Minute), 100, false)
+	rec.QtyOfFreeProgramTrackStackPositions = maxFreeProgramTrackStack - 40
+	now := summary.sweeps[1].Add(time.Second)
+	p = exec.Progress(&rec, now)
+	if p.Uploaded != 100 || p.Consumed != 60 || p.Sweep != 2 {
+		t.Errorf("running: got %+v", p)
+	}
+	if expected := 100 * 60 / float64(summary.Points); math.Abs(p.Percent-expected) > 1e-9 {
+		t.Errorf("percent %g, expected %g", p.Percent, expected)
+	}
+
+	// the ETA slips while paused
+	exec.pattern = scan
+	exec.tel = NewTelescope(newFakeACU(120, 60))
+	exec.tel.rec = rec
+	exec.cancel = func() {}
+	exec.uploaded = make(chan struct{})
+	close(exec.uploaded)
+	if err := exec.pause(); err != nil {
+		t.Fatal(err)
+	}
+	p = exec.Progress(&rec, exec.pausedAt.Add(time.Minute))
+	if p.Consumed != 60 || p.Uploaded != 60 || !p.ETA.Equal(summary.Stop.Add(time.Minute)) {
+		t.Errorf("paused: got %+v", p)
+	}
+}
+
+func TestPatternExecUnderrun(t *testing.T) {
+	now := time.Now()
+	acu := newFakeACU(120, 60)
+	exec := &patternExec{
+		ctx:      context.Background(),
+		tel:      NewTelescope(acu),
+		pattern:  NewDriftScanPattern(now.Add(-time.Minute), 10*time.Minute, 120, 60, 0.01),
+		progress: &uploadProgress{},
+		flagger:  &scanFlagger{flags: NewScanFlags()},
+		cancel:   func() {},
+		uploaded: make(chan struct{}),
+	}
+	close(exec.uploaded)
+	alarms := NewAlarms()
+	var rec datasets.StatusGeneral8100
+
+	// plenty of points queued
+	lastT := now.Add(time.Minute)
+	exec.progress.add(lastT, 10, false)
+	rec.QtyOfFreeProgramTrackStackPositions = maxFreeProgramTrackStack - 10
+	if err := exec.CheckUnderrun(&rec, now, alarms); err != nil || len(alarms.List()) != 0 {
+		t.Fatalf("got %v, alarms %+v", err, alarms.List())
+	}
+
+	// the upload is restarted after the last queued point
+	now = lastT.Add(-time.Second)
+	if err := exec.CheckUnderrun(&rec, now, alarms); err != nil {
+		t.Fatal(err)
+	}
+	if list := alarms.List(); len(list) != 1 || list[0].Severity != severityWarning {
+		t.Errorf("alarms %+v", list)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for exec.progress.count() == 10 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	if err := exec.stopUpload(); err != nil {
+		t.Fatal(err)
+	}
+	if len(acu.points) == 0 {
+		t.Fatal("nothing uploaded")
+	}
+	p := acu.points[0]
+	if t0 := VertexTime2Time(p.Day, p.TimeOfDay, now); !t0.After(lastT) || t0.Sub(lastT) > 10*time.Second {
+		t.Errorf("upload restarted at %v, after %v", t0, lastT)
+	}
+
+	// until it's been tried too often
+	rec.QtyOfFreeProgramTrackStackPositions = maxFreeProgramTrackStack
+	exec.recovered = maxUnderrunRecoveries
+	if err := exec.CheckUnderrun(&rec, now, alarms); err != nil {
+		t.Fatal(err)
+	}
+	if list := alarms.List(); len(list) != 1 || list[0].Severity != severityCritical {
+		t.Errorf("alarms %+v", list)
+	}
+}
@@ -0,0 +1,535 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// The external beam-fit pipeline fits the source positions of pointing
+// scans (see pointingScanCmd), and posts the offsets found. They're kept
+// in the pointing-run database, with the pointing model and pointing
+// offset register in use, so the model can be refit from them across
+// model changes. A refit model is staged until an operator approves it.
+
+// the terms of a PointingModel, in order
+var pointingTerms = []string{"IA", "IE", "AN", "AW", "CA", "NPAE", "TF", "TX"}
+
+// term returns the coefficient of the named term.
+func (m *PointingModel) term(name string) *float64 {
+	switch name {
+	case "IA":
+		return &m.IA
+	case "IE":
+		return &m.IE
+	case "AN":
+		return &m.AN
+	case "AW":
+		return &m.AW
+	case "CA":
+		return &m.CA
+	case "NPAE":
+		return &m.NPAE
+	case "TF":
+		return &m.TF
+	case "TX":
+		return &m.TX
+	}
+	return nil
+}
+
+// A PointingRun is a pointing offset measured by the beam-fit pipeline:
+// what should have been added to the commanded position to center the
+// source, in the sense of the offset registers.
+type PointingRun struct {
+	Time      time.Time `json:"time"`
+	Target    string    `json:"target,omitempty"`
+	CommandID string    `json:"command_id,omitempty"`
+	Azimuth   float64   `json:"azimuth"`   // observed [deg]
+	Elevation float64   `json:"elevation"` // observed [deg]
+	XEl       float64   `json:"xel"`       // cross-elevation (great circle) offset [arcsec]
+	El        float64   `json:"el"`        // elevation offset [arcsec]
+
+	// in use when ingested
+	Model    PointingModel `json:"model"`
+	Register AzElOffset    `json:"pointing_offset"` // [deg]
+	Tilt     [2]float64    `json:"tilt"`            // correction, see Pointing.SetTilt
+}
+
+func (r PointingRun) check() error {
+	switch {
+	case r.Time.IsZero():
+		return &FieldError{Field: "time", Reason: "required"}
+	case !isFinite(r.Azimuth) || !isFinite(r.Elevation):
+		return fmt.Errorf("position not finite")
+	case r.Elevation <= 0 || r.Elevation >= 90:
+		return rangeError("elevation", 0, 90, "bad elevation: %g", r.Elevation)
+	case !isFinite(r.XEl) || !isFinite(r.El):
+		return fmt.Errorf("offsets not finite")
+	}
+	return nil
+}
+
+// correction returns the total correction the run measured [arcsec]:
+// the model, tilt correction, and register in use, plus the offset found.
+func (r PointingRun) correction() (float64, float64) {
+	m := r.Model
+	m.AN += r.Tilt[0]
+	m.AW += r.Tilt[1]
+	daz, del := m.Correction(r.Azimuth, r.Elevation)
+	ce := math.Cos(deg2rad(r.Elevation))
+	return 3600*(daz+r.Register.Az) + r.XEl/ce, 3600*(del+r.Register.El) + r.El
+}
+
+// A PointingFit is a pointing model fit to the runs since Since.
+type PointingFit struct {
+	Time      time.Time     `json:"time"`
+	Since     time.Time     `json:"since,omitempty"`
+	Terms     []string      `json:"terms"` // those fit; the rest are kept
+	Runs      int           `json:"runs"`
+	Model     PointingModel `json:"model"`
+	RMSBefore float64       `json:"rms_before"` // of the offsets found [arcsec]
+	RMSAfter  float64       `json:"rms_after"`  // of their residuals from the fit
+}
+
+// fitPointingModel fits terms of a pointing model to runs, keeping the
+// rest of current. The on-sky (great circle) residuals are minimized.
+func fitPointingModel(runs []PointingRun, terms []string, current PointingModel) (PointingModel, float64, float64, error) {
+	if len(terms) == 0 {
+		terms = pointingTerms
+	}
+	base := current
+	for _, name := range terms {
+		p := base.term(name)
+		if p == nil {
+			return current, 0, 0, &FieldError{Field: "terms", Reason: fmt.Sprintf("unknown term %s", name)}
+		}
+		*p = 0
+	}
+	if 2*len(runs) < len(terms) {
+		return current, 0, 0, fmt.Errorf("%d runs can't fit %d terms", len(runs), len(terms))
+	}
+
+	// normal equations, for rows scaled to great circle arcsec
+	n := len(terms)
+	ata := make([][]float64, n)
+	for i := range ata {
+		ata[i] = make([]float64, n+1) // with atb
+	}
+	var before float64
+	row := make([][2]float64, n)
+	for _, r := range runs {
+		ce := math.Cos(deg2rad(r.Elevation))
+		before += r.XEl*r.XEl + r.El*r.El
+		daz, del := r.correction()
+		baz, bel := base.Correction(r.Azimuth, r.Elevation)
+		b := [2]float64{(daz - 3600*baz) * ce, del - 3600*bel}
+		for j, name := range terms {
+			var unit PointingModel
+			*unit.term(name) = 1
+			uaz, uel := unit.Correction(r.Azimuth, r.Elevation)
+			row[j] = [2]float64{3600 * uaz * ce, 3600 * uel}
+		}
+		for i := 0; i < n; i++ {
+			for k := 0; k < 2; k++ {
+				for j := 0; j < n; j++ {
+					ata[i][j] += row[i][k] * row[j][k]
+				}
+				ata[i][n] += row[i][k] * b[k]
+			}
+		}
+	}
+	x, err := solveLinear(ata)
+	if err != nil {
+		return current, 0, 0, fmt.Errorf("terms %v not constrained by the runs", terms)
+	}
+	m := base
+	for j, name := range terms {
+		*m.term(name) = x[j]
+	}
+
+	var after float64
+	for _, r := range runs {
+		ce := math.Cos(deg2rad(r.Elevation))
+		daz, del := r.correction()
+		maz, mel := m.Correction(r.Azimuth, r.Elevation)
+		after += math.Pow((daz-3600*maz)*ce, 2) + math.Pow(del-3600*mel, 2)
+	}
+	k := float64(len(runs))
+	return m, math.Sqrt(before / k), math.Sqrt(after / k), nil
+}
+
+// solveLinear solves the n x n system whose augmented matrix is a,
+// by Gaussian elimination with partial pivoting, overwriting a.
+func solveLinear(a [][]float64) ([]float64, error) {
+	n := len(a)
+	var scale float64
+	for i := range a {
+		scale = math.Max(scale, math.Abs(a[i][i]))
+	}
+	for c := 0; c < n; c++ {
+		p := c
+		for i := c + 1; i < n; i++ {
+			if math.Abs(a[i][c]) > math.Abs(a[p][c]) {
+				p = i
+			}
+		}
+		if math.Abs(a[p][c]) <= 1e-9*scale {
+			return nil, fmt.Errorf("singular")
+		}
+		a[c], a[p] = a[p], a[c]
+		for i := c + 1; i < n; i++ {
+			f := a[i][c] / a[c][c]
+			for j := c; j <= n; j++ {
+				a[i][j] -= f * a[c][j]
+			}
+		}
+	}
+	x := make([]float64, n)
+	for i := n - 1; i >= 0; i-- {
+		s := a[i][n]
+		for j := i + 1; j < n; j++ {
+			s -= a[i][j] * x[j]
+		}
+		x[i] = s / a[i][i]
+	}
+	return x, nil
+}
+
+// PointingRuns is the pointing-run database, and the model staged from
+// it, if any. Runs are appended to its file, if any, as JSON lines.
+// It is safe for concurrent use.
+type PointingRuns struct {
+	pointing *Pointing
+
+	mu     sync.Mutex
+	file   string
+	runs   []PointingRun
+	staged *PointingFit
+}
+
+func NewPointingRuns(pointing *Pointing) *PointingRuns {
+	return &PointingRuns{pointing: pointing}
+}
+
+// Load reads the runs in filename, and appends later ones to it.
+// A missing file is created by the first run added.
+func (db *PointingRuns) Load(filename string) error {
+	var runs []PointingRun
+	f, err := os.Open(filename)
+	if err == nil {
+		defer f.Close()
+		scanner := bufio.NewScanner(f)
+		for line := 1; scanner.Scan(); line++ {
+			var r PointingRun
+			if err := json.Unmarshal(scanner.Bytes(), &r); err != nil {
+				return fmt.Errorf("%s:%d: %w", filename, line, err)
+			}
+			runs = append(runs, r)
+		}
+		err = scanner.Err()
+	} else if os.IsNotExist(err) {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.file, db.runs = filename, runs
+	return nil
+}
+
+// Add checks and records runs, with the pointing model, tilt correction,
+// and register in use.
+func (db *PointingRuns) Add(runs []PointingRun) error {
+	model, _ := db.pointing.Model()
+	tilt := db.pointing.Tilt()
+	register := db.pointing.offsets.Get()["pointing"]
+	for i := range runs {
+		if err := runs[i].check(); err != nil {
+			return fmt.Errorf("run %d: %w", i, err)
+		}
+		runs[i].Model, runs[i].Tilt, runs[i].Register = model, tilt, register
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.file != "" {
+		f, err := os.OpenFile(db.file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+		if err != nil {
+			return err
+		}
+		enc := json.NewEncoder(f)
+		for _, r := range runs {
+			if err == nil {
+				err = enc.Encode(r)
+			}
+		}
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err != nil {
+			return err
+		}
+	}
+	db.runs = append(db.runs, runs...)
+	return nil
+}
+
+// Runs returns the runs since since.
+func (db *PointingRuns) Runs(since time.Time) []PointingRun {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	var runs []PointingRun
+	for _, r := range db.runs {
+		if !r.Time.Before(since) {
+			runs = append(runs, r)
+		}
+	}
+	return runs
+}
+
+// Fit fits terms of the pointing model (all of them, if none) to the runs
+// since since, and stages the model for approval.
+func (db *PointingRuns) Fit(terms []string, since time.Time) (*PointingFit, error) {
+	runs := db.Runs(since)
+	current, _ := db.pointing.Model()
+	m, before, after, err := fitPointingModel(runs, terms, current)
+	if err != nil {
+		return nil, err
+	}
+	if len(terms) == 0 {
+		terms = pointingTerms
+	}
+	fit := &PointingFit{
+		Time:      time.Now(),
+		Since:     since,
+		Terms:     terms,
+		Runs:      len(runs),
+		Model:     m,
+		RMSBefore: before,
+		RMSAfter:  after,
+	}
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.staged = fit
+	return fit, nil
+}
+
+// Staged returns the model awaiting approval, if any.
+func (db *PointingRuns) Staged() *PointingFit {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.staged
+}
+
+// Approve switches to the staged model, and zeroes the pointing offset
+// register, which it replaces.
+func (db *PointingRuns) Approve() (*PointingFit, error) {
+	db.mu.Lock()
+	fit := db.staged
+	db.staged = nil
+	db.mu.Unlock()
+	if fit == nil {
+		return nil, fmt.Errorf("no pointing model staged")
+	}
+	db.pointing.SetModel(fit.Model, "fit "+fit.Time.UTC().Format(time.RFC3339))
+	return fit, db.pointing.offsets.Clear("pointing")
+}
+
+// Reject discards the staged model.
+func (db *PointingRuns) Reject() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if db.staged == nil {
+		return fmt.Errorf("no pointing model staged")
+	}
+	db.staged = nil
+	return nil
+}
+
+// servePointingModel serves the pointing model, and the runs fit to stage
+// a new one for approval.
+func servePointingModel(mux *http.ServeMux, pointing *Pointing, pointingRuns *PointingRuns) {
+	mux.HandleFunc("/pointing-model", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Model  PointingModel `json:"model"`
+				Source string        `json:"source"`
+			}
+			response.Model, response.Source = pointing.Model()
+			err := json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				File  string         `json:"file"`
+				Model *PointingModel `json:"model"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil {
+				switch {
+				case x.File != "" && x.Model == nil:
+					var m PointingModel
+					m, err = LoadPointingModel(x.File)
+					if err == nil {
+						pointing.SetModel(m, x.File)
+						log.Printf("loaded pointing model %s: %+v", x.File, m)
+					}
+				case x.File == "" && x.Model != nil:
+					pointing.SetModel(*x.Model, "api")
+					log.Printf("set pointing model: %+v", *x.Model)
+				default:
+					err = fmt.Errorf("need exactly one of file or model")
+				}
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/pointing-model/runs", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var since time.Time
+			if s := req.URL.Query().Get("since"); s != "" {
+				var err error
+				since, err = time.Parse(time.RFC3339, s)
+				if err != nil {
+					jsonResponse(w, fmt.Errorf("bad since: %w", err), http.StatusBadRequest)
+					return
+				}
+			}
+			err := json.NewEncoder(w).Encode(pointingRuns.Runs(since))
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Runs  []PointingRun `json:"runs"`
+				Refit bool          `json:"refit"`
+				Terms []string      `json:"terms"`
+				Since time.Time     `json:"since"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil {
+				err = pointingRuns.Add(x.Runs)
+			}
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			log.Printf("added %d pointing runs", len(x.Runs))
+			if !x.Refit {
+				jsonResponse(w, nil, http.StatusOK)
+				return
+			}
+			fit, err := pointingRuns.Fit(x.Terms, x.Since)
+			if err != nil {
+				jsonResponse(w, fmt.Errorf("runs added, but not fit: %w", err), http.StatusBadRequest)
+				return
+			}
+			log.Printf("staged pointing model: %+v", *fit)
+			fitResponse(w, fit)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/pointing-model/fit", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Terms []string  `json:"terms"`
+			Since time.Time `json:"since"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		var fit *PointingFit
+		if err == nil {
+			fit, err = pointingRuns.Fit(x.Terms, x.Since)
+		}
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		log.Printf("staged pointing model: %+v", *fit)
+		fitResponse(w, fit)
+	})
+
+	mux.HandleFunc("/pointing-model/staged", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var response struct {
+			Staged *PointingFit  `json:"staged"`
+			Model  PointingModel `json:"model"`
+			Source string        `json:"source"`
+		}
+		response.Staged = pointingRuns.Staged()
+		response.Model, response.Source = pointing.Model()
+		err := json.NewEncoder(w).Encode(&response)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/pointing-model/approve", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		fit, err := pointingRuns.Approve()
+		if fit != nil {
+			log.Printf("approved pointing model: %+v", fit.Model)
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+
+	mux.HandleFunc("/pointing-model/reject", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := pointingRuns.Reject()
+		if err == nil {
+			log.Print("rejected staged pointing model")
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
+
+// fitResponse writes the pointing fit as a response.
+func fitResponse(w http.ResponseWriter, fit *PointingFit) {
+	response := struct {
+		S   string       `json:"status"`
+		Fit *PointingFit `json:"fit"`
+	}{"ok", fit}
+	err := json.NewEncoder(w).Encode(&response)
+	if err != nil {
+		log.Print(err)
+	}
+}
@@ -0,0 +1,123 @@
+package main
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// pointingRunsFor returns runs over the sky, finding the offsets an actual
+// model gives with model in use.
+func pointingRunsFor(actual, model PointingModel) []PointingRun {
+	t0 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	var runs []PointingRun
+	for az := 0.0; az < 360; az += 45 {
+		for _, el := range []float64{25, 40, 55, 70} {
+			aaz, ael := actual.Correction(az, el)
+			maz, mel := model.Correction(az, el)
+			ce := math.Cos(deg2rad(el))
+			runs = append(runs, PointingRun{
+				Time:      t0.Add(time.Duration(len(runs)) * time.Minute),
+				Azimuth:   az,
+				Elevation: el,
+				XEl:       3600 * (aaz - maz) * ce,
+				El:        3600 * (ael - mel),
+				Model:     model,
+			})
+		}
+	}
+	return runs
+}
+
+func TestFitPointingModel(t *testing.T) {
+	actual := PointingModel{IA: -35.2, IE: 12.1, AN: 3, AW: -4, CA: 4, NPAE: 2, TF: 8, TX: -1.5}
+	same := func(a, b PointingModel) bool {
+		for _, name := range pointingTerms {
+			if math.Abs(*a.term(name)-*b.term(name)) > 1e-6 {
+				return false
+			}
+		}
+		return true
+	}
+
+	current := PointingModel{IA: -30, IE: 10}
+	runs := pointingRunsFor(actual, current)
+	m, before, after, err := fitPointingModel(runs, nil, current)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !same(m, actual) || before == 0 || after > 1e-6 {
+		t.Errorf("got %+v (rms %g -> %g), expected %+v", m, before, after, actual)
+	}
+
+	// fitting the index terms keeps the rest
+	current = actual
+	current.IA, current.IE = 0, 0
+	m, _, _, err = fitPointingModel(pointingRunsFor(actual, current), []string{"IA", "IE"}, current)
+	if err != nil || !same(m, actual) {
+		t.Errorf("got %+v, %v, expected %+v", m, err, actual)
+	}
+
+	if _, _, _, err := fitPointingModel(runs[:2], nil, current); err == nil {
+		t.Error("fit 8 terms to 2 runs")
+	}
+	if _, _, _, err := fitPointingModel(runs, []string{"XX"}, current); err == nil {
+		t.Error("fit an unknown term")
+	}
+	// at a single elevation, IA, CA, and NPAE are degenerate
+	if _, _, _, err := fitPointingModel(runs[:1], []string{"IA", "CA"}, current); err == nil {
+		t.Error("fit degenerate terms")
+	}
+}
+
+func TestPointingRuns(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "runs.jsonl")
+	pointing := NewPointing()
+	current := PointingModel{IA: -30, IE: 10}
+	pointing.SetModel(current, "test")
+	pointing.offsets.Set("pointing", AzElOffset{Az: 0.001})
+	db := NewPointingRuns(pointing)
+	if err := db.Load(file); err != nil {
+		t.Fatal(err)
+	}
+
+	runs := pointingRunsFor(current, current)
+	for i := range runs {
+		// the register was off by 3.6 arcsec in azimuth
+		runs[i].XEl = -3.6 * math.Cos(deg2rad(runs[i].Elevation))
+	}
+	if err := db.Add(runs); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Add([]PointingRun{{Azimuth: 10, Elevation: 40}}); err == nil {
+		t.Error("added a run with no time")
+	}
+
+	// reloaded from the file
+	db = NewPointingRuns(pointing)
+	if err := db.Load(file); err != nil {
+		t.Fatal(err)
+	}
+	got := db.Runs(runs[4].Time)
+	if len(got) != len(runs)-4 || got[0].Register.Az != 0.001 || got[0].Model != current {
+		t.Fatalf("got %d runs from %+v", len(got), got[0])
+	}
+
+	fit, err := db.Fit([]string{"IA"}, time.Time{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if db.Staged() != fit || fit.Runs != len(runs) || math.Abs(fit.Model.IA-(-30)) > 1e-6 {
+		t.Errorf("got fit %+v", fit)
+	}
+	if _, err := db.Approve(); err != nil {
+		t.Fatal(err)
+	}
+	if m, _ := pointing.Model(); m != fit.Model || pointing.offsets.Total().Az != 0 || db.Staged() != nil {
+		t.Errorf("approved %+v, but got %+v and offset %+v", fit.Model, m, pointing.offsets.Total())
+	}
+	if err := db.Reject(); err == nil {
+		t.Error("rejected with nothing staged")
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+const (
+	// default half-width of a pointing scan, in beams (see Config.BeamFWHM)
+	pointingScanBeams = 5
+
+	// default grid row spacing, in beams
+	pointingGridStep = 0.5
+)
+
+// A pointingScanCmd is a pointing observation of a calibrator: crosses,
+// or grids of azimuth sweeps, centered on it. Its scan flags are tagged
+// for the pointing fits (see scanTags). The size and grid spacing default
+// to multiples of the beam FWHM when the command is submitted.
+type pointingScanCmd struct {
+	StartTime      float64 `json:"start_time"`
+	Target         string  // solar system body or catalog source, instead of RA/Dec
+	RA             float64
+	Dec            float64
+	Coordsys       string
+	Mode           string  `json:"mode"` // cross or grid
+	Size           float64 `json:"size"` // half-width [deg]
+	Step           float64 `json:"step"` // grid row spacing [deg]
+	Speed          float64 `json:"speed"`
+	TurnaroundTime float64 `json:"turnaround_time"`
+	NumScans       int     `json:"num_scans"` // crosses or grids
+	AzWrap         string  `json:"az_wrap"`
+}
+
+func newPointingScanCmd() pointingScanCmd {
+	fwhm := currentConfig().BeamFWHM
+	return pointingScanCmd{
+		Mode:     "cross",
+		Size:     pointingScanBeams * fwhm,
+		Step:     pointingGridStep * fwhm,
+		NumScans: 1,
+	}
+}
+
+// center returns a track of the command's target.
+func (cmd pointingScanCmd) center() (*TrackScanPattern, error) {
+	track := trackCmd{
+		StartTime: cmd.StartTime,
+		StopTime:  cmd.StartTime,
+		RA:        cmd.RA,
+		Dec:       cmd.Dec,
+		Coordsys:  cmd.Coordsys,
+		Target:    cmd.Target,
+	}
+	track, err := track.resolve()
+	if err != nil {
+		return nil, err
+	}
+	if track.Body == "" {
+		if err := checkCoordsys(track.Coordsys); err != nil {
+			return nil, err
+		}
+	}
+	pattern, err := track.trackPattern()
+	if err != nil {
+		return nil, err
+	}
+	return pattern.(*TrackScanPattern), nil
+}
+
+func (cmd pointingScanCmd) sweeps() *sweepOffsets {
+	turnaround := Seconds2Duration(cmd.TurnaroundTime)
+	if cmd.Mode == "grid" {
+		return gridSweeps(cmd.NumScans, cmd.Size, cmd.Step, cmd.Speed, turnaround)
+	}
+	return crossSweeps(cmd.NumScans, cmd.Size, cmd.Speed, turnaround)
+}
+
+func (cmd pointingScanCmd) Check() error {
+	if cmd.Size <= 0 {
+		return fmt.Errorf("bad size: %g", cmd.Size)
+	}
+	if cmd.Speed <= 0 {
+		return fmt.Errorf("bad speed: %g", cmd.Speed)
+	}
+	if cmd.TurnaroundTime <= 0 {
+		return fmt.Errorf("bad turnaround time: %g", cmd.TurnaroundTime)
+	}
+	if cmd.NumScans < 1 {
+		return fmt.Errorf("bad number of scans: %d", cmd.NumScans)
+	}
+	sweeps := 4 * float64(cmd.NumScans)
+	switch cmd.Mode {
+	case "cross":
+	case "grid":
+		if cmd.Step <= 0 || cmd.Step > cmd.Size {
+			return rangeError("step", 0, cmd.Size, "bad grid step: %g", cmd.Step)
+		}
+		sweeps = (2*math.Floor(cmd.Size/cmd.Step) + 1) * float64(cmd.NumScans)
+	default:
+		return &FieldError{Field: "mode", Reason: fmt.Sprintf("unknown mode %s", cmd.Mode)}
+	}
+	if sweeps > maxCommandItems {
+		return fmt.Errorf("more than %d sweeps", maxCommandItems)
+	}
+	err := checkStartTime(cmd.StartTime)
+	if err != nil {
+		return err
+	}
+	center, err := cmd.center()
+	if err != nil {
+		return err
+	}
+	offsets := cmd.sweeps()
+	d := Seconds2Duration(offsets.duration())
+	if d > maxPatternDuration {
+		return fmt.Errorf("pointing scan longer than %v", maxPatternDuration)
+	}
+	t0 := jsontime(cmd.StartTime)
+	if center.coordsys != "Horizon" {
+		err = checkVisibility(*center, t0, t0.Add(d))
+		if err != nil {
+			return err
+		}
+	}
+	_, el, err := center.azEl(t0)
+	if err != nil {
+		return err
+	}
+	speed, accel, jerk := offsets.peaks()
+	err = checkOffsetKinematics("speed", el, speed, accel, jerk)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd pointingScanCmd) Pattern() (ScanPattern, error) {
+	center, err := cmd.center()
+	if err != nil {
+		return nil, err
+	}
+	pattern := NewSweepsScanPattern(jsontime(cmd.StartTime), *center, cmd.sweeps())
+	return wrapAzimuth(pattern, center.coordsys, cmd.AzWrap)
+}
+
+func (cmd pointingScanCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+// scanTags identify the scans as a pointing observation. Each cross is
+// four sweeps: forward and back in azimuth, then up and down in elevation.
+func (cmd pointingScanCmd) scanTags() map[string]string {
+	target := cmd.Target
+	if target == "" {
+		target = fmt.Sprintf("%s %g,%g", cmd.Coordsys, cmd.RA, cmd.Dec)
+	}
+	return map[string]string{
+		"observation": "pointing",
+		"mode":        cmd.Mode,
+		"target":      target,
+		"size":        fmt.Sprint(cmd.Size),
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestCrossScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	center, _ := NewTrackScanPattern(t0, t0, 100, 0, "Horizon")
+	sweeps := crossSweeps(1, 5, 1, 2*time.Second)
+	// 4 10s sweeps, two 2s turnarounds, and a 12s axis switch
+	if d := sweeps.duration(); d != 56 {
+		t.Fatalf("got duration %g, expected 56", d)
+	}
+	samples := collectPattern(t, NewSweepsScanPattern(t0, *center, sweeps))
+	turning := 0
+	for i, x := range samples {
+		if x.AzFlag == 2 || x.ElFlag == 2 {
+			turning++
+		}
+		if i == 0 {
+			continue
+		}
+		a := samples[i-1]
+		if math.Abs(x.Az-a.Az) > 0.11 || math.Abs(x.El-a.El) > 0.11 {
+			t.Errorf("sample %d: position jump: %+v -> %+v", i, a, x)
+		}
+		if math.Abs(x.AzVel-a.AzVel) > 0.2 || math.Abs(x.ElVel-a.ElVel) > 0.2 {
+			t.Errorf("sample %d: velocity jump: %+v -> %+v", i, a, x)
+		}
+	}
+	// all but the ends of each turnaround
+	if turning != 19+119+19 {
+		t.Errorf("got %d turnaround samples, expected %d", turning, 19+119+19)
+	}
+	// the elevation sweeps cross the center
+	if x := samples[390]; math.Abs(x.Az-100) > 1e-9 || math.Abs(x.El) > 1e-9 || x.ElVel != 1 {
+		t.Errorf("bad elevation sweep: %+v", x)
+	}
+	if x := samples[len(samples)-1]; math.Abs(x.El+5) > 1e-9 || x.ElVel != -1 {
+		t.Errorf("bad end: %+v", x)
+	}
+}
+
+func TestGridSweeps(t *testing.T) {
+	sweeps := gridSweeps(2, 1, 0.5, 1, time.Second)
+	if n := len(sweeps.sweeps); n != 10 {
+		t.Fatalf("got %d sweeps, expected 10", n)
+	}
+	// up, then back down from the top row
+	for i, y := range []float64{-1, -0.5, 0, 0.5, 1, 1, 0.5, 0, -0.5, -1} {
+		if w := sweeps.sweeps[i]; w.y != y || w.vx != math.Copysign(1, -w.x) {
+			t.Errorf("sweep %d: got %+v, expected row %g", i, w, y)
+		}
+	}
+	speed, accel, _ := sweeps.peaks()
+	if math.Abs(speed[0]-1) > 1e-12 || math.Abs(accel[0]-2) > 1e-12 || math.Abs(speed[1]-0.75) > 1e-12 {
+		t.Errorf("got peak speed %v, accel %v", speed, accel)
+	}
+}
+
+func TestPointingScanCmdCheck(t *testing.T) {
+	disableSunAvoidance(t)
+	cmd := newPointingScanCmd()
+	if fwhm := currentConfig().BeamFWHM; cmd.Size != pointingScanBeams*fwhm || cmd.Step != pointingGridStep*fwhm {
+		t.Errorf("got size %g and step %g for a %g beam", cmd.Size, cmd.Step, fwhm)
+	}
+	cmd.StartTime = 10
+	cmd.RA, cmd.Dec, cmd.Coordsys = 120, 45, "Horizon"
+	cmd.Speed, cmd.TurnaroundTime = 0.01, 1
+	for _, mode := range []string{"cross", "grid"} {
+		cmd.Mode = mode
+		if err := cmd.Check(); err != nil {
+			t.Errorf("%s: %v", mode, err)
+		}
+	}
+	for _, bad := range []func(*pointingScanCmd){
+		func(c *pointingScanCmd) { c.Mode = "spiral" },
+		func(c *pointingScanCmd) { c.Step = 2 * c.Size },
+		func(c *pointingScanCmd) { c.Size = 0 },
+		func(c *pointingScanCmd) { c.NumScans = 0 },
+		func(c *pointingScanCmd) { c.Target = "RCW38" },
+		func(c *pointingScanCmd) { c.Speed, c.TurnaroundTime = 10, 0.1 },
+	} {
+		c := cmd
+		bad(&c)
+		if err := c.Check(); err == nil {
+			t.Errorf("%+v: expected an error", c)
+		}
+	}
+	tags := cmd.scanTags()
+	if tags["observation"] != "pointing" || tags["mode"] != "grid" {
+		t.Errorf("got tags %v", tags)
+	}
+}
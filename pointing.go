@@ -1,18 +1,152 @@
 package main
 
+import (
+	"encoding/json"
+	"math"
+	"os"
+	"sync"
+)
+
+// A PointingModel holds the coefficients of a TPOINT-style pointing model
+// for an altazimuth mount. All coefficients are in arcseconds.
+type PointingModel struct {
+	IA   float64 `json:"IA"`   // azimuth index error
+	IE   float64 `json:"IE"`   // elevation index error
+	AN   float64 `json:"AN"`   // azimuth axis tilt, north-south
+	AW   float64 `json:"AW"`   // azimuth axis tilt, east-west
+	CA   float64 `json:"CA"`   // left-right collimation error
+	NPAE float64 `json:"NPAE"` // az/el axis non-perpendicularity
+	TF   float64 `json:"TF"`   // tube flexure, cos(el)
+	TX   float64 `json:"TX"`   // tube flexure, cot(el)
+}
+
+// LoadPointingModel reads a JSON pointing model file.
+func LoadPointingModel(filename string) (PointingModel, error) {
+	var m PointingModel
+	f, err := os.Open(filename)
+	if err != nil {
+		return m, err
+	}
+	defer f.Close()
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&m)
+	return m, err
+}
+
+// Correction returns what to add to the observed az/el to get the
+// raw encoder az/el, using the TPOINT sign conventions.
+// All angles are in degrees.
+func (m PointingModel) Correction(az, el float64) (float64, float64) {
+	sa, ca := math.Sincos(deg2rad(az))
+	se, ce := math.Sincos(deg2rad(el))
+	te := se / ce
+
+	daz := -m.IA -
+		m.AN*sa*te -
+		m.AW*ca*te -
+		m.CA/ce -
+		m.NPAE*te
+	del := m.IE -
+		m.AN*ca +
+		m.AW*sa -
+		m.TF*ce -
+		m.TX/te
+	return daz / 3600, del / 3600
+}
+
+// Pointing transforms between sky and raw (encoder) coordinates.
+// It is safe for concurrent use, and shared by copies of the Telescope.
 type Pointing struct {
-	azOffset float64
-	elOffset float64
-	ref      Refraction
+	offsets *Offsets
+
+	mu          sync.Mutex
+	model       PointingModel
+	modelSource string
+	tilt        [2]float64 // measured change in the AN and AW terms [arcsec]
+	zero        AzElOffset // encoder zero points, see EncoderZeroPoints
+}
+
+func NewPointing() *Pointing {
+	return &Pointing{
+		offsets: NewOffsets(),
+	}
+}
+
+// SetModel switches to a new pointing model.
+// source describes where it came from, e.g. a filename.
+func (p *Pointing) SetModel(m PointingModel, source string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.model = m
+	p.modelSource = source
 }
 
-func NewPointing() Pointing {
-	return Pointing{}
+// Model returns the current pointing model and its source.
+func (p *Pointing) Model() (PointingModel, string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.model, p.modelSource
 }
 
-func (p Pointing) Sky2Raw(az, el, vaz, vel float64) (float64, float64, float64, float64) {
-	// refraction
-	el = p.ref.SkyEl2ObsEl(el)
+// SetTilt sets the tilt correction: the change in the north and west
+// tilt of the azimuth axis since the model was fit, in arcsec.
+func (p *Pointing) SetTilt(north, west float64) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.tilt = [2]float64{north, west}
+}
+
+// Tilt returns the tilt correction.
+func (p *Pointing) Tilt() [2]float64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.tilt
+}
+
+// SetEncoderZero sets the encoder zero points, added to every raw position.
+func (p *Pointing) SetEncoderZero(zero AzElOffset) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.zero = zero
+}
+
+// EncoderZero returns the encoder zero points.
+func (p *Pointing) EncoderZero() AzElOffset {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.zero
+}
+
+// corrected applies the pointing model, with the tilt correction, to
+// observed az/el.
+func (p *Pointing) corrected(az, el float64) (float64, float64) {
+	p.mu.Lock()
+	model := p.model
+	model.AN += p.tilt[0]
+	model.AW += p.tilt[1]
+	p.mu.Unlock()
+
+	daz, del := model.Correction(az, el)
+	return az + daz, el + del
+}
+
+// Sky2Raw converts observed (i.e. refracted) az/el to raw encoder az/el.
+func (p *Pointing) Sky2Raw(az, el, vaz, vel float64) (float64, float64, float64, float64) {
+	az, el = p.corrected(az, el)
+	off := p.offsets.Total()
+	zero := p.EncoderZero()
+	return az + off.Az + zero.Az, el + off.El + zero.El, vaz, vel
+}
 
-	return az + p.azOffset, el + p.elOffset, vaz, vel
+// Raw2Sky converts raw encoder az/el back to observed az/el, inverting
+// Sky2Raw by iteration, since the corrections vary slowly with position.
+func (p *Pointing) Raw2Sky(az, el float64) (float64, float64) {
+	skyAz, skyEl := az, el
+	for i := 0; i < 3; i++ {
+		rawAz, rawEl, _, _ := p.Sky2Raw(skyAz, skyEl, 0, 0)
+		skyAz += az - rawAz
+		skyEl += el - rawEl
+	}
+	return skyAz, skyEl
 }
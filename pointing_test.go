@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestPointingModelCorrection(t *testing.T) {
+	const tol = 1e-12
+	tests := []struct {
+		model    PointingModel
+		az, el   float64
+		daz, del float64 // arcsec
+	}{
+		{PointingModel{IA: 10, IE: 5}, 30, 40, -10, 5},
+		{PointingModel{CA: 10}, 30, 60, -20, 0},
+		{PointingModel{NPAE: 10}, 30, 45, -10, 0},
+		{PointingModel{AN: 10}, 90, 45, -10, 0},
+		{PointingModel{AN: 10}, 0, 45, 0, -10},
+		{PointingModel{AW: 10}, 0, 45, -10, 0},
+		{PointingModel{AW: 10}, 90, 45, 0, 10},
+		{PointingModel{TF: 10}, 0, 60, 0, -5},
+		{PointingModel{TX: 10}, 0, 45, 0, -10},
+	}
+	for _, test := range tests {
+		daz, del := test.model.Correction(test.az, test.el)
+		if math.Abs(3600*daz-test.daz) > tol || math.Abs(3600*del-test.del) > tol {
+			t.Errorf("%+v at (%g,%g): got (%g,%g), expected (%g,%g)",
+				test.model, test.az, test.el, 3600*daz, 3600*del, test.daz, test.del)
+		}
+	}
+}
+
+func TestPointingRaw2Sky(t *testing.T) {
+	p := NewPointing()
+	p.SetModel(PointingModel{IA: 30, IE: -20, CA: 15, NPAE: 10, TX: 5}, "test")
+	p.offsets.Set("user", AzElOffset{Az: 0.01, El: -0.02})
+	for _, pos := range [][2]float64{{30, 40}, {-170, 80}, {300, 15}} {
+		rawAz, rawEl, _, _ := p.Sky2Raw(pos[0], pos[1], 0, 0)
+		az, el := p.Raw2Sky(rawAz, rawEl)
+		if math.Abs(az-pos[0]) > 1e-9 || math.Abs(el-pos[1]) > 1e-9 {
+			t.Errorf("Raw2Sky(Sky2Raw(%v)): got (%g,%g)", pos, az, el)
+		}
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The ACU broadcasts its position at 200 Hz over UDP, once enabled with
+// /acu/position-broadcast. The receiver stamps each sample with its UTC
+// time, then republishes the samples to the UDP forwarding addresses
+// (unicast or multicast) as one JSON array per packet, to WebSocket
+// subscribers, and to the archive as raw packets.
+
+const (
+	positionBroadcastDataset  = "PositionBroadcast"
+	positionBroadcastMaxSubs  = 10
+	positionBroadcastSubQueue = 20 // packets, 1 s at 200 Hz
+)
+
+// see capPositionBroadcast
+const positionBroadcastSamples = 10 // per packet
+
+type broadcastSample struct {
+	Day          int32   // day of year, UTC
+	Time         float64 // fraction of the day
+	Azimuth      float64 // corrected [deg]
+	Elevation    float64
+	Rotator      float64
+	AzimuthRaw   float64 // encoder [deg]
+	ElevationRaw float64
+	RotatorRaw   float64
+}
+
+type positionBroadcastPacket [positionBroadcastSamples]broadcastSample
+
+// A PositionSample is a broadcast sample with its time.
+type PositionSample struct {
+	Time         time.Time `json:"time"` // UTC, from the ACU clock
+	Azimuth      float64   `json:"azimuth"`
+	Elevation    float64   `json:"elevation"`
+	Rotator      float64   `json:"rotator"`
+	AzimuthRaw   float64   `json:"azimuth_raw"`
+	ElevationRaw float64   `json:"elevation_raw"`
+	RotatorRaw   float64   `json:"rotator_raw"`
+}
+
+// broadcastTime converts a sample's day of year and time of day to UTC,
+// taking the year from received, the host time at reception, across the
+// New Year.
+func broadcastTime(day int32, frac float64, received time.Time) time.Time {
+	received = received.UTC()
+	year := received.Year()
+	t := StatusTime2Time(uint32(year), float64(day)+frac)
+	switch {
+	case t.Sub(received) > 180*24*time.Hour:
+		t = StatusTime2Time(uint32(year-1), float64(day)+frac)
+	case received.Sub(t) > 180*24*time.Hour:
+		t = StatusTime2Time(uint32(year+1), float64(day)+frac)
+	}
+	return t
+}
+
+// decodePositionBroadcast decodes a packet received at received.
+func decodePositionBroadcast(b []byte, received time.Time) ([]PositionSample, error) {
+	var p positionBroadcastPacket
+	if len(b) != binary.Size(&p) {
+		return nil, fmt.Errorf("position broadcast: %d byte packet, expected %d", len(b), binary.Size(&p))
+	}
+	err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &p)
+	if err != nil {
+		return nil, err
+	}
+	samples := make([]PositionSample, len(p))
+	for i, s := range p {
+		samples[i] = PositionSample{
+			Time:         broadcastTime(s.Day, s.Time, received),
+			Azimuth:      s.Azimuth,
+			Elevation:    s.Elevation,
+			Rotator:      s.Rotator,
+			AzimuthRaw:   s.AzimuthRaw,
+			ElevationRaw: s.ElevationRaw,
+			RotatorRaw:   s.RotatorRaw,
+		}
+	}
+	return samples, nil
+}
+
+// A PositionBroadcastHeader identifies the command running when a packet
+// was received, so the data taken can be matched to it (see SetHeader).
+type PositionBroadcastHeader struct {
+	CommandID string            `json:"command_id,omitempty"`
+	Command   string            `json:"command,omitempty"`
+	Metadata  map[string]string `json:"metadata,omitempty"`
+}
+
+// PositionBroadcastStatus summarizes the receiver.
+type PositionBroadcastStatus struct {
+	Listen   string          `json:"listen"`
+	Forward  []string        `json:"forward"`
+	Packets  int             `json:"packets"`
+	Errors   int             `json:"errors"`             // bad packets
+	Last     *PositionSample `json:"last,omitempty"`     // most recent sample
+	Received *time.Time      `json:"received,omitempty"` // when the last packet arrived
+	Latency  float64         `json:"latency"`            // received minus last sample time [s]
+}
+
+// A PositionBroadcast receives and republishes the position broadcast.
+type PositionBroadcast struct {
+	conn    *net.UDPConn
+	forward []*net.UDPAddr
+	out     *net.UDPConn
+	archive *Archive // if archiving
+	header  func() PositionBroadcastHeader
+
+	mu       sync.Mutex
+	subs     map[chan []PositionSample]bool
+	packets  int
+	errors   int
+	last     *PositionSample
+	received time.Time
+}
+
+// ListenPositionBroadcast listens for the broadcast on addr, forwarding
+// it to the comma separated UDP addresses in forward, if any.
+func ListenPositionBroadcast(addr, forward string, archive *Archive) (*PositionBroadcast, error) {
+	laddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	b := &PositionBroadcast{archive: archive, subs: make(map[chan []PositionSample]bool)}
+	if forward != "" {
+		for _, s := range strings.Split(forward, ",") {
+			addr, err := net.ResolveUDPAddr("udp", strings.TrimSpace(s))
+			if err != nil {
+				return nil, fmt.Errorf("position broadcast forward: %w", err)
+			}
+			b.forward = append(b.forward, addr)
+		}
+		b.out, err = net.ListenUDP("udp", nil)
+		if err != nil {
+			return nil, err
+		}
+	}
+	b.conn, err = net.ListenUDP("udp", laddr)
+	if err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetHeader has the samples republished with a header, from fn, as
+// {"header": {...}, "samples": [...]} rather than a bare array.
+// It must be called before Run.
+func (b *PositionBroadcast) SetHeader(fn func() PositionBroadcastHeader) {
+	b.header = fn
+}
+
+// Marshal returns the JSON message republishing samples.
+func (b *PositionBroadcast) Marshal(samples []PositionSample) ([]byte, error) {
+	if b.header == nil {
+		return json.Marshal(samples)
+	}
+	return json.Marshal(struct {
+		Header  PositionBroadcastHeader `json:"header"`
+		Samples []PositionSample        `json:"samples"`
+	}{b.header(), samples})
+}
+
+func (b *PositionBroadcast) Run() error {
+	buf := make([]byte, 65536)
+	for {
+		n, _, err := b.conn.ReadFromUDP(buf)
+		if err != nil {
+			return err
+		}
+		now := time.Now()
+		b.handle(buf[:n], now)
+	}
+}
+
+func (b *PositionBroadcast) handle(packet []byte, received time.Time) {
+	samples, err := decodePositionBroadcast(packet, received)
+	if err != nil {
+		b.mu.Lock()
+		b.errors++
+		n := b.errors
+		b.mu.Unlock()
+		if n%1000 == 1 { // don't flood the log at 200 Hz
+			log.Printf("%v (%d bad packets)", err, n)
+		}
+		return
+	}
+	if b.archive != nil {
+		b.archive.Add(positionBroadcastDataset, received, append([]byte(nil), packet...))
+	}
+	if len(b.forward) > 0 {
+		msg, _ := b.Marshal(samples)
+		for _, addr := range b.forward {
+			_, err := b.out.WriteToUDP(msg, addr)
+			if err != nil {
+				log.Print("position broadcast: ", err)
+			}
+		}
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.packets++
+	b.last = &samples[len(samples)-1]
+	b.received = received
+	for c := range b.subs {
+		select {
+		case c <- samples:
+		default: // slow client, drop the packet
+		}
+	}
+}
+
+// Subscribe returns a channel of the samples in each packet.
+func (b *PositionBroadcast) Subscribe() (chan []PositionSample, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if len(b.subs) >= positionBroadcastMaxSubs {
+		return nil, fmt.Errorf("too many position broadcast clients")
+	}
+	c := make(chan []PositionSample, positionBroadcastSubQueue)
+	b.subs[c] = true
+	return c, nil
+}
+
+func (b *PositionBroadcast) Unsubscribe(c chan []PositionSample) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.subs, c)
+}
+
+func (b *PositionBroadcast) Status() PositionBroadcastStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	s := PositionBroadcastStatus{
+		Listen:  b.conn.LocalAddr().String(),
+		Forward: []string{},
+		Packets: b.packets,
+		Errors:  b.errors,
+	}
+	for _, addr := range b.forward {
+		s.Forward = append(s.Forward, addr.String())
+	}
+	if b.last != nil {
+		last, received := *b.last, b.received
+		s.Last, s.Received = &last, &received
+		s.Latency = received.Sub(last.Time).Seconds()
+	}
+	return s
+}
+
+// servePositionBroadcast serves the receiver's status, and streams its
+// samples to WebSocket clients. b is nil if the receiver isn't enabled.
+func servePositionBroadcast(mux *http.ServeMux, b *PositionBroadcast) {
+	mux.HandleFunc("/acu/position-broadcast/status", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		if b == nil {
+			err := fmt.Errorf("position broadcast receiver not enabled")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		status := b.Status()
+		err := json.NewEncoder(w).Encode(&status)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/acu/position-broadcast/stream", func(w http.ResponseWriter, req *http.Request) {
+		if b == nil {
+			err := fmt.Errorf("position broadcast receiver not enabled")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		sub, err := b.Subscribe()
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		defer b.Unsubscribe(sub)
+
+		conn, err := upgradeWebsocket(w, req)
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		done := make(chan struct{})
+		go conn.serveControl(done)
+
+		for {
+			select {
+			case <-done:
+				return
+			case samples := <-sub:
+				b, err := b.Marshal(samples)
+				if err == nil {
+					err = conn.WriteText(b)
+				}
+				if err != nil {
+					log.Print("position broadcast stream: ", err)
+					return
+				}
+			}
+		}
+	})
+}
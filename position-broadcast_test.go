@@ -0,0 +1,112 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestBroadcastTime(t *testing.T) {
+	for _, test := range []struct {
+		day      int32
+		frac     float64
+		received time.Time
+		expected time.Time
+	}{
+		{152, 0.5, time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC), time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)},
+		// sent just before the New Year, received after
+		{365, 0.999, time.Date(2026, 1, 1, 0, 0, 1, 0, time.UTC), time.Date(2025, 12, 31, 23, 58, 33, 600e6, time.UTC)},
+		// the ACU clock ahead across the New Year
+		{1, 0.001, time.Date(2025, 12, 31, 23, 59, 59, 0, time.UTC), time.Date(2026, 1, 1, 0, 1, 26, 400e6, time.UTC)},
+	} {
+		got := broadcastTime(test.day, test.frac, test.received)
+		if d := got.Sub(test.expected); d < -time.Millisecond || d > time.Millisecond {
+			t.Errorf("broadcastTime(%d, %g, %v) = %v, expected %v", test.day, test.frac, test.received, got, test.expected)
+		}
+	}
+}
+
+func TestPositionBroadcast(t *testing.T) {
+	forward, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer forward.Close()
+	b, err := ListenPositionBroadcast("127.0.0.1:0", forward.LocalAddr().String(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.Run()
+	sub, err := b.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer b.Unsubscribe(sub)
+
+	now := time.Now().UTC()
+	doy := float64(now.YearDay()) + (time.Duration(now.Hour())*time.Hour+time.Duration(now.Minute())*time.Minute).Hours()/24
+	var p positionBroadcastPacket
+	for i := range p {
+		p[i] = broadcastSample{Day: int32(doy), Time: doy - float64(int32(doy)), Azimuth: float64(i), Elevation: 60}
+	}
+	var packet bytes.Buffer
+	binary.Write(&packet, binary.LittleEndian, &p)
+	conn, err := net.Dial("udp", b.conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte("short"))
+	conn.Write(packet.Bytes())
+
+	select {
+	case samples := <-sub:
+		if len(samples) != positionBroadcastSamples || samples[9].Azimuth != 9 || samples[0].Elevation != 60 ||
+			now.Sub(samples[0].Time) > time.Minute {
+			t.Errorf("got %+v", samples)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("no samples")
+	}
+
+	buf := make([]byte, 65536)
+	forward.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := forward.ReadFromUDP(buf)
+	var forwarded []PositionSample
+	if err == nil {
+		err = json.Unmarshal(buf[:n], &forwarded)
+	}
+	if err != nil || len(forwarded) != positionBroadcastSamples {
+		t.Errorf("forwarded %d samples, %v", len(forwarded), err)
+	}
+
+	if s := b.Status(); s.Packets != 1 || s.Errors != 1 || s.Last == nil || s.Last.Azimuth != 9 {
+		t.Errorf("got status %+v", s)
+	}
+}
+
+func TestPositionBroadcastHeader(t *testing.T) {
+	var b PositionBroadcast
+	samples := []PositionSample{{Azimuth: 120, Elevation: 60}}
+	msg, err := b.Marshal(samples)
+	if err != nil || msg[0] != '[' {
+		t.Errorf("without a header: got %s, %v", msg, err)
+	}
+	b.SetHeader(func() PositionBroadcastHeader {
+		return PositionBroadcastHeader{CommandID: "a", Command: "/track", Metadata: map[string]string{"observation_id": "obs-1"}}
+	})
+	msg, err = b.Marshal(samples)
+	var x struct {
+		Header  PositionBroadcastHeader
+		Samples []PositionSample
+	}
+	if err == nil {
+		err = json.Unmarshal(msg, &x)
+	}
+	if err != nil || x.Header.CommandID != "a" || x.Header.Metadata["observation_id"] != "obs-1" || len(x.Samples) != 1 {
+		t.Errorf("with a header: got %s, %v", msg, err)
+	}
+}
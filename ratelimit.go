@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// RateLimit limits the commands each client with a role may submit:
+// a sustained rate with bursts, and no resubmitting the same command
+// (endpoint and arguments) too soon.
+type RateLimit struct {
+	Rate            float64 `json:"rate"`             // [commands/s], 0 for no limit
+	Burst           int     `json:"burst"`            // commands
+	DuplicateWindow float64 `json:"duplicate_window"` // [s], 0 to allow duplicates
+}
+
+func (l RateLimit) validate(role string) error {
+	if !(l.Rate >= 0) || (l.Rate > 0 && l.Burst < 1) || !(l.DuplicateWindow >= 0) {
+		return fmt.Errorf("rate_limits: bad %s limit %+v", role, l)
+	}
+	return nil
+}
+
+// RateLimitsConfig sets the rate limits by role. Without authentication,
+// clients have every role, so the engineer's limits.
+type RateLimitsConfig struct {
+	Observer RateLimit `json:"observer"`
+	Operator RateLimit `json:"operator"`
+	Engineer RateLimit `json:"engineer"`
+}
+
+func (c RateLimitsConfig) validate() error {
+	err := c.Observer.validate("observer")
+	if err == nil {
+		err = c.Operator.validate("operator")
+	}
+	if err == nil {
+		err = c.Engineer.validate("engineer")
+	}
+	return err
+}
+
+func (c RateLimitsConfig) forRole(r Role) RateLimit {
+	switch r {
+	case roleObserver:
+		return c.Observer
+	case roleOperator:
+		return c.Operator
+	}
+	return c.Engineer
+}
+
+// commands which are never limited, so a client can always stop
+var unlimitedEndpoints = map[string]bool{
+	"/shutdown": true,
+	"/stow":     true,
+}
+
+// A CommandLimiter applies the configured rate limits to each client,
+// by name. It is safe for concurrent use.
+type CommandLimiter struct {
+	mu      sync.Mutex
+	clients map[string]*clientLimit
+}
+
+type clientLimit struct {
+	tokens      float64
+	refilled    time.Time
+	command     string // the last one allowed
+	commandTime time.Time
+}
+
+func NewCommandLimiter() *CommandLimiter {
+	return &CommandLimiter{clients: make(map[string]*clientLimit)}
+}
+
+// Allow checks p (nil without authentication) may submit a command to
+// endpoint with args at now, and if so, counts it.
+func (l *CommandLimiter) Allow(p *Principal, endpoint string, args []byte, now time.Time) error {
+	if unlimitedEndpoints[endpoint] {
+		return nil
+	}
+	name, role := "", roleEngineer
+	if p != nil {
+		name, role = p.Name, p.Role
+	}
+	limit := currentConfig().RateLimits.forRole(role)
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	c := l.clients[name]
+	if c == nil {
+		c = &clientLimit{tokens: float64(limit.Burst), refilled: now}
+		l.clients[name] = c
+	}
+	if limit.Rate > 0 {
+		dt := now.Sub(c.refilled).Seconds()
+		c.tokens = math.Min(c.tokens+dt*limit.Rate, float64(limit.Burst))
+		c.refilled = now
+		if c.tokens < 1 {
+			return fmt.Errorf("rate limited: more than %d commands, or %g per second", limit.Burst, limit.Rate)
+		}
+		c.tokens--
+	}
+	command := endpoint + " " + string(args)
+	if age := now.Sub(c.commandTime).Seconds(); command == c.command && age < limit.DuplicateWindow {
+		return fmt.Errorf("duplicate of the %s command submitted %.1f seconds ago", endpoint, age)
+	}
+	c.command, c.commandTime = command, now
+	return nil
+}
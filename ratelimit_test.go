@@ -0,0 +1,41 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandLimiter(t *testing.T) {
+	defer applyConfig(currentConfig())
+	c := currentConfig()
+	c.RateLimits.Observer = RateLimit{Rate: 1, Burst: 2, DuplicateWindow: 5}
+	c.RateLimits.Engineer = RateLimit{}
+	applyConfig(c)
+
+	l := NewCommandLimiter()
+	alice := &Principal{Name: "alice", Role: roleObserver}
+	bob := &Principal{Name: "bob", Role: roleObserver}
+	now := time.Now()
+	for i, tc := range []struct {
+		p        *Principal
+		endpoint string
+		args     string
+		dt       float64 // [s]
+		ok       bool
+	}{
+		{alice, "/move-to", `{"azimuth": 120, "elevation": 60}`, 0, true},
+		{alice, "/move-to", `{"azimuth": 120, "elevation": 60}`, 0, false}, // duplicate
+		{alice, "/move-to", `{"azimuth": 121, "elevation": 60}`, 0, false}, // burst used up
+		{alice, "/stow", `{}`, 0, true},
+		{bob, "/move-to", `{"azimuth": 120, "elevation": 60}`, 0, true},
+		{alice, "/move-to", `{"azimuth": 121, "elevation": 60}`, 1, true},
+		{alice, "/move-to", `{"azimuth": 120, "elevation": 60}`, 6, true},
+		{nil, "/move-to", `{"azimuth": 120, "elevation": 60}`, 6, true}, // no limits
+		{nil, "/move-to", `{"azimuth": 120, "elevation": 60}`, 6, true},
+	} {
+		err := l.Allow(tc.p, tc.endpoint, []byte(tc.args), now.Add(Seconds2Duration(tc.dt)))
+		if (err == nil) != tc.ok {
+			t.Errorf("%d: got %v, expected ok %v", i, err, tc.ok)
+		}
+	}
+}
@@ -0,0 +1,244 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// A recording is the raw ACU status traffic, as the TCS fetched it:
+//
+//	int64 unix time [ns] | uint16 name length | uint32 length | dataset name | raw dataset bytes
+//
+// all little endian, after a recordingMagic header.
+
+const recordingMagic = "FYSTREC1"
+
+// A StatusRecorder records the datasets fetched from the ACU.
+type StatusRecorder struct {
+	mu sync.Mutex
+	f  *os.File
+}
+
+func NewStatusRecorder(filename string) (*StatusRecorder, error) {
+	f, err := os.OpenFile(filename, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return nil, err
+	}
+	_, err = f.WriteString(recordingMagic)
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return &StatusRecorder{f: f}, nil
+}
+
+// Record records dataset b, fetched now.
+func (r *StatusRecorder) Record(name string, b []byte) {
+	buf := make([]byte, 14, 14+len(name)+len(b))
+	binary.LittleEndian.PutUint64(buf[0:8], uint64(time.Now().UnixNano()))
+	binary.LittleEndian.PutUint16(buf[8:10], uint16(len(name)))
+	binary.LittleEndian.PutUint32(buf[10:14], uint32(len(b)))
+	buf = append(buf, name...)
+	buf = append(buf, b...)
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	_, err := r.f.Write(buf) // unbuffered, so a crash keeps everything
+	if err != nil {
+		log.Print("recording: ", err)
+	}
+}
+
+func (r *StatusRecorder) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.f.Close()
+}
+
+type recordedDataset struct {
+	t time.Time
+	b []byte
+}
+
+// A Replay is recorded ACU status, by dataset and time.
+type Replay map[string][]recordedDataset
+
+// ReadRecording reads a recording file.
+func ReadRecording(filename string) (Replay, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	r := bufio.NewReader(f)
+	magic := make([]byte, len(recordingMagic))
+	_, err = io.ReadFull(r, magic)
+	if err != nil || string(magic) != recordingMagic {
+		return nil, fmt.Errorf("%s: not a recording", filename)
+	}
+	replay := make(Replay)
+	for {
+		var hdr [14]byte
+		_, err := io.ReadFull(r, hdr[:])
+		if err != nil {
+			break // EOF, or truncated by a crash
+		}
+		t := time.Unix(0, int64(binary.LittleEndian.Uint64(hdr[0:8])))
+		name := make([]byte, binary.LittleEndian.Uint16(hdr[8:10]))
+		b := make([]byte, binary.LittleEndian.Uint32(hdr[10:14]))
+		_, err = io.ReadFull(r, name)
+		if err == nil {
+			_, err = io.ReadFull(r, b)
+		}
+		if err != nil {
+			break
+		}
+		replay[string(name)] = append(replay[string(name)], recordedDataset{t, b})
+	}
+	return replay, nil
+}
+
+// ReadArchiveReplay reads the archived datasets from t0 up to t1 (see Archive).
+func ReadArchiveReplay(dir string, t0, t1 time.Time) (Replay, error) {
+	replay := make(Replay)
+	for name := range archiveDatasets {
+		err := ReadArchive(dir, name, t0, t1, func(t time.Time, b []byte) error {
+			replay[name] = append(replay[name], recordedDataset{t, b})
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return replay, nil
+}
+
+// Span returns the recording's start and end.
+func (replay Replay) Span() (time.Time, time.Time) {
+	var t0, t1 time.Time
+	for _, records := range replay {
+		if len(records) == 0 {
+			continue
+		}
+		if t0.IsZero() || records[0].t.Before(t0) {
+			t0 = records[0].t
+		}
+		if last := records[len(records)-1].t; last.After(t1) {
+			t1 = last
+		}
+	}
+	return t0, t1
+}
+
+// at returns the latest dataset recorded by t.
+func (replay Replay) at(name string, t time.Time) ([]byte, bool) {
+	records := replay[name]
+	i := sort.Search(len(records), func(i int) bool { return records[i].t.After(t) })
+	if i == 0 {
+		return nil, false
+	}
+	return records[i-1].b, true
+}
+
+// A ReplayACU stands in for the ACU, serving recorded status
+// from the start of the recording, speed times faster than real time.
+// It accepts and ignores commands, so the TCS runs as it would have.
+type ReplayACU struct {
+	now    func() time.Time // for tests
+	replay Replay
+	speed  float64
+	t0, t1 time.Time // recording span
+	start  time.Time // of the replay
+
+	mu       sync.Mutex
+	finished bool
+}
+
+func NewReplayACU(replay Replay, speed float64) (*ReplayACU, error) {
+	if speed <= 0 {
+		return nil, fmt.Errorf("bad replay speed %g", speed)
+	}
+	t0, t1 := replay.Span()
+	if t0.IsZero() {
+		return nil, fmt.Errorf("empty recording")
+	}
+	r := &ReplayACU{now: time.Now, replay: replay, speed: speed, t0: t0, t1: t1}
+	r.start = r.now()
+	return r, nil
+}
+
+// recordingTime returns the time in the recording being replayed.
+func (r *ReplayACU) recordingTime() time.Time {
+	dt := Seconds2Duration(r.now().Sub(r.start).Seconds() * r.speed)
+	t := r.t0.Add(dt)
+	if t.After(r.t1) {
+		r.mu.Lock()
+		if !r.finished {
+			log.Print("replay: finished, holding the last status")
+			r.finished = true
+		}
+		r.mu.Unlock()
+	}
+	return t
+}
+
+func (r *ReplayACU) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	switch req.URL.Path {
+	case "/Values":
+		name := strings.TrimPrefix(req.URL.Query().Get("identifier"), "DataSets.")
+		b, ok := r.replay.at(name, r.recordingTime())
+		if !ok {
+			fmt.Fprintf(w, "Failed: %s not recorded yet", name)
+			return
+		}
+		if name == "StatusGeneral8100" {
+			// the TCS checks the ACU clock against its own
+			var rec datasets.StatusGeneral8100
+			err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &rec)
+			if err == nil {
+				rec.Year, rec.Time = statusTime(r.now())
+				var buf bytes.Buffer
+				binary.Write(&buf, binary.LittleEndian, &rec)
+				b = buf.Bytes()
+			}
+		}
+		w.Write(b)
+	case "/GetPtStack":
+	default:
+		log.Printf("replay: ignoring %s %s", req.Method, req.URL.RequestURI())
+		fmt.Fprint(w, "OK")
+	}
+}
+
+// loadReplay reads a recording file, or the archive directory
+// from start up to stop (RFC 3339).
+func loadReplay(path, start, stop string) (Replay, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return ReadRecording(path)
+	}
+	t0, err := time.Parse(time.RFC3339, start)
+	if err != nil {
+		return nil, fmt.Errorf("replay start: %w", err)
+	}
+	t1, err := time.Parse(time.RFC3339, stop)
+	if err != nil {
+		return nil, fmt.Errorf("replay stop: %w", err)
+	}
+	return ReadArchiveReplay(path, t0, t1)
+}
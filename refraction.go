@@ -1,7 +1,12 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
+	"log"
 	"math"
+	"net/http"
+	"sync"
 )
 
 // A Refraction represents the atmospheric refraction model
@@ -53,3 +58,155 @@ func (ref Refraction) SkyEl2ObsEl(skyEl float64) float64 {
 	dz := (ref.a + w) * tz / (1.0 + (ref.a+3.0*w)/(cz*cz))
 	return skyEl + rad2deg(dz)
 }
+
+// Weather holds the site conditions that determine refraction.
+type Weather struct {
+	Pressure    float64 `json:"pressure"`    // hPa
+	Temperature float64 `json:"temperature"` // deg C
+	Humidity    float64 `json:"humidity"`    // relative, 0-1
+}
+
+// typical conditions at the site
+var defaultWeather = Weather{
+	Pressure:    550,
+	Temperature: 0,
+	Humidity:    0.2,
+}
+
+// observing wavelength [micrometers]; refraction is achromatic above 100
+const refractionWavelength = 1000
+
+// An Atmosphere applies refraction for the current site weather.
+// It is safe for concurrent use.
+type Atmosphere struct {
+	mu      sync.Mutex
+	enabled bool
+	weather Weather
+	ref     Refraction
+}
+
+// siteAtmosphere is used when converting celestial to horizon coordinates.
+var siteAtmosphere = NewAtmosphere(defaultWeather)
+
+func NewAtmosphere(w Weather) *Atmosphere {
+	atm := &Atmosphere{enabled: true}
+	err := atm.SetWeather(w)
+	if err != nil {
+		panic(err)
+	}
+	return atm
+}
+
+// SetWeather updates the refraction model for new conditions.
+func (atm *Atmosphere) SetWeather(w Weather) error {
+	if w.Pressure <= 0 || w.Humidity < 0 || w.Humidity > 1 || w.Temperature < -150 || w.Temperature > 100 {
+		return fmt.Errorf("bad weather: %+v", w)
+	}
+	ref, err := NewRefraction(w.Pressure, w.Temperature, w.Humidity, refractionWavelength)
+	if err != nil {
+		return err
+	}
+	atm.mu.Lock()
+	defer atm.mu.Unlock()
+	atm.weather = w
+	atm.ref = ref
+	return nil
+}
+
+// SetEnabled turns the refraction correction on or off.
+func (atm *Atmosphere) SetEnabled(enabled bool) {
+	atm.mu.Lock()
+	defer atm.mu.Unlock()
+	atm.enabled = enabled
+}
+
+// State returns whether the correction is enabled, and the current weather.
+func (atm *Atmosphere) State() (bool, Weather) {
+	atm.mu.Lock()
+	defer atm.mu.Unlock()
+	return atm.enabled, atm.weather
+}
+
+// SkyEl2ObsEl converts topocentric to observed (refracted) elevation.
+func (atm *Atmosphere) SkyEl2ObsEl(el float64) float64 {
+	atm.mu.Lock()
+	enabled, ref := atm.enabled, atm.ref
+	atm.mu.Unlock()
+	if !enabled {
+		return el
+	}
+	return ref.SkyEl2ObsEl(el)
+}
+
+// ObsEl2SkyEl converts observed (refracted) to topocentric elevation.
+func (atm *Atmosphere) ObsEl2SkyEl(el float64) float64 {
+	atm.mu.Lock()
+	enabled, ref := atm.enabled, atm.ref
+	atm.mu.Unlock()
+	if !enabled {
+		return el
+	}
+	return ref.ObsEl2SkyEl(el)
+}
+
+// RADec2ObsAzEl converts ICRS RA/Dec to observed (i.e., refracted) Az/El,
+// using the site atmosphere. All angles are in degrees.
+func RADec2ObsAzEl(unixtime, ra, dec float64) (float64, float64, error) {
+	az, el, err := RADec2AzEl(unixtime, ra, dec)
+	return az, siteAtmosphere.SkyEl2ObsEl(el), err
+}
+
+// StarObsAzEl converts a catalog position to observed (i.e., refracted) Az/El,
+// using the site atmosphere. All angles are in degrees.
+func StarObsAzEl(unixtime float64, star Star) (float64, float64, error) {
+	az, el, err := StarAzEl(unixtime, star)
+	return az, siteAtmosphere.SkyEl2ObsEl(el), err
+}
+
+// Sky2ObsAzEl converts celestial coordinates x,y to observed Az/El.
+// See Sky2ICRS for the coordinate systems. All angles are in degrees.
+func Sky2ObsAzEl(unixtime, x, y float64, coordsys string) (float64, float64, error) {
+	ra, dec, err := Sky2ICRS(coordsys, x, y)
+	if err != nil {
+		return 0, 0, err
+	}
+	return RADec2ObsAzEl(unixtime, ra, dec)
+}
+
+// serveRefraction serves the site atmosphere used for refraction.
+func serveRefraction() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Enabled bool `json:"enabled"`
+				Weather
+			}
+			response.Enabled, response.Weather = siteAtmosphere.State()
+			err := json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Enabled *bool    `json:"enabled"`
+				Weather *Weather `json:"weather"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil && x.Weather != nil {
+				log.Printf("setting refraction weather: %+v", *x.Weather)
+				err = siteAtmosphere.SetWeather(*x.Weather)
+			}
+			if err == nil && x.Enabled != nil {
+				log.Printf("setting refraction enabled: %v", *x.Enabled)
+				siteAtmosphere.SetEnabled(*x.Enabled)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	}
+}
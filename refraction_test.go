@@ -25,3 +25,17 @@ func TestRefraction(t *testing.T) {
 		t.Error(obsEl, skyEl, obsEl2)
 	}
 }
+
+func TestAtmosphere(t *testing.T) {
+	atm := NewAtmosphere(Weather{Pressure: 550, Temperature: 10, Humidity: 0.5})
+	if el := atm.SkyEl2ObsEl(20); el <= 20 {
+		t.Errorf("refraction should raise the elevation: got %v", el)
+	}
+	atm.SetEnabled(false)
+	if el := atm.SkyEl2ObsEl(20); el != 20 {
+		t.Errorf("disabled refraction changed the elevation: got %v", el)
+	}
+	if err := atm.SetWeather(Weather{Pressure: -1}); err == nil {
+		t.Error("bad weather accepted")
+	}
+}
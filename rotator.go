@@ -0,0 +1,128 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"math"
+	"time"
+)
+
+// instrument rotator (ACU third axis) limits, set at startup, see applyConfig
+var (
+	rotatorMin      = -180.0
+	rotatorMax      = 180.0
+	rotatorSpeedMax = 1.0 // [deg/s]
+)
+
+// see capThirdAxis
+type thirdAxisStatus struct {
+	Mode              uint8
+	CommandedPosition float64
+	CurrentPosition   float64
+	CurrentVelocity   float64
+}
+
+const (
+	thirdAxisModeStop   = 0
+	thirdAxisModePreset = 1
+)
+
+func checkRotator(angle float64) error {
+	if angle < rotatorMin || angle > rotatorMax {
+		return &LimitError{"rotator", "position", angle, rotatorMin, rotatorMax, false}
+	}
+	return nil
+}
+
+// checkRotatorOption checks an optional rotator angle.
+func checkRotatorOption(angle *float64) error {
+	if angle == nil {
+		return nil
+	}
+	return checkRotator(*angle)
+}
+
+// A rotatorCmd moves the instrument rotator.
+type rotatorCmd struct {
+	Angle float64 `json:"angle"`
+}
+
+func (cmd rotatorCmd) Check() error {
+	return checkRotator(cmd.Angle)
+}
+
+func (cmd rotatorCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startRotator(tel, cmd.Angle)
+}
+
+// startRotator moves the rotator to angle, returning an IsDoneFunc that
+// is done when the rotator is stationary at angle, and fails if the
+// rotator leaves preset mode.
+func startRotator(tel *Telescope, angle float64) (IsDoneFunc, error) {
+	var status thirdAxisStatus
+	err := tel.acu.ThirdAxisStatusGet(&status)
+	if err != nil {
+		return nil, err
+	}
+	t0 := time.Now()
+	timeout := Seconds2Duration(1.1*math.Abs(angle-status.CurrentPosition)/rotatorSpeedMax + 10)
+	log.Printf("rotator: moving from %g to %g", status.CurrentPosition, angle)
+
+	err = tel.acu.ThirdAxisPresetSet(angle)
+	if err != nil {
+		return nil, err
+	}
+
+	seenPreset := false
+	isDone := func(tel *Telescope) (bool, error) {
+		var status thirdAxisStatus
+		err := tel.acu.ThirdAxisStatusGet(&status)
+		if err != nil {
+			return true, err
+		}
+		if status.Mode == thirdAxisModePreset {
+			seenPreset = true
+		} else if seenPreset {
+			return true, fmt.Errorf("rotator left preset mode (mode %d)", status.Mode)
+		}
+		cfg := currentConfig()
+		done := seenPreset &&
+			(math.Abs(status.CurrentPosition-angle) < cfg.PositionTolerance) &&
+			(math.Abs(status.CurrentVelocity) < cfg.SpeedTolerance)
+		if !done && time.Since(t0) > timeout {
+			return true, fmt.Errorf("rotator move timed out")
+		}
+		return done, nil
+	}
+	return isDone, nil
+}
+
+// startWithRotator starts a command, first moving the rotator to angle
+// if it's not nil. The command is done when both the command and the
+// rotator are done.
+func startWithRotator(tel *Telescope, angle *float64, start func() (IsDoneFunc, error)) (IsDoneFunc, error) {
+	if angle == nil {
+		return start()
+	}
+	rotatorDone, err := startRotator(tel, *angle)
+	if err != nil {
+		return nil, err
+	}
+	cmdDone, err := start()
+	if err != nil {
+		return nil, err
+	}
+	isDone := func(tel *Telescope) (bool, error) {
+		rdone, err := rotatorDone(tel)
+		if err != nil {
+			return true, err
+		}
+		done, err := cmdDone(tel)
+		if !done || err != nil {
+			return done, err
+		}
+		return rdone, nil
+	}
+	return isDone, nil
+}
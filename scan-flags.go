@@ -0,0 +1,174 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The detector DAQ cuts the turnarounds out of the data using the scan
+// flags: the times the executing pattern switches between scanning at
+// constant velocity and turning around. They're taken from the pattern's
+// own turnaround flags as its points are uploaded, so they arrive up to
+// uploadLookahead ahead of time, rather than being thresholded from the
+// velocity afterwards.
+
+const (
+	scanFlagsMaxSubs  = 10
+	scanFlagsSubQueue = 100
+)
+
+// scan flag segments
+const (
+	segmentScan       = "scan" // between turnarounds
+	segmentTurnaround = "turnaround"
+	segmentEnd        = "end" // no pattern
+)
+
+// A ScanFlag marks the start of a segment of the pattern, which lasts
+// until the next flag. An end flag cancels any later flags already sent,
+// e.g. when a pattern is paused or aborted.
+type ScanFlag struct {
+	Time    time.Time         `json:"time"`
+	Segment string            `json:"segment"`
+	Sweep   int               `json:"sweep,omitempty"` // of the pattern, from 1, for scans
+	Tags    map[string]string `json:"tags,omitempty"`  // of the command, for scans
+}
+
+// A taggedCommand tags its scan flags, so its data can be found
+// downstream, e.g. by the pointing fits.
+type taggedCommand interface {
+	scanTags() map[string]string
+}
+
+// ScanFlags publishes the scan flags to its subscribers.
+type ScanFlags struct {
+	mu   sync.Mutex
+	subs map[chan ScanFlag]bool
+	last *ScanFlag
+}
+
+func NewScanFlags() *ScanFlags {
+	return &ScanFlags{subs: make(map[chan ScanFlag]bool)}
+}
+
+// Subscribe returns a channel of the flags, starting with the last one sent.
+func (f *ScanFlags) Subscribe() (chan ScanFlag, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs) >= scanFlagsMaxSubs {
+		return nil, fmt.Errorf("too many scan flag clients")
+	}
+	c := make(chan ScanFlag, scanFlagsSubQueue)
+	if f.last != nil {
+		c <- *f.last
+	}
+	f.subs[c] = true
+	return c, nil
+}
+
+func (f *ScanFlags) Unsubscribe(c chan ScanFlag) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	delete(f.subs, c)
+}
+
+func (f *ScanFlags) publish(flag ScanFlag) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.last = &flag
+	for c := range f.subs {
+		select {
+		case c <- flag:
+		default: // slow client, drop the flag
+		}
+	}
+}
+
+// A scanFlagger flags a pattern's segments as its points are uploaded.
+// Only one goroutine may use it at a time.
+type scanFlagger struct {
+	flags   *ScanFlags
+	segment string // "" before the first point, and after the end
+	stopped string // segment the pattern was stopped in, if it may resume
+	sweep   int
+	tags    map[string]string
+	start   time.Time // points before this are a lead-in, and aren't flagged
+}
+
+// add flags the segments starting at samples, which follow those added before.
+func (f *scanFlagger) add(samples []ScanPatternSample) {
+	for i := range samples {
+		p := &samples[i]
+		if p.T.Before(f.start) {
+			continue
+		}
+		// the turnaround flag marks the interval after the point
+		segment := segmentScan
+		if p.AzFlag == 2 || p.ElFlag == 2 {
+			segment = segmentTurnaround
+		}
+		if segment == f.segment {
+			continue
+		}
+		if segment == segmentScan && !(f.segment == "" && f.stopped == segmentScan) {
+			f.sweep++
+		}
+		f.segment, f.stopped = segment, ""
+		flag := ScanFlag{Time: p.T, Segment: segment}
+		if segment == segmentScan {
+			flag.Sweep, flag.Tags = f.sweep, f.tags
+		}
+		f.flags.publish(flag)
+	}
+}
+
+// end flags the end of the pattern at t, remembering the segment it was
+// in, in case it's resumed.
+func (f *scanFlagger) end(t time.Time) {
+	if f.segment == "" {
+		return
+	}
+	f.stopped, f.segment = f.segment, ""
+	f.flags.publish(ScanFlag{Time: t, Segment: segmentEnd})
+}
+
+// serveScanFlags streams the scan flags to a WebSocket client.
+func serveScanFlags(flags *ScanFlags) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		sub, err := flags.Subscribe()
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		defer flags.Unsubscribe(sub)
+
+		conn, err := upgradeWebsocket(w, req)
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		done := make(chan struct{})
+		go conn.serveControl(done)
+
+		for {
+			select {
+			case <-done:
+				return
+			case flag := <-sub:
+				b, err := json.Marshal(flag)
+				if err == nil {
+					err = conn.WriteText(b)
+				}
+				if err != nil {
+					log.Print("scan flag stream: ", err)
+					return
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestScanFlagger(t *testing.T) {
+	flags := NewScanFlags()
+	sub, err := flags.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flags.Unsubscribe(sub)
+
+	t0 := time.Date(2025, 6, 1, 12, 0, 0, 0, time.UTC)
+	at := func(s float64) time.Time { return t0.Add(Seconds2Duration(s)) }
+	sample := func(s float64, flag int8) ScanPatternSample {
+		return ScanPatternSample{T: at(s), AzFlag: flag}
+	}
+	tags := map[string]string{"observation": "pointing"}
+	f := &scanFlagger{flags: flags, tags: tags}
+	f.add([]ScanPatternSample{sample(0, 1), sample(1, 1), sample(2, 2), sample(3, 2)})
+	f.add([]ScanPatternSample{sample(4, 1), sample(5, 1)})
+	f.end(at(5.5)) // paused mid-scan
+	f.add([]ScanPatternSample{sample(10, 1), sample(11, 2), sample(12, 1)})
+	f.end(at(12))
+	f.end(at(13)) // already ended
+
+	expected := []ScanFlag{
+		{at(0), segmentScan, 1, nil},
+		{at(2), segmentTurnaround, 0, nil},
+		{at(4), segmentScan, 2, nil},
+		{at(5.5), segmentEnd, 0, nil},
+		{at(10), segmentScan, 2, nil}, // resumed
+		{at(11), segmentTurnaround, 0, nil},
+		{at(12), segmentScan, 3, nil},
+		{at(12), segmentEnd, 0, nil},
+	}
+	for i, e := range expected {
+		select {
+		case got := <-sub:
+			if e.Segment == segmentScan {
+				e.Tags = tags
+			}
+			if !got.Time.Equal(e.Time) || got.Segment != e.Segment || got.Sweep != e.Sweep || len(got.Tags) != len(e.Tags) {
+				t.Errorf("flag %d: got %+v, expected %+v", i, got, e)
+			}
+		default:
+			t.Fatalf("flag %d: missing, expected %+v", i, e)
+		}
+	}
+	select {
+	case got := <-sub:
+		t.Errorf("unexpected flag %+v", got)
+	default:
+	}
+
+	// new subscribers start with the last flag
+	sub2, err := flags.Subscribe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer flags.Unsubscribe(sub2)
+	if got := <-sub2; got.Segment != segmentEnd {
+		t.Errorf("got %+v, expected the end", got)
+	}
+}
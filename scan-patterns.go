@@ -2,11 +2,13 @@ package main
 
 import (
 	"fmt"
-	"log"
 	"math"
+	"sort"
 	"time"
 )
 
+// A ScanPatternSample is a program track point. The velocities are
+// feedforward for the ACU; its program track format has no accelerations.
 type ScanPatternSample struct {
 	T      time.Time `json:"t"`
 	Az     float64   `json:"az"`
@@ -17,7 +19,55 @@ type ScanPatternSample struct {
 	ElFlag int8      `json:"elFlag"`
 }
 
+// sample times from non-finite arithmetic come out near the minimum time.Time
+var minSampleTime = time.Date(1900, 1, 1, 0, 0, 0, 0, time.UTC)
+
+// checkSample checks a sample's position, velocity, and time are finite,
+// before they're checked against the limits or uploaded.
+func checkSample(x *ScanPatternSample) error {
+	switch {
+	case !isFinite(x.Az):
+		return finiteError("azimuth", x.Az)
+	case !isFinite(x.El):
+		return finiteError("elevation", x.El)
+	case !isFinite(x.AzVel):
+		return finiteError("azimuth_velocity", x.AzVel)
+	case !isFinite(x.ElVel):
+		return finiteError("elevation_velocity", x.ElVel)
+	case x.T.Before(minSampleTime):
+		return &FieldError{Field: "time", Reason: reasonNotFinite, msg: fmt.Sprintf("time (%v) not finite", x.T)}
+	}
+	return nil
+}
+
+// half the interval over which azElRate differentiates a trajectory [s]
+const azElRateStep = 0.5
+
+// azElRate returns the az,el of a trajectory at unixtime ut, with their
+// rates [deg/s] as feedforward for the ACU, by differentiating the
+// trajectory f (not the sampled points) across ut.
+func azElRate(f func(ut float64) (float64, float64, error), ut float64) (az, el, vaz, vel float64, err error) {
+	az, el, err = f(ut)
+	if err != nil {
+		return
+	}
+	az0, el0, err := f(ut - azElRateStep)
+	if err != nil {
+		return
+	}
+	az1, el1, err := f(ut + azElRateStep)
+	if err != nil {
+		return
+	}
+	daz := math.Remainder(az1-az0, 360) // across north
+	vaz = daz / (2 * azElRateStep)
+	vel = (el1 - el0) / (2 * azElRateStep)
+	return
+}
+
 // A ScanPattern represents an abstract scan pattern generator.
+// Its points are generated as they're uploaded, so it shouldn't store
+// them all, which for a long observation could be many.
 type ScanPattern interface {
 	Iterator() *ScanPatternIterator
 	// Done returns true if there are no more points, false otherwise.
@@ -26,14 +76,28 @@ type ScanPattern interface {
 	Next(*ScanPatternIterator, *ScanPatternSample) error
 }
 
+// A DelayableScanPattern can be re-timestamped, e.g. to resume after a pause.
+type DelayableScanPattern interface {
+	ScanPattern
+	// Delay returns a copy of the pattern with every point d later.
+	Delay(d time.Duration) ScanPattern
+}
+
 type ScanPatternIterator struct {
 	index int
 	t     time.Time
+
+	// used by wrapped patterns
+	inner *ScanPatternIterator
+	next  *ScanPatternSample
+	err   error
+	part  int // of a chained pattern
 }
 
 // A RepeatingScanPattern executes an az,el pattern multiple times.
 type RepeatingScanPattern struct {
 	n, m  int
+	tail  int // points left off the last repetition
 	azs   []float64
 	els   []float64
 	vazs  []float64
@@ -48,8 +112,13 @@ func (scan RepeatingScanPattern) Iterator() *ScanPatternIterator {
 	return &ScanPatternIterator{t: scan.start}
 }
 
+func (scan RepeatingScanPattern) Delay(d time.Duration) ScanPattern {
+	scan.start = scan.start.Add(d)
+	return scan
+}
+
 func (scan RepeatingScanPattern) Done(iter *ScanPatternIterator) bool {
-	return iter.index == scan.n*scan.m
+	return iter.index == scan.n*scan.m-scan.tail
 }
 
 func (scan RepeatingScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
@@ -70,66 +139,237 @@ func (scan RepeatingScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternS
 }
 
 // NewAzimuthScanPattern scans back and forth in azimuth at constant elevation.
+// A zero turnaround is the shortest the axis limits allow.
 func NewAzimuthScanPattern(start time.Time, num int, el float64, az [2]float64, speed float64, turnaround time.Duration) *RepeatingScanPattern {
+	scan := newSweepScanPattern(start, num, az, speed, turnaround, currentKinematicLimits(el)[0])
+	for i := range scan.els {
+		scan.els[i] = el
+	}
+	return scan
+}
+
+// NewElevationScanPattern scans back and forth in elevation at constant azimuth.
+// A zero turnaround is the shortest the axis limits allow.
+func NewElevationScanPattern(start time.Time, num int, az float64, el [2]float64, speed float64, turnaround time.Duration) *RepeatingScanPattern {
+	scan := newSweepScanPattern(start, num, el, speed, turnaround, currentKinematicLimits(el[0])[1])
+	// the sweep was generated in the azimuth slots; swap axes
+	scan.azs, scan.els = scan.els, scan.azs
+	scan.vazs, scan.vels = scan.vels, scan.vazs
+	scan.fazs, scan.fels = scan.fels, scan.fazs
+	for i := range scan.azs {
+		scan.azs[i] = az
+	}
+	return scan
+}
+
+// newSweepScanPattern sweeps back and forth over rng along the azimuth axis,
+// leaving the elevation axis zeroed for the caller to fill in. Each
+// turnaround is a jerk-limited S-curve past the end of the range, sampled
+// like the offset scans.
+func newSweepScanPattern(start time.Time, num int, rng [2]float64, speed float64, turnaround time.Duration, lim axisKinematicLimits) *RepeatingScanPattern {
 	const m = 5
-	azs := make([]float64, 2*m)
-	els := make([]float64, 2*m)
-	vazs := make([]float64, 2*m)
-	vels := make([]float64, 2*m)
-	fazs := make([]int8, 2*m)
-	fels := make([]int8, 2*m)
-	dts := make([]time.Duration, 2*m)
-	daz := (az[1] - az[0]) / (m - 1)
+	tt := turnaround.Seconds()
+	if tt == 0 {
+		tt = minTurnaroundTime(speed, lim.accelMax, lim.jerkMax)
+	}
+	curve := newSCurve(speed, tt, lim.jerkMax)
+	steps := int(math.Ceil(tt/offsetScanSampleInterval.Seconds() - 1e-9))
+	if steps < 1 {
+		steps = 1
+	}
+	step := tt / float64(steps)
+
+	scan := &RepeatingScanPattern{n: num, start: start}
+	add := func(az, vaz float64, flag int8, dt time.Duration) {
+		scan.azs = append(scan.azs, az)
+		scan.vazs = append(scan.vazs, vaz)
+		scan.fazs = append(scan.fazs, flag)
+		scan.dts = append(scan.dts, dt)
+	}
+	daz := (rng[1] - rng[0]) / (m - 1)
 	vel := math.Copysign(speed, daz)
 	dt := time.Duration(1e9*daz/vel) * time.Nanosecond
-	for i := 0; i < m; i++ {
-		azs[i] = az[0] + float64(i)*daz
-		els[i] = el
-		vazs[i] = vel
-		vels[i] = 0
-		fazs[i] = 1 // linear interpolation
-		fels[i] = 0
-		dts[i] = dt
-	}
-	for i := m; i < 2*m; i++ {
-		azs[i] = az[1] - float64(i-m)*daz
-		els[i] = el
-		vazs[i] = -vel
-		vels[i] = 0
-		fazs[i] = 1 // linear interpolation
-		fels[i] = 0
-		dts[i] = dt
-	}
-	dts[m-1] = turnaround
-	dts[2*m-1] = turnaround
-	fazs[m-1] = 2 // turnaround flag
-	fazs[2*m-1] = 2
-	return &RepeatingScanPattern{
-		n:     num,
-		m:     2 * m,
-		azs:   azs,
-		els:   els,
-		vazs:  vazs,
-		vels:  vels,
-		fazs:  fazs,
-		fels:  fels,
-		dts:   dts,
+	for _, dir := range []float64{1, -1} {
+		az0 := rng[0]
+		if dir < 0 {
+			az0 = rng[1]
+		}
+		for i := 0; i < m-1; i++ {
+			add(az0+dir*float64(i)*daz, dir*vel, 1, dt) // linear interpolation
+		}
+		// the turnaround flag marks the interval after the point
+		az1 := az0 + dir*float64(m-1)*daz
+		add(az1, dir*vel, 2, Seconds2Duration(step))
+		for k := 1; k < steps; k++ {
+			x, v := curve.at(float64(k) * step)
+			add(az1+dir*x*vel/speed, dir*v*vel/speed, 2, Seconds2Duration(step))
+		}
+	}
+	scan.m = len(scan.azs)
+	scan.els = make([]float64, scan.m)
+	scan.vels = make([]float64, scan.m)
+	scan.fels = make([]int8, scan.m)
+	// end on the last sweep, leaving the ACU to stop
+	scan.tail = steps - 1
+	return scan
+}
+
+// driftScanSampleInterval is the spacing of a drift scan's points.
+const driftScanSampleInterval = 10 * time.Second
+
+// A DriftScanPattern holds a constant elevation, moving at a constant
+// azimuth rate. Its points are computed as they're needed, so it takes
+// the same memory however long it lasts.
+type DriftScanPattern struct {
+	steps  int
+	dt     time.Duration
+	az, el float64
+	rate   float64 // [deg/s]
+	start  time.Time
+}
+
+// NewDriftScanPattern holds elevation el for duration, from azimuth az
+// moving at a constant azimuth rate [deg/s], or parked there if it's zero.
+func NewDriftScanPattern(start time.Time, duration time.Duration, az, el, rate float64) *DriftScanPattern {
+	steps := int(math.Ceil(duration.Seconds()/driftScanSampleInterval.Seconds() - 1e-9))
+	if steps < 1 {
+		steps = 1
+	}
+	return &DriftScanPattern{
+		steps: steps,
+		dt:    duration / time.Duration(steps),
+		az:    az,
+		el:    el,
+		rate:  rate,
 		start: start,
 	}
 }
 
-// A PathScanPattern follows a path of points.
+func (scan DriftScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{}
+}
+
+func (scan DriftScanPattern) Delay(d time.Duration) ScanPattern {
+	scan.start = scan.start.Add(d)
+	return scan
+}
+
+func (scan DriftScanPattern) Done(iter *ScanPatternIterator) bool {
+	return iter.index > scan.steps
+}
+
+func (scan DriftScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	dt := time.Duration(iter.index) * scan.dt
+	*p = ScanPatternSample{
+		T:     scan.start.Add(dt),
+		Az:    scan.az + scan.rate*dt.Seconds(),
+		El:    scan.el,
+		AzVel: scan.rate,
+	}
+	if scan.rate != 0 {
+		p.AzFlag = 1 // linear interpolation
+	}
+	iter.index++
+	return nil
+}
+
+// rasterScanRowPoints is the number of points along each row of a raster.
+const rasterScanRowPoints = 5
+
+// A RasterScanPattern sweeps back and forth along one axis, stepping the
+// other axis during each turnaround (a boustrophedon raster). Its points
+// are computed as they're needed, so it takes the same memory however
+// many rows it has.
+type RasterScanPattern struct {
+	rows       int
+	sweep      [2]float64
+	cross      float64 // first row
+	dcross     float64 // row step
+	vel        float64 // along the first row
+	dt         time.Duration
+	turnaround time.Duration
+	sweepEl    bool
+	start      time.Time
+}
+
+// NewRasterScanPattern sweeps back and forth along one axis, stepping the
+// other axis by step during each turnaround.
+// If sweepEl is true the sweeps are in elevation and the steps in azimuth.
+func NewRasterScanPattern(start time.Time, az, el [2]float64, step, speed float64, turnaround time.Duration, sweepEl bool) *RasterScanPattern {
+	const m = rasterScanRowPoints
+	sweep, cross := az, el
+	if sweepEl {
+		sweep, cross = el, az
+	}
+	dsweep := (sweep[1] - sweep[0]) / (m - 1)
+	vel := math.Copysign(speed, dsweep)
+	return &RasterScanPattern{
+		rows:       int(math.Floor(math.Abs(cross[1]-cross[0])/step+1e-9)) + 1,
+		sweep:      sweep,
+		cross:      cross[0],
+		dcross:     math.Copysign(step, cross[1]-cross[0]),
+		vel:        vel,
+		dt:         time.Duration(1e9*dsweep/vel) * time.Nanosecond,
+		turnaround: turnaround,
+		sweepEl:    sweepEl,
+		start:      start,
+	}
+}
+
+func (scan RasterScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{}
+}
+
+func (scan RasterScanPattern) Delay(d time.Duration) ScanPattern {
+	scan.start = scan.start.Add(d)
+	return scan
+}
+
+func (scan RasterScanPattern) Done(iter *ScanPatternIterator) bool {
+	return iter.index == scan.rows*rasterScanRowPoints
+}
+
+func (scan RasterScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	const m = rasterScanRowPoints
+	r, i := iter.index/m, iter.index%m
+	x0, dx, v := scan.sweep[0], (scan.sweep[1]-scan.sweep[0])/(m-1), scan.vel
+	if r%2 == 1 {
+		x0, dx, v = scan.sweep[1], -dx, -v
+	}
+	row := time.Duration(m-1)*scan.dt + scan.turnaround
+	x, y := x0+float64(i)*dx, scan.cross+float64(r)*scan.dcross
+	var flag int8 = 1 // linear interpolation
+	if i == m-1 {
+		flag = 2 // turnaround
+	}
+
+	*p = ScanPatternSample{T: scan.start.Add(time.Duration(r)*row + time.Duration(i)*scan.dt)}
+	if scan.sweepEl {
+		p.Az, p.El, p.ElVel, p.ElFlag = y, x, v, flag
+	} else {
+		p.Az, p.El, p.AzVel, p.AzFlag = x, y, v, flag
+	}
+	iter.index++
+	return nil
+}
+
+// A PathScanPattern follows a path of points [t, x, y, vx, vy]. In
+// horizon coordinates vx,vy are the az,el velocities; in sky coordinates
+// they're ignored, unless skyRates is set, when the point moves at that
+// rate on the sky.
 type PathScanPattern struct {
 	coordsys string
 	points   [][5]float64
 	t0       time.Time
+	skyRates bool
 }
 
-func NewPathScanPattern(t0 time.Time, points [][5]float64, coordsys string) *PathScanPattern {
+func NewPathScanPattern(t0 time.Time, points [][5]float64, coordsys string, skyRates bool) *PathScanPattern {
 	return &PathScanPattern{
 		coordsys: coordsys,
 		points:   points,
 		t0:       t0,
+		skyRates: skyRates,
 	}
 }
 
@@ -137,6 +377,11 @@ func (path PathScanPattern) Iterator() *ScanPatternIterator {
 	return &ScanPatternIterator{}
 }
 
+func (path PathScanPattern) Delay(d time.Duration) ScanPattern {
+	path.t0 = path.t0.Add(d)
+	return path
+}
+
 func (path PathScanPattern) Done(iter *ScanPatternIterator) bool {
 	return iter.index == len(path.points)
 }
@@ -150,12 +395,17 @@ func (path PathScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample
 	switch path.coordsys {
 	case "Horizon":
 		az, el, vaz, vel = x[1], x[2], x[3], x[4]
-	case "ICRS":
+	default:
+		var vx, vy float64
+		if path.skyRates {
+			vx, vy = x[3], x[4]
+		}
 		var err error
 		ut := Time2Unixtime(t)
-		az, el, err = RADec2AzEl(ut, x[1], x[2])
-		// XXX:TBD velocities
-		log.Printf("%f RA:%3.2f DEC:%3.2f AZ:%3.2f EL:%3.2f", ut, x[1], x[2], az, el)
+		az, el, vaz, vel, err = azElRate(func(u float64) (float64, float64, error) {
+			dt := u - ut
+			return Sky2ObsAzEl(u, x[1]+vx*dt, x[2]+vy*dt, path.coordsys)
+		}, ut)
 		if err != nil {
 			return err
 		}
@@ -171,13 +421,16 @@ func (path PathScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample
 	return nil
 }
 
-// A TrackScanPattern tracks a point on the celestial sphere.
+// A TrackScanPattern tracks a point on the celestial sphere,
+// or a solar system body.
 type TrackScanPattern struct {
 	tmin     time.Time
 	tmax     time.Time
 	ra       float64
 	dec      float64
 	coordsys string
+	body     string
+	star     *Star
 }
 
 func NewTrackScanPattern(t0, t1 time.Time, ra, dec float64, coordsys string) (*TrackScanPattern, error) {
@@ -190,28 +443,90 @@ func NewTrackScanPattern(t0, t1 time.Time, ra, dec float64, coordsys string) (*T
 	}, nil
 }
 
+func NewBodyTrackScanPattern(t0, t1 time.Time, body string) (*TrackScanPattern, error) {
+	err := checkSolarSystemBody(body)
+	if err != nil {
+		return nil, err
+	}
+	return &TrackScanPattern{
+		tmin: t0,
+		tmax: t1,
+		body: body,
+	}, nil
+}
+
+func NewStarTrackScanPattern(t0, t1 time.Time, star Star) (*TrackScanPattern, error) {
+	return &TrackScanPattern{
+		tmin:     t0,
+		tmax:     t1,
+		ra:       star.RA,
+		dec:      star.Dec,
+		coordsys: "ICRS",
+		star:     &star,
+	}, nil
+}
+
 func (track TrackScanPattern) Iterator() *ScanPatternIterator {
 	return &ScanPatternIterator{t: track.tmin}
 }
 
+func (track TrackScanPattern) Delay(d time.Duration) ScanPattern {
+	track.tmin = track.tmin.Add(d)
+	track.tmax = track.tmax.Add(d)
+	return track
+}
+
 func (track TrackScanPattern) Done(iter *ScanPatternIterator) bool {
 	return iter.t.After(track.tmax)
 }
 
+// azEl returns the target's position at t, which needn't be within the
+// pattern's times.
+func (track TrackScanPattern) azEl(t time.Time) (float64, float64, error) {
+	ut := Time2Unixtime(t)
+	switch {
+	case track.body != "":
+		return BodyObsAzEl(ut, track.body)
+	case track.star != nil:
+		return StarObsAzEl(ut, *track.star)
+	case track.coordsys == "Horizon":
+		return track.ra, track.dec, nil
+	}
+	return Sky2ObsAzEl(ut, track.ra, track.dec, track.coordsys)
+}
+
 func (track TrackScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
 	t := iter.t
 
 	// convert ra,dec to az,el
-	var az, el float64
+	var az, el, vaz, vel float64
 
-	switch track.coordsys {
-	case "Horizon":
+	switch {
+	case track.body != "":
+		var err error
+		az, el, vaz, vel, err = azElRate(func(ut float64) (float64, float64, error) {
+			return BodyObsAzEl(ut, track.body)
+		}, Time2Unixtime(t))
+		if err != nil {
+			return err
+		}
+	case track.star != nil:
+		var err error
+		unixtime := Time2Unixtime(t)
+		az, el, vaz, vel, err = azElRate(func(ut float64) (float64, float64, error) {
+			return StarObsAzEl(ut, *track.star)
+		}, unixtime)
+		if err != nil {
+			return err
+		}
+	case track.coordsys == "Horizon":
 		az, el = track.ra, track.dec
-	case "ICRS":
+	default:
 		var err error
 		unixtime := float64(t.UnixNano()) * 1e-9
-		az, el, err = RADec2AzEl(unixtime, track.ra, track.dec)
-		log.Printf("%f RA:%3.2f DEC:%3.2f AZ:%3.2f EL:%3.2f", unixtime, track.ra, track.dec, az, el)
+		az, el, vaz, vel, err = azElRate(func(ut float64) (float64, float64, error) {
+			return Sky2ObsAzEl(ut, track.ra, track.dec, track.coordsys)
+		}, unixtime)
 		if err != nil {
 			return err
 		}
@@ -220,6 +535,8 @@ func (track TrackScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSamp
 	p.T = t
 	p.Az = az
 	p.El = el
+	p.AzVel = vaz
+	p.ElVel = vel
 
 	remaining := track.tmax.Sub(t)
 	if remaining < 0 {
@@ -233,3 +550,575 @@ func (track TrackScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSamp
 	iter.t = t.Add(dt)
 	return nil
 }
+
+// An OffsetFunc returns the on-sky offset (dx,dy) and its rate of change
+// (vdx,vdy) at t seconds since the start of a pattern.
+// dx is a great-circle offset in the azimuth direction.
+type OffsetFunc func(t float64) (dx, dy, vdx, vdy float64)
+
+// An OffsetScanPattern traces an offset path around a center position.
+type OffsetScanPattern struct {
+	tmin     time.Time
+	tmax     time.Time
+	dt       time.Duration
+	x, y     float64
+	coordsys string
+	center   func(ut float64) (float64, float64, error) // observed az,el, unless Horizon
+	offset   OffsetFunc
+	flags    func(t float64) (int8, int8) // az,el flags, if not zero
+}
+
+const offsetScanSampleInterval = 100 * time.Millisecond
+
+func NewOffsetScanPattern(t0, t1 time.Time, x, y float64, coordsys string, offset OffsetFunc) *OffsetScanPattern {
+	return &OffsetScanPattern{
+		tmin:     t0,
+		tmax:     t1,
+		dt:       offsetScanSampleInterval,
+		x:        x,
+		y:        y,
+		coordsys: coordsys,
+		center: func(ut float64) (float64, float64, error) {
+			return Sky2ObsAzEl(ut, x, y, coordsys)
+		},
+		offset: offset,
+	}
+}
+
+// newTargetOffsetScanPattern is NewOffsetScanPattern centered on a track's
+// target, which may be a solar system body or a star.
+func newTargetOffsetScanPattern(t0, t1 time.Time, target TrackScanPattern, offset OffsetFunc) *OffsetScanPattern {
+	return &OffsetScanPattern{
+		tmin:     t0,
+		tmax:     t1,
+		dt:       offsetScanSampleInterval,
+		x:        target.ra,
+		y:        target.dec,
+		coordsys: target.coordsys,
+		center: func(ut float64) (float64, float64, error) {
+			return target.azEl(Unixtime2Time(ut))
+		},
+		offset: offset,
+	}
+}
+
+// NewLissajousScanPattern traces the Lissajous figure
+//
+//	dx = amp[0] sin(2 pi t/period[0] + phase)
+//	dy = amp[1] sin(2 pi t/period[1])
+//
+// around the center. Angles are in degrees and periods in seconds.
+func NewLissajousScanPattern(t0, t1 time.Time, x, y float64, coordsys string, amp, period [2]float64, phase float64) *OffsetScanPattern {
+	wx := 2 * math.Pi / period[0]
+	wy := 2 * math.Pi / period[1]
+	ph := deg2rad(phase)
+	offset := func(t float64) (float64, float64, float64, float64) {
+		sx, cx := math.Sincos(wx*t + ph)
+		sy, cy := math.Sincos(wy * t)
+		return amp[0] * sx, amp[1] * sy, amp[0] * wx * cx, amp[1] * wy * cy
+	}
+	return NewOffsetScanPattern(t0, t1, x, y, coordsys, offset)
+}
+
+// NewDaisyScanPattern traces a rose curve r = radius*sin(w t) rotating
+// at a constant rate around the center, making numPetals petals per rotation.
+// w is chosen so the peak radial speed is speed [deg/sec].
+func NewDaisyScanPattern(t0, t1 time.Time, x, y float64, coordsys string, radius, speed float64, numPetals int) *OffsetScanPattern {
+	wr, wt := daisyRates(radius, speed, numPetals)
+	offset := func(t float64) (float64, float64, float64, float64) {
+		sr, cr := math.Sincos(wr * t)
+		st, ct := math.Sincos(wt * t)
+		r := radius * sr
+		vr := radius * wr * cr
+		return r * ct, r * st, vr*ct - r*wt*st, vr*st + r*wt*ct
+	}
+	return NewOffsetScanPattern(t0, t1, x, y, coordsys, offset)
+}
+
+// daisyRates returns the radial and rotational angular rates [rad/sec]
+// of a daisy pattern. Each half period of the radial oscillation is one petal.
+func daisyRates(radius, speed float64, numPetals int) (float64, float64) {
+	wr := speed / radius
+	wt := 2 * wr / float64(numPetals)
+	return wr, wt
+}
+
+func (scan OffsetScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{t: scan.tmin}
+}
+
+func (scan OffsetScanPattern) Delay(d time.Duration) ScanPattern {
+	scan.tmin = scan.tmin.Add(d)
+	scan.tmax = scan.tmax.Add(d)
+	return scan
+}
+
+func (scan OffsetScanPattern) Done(iter *ScanPatternIterator) bool {
+	return iter.t.After(scan.tmax)
+}
+
+func (scan OffsetScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	t := iter.t
+
+	var az0, el0, vaz0, vel0 float64
+	switch scan.coordsys {
+	case "Horizon":
+		az0, el0 = scan.x, scan.y
+	default:
+		var err error
+		az0, el0, vaz0, vel0, err = azElRate(scan.center, Time2Unixtime(t))
+		if err != nil {
+			return err
+		}
+	}
+
+	// az = az0 + dx/cos(el0), and el = el0 + dy
+	dx, dy, vdx, vdy := scan.offset(t.Sub(scan.tmin).Seconds())
+	sinEl, cosEl := math.Sincos(deg2rad(el0))
+	p.T = t
+	p.Az = az0 + dx/cosEl
+	p.El = el0 + dy
+	p.AzVel = vaz0 + vdx/cosEl + dx*sinEl/(cosEl*cosEl)*deg2rad(vel0)
+	p.ElVel = vel0 + vdy
+	if scan.flags != nil {
+		p.AzFlag, p.ElFlag = scan.flags(t.Sub(scan.tmin).Seconds())
+	}
+
+	iter.t = t.Add(scan.dt)
+	return nil
+}
+
+// NewScanTrackPattern tracks a point while sweeping back and forth in
+// azimuth across it, from -throw to +throw (great-circle degrees) at
+// constant speed, reversing over turnaround with an S-curve at jerk
+// (great-circle deg/s^3, see scanTrackJerk).
+func NewScanTrackPattern(t0, t1 time.Time, x, y float64, coordsys string, throw, speed float64, turnaround time.Duration, jerk float64) *OffsetScanPattern {
+	ts := 2 * throw / speed
+	tt := turnaround.Seconds()
+	curve := newSCurve(speed, tt, jerk)
+	period := 2 * (ts + tt)
+	offset := func(t float64) (float64, float64, float64, float64) {
+		u := math.Mod(t, period)
+		switch {
+		case u < ts:
+			return -throw + speed*u, 0, speed, 0
+		case u < ts+tt:
+			x, v := curve.at(u - ts)
+			return throw + x, 0, v, 0
+		case u < 2*ts+tt:
+			u -= ts + tt
+			return throw - speed*u, 0, -speed, 0
+		default:
+			x, v := curve.at(u - 2*ts - tt)
+			return -throw - x, 0, -v, 0
+		}
+	}
+	return NewOffsetScanPattern(t0, t1, x, y, coordsys, offset)
+}
+
+// An offsetSweep is a constant velocity leg of an offset scan, from x,y.
+type offsetSweep struct {
+	x, y, vx, vy float64
+}
+
+// sweepOffsets joins offset sweeps, each lasting ts seconds, with cubic
+// (Hermite) turnarounds matching the position and velocity at either end.
+// A turnaround reversing a sweep in place has constant deceleration.
+type sweepOffsets struct {
+	sweeps []offsetSweep
+	ts     float64
+	turns  []float64 // duration of the turnaround after each sweep but the last
+	starts []float64 // of each sweep
+}
+
+func newSweepOffsets(sweeps []offsetSweep, ts float64, turns []float64) *sweepOffsets {
+	s := &sweepOffsets{sweeps: sweeps, ts: ts, turns: turns, starts: make([]float64, len(sweeps))}
+	for i := 1; i < len(sweeps); i++ {
+		s.starts[i] = s.starts[i-1] + ts + turns[i-1]
+	}
+	return s
+}
+
+func (s *sweepOffsets) duration() float64 {
+	return s.starts[len(s.starts)-1] + s.ts
+}
+
+// turn returns the ends of the turnaround after sweep k, on each axis.
+func (s *sweepOffsets) turn(k int) (p0, v0, p1, v1 [2]float64) {
+	a, b := s.sweeps[k], s.sweeps[k+1]
+	p0 = [2]float64{a.x + a.vx*s.ts, a.y + a.vy*s.ts}
+	v0 = [2]float64{a.vx, a.vy}
+	p1 = [2]float64{b.x, b.y}
+	v1 = [2]float64{b.vx, b.vy}
+	return
+}
+
+// at returns the offset and its rate at t seconds, and the index of the
+// sweep it's in or turning around after, and whether it's turning.
+func (s *sweepOffsets) at(t float64) (dx, dy, vdx, vdy float64, k int, turning bool) {
+	k = sort.Search(len(s.starts), func(i int) bool { return s.starts[i] > t }) - 1
+	if k < 0 {
+		k = 0
+	}
+	u := t - s.starts[k]
+	if u <= s.ts || k == len(s.sweeps)-1 {
+		w := s.sweeps[k]
+		return w.x + w.vx*u, w.y + w.vy*u, w.vx, w.vy, k, false
+	}
+	T := s.turns[k]
+	u = (u - s.ts) / T
+	p0, v0, p1, v1 := s.turn(k)
+	var p, v [2]float64
+	for i := range p {
+		p[i] = (2*u*u*u-3*u*u+1)*p0[i] + (u*u*u-2*u*u+u)*T*v0[i] + (3*u*u-2*u*u*u)*p1[i] + (u*u*u-u*u)*T*v1[i]
+		v[i] = ((6*u*u-6*u)*p0[i]+(6*u-6*u*u)*p1[i])/T + (3*u*u-4*u+1)*v0[i] + (3*u*u-2*u)*v1[i]
+	}
+	return p[0], p[1], v[0], v[1], k, true
+}
+
+func (s *sweepOffsets) offset(t float64) (float64, float64, float64, float64) {
+	dx, dy, vdx, vdy, _, _ := s.at(t)
+	return dx, dy, vdx, vdy
+}
+
+// flags flags the axes moving in a turnaround.
+func (s *sweepOffsets) flags(t float64) (int8, int8) {
+	_, _, _, _, k, turning := s.at(t)
+	if !turning {
+		return 0, 0
+	}
+	var flags [2]int8
+	for _, w := range []offsetSweep{s.sweeps[k], s.sweeps[k+1]} {
+		if w.vx != 0 {
+			flags[0] = 2
+		}
+		if w.vy != 0 {
+			flags[1] = 2
+		}
+	}
+	return flags[0], flags[1]
+}
+
+// peaks returns the peak on-sky speed, acceleration, and jerk on each axis.
+func (s *sweepOffsets) peaks() (speed, accel, jerk [2]float64) {
+	for _, w := range s.sweeps {
+		speed[0] = math.Max(speed[0], math.Abs(w.vx))
+		speed[1] = math.Max(speed[1], math.Abs(w.vy))
+	}
+	for k, T := range s.turns {
+		p0, v0, p1, v1 := s.turn(k)
+		for i := range p0 {
+			v, a, j := hermitePeaks(p0[i], v0[i], p1[i], v1[i], T)
+			speed[i] = math.Max(speed[i], v)
+			accel[i] = math.Max(accel[i], a)
+			jerk[i] = math.Max(jerk[i], j)
+		}
+	}
+	return
+}
+
+// hermitePeaks returns the peak speed, acceleration, and jerk of a cubic
+// (Hermite) path from p0 at velocity v0 to p1 at v1, taking T seconds.
+func hermitePeaks(p0, v0, p1, v1, T float64) (speed, accel, jerk float64) {
+	a0 := (6*(p1-p0) - 4*T*v0 - 2*T*v1) / (T * T)
+	a1 := (-6*(p1-p0) + 2*T*v0 + 4*T*v1) / (T * T)
+	j := (a1 - a0) / T
+	speed = math.Max(math.Abs(v0), math.Abs(v1))
+	if j != 0 {
+		// the velocity is quadratic, peaking where a = 0
+		if u := -a0 / j; u > 0 && u < T {
+			speed = math.Max(speed, math.Abs(v0+a0*u+j*u*u/2))
+		}
+	}
+	return speed, math.Max(math.Abs(a0), math.Abs(a1)), math.Abs(j)
+}
+
+// crossSweeps returns num crosses of a point, each sweeping forward and
+// back in azimuth then in elevation, from -size to +size (great-circle
+// degrees) at speed, reversing over turnaround. Switching axes takes a
+// turnaround and a sweep, keeping it near the sweep speed.
+func crossSweeps(num int, size, speed float64, turnaround time.Duration) *sweepOffsets {
+	tt := turnaround.Seconds()
+	ts := 2 * size / speed
+	var sweeps []offsetSweep
+	var turns []float64
+	for i := 0; i < num; i++ {
+		sweeps = append(sweeps,
+			offsetSweep{-size, 0, speed, 0},
+			offsetSweep{size, 0, -speed, 0},
+			offsetSweep{0, -size, 0, speed},
+			offsetSweep{0, size, 0, -speed})
+		turns = append(turns, tt, tt+ts, tt, tt+ts)
+	}
+	return newSweepOffsets(sweeps, ts, turns[:len(sweeps)-1])
+}
+
+// gridSweeps returns num grids on a point, each of azimuth sweeps from
+// -size to +size (great-circle degrees) at speed, in rows step apart in
+// elevation, alternately up and down. Each turnaround, lasting turnaround,
+// steps to the next row.
+func gridSweeps(num int, size, step, speed float64, turnaround time.Duration) *sweepOffsets {
+	rows := 2*int(math.Floor(size/step+1e-9)) + 1
+	var sweeps []offsetSweep
+	var turns []float64
+	for i := 0; i < num*rows; i++ {
+		row := i % rows
+		if (i/rows)%2 == 1 {
+			row = rows - 1 - row
+		}
+		dy := float64(row-rows/2) * step
+		if i%2 == 0 {
+			sweeps = append(sweeps, offsetSweep{-size, dy, speed, 0})
+		} else {
+			sweeps = append(sweeps, offsetSweep{size, dy, -speed, 0})
+		}
+		turns = append(turns, turnaround.Seconds())
+	}
+	return newSweepOffsets(sweeps, 2*size/speed, turns[:len(sweeps)-1])
+}
+
+// NewSweepsScanPattern traces sweeps around a track's target, from t0.
+func NewSweepsScanPattern(t0 time.Time, target TrackScanPattern, sweeps *sweepOffsets) *OffsetScanPattern {
+	t1 := t0.Add(Seconds2Duration(sweeps.duration()))
+	scan := newTargetOffsetScanPattern(t0, t1, target, sweeps.offset)
+	scan.flags = sweeps.flags
+	return scan
+}
+
+// A ResumedScanPattern is the part of a pattern from tmin onwards.
+type ResumedScanPattern struct {
+	pattern ScanPattern
+	tmin    time.Time
+}
+
+func NewResumedScanPattern(pattern ScanPattern, tmin time.Time) *ResumedScanPattern {
+	return &ResumedScanPattern{
+		pattern: pattern,
+		tmin:    tmin,
+	}
+}
+
+func (scan ResumedScanPattern) Iterator() *ScanPatternIterator {
+	iter := &ScanPatternIterator{inner: scan.pattern.Iterator()}
+	// skip ahead to the first point at or after tmin
+	for {
+		scan.advance(iter)
+		if iter.next == nil || !iter.next.T.Before(scan.tmin) {
+			break
+		}
+	}
+	return iter
+}
+
+func (scan ResumedScanPattern) advance(iter *ScanPatternIterator) {
+	iter.next = nil
+	if iter.err != nil || scan.pattern.Done(iter.inner) {
+		return
+	}
+	var x ScanPatternSample
+	iter.err = scan.pattern.Next(iter.inner, &x)
+	if iter.err == nil {
+		iter.next = &x
+	}
+}
+
+func (scan ResumedScanPattern) Done(iter *ScanPatternIterator) bool {
+	return iter.next == nil && iter.err == nil
+}
+
+func (scan ResumedScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	if iter.err != nil {
+		return iter.err
+	}
+	*p = *iter.next
+	iter.index++
+	scan.advance(iter)
+	return nil
+}
+
+// A windowScanPattern is the part of a pattern within d of its first point.
+type windowScanPattern struct {
+	ResumedScanPattern
+	d time.Duration
+}
+
+func newWindowScanPattern(pattern ScanPattern, d time.Duration) windowScanPattern {
+	return windowScanPattern{ResumedScanPattern{pattern: pattern}, d}
+}
+
+func (scan windowScanPattern) Iterator() *ScanPatternIterator {
+	iter := scan.ResumedScanPattern.Iterator()
+	if iter.next != nil {
+		iter.t = iter.next.T
+	}
+	return iter
+}
+
+func (scan windowScanPattern) Done(iter *ScanPatternIterator) bool {
+	return scan.ResumedScanPattern.Done(iter) || iter.next != nil && iter.next.T.Sub(iter.t) > scan.d
+}
+
+// chainTransitionInterval is the spacing of the samples joining chained patterns.
+const chainTransitionInterval = offsetScanSampleInterval
+
+// A ChainedScanPattern runs patterns back-to-back in one program track,
+// each retimed to start a transition time after the last point of the one
+// before, and joined to it by a cubic (Hermite) transition matching the
+// position and velocity at either end. The ACU stays in ProgramTrack, with
+// the next pattern's points on the stack before the last one finishes.
+type ChainedScanPattern struct {
+	parts []DelayableScanPattern // the patterns, with the transitions between them
+}
+
+func NewChainedScanPattern(patterns []ScanPattern, transition time.Duration) (*ChainedScanPattern, error) {
+	if len(patterns) == 0 {
+		return nil, fmt.Errorf("no patterns to chain")
+	}
+	if transition <= 0 {
+		return nil, fmt.Errorf("chain transition time must be positive")
+	}
+	var chain ChainedScanPattern
+	var last ScanPatternSample
+	for i, p := range patterns {
+		pattern, ok := p.(DelayableScanPattern)
+		if !ok {
+			return nil, fmt.Errorf("chained pattern %d can't be retimed", i)
+		}
+		if i > 0 {
+			// retime the pattern from its first point, then walk it once
+			// for both ends, since a sky pattern moves when delayed
+			start, err := patternStart(pattern)
+			if err != nil {
+				return nil, fmt.Errorf("chained pattern %d: %w", i, err)
+			}
+			pattern = pattern.Delay(last.T.Add(transition).Sub(start.T)).(DelayableScanPattern)
+		}
+		first, end, err := patternEnds(pattern)
+		if err != nil {
+			return nil, fmt.Errorf("chained pattern %d: %w", i, err)
+		}
+		if i > 0 {
+			chain.parts = append(chain.parts, newTransitionScanPattern(last, first))
+		}
+		chain.parts = append(chain.parts, pattern)
+		last = end
+	}
+	return &chain, nil
+}
+
+// patternStart returns the first point of a pattern.
+func patternStart(pattern ScanPattern) (first ScanPatternSample, err error) {
+	iter := pattern.Iterator()
+	if pattern.Done(iter) {
+		return first, fmt.Errorf("pattern has no points")
+	}
+	err = pattern.Next(iter, &first)
+	return
+}
+
+// patternEnds returns the first and last points of a pattern.
+func patternEnds(pattern ScanPattern) (first, last ScanPatternSample, err error) {
+	iter := pattern.Iterator()
+	for i := 0; !pattern.Done(iter); i++ {
+		err = pattern.Next(iter, &last)
+		if err != nil {
+			return
+		}
+		if i == 0 {
+			first = last
+		}
+	}
+	if first.T.IsZero() {
+		err = fmt.Errorf("pattern has no points")
+	}
+	return
+}
+
+func (chain ChainedScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{inner: chain.parts[0].Iterator()}
+}
+
+func (chain ChainedScanPattern) Delay(d time.Duration) ScanPattern {
+	parts := make([]DelayableScanPattern, len(chain.parts))
+	for i, p := range chain.parts {
+		parts[i] = p.Delay(d).(DelayableScanPattern)
+	}
+	chain.parts = parts
+	return chain
+}
+
+// Done moves the iterator on to the next part when one is done.
+func (chain ChainedScanPattern) Done(iter *ScanPatternIterator) bool {
+	for chain.parts[iter.part].Done(iter.inner) {
+		if iter.part == len(chain.parts)-1 {
+			return true
+		}
+		iter.part++
+		iter.inner = chain.parts[iter.part].Iterator()
+	}
+	return false
+}
+
+func (chain ChainedScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	if chain.Done(iter) {
+		return fmt.Errorf("no more points in chained pattern")
+	}
+	iter.index++
+	return chain.parts[iter.part].Next(iter.inner, p)
+}
+
+// A transitionScanPattern joins two points with a cubic (Hermite) path,
+// with both axes flagged as turning around. The points themselves aren't
+// part of it.
+type transitionScanPattern struct {
+	samples []ScanPatternSample
+}
+
+func newTransitionScanPattern(a, b ScanPatternSample) transitionScanPattern {
+	T := b.T.Sub(a.T).Seconds()
+	n := int(math.Ceil(T / chainTransitionInterval.Seconds()))
+	var samples []ScanPatternSample
+	p0, v0 := [2]float64{a.Az, a.El}, [2]float64{a.AzVel, a.ElVel}
+	p1, v1 := [2]float64{b.Az, b.El}, [2]float64{b.AzVel, b.ElVel}
+	for k := 1; k < n; k++ {
+		u := float64(k) / float64(n)
+		var p, v [2]float64
+		for i := range p {
+			p[i] = (2*u*u*u-3*u*u+1)*p0[i] + (u*u*u-2*u*u+u)*T*v0[i] + (3*u*u-2*u*u*u)*p1[i] + (u*u*u-u*u)*T*v1[i]
+			v[i] = ((6*u*u-6*u)*p0[i]+(6*u-6*u*u)*p1[i])/T + (3*u*u-4*u+1)*v0[i] + (3*u*u-2*u)*v1[i]
+		}
+		samples = append(samples, ScanPatternSample{
+			T:      a.T.Add(Seconds2Duration(u * T)),
+			Az:     p[0],
+			El:     p[1],
+			AzVel:  v[0],
+			ElVel:  v[1],
+			AzFlag: 2,
+			ElFlag: 2,
+		})
+	}
+	return transitionScanPattern{samples}
+}
+
+func (scan transitionScanPattern) Iterator() *ScanPatternIterator {
+	return &ScanPatternIterator{}
+}
+
+func (scan transitionScanPattern) Delay(d time.Duration) ScanPattern {
+	samples := make([]ScanPatternSample, len(scan.samples))
+	for i, x := range scan.samples {
+		x.T = x.T.Add(d)
+		samples[i] = x
+	}
+	return transitionScanPattern{samples}
+}
+
+func (scan transitionScanPattern) Done(iter *ScanPatternIterator) bool {
+	return iter.index == len(scan.samples)
+}
+
+func (scan transitionScanPattern) Next(iter *ScanPatternIterator, p *ScanPatternSample) error {
+	*p = scan.samples[iter.index]
+	iter.index++
+	return nil
+}
@@ -0,0 +1,372 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func collectPattern(t *testing.T, pattern ScanPattern) []ScanPatternSample {
+	var samples []ScanPatternSample
+	iter := pattern.Iterator()
+	for !pattern.Done(iter) {
+		var x ScanPatternSample
+		err := pattern.Next(iter, &x)
+		if err != nil {
+			t.Fatal(err)
+		}
+		samples = append(samples, x)
+	}
+	return samples
+}
+
+func TestElevationScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	pattern := NewElevationScanPattern(t0, 2, 120, [2]float64{30, 40}, 0.5, 5*time.Second)
+	samples := collectPattern(t, pattern)
+	// 5 sweep points and 49 turnaround points each way, ending on the last sweep
+	const m = 54
+	if len(samples) != 4*m-49 {
+		t.Fatalf("got %d samples, expected %d", len(samples), 4*m-49)
+	}
+	for i, x := range samples {
+		if x.Az != 120 || x.AzVel != 0 {
+			t.Errorf("sample %d: azimuth not fixed: %+v", i, x)
+		}
+		// the turnarounds overshoot by less than speed*turnaround/2
+		if x.El < 30-1.25 || x.El > 40+1.25 {
+			t.Errorf("sample %d: elevation out of range: %+v", i, x)
+		}
+		if i > 0 {
+			if dv := math.Abs(x.ElVel - samples[i-1].ElVel); dv > elevationAccelMax*0.1+1e-9 {
+				t.Errorf("sample %d: velocity jump %g", i, dv)
+			}
+		}
+	}
+	if samples[0].El != 30 || samples[4].El != 40 || samples[m].El != 40 {
+		t.Errorf("bad sweep endpoints: %v %v %v", samples[0].El, samples[4].El, samples[m].El)
+	}
+	if samples[0].ElVel != 0.5 || samples[m].ElVel != -0.5 {
+		t.Errorf("bad sweep velocities: %v %v", samples[0].ElVel, samples[m].ElVel)
+	}
+	if samples[4].ElFlag != 2 || samples[m-1].ElFlag != 2 || samples[m].ElFlag != 1 {
+		t.Errorf("bad turnaround flags: %v %v %v", samples[4].ElFlag, samples[m-1].ElFlag, samples[m].ElFlag)
+	}
+	// 4 steps of 2.5 deg at 0.5 deg/s, then the turnaround
+	if dt := samples[m].T.Sub(samples[4].T); dt != 5*time.Second {
+		t.Errorf("bad turnaround time: %v", dt)
+	}
+	if dt := samples[4].T.Sub(samples[0].T); dt != 20*time.Second {
+		t.Errorf("bad sweep time: %v", dt)
+	}
+	if err := ValidateScanPattern(pattern); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestMinimumTurnaroundScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	pattern := NewAzimuthScanPattern(t0, 3, 60, [2]float64{110, 130}, 1.5, 0)
+	if err := ValidateScanPattern(pattern); err != nil {
+		t.Error(err)
+	}
+	samples := collectPattern(t, pattern)
+	tt := minTurnaroundTime(1.5, azimuthAccelMax, azimuthJerkMax)
+	for i := 1; i < len(samples); i++ {
+		if samples[i-1].AzFlag != 2 && samples[i].AzFlag == 2 {
+			// the sweep ends; find the next one
+			j := i + 1
+			for samples[j].AzFlag == 2 {
+				j++
+			}
+			if dt := samples[j].T.Sub(samples[i].T).Seconds(); math.Abs(dt-tt) > 1e-6 {
+				t.Errorf("sample %d: turnaround %g s, expected %g", i, dt, tt)
+			}
+			break
+		}
+	}
+}
+
+func TestRasterScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	pattern := NewRasterScanPattern(t0, [2]float64{100, 110}, [2]float64{40, 41}, 0.5, 1, 5*time.Second, false)
+	samples := collectPattern(t, pattern)
+	if len(samples) != 3*5 {
+		t.Fatalf("got %d samples, expected %d", len(samples), 15)
+	}
+	for row, el := range []float64{40, 40.5, 41} {
+		first, last := samples[5*row], samples[5*row+4]
+		if first.El != el || last.El != el {
+			t.Errorf("row %d: bad elevation: %v %v", row, first.El, last.El)
+		}
+		az0, az1 := 100.0, 110.0
+		if row%2 == 1 {
+			az0, az1 = az1, az0
+		}
+		if first.Az != az0 || last.Az != az1 {
+			t.Errorf("row %d: bad azimuth endpoints: %v %v", row, first.Az, last.Az)
+		}
+		if last.AzFlag != 2 {
+			t.Errorf("row %d: missing turnaround flag", row)
+		}
+	}
+}
+
+func TestDriftScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	samples := collectPattern(t, NewDriftScanPattern(t0, 95*time.Second, 120, 60, 0.2))
+	if len(samples) != 11 {
+		t.Fatalf("got %d samples, expected 11", len(samples))
+	}
+	for i, x := range samples {
+		dt := x.T.Sub(t0).Seconds()
+		if math.Abs(x.Az-(120+0.2*dt)) > 1e-9 || x.El != 60 || x.AzVel != 0.2 || x.ElVel != 0 || x.AzFlag != 1 {
+			t.Errorf("sample %d: got %+v", i, x)
+		}
+	}
+	if last := samples[len(samples)-1]; last.T != t0.Add(95*time.Second) {
+		t.Errorf("ends at %v", last.T)
+	}
+
+	// parked
+	samples = collectPattern(t, NewDriftScanPattern(t0, 5*time.Second, 120, 60, 0))
+	if len(samples) != 2 || samples[1].Az != 120 || samples[1].AzVel != 0 || samples[1].AzFlag != 0 {
+		t.Errorf("parked: got %+v", samples)
+	}
+}
+
+// Long patterns are generated as they're uploaded, so shouldn't take
+// memory in proportion to their length.
+func TestLongScanPatternAllocs(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, f := range []func() ScanPattern{
+		func() ScanPattern { return NewDriftScanPattern(t0, 12*time.Hour, 120, 60, 0.01) },
+		func() ScanPattern {
+			return NewRasterScanPattern(t0, [2]float64{100, 110}, [2]float64{20, 80}, 0.01, 1, 5*time.Second, false)
+		},
+	} {
+		n := 0
+		allocs := testing.AllocsPerRun(1, func() {
+			pattern := f()
+			iter := pattern.Iterator()
+			var x ScanPatternSample
+			for n = 0; !pattern.Done(iter); n++ {
+				if err := pattern.Next(iter, &x); err != nil {
+					t.Fatal(err)
+				}
+			}
+		})
+		if n < 4000 || allocs > 4 {
+			t.Errorf("%T: %d points, %g allocations", f(), n, allocs)
+		}
+	}
+}
+
+func TestDaisyScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(60 * time.Second)
+	pattern := NewDaisyScanPattern(t0, t1, 100, 0, "Horizon", 0.5, 0.1, 7)
+	samples := collectPattern(t, pattern)
+	if len(samples) != 601 {
+		t.Fatalf("got %d samples, expected %d", len(samples), 601)
+	}
+	for i, x := range samples {
+		r := math.Hypot(x.Az-100, x.El)
+		if r > 0.5+1e-9 {
+			t.Errorf("sample %d: outside radius: %v", i, r)
+		}
+	}
+	// velocities should match finite differences
+	for i := 1; i < len(samples); i++ {
+		a, b := samples[i-1], samples[i]
+		dt := b.T.Sub(a.T).Seconds()
+		vaz := (b.Az - a.Az) / dt
+		if math.Abs(vaz-(a.AzVel+b.AzVel)/2) > 1e-3 {
+			t.Errorf("sample %d: bad azimuth velocity: %v %v", i, vaz, a.AzVel)
+		}
+	}
+}
+
+func TestScanTrackPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	t1 := t0.Add(120 * time.Second)
+	pattern := NewScanTrackPattern(t0, t1, 100, 0, "Horizon", 5, 1, 2*time.Second, azimuthJerkMax)
+	samples := collectPattern(t, pattern)
+	curve := newSCurve(1, 2, azimuthJerkMax)
+	overshoot, _ := curve.at(1)
+	for i, x := range samples {
+		if math.Abs(x.Az-100) > 5+overshoot+1e-9 {
+			t.Errorf("sample %d: bad azimuth: %v", i, x.Az)
+		}
+		if x.El != 0 || x.ElVel != 0 {
+			t.Errorf("sample %d: elevation not fixed: %+v", i, x)
+		}
+		if i > 0 {
+			a := samples[i-1]
+			if math.Abs(x.AzVel-a.AzVel) > curve.accel*0.1+1e-9 {
+				t.Errorf("sample %d: velocity jump: %v -> %v", i, a.AzVel, x.AzVel)
+			}
+		}
+	}
+	// one full period is 2*(10s sweep + 2s turnaround)
+	if x := samples[240]; math.Abs(x.Az-95) > 1e-9 || x.AzVel != 1 {
+		t.Errorf("bad position after one period: %+v", x)
+	}
+
+	// the shortest turnaround the limits allow is within them
+	el := 45.0
+	_, accelMax := azimuthLimitsAt(el)
+	tt := minTurnaroundTime(1/math.Cos(deg2rad(el)), accelMax, azimuthJerkMax)
+	pattern = NewScanTrackPattern(t0, t1, 100, el, "Horizon", 5, 1, Seconds2Duration(tt), scanTrackJerk(el))
+	if err := ValidateScanPattern(pattern); err != nil {
+		t.Errorf("turnaround of %gs: %v", tt, err)
+	}
+}
+
+func TestResumedScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	pattern := NewAzimuthScanPattern(t0, 2, 60, [2]float64{110, 130}, 1, 5*time.Second)
+	orig := collectPattern(t, pattern)
+
+	// pause after the 3rd point, resume 1 minute later
+	delay := time.Minute
+	resumed := NewResumedScanPattern(pattern.Delay(delay), orig[3].T.Add(delay))
+	samples := collectPattern(t, resumed)
+	if len(samples) != len(orig)-3 {
+		t.Fatalf("got %d samples, expected %d", len(samples), len(orig)-3)
+	}
+	for i, x := range samples {
+		y := orig[i+3]
+		if x.Az != y.Az || x.T != y.T.Add(delay) {
+			t.Errorf("sample %d: got %+v, expected %+v delayed", i, x, y)
+		}
+	}
+}
+
+func TestWindowScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	pattern := NewAzimuthScanPattern(t0, 2, 60, [2]float64{110, 130}, 1, 5*time.Second)
+	orig := collectPattern(t, pattern)
+	d := orig[len(orig)/2].T.Sub(orig[0].T)
+	samples := collectPattern(t, newWindowScanPattern(pattern, d))
+	if len(samples) != len(orig)/2+1 {
+		t.Fatalf("got %d samples, expected %d", len(samples), len(orig)/2+1)
+	}
+	for i, x := range samples {
+		if x != orig[i] {
+			t.Errorf("sample %d: got %+v, expected %+v", i, x, orig[i])
+		}
+	}
+	if n := len(collectPattern(t, newWindowScanPattern(pattern, time.Hour))); n != len(orig) {
+		t.Errorf("got %d samples, expected all %d", n, len(orig))
+	}
+}
+
+func TestChainedScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	a := NewAzimuthScanPattern(t0, 2, 60, [2]float64{110, 130}, 1, 5*time.Second)
+	b := NewAzimuthScanPattern(t0, 2, 62, [2]float64{115, 125}, 1, 5*time.Second)
+	chain, err := NewChainedScanPattern([]ScanPattern{a, b}, 10*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	samplesA, samplesB := collectPattern(t, a), collectPattern(t, b)
+	samples := collectPattern(t, chain)
+	last := samplesA[len(samplesA)-1]
+	n := len(samplesA)
+	next := samples[n]
+	for ; samples[n].AzFlag == 2 && samples[n].ElFlag == 2; n++ {
+	}
+	if n == len(samplesA) {
+		t.Fatal("no transition samples")
+	}
+	if first := samples[n]; first.Az != samplesB[0].Az || first.El != 62 || first.T != last.T.Add(10*time.Second) {
+		t.Errorf("got %+v starting the second pattern, expected it 10s after %v", first, last.T)
+	}
+	if len(samples) != n+len(samplesB) {
+		t.Errorf("got %d samples, expected %d", len(samples), n+len(samplesB))
+	}
+	if dt := next.T.Sub(last.T); dt > chainTransitionInterval {
+		t.Errorf("got %v before the first transition sample", dt)
+	}
+	for i := 1; i < len(samples); i++ {
+		x, y := samples[i-1], samples[i]
+		dt := y.T.Sub(x.T).Seconds()
+		if dt <= 0 || math.Abs(y.Az-x.Az) > 2*dt || math.Abs(y.El-x.El) > dt {
+			t.Errorf("sample %d: jump from %+v to %+v", i, x, y)
+		}
+	}
+
+	delayed := collectPattern(t, chain.Delay(time.Minute))
+	for i, x := range delayed {
+		if x.T != samples[i].T.Add(time.Minute) || x.Az != samples[i].Az {
+			t.Errorf("sample %d: got %+v, expected %+v delayed", i, x, samples[i])
+		}
+	}
+}
+
+func TestAzWrapScanPattern(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	newPath := func(az0 float64) ScanPattern {
+		var points [][5]float64
+		for i := 0; i <= 20; i++ {
+			points = append(points, [5]float64{float64(i), math.Mod(az0+float64(i), 360), 45, 1, 0})
+		}
+		return NewPathScanPattern(t0, points, "Horizon", false)
+	}
+
+	tests := []struct {
+		az0  float64
+		wrap string
+		az1  float64
+	}{
+		{350, "", -10}, // crosses north, only fits below 0
+		{350, "high", -10},
+		{200, "", 200},
+		{200, "low", -160},
+		{200, "high", 200},
+	}
+	for _, test := range tests {
+		pattern, err := NewAzWrapScanPattern(newPath(test.az0), test.wrap)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i, x := range collectPattern(t, pattern) {
+			if az := test.az1 + float64(i); math.Abs(x.Az-az) > 1e-9 {
+				t.Errorf("%+v: sample %d: got az %g, expected %g", test, i, x.Az, az)
+			}
+		}
+	}
+}
+
+func TestPathScanPatternSkyRates(t *testing.T) {
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	points := [][5]float64{{0, 100, -30, 0, 0}, {10, 101, -31, 0, 0}}
+	moving := [][5]float64{{0, 100, -30, 0.1, -0.1}, {10, 101, -31, 0.1, -0.1}}
+
+	// vx,vy are ignored for sky paths unless they're sky rates
+	fixed := collectPattern(t, NewPathScanPattern(t0, points, "ICRS", false))
+	for i, x := range collectPattern(t, NewPathScanPattern(t0, moving, "ICRS", false)) {
+		if x != fixed[i] {
+			t.Errorf("sample %d: got %+v, expected %+v", i, x, fixed[i])
+		}
+	}
+	// and only move the point between samples when they are
+	for i, x := range collectPattern(t, NewPathScanPattern(t0, moving, "ICRS", true)) {
+		if x.Az != fixed[i].Az || x.El != fixed[i].El {
+			t.Errorf("sample %d: got %+v, expected the same position as %+v", i, x, fixed[i])
+		}
+	}
+}
+
+func TestAzElRate(t *testing.T) {
+	// crossing north
+	f := func(ut float64) (float64, float64, error) {
+		return math.Mod(359.9+0.2*ut, 360), 30 + 0.01*ut, nil
+	}
+	az, el, vaz, vel, err := azElRate(f, 0.25)
+	if err != nil || math.Abs(az-359.95) > 1e-9 || math.Abs(el-30.0025) > 1e-9 ||
+		math.Abs(vaz-0.2) > 1e-9 || math.Abs(vel-0.01) > 1e-9 {
+		t.Errorf("got %v %v %v %v %v", az, el, vaz, vel, err)
+	}
+}
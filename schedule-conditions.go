@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// how far ahead to look for an entry's conditions by default
+	conditionSearchWindow = 24 * time.Hour
+
+	// conditions are checked this often, then bisected to the second
+	conditionSearchStep = 1 * time.Minute
+)
+
+// An ElevationCondition holds while a target is above an elevation.
+type ElevationCondition struct {
+	RA        float64 `json:"ra"` // ICRS [deg]
+	Dec       float64 `json:"dec"`
+	Body      string  `json:"body,omitempty"` // instead of ra,dec
+	Elevation float64 `json:"elevation"`      // minimum, observed [deg]
+}
+
+func (c *ElevationCondition) check() error {
+	if c.Body != "" {
+		return checkSolarSystemBody(c.Body)
+	}
+	if c.RA < 0 || c.RA >= 360 || c.Dec < -90 || c.Dec > 90 {
+		return fmt.Errorf("bad target ra,dec (%g,%g)", c.RA, c.Dec)
+	}
+	return nil
+}
+
+func (c *ElevationCondition) holds(t time.Time) (bool, error) {
+	var el float64
+	var err error
+	if c.Body != "" {
+		_, el, err = BodyObsAzEl(Time2Unixtime(t), c.Body)
+	} else {
+		_, el, err = RADec2ObsAzEl(Time2Unixtime(t), c.RA, c.Dec)
+	}
+	return el >= c.Elevation, err
+}
+
+// inLSTWindow checks if lst is in the window [start,stop) (hours),
+// which may wrap through 0h.
+func inLSTWindow(lst float64, window [2]float64) bool {
+	if window[0] <= window[1] {
+		return lst >= window[0] && lst < window[1]
+	}
+	return lst >= window[0] || lst < window[1]
+}
+
+// hasConditions checks if the entry waits for LST or elevation.
+func (e *ScheduleEntry) hasConditions() bool {
+	return e.LSTWindow != nil || e.MinElevation != nil
+}
+
+func (e *ScheduleEntry) checkConditions() error {
+	if w := e.LSTWindow; w != nil {
+		for _, h := range w {
+			if h < 0 || h >= 24 {
+				return rangeError("lst_window", 0, 24, "LST window (%g,%g) out of range [0,24)", w[0], w[1])
+			}
+		}
+		if w[0] == w[1] {
+			return fmt.Errorf("empty LST window")
+		}
+	}
+	if e.MinElevation != nil {
+		return e.MinElevation.check()
+	}
+	return nil
+}
+
+func (e *ScheduleEntry) conditionsHold(t time.Time) (bool, error) {
+	if e.LSTWindow != nil {
+		lst, err := LST(Time2Unixtime(t))
+		if err != nil || !inLSTWindow(lst, *e.LSTWindow) {
+			return false, err
+		}
+	}
+	if e.MinElevation != nil {
+		return e.MinElevation.holds(t)
+	}
+	return true, nil
+}
+
+// triggerTime returns the first time from earliest up to latest
+// when the entry's conditions hold.
+func (e *ScheduleEntry) triggerTime(earliest, latest time.Time) (time.Time, error) {
+	ok, err := e.conditionsHold(earliest)
+	if err != nil || ok {
+		return earliest, err
+	}
+	prev := earliest
+	for t := earliest.Add(conditionSearchStep); !t.After(latest); t = t.Add(conditionSearchStep) {
+		ok, err := e.conditionsHold(t)
+		if err != nil {
+			return t, err
+		}
+		if !ok {
+			prev = t
+			continue
+		}
+		// bisect to the second
+		for t.Sub(prev) > time.Second {
+			mid := prev.Add(t.Sub(prev) / 2)
+			ok, err := e.conditionsHold(mid)
+			if err != nil {
+				return mid, err
+			}
+			if ok {
+				t = mid
+			} else {
+				prev = mid
+			}
+		}
+		return t, nil
+	}
+	return latest, fmt.Errorf("conditions not met by %s", latest.UTC().Format(time.RFC3339))
+}
+
+// resolveStart returns when the entry should start: its start time, or
+// with conditions, the first time from then (or now) that they hold.
+func (e *ScheduleEntry) resolveStart(now time.Time) (time.Time, error) {
+	if !e.hasConditions() {
+		return Unixtime2Time(e.StartTime), nil
+	}
+	err := e.checkConditions()
+	if err != nil {
+		return time.Time{}, err
+	}
+	earliest := now.Add(time.Second)
+	if e.StartTime != 0 {
+		earliest = Unixtime2Time(e.StartTime)
+	}
+	latest := earliest.Add(conditionSearchWindow)
+	if e.Deadline != 0 {
+		latest = Unixtime2Time(e.Deadline)
+	}
+	if latest.Before(earliest) {
+		return time.Time{}, fmt.Errorf("deadline before start time")
+	}
+	return e.triggerTime(earliest, latest)
+}
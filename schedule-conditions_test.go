@@ -0,0 +1,72 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLST(t *testing.T) {
+	// GMST is 18.697374558h at J2000.0
+	lst, err := LST(Time2Unixtime(time.Date(2000, 1, 1, 12, 0, 0, 0, time.UTC)))
+	expected := 18.697374558 + FYST_LONGITUDE_EAST_DEG/15
+	if err != nil || math.Abs(lst-expected) > 1e-3 {
+		t.Errorf("got %g, %v, expected %g", lst, err, expected)
+	}
+}
+
+func TestInLSTWindow(t *testing.T) {
+	for _, c := range []struct {
+		lst    float64
+		window [2]float64
+		in     bool
+	}{
+		{3, [2]float64{2, 4}, true},
+		{4, [2]float64{2, 4}, false},
+		{23, [2]float64{22, 2}, true},
+		{1, [2]float64{22, 2}, true},
+		{12, [2]float64{22, 2}, false},
+	} {
+		if got := inLSTWindow(c.lst, c.window); got != c.in {
+			t.Errorf("%g in %v: got %v", c.lst, c.window, got)
+		}
+	}
+}
+
+func TestScheduleConditions(t *testing.T) {
+	now := time.Date(2026, 3, 1, 0, 0, 0, 0, time.UTC)
+	lst0, _ := LST(Time2Unixtime(now))
+	window := [2]float64{math.Mod(lst0+1, 24), math.Mod(lst0+2, 24)}
+
+	e := ScheduleEntry{LSTWindow: &window}
+	start, err := e.resolveStart(now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// a sidereal hour is a bit shorter
+	if dt := start.Sub(now).Hours(); math.Abs(dt-1/1.00273790935) > 2./3600 {
+		t.Errorf("triggered after %g hours", dt)
+	}
+
+	e.Deadline = Time2Unixtime(now.Add(30 * time.Minute))
+	if _, err := e.resolveStart(now); err == nil {
+		t.Error("expected deadline to pass")
+	}
+
+	// already in the window
+	e = ScheduleEntry{StartTime: Time2Unixtime(now.Add(90 * time.Minute)), LSTWindow: &window}
+	start, err = e.resolveStart(now)
+	if err != nil || !start.Equal(now.Add(90*time.Minute)) {
+		t.Errorf("got %v, %v", start, err)
+	}
+
+	bad := [2]float64{1, 25}
+	e = ScheduleEntry{LSTWindow: &bad}
+	if _, err := e.resolveStart(now); err == nil {
+		t.Error("expected bad window to fail")
+	}
+	e = ScheduleEntry{MinElevation: &ElevationCondition{RA: 400, Elevation: 30}}
+	if _, err := e.resolveStart(now); err == nil {
+		t.Error("expected bad target to fail")
+	}
+}
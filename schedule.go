@@ -0,0 +1,301 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	// how long a scheduled command may wait for the one before it
+	scheduleMaxLate = 60 * time.Second
+
+	scheduleRetryInterval = 1 * time.Second
+)
+
+// A ScheduleEntry is a command to submit at an absolute time, or
+// once its conditions hold, from the start time (if any) up to the deadline.
+type ScheduleEntry struct {
+	StartTime float64         `json:"start_time"` // unix time
+	Command   string          `json:"command"`    // endpoint, e.g. "/azimuth-scan"
+	Args      json.RawMessage `json:"args"`
+
+	// conditions
+	LSTWindow    *[2]float64         `json:"lst_window,omitempty"` // [h]
+	MinElevation *ElevationCondition `json:"min_elevation,omitempty"`
+	Deadline     float64             `json:"deadline,omitempty"` // unix time, default a day on
+}
+
+// schedule entry states
+const (
+	schedulePending    = "pending"
+	scheduleDispatched = "dispatched"
+	scheduleSkipped    = "skipped"
+	scheduleCancelled  = "cancelled"
+)
+
+// A ScheduledEntry is a validated ScheduleEntry, with its estimated
+// timing and progress.
+type ScheduledEntry struct {
+	ScheduleEntry
+	Start time.Time `json:"start"`
+
+	// estimated from the entries before, if known; the slack is
+	// the spare time [s] after the previous entry finishes
+	End   *time.Time `json:"end,omitempty"`
+	Slack *float64   `json:"slack,omitempty"`
+
+	State string `json:"state"`
+	ID    string `json:"id,omitempty"` // command ID, once dispatched
+	Error string `json:"error,omitempty"`
+}
+
+// planSchedule checks and decodes every entry, which client (nil without
+// authentication) must be allowed to submit, and estimates when each
+// finishes, starting from pos (nil if unknown).
+func planSchedule(entries []ScheduleEntry, client *Principal, pos *[2]float64, now time.Time) ([]*ScheduledEntry, error) {
+	if len(entries) == 0 {
+		return nil, fmt.Errorf("empty schedule")
+	}
+	plan := make([]*ScheduledEntry, len(entries))
+	var prevEnd *time.Time
+	for i, e := range entries {
+		start, err := e.resolveStart(now)
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %d: %w", i, err)
+		}
+		p := &ScheduledEntry{ScheduleEntry: e, Start: start, State: schedulePending}
+		if !p.Start.After(now) {
+			return nil, fmt.Errorf("schedule entry %d: start time (%f) is in the past", i, e.StartTime)
+		}
+		if i > 0 && p.Start.Before(plan[i-1].Start) {
+			return nil, fmt.Errorf("schedule entry %d: starts before entry %d", i, i-1)
+		}
+		cmd, err := decodeCommand(e.Command, bytes.NewReader(e.Args))
+		if err == nil {
+			err = checkCommandRole(client, e.Command, cmd)
+		}
+		if err == nil {
+			err = cmd.Check()
+		}
+		var d *DryRun
+		var end *[2]float64
+		if err == nil {
+			d, end, err = dryRun(cmd, pos, p.Start)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("schedule entry %d: %w", i, err)
+		}
+
+		// when the command needs the one before finished
+		readyBy := p.Start
+		var finish *time.Time
+		switch {
+		case d.Start != nil:
+			// relative pattern start times count from when it's dispatched
+			start := *d.Start
+			if start.Before(p.Start) {
+				start = p.Start.Add(start.Sub(now))
+			}
+			readyBy = start
+			if pos != nil && d.first != nil {
+				// slew to the start of the pattern
+				readyBy = readyBy.Add(-estimateMoveTime(pos[0], d.first[0], pos[1], d.first[1]))
+			}
+			t := start.Add(Seconds2Duration(*d.Duration))
+			finish = &t
+		case d.Duration != nil:
+			t := p.Start.Add(Seconds2Duration(*d.Duration))
+			finish = &t
+		}
+		if prevEnd != nil {
+			slack := readyBy.Sub(*prevEnd).Seconds()
+			if slack < 0 {
+				return nil, fmt.Errorf("schedule entry %d: entry %d won't be done for %.0f seconds after it should start",
+					i, i-1, -slack)
+			}
+			p.Slack = &slack
+		}
+		p.End, prevEnd = finish, finish
+		pos = end
+		plan[i] = p
+	}
+	return plan, nil
+}
+
+// A Scheduler submits the commands of a schedule at their start times.
+type Scheduler struct {
+	submit func(p *Principal, endpoint string, body io.Reader) (string, int, error)
+	busy   func() bool // running a command
+
+	mu       sync.Mutex
+	entries  []*ScheduledEntry
+	cancel   context.CancelFunc
+	onChange func()
+}
+
+func NewScheduler(submit func(p *Principal, endpoint string, body io.Reader) (string, int, error), busy func() bool) *Scheduler {
+	return &Scheduler{submit: submit, busy: busy}
+}
+
+// OnChange calls fn, which mustn't block, after each change.
+// It must be set before the scheduler is used.
+func (s *Scheduler) OnChange(fn func()) {
+	s.onChange = fn
+}
+
+func (s *Scheduler) changed() {
+	if s.onChange != nil {
+		s.onChange()
+	}
+}
+
+// Run replaces the current schedule, submitting the commands as p.
+func (s *Scheduler) Run(entries []*ScheduledEntry, p *Principal) {
+	s.Cancel()
+	ctx, cancel := context.WithCancel(context.Background())
+	s.mu.Lock()
+	s.entries, s.cancel = entries, cancel
+	s.mu.Unlock()
+	s.changed()
+	go s.run(ctx, entries, p)
+}
+
+func (s *Scheduler) run(ctx context.Context, entries []*ScheduledEntry, p *Principal) {
+	for i, e := range entries {
+		select {
+		case <-time.After(time.Until(e.Start)):
+		case <-ctx.Done():
+			return
+		}
+		// wait a little for the command before to finish
+		for s.busy() && time.Since(e.Start) < scheduleMaxLate {
+			select {
+			case <-time.After(scheduleRetryInterval):
+			case <-ctx.Done():
+				return
+			}
+		}
+		id, _, err := s.submit(p, e.Command, bytes.NewReader(e.Args))
+		s.mu.Lock()
+		if err != nil {
+			log.Printf("schedule entry %d: %s: %v", i, e.Command, err)
+			e.State, e.Error = scheduleSkipped, err.Error()
+		} else {
+			log.Printf("schedule entry %d: %s dispatched as %s", i, e.Command, id)
+			e.State, e.ID = scheduleDispatched, id
+		}
+		s.mu.Unlock()
+		s.changed()
+	}
+}
+
+// Cancel cancels the pending entries of the current schedule.
+func (s *Scheduler) Cancel() {
+	defer s.changed()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.cancel != nil {
+		s.cancel()
+		s.cancel = nil
+	}
+	for _, e := range s.entries {
+		if e.State == schedulePending {
+			e.State = scheduleCancelled
+		}
+	}
+}
+
+// List returns the current schedule.
+func (s *Scheduler) List() []ScheduledEntry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	list := make([]ScheduledEntry, len(s.entries))
+	for i, e := range s.entries {
+		list[i] = *e
+	}
+	return list
+}
+
+// serveSchedule serves the schedule, planning new ones from the telescope's
+// current position.
+func serveSchedule(mux *http.ServeMux, scheduler *Scheduler, auth *Auth, currentPosition func() *[2]float64) {
+	mux.HandleFunc("/schedule", func(w http.ResponseWriter, req *http.Request) {
+		var response struct {
+			S       string           `json:"status"`
+			Entries []ScheduledEntry `json:"entries"`
+		}
+		response.S = "ok"
+		switch req.Method {
+		case "GET":
+			response.Entries = scheduler.List()
+		case "POST":
+			var x struct {
+				Entries []ScheduleEntry `json:"entries"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			dryRun, _ := strconv.ParseBool(req.URL.Query().Get("dry_run"))
+			p := principalFrom(req.Context())
+			if !dryRun {
+				err = auth.CheckLock(p)
+				if err != nil {
+					jsonResponse(w, err, http.StatusLocked)
+					return
+				}
+			}
+			plan, err := planSchedule(x.Entries, p, currentPosition(), time.Now())
+			var roleErr *RoleError
+			if errors.Is(err, errBadEndpoint) {
+				commandResponse(w, "", err, http.StatusNotFound)
+				return
+			}
+			if errors.As(err, &roleErr) {
+				commandResponse(w, "", err, http.StatusForbidden)
+				return
+			}
+			if err != nil {
+				commandResponse(w, "", err, http.StatusBadRequest)
+				return
+			}
+			for _, e := range plan {
+				response.Entries = append(response.Entries, *e)
+			}
+			if !dryRun {
+				scheduler.Run(plan, p)
+				log.Printf("schedule of %d entries from %s", len(plan), plan[0].Start.UTC().Format(time.RFC3339))
+			}
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		err := json.NewEncoder(w).Encode(&response)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+
+	mux.HandleFunc("/schedule/cancel", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		scheduler.Cancel()
+		jsonResponse(w, nil, http.StatusOK)
+	})
+}
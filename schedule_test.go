@@ -0,0 +1,129 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func scheduleEntry(t time.Time, command, args string) ScheduleEntry {
+	return ScheduleEntry{StartTime: Time2Unixtime(t), Command: command, Args: json.RawMessage(args)}
+}
+
+func TestPlanSchedule(t *testing.T) {
+	disableSunAvoidance(t)
+	now := time.Now()
+	t0 := now.Add(time.Hour)
+	scan := func(start time.Time) string {
+		return fmt.Sprintf(`{"azimuth_range": [110, 130], "elevation": 60, "num_scans": 4,
+			"start_time": %f, "turnaround_time": 5, "speed": 0.8}`, Time2Unixtime(start))
+	}
+	entries := []ScheduleEntry{
+		scheduleEntry(t0, "/move-to", `{"azimuth": 110, "elevation": 60}`),
+		scheduleEntry(t0.Add(3*time.Minute), "/azimuth-scan", scan(t0.Add(4*time.Minute))),
+		scheduleEntry(t0.Add(10*time.Minute), "/stow", `{}`),
+	}
+	plan, err := planSchedule(entries, nil, &[2]float64{0, 90}, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(plan) != 3 || plan[0].Slack != nil || plan[1].Slack == nil || plan[2].Slack == nil {
+		t.Fatalf("got %+v", plan)
+	}
+	// the scan starts where the move ends
+	move := estimateMoveTime(0, 110, 90, 60)
+	slew := estimateMoveTime(110, 110, 60, 60)
+	expected := (4*time.Minute - slew - move).Seconds()
+	if math.Abs(*plan[1].Slack-expected) > 1e-3 {
+		t.Errorf("scan slack %g, expected %g", *plan[1].Slack, expected)
+	}
+	if plan[1].End == nil || plan[1].End.Sub(t0) < 4*time.Minute+100*time.Second {
+		t.Errorf("scan end %v", plan[1].End)
+	}
+	for _, p := range plan {
+		if p.State != schedulePending {
+			t.Errorf("state %s", p.State)
+		}
+	}
+
+	// the scan can't start before the move's done
+	bad := append([]ScheduleEntry(nil), entries...)
+	bad[1] = scheduleEntry(t0.Add(time.Minute), "/azimuth-scan", scan(t0.Add(time.Minute)))
+	if _, err := planSchedule(bad, nil, &[2]float64{0, 90}, now); err == nil || !strings.Contains(err.Error(), "entry 1") {
+		t.Errorf("expected conflict, got %v", err)
+	}
+	bad = append([]ScheduleEntry(nil), entries[1], entries[0])
+	if _, err := planSchedule(bad, nil, nil, now); err == nil {
+		t.Error("expected unsorted entries to fail")
+	}
+	bad = []ScheduleEntry{scheduleEntry(now.Add(-time.Second), "/stow", `{}`)}
+	if _, err := planSchedule(bad, nil, nil, now); err == nil {
+		t.Error("expected past entry to fail")
+	}
+	bad = []ScheduleEntry{scheduleEntry(t0, "/move-to", `{"azimuth": 400, "elevation": 60}`)}
+	if _, err := planSchedule(bad, nil, nil, now); err == nil {
+		t.Error("expected bad command to fail")
+	}
+
+	// observers can't schedule what they can't submit
+	alice := &Principal{Name: "alice", Role: roleObserver}
+	var roleErr *RoleError
+	if _, err := planSchedule(entries, alice, &[2]float64{0, 90}, now); !errors.As(err, &roleErr) || roleErr.Endpoint != "/stow" {
+		t.Errorf("expected /stow to need a role, got %v", err)
+	}
+	bad = []ScheduleEntry{scheduleEntry(t0, "/sequence", `{"commands": [{"command": "/shutdown", "args": {}}]}`)}
+	if _, err := planSchedule(bad, alice, nil, now); !errors.As(err, &roleErr) || roleErr.Endpoint != "/shutdown" {
+		t.Errorf("expected /shutdown to need a role, got %v", err)
+	}
+	bob := &Principal{Name: "bob", Role: roleOperator}
+	if _, err := planSchedule(entries, bob, &[2]float64{0, 90}, now); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestScheduler(t *testing.T) {
+	var mu sync.Mutex
+	var submitted []string
+	submit := func(p *Principal, endpoint string, body io.Reader) (string, int, error) {
+		b, _ := ioutil.ReadAll(body)
+		mu.Lock()
+		defer mu.Unlock()
+		submitted = append(submitted, endpoint+" "+string(b))
+		if endpoint == "/bad" {
+			return "", 400, fmt.Errorf("bad")
+		}
+		return fmt.Sprint(len(submitted)), 200, nil
+	}
+	s := NewScheduler(submit, func() bool { return false })
+	now := time.Now()
+	entries := []*ScheduledEntry{
+		{ScheduleEntry: scheduleEntry(now.Add(10*time.Millisecond), "/stow", `{}`), State: schedulePending},
+		{ScheduleEntry: scheduleEntry(now.Add(20*time.Millisecond), "/bad", `{}`), State: schedulePending},
+		{ScheduleEntry: scheduleEntry(now.Add(time.Hour), "/stow", `{}`), State: schedulePending},
+	}
+	for _, e := range entries {
+		e.Start = Unixtime2Time(e.StartTime)
+	}
+	s.Run(entries, nil)
+	time.Sleep(100 * time.Millisecond)
+	s.Cancel()
+
+	list := s.List()
+	if list[0].State != scheduleDispatched || list[0].ID != "1" ||
+		list[1].State != scheduleSkipped || list[1].Error != "bad" ||
+		list[2].State != scheduleCancelled {
+		t.Errorf("got %+v", list)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(submitted) != 2 || submitted[0] != "/stow {}" {
+		t.Errorf("submitted %q", submitted)
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	maxScriptRepeat = 1000
+	maxScriptDepth  = 8 // of nested steps
+
+	// how long a wait for a condition may last by default
+	scriptWaitTimeout = 1 * time.Hour
+
+	// conditions and commands are checked this often
+	scriptPollInterval = 1 * time.Second
+)
+
+// A ScriptStep is one step of a script. It is exactly one of:
+//
+//   - a command, submitted as if by the script's client, and waited for
+//   - a wait, for some seconds or until a condition holds
+//   - a conditional, running then or else
+//   - a loop, running steps repeat times
+type ScriptStep struct {
+	Command string          `json:"command,omitempty"` // endpoint, e.g. "/azimuth-scan"
+	Args    json.RawMessage `json:"args,omitempty"`
+
+	Wait *ScriptWait `json:"wait,omitempty"`
+
+	If   *ScriptCondition `json:"if,omitempty"`
+	Then []ScriptStep     `json:"then,omitempty"`
+	Else []ScriptStep     `json:"else,omitempty"`
+
+	Repeat int          `json:"repeat,omitempty"`
+	Steps  []ScriptStep `json:"steps,omitempty"`
+}
+
+// A ScriptWait waits for some seconds, or until a condition holds,
+// failing the script after the timeout.
+type ScriptWait struct {
+	Seconds float64          `json:"seconds,omitempty"`
+	Until   *ScriptCondition `json:"until,omitempty"`
+	Timeout float64          `json:"timeout,omitempty"` // [s], default an hour
+}
+
+// A ScriptCondition holds when all its conditions do.
+type ScriptCondition struct {
+	LSTWindow    *[2]float64         `json:"lst_window,omitempty"` // [h]
+	MinElevation *ElevationCondition `json:"min_elevation,omitempty"`
+	MaxWindSpeed *float64            `json:"max_wind_speed,omitempty"` // [m/s]
+	MaxHumidity  *float64            `json:"max_humidity,omitempty"`   // relative, 0-1
+}
+
+// A Script is a named list of steps.
+type Script struct {
+	Name  string       `json:"name"`
+	Steps []ScriptStep `json:"steps"`
+}
+
+// script states
+const (
+	scriptRunning   = "running"
+	scriptDone      = "done"
+	scriptFailed    = "failed"
+	scriptCancelled = "cancelled"
+)
+
+// A ScriptStatus is the progress of a script.
+type ScriptStatus struct {
+	Name     string    `json:"name"`
+	State    string    `json:"state"`
+	Step     string    `json:"step,omitempty"` // e.g. "2.then.0", while running
+	Commands []string  `json:"commands"`       // IDs, as submitted
+	Started  time.Time `json:"started"`
+	Error    string    `json:"error,omitempty"`
+}
+
+func (c *ScriptCondition) check(hasWeather bool) error {
+	e := ScheduleEntry{LSTWindow: c.LSTWindow, MinElevation: c.MinElevation}
+	err := e.checkConditions()
+	if err != nil {
+		return err
+	}
+	if (c.MaxWindSpeed != nil || c.MaxHumidity != nil) && !hasWeather {
+		return fmt.Errorf("no weather station configured")
+	}
+	return nil
+}
+
+func (c *ScriptCondition) holds(t time.Time, weather func() (WeatherReading, error)) (bool, error) {
+	e := ScheduleEntry{LSTWindow: c.LSTWindow, MinElevation: c.MinElevation}
+	ok, err := e.conditionsHold(t)
+	if err != nil || !ok {
+		return false, err
+	}
+	if c.MaxWindSpeed != nil || c.MaxHumidity != nil {
+		r, err := weather()
+		if err != nil {
+			return false, err
+		}
+		if c.MaxWindSpeed != nil && r.WindSpeed > *c.MaxWindSpeed {
+			return false, nil
+		}
+		if c.MaxHumidity != nil && r.Humidity > *c.MaxHumidity {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// checkScriptSteps checks the steps, and that p (nil without authentication)
+// may submit their commands.
+func checkScriptSteps(steps []ScriptStep, path string, depth int, p *Principal, hasWeather bool) error {
+	if depth > maxScriptDepth {
+		return fmt.Errorf("step %s: nested more than %d deep", path, maxScriptDepth)
+	}
+	for i, s := range steps {
+		err := s.check(scriptStepPath(path, i), depth, p, hasWeather)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *ScriptStep) check(path string, depth int, p *Principal, hasWeather bool) error {
+	kinds := 0
+	for _, b := range []bool{s.Command != "", s.Wait != nil, s.If != nil, s.Repeat != 0} {
+		if b {
+			kinds++
+		}
+	}
+	if kinds != 1 {
+		return fmt.Errorf("step %s: not exactly one of command, wait, if, or repeat", path)
+	}
+	if s.Command == "" && s.Args != nil || s.If == nil && (s.Then != nil || s.Else != nil) ||
+		s.Repeat == 0 && s.Steps != nil {
+		return fmt.Errorf("step %s: fields of another kind of step", path)
+	}
+	var err error
+	switch {
+	case s.Command != "":
+		if r := requiredRole("POST", s.Command); p != nil && p.Role < r {
+			return fmt.Errorf("step %s: %s needs the %s role", path, s.Command, r)
+		}
+		args := s.Args
+		if args == nil {
+			args = json.RawMessage("{}")
+		}
+		var cmd Command
+		cmd, err = decodeCommand(s.Command, bytes.NewReader(args))
+		if r, e := commandRole(s.Command, cmd); err == nil && p != nil && p.Role < r {
+			return fmt.Errorf("step %s: %s needs the %s role", path, e, r)
+		}
+	case s.Wait != nil:
+		w := s.Wait
+		switch {
+		case (w.Seconds != 0) == (w.Until != nil):
+			err = fmt.Errorf("wait for either seconds or until a condition")
+		case !isFinite(w.Seconds) || w.Seconds < 0:
+			err = fmt.Errorf("bad wait: %g seconds", w.Seconds)
+		case !isFinite(w.Timeout) || w.Timeout < 0:
+			err = fmt.Errorf("bad wait timeout: %g seconds", w.Timeout)
+		case w.Until != nil:
+			err = w.Until.check(hasWeather)
+		}
+	case s.If != nil:
+		err = s.If.check(hasWeather)
+		if err == nil {
+			err = checkScriptSteps(s.Then, path+".then", depth+1, p, hasWeather)
+		}
+		if err == nil {
+			err = checkScriptSteps(s.Else, path+".else", depth+1, p, hasWeather)
+		}
+		return err
+	default:
+		if s.Repeat < 1 || s.Repeat > maxScriptRepeat {
+			err = rangeError("repeat", 1, maxScriptRepeat, "bad repeat: %d", s.Repeat)
+		} else if len(s.Steps) == 0 {
+			err = fmt.Errorf("no steps to repeat")
+		} else {
+			return checkScriptSteps(s.Steps, path+".steps", depth+1, p, hasWeather)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("step %s: %w", path, err)
+	}
+	return nil
+}
+
+// A ScriptRunner runs one script at a time, submitting its commands
+// through the same checks as any client's.
+type ScriptRunner struct {
+	submit  func(p *Principal, endpoint string, body io.Reader) (string, int, error)
+	command func(id string) (CommandRecord, bool)
+	weather func() (WeatherReading, error) // nil if no weather station
+	poll    time.Duration
+
+	mu     sync.Mutex
+	status *ScriptStatus
+	cancel context.CancelFunc
+}
+
+func NewScriptRunner(submit func(p *Principal, endpoint string, body io.Reader) (string, int, error),
+	command func(id string) (CommandRecord, bool), weather func() (WeatherReading, error)) *ScriptRunner {
+	return &ScriptRunner{submit: submit, command: command, weather: weather, poll: scriptPollInterval}
+}
+
+// Run checks the script and starts running it as p, unless a script
+// is already running.
+func (r *ScriptRunner) Run(script Script, p *Principal) error {
+	if len(script.Steps) == 0 {
+		return fmt.Errorf("empty script")
+	}
+	err := checkScriptSteps(script.Steps, "", 0, p, r.weather != nil)
+	if err != nil {
+		return err
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status != nil && r.status.State == scriptRunning {
+		return fmt.Errorf("%w: script %s is running", errBusy, r.status.Name)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r.status = &ScriptStatus{Name: script.Name, State: scriptRunning, Commands: []string{}, Started: time.Now()}
+	r.cancel = cancel
+	go r.run(ctx, script, p, r.status)
+	return nil
+}
+
+func (r *ScriptRunner) run(ctx context.Context, script Script, p *Principal, status *ScriptStatus) {
+	log.Printf("script %s: started", script.Name)
+	err := r.runSteps(ctx, script.Steps, "", p, status)
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case ctx.Err() != nil:
+		status.State = scriptCancelled
+	case err != nil:
+		status.State, status.Error = scriptFailed, err.Error()
+	default:
+		status.State = scriptDone
+	}
+	status.Step = ""
+	r.cancel()
+	log.Printf("script %s: %s %s", script.Name, status.State, status.Error)
+}
+
+func (r *ScriptRunner) runSteps(ctx context.Context, steps []ScriptStep, path string, p *Principal, status *ScriptStatus) error {
+	for i, s := range steps {
+		r.mu.Lock()
+		status.Step = scriptStepPath(path, i)
+		r.mu.Unlock()
+		err := r.runStep(ctx, s, status.Step, p, status)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (r *ScriptRunner) runStep(ctx context.Context, s ScriptStep, path string, p *Principal, status *ScriptStatus) error {
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	switch {
+	case s.Command != "":
+		args := s.Args
+		if args == nil {
+			args = json.RawMessage("{}")
+		}
+		id, _, err := r.submit(p, s.Command, bytes.NewReader(args))
+		if err != nil {
+			return fmt.Errorf("step %s: %s: %w", path, s.Command, err)
+		}
+		r.mu.Lock()
+		status.Commands = append(status.Commands, id)
+		r.mu.Unlock()
+		return r.waitFor(ctx, func() (bool, error) {
+			rec, ok := r.command(id)
+			if !ok {
+				return false, fmt.Errorf("step %s: command %s forgotten", path, id)
+			}
+			switch rec.State {
+			case commandDone:
+				return true, nil
+			case commandFailed, commandAborted:
+				return false, fmt.Errorf("step %s: %s %s: %s", path, s.Command, rec.State, rec.Error)
+			}
+			return false, nil
+		}, 0)
+	case s.Wait != nil:
+		if s.Wait.Until == nil {
+			select {
+			case <-time.After(Seconds2Duration(s.Wait.Seconds)):
+				return nil
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		timeout := scriptWaitTimeout
+		if s.Wait.Timeout != 0 {
+			timeout = Seconds2Duration(s.Wait.Timeout)
+		}
+		err := r.waitFor(ctx, func() (bool, error) {
+			return s.Wait.Until.holds(time.Now(), r.weather)
+		}, timeout)
+		if err != nil {
+			return fmt.Errorf("step %s: %w", path, err)
+		}
+		return nil
+	case s.If != nil:
+		ok, err := s.If.holds(time.Now(), r.weather)
+		if err != nil {
+			return fmt.Errorf("step %s: %w", path, err)
+		}
+		if ok {
+			return r.runSteps(ctx, s.Then, path+".then", p, status)
+		}
+		return r.runSteps(ctx, s.Else, path+".else", p, status)
+	default:
+		for i := 0; i < s.Repeat; i++ {
+			err := r.runSteps(ctx, s.Steps, fmt.Sprintf("%s.steps[%d]", path, i), p, status)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// waitFor polls done until it returns true or an error,
+// or the timeout (if not 0) passes.
+func (r *ScriptRunner) waitFor(ctx context.Context, done func() (bool, error), timeout time.Duration) error {
+	start := time.Now()
+	for {
+		ok, err := done()
+		if err != nil || ok {
+			return err
+		}
+		if timeout != 0 && time.Since(start) > timeout {
+			return fmt.Errorf("timed out after %.0f seconds", timeout.Seconds())
+		}
+		select {
+		case <-time.After(r.poll):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+// Cancel stops the running script, if any, after its current step.
+// A command already submitted keeps running.
+func (r *ScriptRunner) Cancel() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.cancel != nil {
+		r.cancel()
+	}
+}
+
+// Status returns the progress of the current or last script, if any.
+func (r *ScriptRunner) Status() *ScriptStatus {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.status == nil {
+		return nil
+	}
+	s := *r.status
+	s.Commands = append([]string{}, s.Commands...)
+	return &s
+}
+
+// scriptStepPath is the path of step i under path, e.g. "2.then.0".
+func scriptStepPath(path string, i int) string {
+	if path == "" {
+		return strconv.Itoa(i)
+	}
+	return path + "." + strconv.Itoa(i)
+}
+
+// serveScripts serves the script runner.
+func serveScripts(mux *http.ServeMux, scripts *ScriptRunner, auth *Auth) {
+	mux.HandleFunc("/scripts", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			status := scripts.Status()
+			if status == nil {
+				err := fmt.Errorf("no script run yet")
+				jsonResponse(w, err, http.StatusNotFound)
+				return
+			}
+			err := json.NewEncoder(w).Encode(status)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var script Script
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&script)
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			p := principalFrom(req.Context())
+			err = auth.CheckLock(p)
+			if err != nil {
+				jsonResponse(w, err, http.StatusLocked)
+				return
+			}
+			err = scripts.Run(script, p)
+			if errors.Is(err, errBusy) {
+				jsonResponse(w, err, http.StatusConflict)
+				return
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/scripts/cancel", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		scripts.Cancel()
+		jsonResponse(w, nil, http.StatusOK)
+	})
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+func waitForScript(t *testing.T, r *ScriptRunner) *ScriptStatus {
+	t.Helper()
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		if s := r.Status(); s.State != scriptRunning {
+			return s
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatal("script still running")
+	return nil
+}
+
+func TestScriptRunner(t *testing.T) {
+	tracker := NewCommandTracker()
+	var submitted []string
+	submit := func(p *Principal, endpoint string, body io.Reader) (string, int, error) {
+		b, _ := io.ReadAll(body)
+		id := fmt.Sprint(len(submitted))
+		submitted = append(submitted, endpoint)
+		tracker.Add(id, endpoint)
+		if strings.Contains(string(b), `"elevation": 10`) {
+			tracker.Set(id, commandFailed, fmt.Errorf("too low"))
+		} else {
+			tracker.Set(id, commandDone, nil)
+		}
+		return id, 200, nil
+	}
+	weather := func() (WeatherReading, error) {
+		return WeatherReading{WindSpeed: 5}, nil
+	}
+	r := NewScriptRunner(submit, tracker.Get, weather)
+	r.poll = time.Millisecond
+
+	var script Script
+	err := json.Unmarshal([]byte(`{"name": "test", "steps": [
+		{"repeat": 2, "steps": [{"command": "/move-to", "args": {"azimuth": 120, "elevation": 60}}]},
+		{"wait": {"seconds": 0.01}},
+		{"wait": {"until": {"max_wind_speed": 10}}},
+		{"if": {"max_wind_speed": 3}, "then": [{"command": "/stow"}], "else": [{"command": "/rotator", "args": {"angle": 0}}]}
+	]}`), &script)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(script, &Principal{Name: "alice", Role: roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+	s := waitForScript(t, r)
+	if s.State != scriptDone || len(s.Commands) != 3 || strings.Join(submitted, " ") != "/move-to /move-to /rotator" {
+		t.Errorf("got %+v, submitted %v", s, submitted)
+	}
+
+	// a failed command fails the script
+	script.Steps = []ScriptStep{{Command: "/move-to", Args: json.RawMessage(`{"azimuth": 120, "elevation": 10}`)}}
+	if err := r.Run(script, nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := waitForScript(t, r); s.State != scriptFailed || !strings.Contains(s.Error, "too low") {
+		t.Errorf("got %+v", s)
+	}
+
+	// one script at a time
+	script.Steps = []ScriptStep{{Wait: &ScriptWait{Until: &ScriptCondition{MaxWindSpeed: new(float64)}}}}
+	if err := r.Run(script, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Run(script, nil); !errors.Is(err, errBusy) {
+		t.Errorf("second script: got %v", err)
+	}
+	r.Cancel()
+	if s := waitForScript(t, r); s.State != scriptCancelled {
+		t.Errorf("got %+v", s)
+	}
+
+	for _, bad := range []string{
+		`[]`,
+		`[{"command": "/stow", "wait": {"seconds": 1}}]`,
+		`[{"command": "/bogus"}]`,
+		`[{"command": "/move-to", "args": {"azimuth": 120}}]`,
+		`[{"command": "/stow"}]`, // needs an operator
+		`[{"wait": {"seconds": -1}}]`,
+		`[{"wait": {"seconds": 1, "until": {"max_wind_speed": 10}}}]`,
+		`[{"wait": {"until": {"lst_window": [25, 2]}}}]`,
+		`[{"repeat": 0, "steps": [{"wait": {"seconds": 1}}]}]`,
+		`[{"repeat": 2}]`,
+		`[{"if": {"max_humidity": 0.5}, "steps": [{"wait": {"seconds": 1}}]}]`,
+	} {
+		var steps []ScriptStep
+		if err := json.Unmarshal([]byte(bad), &steps); err != nil {
+			t.Fatal(err)
+		}
+		err := r.Run(Script{Name: "bad", Steps: steps}, &Principal{Name: "alice", Role: roleObserver})
+		if err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+
+	// weather conditions need a weather station
+	r = NewScriptRunner(submit, tracker.Get, nil)
+	script.Steps = []ScriptStep{{If: &ScriptCondition{MaxWindSpeed: new(float64)}}}
+	if err := r.Run(script, nil); err == nil {
+		t.Error("weather condition without a weather station accepted")
+	}
+}
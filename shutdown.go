@@ -0,0 +1,19 @@
+package main
+
+import (
+	"fmt"
+)
+
+// what to do with the current command on shutdown
+const (
+	shutdownStop   = "stop"   // abort it, stopping the telescope
+	shutdownFinish = "finish" // let it finish, up to the shutdown timeout
+)
+
+func checkShutdownMode(mode string) error {
+	switch mode {
+	case shutdownStop, shutdownFinish:
+		return nil
+	}
+	return fmt.Errorf("bad shutdown mode %q: expected %s or %s", mode, shutdownStop, shutdownFinish)
+}
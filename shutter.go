@@ -0,0 +1,280 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// The enclosure shutter (or membrane) has its own controller. The TCS
+// polls its state, refuses sky commands while it isn't open, and can open
+// it for them and close it when stowing (see ShutterConfig).
+
+const (
+	shutterPollInterval = 5 * time.Second
+	shutterStaleAge     = 30 * time.Second
+	shutterMoveTimeout  = 5 * time.Minute
+)
+
+// ShutterConfig sets whether the TCS moves the shutter itself.
+type ShutterConfig struct {
+	OpenForSky  bool `json:"open_for_sky"`  // open it before starting sky commands
+	CloseOnStow bool `json:"close_on_stow"` // close it when stowing
+}
+
+// shutter states, as reported by the controller
+const (
+	shutterOpen    = "open"
+	shutterClosed  = "closed"
+	shutterMoving  = "moving"
+	shutterFault   = "fault"
+	shutterUnknown = "unknown" // not read, or stale
+)
+
+// ShutterStatus is the state of the shutter.
+type ShutterStatus struct {
+	State    string    `json:"state"`
+	Time     time.Time `json:"time,omitempty"` // when reported
+	Error    string    `json:"error,omitempty"`
+	Override bool      `json:"override"` // allow sky commands while not open
+}
+
+// isSkyCommand returns true for motion commands that point at the sky,
+// rather than drive to a fixed position.
+func isSkyCommand(cmd Command) bool {
+	return isMotionCommand(cmd) && !isMoveCommand(cmd)
+}
+
+// A Shutter polls the shutter controller over HTTP. GETs of the URL
+// should return a JSON object like {"state": "open"}, and POSTs of
+// {"command": "open"} or {"command": "close"} move it.
+// XXX:TBD interface to be agreed with the enclosure controller
+// It is safe for concurrent use.
+type Shutter struct {
+	url    string
+	client *http.Client
+	alarms *Alarms
+
+	mu       sync.Mutex
+	status   ShutterStatus
+	err      error
+	override bool
+}
+
+func NewShutter(url string, alarms *Alarms) *Shutter {
+	return &Shutter{
+		url: url,
+		client: &http.Client{
+			Timeout: 2 * time.Second,
+		},
+		alarms: alarms,
+		status: ShutterStatus{State: shutterUnknown},
+		err:    fmt.Errorf("no shutter state yet"),
+	}
+}
+
+// Run polls the shutter controller forever.
+func (s *Shutter) Run() {
+	for {
+		err := s.poll()
+		status := s.Status()
+		s.alarms.Set(err != nil, "shutter", severityWarning, false, "can't read shutter state: %v", err)
+		s.alarms.Set(status.State == shutterFault, "shutter_fault", severityCritical, false, "shutter fault")
+		time.Sleep(shutterPollInterval)
+	}
+}
+
+func (s *Shutter) poll() error {
+	var status ShutterStatus
+	resp, err := s.client.Get(s.url)
+	if err == nil {
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			err = fmt.Errorf(resp.Status)
+		} else {
+			err = json.NewDecoder(resp.Body).Decode(&status)
+		}
+	}
+	if err == nil {
+		switch status.State {
+		case shutterOpen, shutterClosed, shutterMoving, shutterFault:
+		default:
+			err = fmt.Errorf("unknown shutter state %q", status.State)
+		}
+	}
+	if err == nil && status.Time.IsZero() {
+		status.Time = time.Now()
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.err = err
+	if err != nil {
+		log.Printf("shutter: %v", err)
+		return err
+	}
+	if s.status.State != status.State {
+		log.Printf("shutter %s", status.State)
+	}
+	s.status.State, s.status.Time = status.State, status.Time
+	return nil
+}
+
+func (s *Shutter) Status() ShutterStatus {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	status, err := s.status, s.err
+	status.Override = s.override
+	if age := time.Since(status.Time); err == nil && age > shutterStaleAge {
+		err = fmt.Errorf("shutter state is stale (%.0f secs old)", age.Seconds())
+	}
+	if err != nil {
+		status.State, status.Error = shutterUnknown, err.Error()
+	}
+	return status
+}
+
+// SetOverride allows, or stops allowing, sky commands while the shutter
+// isn't open.
+func (s *Shutter) SetOverride(override bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.override = override
+}
+
+// Check returns an error if a command points at the sky while the
+// shutter isn't open, unless overridden.
+func (s *Shutter) Check(cmd Command) error {
+	if !isSkyCommand(cmd) {
+		return nil
+	}
+	status := s.Status()
+	if status.State == shutterOpen || status.Override {
+		return nil
+	}
+	if status.Error != "" {
+		return fmt.Errorf("shutter state unknown: %s", status.Error)
+	}
+	return fmt.Errorf("shutter %s", status.State)
+}
+
+// Move commands the shutter to open or close, without waiting.
+func (s *Shutter) Move(open bool) error {
+	command := "close"
+	if open {
+		command = "open"
+	}
+	log.Printf("shutter: commanding %s", command)
+	b, _ := json.Marshal(map[string]string{"command": command})
+	resp, err := s.client.Post(s.url, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return fmt.Errorf("shutter %s: %w", command, err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("shutter %s: %s", command, resp.Status)
+	}
+	return nil
+}
+
+// Open opens the shutter, and waits until it's open.
+func (s *Shutter) Open() error {
+	err := s.Move(true)
+	if err != nil {
+		return err
+	}
+	t0 := time.Now()
+	for time.Since(t0) < shutterMoveTimeout {
+		time.Sleep(shutterPollInterval)
+		s.poll()
+		switch s.Status().State {
+		case shutterOpen:
+			return nil
+		case shutterFault:
+			return fmt.Errorf("shutter fault while opening")
+		}
+	}
+	return fmt.Errorf("shutter not open after %v", shutterMoveTimeout)
+}
+
+// Prepare gets the shutter ready for a command: if it points at the sky,
+// the shutter is opened if configured to, then checked.
+func (s *Shutter) Prepare(cmd Command) error {
+	if isSkyCommand(cmd) && currentConfig().Shutter.OpenForSky {
+		if status := s.Status(); status.State == shutterClosed && !status.Override {
+			err := s.Open()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return s.Check(cmd)
+}
+
+// serveShutter serves the shutter controller, or nil if there's none.
+func serveShutter(mux *http.ServeMux, shutter *Shutter) {
+	mux.HandleFunc("/shutter", func(w http.ResponseWriter, req *http.Request) {
+		if shutter == nil {
+			err := fmt.Errorf("no shutter controller configured")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			status := shutter.Status()
+			err := json.NewEncoder(w).Encode(&status)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Command string `json:"command"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			if x.Command != "open" && x.Command != "close" {
+				err = fmt.Errorf("bad command %q: expected open or close", x.Command)
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			err = shutter.Move(x.Command == "open")
+			jsonResponse(w, err, http.StatusInternalServerError)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/shutter/override", func(w http.ResponseWriter, req *http.Request) {
+		if shutter == nil {
+			err := fmt.Errorf("no shutter controller configured")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Override bool `json:"override"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			log.Printf("setting shutter override: %v", x.Override)
+			shutter.SetOverride(x.Override)
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
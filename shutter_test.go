@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestShutter(t *testing.T) {
+	state := shutterClosed
+	var commands []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method == "POST" {
+			var x struct{ Command string }
+			json.NewDecoder(req.Body).Decode(&x)
+			commands = append(commands, x.Command)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]string{"state": state})
+	}))
+	defer srv.Close()
+	s := NewShutter(srv.URL, NewAlarms())
+	track := trackCmd{}
+	stow := newStowCmd()
+
+	if s.Check(track) == nil {
+		t.Error("sky command allowed before the shutter state is read")
+	}
+	if err := s.poll(); err != nil {
+		t.Fatal(err)
+	}
+	if s.Check(track) == nil {
+		t.Error("sky command allowed with the shutter closed")
+	}
+	if err := s.Check(stow); err != nil {
+		t.Errorf("stow refused with the shutter closed: %v", err)
+	}
+	s.SetOverride(true)
+	if err := s.Check(track); err != nil {
+		t.Errorf("sky command refused with the override: %v", err)
+	}
+	s.SetOverride(false)
+
+	state = shutterOpen
+	s.poll()
+	if err := s.Check(track); err != nil {
+		t.Errorf("sky command refused with the shutter open: %v", err)
+	}
+
+	state = "ajar"
+	if s.poll() == nil || s.Status().State != shutterUnknown || s.Check(track) == nil {
+		t.Errorf("got %+v, expected unknown", s.Status())
+	}
+
+	if err := s.Move(false); err != nil || len(commands) != 1 || commands[0] != "close" {
+		t.Errorf("got %v %v, expected close", err, commands)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+)
+
+// A skydipCmd measures the atmospheric opacity, by stepping or sweeping
+// the elevation over a range at a fixed azimuth. In step mode it dwells
+// at each step, moving between them at up to speed; in sweep mode it
+// sweeps the range at speed, reversing in place over turnaround_time.
+// Scans alternate up and down the range. Its scan flags are tagged for
+// the opacity pipeline (see scanTags): each dwell or sweep is a scan,
+// and each move or reversal a turnaround.
+type skydipCmd struct {
+	Azimuth        float64    `json:"azimuth"`
+	ElevationRange [2]float64 `json:"elevation_range"` // from, to
+	Mode           string     `json:"mode"`            // step or sweep
+	Step           float64    `json:"step"`            // [deg]
+	Dwell          float64    `json:"dwell"`           // at each step [s]
+	Speed          float64    `json:"speed"`           // [deg/s]
+	TurnaroundTime float64    `json:"turnaround_time"` // sweep reversal [s]
+	NumScans       int        `json:"num_scans"`
+	StartTime      float64    `json:"start_time"`
+}
+
+func newSkydipCmd() skydipCmd {
+	return skydipCmd{
+		Mode:     "step",
+		NumScans: 1,
+	}
+}
+
+// elevations returns the elevations stepped to, in order.
+func (cmd skydipCmd) elevations() []float64 {
+	rng := cmd.ElevationRange
+	n := int(math.Floor(math.Abs(rng[1]-rng[0])/cmd.Step+1e-9)) + 1
+	step := math.Copysign(cmd.Step, rng[1]-rng[0])
+	var els []float64
+	for i := 0; i < cmd.NumScans; i++ {
+		for k := 0; k < n; k++ {
+			j := k
+			if i%2 == 1 {
+				j = n - 1 - k
+			}
+			if i > 0 && k == 0 {
+				continue // still there from the last scan
+			}
+			els = append(els, rng[0]+float64(j)*step)
+		}
+	}
+	return els
+}
+
+// stepTime returns how long a move of step deg takes from rest to rest,
+// along a cubic within the elevation limits at el.
+func (cmd skydipCmd) stepTime(el float64) float64 {
+	lim := currentKinematicLimits(el)[1]
+	speed := math.Min(cmd.Speed, lim.speedMax)
+	return math.Max(1.5*cmd.Step/speed, math.Max(math.Sqrt(6*cmd.Step/lim.accelMax), math.Cbrt(12*cmd.Step/lim.jerkMax)))
+}
+
+// sweeps returns the command's elevation offsets from the start of the range.
+func (cmd skydipCmd) sweeps() *sweepOffsets {
+	rng := cmd.ElevationRange
+	var sweeps []offsetSweep
+	var turns []float64
+	if cmd.Mode == "sweep" {
+		v := math.Copysign(cmd.Speed, rng[1]-rng[0])
+		for i := 0; i < cmd.NumScans; i++ {
+			if i%2 == 0 {
+				sweeps = append(sweeps, offsetSweep{0, 0, 0, v})
+			} else {
+				sweeps = append(sweeps, offsetSweep{0, rng[1] - rng[0], 0, -v})
+			}
+			turns = append(turns, cmd.TurnaroundTime)
+		}
+		return newSweepOffsets(sweeps, math.Abs(rng[1]-rng[0])/cmd.Speed, turns[:len(sweeps)-1])
+	}
+	move := cmd.stepTime(math.Min(rng[0], rng[1]))
+	for _, el := range cmd.elevations() {
+		sweeps = append(sweeps, offsetSweep{0, el - rng[0], 0, 0})
+		turns = append(turns, move)
+	}
+	return newSweepOffsets(sweeps, cmd.Dwell, turns[:len(sweeps)-1])
+}
+
+func (cmd skydipCmd) Check() error {
+	rng := cmd.ElevationRange
+	if rng[0] == rng[1] {
+		return fmt.Errorf("empty elevation range")
+	}
+	if cmd.Speed <= 0 || cmd.Speed > elevationSpeedMax {
+		return rangeError("speed", 0, elevationSpeedMax, "speed (%g) out of range (0,%g]", cmd.Speed, elevationSpeedMax)
+	}
+	if cmd.NumScans < 1 {
+		return fmt.Errorf("bad number of scans: %d", cmd.NumScans)
+	}
+	scans := float64(cmd.NumScans)
+	switch cmd.Mode {
+	case "step":
+		if cmd.Step <= 0 || cmd.Step > math.Abs(rng[1]-rng[0]) {
+			return rangeError("step", 0, math.Abs(rng[1]-rng[0]), "bad step size: %g", cmd.Step)
+		}
+		if cmd.Dwell <= 0 {
+			return fmt.Errorf("bad dwell time: %g", cmd.Dwell)
+		}
+		scans *= math.Floor(math.Abs(rng[1]-rng[0])/cmd.Step) + 1
+	case "sweep":
+		if cmd.TurnaroundTime <= 0 {
+			return fmt.Errorf("bad turnaround time: %g", cmd.TurnaroundTime)
+		}
+	default:
+		return &FieldError{Field: "mode", Reason: fmt.Sprintf("unknown mode %s", cmd.Mode)}
+	}
+	if scans > maxCommandItems {
+		return fmt.Errorf("more than %d dwells or sweeps", maxCommandItems)
+	}
+	for _, el := range rng {
+		err := checkAzEl(cmd.Azimuth, el, 0, 0)
+		if err != nil {
+			return err
+		}
+	}
+	err := checkStartTime(cmd.StartTime)
+	if err != nil {
+		return err
+	}
+	offsets := cmd.sweeps()
+	if Seconds2Duration(offsets.duration()) > maxPatternDuration {
+		return fmt.Errorf("skydip longer than %v", maxPatternDuration)
+	}
+	speed, accel, jerk := offsets.peaks()
+	err = checkOffsetKinematics("speed", math.Min(rng[0], rng[1]), speed, accel, jerk)
+	if err != nil {
+		return err
+	}
+	return checkPatternCmd(cmd)
+}
+
+func (cmd skydipCmd) Pattern() (ScanPattern, error) {
+	t0 := jsontime(cmd.StartTime)
+	center, err := NewTrackScanPattern(t0, t0, cmd.Azimuth, cmd.ElevationRange[0], "Horizon")
+	if err != nil {
+		return nil, err
+	}
+	sweeps := cmd.sweeps()
+	pattern := NewSweepsScanPattern(t0, *center, sweeps)
+	// only the elevation moves, even between dwells at rest
+	pattern.flags = func(t float64) (int8, int8) {
+		if _, _, _, _, _, turning := sweeps.at(t); turning {
+			return 0, 2
+		}
+		return 0, 0
+	}
+	return pattern, nil
+}
+
+func (cmd skydipCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return startPatternCmd(ctx, tel, cmd)
+}
+
+// scanTags identify the scans as a skydip. In step mode, the step is
+// tagged too, so the elevation of each dwell follows from its sweep number.
+func (cmd skydipCmd) scanTags() map[string]string {
+	tags := map[string]string{
+		"observation":     "skydip",
+		"mode":            cmd.Mode,
+		"azimuth":         fmt.Sprint(cmd.Azimuth),
+		"elevation_range": fmt.Sprintf("%g,%g", cmd.ElevationRange[0], cmd.ElevationRange[1]),
+	}
+	if cmd.Mode == "step" {
+		tags["step"] = fmt.Sprint(cmd.Step)
+	}
+	return tags
+}
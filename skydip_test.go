@@ -0,0 +1,99 @@
+package main
+
+import (
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestSkydipElevations(t *testing.T) {
+	cmd := newSkydipCmd()
+	cmd.ElevationRange = [2]float64{60, 30}
+	cmd.Step = 10
+	cmd.NumScans = 2
+	got := cmd.elevations()
+	expected := []float64{60, 50, 40, 30, 40, 50, 60}
+	if len(got) != len(expected) {
+		t.Fatalf("got %v, expected %v", got, expected)
+	}
+	for i := range got {
+		if math.Abs(got[i]-expected[i]) > 1e-9 {
+			t.Errorf("got %v, expected %v", got, expected)
+			break
+		}
+	}
+}
+
+func TestSkydipCmd(t *testing.T) {
+	disableSunAvoidance(t)
+	body := `{"azimuth": 180, "elevation_range": [20, 80], "step": 20, "dwell": 10, "speed": 1, "start_time": 10}`
+	c, err := decodeCommand("/skydip", strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	cmd := c.(skydipCmd)
+	if err := cmd.Check(); err != nil {
+		t.Fatal(err)
+	}
+	pattern, err := cmd.Pattern()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// four dwells, at each step, with the elevation moving between them
+	samples := collectPattern(t, pattern)
+	var dwells []float64
+	for i, x := range samples {
+		if x.Az != 180 || x.AzFlag != 0 {
+			t.Fatalf("sample %d: azimuth moved: %+v", i, x)
+		}
+		if x.ElFlag == 2 {
+			continue
+		}
+		if math.Abs(x.ElVel) > 1e-9 {
+			t.Fatalf("sample %d: moving while dwelling: %+v", i, x)
+		}
+		if n := len(dwells); n == 0 || math.Abs(x.El-dwells[n-1]) > 1e-9 {
+			dwells = append(dwells, x.El)
+		}
+	}
+	if len(dwells) != 4 || math.Abs(dwells[0]-20) > 1e-9 || math.Abs(dwells[3]-80) > 1e-9 {
+		t.Errorf("got dwells at %v", dwells)
+	}
+	move := cmd.stepTime(20)
+	d := samples[len(samples)-1].T.Sub(samples[0].T).Seconds()
+	if math.Abs(d-(40+3*move)) > 0.1 {
+		t.Errorf("got duration %g, expected %g", d, 40+3*move)
+	}
+
+	sweep := cmd
+	sweep.Mode, sweep.TurnaroundTime, sweep.NumScans = "sweep", 5, 3
+	if err := sweep.Check(); err != nil {
+		t.Fatal(err)
+	}
+	offsets := sweep.sweeps()
+	if dur := offsets.duration(); dur != 3*60+2*5 {
+		t.Errorf("sweep: got duration %g", dur)
+	}
+	if _, _, _, vdy, _, _ := offsets.at(70); vdy != -1 {
+		t.Errorf("sweep: second sweep at %g deg/s, expected -1", vdy)
+	}
+
+	for name, modify := range map[string]func(*skydipCmd){
+		"empty range":    func(c *skydipCmd) { c.ElevationRange[1] = c.ElevationRange[0] },
+		"out of range":   func(c *skydipCmd) { c.ElevationRange[1] = 200 },
+		"step too large": func(c *skydipCmd) { c.Step = 90 },
+		"no dwell":       func(c *skydipCmd) { c.Dwell = 0 },
+		"too fast":       func(c *skydipCmd) { c.Speed = elevationSpeedMax + 1 },
+		"bad mode":       func(c *skydipCmd) { c.Mode = "spiral" },
+		"no turnaround":  func(c *skydipCmd) { c.Mode = "sweep" },
+		"no scans":       func(c *skydipCmd) { c.NumScans = 0 },
+		"start in past":  func(c *skydipCmd) { c.StartTime = 1615586380 },
+	} {
+		bad := cmd
+		modify(&bad)
+		if err := bad.Check(); err == nil {
+			t.Errorf("%s: check passed", name)
+		}
+	}
+}
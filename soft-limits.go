@@ -0,0 +1,297 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const limitOverrideMaxDuration = 24 * time.Hour
+
+// Limits are azimuth and elevation ranges [deg].
+type Limits struct {
+	Azimuth   [2]float64 `json:"azimuth"`
+	Elevation [2]float64 `json:"elevation"`
+}
+
+func hardLimits() Limits {
+	return Limits{
+		Azimuth:   [2]float64{azimuthMin, azimuthMax},
+		Elevation: [2]float64{elevationMin, elevationMax},
+	}
+}
+
+// LimitsState is the active limits, whether they're soft, and the
+// overrides widening them.
+type LimitsState struct {
+	Limits
+	Soft      bool            `json:"soft"`
+	SetBy     string          `json:"set_by,omitempty"`
+	Overrides []LimitOverride `json:"overrides,omitempty"`
+}
+
+// A LimitOverride widens the soft limits of an axis for a while, e.g. to
+// allow low elevations during commissioning.
+type LimitOverride struct {
+	ID       string     `json:"id"`
+	Axis     string     `json:"axis"`  // "azimuth" or "elevation"
+	Range    [2]float64 `json:"range"` // allowed, within the hard limits [deg]
+	Reason   string     `json:"reason"`
+	IssuedBy string     `json:"issued_by,omitempty"`
+	Expires  time.Time  `json:"expires"`
+}
+
+// SoftLimits narrow the hard limits for commands, e.g. during mirror work.
+// Stows ignore them. It is safe for concurrent use.
+type SoftLimits struct {
+	mu        sync.Mutex
+	limits    *Limits // nil for the hard limits
+	setBy     string
+	overrides []LimitOverride
+}
+
+var siteSoftLimits = &SoftLimits{}
+
+// State returns the active limits.
+func (sl *SoftLimits) State() LimitsState {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	overrides := sl.active(time.Now())
+	if sl.limits == nil {
+		return LimitsState{Limits: hardLimits(), Overrides: overrides}
+	}
+	return LimitsState{Limits: *sl.limits, Soft: true, SetBy: sl.setBy, Overrides: overrides}
+}
+
+// active returns the overrides not expired at now.
+func (sl *SoftLimits) active(now time.Time) []LimitOverride {
+	var active []LimitOverride
+	for _, o := range sl.overrides {
+		if now.Before(o.Expires) {
+			active = append(active, o)
+		}
+	}
+	return active
+}
+
+// Override issues an override of an axis' soft limits for d,
+// which expires by itself.
+func (sl *SoftLimits) Override(o LimitOverride, d time.Duration) (LimitOverride, error) {
+	hard := hardLimits()
+	var limit [2]float64
+	switch o.Axis {
+	case "azimuth":
+		limit = hard.Azimuth
+	case "elevation":
+		limit = hard.Elevation
+	default:
+		return o, &FieldError{Field: "axis", Reason: fmt.Sprintf("unknown axis %q", o.Axis)}
+	}
+	if o.Range[0] >= o.Range[1] || o.Range[0] < limit[0] || o.Range[1] > limit[1] {
+		return o, rangeError("range", limit[0], limit[1], "override %s range [%g,%g] not a range within [%g,%g]",
+			o.Axis, o.Range[0], o.Range[1], limit[0], limit[1])
+	}
+	if d <= 0 || d > limitOverrideMaxDuration {
+		return o, rangeError("duration", 0, limitOverrideMaxDuration.Seconds(), "override duration %v not in (0,%v]",
+			d, limitOverrideMaxDuration)
+	}
+	if o.Reason == "" {
+		return o, &FieldError{Field: "reason", Reason: "required"}
+	}
+	o.ID = newCommandID()
+	o.Expires = time.Now().Add(d)
+	sl.mu.Lock()
+	sl.overrides = append(sl.active(time.Now()), o)
+	sl.mu.Unlock()
+	log.Printf("limit override %s: %s [%g,%g] until %s by %s: %s",
+		o.ID, o.Axis, o.Range[0], o.Range[1], o.Expires.UTC().Format(time.RFC3339), o.IssuedBy, o.Reason)
+	time.AfterFunc(d, func() {
+		if sl.remove(o.ID) {
+			log.Printf("limit override %s expired", o.ID)
+		}
+	})
+	return o, nil
+}
+
+// Revoke ends an override early.
+func (sl *SoftLimits) Revoke(id, by string) error {
+	if !sl.remove(id) {
+		return fmt.Errorf("no limit override %s", id)
+	}
+	log.Printf("limit override %s revoked by %s", id, by)
+	return nil
+}
+
+func (sl *SoftLimits) remove(id string) bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	for i, o := range sl.overrides {
+		if o.ID == id {
+			sl.overrides = append(sl.overrides[:i], sl.overrides[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
+
+// Set sets the soft limits, which must be within the hard limits.
+func (sl *SoftLimits) Set(l Limits, setBy string) error {
+	hard := hardLimits()
+	for _, c := range []struct {
+		name        string
+		soft, limit [2]float64
+	}{
+		{"azimuth", l.Azimuth, hard.Azimuth},
+		{"elevation", l.Elevation, hard.Elevation},
+	} {
+		if c.soft[0] >= c.soft[1] || c.soft[0] < c.limit[0] || c.soft[1] > c.limit[1] {
+			return rangeError(c.name, c.limit[0], c.limit[1], "soft %s limits [%g,%g] not a range within [%g,%g]",
+				c.name, c.soft[0], c.soft[1], c.limit[0], c.limit[1])
+		}
+	}
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.limits, sl.setBy = &l, setBy
+	return nil
+}
+
+// Clear restores the hard limits.
+func (sl *SoftLimits) Clear() {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	sl.limits, sl.setBy = nil, ""
+}
+
+// Check checks az,el is within the soft limits, or an override's range.
+func (sl *SoftLimits) Check(az, el float64) error {
+	sl.mu.Lock()
+	l := sl.limits
+	overrides := sl.active(time.Now())
+	sl.mu.Unlock()
+	overridden := func(axis string, x float64) bool {
+		for _, o := range overrides {
+			if o.Axis == axis && x >= o.Range[0] && x <= o.Range[1] {
+				return true
+			}
+		}
+		return false
+	}
+	switch {
+	case l == nil:
+		return nil
+	case (az < l.Azimuth[0] || az > l.Azimuth[1]) && !overridden("azimuth", az):
+		return &LimitError{"azimuth", "position", az, l.Azimuth[0], l.Azimuth[1], true}
+	case (el < l.Elevation[0] || el > l.Elevation[1]) && !overridden("elevation", el):
+		return &LimitError{"elevation", "position", el, l.Elevation[0], l.Elevation[1], true}
+	}
+	return nil
+}
+
+func (l Limits) String() string {
+	return fmt.Sprintf("az [%g,%g] el [%g,%g]", l.Azimuth[0], l.Azimuth[1], l.Elevation[0], l.Elevation[1])
+}
+
+// serveSoftLimits serves the site soft limits and their overrides.
+func serveSoftLimits(mux *http.ServeMux) {
+	mux.HandleFunc("/limits", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			state := siteSoftLimits.State()
+			err := json.NewEncoder(w).Encode(&state)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			l := siteSoftLimits.State().Limits
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&l)
+			if err == nil {
+				setBy := ""
+				if p := principalFrom(req.Context()); p != nil {
+					setBy = p.Name
+				}
+				log.Printf("setting soft limits: %v", l)
+				err = siteSoftLimits.Set(l, setBy)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/limits/clear", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		log.Print("clearing soft limits")
+		siteSoftLimits.Clear()
+		jsonResponse(w, nil, http.StatusOK)
+	})
+
+	mux.HandleFunc("/limits/overrides", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			overrides := siteSoftLimits.State().Overrides
+			if overrides == nil {
+				overrides = []LimitOverride{}
+			}
+			err := json.NewEncoder(w).Encode(overrides)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Axis     string     `json:"axis"`
+				Range    [2]float64 `json:"range"`
+				Duration float64    `json:"duration"` // [s]
+				Reason   string     `json:"reason"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			o := LimitOverride{Axis: x.Axis, Range: x.Range, Reason: x.Reason,
+				IssuedBy: clientName(principalFrom(req.Context()))}
+			o, err = siteSoftLimits.Override(o, Seconds2Duration(x.Duration))
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+			err = json.NewEncoder(w).Encode(&o)
+			if err != nil {
+				log.Print(err)
+			}
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/limits/overrides/revoke", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			ID string `json:"id"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			err = siteSoftLimits.Revoke(x.ID, clientName(principalFrom(req.Context())))
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
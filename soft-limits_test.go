@@ -0,0 +1,110 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSoftLimits(t *testing.T) {
+	defer siteSoftLimits.Clear()
+	disableSunAvoidance(t)
+
+	for _, l := range []Limits{
+		{Azimuth: [2]float64{-180, 360}, Elevation: [2]float64{80, 30}},
+		{Azimuth: [2]float64{-200, 360}, Elevation: [2]float64{30, 80}},
+	} {
+		if err := siteSoftLimits.Set(l, "alice"); err == nil {
+			t.Errorf("%v: expected error", l)
+		}
+	}
+	if s := siteSoftLimits.State(); s.Soft || s.Limits != hardLimits() {
+		t.Errorf("got %+v", s)
+	}
+
+	l := Limits{Azimuth: [2]float64{-180, 360}, Elevation: [2]float64{30, 80}}
+	err := siteSoftLimits.Set(l, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := siteSoftLimits.State(); !s.Soft || s.Limits != l || s.SetBy != "alice" {
+		t.Errorf("got %+v", s)
+	}
+	if err := (moveToCmd{Azimuth: 120, Elevation: 85}).Check(); err == nil {
+		t.Error("expected move outside the soft limits to fail")
+	}
+	if err := (moveToCmd{Azimuth: 120, Elevation: 60}).Check(); err != nil {
+		t.Error(err)
+	}
+	scan := azScanCmd{AzimuthRange: [2]float64{110, 130}, Elevation: 85, NumScans: 2, TurnaroundTime: 5, Speed: 0.8}
+	if err := scan.Check(); err == nil {
+		t.Error("expected scan outside the soft limits to fail")
+	}
+	if err := (stowCmd{az: 0, el: 90}).Check(); err != nil {
+		t.Errorf("stow should ignore the soft limits: %v", err)
+	}
+
+	siteSoftLimits.Clear()
+	if err := (moveToCmd{Azimuth: 120, Elevation: 85}).Check(); err != nil {
+		t.Error(err)
+	}
+}
+
+func TestLimitOverrides(t *testing.T) {
+	defer siteSoftLimits.Clear()
+	disableSunAvoidance(t)
+
+	l := Limits{Azimuth: [2]float64{-180, 360}, Elevation: [2]float64{20, 88}}
+	err := siteSoftLimits.Set(l, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, o := range []LimitOverride{
+		{Axis: "rotator", Range: [2]float64{0, 10}, Reason: "test"},
+		{Axis: "elevation", Range: [2]float64{-100, 88}, Reason: "test"},
+		{Axis: "elevation", Range: [2]float64{5, 88}},
+	} {
+		if _, err := siteSoftLimits.Override(o, time.Minute); err == nil {
+			t.Errorf("%+v: expected error", o)
+		}
+	}
+	if _, err := siteSoftLimits.Override(LimitOverride{Axis: "elevation", Range: [2]float64{5, 88}, Reason: "test"}, 48*time.Hour); err == nil {
+		t.Error("expected error for a too long override")
+	}
+
+	low := moveToCmd{Azimuth: 120, Elevation: 10}
+	if err := low.Check(); err == nil {
+		t.Error("expected move outside the soft limits to fail")
+	}
+	o, err := siteSoftLimits.Override(LimitOverride{Axis: "elevation", Range: [2]float64{5, 88}, Reason: "commissioning", IssuedBy: "bob"}, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := siteSoftLimits.State(); len(s.Overrides) != 1 || s.Overrides[0].ID != o.ID || s.Limits != l {
+		t.Errorf("got %+v", s)
+	}
+	if err := low.Check(); err != nil {
+		t.Errorf("override: %v", err)
+	}
+	if err := (moveToCmd{Azimuth: 120, Elevation: 4}).Check(); err == nil {
+		t.Error("expected move outside the override to fail")
+	}
+	if err := siteSoftLimits.Revoke(o.ID, "bob"); err != nil {
+		t.Fatal(err)
+	}
+	if err := siteSoftLimits.Revoke(o.ID, "bob"); err == nil {
+		t.Error("Revoke: expected error for a revoked override")
+	}
+	if err := low.Check(); err == nil {
+		t.Error("expected move outside the soft limits to fail once revoked")
+	}
+
+	// expiring
+	_, err = siteSoftLimits.Override(LimitOverride{Axis: "elevation", Range: [2]float64{5, 88}, Reason: "commissioning"}, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if s := siteSoftLimits.State(); len(s.Overrides) != 0 || low.Check() == nil {
+		t.Errorf("expired: got %+v", s)
+	}
+}
@@ -0,0 +1,118 @@
+package main
+
+import (
+	"math"
+	"sort"
+)
+
+// pathSplineInterval is the spacing of resampled path points [s], as for
+// offset scans.
+var pathSplineInterval = offsetScanSampleInterval.Seconds()
+
+// A cubicSpline interpolates y(t), with continuous first and second
+// derivatives.
+type cubicSpline struct {
+	t, y []float64
+	m    []float64 // second derivatives at t
+}
+
+// newClampedSpline fits a cubic spline through the knots (t, y), with the
+// first derivatives v0 and v1 at the ends. The times must increase.
+func newClampedSpline(t, y []float64, v0, v1 float64) *cubicSpline {
+	n := len(t)
+	h := make([]float64, n-1)
+	for i := range h {
+		h[i] = t[i+1] - t[i]
+	}
+
+	// tridiagonal system a[i] m[i-1] + b[i] m[i] + c[i] m[i+1] = d[i]
+	a := make([]float64, n)
+	b := make([]float64, n)
+	c := make([]float64, n)
+	d := make([]float64, n)
+	b[0], c[0] = 2*h[0], h[0]
+	d[0] = 6 * ((y[1]-y[0])/h[0] - v0)
+	for i := 1; i < n-1; i++ {
+		a[i], b[i], c[i] = h[i-1], 2*(h[i-1]+h[i]), h[i]
+		d[i] = 6 * ((y[i+1]-y[i])/h[i] - (y[i]-y[i-1])/h[i-1])
+	}
+	a[n-1], b[n-1] = h[n-2], 2*h[n-2]
+	d[n-1] = 6 * (v1 - (y[n-1]-y[n-2])/h[n-2])
+
+	// Thomas algorithm
+	for i := 1; i < n; i++ {
+		w := a[i] / b[i-1]
+		b[i] -= w * c[i-1]
+		d[i] -= w * d[i-1]
+	}
+	m := make([]float64, n)
+	m[n-1] = d[n-1] / b[n-1]
+	for i := n - 2; i >= 0; i-- {
+		m[i] = (d[i] - c[i]*m[i+1]) / b[i]
+	}
+	return &cubicSpline{t: t, y: y, m: m}
+}
+
+// Eval returns the spline and its derivative at t.
+func (s *cubicSpline) Eval(t float64) (y, dy float64) {
+	i := sort.SearchFloat64s(s.t, t) - 1
+	if i < 0 {
+		i = 0
+	} else if i > len(s.t)-2 {
+		i = len(s.t) - 2
+	}
+	h := s.t[i+1] - s.t[i]
+	a, b := s.t[i+1]-t, t-s.t[i]
+	m0, m1 := s.m[i], s.m[i+1]
+	c0 := s.y[i]/h - m0*h/6
+	c1 := s.y[i+1]/h - m1*h/6
+	y = m0*a*a*a/(6*h) + m1*b*b*b/(6*h) + c0*a + c1*b
+	dy = -m0*a*a/(2*h) + m1*b*b/(2*h) - c0 + c1
+	return
+}
+
+// splinePath fits splines through the positions of the path points
+// [t, x, y, vx, vy], and resamples them every interval seconds. With
+// endRates, the supplied velocities are kept at the ends, otherwise those
+// of the first and last segments are used; elsewhere they come from the
+// splines. Sky longitudes are unwrapped, so a path may cross 0.
+func splinePath(points [][5]float64, coordsys string, interval float64, endRates bool) [][5]float64 {
+	n := len(points)
+	t := make([]float64, n)
+	x := make([]float64, n)
+	y := make([]float64, n)
+	for i, p := range points {
+		t[i], x[i], y[i] = p[0], p[1], p[2]
+		if i > 0 && coordsys != "Horizon" {
+			x[i] = x[i-1] + math.Remainder(x[i]-x[i-1], 360)
+		}
+	}
+	vx0, vx1 := points[0][3], points[n-1][3]
+	vy0, vy1 := points[0][4], points[n-1][4]
+	if !endRates {
+		vx0, vx1 = (x[1]-x[0])/(t[1]-t[0]), (x[n-1]-x[n-2])/(t[n-1]-t[n-2])
+		vy0, vy1 = (y[1]-y[0])/(t[1]-t[0]), (y[n-1]-y[n-2])/(t[n-1]-t[n-2])
+	}
+	sx := newClampedSpline(t, x, vx0, vx1)
+	sy := newClampedSpline(t, y, vy0, vy1)
+
+	var resampled [][5]float64
+	sample := func(ti float64) [5]float64 {
+		xi, vx := sx.Eval(ti)
+		yi, vy := sy.Eval(ti)
+		if coordsys != "Horizon" {
+			if xi = math.Mod(xi, 360); xi < 0 {
+				xi += 360
+			}
+		}
+		return [5]float64{ti, xi, yi, vx, vy}
+	}
+	for i := 0; t[0]+float64(i)*interval < t[n-1]; i++ {
+		resampled = append(resampled, sample(t[0]+float64(i)*interval))
+	}
+	// end on the last point, at least half an interval after the one before
+	if k := len(resampled); k > 1 && t[n-1]-resampled[k-1][0] < interval/2 {
+		resampled = resampled[:k-1]
+	}
+	return append(resampled, sample(t[n-1]))
+}
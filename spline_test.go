@@ -0,0 +1,59 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestClampedSpline(t *testing.T) {
+	// cubics are reproduced exactly
+	f := func(t float64) (float64, float64) { return t*t*t - 2*t + 1, 3*t*t - 2 }
+	ts := []float64{0, 0.5, 2, 3, 4.5}
+	ys := make([]float64, len(ts))
+	for i := range ts {
+		ys[i], _ = f(ts[i])
+	}
+	_, v0 := f(ts[0])
+	_, v1 := f(ts[len(ts)-1])
+	s := newClampedSpline(ts, ys, v0, v1)
+	for x := 0.0; x <= 4.5; x += 0.1 {
+		y, dy := s.Eval(x)
+		expectedY, expectedDy := f(x)
+		if math.Abs(y-expectedY) > 1e-9 || math.Abs(dy-expectedDy) > 1e-9 {
+			t.Errorf("at %g: got %g %g, expected %g %g", x, y, dy, expectedY, expectedDy)
+		}
+	}
+}
+
+func TestSplinePath(t *testing.T) {
+	points := [][5]float64{
+		{0, 359, 10, 0.1, 0},
+		{10, 1, 11, 0, 0},
+		{20.03, 3, 10, 0.1, 0},
+	}
+	resampled := splinePath(points, "ICRS", 0.1, true)
+	if n := len(resampled); n != 201 {
+		t.Fatalf("got %d points, expected 201", n)
+	}
+	last := resampled[len(resampled)-1]
+	for i := range last {
+		if math.Abs(last[i]-points[2][i]) > 1e-9 {
+			t.Errorf("got last point %v, expected %v", last, points[2])
+			break
+		}
+	}
+	for i, p := range resampled {
+		if p[1] < 0 || p[1] >= 360 {
+			t.Errorf("point %d: longitude %g out of range", i, p[1])
+		}
+		if i > 0 {
+			if dt := p[0] - resampled[i-1][0]; dt < 0.05 {
+				t.Errorf("point %d: %g s after the one before", i, dt)
+			}
+			// crossing 0 smoothly, not back through 180
+			if dx := math.Abs(math.Remainder(p[1]-resampled[i-1][1], 360)); dx > 0.1 {
+				t.Errorf("point %d: jumped %g degrees", i, dx)
+			}
+		}
+	}
+}
@@ -0,0 +1,185 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// The startup and shutdown commands run the operators' checklists as
+// sequences of steps, reporting each step's progress in the command
+// record (see CommandRecord.Steps).
+
+// A commandStep is a step of a command. A nil start skips it.
+type commandStep struct {
+	name  string
+	start func(context.Context, *Telescope) (IsDoneFunc, error)
+}
+
+// instantStep is a step which is done once f returns.
+func instantStep(name string, f func(*Telescope) error) commandStep {
+	return commandStep{name, func(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+		err := f(tel)
+		return func(*Telescope) (bool, error) { return true, nil }, err
+	}}
+}
+
+// startSteps runs steps one after another, stopping at the first error.
+func startSteps(ctx context.Context, tel *Telescope, steps []commandStep) (IsDoneFunc, error) {
+	logger := commandLogger(ctx)
+	progress := commandSteps(ctx)
+	names := make([]string, len(steps))
+	for i, s := range steps {
+		names[i] = s.name
+	}
+	progress.Init(names)
+
+	i := -1
+	var isStepDone IsDoneFunc
+	failed := func(err error) error {
+		progress.Set(i, stepFailed, err)
+		return fmt.Errorf("%s: %w", steps[i].name, err)
+	}
+	// next starts the next step, returning true once they're all done
+	next := func(tel *Telescope) (bool, error) {
+		for i++; i < len(steps); i++ {
+			if steps[i].start == nil {
+				logger.Printf("step %d/%d: %s: skipped", i+1, len(steps), steps[i].name)
+				progress.Set(i, stepSkipped, nil)
+				continue
+			}
+			logger.Printf("step %d/%d: %s", i+1, len(steps), steps[i].name)
+			progress.Set(i, stepRunning, nil)
+			var err error
+			isStepDone, err = steps[i].start(ctx, tel)
+			if errors.Is(err, errUnconfirmed) {
+				// the ACU can't yet, see acuCapabilities
+				logger.Printf("step %d/%d: %s: skipped: %v", i+1, len(steps), steps[i].name, err)
+				progress.Set(i, stepSkipped, nil)
+				continue
+			}
+			if err != nil {
+				return true, failed(err)
+			}
+			return false, nil
+		}
+		return true, nil
+	}
+
+	done, err := next(tel)
+	if err != nil {
+		return nil, err
+	}
+	isDone := func(tel *Telescope) (bool, error) {
+		if done {
+			return true, nil
+		}
+		d, err := isStepDone(tel)
+		if err != nil {
+			return true, failed(err)
+		}
+		if !d {
+			return false, nil
+		}
+		progress.Set(i, stepDone, nil)
+		done, err = next(tel)
+		return done, err
+	}
+	return isDone, nil
+}
+
+// startRetractStowPins retracts the stow pins.
+func startRetractStowPins(tel *Telescope) (IsDoneFunc, error) {
+	err := tel.acu.StowPinsSet(false)
+	if err != nil {
+		return nil, err
+	}
+	pinsT := time.Now()
+	isDone := func(tel *Telescope) (bool, error) {
+		az, el, err := tel.acu.StowPinsGet()
+		if err != nil || (!az && !el) {
+			return true, err
+		}
+		if time.Since(pinsT) > stowPinsTimeout {
+			return true, fmt.Errorf("stow pins not retracted: azimuth=%v, elevation=%v", az, el)
+		}
+		return false, nil
+	}
+	return isDone, nil
+}
+
+// stowPinsStep is a step if the stow pins are in use, else skipped.
+func stowPinsStep(name string, start func(*Telescope) (IsDoneFunc, error)) commandStep {
+	if !stowPinsEnabled {
+		return commandStep{name: name}
+	}
+	return commandStep{name, func(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+		return start(tel)
+	}}
+}
+
+// A startupCmd gets the telescope ready to observe: it clears the ACU's
+// faults, enables the drives, retracts the stow pins, and drives to the
+// stow position.
+type startupCmd struct {
+	az, el float64
+}
+
+func newStartupCmd() startupCmd {
+	pos := currentConfig().StowPosition
+	return startupCmd{az: pos[0], el: pos[1]}
+}
+
+func (cmd startupCmd) Check() error {
+	return checkHardAzEl(cmd.az, cmd.el, 0, 0)
+}
+
+func (cmd startupCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	move := moveToCmd{Azimuth: cmd.az, Elevation: cmd.el, skipSunCheck: true}
+	return startSteps(ctx, tel, []commandStep{
+		instantStep("connect", func(tel *Telescope) error {
+			err := tel.UpdateStatus()
+			if err == nil {
+				err = tel.Ready()
+			}
+			return err
+		}),
+		instantStep("clear faults", func(tel *Telescope) error { return tel.acu.FailureReset() }),
+		instantStep("enable drives", func(tel *Telescope) error { return tel.acu.DrivesSet(true) }),
+		stowPinsStep("retract stow pins", startRetractStowPins),
+		{"go to park", move.Start},
+	})
+}
+
+// A shutdownCmd makes the telescope safe: it stops it, stows it, inserts
+// the stow pins, and disables the drives. With Abort, the current
+// command is aborted first.
+type shutdownCmd struct {
+	Abort bool `json:"abort"`
+
+	az, el float64
+}
+
+func newShutdownCmd() shutdownCmd {
+	pos := currentConfig().StowPosition
+	return shutdownCmd{az: pos[0], el: pos[1]}
+}
+
+func (cmd shutdownCmd) Check() error {
+	return checkHardAzEl(cmd.az, cmd.el, 0, 0)
+}
+
+func (cmd shutdownCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	// stowing is for safety, so ignore the Sun
+	move := moveToCmd{Azimuth: cmd.az, Elevation: cmd.el, skipSunCheck: true}
+	return startSteps(ctx, tel, []commandStep{
+		{"stop", abortCmd{}.Start},
+		{"stow", func(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+			closeShutterForStow(tel)
+			return move.Start(ctx, tel)
+		}},
+		stowPinsStep("insert stow pins", startInsertStowPins),
+		instantStep("disable drives", func(tel *Telescope) error { return tel.acu.DrivesSet(false) }),
+	})
+}
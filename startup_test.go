@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+)
+
+// runCommand runs cmd on the simulator until it's done.
+func runCommand(t *testing.T, cmd Command, tel *Telescope, now *time.Time, ct *CommandTracker, id string) error {
+	t.Helper()
+	ct.Add(id, commandName(cmd))
+	ctx := withCommandSteps(context.Background(), ct, id)
+	if err := tel.UpdateStatus(); err != nil {
+		t.Fatal(err)
+	}
+	isDone, err := cmd.Start(ctx, tel)
+	for i := 0; err == nil && i < 1000; i++ {
+		*now = now.Add(100 * time.Millisecond)
+		if err = tel.UpdateStatus(); err != nil {
+			break
+		}
+		var done bool
+		if done, err = isDone(tel); done {
+			return err
+		}
+	}
+	if err == nil {
+		t.Fatal("command not done")
+	}
+	return err
+}
+
+func stepStates(r CommandRecord) string {
+	var s []string
+	for _, step := range r.Steps {
+		s = append(s, step.Name+":"+step.State)
+	}
+	return fmt.Sprint(s)
+}
+
+func TestStartupShutdown(t *testing.T) {
+	_, acu, now := newTestSimulator(t, 100, 40)
+	tel := NewTelescope(acu)
+	ct := NewCommandTracker()
+
+	startup := startupCmd{az: 10, el: 80}
+	if err := runCommand(t, startup, tel, now, ct, "a"); err != nil {
+		t.Fatal(err)
+	}
+	r, _ := ct.Get("a")
+	// without the simulator's unconfirmed capabilities, as with the real ACU
+	expected := "[connect:done clear faults:done enable drives:skipped retract stow pins:skipped go to park:done]"
+	if s := stepStates(r); s != expected {
+		t.Errorf("startup: got steps %s, expected %s", s, expected)
+	}
+	rec := tel.Status()
+	if math.Abs(rec.AzimuthCurrentPosition-10) > 0.01 || math.Abs(rec.ElevationCurrentPosition-80) > 0.01 {
+		t.Errorf("startup: at %g,%g, expected 10,80", rec.AzimuthCurrentPosition, rec.ElevationCurrentPosition)
+	}
+
+	shutdown := shutdownCmd{az: 20, el: 85}
+	if err := runCommand(t, shutdown, tel, now, ct, "b"); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = ct.Get("b")
+	expected = "[stop:done stow:done insert stow pins:skipped disable drives:skipped]"
+	if s := stepStates(r); s != expected {
+		t.Errorf("shutdown: got steps %s, expected %s", s, expected)
+	}
+
+	acu.unconfirmed = true
+	if err := runCommand(t, startup, tel, now, ct, "c"); err != nil {
+		t.Fatal(err)
+	}
+	r, _ = ct.Get("c")
+	expected = "[connect:done clear faults:done enable drives:done retract stow pins:skipped go to park:done]"
+	if s := stepStates(r); s != expected {
+		t.Errorf("startup with the simulator: got steps %s, expected %s", s, expected)
+	}
+}
+
+func TestStepFailure(t *testing.T) {
+	ct := NewCommandTracker()
+	ct.Add("a", "test")
+	ctx := withCommandSteps(context.Background(), ct, "a")
+	isDone, err := startSteps(ctx, nil, []commandStep{
+		instantStep("one", func(*Telescope) error { return nil }),
+		instantStep("two", func(*Telescope) error { return fmt.Errorf("oops") }),
+		instantStep("three", func(*Telescope) error { return nil }),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	done, err := isDone(nil)
+	if !done || err == nil || err.Error() != "two: oops" {
+		t.Errorf("got %v %v, expected step two to fail", done, err)
+	}
+	r, _ := ct.Get("a")
+	if s := stepStates(r); s != "[one:done two:failed three:pending]" {
+		t.Errorf("got steps %s", s)
+	}
+}
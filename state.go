@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// how often the state file may be rewritten
+const stateMinInterval = 100 * time.Millisecond
+
+// TCSState is what the TCS is doing, saved so a restart can report
+// what was interrupted.
+type TCSState struct {
+	Time     time.Time             `json:"time"`
+	Shutdown string                `json:"shutdown,omitempty"` // the shutdown mode, after a clean shutdown
+	Current  *CommandRecord        `json:"current,omitempty"`  // running, or interrupted by the shutdown
+	Schedule []ScheduledEntry      `json:"schedule,omitempty"` // entries not yet dispatched
+	Offsets  map[string]AzElOffset `json:"offsets"`
+	Commands []CommandRecord       `json:"commands"`
+}
+
+// LoadState reads a state file, returning nil if there's none.
+func LoadState(filename string) (*TCSState, error) {
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var state TCSState
+	err = json.Unmarshal(b, &state)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	return &state, nil
+}
+
+// writeState writes the state to filename, replacing it atomically.
+func writeState(filename string, state *TCSState) error {
+	return writeJSONFile(filename, state)
+}
+
+// writeJSONFile writes v to filename as indented JSON, replacing it atomically.
+func writeJSONFile(filename string, v interface{}) error {
+	b, err := json.MarshalIndent(v, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(filename), filepath.Base(filename)+".*")
+	if err != nil {
+		return err
+	}
+	_, err = tmp.Write(append(b, '\n'))
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+	}
+	return err
+}
+
+// pendingEntries returns the schedule entries not yet dispatched.
+func pendingEntries(entries []ScheduledEntry) []ScheduledEntry {
+	var pending []ScheduledEntry
+	for _, e := range entries {
+		if e.State == schedulePending {
+			pending = append(pending, e)
+		}
+	}
+	return pending
+}
+
+// currentCommand returns the running command, with its arguments.
+func currentCommand(tracker *CommandTracker) *CommandRecord {
+	if r := tracker.Current(); r != nil {
+		if full, ok := tracker.Get(r.ID); ok {
+			return &full
+		}
+	}
+	return nil
+}
+
+// A StateStore saves the state whenever it changes.
+type StateStore struct {
+	filename string
+	snapshot func() *TCSState
+	dirty    chan struct{}
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func NewStateStore(filename string, snapshot func() *TCSState) *StateStore {
+	return &StateStore{
+		filename: filename,
+		snapshot: snapshot,
+		dirty:    make(chan struct{}, 1),
+	}
+}
+
+// Changed marks the state as changed. It doesn't block.
+func (s *StateStore) Changed() {
+	select {
+	case s.dirty <- struct{}{}:
+	default:
+	}
+}
+
+// Run saves the state on changes, at most every stateMinInterval.
+func (s *StateStore) Run() {
+	for range s.dirty {
+		s.mu.Lock()
+		if !s.closed {
+			err := s.write(s.snapshot())
+			if err != nil {
+				log.Print("state: ", err)
+			}
+		}
+		s.mu.Unlock()
+		time.Sleep(stateMinInterval)
+	}
+}
+
+func (s *StateStore) write(state *TCSState) error {
+	state.Time = time.Now()
+	return writeState(s.filename, state)
+}
+
+// Close saves the final state, after which changes are ignored.
+func (s *StateStore) Close(state *TCSState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	return s.write(state)
+}
+
+// reportPreviousState logs what the previous run was doing when it stopped.
+func reportPreviousState(state *TCSState) {
+	how := "crashed"
+	if state.Shutdown != "" {
+		how = "shut down (" + state.Shutdown + ")"
+	}
+	log.Printf("state: previous run %s, last saved %s", how, state.Time.UTC().Format(time.RFC3339))
+	if r := state.Current; r != nil {
+		var args bytes.Buffer
+		json.Compact(&args, r.Args)
+		log.Printf("state: interrupted command %s %s (%s), args %s", r.ID, r.Command, r.State, args.Bytes())
+	}
+	if n := len(state.Schedule); n > 0 {
+		log.Printf("state: %d schedule entries not dispatched, and not resumed", n)
+	}
+}
+
+// serveState serves the state saved by the previous run, or nil if there's
+// none.
+func serveState(prevState *TCSState) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		if prevState == nil {
+			err := fmt.Errorf("no previous state")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		err := json.NewEncoder(w).Encode(prevState)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
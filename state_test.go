@@ -0,0 +1,82 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestStateStore(t *testing.T) {
+	if checkShutdownMode(shutdownFinish) != nil || checkShutdownMode("later") == nil {
+		t.Error("checkShutdownMode")
+	}
+
+	filename := filepath.Join(t.TempDir(), "state.json")
+	if state, err := LoadState(filename); state != nil || err != nil {
+		t.Errorf("got %+v, %v, expected no state", state, err)
+	}
+
+	tracker := NewCommandTracker()
+	offsets := NewOffsets()
+	entries := []ScheduledEntry{
+		{ScheduleEntry: ScheduleEntry{Command: "/stow"}, State: scheduleDispatched},
+		{ScheduleEntry: ScheduleEntry{Command: "/move-to"}, State: schedulePending},
+	}
+	store := NewStateStore(filename, func() *TCSState {
+		return &TCSState{
+			Current:  currentCommand(tracker),
+			Schedule: pendingEntries(entries),
+			Offsets:  offsets.Get(),
+			Commands: tracker.List(),
+		}
+	})
+	tracker.OnChange(store.Changed)
+	offsets.OnChange(store.Changed)
+	go store.Run()
+
+	tracker.Add("1", "/azimuth-scan")
+	tracker.SetArgs("1", []byte(`{"elevation": 60}`))
+	tracker.Set("1", commandTracking, nil)
+	offsets.Set("user", AzElOffset{Az: 0.1})
+	var state *TCSState
+	for i := 0; i < 50; i++ {
+		time.Sleep(20 * time.Millisecond)
+		state, _ = LoadState(filename)
+		if state != nil && state.Current != nil && state.Current.State == commandTracking && state.Offsets["user"].Az == 0.1 {
+			break
+		}
+	}
+	var args bytes.Buffer
+	if state != nil && state.Current != nil {
+		json.Compact(&args, state.Current.Args)
+	}
+	if state == nil || state.Current == nil || state.Current.ID != "1" || args.String() != `{"elevation":60}` ||
+		len(state.Schedule) != 1 || state.Schedule[0].Command != "/move-to" || state.Shutdown != "" {
+		t.Fatalf("got %+v", state)
+	}
+
+	final := &TCSState{Shutdown: shutdownStop, Commands: tracker.List()}
+	err := store.Close(final)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tracker.Set("1", commandDone, nil)
+	time.Sleep(2 * stateMinInterval)
+	state, err = LoadState(filename)
+	if err != nil || state.Shutdown != shutdownStop {
+		t.Errorf("got %+v, %v, expected the final state", state, err)
+	}
+	if files, _ := filepath.Glob(filepath.Join(filepath.Dir(filename), "*")); len(files) != 1 {
+		t.Errorf("left temporary files: %v", files)
+	}
+
+	// the interrupted command is reported after a restart
+	restarted := NewCommandTracker()
+	restarted.Restore(state.Commands, time.Now())
+	r, ok := restarted.Get("1")
+	if !ok || r.State != commandAborted || r.Error == "" || restarted.Current() != nil {
+		t.Errorf("restored %+v", r)
+	}
+}
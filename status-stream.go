@@ -0,0 +1,478 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+const (
+	statusStreamMinRate    = 1.0  // [Hz]
+	statusStreamMaxRate    = 20.0 // [Hz]
+	statusStreamMaxClients = 16
+)
+
+// A StatusStream polls the ACU status for its subscribers,
+// each at their own rate, no faster than statusStreamMaxRate.
+type StatusStream struct {
+	acu      *ACU
+	tracker  *CommandTracker
+	alarms   *Alarms
+	timeSync *TimeSync
+	faults   *Faults
+	estop    *EmergencyStop
+	derating *Derating
+	tracking *TrackingErrors
+	hexapod  *Hexapod        // nil if none
+	weather  *WeatherStation // nil if none
+	pointing *Pointing
+
+	mu   sync.Mutex
+	subs map[*statusSub]bool
+	last time.Time // of the last sample
+}
+
+type statusSub struct {
+	interval time.Duration
+	last     time.Time
+	c        chan statusSample
+}
+
+// A statusSample is the ACU status, the current command if any,
+// the raised alarms, the active limits, the ACU link health, the clock
+// offsets, the decoded faults, the drive temperatures, the emergency
+// stop state, the tracking error, the hexapod state and latest weather
+// reading if any, and the derived boresight position and LST.
+type statusSample struct {
+	rec      datasets.StatusGeneral8100
+	command  *CommandRecord
+	alarms   []Alarm
+	limits   LimitsState
+	link     ACULinkStatus
+	timeSync TimeSyncStatus
+	faults   FaultsStatus
+	temps    TemperatureStatus
+	estop    EStopStatus
+	tracking TrackingErrorStatus
+	hexapod  *HexapodStatus
+	weather  *WeatherStatus
+
+	boresight *BoresightStatus
+	lst       *float64
+}
+
+// A BoresightStatus is where the telescope is pointing.
+type BoresightStatus struct {
+	Azimuth     float64 `json:"azimuth"`      // observed, i.e. without the pointing model [deg]
+	Elevation   float64 `json:"elevation"`    // [deg]
+	RA          float64 `json:"ra"`           // apparent, without refraction [deg]
+	Dec         float64 `json:"dec"`          // [deg]
+	ICRSRA      float64 `json:"icrs_ra"`      // astrometric [deg]
+	ICRSDec     float64 `json:"icrs_dec"`     // [deg]
+	GalacticL   float64 `json:"galactic_l"`   // [deg]
+	GalacticB   float64 `json:"galactic_b"`   // [deg]
+	SunDistance float64 `json:"sun_distance"` // [deg]
+}
+
+func NewStatusStream(acu *ACU, tracker *CommandTracker, alarms *Alarms, timeSync *TimeSync, faults *Faults, estop *EmergencyStop, derating *Derating, tracking *TrackingErrors, hexapod *Hexapod, pointing *Pointing) *StatusStream {
+	return &StatusStream{
+		acu:      acu,
+		tracker:  tracker,
+		alarms:   alarms,
+		timeSync: timeSync,
+		faults:   faults,
+		estop:    estop,
+		derating: derating,
+		tracking: tracking,
+		hexapod:  hexapod,
+		pointing: pointing,
+		subs:     make(map[*statusSub]bool),
+	}
+}
+
+// Subscribe returns a subscription at rate Hz.
+func (s *StatusStream) Subscribe(rate float64) (*statusSub, error) {
+	if rate < statusStreamMinRate || rate > statusStreamMaxRate {
+		return nil, rangeError("rate", statusStreamMinRate, statusStreamMaxRate,
+			"status rate (%g Hz) out of range [%g,%g]", rate, statusStreamMinRate, statusStreamMaxRate)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.subs) >= statusStreamMaxClients {
+		return nil, fmt.Errorf("too many status stream clients")
+	}
+	sub := &statusSub{
+		interval: Seconds2Duration(1 / rate),
+		c:        make(chan statusSample, 1),
+	}
+	s.subs[sub] = true
+	return sub, nil
+}
+
+func (s *StatusStream) Unsubscribe(sub *statusSub) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.subs, sub)
+}
+
+// LastSample returns the time of the last sample, zero if none.
+func (s *StatusStream) LastSample() time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.last
+}
+
+// due returns the subscriptions due a new record at time t.
+func (s *StatusStream) due(t time.Time) []*statusSub {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var due []*statusSub
+	for sub := range s.subs {
+		// allow some jitter in the ticker
+		if t.Sub(sub.last) > sub.interval*9/10 {
+			sub.last = t
+			due = append(due, sub)
+		}
+	}
+	return due
+}
+
+func (s *StatusStream) Run() {
+	ticker := time.NewTicker(Seconds2Duration(1 / statusStreamMaxRate))
+	defer ticker.Stop()
+	for t := range ticker.C {
+		due := s.due(t)
+		if len(due) == 0 {
+			continue
+		}
+		sample, err := s.Snapshot(t)
+		if err != nil {
+			log.Print("status stream: ", err)
+			continue
+		}
+		s.mu.Lock()
+		s.last = t
+		s.mu.Unlock()
+		for _, sub := range due {
+			select {
+			case sub.c <- sample:
+			default: // slow client, drop the record
+			}
+		}
+	}
+}
+
+// poll polls the ACU status at time t.
+func (s *StatusStream) poll(t time.Time) (statusSample, error) {
+	var sample statusSample
+	err := s.acu.StatusGeneral8100Get(&sample.rec)
+	if err != nil {
+		return sample, err
+	}
+	sample.command = s.tracker.Current()
+	sample.alarms = s.alarms.List()
+	sample.limits = siteSoftLimits.State()
+	sample.link = s.acu.Link()
+	sample.timeSync = s.timeSync.Status(t)
+	sample.faults = s.faults.Status()
+	sample.temps = s.derating.Status()
+	sample.estop = s.estop.Status()
+	sample.tracking = s.tracking.Status()
+	if s.hexapod != nil {
+		status := s.hexapod.Status()
+		sample.hexapod = &status
+	}
+	if s.weather != nil {
+		status := s.weather.Status(t)
+		sample.weather = &status
+	}
+	return sample, nil
+}
+
+// Snapshot polls the ACU status at time t, with the derived quantities.
+func (s *StatusStream) Snapshot(t time.Time) (statusSample, error) {
+	sample, err := s.poll(t)
+	if err != nil {
+		return sample, err
+	}
+	ut := Time2Unixtime(t)
+	lst, err := LST(ut)
+	if err != nil {
+		return sample, err
+	}
+	sample.lst = &lst
+
+	var b BoresightStatus
+	b.Azimuth, b.Elevation = s.pointing.Raw2Sky(sample.rec.AzimuthCurrentPosition, sample.rec.ElevationCurrentPosition)
+	el := siteAtmosphere.ObsEl2SkyEl(b.Elevation)
+	b.RA, b.Dec, err = AzEl2AppRADec(ut, b.Azimuth, el)
+	if err != nil {
+		return sample, err
+	}
+	b.ICRSRA, b.ICRSDec, err = AzEl2RADec(ut, b.Azimuth, el)
+	if err != nil {
+		return sample, err
+	}
+	b.GalacticL, b.GalacticB = ICRS2Galactic(b.ICRSRA, b.ICRSDec)
+	sunAz, sunEl, err := SunAzEl(t)
+	if err != nil {
+		return sample, err
+	}
+	b.SunDistance = angularSeparation(b.Azimuth, el, sunAz, sunEl)
+	sample.boresight = &b
+	return sample, nil
+}
+
+// pseudo-fields for the current command, raised alarms, active limits,
+// ACU link health, clock offsets, decoded faults, drive temperatures,
+// emergency stop state, tracking error, hexapod state, weather,
+// boresight position, and LST
+const (
+	statusCommandField   = "Command"
+	statusAlarmsField    = "Alarms"
+	statusLimitsField    = "Limits"
+	statusLinkField      = "Link"
+	statusTimeSyncField  = "TimeSync"
+	statusFaultsField    = "Faults"
+	statusTempsField     = "Temperatures"
+	statusEStopField     = "EmergencyStop"
+	statusTrackingField  = "TrackingError"
+	statusHexapodField   = "Hexapod"
+	statusWeatherField   = "Weather"
+	statusBoresightField = "Boresight"
+	statusLSTField       = "LST"
+)
+
+// statusFields checks a comma separated list of StatusGeneral8100 fields.
+func statusFields(list string) ([]string, error) {
+	if list == "" {
+		return nil, nil
+	}
+	t := reflect.TypeOf(datasets.StatusGeneral8100{})
+	fields := strings.Split(list, ",")
+	for _, f := range fields {
+		if _, ok := t.FieldByName(f); !ok && f != statusCommandField && f != statusAlarmsField && f != statusLimitsField && f != statusLinkField &&
+			f != statusTimeSyncField && f != statusFaultsField && f != statusTempsField &&
+			f != statusEStopField && f != statusTrackingField && f != statusHexapodField &&
+			f != statusWeatherField && f != statusBoresightField && f != statusLSTField {
+			return nil, &FieldError{Field: "fields", Reason: fmt.Sprintf("unknown status field %s", f)}
+		}
+	}
+	return fields, nil
+}
+
+// encodeStatus encodes the selected fields of the sample's status, or all
+// of them if fields is empty, with the Command, Alarms, Limits, Link, TimeSync,
+// Faults, Temperatures, EmergencyStop, TrackingError, Hexapod, Weather,
+// Boresight, and LST pseudo-fields.
+func encodeStatus(sample *statusSample, fields []string) ([]byte, error) {
+	rec := &sample.rec
+	sanitizeStatus(rec)
+	if len(fields) == 0 {
+		return json.Marshal(struct {
+			*datasets.StatusGeneral8100
+			Command       *CommandRecord `json:",omitempty"`
+			Alarms        []Alarm        `json:",omitempty"`
+			Limits        LimitsState
+			Link          ACULinkStatus
+			TimeSync      TimeSyncStatus
+			Faults        FaultsStatus
+			Temperatures  TemperatureStatus
+			EmergencyStop EStopStatus
+			TrackingError TrackingErrorStatus
+			Hexapod       *HexapodStatus   `json:",omitempty"`
+			Weather       *WeatherStatus   `json:",omitempty"`
+			Boresight     *BoresightStatus `json:",omitempty"`
+			LST           *float64         `json:",omitempty"`
+		}{rec, sample.command, sample.alarms, sample.limits, sample.link, sample.timeSync, sample.faults, sample.temps,
+			sample.estop, sample.tracking, sample.hexapod, sample.weather, sample.boresight, sample.lst})
+	}
+	v := reflect.ValueOf(rec).Elem()
+	m := make(map[string]interface{}, len(fields))
+	for _, f := range fields {
+		switch f {
+		case statusCommandField:
+			m[f] = sample.command
+			continue
+		case statusAlarmsField:
+			m[f] = sample.alarms
+			continue
+		case statusLimitsField:
+			m[f] = sample.limits
+			continue
+		case statusLinkField:
+			m[f] = sample.link
+			continue
+		case statusTimeSyncField:
+			m[f] = sample.timeSync
+			continue
+		case statusFaultsField:
+			m[f] = sample.faults
+			continue
+		case statusTempsField:
+			m[f] = sample.temps
+			continue
+		case statusEStopField:
+			m[f] = sample.estop
+			continue
+		case statusTrackingField:
+			m[f] = sample.tracking
+			continue
+		case statusHexapodField:
+			m[f] = sample.hexapod
+			continue
+		case statusWeatherField:
+			m[f] = sample.weather
+			continue
+		case statusBoresightField:
+			m[f] = sample.boresight
+			continue
+		case statusLSTField:
+			m[f] = sample.lst
+			continue
+		}
+		m[f] = v.FieldByName(f).Interface()
+	}
+	return json.Marshal(m)
+}
+
+// sanitizeStatus replaces the NaNs in rec, which encoding/json doesn't handle.
+func sanitizeStatus(rec *datasets.StatusGeneral8100) {
+	if math.IsNaN(rec.AzimuthCommandedPosition) {
+		rec.AzimuthCommandedPosition = -1e9
+	}
+	if math.IsNaN(rec.ElevationCommandedPosition) {
+		rec.ElevationCommandedPosition = -1e9
+	}
+}
+
+// serveStatus serves a snapshot of the status, with the derived quantities.
+func serveStatus(stream *StatusStream) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		fields, err := statusFields(req.URL.Query().Get("fields"))
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		sample, err := stream.Snapshot(time.Now())
+		if err != nil {
+			jsonResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		b, err := encodeStatus(&sample, fields)
+		if err != nil {
+			jsonResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(append(b, '\n'))
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// serveStatusStream streams stream's samples to a WebSocket client.
+func serveStatusStream(stream *StatusStream) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		fields, err := statusFields(req.URL.Query().Get("fields"))
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		rate := 10.
+		if s := req.URL.Query().Get("rate"); s != "" {
+			rate, err = strconv.ParseFloat(s, 64)
+			if err != nil {
+				jsonResponse(w, err, http.StatusBadRequest)
+				return
+			}
+		}
+		sub, err := stream.Subscribe(rate)
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		defer stream.Unsubscribe(sub)
+
+		conn, err := upgradeWebsocket(w, req)
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		done := make(chan struct{})
+		go conn.serveControl(done)
+
+		for {
+			select {
+			case <-done:
+				return
+			case sample := <-sub.c:
+				b, err := encodeStatus(&sample, fields)
+				if err == nil {
+					err = conn.WriteText(b)
+				}
+				if err != nil {
+					log.Print("status stream: ", err)
+					return
+				}
+			}
+		}
+	}
+}
+
+// serveACUStatus serves the ACU status, without the derived quantities.
+func serveACUStatus(stream *StatusStream) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+
+		fields, err := statusFields(req.URL.Query().Get("fields"))
+		if err != nil {
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+
+		var sample statusSample
+		err = stream.acu.StatusGeneral8100Get(&sample.rec)
+		if err != nil {
+			jsonResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		sample.command = stream.tracker.Current()
+		sample.alarms = stream.alarms.List()
+		sample.limits = siteSoftLimits.State()
+		sample.link = stream.acu.Link()
+		sample.timeSync = stream.timeSync.Status(time.Now())
+		sample.faults = stream.faults.Status()
+		sample.temps = stream.derating.Status()
+		sample.estop = stream.estop.Status()
+
+		b, err := encodeStatus(&sample, fields)
+		if err != nil {
+			jsonResponse(w, err, http.StatusInternalServerError)
+			return
+		}
+		_, err = w.Write(append(b, '\n'))
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+func TestStatusFields(t *testing.T) {
+	_, err := statusFields("AzimuthCurrentPosition,Bogus")
+	if err == nil {
+		t.Error("statusFields: expected error for unknown field")
+	}
+
+	fields, err := statusFields("AzimuthCurrentPosition,ElevationCurrentPosition")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample := statusSample{rec: datasets.StatusGeneral8100{AzimuthCurrentPosition: 120, ElevationCurrentPosition: 45}}
+	b, err := encodeStatus(&sample, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var m map[string]float64
+	err = json.Unmarshal(b, &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(m) != 2 || m["AzimuthCurrentPosition"] != 120 || m["ElevationCurrentPosition"] != 45 {
+		t.Errorf("encodeStatus: got %s", b)
+	}
+
+	fields, err = statusFields("Weather")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sample.weather = &WeatherStatus{Reading: WeatherReading{WindSpeed: 12}, Age: 150, Stale: true}
+	b, err = encodeStatus(&sample, fields)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var w struct{ Weather WeatherStatus }
+	err = json.Unmarshal(b, &w)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w.Weather.Reading.WindSpeed != 12 || w.Weather.Age != 150 || !w.Weather.Stale {
+		t.Errorf("encodeStatus: got %s", b)
+	}
+}
+
+func TestServeStatus(t *testing.T) {
+	_, acu, _ := newTestSimulator(t, 120, 45)
+	tracker, alarms := NewCommandTracker(), NewAlarms()
+	faults := &Faults{}
+	stream := NewStatusStream(acu, tracker, alarms, NewTimeSync(acu, "", alarms), faults, NewEmergencyStop(faults, alarms),
+		&Derating{}, NewTrackingErrors(tracker), nil, NewPointing())
+	tracker.Add("a", "/stow")
+	tracker.Set("a", commandStarted, nil)
+	h := serveStatus(stream)
+
+	w := httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/status?fields=Bogus", nil))
+	if w.Code != http.StatusBadRequest {
+		t.Errorf("unknown field: got %d", w.Code)
+	}
+
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/status?fields=AzimuthCurrentPosition,Boresight,LST,Command", nil))
+	var status struct {
+		AzimuthCurrentPosition float64
+		Boresight              *BoresightStatus
+		LST                    *float64
+		Command                *CommandRecord
+	}
+	err := json.Unmarshal(w.Body.Bytes(), &status)
+	if w.Code != http.StatusOK || err != nil {
+		t.Fatalf("got %d %s, %v", w.Code, w.Body, err)
+	}
+	b := status.Boresight
+	if status.AzimuthCurrentPosition != 120 || status.LST == nil || status.Command == nil || status.Command.ID != "a" ||
+		b == nil || math.Abs(b.Azimuth-120) > 1e-6 || math.Abs(b.Elevation-45) > 1e-6 {
+		t.Errorf("got %s", w.Body)
+	}
+
+	// all fields
+	w = httptest.NewRecorder()
+	h(w, httptest.NewRequest("GET", "/status", nil))
+	var all map[string]json.RawMessage
+	json.Unmarshal(w.Body.Bytes(), &all)
+	var boresight map[string]float64
+	json.Unmarshal(all["Boresight"], &boresight)
+	if _, ok := boresight["galactic_l"]; !ok || all["LST"] == nil || all["ElevationCurrentPosition"] == nil {
+		t.Errorf("got %s", w.Body)
+	}
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// whether to use the stow pins, set at startup, see applyConfig
+var stowPinsEnabled = false
+
+// how long to wait for the stow pins to move
+var stowPinsTimeout = 60 * time.Second
+
+// parseAzEl parses an "az,el" position in degrees.
+func parseAzEl(s string) ([2]float64, error) {
+	var pos [2]float64
+	fields := strings.Split(s, ",")
+	if len(fields) != 2 {
+		return pos, fmt.Errorf("bad position %q: expected az,el", s)
+	}
+	for i, f := range fields {
+		x, err := strconv.ParseFloat(strings.TrimSpace(f), 64)
+		if err != nil {
+			return pos, fmt.Errorf("bad position %q: %w", s, err)
+		}
+		pos[i] = x
+	}
+	return pos, checkHardAzEl(pos[0], pos[1], 0, 0)
+}
+
+// A stowCmd drives to the stow position and inserts the stow pins.
+type stowCmd struct {
+	az, el float64
+}
+
+func newStowCmd() stowCmd {
+	pos := currentConfig().StowPosition
+	return stowCmd{az: pos[0], el: pos[1]}
+}
+
+func (cmd stowCmd) Check() error {
+	return checkHardAzEl(cmd.az, cmd.el, 0, 0)
+}
+
+func (cmd stowCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	closeShutterForStow(tel)
+	// stowing is for safety, so ignore the Sun
+	move := moveToCmd{Azimuth: cmd.az, Elevation: cmd.el, skipSunCheck: true}
+	return startPark(ctx, tel, move)
+}
+
+// A maintenanceCmd drives to the maintenance position and inserts the stow pins.
+type maintenanceCmd struct {
+	az, el float64
+}
+
+func newMaintenanceCmd() maintenanceCmd {
+	pos := currentConfig().MaintenancePosition
+	return maintenanceCmd{az: pos[0], el: pos[1]}
+}
+
+func (cmd maintenanceCmd) Check() error {
+	return moveToCmd{Azimuth: cmd.az, Elevation: cmd.el}.Check()
+}
+
+func (cmd maintenanceCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	move := moveToCmd{Azimuth: cmd.az, Elevation: cmd.el}
+	return startPark(ctx, tel, move)
+}
+
+// startPark moves to a position and, if enabled, inserts the stow pins.
+func startPark(ctx context.Context, tel *Telescope, move moveToCmd) (IsDoneFunc, error) {
+	moveDone, err := startRetracted(ctx, tel, move.Start)
+	if err != nil {
+		return nil, err
+	}
+	if !stowPinsEnabled {
+		return moveDone, nil
+	}
+
+	var pinsDone IsDoneFunc
+	isDone := func(tel *Telescope) (bool, error) {
+		if pinsDone == nil {
+			done, err := moveDone(tel)
+			if !done || err != nil {
+				return done, err
+			}
+			pinsDone, err = startInsertStowPins(tel)
+			if err != nil {
+				return true, err
+			}
+			return false, nil
+		}
+		return pinsDone(tel)
+	}
+	return isDone, nil
+}
+
+// startInsertStowPins stops the telescope and inserts the stow pins.
+func startInsertStowPins(tel *Telescope) (IsDoneFunc, error) {
+	err := tel.Stop()
+	if err != nil {
+		return nil, err
+	}
+	log.Print("inserting stow pins")
+	err = tel.acu.StowPinsSet(true)
+	if errors.Is(err, errUnconfirmed) {
+		// parked all the same
+		log.Printf("stow pins not inserted: %v", err)
+		return func(*Telescope) (bool, error) { return true, nil }, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	pinsT := time.Now()
+	isDone := func(tel *Telescope) (bool, error) {
+		az, el, err := tel.acu.StowPinsGet()
+		if err != nil {
+			return true, err
+		}
+		if az && el {
+			log.Print("stow pins inserted")
+			return true, nil
+		}
+		if time.Since(pinsT) > stowPinsTimeout {
+			return true, fmt.Errorf("stow pins not inserted: azimuth=%v, elevation=%v", az, el)
+		}
+		return false, nil
+	}
+	return isDone, nil
+}
+
+// closeShutterForStow starts closing the shutter, if configured to.
+// Stowing is for safety, so it doesn't wait, or fail if it can't.
+func closeShutterForStow(tel *Telescope) {
+	if tel.shutter != nil && currentConfig().Shutter.CloseOnStow {
+		err := tel.shutter.Move(false)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
+
+// startRetracted retracts the stow pins, if in use and inserted, so the
+// telescope can move, and calls start once they're out, without waiting
+// for them.
+func startRetracted(ctx context.Context, tel *Telescope, start func(context.Context, *Telescope) (IsDoneFunc, error)) (IsDoneFunc, error) {
+	if !stowPinsEnabled {
+		return start(ctx, tel)
+	}
+	az, el, err := tel.acu.StowPinsGet()
+	if errors.Is(err, errUnconfirmed) {
+		// never inserted
+		return start(ctx, tel)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if !az && !el {
+		return start(ctx, tel)
+	}
+	log.Print("retracting stow pins")
+	pinsDone, err := startRetractStowPins(tel)
+	if err != nil {
+		return nil, err
+	}
+
+	var startDone IsDoneFunc
+	isDone := func(tel *Telescope) (bool, error) {
+		if startDone == nil {
+			done, err := pinsDone(tel)
+			if !done || err != nil {
+				return done, err
+			}
+			log.Print("stow pins retracted")
+			startDone, err = start(ctx, tel)
+			if err != nil {
+				return true, err
+			}
+			return false, nil
+		}
+		return startDone(tel)
+	}
+	return isDone, nil
+}
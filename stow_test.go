@@ -0,0 +1,107 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestParseAzEl(t *testing.T) {
+	pos, err := parseAzEl("180, 87.5")
+	if err != nil || pos != [2]float64{180, 87.5} {
+		t.Errorf("got %v, %v", pos, err)
+	}
+	for _, s := range []string{"", "180", "180,90,0", "north,90", "400,90"} {
+		if _, err := parseAzEl(s); err == nil {
+			t.Errorf("%q: expected error", s)
+		}
+	}
+}
+
+func TestStartRetractedFake(t *testing.T) {
+	defer func(x bool) { stowPinsEnabled = x }(stowPinsEnabled)
+	defer func(x time.Duration) { stowPinsTimeout = x }(stowPinsTimeout)
+	stowPinsEnabled = true
+	acu := newFakeACU(100, 40)
+	tel := NewTelescope(acu)
+	started := 0
+	start := func(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+		started++
+		return func(*Telescope) (bool, error) { return true, nil }, nil
+	}
+
+	// already retracted: started at once
+	if _, err := startRetracted(context.Background(), tel, start); err != nil || started != 1 {
+		t.Fatalf("started %d times, %v", started, err)
+	}
+
+	// started once the pins are out, without waiting for them
+	acu.pins, acu.stuck = [2]bool{true, true}, true
+	isDone, err := startRetracted(context.Background(), tel, start)
+	if err != nil || started != 1 {
+		t.Fatalf("started %d times, %v", started, err)
+	}
+	if done, err := isDone(tel); done || err != nil || started != 1 {
+		t.Fatalf("pins in: done %v, %v, started %d times", done, err, started)
+	}
+	acu.pins = [2]bool{false, false}
+	if done, err := isDone(tel); done || err != nil || started != 2 {
+		t.Fatalf("pins out: done %v, %v, started %d times", done, err, started)
+	}
+	if done, err := isDone(tel); !done || err != nil {
+		t.Errorf("not done: %v, %v", done, err)
+	}
+
+	// the pins don't come out
+	stowPinsTimeout = 10 * time.Millisecond
+	acu.pins = [2]bool{true, false}
+	isDone, err = startRetracted(context.Background(), tel, start)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if done, err := isDone(tel); !done || err == nil || started != 2 {
+		t.Errorf("stuck pins: done %v, %v, started %d times", done, err, started)
+	}
+}
+
+func TestStartParkFake(t *testing.T) {
+	defer func(x bool) { stowPinsEnabled = x }(stowPinsEnabled)
+	stowPinsEnabled = true
+	acu := newFakeACU(100, 40)
+	acu.stuck = true
+	tel := NewTelescope(acu)
+	tel.UpdateStatus()
+	isDone, err := startPark(context.Background(), tel, moveToCmd{Azimuth: 180, Elevation: 80, skipSunCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acu.arrive()
+	tel.UpdateStatus()
+	if done, err := isDone(tel); done || err != nil {
+		t.Fatalf("done on arriving: %v, %v", done, err)
+	}
+	// done only once the pins are in
+	if done, err := isDone(tel); done || err != nil {
+		t.Fatalf("done before the pins are in: %v, %v", done, err)
+	}
+	acu.pins = [2]bool{true, true}
+	if done, err := isDone(tel); !done || err != nil {
+		t.Errorf("not done with the pins in: %v, %v", done, err)
+	}
+
+	// without stow pins support, done once there
+	acu.noPins = true
+	isDone, err = startPark(context.Background(), tel, moveToCmd{Azimuth: 170, Elevation: 80, skipSunCheck: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	acu.arrive()
+	tel.UpdateStatus()
+	if done, err := isDone(tel); done || err != nil {
+		t.Fatalf("done on arriving: %v, %v", done, err)
+	}
+	if done, err := isDone(tel); !done || err != nil {
+		t.Errorf("not done without stow pins: %v, %v", done, err)
+	}
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	defaultSunAvoidanceRadius = 45.0 // [deg]
+
+	// how often to recompute the Sun's position when checking patterns;
+	// it moves about 0.04 deg in this time
+	sunCheckInterval = 10 * time.Second
+)
+
+// SunRADec returns the apparent RA/Dec of the Sun in degrees,
+// using the low precision formula from the Astronomical Almanac,
+// good to about 0.01 deg between 1950 and 2050.
+func SunRADec(unixtime float64) (float64, float64) {
+	n := unixtime/86400 + UNIX_JD_EPOCH - 2451545.0 // days since J2000.0
+	L := 280.460 + 0.9856474*n                      // mean longitude [deg]
+	g := deg2rad(357.528 + 0.9856003*n)             // mean anomaly
+	lambda := deg2rad(L + 1.915*math.Sin(g) + 0.020*math.Sin(2*g))
+	epsilon := deg2rad(23.439 - 0.0000004*n) // obliquity of the ecliptic
+	sl, cl := math.Sincos(lambda)
+	ra := math.Atan2(math.Cos(epsilon)*sl, cl)
+	dec := math.Asin(math.Sin(epsilon) * sl)
+	return math.Mod(rad2deg(ra)+360, 360), rad2deg(dec)
+}
+
+// SunAzEl returns the topocentric Az/El of the Sun in degrees.
+func SunAzEl(t time.Time) (float64, float64, error) {
+	ut := Time2Unixtime(t)
+	ra, dec := SunRADec(ut)
+	return RADec2AzEl(ut, ra, dec)
+}
+
+// angularSeparation returns the angle between two az/el positions [deg],
+// using the Vincenty formula.
+func angularSeparation(az1, el1, az2, el2 float64) float64 {
+	sd, cd := math.Sincos(deg2rad(az2 - az1))
+	s1, c1 := math.Sincos(deg2rad(el1))
+	s2, c2 := math.Sincos(deg2rad(el2))
+	num := math.Hypot(c2*sd, c1*s2-s1*c2*cd)
+	den := s1*s2 + c1*c2*cd
+	return rad2deg(math.Atan2(num, den))
+}
+
+// SunAvoidance keeps the telescope from pointing within a radius of the Sun.
+// It is safe for concurrent use.
+type SunAvoidance struct {
+	mu      sync.Mutex
+	enabled bool
+	radius  float64 // [deg]
+}
+
+var siteSunAvoidance = NewSunAvoidance()
+
+func NewSunAvoidance() *SunAvoidance {
+	return &SunAvoidance{
+		enabled: true,
+		radius:  defaultSunAvoidanceRadius,
+	}
+}
+
+// State returns whether sun avoidance is enabled, and the avoidance radius.
+func (sa *SunAvoidance) State() (bool, float64) {
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	return sa.enabled, sa.radius
+}
+
+// Set enables or disables sun avoidance, and sets the avoidance radius.
+func (sa *SunAvoidance) Set(enabled bool, radius float64) error {
+	if radius < 0 || radius > 90 {
+		return fmt.Errorf("bad sun avoidance radius: %g", radius)
+	}
+	sa.mu.Lock()
+	defer sa.mu.Unlock()
+	sa.enabled = enabled
+	sa.radius = radius
+	return nil
+}
+
+// A sunTracker caches the position of the Sun.
+type sunTracker struct {
+	t       time.Time
+	az, el  float64
+	enabled bool
+	radius  float64
+}
+
+func (sa *SunAvoidance) tracker() *sunTracker {
+	enabled, radius := sa.State()
+	return &sunTracker{enabled: enabled, radius: radius}
+}
+
+// check returns an error if az,el is within the avoidance radius of the Sun at time t.
+func (st *sunTracker) check(t time.Time, az, el float64) error {
+	if !st.enabled {
+		return nil
+	}
+	if dt := t.Sub(st.t); st.t.IsZero() || dt > sunCheckInterval || dt < -sunCheckInterval {
+		var err error
+		st.az, st.el, err = SunAzEl(t)
+		if err != nil {
+			return err
+		}
+		st.t = t
+	}
+	if sep := angularSeparation(az, el, st.az, st.el); sep < st.radius {
+		return fmt.Errorf("position (%g,%g) is %.1f deg from the Sun at %s, within the avoidance radius (%g deg)",
+			az, el, sep, t.Format(time.RFC3339), st.radius)
+	}
+	return nil
+}
+
+// CheckPosition checks a single position at time t.
+func (sa *SunAvoidance) CheckPosition(t time.Time, az, el float64) error {
+	return sa.tracker().check(t, az, el)
+}
+
+// CheckPattern checks every point of a pattern.
+func (sa *SunAvoidance) CheckPattern(pattern ScanPattern) error {
+	st := sa.tracker()
+	if !st.enabled {
+		return nil
+	}
+	iter := pattern.Iterator()
+	for i := 0; !pattern.Done(iter); i++ {
+		var x ScanPatternSample
+		err := pattern.Next(iter, &x)
+		if err != nil {
+			return fmt.Errorf("point %d: %w", i, err)
+		}
+		err = st.check(x.T, x.Az, x.El)
+		if err != nil {
+			return fmt.Errorf("point %d: %w", i, err)
+		}
+	}
+	return nil
+}
+
+// CheckMove checks the straight az/el path between two positions at time t.
+func (sa *SunAvoidance) CheckMove(t time.Time, az0, el0, az1, el1 float64) error {
+	st := sa.tracker()
+	const n = 100
+	for i := 0; i <= n; i++ {
+		f := float64(i) / n
+		err := st.check(t, az0+f*(az1-az0), el0+f*(el1-el0))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// serveSunAvoidance serves the sun avoidance settings, with the Sun's position.
+func serveSunAvoidance() http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Enabled bool    `json:"enabled"`
+				Radius  float64 `json:"radius"`
+				SunAz   float64 `json:"sun_azimuth"`
+				SunEl   float64 `json:"sun_elevation"`
+			}
+			response.Enabled, response.Radius = siteSunAvoidance.State()
+			var err error
+			response.SunAz, response.SunEl, err = SunAzEl(time.Now())
+			if err != nil {
+				jsonResponse(w, err, http.StatusInternalServerError)
+				return
+			}
+			err = json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Enabled bool    `json:"enabled"`
+				Radius  float64 `json:"radius"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil {
+				log.Printf("setting sun avoidance: %+v", x)
+				err = siteSunAvoidance.Set(x.Enabled, x.Radius)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	}
+}
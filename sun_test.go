@@ -0,0 +1,47 @@
+package main
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestSunRADec(t *testing.T) {
+	// vernal equinox 2023-03-20 21:24 UTC: RA, Dec ~ 0
+	t0 := time.Date(2023, 3, 20, 21, 24, 0, 0, time.UTC)
+	ra, dec := SunRADec(Time2Unixtime(t0))
+	ra = math.Mod(ra+180, 360) - 180
+	if math.Abs(ra) > 0.02 || math.Abs(dec) > 0.02 {
+		t.Errorf("equinox: got RA=%g Dec=%g", ra, dec)
+	}
+	// june solstice 2023-06-21 14:58 UTC: RA=90, Dec=+23.44
+	t1 := time.Date(2023, 6, 21, 14, 58, 0, 0, time.UTC)
+	ra, dec = SunRADec(Time2Unixtime(t1))
+	if math.Abs(ra-90) > 0.02 || math.Abs(dec-23.44) > 0.02 {
+		t.Errorf("solstice: got RA=%g Dec=%g", ra, dec)
+	}
+}
+
+func TestAngularSeparation(t *testing.T) {
+	tests := []struct {
+		az1, el1, az2, el2, sep float64
+	}{
+		{0, 0, 90, 0, 90},
+		{10, 30, 10, 70, 40},
+		{0, 90, 123, 45, 45},
+		{359, 0, 1, 0, 2},
+	}
+	for _, test := range tests {
+		sep := angularSeparation(test.az1, test.el1, test.az2, test.el2)
+		if math.Abs(sep-test.sep) > 1e-9 {
+			t.Errorf("%+v: got %g", test, sep)
+		}
+	}
+}
+
+// disableSunAvoidance keeps Check results independent of the time of day.
+func disableSunAvoidance(t *testing.T) {
+	enabled, radius := siteSunAvoidance.State()
+	siteSunAvoidance.Set(false, radius)
+	t.Cleanup(func() { siteSunAvoidance.Set(enabled, radius) })
+}
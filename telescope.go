@@ -2,8 +2,8 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
 	"math"
 	"os"
 	"time"
@@ -11,18 +11,48 @@ import (
 	"github.com/ccatobs/antenna-control-unit/datasets"
 )
 
+// ACUClient is the part of the ACU's interface that the Telescope and
+// the commands use. *ACU implements it; tests can use a fake instead
+// (see fakeACU).
+type ACUClient interface {
+	StatusGeneral8100Get(*datasets.StatusGeneral8100) error
+	DatasetGet(name string, d interface{}) error
+	ModeSet(mode string) error
+	AxisModeSet(axis, mode string) error
+	PresetPositionSet(azimuth, elevation float64) error
+	AxisPresetSet(axis string, position float64) error
+	ProgramTrackAdd([]datasets.TimePositionTransfer) error
+	ProgramTrackClear() error
+	PositionBroadcastEnable(host string, port int) error
+	ThirdAxisStatusGet(*thirdAxisStatus) error
+	ThirdAxisPresetSet(position float64) error
+	ThirdAxisStop() error
+	StowPinsGet() (bool, bool, error)
+	StowPinsSet(insert bool) error
+	FailureReset() error
+	DrivesSet(on bool) error
+}
+
 // Telescope provides a higher-level interface to the ACU.
 // Responsible for pointing corrections and coordinate transformations.
 type Telescope struct {
-	acu      *ACU
-	pointing Pointing
+	acu      ACUClient
+	pointing *Pointing
 	rec      datasets.StatusGeneral8100
+	pattern  *patternExec // pattern being executed, if any
+	shutter  *Shutter     // nil if none
+	hexapod  *Hexapod     // nil if none
+	flags    *ScanFlags   // of the patterns executed
 }
 
-func NewTelescope(acu *ACU) *Telescope {
+// the ACU status time is only trusted from this year on
+const minStatusTimeYear = 2025
+
+func NewTelescope(acu ACUClient) *Telescope {
 	return &Telescope{
 		acu:      acu,
 		pointing: NewPointing(),
+		flags:    NewScanFlags(),
 	}
 }
 
@@ -44,12 +74,10 @@ func (t Telescope) Ready() error {
 	if t.rec.Year == 0 {
 		return fmt.Errorf("can't contact ACU")
 	}
-	if t.rec.Year > 2024 {
-		y, d := statusTime(time.Now())
-		dy := t.rec.Year - y
-		dt := math.Abs(t.rec.Time-d) * 24 * 60 * 60
-		if dy != 0 || dt > 2 {
-			return fmt.Errorf("ACU & TCS clock mismatch: %d years, %g seconds", dy, dt)
+	if t.rec.Year >= minStatusTimeYear {
+		dt := StatusTime2Time(t.rec.Year, t.rec.Time).Sub(time.Now()).Seconds()
+		if math.Abs(dt) > 2 {
+			return fmt.Errorf("ACU & TCS clock mismatch: %.3f seconds", dt)
 		}
 	}
 	if !t.rec.Remote {
@@ -77,6 +105,31 @@ func (t Telescope) Stop() error {
 	return t.acu.ModeSet("Stop")
 }
 
+// Abort decelerates to a stop, stops any pattern upload, and clears
+// the program track stack. The telescope is stopped first, and even if
+// the upload doesn't stop. The rotator is stopped too, if the ACU
+// supports it.
+func (t *Telescope) Abort() error {
+	err := t.acu.ModeSet("Stop")
+	if rerr := t.acu.ThirdAxisStop(); err == nil && !errors.Is(rerr, errUnconfirmed) {
+		err = rerr
+	}
+	if t.pattern != nil {
+		uerr := t.pattern.stopUpload()
+		if uerr == nil {
+			t.pattern.flagger.end(time.Now())
+		}
+		t.pattern = nil
+		if uerr != nil {
+			return uerr
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return t.acu.ProgramTrackClear()
+}
+
 func (t Telescope) MoveTo(az, el float64) error {
 	// ICD Section 9.1: "Before commanding or setting up a new mode,
 	// it is best practice to set the antenna to Stop mode first."
@@ -94,8 +147,62 @@ func (t Telescope) MoveTo(az, el float64) error {
 	return t.acu.ModeSet("Preset")
 }
 
-// UploadScanPattern uploads a program track in batches.
-func (t Telescope) UploadScanPattern(ctx context.Context, pattern ScanPattern) error {
+// MoveAxisTo moves one axis, "azimuth" or "elevation", to its coordinate
+// of az,el, leaving the other axis in its current mode. The other
+// coordinate should be where that axis is, for the pointing correction.
+func (t Telescope) MoveAxisTo(axis string, az, el float64) error {
+	err := t.acu.AxisModeSet(axis, "Stop")
+	if err != nil {
+		return err
+	}
+	rawAz, rawEl, _, _ := t.pointing.Sky2Raw(az, el, 0, 0)
+	err = t.acu.AxisPresetSet(axis, [2]float64{rawAz, rawEl}[axisIndex(axis)])
+	if err != nil {
+		return err
+	}
+	return t.acu.AxisModeSet(axis, "Preset")
+}
+
+// Position returns the current observed az,el.
+func (t Telescope) Position() (float64, float64) {
+	return t.pointing.Raw2Sky(t.rec.AzimuthCurrentPosition, t.rec.ElevationCurrentPosition)
+}
+
+// setMode sets the mode of axis, "azimuth" or "elevation", or of both
+// axes if axis is "".
+func (t Telescope) setMode(axis, mode string) error {
+	if axis == "" {
+		return t.acu.ModeSet(mode)
+	}
+	return t.acu.AxisModeSet(axis, mode)
+}
+
+const (
+	// points are generated and uploaded this far ahead of time
+	uploadLookahead = 60 * time.Second
+
+	// keep at least this many program track stack positions free
+	programTrackStackWatermark = 100
+
+	// retry interval when the stack is above the watermark,
+	// or an upload failed
+	uploadRetryInterval = time.Second
+
+	// most points the ACU accepts in one upload (see capUploadSize)
+	maxProgramTrackUploadPoints = 1000
+
+	// times a failed upload is retried
+	uploadRetries = 3
+)
+
+// UploadScanPattern streams a program track to the ACU,
+// generating points just in time to stay uploadLookahead ahead.
+// The points fill the free stack positions, above the watermark, in
+// batches of up to maxProgramTrackUploadPoints. Each batch is recorded
+// in progress, and its segments flagged by flagger.
+func (t *Telescope) UploadScanPattern(ctx context.Context, pattern ScanPattern, progress *uploadProgress, flagger *scanFlagger) error {
+	logger := commandLogger(ctx)
+	t0 := time.Now()
 	iter := pattern.Iterator()
 	total := 0
 	samples := make([]ScanPatternSample, maxFreeProgramTrackStack)
@@ -105,22 +212,34 @@ func (t Telescope) UploadScanPattern(ctx context.Context, pattern ScanPattern) e
 	for {
 		err := t.acu.StatusGeneral8100Get(&status)
 		if err != nil {
-			log.Print("failed to get ACU status: ", err)
+			logger.Print("failed to get ACU status: ", err)
 			return err
 		}
-		nmax := int(status.QtyOfFreeProgramTrackStackPositions)
-		if nmax == 0 {
-			return fmt.Errorf("upload: ACU program track stack is full")
+		nmax := int(status.QtyOfFreeProgramTrackStackPositions) - programTrackStackWatermark
+		if nmax <= 0 {
+			logger.Printf("upload: ACU program track stack above watermark, waiting")
+			select {
+			case <-time.After(uploadRetryInterval):
+				continue
+			case <-ctx.Done():
+				logger.Print("upload: cancelled")
+				return nil
+			}
 		}
 
-		// upload batch
+		// upload points up to (and one past) the lookahead horizon
+		horizon := time.Now().Add(uploadLookahead)
 		n := 0
 		for !pattern.Done(iter) {
 			x := &samples[n]
 			err := pattern.Next(iter, x)
 			if err != nil {
-				log.Printf("pattern error: %v", err)
-				break
+				logger.Printf("pattern error: %v", err)
+				return err
+			}
+			err = checkSample(x)
+			if err != nil {
+				return err
 			}
 
 			rawAz, rawEl, rawVaz, rawVel := t.pointing.Sky2Raw(
@@ -129,7 +248,7 @@ func (t Telescope) UploadScanPattern(ctx context.Context, pattern ScanPattern) e
 				x.AzVel,
 				x.ElVel,
 			)
-			err = checkAzEl(rawAz, rawEl, rawVaz, rawVel)
+			err = checkHardAzEl(rawAz, rawEl, rawVaz, rawVel)
 			if err != nil {
 				return err
 			}
@@ -144,20 +263,35 @@ func (t Telescope) UploadScanPattern(ctx context.Context, pattern ScanPattern) e
 			pt.ElFlag = x.ElFlag
 
 			n++
-			if n == nmax {
+			if n == nmax || !x.T.Before(horizon) {
 				break
 			}
 		}
 
 		if n <= 0 {
-			return fmt.Errorf("upload: no points")
+			return fmt.Errorf("no points")
 		}
 
-		total += n
-		log.Printf("upload: adding %d points", n)
-		err = t.acu.ProgramTrackAdd(pts[:n])
-		if err != nil {
-			return err
+		logger.Printf("upload: adding %d points", n)
+		for i := 0; i < n; i += maxProgramTrackUploadPoints {
+			j := minInt(i+maxProgramTrackUploadPoints, n)
+			err = t.uploadBatch(ctx, pts[i:j])
+			if err == nil {
+				// recorded even if cancelled meanwhile, as the ACU has them
+				if total == 0 {
+					commandSteps(ctx).Latency(latencyFirstUpload, time.Since(t0))
+				}
+				total += j - i
+				progress.add(samples[j-1].T, j-i, j == n && pattern.Done(iter))
+				flagger.add(samples[i:j])
+			}
+			if ctx.Err() != nil {
+				logger.Print("upload: cancelled")
+				return nil
+			}
+			if err != nil {
+				return err
+			}
 		}
 
 		// send points to housekeeping
@@ -170,25 +304,61 @@ func (t Telescope) UploadScanPattern(ctx context.Context, pattern ScanPattern) e
 				Points: samples[:n],
 			})
 			if err != nil {
-				log.Printf("upload: %s", err)
+				logger.Printf("upload: %s", err)
 				// ignore error
 			}
 		}
 
 		if pattern.Done(iter) {
-			log.Printf("upload: done, %d points total", total)
+			flagger.end(samples[n-1].T)
+			logger.Printf("upload: done, %d points total", total)
 			return nil
 		}
 
-		// sleep until we can upload the next batch
+		// sleep until half the lookahead is used up
 		lastT := samples[n-1].T
-		wait := time.Until(lastT) / 2
-		log.Printf("upload: next batch in %.3g minutes", wait.Minutes())
+		wait := time.Until(lastT) - uploadLookahead/2
+		if wait < uploadRetryInterval {
+			wait = uploadRetryInterval
+		}
 		select {
 		case <-time.After(wait):
 		case <-ctx.Done():
-			log.Print("upload: cancelled")
+			logger.Print("upload: cancelled")
+			return nil
+		}
+	}
+}
+
+// uploadBatch adds pts to the program track stack, retrying if the
+// upload fails, unless the ACU rejected the points.
+func (t *Telescope) uploadBatch(ctx context.Context, pts []datasets.TimePositionTransfer) error {
+	for retry := 0; ; retry++ {
+		err := t.acu.ProgramTrackAdd(pts)
+		if err == nil {
+			tcsMetrics.uploads.Inc("ok")
+			tcsMetrics.uploadedPoints.Add(float64(len(pts)))
 			return nil
 		}
+		var unverified programTrackUnverified
+		if errors.As(err, &unverified) {
+			// the ACU likely has them; better a gap than duplicates
+			tcsMetrics.uploads.Inc("unverified")
+			tcsMetrics.uploadedPoints.Add(float64(len(pts)))
+			commandLogger(ctx).Printf("upload: %d points: %v", len(pts), err)
+			return nil
+		}
+		var rejected programTrackRejected
+		if errors.As(err, &rejected) || retry == uploadRetries {
+			tcsMetrics.uploads.Inc("failed")
+			return err
+		}
+		tcsMetrics.uploads.Inc("retried")
+		commandLogger(ctx).Printf("upload: %d points failed, retrying: %v", len(pts), err)
+		select {
+		case <-time.After(uploadRetryInterval):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
 	}
 }
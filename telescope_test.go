@@ -0,0 +1,390 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// fakeACU is an ACUClient which records what it's told, and reports
+// whatever status the test sets.
+type fakeACU struct {
+	status datasets.StatusGeneral8100
+	extra  datasets.StatusExtra8100
+	third  thirdAxisStatus
+	err    error // returned by every call, if set
+
+	modes   []string
+	stops   int // of the third axis
+	preset  [2]float64
+	points  []datasets.TimePositionTransfer
+	uploads []int   // points in each upload
+	addErrs []error // returned by the next uploads, before err
+	onAdd   func()  // called by each upload, if set
+	cleared int
+	pins    [2]bool // azimuth, elevation
+	stuck   bool    // the stow pins don't move
+	noPins  bool    // the stow pins aren't supported
+	drives  bool
+	resets  int
+}
+
+func newFakeACU(az, el float64) *fakeACU {
+	return &fakeACU{
+		status: datasets.StatusGeneral8100{
+			Year:                                2024,
+			AzimuthCurrentPosition:              az,
+			ElevationCurrentPosition:            el,
+			QtyOfFreeProgramTrackStackPositions: maxFreeProgramTrackStack,
+			Remote:                              true,
+		},
+		extra: datasets.StatusExtra8100{AzimuthProfilerActive: true, ElevationProfilerActive: true},
+	}
+}
+
+// arrive puts the fake at its preset position, in preset mode.
+func (a *fakeACU) arrive() {
+	a.status.AzimuthMode, a.status.ElevationMode = datasets.AzimuthModePreset, datasets.ElevationModePreset
+	a.status.AzimuthCurrentPosition, a.status.ElevationCurrentPosition = a.preset[0], a.preset[1]
+	a.status.AzimuthCommandedPosition, a.status.ElevationCommandedPosition = a.preset[0], a.preset[1]
+	a.status.AzimuthCurrentVelocity, a.status.ElevationCurrentVelocity = 0, 0
+}
+
+func (a *fakeACU) StatusGeneral8100Get(rec *datasets.StatusGeneral8100) error {
+	if a.err == nil {
+		*rec = a.status
+	}
+	return a.err
+}
+
+func (a *fakeACU) DatasetGet(name string, d interface{}) error {
+	if extra, ok := d.(*datasets.StatusExtra8100); ok && name == "StatusExtra8100" {
+		*extra = a.extra
+		return a.err
+	}
+	return fmt.Errorf("fakeACU: no dataset %s", name)
+}
+
+func (a *fakeACU) ModeSet(mode string) error {
+	a.modes = append(a.modes, mode)
+	return a.err
+}
+
+func (a *fakeACU) PresetPositionSet(az, el float64) error {
+	a.preset = [2]float64{az, el}
+	return a.err
+}
+
+func (a *fakeACU) AxisModeSet(axis, mode string) error {
+	a.modes = append(a.modes, axis+" "+mode)
+	return a.err
+}
+
+func (a *fakeACU) AxisPresetSet(axis string, position float64) error {
+	a.preset[axisIndex(axis)] = position
+	return a.err
+}
+
+func (a *fakeACU) ProgramTrackAdd(points []datasets.TimePositionTransfer) error {
+	a.uploads = append(a.uploads, len(points))
+	if a.onAdd != nil {
+		a.onAdd()
+	}
+	if len(a.addErrs) > 0 {
+		err := a.addErrs[0]
+		a.addErrs = a.addErrs[1:]
+		if _, ok := err.(programTrackUnverified); ok {
+			a.points = append(a.points, points...)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	a.points = append(a.points, points...)
+	return a.err
+}
+
+func (a *fakeACU) ProgramTrackClear() error {
+	a.points = nil
+	a.cleared++
+	return a.err
+}
+
+func (a *fakeACU) PositionBroadcastEnable(host string, port int) error {
+	return a.err
+}
+
+func (a *fakeACU) ThirdAxisStatusGet(status *thirdAxisStatus) error {
+	*status = a.third
+	return a.err
+}
+
+func (a *fakeACU) ThirdAxisPresetSet(position float64) error {
+	a.third.Mode = thirdAxisModePreset
+	a.third.CommandedPosition = position
+	return a.err
+}
+
+func (a *fakeACU) ThirdAxisStop() error {
+	a.third.Mode = thirdAxisModeStop
+	a.stops++
+	return a.err
+}
+
+func (a *fakeACU) StowPinsGet() (bool, bool, error) {
+	if a.noPins {
+		return false, false, errUnconfirmed
+	}
+	return a.pins[0], a.pins[1], a.err
+}
+
+func (a *fakeACU) StowPinsSet(insert bool) error {
+	if a.noPins {
+		return errUnconfirmed
+	}
+	if !a.stuck {
+		a.pins = [2]bool{insert, insert}
+	}
+	return a.err
+}
+
+func (a *fakeACU) FailureReset() error {
+	a.resets++
+	return a.err
+}
+
+func (a *fakeACU) DrivesSet(on bool) error {
+	a.drives = on
+	return a.err
+}
+
+func TestReady(t *testing.T) {
+	acu := newFakeACU(0, 90)
+	tel := NewTelescope(acu)
+	for _, tc := range []struct {
+		setup func()
+		err   string
+	}{
+		{func() {}, ""},
+		{func() { acu.status.Remote = false }, "not in remote mode"},
+		{func() { acu.extra.ElevationProfilerActive = false }, "elevation profiler not active"},
+		{func() { acu.err = fmt.Errorf("down") }, "can't contact ACU"},
+	} {
+		*acu = *newFakeACU(0, 90)
+		tc.setup()
+		tel.UpdateStatus()
+		err := tel.Ready()
+		if tc.err == "" && err != nil {
+			t.Errorf("got error %v", err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("got error %v, expected %q", err, tc.err)
+		}
+	}
+}
+
+func TestMoveToFake(t *testing.T) {
+	acu := newFakeACU(100, 40)
+	tel := NewTelescope(acu)
+	tel.UpdateStatus()
+	cmd := moveToCmd{Azimuth: 120, Elevation: 60, skipSunCheck: true}
+	isDone, err := cmd.Start(context.Background(), tel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(acu.modes); s != "[Stop Preset]" {
+		t.Errorf("got modes %s, expected [Stop Preset]", s)
+	}
+	rawAz, rawEl, _, _ := tel.pointing.Sky2Raw(120, 60, 0, 0)
+	if acu.preset != [2]float64{rawAz, rawEl} {
+		t.Errorf("got preset %v, expected %g,%g", acu.preset, rawAz, rawEl)
+	}
+
+	tel.UpdateStatus()
+	if done, err := isDone(tel); done || err != nil {
+		t.Fatalf("done before arriving: %v, %v", done, err)
+	}
+	acu.arrive()
+	tel.UpdateStatus()
+	if done, err := isDone(tel); !done || err != nil {
+		t.Errorf("not done after arriving: %v, %v", done, err)
+	}
+}
+
+func TestMoveAxisToFake(t *testing.T) {
+	acu := newFakeACU(100, 40)
+	tel := NewTelescope(acu)
+	tel.UpdateStatus()
+	cmd := moveToCmd{Elevation: 60, Axis: "elevation", skipSunCheck: true}
+	if err := cmd.Check(); err != nil {
+		t.Fatal(err)
+	}
+	isDone, err := cmd.Start(context.Background(), tel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(acu.modes); s != "[elevation Stop elevation Preset]" {
+		t.Errorf("got modes %s, expected [elevation Stop elevation Preset]", s)
+	}
+	az, _ := tel.Position()
+	_, rawEl, _, _ := tel.pointing.Sky2Raw(az, 60, 0, 0)
+	if acu.preset != [2]float64{0, rawEl} {
+		t.Errorf("got preset %v, expected 0,%g", acu.preset, rawEl)
+	}
+
+	tel.UpdateStatus()
+	if done, err := isDone(tel); done || err != nil {
+		t.Fatalf("done before arriving: %v, %v", done, err)
+	}
+	// azimuth is left alone
+	acu.status.ElevationMode = datasets.ElevationModePreset
+	acu.status.ElevationCurrentPosition, acu.status.ElevationCommandedPosition = rawEl, rawEl
+	tel.UpdateStatus()
+	if done, err := isDone(tel); !done || err != nil {
+		t.Errorf("not done after arriving: %v, %v", done, err)
+	}
+}
+
+func TestAbortFake(t *testing.T) {
+	acu := newFakeACU(100, 40)
+	acu.status.AzimuthCurrentVelocity = 2
+	tel := NewTelescope(acu)
+	tel.UpdateStatus()
+	isDone, err := abortCmd{}.Start(context.Background(), tel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := fmt.Sprint(acu.modes); s != "[Stop]" || acu.stops != 1 || acu.cleared != 1 {
+		t.Errorf("got modes %s, %d rotator stops, and %d clears, expected [Stop], 1, and 1", s, acu.stops, acu.cleared)
+	}
+	if done, _ := isDone(tel); done {
+		t.Error("done while moving")
+	}
+	acu.status.AzimuthCurrentVelocity = 0
+	tel.UpdateStatus()
+	if done, _ := isDone(tel); !done {
+		t.Error("not done once stopped")
+	}
+
+	// fails if the telescope doesn't stop
+	defer func(d time.Duration) { abortTimeout = d }(abortTimeout)
+	abortTimeout = 10 * time.Millisecond
+	acu.status.AzimuthCurrentVelocity = 2
+	tel.UpdateStatus()
+	isDone, err = abortCmd{}.Start(context.Background(), tel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(20 * time.Millisecond)
+	if done, err := isDone(tel); !done || err == nil {
+		t.Errorf("still moving: got %v, %v, expected a timeout", done, err)
+	}
+}
+
+func TestAbortRotatorFake(t *testing.T) {
+	acu := newFakeACU(100, 40)
+	tel := NewTelescope(acu)
+	tel.UpdateStatus()
+	isDone, err := rotatorCmd{Angle: 30}.Start(context.Background(), tel)
+	if err != nil {
+		t.Fatal(err)
+	}
+	acu.third.CurrentPosition, acu.third.CurrentVelocity = 10, rotatorSpeedMax
+	if done, err := isDone(tel); done || err != nil {
+		t.Fatalf("done while moving: %v, %v", done, err)
+	}
+
+	if err := tel.Abort(); err != nil {
+		t.Fatal(err)
+	}
+	if acu.stops != 1 || acu.third.Mode != thirdAxisModeStop {
+		t.Errorf("rotator not stopped: %d stops, mode %d", acu.stops, acu.third.Mode)
+	}
+	if done, err := isDone(tel); !done || err == nil {
+		t.Errorf("rotator move not ended by the abort: %v, %v", done, err)
+	}
+}
+
+func TestAbortStuckUpload(t *testing.T) {
+	defer func(d time.Duration) { uploadStopTimeout = d }(uploadStopTimeout)
+	uploadStopTimeout = 10 * time.Millisecond
+	acu := newFakeACU(100, 40)
+	tel := NewTelescope(acu)
+	stuck := func() *patternExec {
+		// its upload goroutine never exits
+		return &patternExec{tel: tel, cancel: func() {}, uploaded: make(chan struct{}), flagger: &scanFlagger{flags: NewScanFlags()}}
+	}
+
+	// the telescope is stopped anyway
+	tel.pattern = stuck()
+	if err := tel.Abort(); err == nil {
+		t.Error("abort: stuck upload not reported")
+	}
+	if s := fmt.Sprint(acu.modes); s != "[Stop]" {
+		t.Errorf("abort: got modes %s, expected [Stop]", s)
+	}
+	acu.modes = nil
+	if err := stuck().stop(); err == nil {
+		t.Error("stop: stuck upload not reported")
+	}
+	if s := fmt.Sprint(acu.modes); s != "[Stop]" {
+		t.Errorf("stop: got modes %s, expected [Stop]", s)
+	}
+}
+
+func TestUploadScanPatternBatches(t *testing.T) {
+	acu := newFakeACU(120, 60)
+	tel := NewTelescope(acu)
+	points := make([][5]float64, 2500)
+	for i := range points {
+		points[i] = [5]float64{float64(i) * 0.01, 120, 60, 0, 0}
+	}
+	pattern := NewPathScanPattern(time.Now().Add(time.Second), points, "Horizon", false)
+
+	// a failed upload is retried
+	acu.addErrs = []error{nil, errors.New("connection reset")}
+	progress := &uploadProgress{}
+	err := tel.UploadScanPattern(context.Background(), pattern, progress, &scanFlagger{flags: NewScanFlags()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(acu.uploads) != "[1000 1000 1000 500]" || len(acu.points) != 2500 {
+		t.Errorf("uploads %v, %d points", acu.uploads, len(acu.points))
+	}
+	if _, done := progress.get(); !done || progress.count() != 2500 {
+		t.Errorf("progress: %d points, done %v", progress.count(), done)
+	}
+
+	// a batch the ACU took is recorded, even if cancelled meanwhile
+	acu.points, acu.uploads = nil, nil
+	ctx, cancel := context.WithCancel(context.Background())
+	acu.onAdd = cancel
+	progress = &uploadProgress{}
+	err = tel.UploadScanPattern(ctx, pattern, progress, &scanFlagger{flags: NewScanFlags()})
+	acu.onAdd = nil
+	lastT, _ := progress.get()
+	if day, tod := VertexTime(lastT); err != nil || progress.count() != 1000 || len(acu.points) != 1000 ||
+		day != acu.points[999].Day || tod != acu.points[999].TimeOfDay {
+		t.Errorf("cancelled: got %v, progress %d points to %v, %d points uploaded", err, progress.count(), lastT, len(acu.points))
+	}
+
+	// nor if it was posted, but not verified
+	acu.points, acu.uploads = nil, nil
+	acu.addErrs = []error{programTrackUnverified{errACUDown}}
+	err = tel.UploadScanPattern(context.Background(), pattern, &uploadProgress{}, &scanFlagger{flags: NewScanFlags()})
+	if err != nil || len(acu.uploads) != 3 || len(acu.points) != 2500 {
+		t.Errorf("got %v, uploads %v, %d points", err, acu.uploads, len(acu.points))
+	}
+
+	// but not if the ACU rejected it
+	acu.points, acu.uploads = nil, nil
+	acu.addErrs = []error{programTrackRejected("ProgramTrackPositionFailure")}
+	err = tel.UploadScanPattern(context.Background(), pattern, &uploadProgress{}, &scanFlagger{flags: NewScanFlags()})
+	if err == nil || len(acu.uploads) != 1 {
+		t.Errorf("got %v, uploads %v", err, acu.uploads)
+	}
+}
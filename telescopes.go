@@ -0,0 +1,402 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Besides the main telescope, the TCS can run other ACUs, e.g. a
+// calibration antenna or a test stand, each with its own command
+// dispatcher, alarms, and status stream, under /telescopes/<name>/.
+// The axis limits, soft limits, and Sun avoidance are the main
+// telescope's. XXX:TBD per-telescope limits
+
+// TelescopeConfig configures an additional telescope.
+type TelescopeConfig struct {
+	Name          string      `json:"name"`
+	ACU           ACUAddress  `json:"acu"`
+	Simulator     bool        `json:"simulator"`      // simulate the ACU instead
+	StowPosition  *[2]float64 `json:"stow_position"`  // default the main telescope's
+	PointingModel string      `json:"pointing_model"` // file, if any
+}
+
+var telescopeNameRE = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]*$`)
+
+// LoadTelescopes reads a JSON list of additional telescopes.
+func LoadTelescopes(filename string) ([]TelescopeConfig, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	var configs []TelescopeConfig
+	dec := json.NewDecoder(f)
+	dec.DisallowUnknownFields()
+	err = dec.Decode(&configs)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", filename, err)
+	}
+	names := make(map[string]bool)
+	for _, c := range configs {
+		err = c.validate()
+		if err == nil && names[c.Name] {
+			err = fmt.Errorf("telescope %s: duplicate name", c.Name)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filename, err)
+		}
+		names[c.Name] = true
+	}
+	return configs, nil
+}
+
+func (c TelescopeConfig) validate() error {
+	if !telescopeNameRE.MatchString(c.Name) {
+		return fmt.Errorf("bad telescope name %q", c.Name)
+	}
+	if !c.Simulator && (c.ACU.Host == "" || c.ACU.Port == "" || c.ACU.AdminPort == "") {
+		return fmt.Errorf("telescope %s: acu host, port and admin_port required", c.Name)
+	}
+	if c.StowPosition != nil {
+		err := checkHardAzEl(c.StowPosition[0], c.StowPosition[1], 0, 0)
+		if err != nil {
+			return fmt.Errorf("telescope %s: stow_position: %w", c.Name, err)
+		}
+	}
+	return nil
+}
+
+// splitTelescopePath splits /telescopes/<name>/<endpoint> into the name
+// and /<endpoint>. Other paths are the main telescope's, with name "".
+func splitTelescopePath(path string) (string, string) {
+	const prefix = "/telescopes/"
+	if !strings.HasPrefix(path, prefix) {
+		return "", path
+	}
+	rest := strings.TrimPrefix(path, prefix)
+	i := strings.Index(rest, "/")
+	if i < 0 {
+		return rest, "/"
+	}
+	return rest[:i], rest[i:]
+}
+
+// listenLocal serves h on a local port, returning the port.
+func listenLocal(h http.Handler) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	go func() {
+		log.Fatal(http.Serve(l, h))
+	}()
+	return strconv.Itoa(l.Addr().(*net.TCPAddr).Port), nil
+}
+
+// An Instance is an additional telescope.
+type Instance struct {
+	config     TelescopeConfig
+	acu        *ACU
+	tel        *Telescope
+	tracker    *CommandTracker
+	alarms     *Alarms
+	estop      *EmergencyStop
+	stream     *StatusStream
+	dispatcher *Dispatcher
+	limiter    *CommandLimiter
+}
+
+// StartInstance connects to (or simulates) the telescope's ACU, and
+// starts its monitors and dispatcher.
+func StartInstance(c TelescopeConfig) (*Instance, error) {
+	stow := currentConfig().StowPosition
+	if c.StowPosition != nil {
+		stow = *c.StowPosition
+	}
+	c.StowPosition = &stow
+	addr := c.ACU
+	if c.Simulator {
+		sim := NewACUSimulator(stow[0], stow[1])
+		go sim.Run()
+		port, err := listenLocal(sim)
+		if err != nil {
+			return nil, err
+		}
+		addr = ACUAddress{Host: "127.0.0.1", Port: port, AdminPort: port}
+		log.Printf("telescope %s: simulating the ACU on port %s", c.Name, port)
+	}
+
+	inst := &Instance{
+		config:  c,
+		acu:     NewACU(addr.Host, addr.Port, addr.AdminPort),
+		tracker: NewCommandTracker(),
+		alarms:  NewAlarms(),
+		limiter: NewCommandLimiter(),
+	}
+	inst.acu.unconfirmed = c.Simulator
+	inst.tel = NewTelescope(inst.acu)
+	if c.PointingModel != "" {
+		m, err := LoadPointingModel(c.PointingModel)
+		if err != nil {
+			return nil, fmt.Errorf("telescope %s: %w", c.Name, err)
+		}
+		inst.tel.pointing.SetModel(m, c.PointingModel)
+	}
+
+	timeSync := NewTimeSync(inst.acu, "", inst.alarms)
+	go timeSync.Run()
+	motionParams := NewMotionParams(inst.acu, inst.alarms)
+	go motionParams.Run()
+	faults, derating := &Faults{}, &Derating{}
+	inst.estop = NewEmergencyStop(faults, inst.alarms)
+	trackingErrors := NewTrackingErrors(inst.tracker)
+	inst.stream = NewStatusStream(inst.acu, inst.tracker, inst.alarms, timeSync, faults, inst.estop, derating, trackingErrors, nil, inst.tel.pointing)
+	go inst.stream.Run()
+	go func() {
+		log.Fatal(trackingErrors.Run(inst.stream))
+	}()
+	go func() {
+		log.Fatal(NewAlarmMonitor(inst.acu, inst.alarms, inst.stream, faults, derating).Run())
+	}()
+	inst.dispatcher = NewDispatcher(c.Name, inst.tel, inst.tracker, inst.alarms, inst.estop, timeSync, motionParams)
+	go inst.dispatcher.Run()
+	return inst, nil
+}
+
+// decodeCommand decodes a command, for this telescope's stow position.
+func (inst *Instance) decodeCommand(endpoint string, r io.Reader) (Command, error) {
+	cmd, err := decodeCommand(endpoint, r)
+	if err != nil {
+		return nil, err
+	}
+	az, el := inst.config.StowPosition[0], inst.config.StowPosition[1]
+	switch c := cmd.(type) {
+	case stowCmd:
+		c.az, c.el = az, el
+		cmd = c
+	case startupCmd:
+		c.az, c.el = az, el
+		cmd = c
+	case shutdownCmd:
+		c.az, c.el = az, el
+		cmd = c
+	case maintenanceCmd:
+		return nil, fmt.Errorf("no maintenance position for telescope %s", inst.config.Name)
+	}
+	return cmd, nil
+}
+
+// Submit decodes, checks and queues a command, returning its ID, or an
+// error and the corresponding HTTP status code.
+func (inst *Instance) Submit(auth *Auth, p *Principal, endpoint string, body io.Reader) (string, int, error) {
+	args, err := readCommand(body)
+	if errors.Is(err, errTooLarge) {
+		return "", http.StatusRequestEntityTooLarge, err
+	}
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	t0 := time.Now()
+	cmd, err := inst.decodeCommand(endpoint, bytes.NewReader(args))
+	if errors.Is(err, errBadEndpoint) {
+		return "", http.StatusNotFound, err
+	}
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	decodeTime := time.Since(t0)
+	key, _ := commandIdempotencyKey(args) // checked by decodeCommand
+	if id, ok := inst.tracker.Lookup(clientName(p), key); ok {
+		return id, http.StatusOK, nil
+	}
+	t0 = time.Now()
+	err = cmd.Check()
+	if err != nil {
+		return "", http.StatusBadRequest, err
+	}
+	checkTime := time.Since(t0)
+	if isMotionCommand(cmd) {
+		err = auth.CheckLock(p)
+		if err != nil {
+			return "", http.StatusLocked, err
+		}
+	}
+	err = inst.limiter.Allow(p, endpoint, args, time.Now())
+	if err != nil {
+		return "", http.StatusTooManyRequests, err
+	}
+
+	metadata, _ := commandMetadata(args) // checked by decodeCommand
+	ifBusy, _ := commandIfBusy(args)
+	id, ok := inst.tracker.AddOnce(newCommandID(), endpoint, clientName(p), key)
+	if !ok {
+		return id, http.StatusOK, nil
+	}
+	inst.tracker.SetArgs(id, args)
+	inst.tracker.SetMetadata(id, metadata)
+	inst.tracker.SetLatency(id, latencyDecode, decodeTime)
+	inst.tracker.SetLatency(id, latencyCheck, checkTime)
+	q := queuedCommand{id, cmd}
+	if s, ok := cmd.(shutdownCmd); ok && s.Abort {
+		err = inst.dispatcher.Preempt(q)
+	} else {
+		err = inst.dispatcher.Submit(q, ifBusy)
+	}
+	if err != nil {
+		inst.tracker.Set(id, commandFailed, err)
+		return "", http.StatusServiceUnavailable, err
+	}
+	log.Printf("telescope %s: queued command %s: %s", inst.config.Name, id, endpoint)
+	return id, http.StatusOK, nil
+}
+
+// TelescopeSummary is an additional telescope, as listed by /telescopes.
+type TelescopeSummary struct {
+	Name    string         `json:"name"`
+	ACU     string         `json:"acu"`               // address
+	Command *CommandRecord `json:"command,omitempty"` // current
+	Alarms  int            `json:"alarms"`            // raised
+}
+
+func (inst *Instance) Summary() TelescopeSummary {
+	return TelescopeSummary{
+		Name:    inst.config.Name,
+		ACU:     inst.acu.Addr,
+		Command: inst.tracker.Current(),
+		Alarms:  len(inst.alarms.List()),
+	}
+}
+
+// Handler serves the telescope's API, under its /telescopes/<name> prefix.
+func (inst *Instance) Handler(auth *Auth) http.Handler {
+	mux := http.NewServeMux()
+	get := func(f func() interface{}) http.HandlerFunc {
+		return func(w http.ResponseWriter, req *http.Request) {
+			if req.Method != "GET" {
+				err := fmt.Errorf("method not GET")
+				jsonResponse(w, err, http.StatusMethodNotAllowed)
+				return
+			}
+			err := json.NewEncoder(w).Encode(f())
+			if err != nil {
+				log.Print(err)
+			}
+		}
+	}
+
+	mux.HandleFunc("/abort", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		// the command to abort is optional
+		var x struct {
+			ID string `json:"id"`
+		}
+		err := json.NewDecoder(req.Body).Decode(&x)
+		if err != nil && err != io.EOF { // an empty body aborts the current command
+			jsonResponse(w, err, http.StatusBadRequest)
+			return
+		}
+		err = nil
+		if x.ID != "" && !inst.dispatcher.AbortCommand(x.ID) {
+			err = fmt.Errorf("command %s not queued or running", x.ID)
+		} else if x.ID == "" && !inst.dispatcher.Abort() {
+			err = fmt.Errorf("nothing to abort")
+		}
+		jsonResponse(w, err, http.StatusConflict)
+	})
+
+	mux.HandleFunc("/emergency-stop", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			get(func() interface{} { return inst.estop.Status() })(w, req)
+			return
+		}
+		var x struct {
+			Reason string `json:"reason"`
+		}
+		json.NewDecoder(req.Body).Decode(&x) // the reason is optional
+		by := req.RemoteAddr
+		if p := principalFrom(req.Context()); p != nil {
+			by = p.Name
+		}
+		inst.estop.Engage(by, x.Reason)
+		log.Printf("telescope %s: software emergency stop by %s: %s", inst.config.Name, by, x.Reason)
+		err := inst.acu.EmergencyStop()
+		go inst.dispatcher.Abort()
+		jsonResponse(w, err, http.StatusInternalServerError)
+	})
+
+	mux.HandleFunc("/emergency-stop/release", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		jsonResponse(w, inst.estop.Release(), http.StatusConflict)
+	})
+
+	mux.HandleFunc("/acu/status/stream", serveStatusStream(inst.stream))
+	mux.HandleFunc("/status", serveStatus(inst.stream))
+
+	mux.HandleFunc("/alarms", get(func() interface{} { return inst.alarms.List() }))
+	mux.HandleFunc("/commands", get(func() interface{} { return inst.tracker.List() }))
+
+	mux.HandleFunc("/commands/", func(w http.ResponseWriter, req *http.Request) {
+		id := strings.TrimPrefix(req.URL.Path, "/commands/")
+		r, ok := inst.tracker.Get(id)
+		if !ok {
+			err := fmt.Errorf("unknown command %s", id)
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		get(func() interface{} { return r })(w, req)
+	})
+
+	mux.HandleFunc("/", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			commandResponse(w, "", err, http.StatusMethodNotAllowed)
+			return
+		}
+		id, statusCode, err := inst.Submit(auth, principalFrom(req.Context()), req.URL.Path, req.Body)
+		commandResponse(w, id, err, statusCode)
+	})
+
+	prefix := "/telescopes/" + inst.config.Name
+	return http.StripPrefix(prefix, mux)
+}
+
+// serveTelescopes serves the additional telescopes' APIs, and lists them.
+func serveTelescopes(mux *http.ServeMux, instances []*Instance, auth *Auth) {
+	for _, inst := range instances {
+		mux.Handle("/telescopes/"+inst.config.Name+"/", inst.Handler(auth))
+	}
+	mux.HandleFunc("/telescopes", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		list := make([]TelescopeSummary, len(instances))
+		for i, inst := range instances {
+			list[i] = inst.Summary()
+		}
+		err := json.NewEncoder(w).Encode(list)
+		if err != nil {
+			log.Print(err)
+		}
+	})
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestSplitTelescopePath(t *testing.T) {
+	for _, tc := range []struct {
+		path, name, endpoint string
+	}{
+		{"/stow", "", "/stow"},
+		{"/telescopes", "", "/telescopes"},
+		{"/telescopes/calib", "calib", "/"},
+		{"/telescopes/calib/stow", "calib", "/stow"},
+		{"/telescopes/calib/commands/x", "calib", "/commands/x"},
+	} {
+		name, endpoint := splitTelescopePath(tc.path)
+		if name != tc.name || endpoint != tc.endpoint {
+			t.Errorf("%s: got %q, %q, expected %q, %q", tc.path, name, endpoint, tc.name, tc.endpoint)
+		}
+	}
+}
+
+func TestLoadTelescopes(t *testing.T) {
+	filename := filepath.Join(t.TempDir(), "telescopes.json")
+	for _, tc := range []struct {
+		json, err string
+	}{
+		{`[{"name": "calib", "simulator": true, "stow_position": [0, 90]}]`, ""},
+		{`[{"name": "calib", "acu": {"host": "acu2", "port": "8100", "admin_port": "8080"}}]`, ""},
+		{`[{"name": "calib"}]`, "acu host, port and admin_port required"},
+		{`[{"name": "Calib/1", "simulator": true}]`, "bad telescope name"},
+		{`[{"name": "calib", "simulator": true}, {"name": "calib", "simulator": true}]`, "duplicate name"},
+		{`[{"name": "calib", "simulator": true, "stow_position": [0, 200]}]`, "stow_position"},
+		{`[{"name": "calib", "simulator": true, "bogus": 1}]`, "unknown field"},
+	} {
+		if err := os.WriteFile(filename, []byte(tc.json), 0600); err != nil {
+			t.Fatal(err)
+		}
+		_, err := LoadTelescopes(filename)
+		if tc.err == "" && err != nil {
+			t.Errorf("%s: %v", tc.json, err)
+		} else if tc.err != "" && (err == nil || !strings.Contains(err.Error(), tc.err)) {
+			t.Errorf("%s: got error %v, expected %q", tc.json, err, tc.err)
+		}
+	}
+}
+
+func TestInstanceStowPosition(t *testing.T) {
+	inst := &Instance{config: TelescopeConfig{Name: "calib", StowPosition: &[2]float64{0, 89}}}
+	cmd, err := inst.decodeCommand("/stow", strings.NewReader("{}"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if s := cmd.(stowCmd); s.az != 0 || s.el != 89 {
+		t.Errorf("stow: got %g,%g, expected 0,89", s.az, s.el)
+	}
+	if _, err := inst.decodeCommand("/maintenance", strings.NewReader("{}")); err == nil {
+		t.Error("maintenance: expected error")
+	}
+}
+
+func TestInstanceAbort(t *testing.T) {
+	d, _ := newTestDispatcher(t)
+	inst := &Instance{config: TelescopeConfig{Name: "calib"}, dispatcher: d}
+	h := inst.Handler(nil)
+	for _, tc := range []struct {
+		body string
+		code int
+	}{
+		{"", http.StatusConflict}, // nothing to abort
+		{`{"id": "x"}`, http.StatusConflict},
+		{`{"id": 42}`, http.StatusBadRequest},
+		{`{"id": "x"`, http.StatusBadRequest},
+	} {
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, httptest.NewRequest("POST", "/telescopes/calib/abort", strings.NewReader(tc.body)))
+		if w.Code != tc.code {
+			t.Errorf("%q: got status %d, expected %d: %s", tc.body, w.Code, tc.code, w.Body)
+		}
+	}
+}
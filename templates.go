@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A ScanTemplate is a named command with parameters, e.g. a nightly
+// field scan whose start time and elevation change. Any string in its
+// args which is exactly "$<param>" is replaced by the parameter's value.
+type ScanTemplate struct {
+	Name        string                   `json:"name"`
+	Description string                   `json:"description,omitempty"`
+	Command     string                   `json:"command"` // endpoint, e.g. "/raster-scan"
+	Args        json.RawMessage          `json:"args"`
+	Params      map[string]TemplateParam `json:"params,omitempty"`
+}
+
+// A TemplateParam is a template parameter, required unless it has a
+// default. Min and Max, if any, limit a numeric parameter.
+type TemplateParam struct {
+	Description string          `json:"description,omitempty"`
+	Default     json.RawMessage `json:"default,omitempty"`
+	Min         *float64        `json:"min,omitempty"`
+	Max         *float64        `json:"max,omitempty"`
+}
+
+func (p TemplateParam) check(name string, v interface{}) error {
+	if p.Min == nil && p.Max == nil {
+		return nil
+	}
+	n, ok := v.(json.Number)
+	if !ok {
+		return &FieldError{Field: name, Reason: "not a number"}
+	}
+	x, err := n.Float64()
+	if err != nil || !isFinite(x) {
+		return &FieldError{Field: name, Reason: "not a number"}
+	}
+	if p.Min != nil && x < *p.Min {
+		return &FieldError{Field: name, Reason: "out of range", msg: fmt.Sprintf("%s (%g) below %g", name, x, *p.Min)}
+	}
+	if p.Max != nil && x > *p.Max {
+		return &FieldError{Field: name, Reason: "out of range", msg: fmt.Sprintf("%s (%g) above %g", name, x, *p.Max)}
+	}
+	return nil
+}
+
+func (t ScanTemplate) check() error {
+	switch {
+	case strings.TrimSpace(t.Name) == "":
+		return &FieldError{Field: "name", Reason: "required"}
+	case t.Command == "/run-template":
+		return &FieldError{Field: "command", Reason: "a template can't run a template"}
+	case requiredRole("POST", t.Command) > roleObserver:
+		// /run-template only needs the observer role
+		return &FieldError{Field: "command", Reason: fmt.Sprintf("%s needs the %s role", t.Command, requiredRole("POST", t.Command))}
+	}
+	if _, err := newCommand(t.Command); err != nil {
+		return &FieldError{Field: "command", Reason: err.Error()}
+	}
+	args, err := decodeJSONNumbers(t.Args)
+	if err != nil {
+		return fmt.Errorf("%s: args: %w", t.Name, err)
+	}
+	if _, ok := args.(map[string]interface{}); !ok {
+		return &FieldError{Field: "args", Reason: "not an object"}
+	}
+	for name, p := range t.Params {
+		if p.Min != nil && p.Max != nil && *p.Min > *p.Max {
+			return fmt.Errorf("%s: param %s: min > max", t.Name, name)
+		}
+		if p.Default != nil {
+			v, err := decodeJSONNumbers(p.Default)
+			if err == nil {
+				err = p.check(name, v)
+			}
+			if err != nil {
+				return fmt.Errorf("%s: param %s default: %w", t.Name, name, err)
+			}
+		}
+	}
+	return templateRefs(args, func(name string) error {
+		if _, ok := t.Params[name]; !ok {
+			return fmt.Errorf("%s: undeclared param $%s", t.Name, name)
+		}
+		return nil
+	})
+}
+
+// Instantiate returns the template's command args with params
+// substituted, after checking them.
+func (t ScanTemplate) Instantiate(params map[string]json.RawMessage) ([]byte, error) {
+	values := make(map[string]interface{}, len(t.Params))
+	for name, b := range params {
+		p, ok := t.Params[name]
+		if !ok {
+			return nil, &FieldError{Field: name, Reason: fmt.Sprintf("unknown param for template %s", t.Name)}
+		}
+		v, err := decodeJSONNumbers(b)
+		if err == nil {
+			err = p.check(name, v)
+		}
+		if err != nil {
+			return nil, err
+		}
+		values[name] = v
+	}
+	for name, p := range t.Params {
+		if _, ok := values[name]; ok {
+			continue
+		}
+		if p.Default == nil {
+			return nil, &FieldError{Field: name, Reason: "required"}
+		}
+		values[name], _ = decodeJSONNumbers(p.Default) // checked by check
+	}
+
+	args, err := decodeJSONNumbers(t.Args)
+	if err != nil {
+		return nil, err
+	}
+	var subst func(v interface{}) interface{}
+	subst = func(v interface{}) interface{} {
+		switch x := v.(type) {
+		case string:
+			if name := strings.TrimPrefix(x, "$"); name != x {
+				return values[name]
+			}
+		case map[string]interface{}:
+			for k, y := range x {
+				x[k] = subst(y)
+			}
+		case []interface{}:
+			for i, y := range x {
+				x[i] = subst(y)
+			}
+		}
+		return v
+	}
+	return json.Marshal(subst(args))
+}
+
+// templateRefs calls f with the name of each "$<param>" in v.
+func templateRefs(v interface{}, f func(name string) error) error {
+	switch x := v.(type) {
+	case string:
+		if name := strings.TrimPrefix(x, "$"); name != x {
+			return f(name)
+		}
+	case map[string]interface{}:
+		for _, y := range x {
+			if err := templateRefs(y, f); err != nil {
+				return err
+			}
+		}
+	case []interface{}:
+		for _, y := range x {
+			if err := templateRefs(y, f); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// decodeJSONNumbers decodes b, keeping numbers exactly as given.
+func decodeJSONNumbers(b []byte) (interface{}, error) {
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var v interface{}
+	err := dec.Decode(&v)
+	return v, err
+}
+
+// A TemplateLibrary maps template names, in any case, to templates.
+// Changes are saved to its file, if any. It is safe for concurrent use.
+type TemplateLibrary struct {
+	mu        sync.Mutex
+	file      string
+	templates map[string]ScanTemplate // by lower case name
+}
+
+var siteTemplates = NewTemplateLibrary()
+
+func NewTemplateLibrary() *TemplateLibrary {
+	return &TemplateLibrary{templates: make(map[string]ScanTemplate)}
+}
+
+// Load replaces the library with the JSON list of templates in filename,
+// and saves later changes there. A missing file is created by the first
+// change.
+func (l *TemplateLibrary) Load(filename string) error {
+	b, err := os.ReadFile(filename)
+	if os.IsNotExist(err) {
+		l.mu.Lock()
+		defer l.mu.Unlock()
+		l.file = filename
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var list []ScanTemplate
+	err = json.Unmarshal(b, &list)
+	if err != nil {
+		return fmt.Errorf("%s: %w", filename, err)
+	}
+	templates := make(map[string]ScanTemplate, len(list))
+	for _, t := range list {
+		if err := t.check(); err != nil {
+			return fmt.Errorf("%s: %w", filename, err)
+		}
+		templates[strings.ToLower(t.Name)] = t
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.file, l.templates = filename, templates
+	return nil
+}
+
+func (l *TemplateLibrary) Get(name string) (ScanTemplate, bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	t, ok := l.templates[strings.ToLower(name)]
+	return t, ok
+}
+
+// List returns the templates, by name.
+func (l *TemplateLibrary) List() []ScanTemplate {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	return l.list()
+}
+
+func (l *TemplateLibrary) list() []ScanTemplate {
+	list := make([]ScanTemplate, 0, len(l.templates))
+	for _, t := range l.templates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name) })
+	return list
+}
+
+// Set adds or replaces a template.
+func (l *TemplateLibrary) Set(t ScanTemplate) error {
+	err := t.check()
+	if err != nil {
+		return err
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.templates[strings.ToLower(t.Name)] = t
+	return l.save()
+}
+
+// Delete removes a template.
+func (l *TemplateLibrary) Delete(name string) error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	key := strings.ToLower(name)
+	if _, ok := l.templates[key]; !ok {
+		return fmt.Errorf("unknown template %s", name)
+	}
+	delete(l.templates, key)
+	return l.save()
+}
+
+// save writes the library to its file, if any.
+func (l *TemplateLibrary) save() error {
+	if l.file == "" {
+		return nil
+	}
+	return writeJSONFile(l.file, l.list())
+}
+
+// A runTemplateCmd runs the command of a template in siteTemplates,
+// with params substituted. decodeCommand returns that command, so
+// a runTemplateCmd is never queued itself.
+type runTemplateCmd struct {
+	Name    string                     `json:"name"`
+	Params  map[string]json.RawMessage `json:"params"`
+	Command Command                    `json:"-"`
+}
+
+func (cmd *runTemplateCmd) UnmarshalJSON(b []byte) error {
+	var x struct {
+		Name   string                     `json:"name"`
+		Params map[string]json.RawMessage `json:"params"`
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.DisallowUnknownFields()
+	err := dec.Decode(&x)
+	if err != nil {
+		return err
+	}
+	t, ok := siteTemplates.Get(x.Name)
+	if !ok {
+		return &FieldError{Field: "name", Reason: fmt.Sprintf("unknown template %s", x.Name)}
+	}
+	args, err := t.Instantiate(x.Params)
+	if err != nil {
+		return fmt.Errorf("template %s: %w", t.Name, err)
+	}
+	c, err := decodeCommand(t.Command, bytes.NewReader(args))
+	if err != nil {
+		return fmt.Errorf("template %s: %w", t.Name, err)
+	}
+	cmd.Name, cmd.Params, cmd.Command = x.Name, x.Params, c
+	return nil
+}
+
+func (cmd runTemplateCmd) Check() error {
+	return cmd.Command.Check()
+}
+
+func (cmd runTemplateCmd) Start(ctx context.Context, tel *Telescope) (IsDoneFunc, error) {
+	return cmd.Command.Start(ctx, tel)
+}
+
+// serveTemplates serves the site scan templates.
+func serveTemplates(mux *http.ServeMux) {
+	mux.HandleFunc("/templates", func(w http.ResponseWriter, req *http.Request) {
+		switch req.Method {
+		case "GET":
+			var v interface{} = siteTemplates.List()
+			if name := req.URL.Query().Get("name"); name != "" {
+				t, ok := siteTemplates.Get(name)
+				if !ok {
+					err := fmt.Errorf("unknown template %s", name)
+					jsonResponse(w, err, http.StatusNotFound)
+					return
+				}
+				v = t
+			}
+			err := json.NewEncoder(w).Encode(v)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var t ScanTemplate
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&t)
+			if err == nil {
+				log.Printf("setting template %s: %s %s", t.Name, t.Command, t.Args)
+				err = siteTemplates.Set(t)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	})
+
+	mux.HandleFunc("/templates/delete", func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "POST" {
+			err := fmt.Errorf("method not POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		var x struct {
+			Name string `json:"name"`
+		}
+		dec := json.NewDecoder(req.Body)
+		dec.DisallowUnknownFields()
+		err := dec.Decode(&x)
+		if err == nil {
+			log.Printf("deleting template %s", x.Name)
+			err = siteTemplates.Delete(x.Name)
+		}
+		jsonResponse(w, err, http.StatusBadRequest)
+	})
+}
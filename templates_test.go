@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTemplates(t *testing.T) {
+	defer func(l *TemplateLibrary) { siteTemplates = l }(siteTemplates)
+	siteTemplates = NewTemplateLibrary()
+	filename := filepath.Join(t.TempDir(), "templates.json")
+	if err := siteTemplates.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+
+	min, max := 30., 70.
+	tmpl := ScanTemplate{
+		Name:    "deep56_ces",
+		Command: "/azimuth-scan",
+		Args:    json.RawMessage(`{"azimuth_range": [110, 130], "elevation": "$el", "num_scans": "$n", "start_time": "$start", "turnaround_time": 5, "speed": 0.8}`),
+		Params: map[string]TemplateParam{
+			"el":    {Min: &min, Max: &max},
+			"n":     {Default: json.RawMessage(`20`)},
+			"start": {},
+		},
+	}
+	if err := siteTemplates.Set(tmpl); err != nil {
+		t.Fatal(err)
+	}
+	for _, bad := range []ScanTemplate{
+		{Name: "", Command: "/move-to", Args: json.RawMessage(`{}`)},
+		{Name: "x", Command: "/bogus", Args: json.RawMessage(`{}`)},
+		{Name: "x", Command: "/run-template", Args: json.RawMessage(`{}`)},
+		{Name: "x", Command: "/stow", Args: json.RawMessage(`{}`)},
+		{Name: "x", Command: "/move-to", Args: json.RawMessage(`[]`)},
+		{Name: "x", Command: "/move-to", Args: json.RawMessage(`{"azimuth": "$az"}`)},
+		{Name: "x", Command: "/move-to", Args: json.RawMessage(`{"azimuth": "$az"}`),
+			Params: map[string]TemplateParam{"az": {Min: &max, Max: &min}}},
+		{Name: "x", Command: "/move-to", Args: json.RawMessage(`{"azimuth": "$az"}`),
+			Params: map[string]TemplateParam{"az": {Min: &min, Default: json.RawMessage(`10`)}}},
+	} {
+		if err := siteTemplates.Set(bad); err == nil {
+			t.Errorf("bad template accepted: %+v", bad)
+		}
+	}
+
+	cmd, err := decodeCommand("/run-template", strings.NewReader(`{"name": "DEEP56_CES", "params": {"el": 45.5, "start": 0}}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	scan, ok := cmd.(azScanCmd)
+	if !ok || scan.Elevation != 45.5 || scan.NumScans != 20 || scan.StartTime != 0 || scan.Speed != 0.8 {
+		t.Errorf("got %#v", cmd)
+	}
+	for _, bad := range []string{
+		`{"name": "bogus", "params": {}}`,
+		`{"name": "deep56_ces", "params": {"el": 45}}`,
+		`{"name": "deep56_ces", "params": {"el": 80, "start": 0}}`,
+		`{"name": "deep56_ces", "params": {"el": "high", "start": 0}}`,
+		`{"name": "deep56_ces", "params": {"el": 45, "start": 0, "az": 120}}`,
+		`{"name": "deep56_ces", "params": {"el": 45, "start": "now"}}`,
+	} {
+		if _, err := decodeCommand("/run-template", strings.NewReader(bad)); err == nil {
+			t.Errorf("%s: expected an error", bad)
+		}
+	}
+
+	// the changes are saved
+	l := NewTemplateLibrary()
+	if err := l.Load(filename); err != nil {
+		t.Fatal(err)
+	}
+	if x, ok := l.Get("deep56_ces"); !ok || x.Command != tmpl.Command || len(x.Params) != 3 {
+		t.Errorf("got %+v, %v", x, ok)
+	}
+	if err := l.Delete("deep56_ces"); err != nil || len(l.List()) != 0 {
+		t.Errorf("delete: got %v, %d templates", err, len(l.List()))
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Tiltmeters on the alidade measure the tilt of the azimuth axis, which
+// drifts with the thermal load on the mount. The pointing model's AN and
+// AW terms hold the tilt when it was fit (see TiltConfig.Reference); the
+// tilt correction adds the measured change from that, in real time.
+
+const (
+	tiltPollInterval = 1 * time.Second
+	tiltStaleAge     = 30 * time.Second // the correction is dropped after this
+	tiltDataset      = "Tiltmeter"      // archived readings, see tiltRecord
+)
+
+// TiltConfig sets how the tiltmeter readings become a correction.
+type TiltConfig struct {
+	Orientation   float64    `json:"orientation"`    // azimuth of the sensor x axis at azimuth 0 [deg]
+	Reference     [2]float64 `json:"reference"`      // north, west tilt in the pointing model [arcsec]
+	MaxCorrection float64    `json:"max_correction"` // larger corrections aren't applied [arcsec]
+}
+
+// A TiltReading is a measurement from the tiltmeter, in the sensor's
+// frame on the alidade: x toward its orientation, y 90 degrees
+// counterclockwise from x (i.e. toward the west when x points north).
+type TiltReading struct {
+	Time        time.Time `json:"time"`
+	X           float64   `json:"x"`           // [arcsec]
+	Y           float64   `json:"y"`           // [arcsec]
+	Temperature float64   `json:"temperature"` // deg C
+}
+
+// a TiltReading as archived, with the azimuth when read
+type tiltRecord struct {
+	X, Y, Temperature float64
+	Azimuth           float64
+}
+
+// TiltStatus is the latest tiltmeter reading, the azimuth axis tilt it
+// gives, and the correction applied.
+type TiltStatus struct {
+	Reading    TiltReading `json:"reading"`
+	Azimuth    float64     `json:"azimuth"`    // when read [deg]
+	Tilt       [2]float64  `json:"tilt"`       // north, west [arcsec]
+	Correction [2]float64  `json:"correction"` // applied, north, west [arcsec]
+	Enabled    bool        `json:"enabled"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// axisTilt rotates a reading at azimuth az into the north and west tilt
+// of the azimuth axis, for a sensor x axis at orientation degrees.
+func axisTilt(r TiltReading, az, orientation float64) (float64, float64) {
+	s, c := math.Sincos(deg2rad(az + orientation))
+	return r.X*c + r.Y*s, r.Y*c - r.X*s
+}
+
+// A Tiltmeter polls the tiltmeter over HTTP, archiving its readings and
+// applying the tilt correction to the pointing while enabled. The
+// tiltmeter should return a JSON TiltReading.
+// It is safe for concurrent use.
+type Tiltmeter struct {
+	url      string
+	client   *http.Client
+	pointing *Pointing
+	archive  *Archive // nil if none
+	alarms   *Alarms
+	azimuth  func() (float64, error)
+
+	mu      sync.Mutex
+	enabled bool
+	status  TiltStatus
+	err     error
+}
+
+// NewTiltmeter returns a Tiltmeter reading the telescope azimuth, for the
+// sensor orientation, from azimuth.
+func NewTiltmeter(url string, pointing *Pointing, archive *Archive, alarms *Alarms, azimuth func() (float64, error)) *Tiltmeter {
+	return &Tiltmeter{
+		url: url,
+		client: &http.Client{
+			Timeout: 2 * time.Second,
+		},
+		pointing: pointing,
+		archive:  archive,
+		alarms:   alarms,
+		azimuth:  azimuth,
+		err:      fmt.Errorf("no tiltmeter readings yet"),
+	}
+}
+
+// Run polls the tiltmeter forever.
+func (tm *Tiltmeter) Run() {
+	for {
+		tm.poll()
+		tm.update(time.Now())
+		time.Sleep(tiltPollInterval)
+	}
+}
+
+func (tm *Tiltmeter) poll() {
+	reading, err := tm.fetch()
+	var az float64
+	if err == nil {
+		az, err = tm.azimuth()
+	}
+	if err == nil && tm.archive != nil {
+		var b bytes.Buffer
+		binary.Write(&b, binary.LittleEndian, tiltRecord{reading.X, reading.Y, reading.Temperature, az})
+		tm.archive.Add(tiltDataset, reading.Time, b.Bytes())
+	}
+
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	tm.err = err
+	if err != nil {
+		log.Printf("tiltmeter: %v", err)
+		return
+	}
+	north, west := axisTilt(reading, az, currentConfig().Tilt.Orientation)
+	tm.status.Reading, tm.status.Azimuth, tm.status.Tilt = reading, az, [2]float64{north, west}
+}
+
+func (tm *Tiltmeter) fetch() (TiltReading, error) {
+	var reading TiltReading
+	resp, err := tm.client.Get(tm.url)
+	if err != nil {
+		return reading, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reading, fmt.Errorf(resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reading)
+	if err != nil {
+		return reading, err
+	}
+	if !isFinite(reading.X) || !isFinite(reading.Y) {
+		return reading, fmt.Errorf("tilt not finite")
+	}
+	if reading.Time.IsZero() {
+		reading.Time = time.Now()
+	}
+	return reading, nil
+}
+
+// update sets the pointing's tilt correction at now, dropping it while
+// disabled, while the reading is stale, or if it's too large.
+func (tm *Tiltmeter) update(now time.Time) {
+	cfg := currentConfig().Tilt
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	var correction [2]float64
+	fresh := now.Sub(tm.status.Reading.Time) <= tiltStaleAge // through brief dropouts
+	if fresh {
+		correction[0] = tm.status.Tilt[0] - cfg.Reference[0]
+		correction[1] = tm.status.Tilt[1] - cfg.Reference[1]
+	}
+	tooLarge := math.Hypot(correction[0], correction[1]) > cfg.MaxCorrection
+	tm.alarms.Set(tm.err != nil, "tiltmeter", severityWarning, false, "can't read tiltmeter: %v", tm.err)
+	tm.alarms.Set(tm.enabled && tooLarge, "tilt_correction", severityWarning, false,
+		"tilt correction (%.1f, %.1f arcsec) over %g arcsec, not applied", correction[0], correction[1], cfg.MaxCorrection)
+	if !tm.enabled || !fresh || tooLarge {
+		correction = [2]float64{}
+	}
+	tm.status.Correction = correction
+	tm.pointing.SetTilt(correction[0], correction[1])
+}
+
+// SetEnabled turns the tilt correction on or off.
+func (tm *Tiltmeter) SetEnabled(enabled bool) {
+	tm.mu.Lock()
+	tm.enabled = enabled
+	tm.mu.Unlock()
+	tm.update(time.Now())
+}
+
+func (tm *Tiltmeter) Status() TiltStatus {
+	tm.mu.Lock()
+	defer tm.mu.Unlock()
+	status := tm.status
+	status.Enabled = tm.enabled
+	if tm.err != nil {
+		status.Error = tm.err.Error()
+	} else if age := time.Since(status.Reading.Time); age > tiltStaleAge {
+		status.Error = fmt.Sprintf("tiltmeter reading is stale (%.0f secs old)", age.Seconds())
+	}
+	return status
+}
+
+// serveTilt serves the tiltmeter, or nil if there's none.
+func serveTilt(tiltmeter *Tiltmeter) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if tiltmeter == nil {
+			err := fmt.Errorf("no tiltmeter configured")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			status := tiltmeter.Status()
+			err := json.NewEncoder(w).Encode(&status)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			var x struct {
+				Enabled bool `json:"enabled"`
+			}
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&x)
+			if err == nil {
+				log.Printf("setting tilt correction enabled: %v", x.Enabled)
+				tiltmeter.SetEnabled(x.Enabled)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestAxisTilt(t *testing.T) {
+	r := TiltReading{X: 3, Y: 1}
+	for _, tc := range []struct{ az, orientation, north, west float64 }{
+		{0, 0, 3, 1},
+		{90, 0, 1, -3}, // x points east
+		{45, 45, 1, -3},
+		{180, 0, -3, -1},
+	} {
+		north, west := axisTilt(r, tc.az, tc.orientation)
+		if math.Abs(north-tc.north) > 1e-12 || math.Abs(west-tc.west) > 1e-12 {
+			t.Errorf("%+v: got %g, %g", tc, north, west)
+		}
+	}
+}
+
+func TestTiltmeter(t *testing.T) {
+	reply := `{"x": 4, "y": -2, "temperature": 5}`
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Write([]byte(reply))
+	}))
+	defer srv.Close()
+	pointing := NewPointing()
+	alarms := NewAlarms()
+	tm := NewTiltmeter(srv.URL, pointing, nil, alarms, func() (float64, error) { return 0, nil })
+
+	tm.poll()
+	tm.update(time.Now())
+	if tilt := pointing.Tilt(); tilt != [2]float64{} {
+		t.Errorf("got tilt correction %v while disabled", tilt)
+	}
+	tm.SetEnabled(true)
+	// the reference is zero
+	if tilt := pointing.Tilt(); tilt != [2]float64{4, -2} {
+		t.Errorf("got tilt correction %v, expected [4 -2]", tilt)
+	}
+	az, el, _, _ := pointing.Sky2Raw(120, 40, 0, 0)
+	daz, del := PointingModel{AN: 4, AW: -2}.Correction(120, 40)
+	if math.Abs(az-120-daz) > 1e-12 || math.Abs(el-40-del) > 1e-12 {
+		t.Errorf("got raw %g, %g, expected the AN and AW correction", az, el)
+	}
+
+	// a failed read keeps the correction until it's stale
+	reply = `{"x": "bad"}`
+	tm.poll()
+	tm.update(time.Now())
+	if tilt := pointing.Tilt(); tilt != [2]float64{4, -2} || tm.Status().Error == "" {
+		t.Errorf("got tilt correction %v and %+v after a failed read", tilt, tm.Status())
+	}
+	tm.update(time.Now().Add(2 * tiltStaleAge))
+	if tilt := pointing.Tilt(); tilt != [2]float64{} {
+		t.Errorf("got tilt correction %v from a stale reading", tilt)
+	}
+
+	reply = `{"x": 400, "y": 0}`
+	tm.poll()
+	tm.update(time.Now())
+	if tilt := pointing.Tilt(); tilt != [2]float64{} || len(alarms.List()) == 0 {
+		t.Errorf("got tilt correction %v and alarms %v for a large tilt", tilt, alarms.List())
+	}
+}
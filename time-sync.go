@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// Program tracks are timed by the ACU clock, so a drifting ACU or host
+// clock starts patterns late. The TimeSync monitor compares the host
+// clock, as disciplined by NTP or PTP, with the ACU status time and a GPS
+// time server, if any, and refuses to start program tracks when they
+// disagree.
+
+const (
+	timeSyncInterval    = 1 * time.Second
+	timeSyncGPSInterval = 16 * time.Second
+	timeSyncSamples     = 15               // ACU offsets, for the median
+	timeSyncMaxAge      = 10 * time.Second // of a measurement in use
+	sntpTimeout         = 2 * time.Second
+)
+
+// HostClock is the state of the host clock discipline.
+type HostClock struct {
+	Synchronized   bool    `json:"synchronized"`
+	Offset         float64 `json:"offset"`          // last correction [s]
+	EstimatedError float64 `json:"estimated_error"` // [s]
+	MaxError       float64 `json:"max_error"`       // [s]
+}
+
+// TimeSyncStatus compares the clocks. Offsets are nil if unknown.
+type TimeSyncStatus struct {
+	Host      *HostClock `json:"host,omitempty"`
+	ACUOffset *float64   `json:"acu_offset,omitempty"` // ACU minus host [s]
+	GPSOffset *float64   `json:"gps_offset,omitempty"` // GPS time server minus host [s]
+	Skew      float64    `json:"skew"`                 // largest offset [s]
+	Error     string     `json:"error,omitempty"`      // why program tracks are refused
+}
+
+// A TimeSync monitors the clocks. It is safe for concurrent use.
+type TimeSync struct {
+	acu       *ACU
+	gpsServer string // SNTP server, if any
+	alarms    *Alarms
+
+	mu         sync.Mutex
+	host       *HostClock
+	acuOffsets []float64 // most recent last
+	acuTime    time.Time // of the last ACU offset
+	gpsOffset  float64
+	gpsTime    time.Time
+}
+
+func NewTimeSync(acu *ACU, gpsServer string, alarms *Alarms) *TimeSync {
+	return &TimeSync{acu: acu, gpsServer: gpsServer, alarms: alarms}
+}
+
+func (s *TimeSync) Run() {
+	var lastGPS time.Time
+	for {
+		host, err := hostClock()
+		if err == nil {
+			s.mu.Lock()
+			s.host = host
+			s.mu.Unlock()
+		}
+		s.measureACU()
+		if s.gpsServer != "" && time.Since(lastGPS) >= timeSyncGPSInterval {
+			lastGPS = time.Now()
+			offset, err := sntpOffset(s.gpsServer)
+			s.alarms.Set(err != nil, "gps_time", severityWarning, false, "GPS time server: %v", err)
+			if err == nil {
+				s.setGPSOffset(time.Now(), offset)
+			}
+		}
+		s.alarms.Set(host != nil && !host.Synchronized, "host_clock", severityWarning, false,
+			"host clock not synchronized by NTP or PTP")
+		err = s.Check(time.Now())
+		s.alarms.Set(err != nil, "time_sync", severityWarning, false, "%v", err)
+		time.Sleep(timeSyncInterval)
+	}
+}
+
+// measureACU compares the ACU status time with the host time halfway
+// through the request.
+func (s *TimeSync) measureACU() {
+	var rec datasets.StatusGeneral8100
+	t0 := time.Now()
+	err := s.acu.StatusGeneral8100Get(&rec)
+	t1 := time.Now()
+	if err != nil || rec.Year < minStatusTimeYear {
+		return
+	}
+	mid := t0.Add(t1.Sub(t0) / 2)
+	s.addACUOffset(t1, StatusTime2Time(rec.Year, rec.Time).Sub(mid).Seconds())
+}
+
+func (s *TimeSync) addACUOffset(now time.Time, offset float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.acuOffsets = append(s.acuOffsets, offset)
+	if len(s.acuOffsets) > timeSyncSamples {
+		s.acuOffsets = s.acuOffsets[1:]
+	}
+	s.acuTime = now
+}
+
+func (s *TimeSync) setGPSOffset(now time.Time, offset float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gpsOffset, s.gpsTime = offset, now
+}
+
+// Status returns the clock offsets measured recently at now.
+func (s *TimeSync) Status(now time.Time) TimeSyncStatus {
+	s.mu.Lock()
+	var status TimeSyncStatus
+	if s.host != nil {
+		host := *s.host
+		status.Host = &host
+	}
+	if len(s.acuOffsets) > 0 && now.Sub(s.acuTime) < timeSyncMaxAge {
+		offset := median(s.acuOffsets)
+		status.ACUOffset = &offset
+		status.Skew = math.Abs(offset)
+	}
+	if !s.gpsTime.IsZero() && now.Sub(s.gpsTime) < timeSyncMaxAge+timeSyncGPSInterval {
+		offset := s.gpsOffset
+		status.GPSOffset = &offset
+		status.Skew = math.Max(status.Skew, math.Abs(offset))
+	}
+	s.mu.Unlock()
+	if err := status.check(currentConfig().TimeSkewMax); err != nil {
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// Check checks the clocks agree at now, for starting a program track.
+// Clocks not measured are assumed good.
+func (s *TimeSync) Check(now time.Time) error {
+	status := s.Status(now)
+	if status.Error != "" {
+		return errors.New(status.Error)
+	}
+	return nil
+}
+
+// check checks the measured offsets. An unsynchronized host clock only
+// raises an alarm: it's the offsets which delay program tracks.
+func (status *TimeSyncStatus) check(skewMax float64) error {
+	if o := status.ACUOffset; o != nil && math.Abs(*o) > skewMax {
+		return fmt.Errorf("ACU clock off by %.3f seconds > %g", *o, skewMax)
+	}
+	if o := status.GPSOffset; o != nil && math.Abs(*o) > skewMax {
+		return fmt.Errorf("host clock off GPS by %.3f seconds > %g", -*o, skewMax)
+	}
+	return nil
+}
+
+func median(x []float64) float64 {
+	sorted := append([]float64(nil), x...)
+	sort.Float64s(sorted)
+	n := len(sorted)
+	if n%2 == 1 {
+		return sorted[n/2]
+	}
+	return (sorted[n/2-1] + sorted[n/2]) / 2
+}
+
+// isTimeCritical returns true for commands timed by the ACU clock.
+func isTimeCritical(cmd Command) bool {
+	switch cmd := cmd.(type) {
+	case PatternCommand, focusSweepCmd:
+		return true
+	case sequenceCmd:
+		for _, c := range cmd.Commands {
+			if isTimeCritical(c) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// seconds between the NTP (1900) and unix epochs
+const ntpEpochOffset = 2208988800
+
+func ntpTime(b []byte) time.Time {
+	sec := int64(binary.BigEndian.Uint32(b[0:4])) - ntpEpochOffset
+	frac := int64(binary.BigEndian.Uint32(b[4:8]))
+	return time.Unix(sec, frac*1e9>>32)
+}
+
+// sntpOffset queries an SNTP server (host or host:port) for its offset
+// from the host clock [s].
+func sntpOffset(server string) (float64, error) {
+	if _, _, err := net.SplitHostPort(server); err != nil {
+		server = net.JoinHostPort(server, "123")
+	}
+	conn, err := net.DialTimeout("udp", server, sntpTimeout)
+	if err != nil {
+		return 0, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(sntpTimeout))
+
+	req := make([]byte, 48)
+	req[0] = 4<<3 | 3 // version 4, client
+	t1 := time.Now()
+	_, err = conn.Write(req)
+	if err != nil {
+		return 0, err
+	}
+	resp := make([]byte, 48)
+	n, err := conn.Read(resp)
+	t4 := time.Now()
+	if err != nil {
+		return 0, err
+	}
+	if n < 48 || resp[0]&7 != 4 || resp[1] == 0 {
+		return 0, fmt.Errorf("%s: bad SNTP response", server)
+	}
+	t2, t3 := ntpTime(resp[32:40]), ntpTime(resp[40:48])
+	return (t2.Sub(t1) + t3.Sub(t4)).Seconds() / 2, nil
+}
+
+// serveTimeSync serves the clock offsets.
+func serveTimeSync(s *TimeSync) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		status := s.Status(time.Now())
+		err := json.NewEncoder(w).Encode(&status)
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+)
+
+func TestTimeSync(t *testing.T) {
+	s := NewTimeSync(nil, "", NewAlarms())
+	now := time.Now()
+	if status := s.Status(now); status.ACUOffset != nil || s.Check(now) != nil {
+		t.Errorf("got %+v, expected nothing measured", status)
+	}
+	for _, offset := range []float64{0.01, 5, 0.02, 0.03, -0.01} {
+		s.addACUOffset(now, offset) // the outlier is ignored
+	}
+	if status := s.Status(now); status.ACUOffset == nil || *status.ACUOffset != 0.02 || s.Check(now) != nil {
+		t.Errorf("got %+v, expected the median offset", status)
+	}
+	for i := 0; i < timeSyncSamples; i++ {
+		s.addACUOffset(now, 2)
+	}
+	if err := s.Check(now); err == nil {
+		t.Error("expected the ACU clock off")
+	}
+	if err := s.Check(now.Add(timeSyncMaxAge)); err != nil {
+		t.Errorf("expected the old offsets ignored, got %v", err)
+	}
+
+	s.setGPSOffset(now, -0.5)
+	if status := s.Status(now.Add(timeSyncMaxAge)); status.GPSOffset == nil || status.Skew != 0.5 || status.Error == "" {
+		t.Errorf("got %+v, expected the host clock off GPS", status)
+	}
+
+	if !isTimeCritical(sequenceCmd{Commands: []Command{stowCmd{}, trackCmd{}}}) || isTimeCritical(stowCmd{}) {
+		t.Error("isTimeCritical")
+	}
+}
+
+func TestSNTPOffset(t *testing.T) {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	go func() {
+		b := make([]byte, 48)
+		_, addr, err := conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		// a server 1.5 s ahead
+		ts := time.Now().Add(1500 * time.Millisecond)
+		sec := uint32(ts.Unix() + ntpEpochOffset)
+		frac := uint32(uint64(ts.Nanosecond()) << 32 / 1e9)
+		resp := make([]byte, 48)
+		resp[0], resp[1] = 4<<3|4, 1
+		for _, i := range []int{32, 40} {
+			binary.BigEndian.PutUint32(resp[i:], sec)
+			binary.BigEndian.PutUint32(resp[i+4:], frac)
+		}
+		conn.WriteToUDP(resp, addr)
+	}()
+	offset, err := sntpOffset(conn.LocalAddr().String())
+	if err != nil || offset < 1.49 || offset > 1.51 {
+		t.Errorf("got %g, %v, expected 1.5", offset, err)
+	}
+}
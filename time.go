@@ -5,6 +5,9 @@ import (
 	"time"
 )
 
+// VertexTime converts t to the ACU's absolute program track time: the UTC
+// day of year, and the seconds since 0h UTC that day. It rolls over to the
+// next day at midnight, and to day 1 at the New Year.
 func VertexTime(t time.Time) (int32, float64) {
 	utc := t.UTC()
 	doy := utc.YearDay()
@@ -13,6 +16,29 @@ func VertexTime(t time.Time) (int32, float64) {
 	return int32(doy), float64(60*(60*h+m)+s) + float64(ns)*1e-9
 }
 
+// VertexTime2Time converts an ACU program track time back to a time.Time,
+// taking the year from the nearest of the New Years around ref. A time of
+// day past 86400 seconds, in a leap second (23:59:60), reads as the start of
+// the next day, like POSIX time.
+func VertexTime2Time(day int32, tod float64, ref time.Time) time.Time {
+	ref = ref.UTC()
+	t := time.Date(ref.Year(), 1, int(day), 0, 0, 0, 0, time.UTC).Add(Seconds2Duration(tod))
+	switch {
+	case t.Sub(ref) < -183*24*time.Hour:
+		t = time.Date(ref.Year()+1, 1, int(day), 0, 0, 0, 0, time.UTC).Add(Seconds2Duration(tod))
+	case t.Sub(ref) > 183*24*time.Hour:
+		t = time.Date(ref.Year()-1, 1, int(day), 0, 0, 0, 0, time.UTC).Add(Seconds2Duration(tod))
+	}
+	return t
+}
+
+// StatusTime2Time converts an ACU status time (year, and fractional day of year)
+// to a time.Time.
+func StatusTime2Time(year uint32, doy float64) time.Time {
+	t := time.Date(int(year), 1, 1, 0, 0, 0, 0, time.UTC)
+	return t.Add(time.Duration((doy - 1) * 24 * float64(time.Hour)))
+}
+
 func Unixtime2Time(unixtime float64) time.Time {
 	a, b := math.Modf(unixtime)
 	s := int64(a)
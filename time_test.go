@@ -1,8 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"testing"
 	"time"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
 )
 
 func TestSeconds2Duration(t *testing.T) {
@@ -40,3 +43,50 @@ func TestConversions(t *testing.T) {
 		}
 	}
 }
+
+func TestStatusTime2Time(t *testing.T) {
+	t0 := time.Date(2025, 3, 4, 5, 6, 7, 0, time.UTC)
+	y, d := statusTime(t0)
+	got := StatusTime2Time(y, d)
+	if dt := got.Sub(t0); dt < -time.Microsecond || dt > time.Microsecond {
+		t.Errorf("StatusTime2Time: got %v, expected %v", got, t0)
+	}
+}
+
+func TestVertexTimeRollover(t *testing.T) {
+	for _, test := range []struct {
+		t   time.Time
+		doy int32
+		tod float64
+		ssv string
+	}{
+		{time.Date(2025, 3, 4, 23, 59, 59, 999999999, time.UTC), 63, 86399.999999999, "63 86399.999999999"},
+		{time.Date(2025, 3, 5, 0, 0, 0, 0, time.UTC), 64, 0, "64 0.000000000"},
+		{time.Date(2025, 3, 5, 0, 0, 0, 1, time.UTC), 64, 1e-9, "64 0.000000001"},
+		{time.Date(2024, 12, 31, 23, 59, 59, 5e8, time.UTC), 366, 86399.5, "366 86399.500000000"}, // leap year
+		{time.Date(2025, 1, 1, 0, 0, 0, 5e8, time.UTC), 1, 0.5, "1 0.500000000"},
+		{time.Date(2025, 1, 1, 0, 30, 0, 0, time.FixedZone("CET", 3600)), 366, 84600, "366 84600.000000000"}, // UTC
+	} {
+		doy, tod := VertexTime(test.t)
+		if doy != test.doy || tod != test.tod {
+			t.Errorf("VertexTime(%v): got %d %v, expected %d %v", test.t, doy, tod, test.doy, test.tod)
+		}
+		var b bytes.Buffer
+		datasets.TimePositionTransfer{Day: doy, TimeOfDay: tod}.WriteSSV(&b)
+		if got := b.String(); got[:len(test.ssv)+1] != test.ssv+" " {
+			t.Errorf("WriteSSV: got %q, expected %q...", got, test.ssv)
+		}
+		// on either side of the New Year
+		for _, ref := range []time.Time{test.t.Add(-time.Hour), test.t.Add(time.Hour), test.t.AddDate(0, 5, 0)} {
+			if got := VertexTime2Time(doy, tod, ref); !got.Equal(test.t) {
+				t.Errorf("VertexTime2Time(%d, %v, %v): got %v, expected %v", doy, tod, ref, got, test.t)
+			}
+		}
+	}
+
+	// the leap second at the end of 2016 reads as the start of 2017
+	got := VertexTime2Time(366, 86400.5, time.Date(2016, 12, 31, 23, 59, 59, 0, time.UTC))
+	if expected := time.Date(2017, 1, 1, 0, 0, 0, 5e8, time.UTC); !got.Equal(expected) {
+		t.Errorf("leap second: got %v, expected %v", got, expected)
+	}
+}
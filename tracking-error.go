@@ -0,0 +1,140 @@
+package main
+
+import (
+	"math"
+	"sync"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+// The tracking error is the commanded minus the current position. Its RMS
+// over a scan is our main data-quality metric, so it's monitored from the
+// status stream, and summarized in the record of each pattern command.
+
+// how often the tracking error is sampled
+const trackingErrorRate = 10.0 // [Hz]
+
+// An AxisTrackingError summarizes an axis' tracking error [deg].
+type AxisTrackingError struct {
+	RMS     float64 `json:"rms"`
+	Max     float64 `json:"max"` // largest absolute error
+	Samples int     `json:"samples"`
+}
+
+// A TrackingErrorSummary is the tracking error over a pattern, while the
+// axes were in program track mode.
+type TrackingErrorSummary struct {
+	Azimuth   AxisTrackingError `json:"azimuth"`
+	Elevation AxisTrackingError `json:"elevation"`
+}
+
+// TrackingErrorStatus is the latest tracking error, and the running
+// summary for the current pattern, if any.
+type TrackingErrorStatus struct {
+	Azimuth   *float64              `json:"azimuth,omitempty"` // nil unless tracking [deg]
+	Elevation *float64              `json:"elevation,omitempty"`
+	Command   string                `json:"command,omitempty"` // ID of the summarized command
+	Summary   *TrackingErrorSummary `json:"summary,omitempty"`
+}
+
+// axisTrackingErrors accumulates an axis' tracking error.
+type axisTrackingErrors struct {
+	n     int
+	sumSq float64
+	max   float64
+}
+
+func (a *axisTrackingErrors) add(x float64) {
+	a.n++
+	a.sumSq += x * x
+	a.max = math.Max(a.max, math.Abs(x))
+}
+
+func (a *axisTrackingErrors) summary() AxisTrackingError {
+	s := AxisTrackingError{Max: a.max, Samples: a.n}
+	if a.n > 0 {
+		s.RMS = math.Sqrt(a.sumSq / float64(a.n))
+	}
+	return s
+}
+
+// TrackingErrors monitors the tracking error, recording each pattern's
+// summary in the tracker once it finishes. It is safe for concurrent use.
+type TrackingErrors struct {
+	tracker *CommandTracker
+
+	mu     sync.Mutex
+	status TrackingErrorStatus
+	az, el axisTrackingErrors // for status.Command
+}
+
+func NewTrackingErrors(tracker *CommandTracker) *TrackingErrors {
+	return &TrackingErrors{tracker: tracker}
+}
+
+// Run samples stream until it fails to subscribe.
+func (te *TrackingErrors) Run(stream *StatusStream) error {
+	sub, err := stream.Subscribe(trackingErrorRate)
+	if err != nil {
+		return err
+	}
+	defer stream.Unsubscribe(sub)
+	for sample := range sub.c {
+		te.Update(&sample.rec, sample.command)
+	}
+	return nil
+}
+
+// Update adds the ACU status rec, while cmd (nil if none) is current.
+// Only the axes in program track mode are counted, and only while a
+// pattern is running.
+func (te *TrackingErrors) Update(rec *datasets.StatusGeneral8100, cmd *CommandRecord) {
+	id := ""
+	if cmd != nil && (cmd.State == commandUploading || cmd.State == commandTracking) {
+		id = cmd.ID
+	}
+
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	if id != te.status.Command {
+		te.finish()
+		te.status.Command = id
+	}
+	axis := func(tracking bool, commanded, current float64, acc *axisTrackingErrors) *float64 {
+		if !tracking || math.IsNaN(commanded) {
+			return nil
+		}
+		x := commanded - current
+		if id != "" {
+			acc.add(x)
+		}
+		return &x
+	}
+	te.status.Azimuth = axis(rec.AzimuthMode == datasets.AzimuthModeProgramTrack,
+		rec.AzimuthCommandedPosition, rec.AzimuthCurrentPosition, &te.az)
+	te.status.Elevation = axis(rec.ElevationMode == datasets.ElevationModeProgramTrack,
+		rec.ElevationCommandedPosition, rec.ElevationCurrentPosition, &te.el)
+	te.status.Summary = nil
+	if id != "" {
+		te.status.Summary = te.summary()
+	}
+}
+
+func (te *TrackingErrors) summary() *TrackingErrorSummary {
+	return &TrackingErrorSummary{Azimuth: te.az.summary(), Elevation: te.el.summary()}
+}
+
+// finish records the summary of the last command, if anything was tracked,
+// and starts afresh.
+func (te *TrackingErrors) finish() {
+	if te.status.Command != "" && (te.az.n > 0 || te.el.n > 0) {
+		te.tracker.SetTrackingError(te.status.Command, *te.summary())
+	}
+	te.az, te.el = axisTrackingErrors{}, axisTrackingErrors{}
+}
+
+func (te *TrackingErrors) Status() TrackingErrorStatus {
+	te.mu.Lock()
+	defer te.mu.Unlock()
+	return te.status
+}
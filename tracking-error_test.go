@@ -0,0 +1,53 @@
+package main
+
+import (
+	"math"
+	"testing"
+
+	"github.com/ccatobs/antenna-control-unit/datasets"
+)
+
+func TestTrackingErrors(t *testing.T) {
+	tracker := NewCommandTracker()
+	tracker.Add("a", "/azimuth-scan")
+	te := NewTrackingErrors(tracker)
+	cmd := &CommandRecord{ID: "a", State: commandTracking}
+	rec := datasets.StatusGeneral8100{
+		AzimuthMode:                datasets.AzimuthModeProgramTrack,
+		ElevationMode:              datasets.ElevationModeStop,
+		AzimuthCommandedPosition:   120,
+		ElevationCommandedPosition: 45,
+		ElevationCurrentPosition:   40,
+	}
+	for _, az := range []float64{120.003, 119.996} {
+		rec.AzimuthCurrentPosition = az
+		te.Update(&rec, cmd)
+	}
+	s := te.Status()
+	if s.Azimuth == nil || math.Abs(*s.Azimuth-0.004) > 1e-9 || s.Elevation != nil {
+		t.Errorf("got %+v", s)
+	}
+	if s.Command != "a" || s.Summary == nil {
+		t.Fatalf("got %+v", s)
+	}
+	expected := math.Sqrt((0.003*0.003 + 0.004*0.004) / 2)
+	if az := s.Summary.Azimuth; math.Abs(az.RMS-expected) > 1e-9 || math.Abs(az.Max-0.004) > 1e-9 || az.Samples != 2 {
+		t.Errorf("azimuth summary %+v, expected RMS %g", az, expected)
+	}
+	if s.Summary.Elevation.Samples != 0 {
+		t.Errorf("elevation counted while stopped: %+v", s.Summary.Elevation)
+	}
+	if r, _ := tracker.Get("a"); r.TrackingError != nil {
+		t.Error("summary recorded before the command finished")
+	}
+
+	// the summary is recorded once the command's no longer current
+	te.Update(&rec, nil)
+	r, _ := tracker.Get("a")
+	if r.TrackingError == nil || r.TrackingError.Azimuth.Samples != 2 {
+		t.Errorf("got record %+v", r)
+	}
+	if s := te.Status(); s.Command != "" || s.Summary != nil || s.Azimuth == nil {
+		t.Errorf("got %+v", s)
+	}
+}
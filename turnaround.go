@@ -0,0 +1,48 @@
+package main
+
+import (
+	"math"
+)
+
+// An sCurve reverses an axis from +speed to -speed over a duration, with a
+// trapezoidal acceleration profile: the acceleration ramps at the jerk
+// limit to its peak, holds, and ramps back to zero.
+type sCurve struct {
+	speed    float64
+	duration float64 // [s]
+	accel    float64 // peak deceleration
+	jerk     float64
+	ramp     float64 // time to reach the peak [s]
+}
+
+// newSCurve returns the gentlest S-curve reversal at the jerk limit taking
+// duration seconds, which must be at least minTurnaroundTime.
+func newSCurve(speed, duration, jerk float64) sCurve {
+	// the velocity change 2*speed = accel*(duration - accel/jerk)
+	d := duration*duration - 8*speed/jerk
+	accel := jerk * (duration - math.Sqrt(math.Max(d, 0))) / 2
+	return sCurve{
+		speed:    speed,
+		duration: duration,
+		accel:    accel,
+		jerk:     jerk,
+		ramp:     accel / jerk,
+	}
+}
+
+// at returns the distance past the start of the reversal and the velocity,
+// t seconds into it.
+func (c sCurve) at(t float64) (x, v float64) {
+	// the profile is symmetric about its midpoint
+	if t > c.duration/2 {
+		x, v = c.at(c.duration - t)
+		return x, -v
+	}
+	if t <= c.ramp {
+		return c.speed*t - c.jerk*t*t*t/6, c.speed - c.jerk*t*t/2
+	}
+	x1 := c.speed*c.ramp - c.jerk*c.ramp*c.ramp*c.ramp/6
+	v1 := c.speed - c.accel*c.ramp/2
+	s := t - c.ramp
+	return x1 + v1*s - c.accel*s*s/2, v1 - c.accel*s
+}
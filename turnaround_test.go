@@ -0,0 +1,32 @@
+package main
+
+import (
+	"math"
+	"testing"
+)
+
+func TestSCurve(t *testing.T) {
+	for _, speed := range []float64{0.1, 1, azimuthSpeedMax} {
+		tt := minTurnaroundTime(speed, azimuthAccelMax, azimuthJerkMax)
+		for _, duration := range []float64{tt, 2 * tt} {
+			c := newSCurve(speed, duration, azimuthJerkMax)
+			if c.accel > azimuthAccelMax+1e-9 {
+				t.Errorf("%g deg/s in %g s: peak acceleration %g", speed, duration, c.accel)
+			}
+			x, v := c.at(duration)
+			if math.Abs(x) > 1e-9 || math.Abs(v+speed) > 1e-9 {
+				t.Errorf("%g deg/s in %g s: ends at %g, %g", speed, duration, x, v)
+			}
+			// the velocity is continuous, changing at most at the acceleration limit
+			const dt = 1e-3
+			for s := dt; s <= duration; s += dt {
+				_, v0 := c.at(s - dt)
+				_, v1 := c.at(s)
+				if v1 > v0 || v0-v1 > c.accel*dt+1e-9 {
+					t.Errorf("%g deg/s in %g s: at %g s, velocity %g -> %g", speed, duration, s, v0, v1)
+					break
+				}
+			}
+		}
+	}
+}
@@ -18,3 +18,10 @@ func postJSON(url string, data interface{}) error {
 	resp.Body.Close()
 	return err
 }
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"time"
+)
+
+const (
+	// how often a track's target is checked
+	visibilityStep = time.Minute
+
+	// how far from the track its target's rise and set are looked for
+	visibilitySearch = 24 * time.Hour
+)
+
+// A VisibilityError is a track whose target leaves the elevation limits,
+// or comes too near the Sun, before the track ends. Rise and Set bound the
+// interval the target is visible nearest the start of the track, if found.
+// The API reports it as a FieldError (see As).
+type VisibilityError struct {
+	Time      time.Time // when the target isn't visible
+	Reason    string
+	Rise, Set *time.Time
+}
+
+func (e *VisibilityError) Error() string {
+	s := fmt.Sprintf("target %s at %s", e.Reason, e.Time.UTC().Format(time.RFC3339))
+	switch {
+	case e.Rise != nil && e.Set != nil:
+		s += fmt.Sprintf(": visible from %s to %s", e.Rise.UTC().Format(time.RFC3339), e.Set.UTC().Format(time.RFC3339))
+	case e.Rise != nil:
+		s += fmt.Sprintf(": visible from %s", e.Rise.UTC().Format(time.RFC3339))
+	case e.Set != nil:
+		s += fmt.Sprintf(": visible until %s", e.Set.UTC().Format(time.RFC3339))
+	default:
+		s += fmt.Sprintf(": not visible within %v", visibilitySearch)
+	}
+	return s
+}
+
+// As converts the error to a *FieldError, for errors.As.
+func (e *VisibilityError) As(target interface{}) bool {
+	fe, ok := target.(**FieldError)
+	if ok {
+		*fe = &FieldError{Field: "start_time", Reason: "not visible", msg: e.Error()}
+	}
+	return ok
+}
+
+// visibility checks the target's position at t against the active
+// elevation limits and the Sun, returning why it isn't visible, if it isn't.
+type visibility struct {
+	azEl func(time.Time) (float64, float64, error)
+	el   [2]float64
+	sun  *sunTracker
+}
+
+func (v *visibility) at(t time.Time) (string, error) {
+	az, el, err := v.azEl(t)
+	if err != nil {
+		return "", err
+	}
+	switch {
+	case el < v.el[0]:
+		return fmt.Sprintf("below the elevation limit (%g deg)", v.el[0]), nil
+	case el > v.el[1]:
+		return fmt.Sprintf("above the elevation limit (%g deg)", v.el[1]), nil
+	case v.sun.check(t, az, el) != nil:
+		return "too near the Sun", nil
+	}
+	return "", nil
+}
+
+// change returns when the visibility first differs from visible, going
+// from t in steps of dt, to the second, or nil if it doesn't within
+// visibilitySearch.
+func (v *visibility) change(t time.Time, dt time.Duration, visible bool) (*time.Time, error) {
+	for n := time.Duration(0); n < visibilitySearch; n += visibilityStep {
+		t1 := t.Add(dt)
+		reason, err := v.at(t1)
+		if err != nil {
+			return nil, err
+		}
+		if (reason == "") != visible {
+			// bisect the change, to within a second
+			for t1.Sub(t) > time.Second || t.Sub(t1) > time.Second {
+				mid := t.Add(t1.Sub(t) / 2)
+				reason, err := v.at(mid)
+				if err != nil {
+					return nil, err
+				}
+				if (reason == "") == visible {
+					t = mid
+				} else {
+					t1 = mid
+				}
+			}
+			return &t1, nil
+		}
+		t = t1
+	}
+	return nil, nil
+}
+
+// checkVisibility checks a track's target is visible from start to stop.
+func checkVisibility(track TrackScanPattern, start, stop time.Time) error {
+	v := &visibility{
+		azEl: track.azEl,
+		el:   siteSoftLimits.State().Elevation,
+		sun:  siteSunAvoidance.tracker(),
+	}
+	return v.check(start, stop)
+}
+
+func (v *visibility) check(start, stop time.Time) error {
+	for t := start; ; t = t.Add(visibilityStep) {
+		if t.After(stop) {
+			t = stop
+		}
+		reason, err := v.at(t)
+		if err != nil {
+			return err
+		}
+		if reason != "" {
+			return v.error(start, t, reason)
+		}
+		if t.Equal(stop) {
+			return nil
+		}
+	}
+}
+
+// error returns the error for a target not visible at t, for reason,
+// with its rise and set nearest start.
+func (v *visibility) error(start, t time.Time, reason string) error {
+	e := &VisibilityError{Time: t, Reason: reason}
+	var err error
+	if t.Equal(start) {
+		// rises later, if at all
+		e.Rise, err = v.change(start, visibilityStep, false)
+		if err == nil && e.Rise != nil {
+			e.Set, err = v.change(*e.Rise, visibilityStep, true)
+		}
+	} else {
+		// set during the track
+		e.Rise, err = v.change(start, -visibilityStep, true)
+		if err == nil {
+			e.Set, err = v.change(start, visibilityStep, true)
+		}
+	}
+	if err != nil {
+		return err
+	}
+	return e
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"errors"
+	"math"
+	"testing"
+	"time"
+)
+
+func TestVisibility(t *testing.T) {
+	// a target rising above 20 deg at 6h and setting at 18h
+	t0 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	v := &visibility{
+		azEl: func(t time.Time) (float64, float64, error) {
+			x := t.Sub(t0).Hours() * math.Pi / 12
+			return 180, 20 - 40*math.Cos(x), nil
+		},
+		el:  [2]float64{20, 80},
+		sun: &sunTracker{},
+	}
+	at := func(h float64) time.Time { return t0.Add(time.Duration(h * float64(time.Hour))) }
+	near := func(got *time.Time, h float64) bool {
+		return got != nil && math.Abs(got.Sub(at(h)).Seconds()) <= 1
+	}
+
+	if err := v.check(at(7), at(17)); err != nil {
+		t.Errorf("from 7h to 17h: %v", err)
+	}
+	for _, test := range []struct {
+		start, stop float64
+	}{
+		{2, 10},  // before it rises
+		{12, 20}, // after it sets
+	} {
+		err := v.check(at(test.start), at(test.stop))
+		var ve *VisibilityError
+		if !errors.As(err, &ve) {
+			t.Errorf("%+v: got %v, expected a visibility error", test, err)
+			continue
+		}
+		if !near(ve.Rise, 6) || !near(ve.Set, 18) {
+			t.Errorf("%+v: got %v, expected it visible from 6h to 18h", test, err)
+		}
+		var fe *FieldError
+		if !errors.As(err, &fe) || fe.Field != "start_time" {
+			t.Errorf("%+v: got %+v, expected a start_time error", test, fe)
+		}
+	}
+}
+
+func TestCheckVisibility(t *testing.T) {
+	disableSunAvoidance(t)
+	err := siteSoftLimits.Set(Limits{Azimuth: [2]float64{-180, 360}, Elevation: [2]float64{20, 80}}, "test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(siteSoftLimits.Clear)
+
+	t0 := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	track, err := NewTrackScanPattern(t0, t0.Add(time.Hour), 120, 10, "Horizon")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = checkVisibility(*track, t0, t0.Add(time.Hour))
+	var ve *VisibilityError
+	if !errors.As(err, &ve) || ve.Rise != nil || ve.Set != nil {
+		t.Errorf("got %v, expected a target never visible", err)
+	}
+}
@@ -0,0 +1,73 @@
+package main
+
+import (
+	"time"
+)
+
+// A commandWatchdog notices a command still running well past its
+// estimated end, e.g. after a silently failed upload.
+type commandWatchdog struct {
+	deadline time.Time // zero if the command's duration isn't known
+	pausedAt time.Time
+	fired    bool
+}
+
+// newCommandWatchdog estimates when cmd, started at now from pos (nil if
+// unknown), should be done, allowing margin.
+func newCommandWatchdog(cmd Command, pos *[2]float64, now time.Time, margin time.Duration) *commandWatchdog {
+	w := &commandWatchdog{}
+	d, _, err := dryRun(cmd, pos, now)
+	if err != nil {
+		return w
+	}
+	if end, ok := dryRunEnd(d, now); ok {
+		w.deadline = end.Add(margin)
+	}
+	return w
+}
+
+// dryRunEnd returns when a command started at now ends, if known.
+func dryRunEnd(d *DryRun, now time.Time) (time.Time, bool) {
+	switch {
+	case d.Stop != nil:
+		return *d.Stop, true
+	case len(d.Steps) > 0:
+		for _, step := range d.Steps {
+			end, ok := dryRunEnd(step, now)
+			if !ok {
+				return time.Time{}, false
+			}
+			now = end
+		}
+		return now, true
+	case d.Duration != nil:
+		return now.Add(Seconds2Duration(*d.Duration)), true
+	}
+	return time.Time{}, false
+}
+
+// pause stops the clock at now, until resume.
+func (w *commandWatchdog) pause(now time.Time) {
+	if w.pausedAt.IsZero() {
+		w.pausedAt = now
+	}
+}
+
+// resume extends the deadline by the time paused.
+func (w *commandWatchdog) resume(now time.Time) {
+	if !w.pausedAt.IsZero() {
+		if !w.deadline.IsZero() {
+			w.deadline = w.deadline.Add(now.Sub(w.pausedAt))
+		}
+		w.pausedAt = time.Time{}
+	}
+}
+
+// expired checks if the deadline passed by now, only once.
+func (w *commandWatchdog) expired(now time.Time) bool {
+	if w.fired || w.deadline.IsZero() || !w.pausedAt.IsZero() || now.Before(w.deadline) {
+		return false
+	}
+	w.fired = true
+	return true
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestCommandWatchdog(t *testing.T) {
+	now := time.Date(2025, 6, 1, 0, 0, 0, 0, time.UTC)
+	pos := &[2]float64{0, 30}
+	cmd := sequenceCmd{Commands: []Command{stowCmd{az: 10, el: 30}, stowCmd{az: 10, el: 60}}}
+	move := estimateMoveTime(0, 10, 30, 30) + estimateMoveTime(10, 10, 30, 60)
+	w := newCommandWatchdog(cmd, pos, now, time.Minute)
+	if expected := now.Add(move + time.Minute); !w.deadline.Equal(expected) {
+		t.Fatalf("deadline %v, expected %v", w.deadline, expected)
+	}
+
+	// pausing holds off the deadline
+	w.pause(now)
+	if w.expired(now.Add(time.Hour)) {
+		t.Error("expired while paused")
+	}
+	w.resume(now.Add(time.Hour))
+	if w.expired(w.deadline.Add(-time.Second)) || !w.expired(w.deadline) || w.expired(w.deadline.Add(time.Second)) {
+		t.Error("expected to expire once, at the deadline")
+	}
+
+	// unknown duration
+	if w := newCommandWatchdog(cmd, nil, now, time.Minute); w.expired(now.Add(24 * time.Hour)) {
+		t.Error("expired with no deadline")
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	weatherPollInterval = 10 * time.Second
+	weatherStaleAge     = 2 * time.Minute
+)
+
+// A WeatherReading is a measurement from the site weather station.
+type WeatherReading struct {
+	Time time.Time `json:"time"`
+	Weather
+	WindSpeed     float64 `json:"wind_speed"`     // m/s
+	WindDirection float64 `json:"wind_direction"` // deg, N=0,E=90
+}
+
+// A WeatherStation polls the site weather station over HTTP,
+// feeding the readings into the refraction correction.
+// The station should return a JSON WeatherReading.
+type WeatherStation struct {
+	url    string
+	client *http.Client
+	atm    *Atmosphere
+
+	mu     sync.Mutex
+	latest WeatherReading
+	err    error
+}
+
+func NewWeatherStation(url string, atm *Atmosphere) *WeatherStation {
+	return &WeatherStation{
+		url: url,
+		client: &http.Client{
+			Timeout: 2 * time.Second,
+		},
+		atm: atm,
+		err: fmt.Errorf("no weather readings yet"),
+	}
+}
+
+// Run polls the weather station forever.
+func (ws *WeatherStation) Run() {
+	for {
+		ws.poll()
+		time.Sleep(weatherPollInterval)
+	}
+}
+
+func (ws *WeatherStation) poll() {
+	reading, err := ws.fetch()
+	if err == nil {
+		err = ws.atm.SetWeather(reading.Weather)
+	}
+
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if err != nil {
+		log.Printf("weather: %v", err)
+		ws.err = err
+		return
+	}
+	ws.latest = reading
+	ws.err = nil
+}
+
+func (ws *WeatherStation) fetch() (WeatherReading, error) {
+	var reading WeatherReading
+	resp, err := ws.client.Get(ws.url)
+	if err != nil {
+		return reading, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return reading, fmt.Errorf(resp.Status)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&reading)
+	if err != nil {
+		return reading, err
+	}
+	if reading.Time.IsZero() {
+		reading.Time = time.Now()
+	}
+	return reading, nil
+}
+
+// Latest returns the most recent good reading, and an error if
+// the last poll failed or the reading is stale.
+func (ws *WeatherStation) Latest() (WeatherReading, error) {
+	return ws.latestAt(time.Now())
+}
+
+func (ws *WeatherStation) latestAt(t time.Time) (WeatherReading, error) {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.err != nil {
+		return ws.latest, ws.err
+	}
+	if age := t.Sub(ws.latest.Time); age > weatherStaleAge {
+		return ws.latest, fmt.Errorf("weather reading is stale (%.0f secs old)", age.Seconds())
+	}
+	return ws.latest, nil
+}
+
+// A WeatherStatus is the most recent good reading, its age, and why
+// it shouldn't be relied on, if it shouldn't.
+type WeatherStatus struct {
+	Reading WeatherReading `json:"reading"`
+	Age     float64        `json:"age"`   // [s], 0 if no reading
+	Stale   bool           `json:"stale"` // the last poll failed or the reading is stale
+	Error   string         `json:"error,omitempty"`
+}
+
+// Status returns the weather status at time t.
+func (ws *WeatherStation) Status(t time.Time) WeatherStatus {
+	reading, err := ws.latestAt(t)
+	status := WeatherStatus{Reading: reading}
+	if !reading.Time.IsZero() {
+		status.Age = t.Sub(reading.Time).Seconds()
+	}
+	if err != nil {
+		status.Stale = true
+		status.Error = err.Error()
+	}
+	return status
+}
+
+// serveWeather serves the weather station's status, or nil if there's none.
+func serveWeather(weather *WeatherStation) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != "GET" {
+			err := fmt.Errorf("method not GET")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+			return
+		}
+		if weather == nil {
+			err := fmt.Errorf("no weather station configured")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		err := json.NewEncoder(w).Encode(weather.Status(time.Now()))
+		if err != nil {
+			log.Print(err)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestWeatherStation(t *testing.T) {
+	body, code := "", http.StatusOK
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.WriteHeader(code)
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+	atm := NewAtmosphere(defaultWeather)
+	ws := NewWeatherStation(srv.URL, atm)
+
+	if _, err := ws.Latest(); err == nil {
+		t.Error("no error before the first reading")
+	}
+	if s := ws.Status(time.Now()); !s.Stale || s.Age != 0 || s.Error == "" {
+		t.Errorf("got %+v before the first reading", s)
+	}
+
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	body = `{"time":"2023-01-01T00:00:00Z","pressure":560,"temperature":-5,"humidity":0.2,"wind_speed":7.5,"wind_direction":270}`
+	ws.poll()
+	reading, err := ws.latestAt(t0.Add(time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := WeatherReading{Time: t0, Weather: Weather{Pressure: 560, Temperature: -5, Humidity: 0.2}, WindSpeed: 7.5, WindDirection: 270}
+	if !reading.Time.Equal(t0) || reading.Weather != expected.Weather || reading.WindSpeed != 7.5 || reading.WindDirection != 270 {
+		t.Errorf("got %+v, expected %+v", reading, expected)
+	}
+	if _, w := atm.State(); w != expected.Weather {
+		t.Errorf("refraction weather %+v, expected %+v", w, expected.Weather)
+	}
+	if s := ws.Status(t0.Add(time.Minute)); s.Stale || s.Age != 60 || s.Error != "" {
+		t.Errorf("got %+v", s)
+	}
+
+	// stale
+	if _, err := ws.latestAt(t0.Add(weatherStaleAge + time.Second)); err == nil {
+		t.Error("stale reading accepted")
+	}
+	if s := ws.Status(t0.Add(5 * time.Minute)); !s.Stale || s.Age != 300 || s.Reading.WindSpeed != 7.5 {
+		t.Errorf("got %+v", s)
+	}
+
+	// a reading without a time is timestamped when fetched
+	body = `{"pressure":550,"temperature":0,"humidity":0.3}`
+	if reading, err = ws.fetch(); err != nil || time.Since(reading.Time) > time.Second {
+		t.Errorf("got %+v, %v", reading, err)
+	}
+
+	// failed polls keep the last good reading
+	for _, bad := range []struct {
+		body string
+		code int
+	}{
+		{`{"pressure":`, http.StatusOK},
+		{`{"pressure":-1}`, http.StatusOK},
+		{``, http.StatusServiceUnavailable},
+	} {
+		body, code = bad.body, bad.code
+		ws.poll()
+		reading, err := ws.latestAt(t0.Add(time.Minute))
+		if err == nil || reading.WindSpeed != 7.5 {
+			t.Errorf("%q (%d): got %+v, %v", bad.body, bad.code, reading, err)
+		}
+		if _, w := atm.State(); w != expected.Weather {
+			t.Errorf("%q (%d): refraction weather %+v", bad.body, bad.code, w)
+		}
+	}
+
+	// an unreachable station
+	srv.Close()
+	if _, err := ws.fetch(); err == nil {
+		t.Error("no error from a closed server")
+	}
+}
@@ -0,0 +1,34 @@
+package main
+
+import (
+	"bufio"
+	"net"
+	"testing"
+)
+
+func TestWebsocketAccept(t *testing.T) {
+	// example from RFC 6455
+	got := websocketAccept("dGhlIHNhbXBsZSBub25jZQ==")
+	expected := "s3pPLMBiTxaQ9kYGzzhZRbK+xOo="
+	if got != expected {
+		t.Errorf("websocketAccept: got %q, expected %q", got, expected)
+	}
+}
+
+func TestWebsocketReadFrame(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	// masked "Hello" from RFC 6455
+	go client.Write([]byte{0x81, 0x85, 0x37, 0xfa, 0x21, 0x3d, 0x7f, 0x9f, 0x4d, 0x51, 0x58})
+
+	c := &wsConn{conn: server, r: bufio.NewReader(server)}
+	op, payload, err := c.readFrame()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if op != wsOpText || string(payload) != "Hello" {
+		t.Errorf("readFrame: got op %d payload %q", op, payload)
+	}
+}
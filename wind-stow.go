@@ -0,0 +1,267 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A WindStowPolicy says when to stow the telescope because of wind.
+// Speeds are in m/s, times in seconds, and positions in degrees.
+type WindStowPolicy struct {
+	Enabled         bool    `json:"enabled"`
+	SustainedMax    float64 `json:"sustained_max"`     // max mean speed over sustained_window
+	SustainedWindow float64 `json:"sustained_window"`  // averaging time for the sustained speed
+	GustMax         float64 `json:"gust_max"`          // max speed of any single reading
+	ClearSpeed      float64 `json:"clear_speed"`       // stay stowed until the wind is below this...
+	ClearTime       float64 `json:"clear_time"`        // ...for this long
+	DataLossTimeout float64 `json:"data_loss_timeout"` // stow without wind data this long, 0 never
+	StowAzimuth     float64 `json:"stow_azimuth"`
+	StowElevation   float64 `json:"stow_elevation"`
+}
+
+var defaultWindStowPolicy = WindStowPolicy{
+	Enabled:         true,
+	SustainedMax:    15,
+	SustainedWindow: 10 * 60,
+	GustMax:         20,
+	ClearSpeed:      10,
+	ClearTime:       30 * 60,
+	DataLossTimeout: 5 * 60,
+	StowAzimuth:     0,
+	StowElevation:   90,
+}
+
+func (p WindStowPolicy) Check() error {
+	if p.SustainedMax <= 0 || p.GustMax <= 0 {
+		return fmt.Errorf("wind thresholds must be positive")
+	}
+	if p.ClearSpeed <= 0 || p.ClearSpeed > p.SustainedMax || p.ClearSpeed > p.GustMax {
+		return fmt.Errorf("clear speed (%g) must be positive and below the stow thresholds", p.ClearSpeed)
+	}
+	if p.SustainedWindow <= 0 || p.ClearTime < 0 || !(p.DataLossTimeout >= 0) {
+		return fmt.Errorf("bad wind stow times")
+	}
+	return checkHardAzEl(p.StowAzimuth, p.StowElevation, 0, 0)
+}
+
+// WindStowState is the current state of the wind stow monitor.
+type WindStowState struct {
+	Stowed     bool      `json:"stowed"`
+	Sustained  float64   `json:"sustained"`
+	Gust       float64   `json:"gust"`
+	ClearSince time.Time `json:"clear_since,omitempty"`
+	LostSince  time.Time `json:"lost_since,omitempty"` // no wind data since
+	DataLost   bool      `json:"data_lost"`            // stowed for lack of wind data
+}
+
+type windSample struct {
+	t     time.Time
+	speed float64
+}
+
+// A WindStow watches the weather station, and stows the telescope
+// (preempting the current command) when the wind is too strong, or
+// its readings have been lost for too long. New motion commands are
+// blocked until the wind has calmed down.
+type WindStow struct {
+	weather *WeatherStation
+	preempt chan<- queuedCommand
+	alarms  *Alarms
+
+	mu      sync.Mutex
+	policy  WindStowPolicy
+	samples []windSample
+	state   WindStowState
+}
+
+func NewWindStow(weather *WeatherStation, preempt chan<- queuedCommand, alarms *Alarms) *WindStow {
+	policy := defaultWindStowPolicy
+	pos := currentConfig().StowPosition
+	policy.StowAzimuth, policy.StowElevation = pos[0], pos[1]
+	return &WindStow{
+		weather: weather,
+		preempt: preempt,
+		alarms:  alarms,
+		policy:  policy,
+	}
+}
+
+// Run monitors the wind forever.
+func (ws *WindStow) Run() {
+	var last time.Time
+	for {
+		time.Sleep(weatherPollInterval)
+		reading, err := ws.weather.Latest()
+		var stow bool
+		if err != nil {
+			log.Printf("wind stow: %v", err)
+			stow = ws.lost(time.Now())
+		} else if reading.Time.After(last) {
+			last = reading.Time
+			stow = ws.update(reading.Time, reading.WindSpeed)
+		}
+		state := ws.State()
+		ws.alarms.Set(!state.LostSince.IsZero() && ws.Policy().Enabled, "wind_data_lost", severityCritical, false,
+			"wind data lost since %s: %v", state.LostSince.UTC().Format(time.RFC3339), err)
+		ws.alarms.Set(state.Stowed, "wind_stow", severityCritical, false,
+			"wind stow (sustained %.1f m/s, gust %.1f m/s)", state.Sustained, state.Gust)
+		if stow {
+			policy := ws.Policy()
+			log.Printf("wind stow: stowing, state %+v", state)
+			ws.preempt <- queuedCommand{cmd: stowCmd{
+				az: policy.StowAzimuth,
+				el: policy.StowElevation,
+			}}
+		}
+	}
+}
+
+// lost records failing to get a wind reading at t, and returns true if
+// we need to stow, as for too strong a wind, after data_loss_timeout.
+func (ws *WindStow) lost(t time.Time) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	p := ws.policy
+	if ws.state.LostSince.IsZero() {
+		ws.state.LostSince = t
+	}
+	if !p.Enabled || p.DataLossTimeout == 0 || t.Sub(ws.state.LostSince).Seconds() < p.DataLossTimeout {
+		return false
+	}
+	ws.state.ClearSince = time.Time{}
+	if !ws.state.Stowed {
+		ws.state.Stowed, ws.state.DataLost = true, true
+		return true
+	}
+	return false
+}
+
+// update adds a wind speed reading, and returns true if we need to stow.
+func (ws *WindStow) update(t time.Time, speed float64) bool {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	p := ws.policy
+	ws.state.LostSince = time.Time{}
+
+	ws.samples = append(ws.samples, windSample{t, speed})
+	tmin := t.Add(-Seconds2Duration(p.SustainedWindow))
+	i := 0
+	for i < len(ws.samples) && ws.samples[i].t.Before(tmin) {
+		i++
+	}
+	ws.samples = ws.samples[i:]
+	sum := 0.0
+	for _, x := range ws.samples {
+		sum += x.speed
+	}
+	ws.state.Sustained = sum / float64(len(ws.samples))
+	ws.state.Gust = speed
+
+	if !p.Enabled {
+		ws.state.Stowed, ws.state.DataLost = false, false
+		ws.state.ClearSince = time.Time{}
+		return false
+	}
+
+	if ws.state.Sustained > p.SustainedMax || ws.state.Gust > p.GustMax {
+		ws.state.ClearSince = time.Time{}
+		if !ws.state.Stowed {
+			ws.state.Stowed = true
+			return true
+		}
+		return false
+	}
+
+	if ws.state.Stowed {
+		if ws.state.Sustained < p.ClearSpeed && ws.state.Gust < p.ClearSpeed {
+			if ws.state.ClearSince.IsZero() {
+				ws.state.ClearSince = t
+			} else if t.Sub(ws.state.ClearSince).Seconds() >= p.ClearTime {
+				log.Print("wind stow: cleared")
+				ws.state.Stowed, ws.state.DataLost = false, false
+				ws.state.ClearSince = time.Time{}
+			}
+		} else {
+			ws.state.ClearSince = time.Time{}
+		}
+	}
+	return false
+}
+
+// Blocked returns an error while motion commands are blocked.
+func (ws *WindStow) Blocked() error {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	if ws.state.Stowed && ws.state.DataLost {
+		return fmt.Errorf("wind stow: motion blocked (stowed for lack of wind data)")
+	}
+	if ws.state.Stowed {
+		return fmt.Errorf("wind stow: motion blocked (sustained %.1f m/s, gust %.1f m/s)", ws.state.Sustained, ws.state.Gust)
+	}
+	return nil
+}
+
+func (ws *WindStow) State() WindStowState {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.state
+}
+
+func (ws *WindStow) Policy() WindStowPolicy {
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	return ws.policy
+}
+
+func (ws *WindStow) SetPolicy(p WindStowPolicy) error {
+	err := p.Check()
+	if err != nil {
+		return err
+	}
+	ws.mu.Lock()
+	defer ws.mu.Unlock()
+	ws.policy = p
+	return nil
+}
+
+// serveWindStow serves the wind stow policy and state, or nil without a
+// weather station.
+func serveWindStow(windStow *WindStow) http.HandlerFunc {
+	return func(w http.ResponseWriter, req *http.Request) {
+		if windStow == nil {
+			err := fmt.Errorf("no weather station configured")
+			jsonResponse(w, err, http.StatusNotFound)
+			return
+		}
+		switch req.Method {
+		case "GET":
+			var response struct {
+				Policy WindStowPolicy `json:"policy"`
+				State  WindStowState  `json:"state"`
+			}
+			response.Policy = windStow.Policy()
+			response.State = windStow.State()
+			err := json.NewEncoder(w).Encode(&response)
+			if err != nil {
+				log.Print(err)
+			}
+		case "POST":
+			p := windStow.Policy() // for fields left out
+			dec := json.NewDecoder(req.Body)
+			dec.DisallowUnknownFields()
+			err := dec.Decode(&p)
+			if err == nil {
+				log.Printf("setting wind stow policy: %+v", p)
+				err = windStow.SetPolicy(p)
+			}
+			jsonResponse(w, err, http.StatusBadRequest)
+		default:
+			err := fmt.Errorf("method not GET or POST")
+			jsonResponse(w, err, http.StatusMethodNotAllowed)
+		}
+	}
+}
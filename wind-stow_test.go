@@ -0,0 +1,111 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindStowHysteresis(t *testing.T) {
+	ws := NewWindStow(nil, nil, nil)
+	p := defaultWindStowPolicy
+	p.SustainedWindow = 60
+	p.ClearTime = 120
+	if err := ws.SetPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	tick := func(i int) time.Time { return t0.Add(time.Duration(i) * 10 * time.Second) }
+
+	for i := 0; i < 10; i++ {
+		if ws.update(tick(i), 5) {
+			t.Fatalf("stowed in calm wind")
+		}
+	}
+	if ws.Blocked() != nil {
+		t.Fatal("blocked in calm wind")
+	}
+
+	// a single gust stows
+	if !ws.update(tick(10), p.GustMax+1) {
+		t.Fatal("gust didn't stow")
+	}
+	if ws.Blocked() == nil {
+		t.Fatal("not blocked after stowing")
+	}
+	// ...only once
+	if ws.update(tick(11), p.GustMax+1) {
+		t.Fatal("stowed twice")
+	}
+
+	// in between the clear and stow speeds, we stay stowed
+	i := 12
+	for ; i < 40; i++ {
+		ws.update(tick(i), p.ClearSpeed+1)
+	}
+	if ws.Blocked() == nil {
+		t.Fatal("unblocked above the clear speed")
+	}
+
+	// calm, but clear_time (12 ticks) has to pass
+	for ; i < 50; i++ {
+		ws.update(tick(i), 1)
+	}
+	if ws.Blocked() == nil {
+		t.Fatal("unblocked before clear_time")
+	}
+	for ; i < 60; i++ {
+		ws.update(tick(i), 1)
+	}
+	if err := ws.Blocked(); err != nil {
+		t.Fatalf("still blocked: %v", err)
+	}
+}
+
+func TestWindStowDataLoss(t *testing.T) {
+	ws := NewWindStow(nil, nil, nil)
+	p := defaultWindStowPolicy
+	p.DataLossTimeout = 60
+	p.ClearTime = 60
+	if err := ws.SetPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	t0 := time.Date(2023, 1, 1, 0, 0, 0, 0, time.UTC)
+	ws.update(t0, 5)
+
+	// no readings, but not for long enough to stow
+	if ws.lost(t0.Add(10*time.Second)) || ws.lost(t0.Add(60*time.Second)) || ws.Blocked() != nil {
+		t.Fatal("stowed before data_loss_timeout")
+	}
+	if ws.State().LostSince.IsZero() {
+		t.Error("data loss not recorded")
+	}
+	if !ws.lost(t0.Add(70 * time.Second)) {
+		t.Fatal("didn't stow after data_loss_timeout")
+	}
+	if err := ws.Blocked(); err == nil || !ws.State().DataLost {
+		t.Fatal("not blocked after losing the wind data")
+	}
+	if ws.lost(t0.Add(80 * time.Second)) {
+		t.Fatal("stowed twice")
+	}
+
+	// readings return: blocked until clear_time has passed
+	ws.update(t0.Add(90*time.Second), 1)
+	if !ws.State().LostSince.IsZero() || ws.Blocked() == nil {
+		t.Fatalf("got %+v", ws.State())
+	}
+	ws.update(t0.Add(160*time.Second), 1)
+	if err := ws.Blocked(); err != nil {
+		t.Fatalf("still blocked: %v", err)
+	}
+
+	// never, with no timeout
+	p.DataLossTimeout = 0
+	if err := ws.SetPolicy(p); err != nil {
+		t.Fatal(err)
+	}
+	if ws.lost(t0.Add(time.Hour)) || ws.lost(t0.Add(2*time.Hour)) {
+		t.Error("stowed with no data_loss_timeout")
+	}
+}